@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/nvanthao/velero-plugin-cnpg-restore/internal/plugin"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// rehearsalCleanupLease is the name of the Lease replicas of the cleanup-rehearsals
+// controller elect their leader with, in the scratch namespace
+const rehearsalCleanupLease = "velero-cnpg-cleanup-rehearsals"
+
+// Timings of the leader election, those client-go recommends
+const (
+	leaseDuration = 15 * time.Second
+	renewDeadline = 10 * time.Second
+	retryPeriod   = 2 * time.Second
+)
+
+// runCleanupRehearsals implements the cleanup-rehearsals subcommand, which verifies the
+// rehearsed clusters of a scratch namespace and deletes them once their TTL has passed.
+// It makes a single pass, or runs as a controller making a pass every --interval until it
+// is terminated. With --leader-elect, replicas of the controller elect a leader, which
+// alone makes passes. A single pass returns 0 when every drill was handled, 1 when some
+// could not be cleaned up and 2 on error.
+func runCleanupRehearsals(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("cleanup-rehearsals", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	namespace := flags.String("namespace", "", "scratch namespace of the rehearsals")
+	ttl := flags.Duration("ttl", time.Hour, "how long a drill is kept after it was verified")
+	maxAge := flags.Duration("max-age", 0, "how long after its creation a drill that was not verified is deleted, 0 keeps it")
+	interval := flags.Duration("interval", 0, "run as a controller making a pass at this interval, 0 makes a single pass")
+	dryRun := flags.Bool("dry-run", false, "report what would be deleted without changing anything")
+	timeout := flags.Duration("timeout", time.Minute, "timeout of the API calls of a pass")
+	leaderElect := flags.Bool("leader-elect", false, "elect a leader among the replicas of the controller, which alone makes passes")
+	healthAddress := flags.String("health-address", "", "address serving /healthz while running as a controller, such as :8081")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *namespace == "" {
+		fmt.Fprintln(stderr, "cleanup-rehearsals requires --namespace")
+		return 2
+	}
+	if *ttl < 0 || *maxAge < 0 || *interval < 0 {
+		fmt.Fprintln(stderr, "--ttl, --max-age and --interval must not be negative")
+		return 2
+	}
+	if *interval == 0 && (*leaderElect || *healthAddress != "") {
+		fmt.Fprintln(stderr, "--leader-elect and --health-address require --interval")
+		return 2
+	}
+
+	client, err := plugin.GetClient()
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to create Kubernetes client: %v\n", err)
+		return 2
+	}
+	dynamicClient, err := plugin.GetDynamicClient()
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to create dynamic client: %v\n", err)
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	options := plugin.RehearsalCleanupOptions{TTL: *ttl, MaxAge: *maxAge, DryRun: *dryRun}
+	pass := func(ctx context.Context) int {
+		return cleanupRehearsalsPass(ctx, client, dynamicClient, *namespace, options, *timeout, stdout, stderr)
+	}
+	if *interval == 0 {
+		return pass(ctx)
+	}
+
+	var watchdog *leaderelection.HealthzAdaptor
+	if *leaderElect {
+		watchdog = leaderelection.NewLeaderHealthzAdaptor(renewDeadline)
+	}
+	// A controller that cannot serve its health endpoint would be restarted by its probes
+	// anyway, so it stops right away
+	serveErr := make(chan error, 1)
+	if *healthAddress != "" {
+		server := &http.Server{Addr: *healthAddress, Handler: healthHandler(watchdog), ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				serveErr <- err
+				stop()
+			}
+		}()
+		defer server.Close()
+	}
+	exitCode := func() int {
+		select {
+		case err := <-serveErr:
+			fmt.Fprintf(stderr, "Failed to serve health endpoint: %v\n", err)
+			return 2
+		default:
+			return 0
+		}
+	}
+
+	if !*leaderElect {
+		runCleanupLoop(ctx, pass, *interval)
+		return exitCode()
+	}
+
+	identity, err := os.Hostname()
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to get hostname for leader election: %v\n", err)
+		return 2
+	}
+	// A replica that lost the lease stands for election again until it is terminated
+	for ctx.Err() == nil {
+		leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+			Lock: &resourcelock.LeaseLock{
+				LeaseMeta:  metav1.ObjectMeta{Name: rehearsalCleanupLease, Namespace: *namespace},
+				Client:     client.CoordinationV1(),
+				LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+			},
+			LeaseDuration:   leaseDuration,
+			RenewDeadline:   renewDeadline,
+			RetryPeriod:     retryPeriod,
+			ReleaseOnCancel: true,
+			WatchDog:        watchdog,
+			Name:            rehearsalCleanupLease,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(ctx context.Context) {
+					fmt.Fprintf(stderr, "%s is the leader, cleaning up rehearsals\n", identity)
+					runCleanupLoop(ctx, pass, *interval)
+				},
+				OnStoppedLeading: func() {
+					fmt.Fprintf(stderr, "%s is no longer the leader\n", identity)
+				},
+			},
+		})
+	}
+	return exitCode()
+}
+
+// runCleanupLoop makes a cleanup pass every interval until the context is done
+func runCleanupLoop(ctx context.Context, pass func(context.Context) int, interval time.Duration) {
+	for {
+		pass(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// healthHandler serves /healthz, which fails while the replica holds a lease it could not
+// renew in time when running with leader election
+func healthHandler(watchdog *leaderelection.HealthzAdaptor) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		if watchdog != nil {
+			if err := watchdog.Check(req); err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	return mux
+}
+
+// cleanupRehearsalsPass makes a single cleanup pass and prints its results
+func cleanupRehearsalsPass(ctx context.Context, client kubernetes.Interface, dynamicClient dynamic.Interface, namespace string, options plugin.RehearsalCleanupOptions, timeout time.Duration, stdout, stderr io.Writer) int {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	results, err := plugin.CleanupRehearsals(ctx, client, dynamicClient, plugin.PodProxyInstanceStatus(client), namespace, options, time.Now())
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to clean up rehearsals: %v\n", err)
+		return 2
+	}
+
+	code := 0
+	for _, result := range results {
+		printRehearsalCleanupResult(stdout, result, options)
+		if result.Error != "" {
+			code = 1
+		}
+	}
+	return code
+}
+
+// printRehearsalCleanupResult prints what a pass did with a drill, one line per drill
+func printRehearsalCleanupResult(w io.Writer, result plugin.RehearsalCleanupResult, options plugin.RehearsalCleanupOptions) {
+	deleted := "deleted"
+	if options.DryRun {
+		deleted = "would delete"
+	}
+
+	fmt.Fprintf(w, "%s/%s (restore %s): ", result.Namespace, result.Cluster, result.Restore)
+	switch result.Outcome {
+	case plugin.RehearsalVerifying:
+		fmt.Fprintf(w, "not verified yet: %s", strings.Join(result.Problems, "; "))
+	case plugin.RehearsalVerified:
+		fmt.Fprintf(w, "verified at %s, kept until %s", result.VerifiedAt.Format(time.RFC3339), result.VerifiedAt.Add(options.TTL).Format(time.RFC3339))
+	case plugin.RehearsalDeleted:
+		fmt.Fprintf(w, "verified at %s, %s %s", result.VerifiedAt.Format(time.RFC3339), deleted, strings.Join(result.Deleted, ", "))
+	case plugin.RehearsalExpired:
+		fmt.Fprintf(w, "not verified within %s (%s), %s %s", options.MaxAge, strings.Join(result.Problems, "; "), deleted, strings.Join(result.Deleted, ", "))
+	}
+	if result.Error != "" {
+		fmt.Fprintf(w, ", failed: %s", result.Error)
+	}
+	fmt.Fprintln(w)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/nvanthao/velero-plugin-cnpg-restore/internal/plugin"
+	"sigs.k8s.io/yaml"
+)
+
+// runDiagnostics implements the diagnostics subcommand, which writes the plugin's view of
+// a namespace as a single JSON or YAML bundle for support cases. It returns 0 when the
+// bundle is complete, 1 when parts of it could not be collected and 2 on failure.
+func runDiagnostics(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("diagnostics", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	namespace := flags.String("namespace", "", "namespace to collect")
+	output := flags.String("output", "yaml", "output format, yaml or json")
+	timeout := flags.Duration("timeout", time.Minute, "timeout of the API calls")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *namespace == "" {
+		fmt.Fprintln(stderr, "diagnostics requires --namespace")
+		return 2
+	}
+	if *output != "yaml" && *output != "json" {
+		fmt.Fprintf(stderr, "unknown output format %q\n", *output)
+		return 2
+	}
+
+	client, err := plugin.GetClient()
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to create Kubernetes client: %v\n", err)
+		return 2
+	}
+	dynamicClient, err := plugin.GetDynamicClient()
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to create dynamic client: %v\n", err)
+		return 2
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	diagnostics := plugin.CollectDiagnostics(ctx, client, dynamicClient, *namespace, time.Now())
+
+	raw, err := json.MarshalIndent(diagnostics, "", "  ")
+	if err == nil && *output == "yaml" {
+		raw, err = yaml.JSONToYAML(raw)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to encode diagnostics: %v\n", err)
+		return 2
+	}
+	if *output == "json" {
+		raw = append(raw, '\n')
+	}
+	if _, err := stdout.Write(raw); err != nil {
+		fmt.Fprintf(stderr, "Failed to write diagnostics: %v\n", err)
+		return 2
+	}
+
+	for _, problem := range diagnostics.Errors {
+		fmt.Fprintf(stderr, "Incomplete diagnostics: %s\n", problem)
+	}
+	if len(diagnostics.Errors) > 0 {
+		return 1
+	}
+	return 0
+}
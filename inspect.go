@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/nvanthao/velero-plugin-cnpg-restore/internal/plugin"
+)
+
+// runInspectBackup implements the inspect-backup subcommand, which lists the CNPG clusters
+// of a downloaded Velero backup archive and whether the restore action can recover them.
+// It returns 0 when every cluster is restorable, 1 when some are not and 2 when the
+// archive could not be read.
+func runInspectBackup(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("inspect-backup", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	output := flags.String("output", "text", "output format, text or json")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(stderr, "inspect-backup requires the path of a backup archive, as written by velero backup download")
+		return 2
+	}
+	if *output != "text" && *output != "json" {
+		fmt.Fprintf(stderr, "unknown output format %q\n", *output)
+		return 2
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to open backup archive: %v\n", err)
+		return 2
+	}
+	defer file.Close()
+
+	clusters, err := plugin.InspectBackupArchive(file)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to inspect backup archive: %v\n", err)
+		return 2
+	}
+
+	if *output == "json" {
+		if clusters == nil {
+			clusters = []*plugin.ClusterInspection{}
+		}
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(clusters); err != nil {
+			fmt.Fprintf(stderr, "Failed to encode result: %v\n", err)
+			return 2
+		}
+	} else {
+		printInspection(stdout, clusters)
+	}
+
+	for _, cluster := range clusters {
+		if !cluster.Restorable {
+			return 1
+		}
+	}
+	return 0
+}
+
+// printInspection prints the clusters of a backup archive for humans
+func printInspection(w io.Writer, clusters []*plugin.ClusterInspection) {
+	if len(clusters) == 0 {
+		fmt.Fprintln(w, "No CNPG clusters found in the backup")
+		return
+	}
+
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "NAMESPACE\tCLUSTER\tMETHOD\tSERVER NAME\tBACKUP ID\tSCHEDULE\tSIZE\tRESTORABLE")
+	for _, cluster := range clusters {
+		size := ""
+		if cluster.DatabaseSize > 0 {
+			size = plugin.FormatBytes(cluster.DatabaseSize)
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%t\n", cluster.Namespace, cluster.Name, orNone(cluster.BackupMethod), orNone(cluster.ServerName), orNone(cluster.BackupID), orNone(cluster.Schedule), orNone(size), cluster.Restorable)
+	}
+	table.Flush()
+
+	for _, cluster := range clusters {
+		notes := append(append([]string{}, cluster.Problems...), cluster.Warnings...)
+		if len(notes) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\n%s/%s:\n  - %s\n", cluster.Namespace, cluster.Name, strings.Join(notes, "\n  - "))
+	}
+}
+
+// orNone returns value, or "-" when it is empty
+func orNone(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
@@ -0,0 +1,145 @@
+package plugin
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// archiveLocation is where a cluster archives WAL: an object store and the serverName
+// directory within it
+type archiveLocation struct {
+	store      string
+	serverName string
+}
+
+// String formats the location for messages
+func (l archiveLocation) String() string {
+	return l.serverName + " in " + l.store
+}
+
+// archiveLocations returns the locations a cluster archives WAL to, through the in-tree
+// object store and through barman-cloud plugins. The serverName defaults to the cluster
+// name, as it does in CNPG.
+func archiveLocations(cluster map[string]interface{}) []archiveLocation {
+	obj := &unstructured.Unstructured{Object: cluster}
+	specMap, err := getSpecMap(cluster)
+	if err != nil {
+		return nil
+	}
+
+	serverNameOf := func(params map[string]interface{}) string {
+		if serverName, _ := params["serverName"].(string); serverName != "" {
+			return serverName
+		}
+		return obj.GetName()
+	}
+
+	var locations []archiveLocation
+	if objectStore, found, _ := nestedMapNoCopy(specMap, "backup", "barmanObjectStore"); found {
+		destinationPath, _ := objectStore["destinationPath"].(string)
+		locations = append(locations, archiveLocation{store: destinationPath, serverName: serverNameOf(objectStore)})
+	}
+	for _, plugin := range sliceOfMaps(specMap["plugins"]) {
+		params, _ := plugin["parameters"].(map[string]interface{})
+		barmanObjectName, _ := params["barmanObjectName"].(string)
+		if barmanObjectName == "" {
+			continue
+		}
+		locations = append(locations, archiveLocation{store: "ObjectStore " + barmanObjectName, serverName: serverNameOf(params)})
+	}
+
+	return locations
+}
+
+// archiveConflicts lists the live clusters in the namespace of the restored cluster that
+// archive WAL to one of its locations. Two clusters archiving to the same location
+// overwrite each other's WAL and corrupt the archive of both.
+func (p *RestorePluginV2) archiveConflicts(itemContent map[string]interface{}, namespace, clusterName string) ([]string, error) {
+	locations := archiveLocations(itemContent)
+	if len(locations) == 0 {
+		return nil, nil
+	}
+
+	dynamicClient, err := p.getDynamicClient()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create dynamic client")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	clusters, err := dynamicClient.Resource(cnpgClusterGVR).Namespace(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(classifyAPIError(err), "failed to list clusters in namespace %s", namespace)
+	}
+
+	var conflicts []string
+	for _, live := range clusters.Items {
+		if live.GetName() == clusterName {
+			continue
+		}
+		for _, liveLocation := range archiveLocations(live.Object) {
+			for _, location := range locations {
+				if liveLocation == location {
+					conflicts = append(conflicts, live.GetName()+" ("+location.String()+")")
+				}
+			}
+		}
+	}
+	sort.Strings(conflicts)
+
+	return conflicts, nil
+}
+
+// resolveArchiveConflicts fails the restore or renames the archive serverName of the
+// restored cluster, per policy, when a live cluster in its namespace archives to the same
+// location, naming the new serverName with the configured strategy. When the live clusters
+// cannot be listed, the restore fails with the fail policy, and the check is skipped with a
+// restore warning with the rename policy.
+func (p *RestorePluginV2) resolveArchiveConflicts(itemContent map[string]interface{}, restore *v1.Restore, namespace, clusterName, policy string, strategy *ServerNameStrategyConfig, warnings *restoreWarnings) error {
+	conflicts, err := p.archiveConflicts(itemContent, namespace, clusterName)
+	if err != nil {
+		if policy != ArchiveConflictRename {
+			return errors.Wrapf(err, "cannot check whether cluster %s/%s would archive WAL to the same location as a live cluster (archiveConflictPolicy is %s)",
+				namespace, clusterName, ArchiveConflictFail)
+		}
+		warnings.Warnf("Skipping archive conflict check: %v", err)
+		return nil
+	}
+	if len(conflicts) == 0 {
+		return nil
+	}
+
+	if policy != ArchiveConflictRename {
+		return errors.Errorf("cluster %s/%s would archive WAL to the same location as live cluster(s) %s; set archiveConflictPolicy to %s to give it a new serverName",
+			namespace, clusterName, strings.Join(conflicts, ", "), ArchiveConflictRename)
+	}
+
+	newServerName, err := p.nextServerName(itemContent, restore, strategy)
+	if err != nil {
+		return errors.Wrap(err, "failed to name new serverName")
+	}
+	specMap, err := getSpecMap(itemContent)
+	if err != nil {
+		return err
+	}
+	// Set the serverName even where it was defaulted to the cluster name
+	for _, plugin := range sliceOfMaps(specMap["plugins"]) {
+		if params, ok := plugin["parameters"].(map[string]interface{}); ok && params["barmanObjectName"] != nil {
+			params["serverName"] = newServerName
+		}
+	}
+	if err := p.updateBarmanObjectStoreServerName(itemContent, newServerName); err != nil {
+		return errors.Wrap(err, "failed to update barmanObjectStore serverName")
+	}
+	warnings.Warnf("Live cluster(s) %s archive WAL to the same location, archiving to serverName %s instead", strings.Join(conflicts, ", "), newServerName)
+
+	return nil
+}
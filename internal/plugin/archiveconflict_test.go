@@ -0,0 +1,144 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestArchiveLocations(t *testing.T) {
+	cluster := createMockArchivingCluster("pg", "default", "pg-sn", nil)
+	assert.Equal(t, []archiveLocation{
+		{store: "s3://backups/", serverName: "pg-sn"},
+		{store: "ObjectStore store", serverName: "pg-sn"},
+	}, archiveLocations(cluster.Object))
+
+	// serverName defaults to the cluster name
+	unstructured.RemoveNestedField(cluster.Object, "spec", "backup", "barmanObjectStore", "serverName")
+	assert.Equal(t, archiveLocation{store: "s3://backups/", serverName: "pg"}, archiveLocations(cluster.Object)[0])
+
+	// Plugins without an object store do not archive
+	noArchive := &unstructured.Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "pg"},
+		"spec": map[string]interface{}{
+			"plugins": []interface{}{map[string]interface{}{"name": "other"}},
+		},
+	}}
+	assert.Empty(t, archiveLocations(noArchive.Object))
+}
+
+func TestResolveArchiveConflicts(t *testing.T) {
+	otherStore := createMockArchivingCluster("pg-old", "default", "pg", nil)
+	unstructured.SetNestedField(otherStore.Object, "s3://other/", "spec", "backup", "barmanObjectStore", "destinationPath")
+	unstructured.SetNestedSlice(otherStore.Object, []interface{}{
+		map[string]interface{}{
+			"name":       "barman-cloud.cloudnative-pg.io",
+			"parameters": map[string]interface{}{"barmanObjectName": "other-store", "serverName": "pg"},
+		},
+	}, "spec", "plugins")
+
+	tests := []struct {
+		name           string
+		item           *unstructured.Unstructured
+		live           []runtime.Object
+		policy         string
+		listErr        error
+		expectedError  string
+		expectRenamed  bool
+		expectWarnings int
+	}{
+		{
+			name: "no live clusters",
+			item: createMockArchivingCluster("pg-new", "default", "pg", nil),
+		},
+		{
+			name: "live cluster archiving elsewhere",
+			item: createMockArchivingCluster("pg-new", "default", "pg", nil),
+			live: []runtime.Object{createMockArchivingCluster("other", "default", "other", nil)},
+		},
+		{
+			name: "live cluster in another object store",
+			item: createMockArchivingCluster("pg-new", "default", "pg", nil),
+			live: []runtime.Object{otherStore},
+		},
+		{
+			name: "live cluster in another namespace",
+			item: createMockArchivingCluster("pg-new", "default", "pg", nil),
+			live: []runtime.Object{createMockArchivingCluster("pg-old", "other", "pg", nil)},
+		},
+		{
+			name: "cluster updated in place",
+			item: createMockArchivingCluster("pg", "default", "pg", nil),
+			live: []runtime.Object{createMockArchivingCluster("pg", "default", "pg", nil)},
+		},
+		{
+			name:          "conflict fails by default",
+			item:          createMockArchivingCluster("pg-new", "default", "pg", nil),
+			live:          []runtime.Object{createMockArchivingCluster("pg-old", "default", "pg", nil)},
+			expectedError: "pg-old (pg in ObjectStore store), pg-old (pg in s3://backups/)",
+		},
+		{
+			name:          "conflict with defaulted serverName",
+			item:          createMockArchivingCluster("pg", "default", "", nil),
+			live:          []runtime.Object{createMockArchivingCluster("pg-old", "default", "pg", nil)},
+			policy:        ArchiveConflictFail,
+			expectedError: "live cluster(s) pg-old",
+		},
+		{
+			name:           "conflict renames",
+			item:           createMockArchivingCluster("pg-new", "default", "pg", nil),
+			live:           []runtime.Object{createMockArchivingCluster("pg-old", "default", "pg", nil)},
+			policy:         ArchiveConflictRename,
+			expectRenamed:  true,
+			expectWarnings: 1,
+		},
+		{
+			name:          "list failure fails by default",
+			item:          createMockArchivingCluster("pg-new", "default", "pg", nil),
+			listErr:       errors.New("connection refused"),
+			expectedError: "cannot check whether cluster default/pg-new would archive WAL to the same location as a live cluster (archiveConflictPolicy is fail)",
+		},
+		{
+			name:           "list failure is a warning when renaming",
+			item:           createMockArchivingCluster("pg-new", "default", "pg", nil),
+			policy:         ArchiveConflictRename,
+			listErr:        errors.New("connection refused"),
+			expectWarnings: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dynamicClient := newFakeDynamicClient(tt.live...)
+			if tt.listErr != nil {
+				dynamicClient.PrependReactor("list", "clusters", func(k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, tt.listErr
+				})
+			}
+			plugin := &RestorePluginV2{log: logrus.New(), dynamicClient: dynamicClient}
+			warnings := &restoreWarnings{log: logrus.New()}
+
+			err := plugin.resolveArchiveConflicts(tt.item.Object, nil, "default", tt.item.GetName(), tt.policy, nil, warnings)
+			if tt.expectedError != "" {
+				assert.ErrorContains(t, err, tt.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Len(t, warnings.messages, tt.expectWarnings)
+
+			for _, location := range archiveLocations(tt.item.Object) {
+				if tt.expectRenamed {
+					assert.Contains(t, location.serverName, "pg-new-")
+				} else {
+					assert.NotContains(t, location.serverName, "pg-new-")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package plugin
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+)
+
+// backupLists is shared by all actions of the plugin process, so the clusters of one
+// namespace reuse the Backups listed for the first of them
+var backupLists = &backupListCache{}
+
+// backupListCache holds the CNPG Backups listed per namespace during one Velero backup.
+// Every cluster in a namespace pins its backup from the same list, which is taken once per
+// Velero backup rather than once per cluster. Starting another Velero backup drops the
+// lists, so a scheduled backup always pins the backups completed since the last one.
+type backupListCache struct {
+	mu        sync.Mutex
+	backupUID types.UID
+	lists     map[string]*namespaceBackups
+}
+
+// namespaceBackups are the Backups of a namespace. The mutex is held while listing, so
+// clusters of the namespace backed up in parallel wait for one list call.
+type namespaceBackups struct {
+	mu     sync.Mutex
+	listed bool
+	items  []unstructured.Unstructured
+}
+
+// veleroBackupUID returns the UID of a Velero backup, or "" without one
+func veleroBackupUID(backup *v1.Backup) types.UID {
+	if backup == nil {
+		return ""
+	}
+	return backup.UID
+}
+
+// namespace returns the entry of a namespace for a Velero backup
+func (c *backupListCache) namespace(backupUID types.UID, namespace string) *namespaceBackups {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.backupUID != backupUID || c.lists == nil {
+		c.backupUID = backupUID
+		c.lists = map[string]*namespaceBackups{}
+	}
+	entry, found := c.lists[namespace]
+	if !found {
+		entry = &namespaceBackups{}
+		c.lists[namespace] = entry
+	}
+	return entry
+}
+
+// list returns the Backups of a namespace, listing them with the Backup list limiter on the
+// first call for the namespace during the Velero backup. Failed lists are not kept. Without
+// a Velero backup UID every call lists. The returned items are shared and must not be
+// modified.
+func (c *backupListCache) list(ctx context.Context, dynamicClient dynamic.Interface, backupUID types.UID, namespace string) ([]unstructured.Unstructured, error) {
+	if backupUID == "" {
+		return listNamespaceBackups(ctx, dynamicClient, namespace)
+	}
+
+	entry := c.namespace(backupUID, namespace)
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	if entry.listed {
+		return entry.items, nil
+	}
+
+	items, err := listNamespaceBackups(ctx, dynamicClient, namespace)
+	if err != nil {
+		return nil, err
+	}
+	entry.items = items
+	entry.listed = true
+	return items, nil
+}
+
+// listNamespaceBackups lists the CNPG Backups of a namespace with the Backup list limiter
+func listNamespaceBackups(ctx context.Context, dynamicClient dynamic.Interface, namespace string) ([]unstructured.Unstructured, error) {
+	release, err := backupListLimiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	backupList, err := dynamicClient.Resource(cnpgBackupGVR).Namespace(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrap(classifyAPIError(err), "failed to list CNPG backup resources")
+	}
+	return backupList.Items, nil
+}
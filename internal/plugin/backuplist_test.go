@@ -0,0 +1,59 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/dynamic/fake"
+)
+
+// countBackupLists returns the number of Backup list calls made through a fake client
+func countBackupLists(dynamicClient *fake.FakeDynamicClient) int {
+	count := 0
+	for _, action := range dynamicClient.Actions() {
+		if action.GetVerb() == "list" && action.GetResource() == cnpgBackupGVR {
+			count++
+		}
+	}
+	return count
+}
+
+func TestBackupListCache(t *testing.T) {
+	dynamicClient := newFakeDynamicClient(
+		createMockBackup("pg-1", "app", "pg", "completed", "1", time.Now()),
+		createMockBackup("other-1", "app", "other", "completed", "2", time.Now()),
+		createMockBackup("pg-1", "db", "pg", "completed", "3", time.Now()),
+	)
+	cache := &backupListCache{}
+	ctx := context.Background()
+
+	items, err := cache.list(ctx, dynamicClient, "backup-1", "app")
+	require.NoError(t, err)
+	assert.Len(t, items, 2)
+
+	// Clusters of the same namespace reuse the list during a Velero backup
+	_, err = cache.list(ctx, dynamicClient, "backup-1", "app")
+	require.NoError(t, err)
+	assert.Equal(t, 1, countBackupLists(dynamicClient))
+
+	// Other namespaces are listed on their own
+	items, err = cache.list(ctx, dynamicClient, "backup-1", "db")
+	require.NoError(t, err)
+	assert.Len(t, items, 1)
+	assert.Equal(t, 2, countBackupLists(dynamicClient))
+
+	// The next Velero backup lists again
+	_, err = cache.list(ctx, dynamicClient, "backup-2", "app")
+	require.NoError(t, err)
+	assert.Equal(t, 3, countBackupLists(dynamicClient))
+
+	// Without a Velero backup nothing is kept
+	_, err = cache.list(ctx, dynamicClient, "", "app")
+	require.NoError(t, err)
+	_, err = cache.list(ctx, dynamicClient, "", "app")
+	require.NoError(t, err)
+	assert.Equal(t, 5, countBackupLists(dynamicClient))
+}
@@ -0,0 +1,390 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/label"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	veleroutil "github.com/vmware-tanzu/velero/pkg/util"
+	"github.com/vmware-tanzu/velero/pkg/util/boolptr"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	// AnnotationBackupMethod is the annotation key used to store how the cluster is backed up
+	AnnotationBackupMethod = "velero-cnpg/backup-method"
+
+	// AnnotationVolumeSnapshots is the annotation key used to store the VolumeSnapshots
+	// of the pinned volumeSnapshot backup
+	AnnotationVolumeSnapshots = "velero-cnpg/volume-snapshots"
+)
+
+const (
+	// BackupMethodPlugin is an object-store backup through the barman-cloud CNPG-I plugin
+	BackupMethodPlugin = "plugin"
+
+	// BackupMethodBarmanObjectStore is an object-store backup through the in-tree barmanObjectStore
+	BackupMethodBarmanObjectStore = "barmanObjectStore"
+
+	// BackupMethodVolumeSnapshot is a Kubernetes VolumeSnapshot backup
+	BackupMethodVolumeSnapshot = "volumeSnapshot"
+)
+
+// VolumeSnapshots lists the VolumeSnapshots a volumeSnapshot backup consists of
+type VolumeSnapshots struct {
+	// Storage is the PGDATA snapshot
+	Storage string `json:"storage"`
+
+	// WalStorage is the WAL volume snapshot, if the cluster has a separate WAL volume
+	WalStorage string `json:"walStorage,omitempty"`
+
+	// TablespaceStorage maps tablespace names to their snapshots
+	TablespaceStorage map[string]string `json:"tablespaceStorage,omitempty"`
+}
+
+// detectBackupMethod returns the backup method configured in the cluster spec.
+// Object-store methods take precedence, since they also provide WAL archiving
+// for clusters that combine them with volume snapshots.
+func detectBackupMethod(itemContent map[string]interface{}, pluginServerName string) string {
+	if pluginServerName != "" {
+		return BackupMethodPlugin
+	}
+
+	if _, found, _ := unstructured.NestedMap(itemContent, "spec", "backup", "barmanObjectStore"); found {
+		return BackupMethodBarmanObjectStore
+	}
+
+	if _, found, _ := unstructured.NestedMap(itemContent, "spec", "backup", "volumeSnapshot"); found {
+		return BackupMethodVolumeSnapshot
+	}
+
+	return ""
+}
+
+// barmanObjectStoreServerName returns the serverName used by the in-tree barmanObjectStore,
+// which defaults to the cluster name
+func barmanObjectStoreServerName(itemContent map[string]interface{}) string {
+	if serverName, found, _ := unstructured.NestedString(itemContent, "spec", "backup", "barmanObjectStore", "serverName"); found && serverName != "" {
+		return serverName
+	}
+
+	name, _, _ := unstructured.NestedString(itemContent, "metadata", "name")
+	return name
+}
+
+// backupMethodOf returns the method a CNPG Backup CR was taken with
+func backupMethodOf(backup *unstructured.Unstructured) string {
+	if method, found, _ := unstructured.NestedString(backup.Object, "status", "method"); found && method != "" {
+		return method
+	}
+
+	method, _, _ := unstructured.NestedString(backup.Object, "spec", "method")
+	return method
+}
+
+// volumeSnapshotsOf returns the VolumeSnapshots recorded in a volumeSnapshot Backup CR status
+func volumeSnapshotsOf(backup *unstructured.Unstructured) (*VolumeSnapshots, error) {
+	elements, found, err := unstructured.NestedSlice(backup.Object, "status", "backupSnapshotStatus", "elements")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get backupSnapshotStatus elements")
+	}
+	if !found {
+		return nil, errors.New("backupSnapshotStatus elements not found in backup status")
+	}
+
+	snapshots := &VolumeSnapshots{}
+	for _, element := range elements {
+		elementMap, ok := element.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		name, _ := elementMap["name"].(string)
+		elementType, _ := elementMap["type"].(string)
+		switch elementType {
+		case "PG_DATA":
+			snapshots.Storage = name
+		case "PG_WAL":
+			snapshots.WalStorage = name
+		case "PG_TABLESPACE":
+			tablespace, _ := elementMap["tablespaceName"].(string)
+			if snapshots.TablespaceStorage == nil {
+				snapshots.TablespaceStorage = map[string]string{}
+			}
+			snapshots.TablespaceStorage[tablespace] = name
+		}
+	}
+
+	if snapshots.Storage == "" {
+		return nil, errors.New("no PG_DATA snapshot found in backup status")
+	}
+
+	return snapshots, nil
+}
+
+// encodeVolumeSnapshots serializes VolumeSnapshots for the annotation
+func encodeVolumeSnapshots(snapshots *VolumeSnapshots) (string, error) {
+	raw, err := json.Marshal(snapshots)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to encode volume snapshots")
+	}
+	return string(raw), nil
+}
+
+// decodeVolumeSnapshots parses the VolumeSnapshots annotation
+func decodeVolumeSnapshots(value string) (*VolumeSnapshots, error) {
+	snapshots := &VolumeSnapshots{}
+	if err := json.Unmarshal([]byte(value), snapshots); err != nil {
+		return nil, errors.Wrap(err, "failed to decode volume snapshots")
+	}
+	if snapshots.Storage == "" {
+		return nil, errors.New("volume snapshots annotation has no storage snapshot")
+	}
+	return snapshots, nil
+}
+
+// mapRestoredVolumeSnapshots returns the recorded VolumeSnapshots under the names Velero
+// restores them with. Velero's CSI restore action renames each VolumeSnapshot to the
+// SHA-256 of the restore UID and its original name, and the copies keep the
+// velero.io/restore-name label of the restore. Snapshots the restore has not brought back
+// yet are returned as additional items of the cluster, so they map to that name as well,
+// unless one of the original name exists in the namespace or the restore skips volumes.
+func (p *RestorePluginV2) mapRestoredVolumeSnapshots(snapshots *VolumeSnapshots, restore *v1.Restore, namespace string, warnings *restoreWarnings) *VolumeSnapshots {
+	if restore == nil {
+		return snapshots
+	}
+
+	dynamicClient, err := p.getDynamicClient()
+	if err != nil {
+		warnings.Warnf("Failed to create dynamic client, recovering from the VolumeSnapshot names of the backup: %v", err)
+		return snapshots
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	list, err := dynamicClient.Resource(volumeSnapshotGVR).Namespace(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		warnings.Warnf("Failed to list VolumeSnapshots, recovering from the VolumeSnapshot names of the backup: %v", classifyAPIError(err))
+		return snapshots
+	}
+
+	restoreName := label.GetValidName(restore.Name)
+	restored := map[string]bool{}
+	existing := map[string]bool{}
+	for _, snapshot := range list.Items {
+		existing[snapshot.GetName()] = true
+		if snapshot.GetLabels()[v1.RestoreNameLabel] == restoreName {
+			restored[snapshot.GetName()] = true
+		}
+	}
+
+	resolve := func(name string) string {
+		generated := veleroutil.GenerateSha256FromRestoreUIDAndVsName(string(restore.UID), name)
+		if restored[generated] {
+			p.log.Infof("VolumeSnapshot %s was restored as %s", name, generated)
+			return generated
+		}
+		if existing[name] {
+			return name
+		}
+		if boolptr.IsSetToFalse(restore.Spec.RestorePVs) {
+			warnings.Warnf("VolumeSnapshot %s does not exist in namespace %s and the restore does not restore volumes, recovery waits for it", name, namespace)
+			return name
+		}
+		p.log.Infof("VolumeSnapshot %s is restored as %s before the cluster", name, generated)
+		return generated
+	}
+
+	mapped := &VolumeSnapshots{
+		Storage: resolve(snapshots.Storage),
+	}
+	if snapshots.WalStorage != "" {
+		mapped.WalStorage = resolve(snapshots.WalStorage)
+	}
+	for tablespace, name := range snapshots.TablespaceStorage {
+		if mapped.TablespaceStorage == nil {
+			mapped.TablespaceStorage = map[string]string{}
+		}
+		mapped.TablespaceStorage[tablespace] = resolve(name)
+	}
+	return mapped
+}
+
+// volumeSnapshotItems returns the VolumeSnapshots of the backup that the cluster recovers
+// from under their restored names, as additional items for Velero to restore before the
+// cluster. Snapshots used under their original name are already in place.
+func volumeSnapshotItems(recorded, mapped *VolumeSnapshots, namespace string) []velero.ResourceIdentifier {
+	var items []velero.ResourceIdentifier
+	add := func(original, name string) {
+		if original != "" && name != original {
+			items = append(items, velero.ResourceIdentifier{
+				GroupResource: volumeSnapshotGVR.GroupResource(),
+				Namespace:     namespace,
+				Name:          original,
+			})
+		}
+	}
+
+	add(recorded.Storage, mapped.Storage)
+	add(recorded.WalStorage, mapped.WalStorage)
+	tablespaces := make([]string, 0, len(recorded.TablespaceStorage))
+	for tablespace := range recorded.TablespaceStorage {
+		tablespaces = append(tablespaces, tablespace)
+	}
+	sort.Strings(tablespaces)
+	for _, tablespace := range tablespaces {
+		add(recorded.TablespaceStorage[tablespace], mapped.TablespaceStorage[tablespace])
+	}
+	return items
+}
+
+// volumeSnapshotsReady reports whether the VolumeSnapshots returned as additional items
+// of a cluster were restored and are ready to use. Items are looked up under the name and
+// namespace Velero restored them with. A snapshot that failed is reported as an error.
+func (p *RestorePluginV2) volumeSnapshotsReady(items []velero.ResourceIdentifier, restore *v1.Restore) (bool, error) {
+	dynamicClient, err := p.getDynamicClient()
+	if err != nil {
+		return false, errors.Wrap(err, "failed to create dynamic client")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	for _, item := range items {
+		if item.GroupResource != volumeSnapshotGVR.GroupResource() {
+			continue
+		}
+
+		namespace := restoredNamespace(restore, item.Namespace)
+		name := veleroutil.GenerateSha256FromRestoreUIDAndVsName(string(restore.UID), item.Name)
+
+		snapshot, err := dynamicClient.Resource(volumeSnapshotGVR).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			p.log.Infof("Waiting for VolumeSnapshot %s to be restored as %s/%s", item.Name, namespace, name)
+			return false, nil
+		}
+		if err != nil {
+			return false, errors.Wrapf(classifyAPIError(err), "failed to get VolumeSnapshot %s/%s", namespace, name)
+		}
+
+		if message, found, _ := unstructured.NestedString(snapshot.Object, "status", "error", "message"); found && message != "" {
+			return false, errors.Errorf("restored VolumeSnapshot %s/%s failed: %s", namespace, name, message)
+		}
+		if ready, _, _ := unstructured.NestedBool(snapshot.Object, "status", "readyToUse"); !ready {
+			p.log.Infof("Waiting for VolumeSnapshot %s/%s to be ready", namespace, name)
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// configureExternalClusterObjectStore adds an externalClusters entry reading from the
+// in-tree barmanObjectStore of the backed-up cluster
+func (p *RestorePluginV2) configureExternalClusterObjectStore(itemContent map[string]interface{}, serverName string) error {
+	specMap, err := getSpecMap(itemContent)
+	if err != nil {
+		return err
+	}
+
+	objectStore, found, err := unstructured.NestedMap(specMap, "backup", "barmanObjectStore")
+	if err != nil {
+		return errors.Wrap(err, "failed to get backup.barmanObjectStore")
+	}
+	if !found {
+		return specShapeError("backup.barmanObjectStore not found in spec")
+	}
+
+	// The copy reads from the original archive, so it must keep the original serverName
+	objectStore["serverName"] = serverName
+
+	specMap["externalClusters"] = append([]interface{}{
+		map[string]interface{}{
+			"name":              recoverySourceName,
+			"barmanObjectStore": objectStore,
+		},
+	}, streamingSources(specMap)...)
+
+	return nil
+}
+
+// updateBarmanObjectStoreServerName updates spec.backup.barmanObjectStore.serverName so the
+// restored cluster archives under its own identity
+func (p *RestorePluginV2) updateBarmanObjectStoreServerName(itemContent map[string]interface{}, newServerName string) error {
+	specMap, err := getSpecMap(itemContent)
+	if err != nil {
+		return err
+	}
+
+	objectStore, found, err := unstructured.NestedFieldNoCopy(specMap, "backup", "barmanObjectStore")
+	if err != nil {
+		return errors.Wrap(err, "failed to get backup.barmanObjectStore")
+	}
+	if !found {
+		return nil
+	}
+
+	objectStoreMap, ok := objectStore.(map[string]interface{})
+	if !ok {
+		return specShapeError("backup.barmanObjectStore is not a map")
+	}
+
+	objectStoreMap["serverName"] = newServerName
+	p.log.Infof("Updated spec.backup.barmanObjectStore.serverName to: %s", newServerName)
+
+	return nil
+}
+
+// configureBootstrapVolumeSnapshots updates bootstrap configuration to recover from
+// VolumeSnapshots. When a recovery source is given, WAL is replayed from it as well.
+func (p *RestorePluginV2) configureBootstrapVolumeSnapshots(itemContent map[string]interface{}, snapshots *VolumeSnapshots, source string) error {
+	specMap, err := getSpecMap(itemContent)
+	if err != nil {
+		return err
+	}
+
+	volumeSnapshots := map[string]interface{}{
+		"storage": snapshotReference(snapshots.Storage),
+	}
+	if snapshots.WalStorage != "" {
+		volumeSnapshots["walStorage"] = snapshotReference(snapshots.WalStorage)
+	}
+	if len(snapshots.TablespaceStorage) > 0 {
+		tablespaces := make(map[string]interface{}, len(snapshots.TablespaceStorage))
+		for tablespace, name := range snapshots.TablespaceStorage {
+			tablespaces[tablespace] = snapshotReference(name)
+		}
+		volumeSnapshots["tablespaceStorage"] = tablespaces
+	}
+
+	recovery := map[string]interface{}{
+		"volumeSnapshots": volumeSnapshots,
+	}
+	if source != "" {
+		recovery["source"] = source
+	}
+
+	// Replace bootstrap configuration with snapshot recovery
+	specMap["bootstrap"] = map[string]interface{}{
+		"recovery": recovery,
+	}
+
+	return nil
+}
+
+// snapshotReference returns a TypedLocalObjectReference to a VolumeSnapshot
+func snapshotReference(name string) map[string]interface{} {
+	return map[string]interface{}{
+		"name":     name,
+		"kind":     "VolumeSnapshot",
+		"apiGroup": "snapshot.storage.k8s.io",
+	}
+}
@@ -0,0 +1,439 @@
+package plugin
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	veleroutil "github.com/vmware-tanzu/velero/pkg/util"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// createMockSnapshotBackup creates a completed volumeSnapshot CNPG Backup resource
+func createMockSnapshotBackup(name, namespace, clusterName, backupID string, creationTime time.Time) *unstructured.Unstructured {
+	backup := createMockBackup(name, namespace, clusterName, "completed", backupID, creationTime)
+	backup.Object["spec"].(map[string]interface{})["method"] = BackupMethodVolumeSnapshot
+	status := backup.Object["status"].(map[string]interface{})
+	status["method"] = BackupMethodVolumeSnapshot
+	status["backupSnapshotStatus"] = map[string]interface{}{
+		"elements": []interface{}{
+			map[string]interface{}{"name": name + "-data", "type": "PG_DATA"},
+			map[string]interface{}{"name": name + "-wal", "type": "PG_WAL"},
+			map[string]interface{}{"name": name + "-tbs", "type": "PG_TABLESPACE", "tablespaceName": "archive"},
+		},
+	}
+	return backup
+}
+
+func TestDetectBackupMethod(t *testing.T) {
+	tests := []struct {
+		name             string
+		itemContent      map[string]interface{}
+		pluginServerName string
+		expectedMethod   string
+	}{
+		{
+			name:             "barman plugin",
+			itemContent:      map[string]interface{}{"spec": map[string]interface{}{}},
+			pluginServerName: "server-1",
+			expectedMethod:   BackupMethodPlugin,
+		},
+		{
+			name: "in-tree object store",
+			itemContent: map[string]interface{}{
+				"spec": map[string]interface{}{
+					"backup": map[string]interface{}{
+						"barmanObjectStore": map[string]interface{}{"destinationPath": "s3://bucket"},
+						"volumeSnapshot":    map[string]interface{}{"className": "csi"},
+					},
+				},
+			},
+			expectedMethod: BackupMethodBarmanObjectStore,
+		},
+		{
+			name: "volume snapshots only",
+			itemContent: map[string]interface{}{
+				"spec": map[string]interface{}{
+					"backup": map[string]interface{}{
+						"volumeSnapshot": map[string]interface{}{"className": "csi"},
+					},
+				},
+			},
+			expectedMethod: BackupMethodVolumeSnapshot,
+		},
+		{
+			name:           "no backup configured",
+			itemContent:    map[string]interface{}{"spec": map[string]interface{}{}},
+			expectedMethod: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expectedMethod, detectBackupMethod(tt.itemContent, tt.pluginServerName))
+		})
+	}
+}
+
+func TestBarmanObjectStoreServerName(t *testing.T) {
+	itemContent := map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "test-cluster"},
+		"spec": map[string]interface{}{
+			"backup": map[string]interface{}{
+				"barmanObjectStore": map[string]interface{}{"destinationPath": "s3://bucket"},
+			},
+		},
+	}
+	assert.Equal(t, "test-cluster", barmanObjectStoreServerName(itemContent))
+
+	itemContent["spec"].(map[string]interface{})["backup"].(map[string]interface{})["barmanObjectStore"].(map[string]interface{})["serverName"] = "explicit"
+	assert.Equal(t, "explicit", barmanObjectStoreServerName(itemContent))
+}
+
+func TestVolumeSnapshotsOf(t *testing.T) {
+	backup := createMockSnapshotBackup("backup-1", "default", "test-cluster", "backup-id-123", time.Now())
+
+	assert.Equal(t, BackupMethodVolumeSnapshot, backupMethodOf(backup))
+
+	snapshots, err := volumeSnapshotsOf(backup)
+	require.NoError(t, err)
+	assert.Equal(t, "backup-1-data", snapshots.Storage)
+	assert.Equal(t, "backup-1-wal", snapshots.WalStorage)
+	assert.Equal(t, map[string]string{"archive": "backup-1-tbs"}, snapshots.TablespaceStorage)
+
+	encoded, err := encodeVolumeSnapshots(snapshots)
+	require.NoError(t, err)
+	decoded, err := decodeVolumeSnapshots(encoded)
+	require.NoError(t, err)
+	assert.Equal(t, snapshots, decoded)
+
+	_, err = volumeSnapshotsOf(createMockBackup("backup-2", "default", "test-cluster", "completed", "id", time.Now()))
+	assert.Error(t, err)
+
+	_, err = decodeVolumeSnapshots(`{"walStorage":"wal"}`)
+	assert.Error(t, err)
+}
+
+func TestBackupExecuteBackupMethod(t *testing.T) {
+	tests := []struct {
+		name                string
+		spec                map[string]interface{}
+		mockBackups         []runtime.Object
+		expectedMethod      string
+		expectedServerName  string
+		expectSnapshotsNote bool
+	}{
+		{
+			name: "in-tree object store uses cluster name as serverName",
+			spec: map[string]interface{}{
+				"backup": map[string]interface{}{
+					"barmanObjectStore": map[string]interface{}{"destinationPath": "s3://bucket"},
+				},
+			},
+			expectedMethod:     BackupMethodBarmanObjectStore,
+			expectedServerName: "test-cluster",
+		},
+		{
+			name: "volume snapshot backup records snapshots",
+			spec: map[string]interface{}{
+				"backup": map[string]interface{}{
+					"volumeSnapshot": map[string]interface{}{"className": "csi"},
+				},
+			},
+			mockBackups: []runtime.Object{
+				createMockSnapshotBackup("backup-1", "default", "test-cluster", "backup-id-123", time.Now()),
+			},
+			expectedMethod:      BackupMethodVolumeSnapshot,
+			expectSnapshotsNote: true,
+		},
+		{
+			name: "pinned snapshot backup overrides object store method",
+			spec: map[string]interface{}{
+				"backup": map[string]interface{}{
+					"barmanObjectStore": map[string]interface{}{"destinationPath": "s3://bucket"},
+					"volumeSnapshot":    map[string]interface{}{"className": "csi"},
+				},
+			},
+			mockBackups: []runtime.Object{
+				createMockSnapshotBackup("backup-1", "default", "test-cluster", "backup-id-123", time.Now()),
+			},
+			expectedMethod:      BackupMethodVolumeSnapshot,
+			expectedServerName:  "test-cluster",
+			expectSnapshotsNote: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plugin := &BackupPluginV2{
+				log:           logrus.New(),
+				config:        DefaultPluginConfig(),
+				dynamicClient: newFakeDynamicClient(tt.mockBackups...),
+			}
+
+			item := &unstructured.Unstructured{}
+			item.SetUnstructuredContent(map[string]interface{}{
+				"apiVersion": "postgresql.cnpg.io/v1",
+				"kind":       "Cluster",
+				"metadata": map[string]interface{}{
+					"name":      "test-cluster",
+					"namespace": "default",
+				},
+				"spec": tt.spec,
+			})
+
+			resultItem, _, _, _, err := plugin.Execute(item, nil)
+			require.NoError(t, err)
+
+			annotations := resultItem.(*unstructured.Unstructured).GetAnnotations()
+			assert.Equal(t, tt.expectedMethod, annotations[AnnotationBackupMethod])
+			assert.Equal(t, strconv.Itoa(CurrentSchemaVersion), annotations[AnnotationSchemaVersion])
+			assert.Equal(t, tt.expectedServerName, annotations[AnnotationServerName])
+			_, hasSnapshots := annotations[AnnotationVolumeSnapshots]
+			assert.Equal(t, tt.expectSnapshotsNote, hasSnapshots)
+		})
+	}
+}
+
+func TestConfigureRecoveryBackupMethods(t *testing.T) {
+	plugin := &RestorePluginV2{
+		log: logrus.New(),
+	}
+
+	snapshots := &VolumeSnapshots{Storage: "snap-data", WalStorage: "snap-wal"}
+
+	tests := []struct {
+		name             string
+		spec             map[string]interface{}
+		method           string
+		barmanObjectName string
+		snapshots        *VolumeSnapshots
+		validateFn       func(t *testing.T, spec map[string]interface{})
+	}{
+		{
+			name: "in-tree object store copies the store with the original serverName",
+			spec: map[string]interface{}{
+				"backup": map[string]interface{}{
+					"barmanObjectStore": map[string]interface{}{
+						"destinationPath": "s3://bucket",
+						"serverName":      "new-server",
+					},
+				},
+			},
+			method: BackupMethodBarmanObjectStore,
+			validateFn: func(t *testing.T, spec map[string]interface{}) {
+				externalClusters := spec["externalClusters"].([]interface{})
+				require.Len(t, externalClusters, 1)
+				cluster := externalClusters[0].(map[string]interface{})
+				assert.Equal(t, "clusterBackup", cluster["name"])
+				objectStore := cluster["barmanObjectStore"].(map[string]interface{})
+				assert.Equal(t, "s3://bucket", objectStore["destinationPath"])
+				assert.Equal(t, "original-server", objectStore["serverName"])
+
+				// The cluster's own object store is left alone
+				own := spec["backup"].(map[string]interface{})["barmanObjectStore"].(map[string]interface{})
+				assert.Equal(t, "new-server", own["serverName"])
+
+				recovery := spec["bootstrap"].(map[string]interface{})["recovery"].(map[string]interface{})
+				assert.Equal(t, "clusterBackup", recovery["source"])
+			},
+		},
+		{
+			name: "volume snapshots without object store",
+			spec: map[string]interface{}{
+				"backup": map[string]interface{}{
+					"volumeSnapshot": map[string]interface{}{"className": "csi"},
+				},
+			},
+			method:    BackupMethodVolumeSnapshot,
+			snapshots: snapshots,
+			validateFn: func(t *testing.T, spec map[string]interface{}) {
+				_, hasExternalClusters := spec["externalClusters"]
+				assert.False(t, hasExternalClusters)
+
+				recovery := spec["bootstrap"].(map[string]interface{})["recovery"].(map[string]interface{})
+				_, hasSource := recovery["source"]
+				assert.False(t, hasSource)
+
+				volumeSnapshots := recovery["volumeSnapshots"].(map[string]interface{})
+				storage := volumeSnapshots["storage"].(map[string]interface{})
+				assert.Equal(t, "snap-data", storage["name"])
+				assert.Equal(t, "VolumeSnapshot", storage["kind"])
+				assert.Equal(t, "snapshot.storage.k8s.io", storage["apiGroup"])
+				walStorage := volumeSnapshots["walStorage"].(map[string]interface{})
+				assert.Equal(t, "snap-wal", walStorage["name"])
+			},
+		},
+		{
+			name:             "volume snapshots with barman plugin WAL archive",
+			spec:             map[string]interface{}{},
+			method:           BackupMethodVolumeSnapshot,
+			barmanObjectName: "backup-store",
+			snapshots:        snapshots,
+			validateFn: func(t *testing.T, spec map[string]interface{}) {
+				externalClusters := spec["externalClusters"].([]interface{})
+				require.Len(t, externalClusters, 1)
+
+				recovery := spec["bootstrap"].(map[string]interface{})["recovery"].(map[string]interface{})
+				assert.Equal(t, "clusterBackup", recovery["source"])
+				assert.NotNil(t, recovery["volumeSnapshots"])
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			itemContent := map[string]interface{}{"spec": tt.spec}
+
+			require.NoError(t, plugin.configureRecoverySource(itemContent, tt.method, "original-server", tt.barmanObjectName))
+			require.NoError(t, plugin.configureRecoveryBootstrap(itemContent, tt.method, "", tt.snapshots))
+
+			tt.validateFn(t, itemContent["spec"].(map[string]interface{}))
+		})
+	}
+}
+
+func TestUpdateBarmanObjectStoreServerName(t *testing.T) {
+	plugin := &RestorePluginV2{
+		log: logrus.New(),
+	}
+
+	itemContent := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"backup": map[string]interface{}{
+				"barmanObjectStore": map[string]interface{}{"destinationPath": "s3://bucket"},
+			},
+		},
+	}
+	require.NoError(t, plugin.updateBarmanObjectStoreServerName(itemContent, "new-server"))
+	serverName, _, _ := unstructured.NestedString(itemContent, "spec", "backup", "barmanObjectStore", "serverName")
+	assert.Equal(t, "new-server", serverName)
+
+	// Clusters without an in-tree object store are left unchanged
+	noStore := map[string]interface{}{"spec": map[string]interface{}{}}
+	require.NoError(t, plugin.updateBarmanObjectStoreServerName(noStore, "new-server"))
+	assert.Equal(t, map[string]interface{}{}, noStore["spec"])
+}
+
+func createMockRestoredVolumeSnapshot(name, namespace string, labels map[string]string) *unstructured.Unstructured {
+	snapshot := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "snapshot.storage.k8s.io/v1",
+		"kind":       "VolumeSnapshot",
+		"metadata": map[string]interface{}{
+			"name":      name,
+			"namespace": namespace,
+		},
+	}}
+	snapshot.SetLabels(labels)
+	return snapshot
+}
+
+func TestMapRestoredVolumeSnapshots(t *testing.T) {
+	restore := &v1.Restore{ObjectMeta: metav1.ObjectMeta{Name: "restore-1", UID: "3f6a9c1e"}}
+	restored := func(name string) string {
+		return veleroutil.GenerateSha256FromRestoreUIDAndVsName(string(restore.UID), name)
+	}
+	restoreLabels := map[string]string{v1.RestoreNameLabel: "restore-1"}
+
+	snapshots := &VolumeSnapshots{
+		Storage:           "pg-data",
+		WalStorage:        "pg-wal",
+		TablespaceStorage: map[string]string{"archive": "pg-tbs", "logs": "pg-logs"},
+	}
+	dynamicClient := newFakeDynamicClient(
+		createMockRestoredVolumeSnapshot(restored("pg-data"), "default", restoreLabels),
+		// Restored by another restore of the same backup
+		createMockRestoredVolumeSnapshot(veleroutil.GenerateSha256FromRestoreUIDAndVsName("other", "pg-wal"), "default", map[string]string{v1.RestoreNameLabel: "restore-0"}),
+		// Exists under its original name
+		createMockRestoredVolumeSnapshot("pg-logs", "default", nil),
+	)
+	plugin := &RestorePluginV2{log: logrus.New(), dynamicClient: dynamicClient}
+	warnings := &restoreWarnings{log: logrus.New()}
+
+	// Snapshots not restored yet are restored as additional items under the generated name
+	mapped := plugin.mapRestoredVolumeSnapshots(snapshots, restore, "default", warnings)
+	assert.Equal(t, &VolumeSnapshots{
+		Storage:           restored("pg-data"),
+		WalStorage:        restored("pg-wal"),
+		TablespaceStorage: map[string]string{"archive": restored("pg-tbs"), "logs": "pg-logs"},
+	}, mapped)
+	assert.Empty(t, warnings.messages)
+
+	// Restores that skip volumes bring no snapshots back
+	restorePVs := false
+	restore.Spec.RestorePVs = &restorePVs
+	mapped = plugin.mapRestoredVolumeSnapshots(&VolumeSnapshots{Storage: "pg-data", WalStorage: "pg-wal"}, restore, "default", warnings)
+	assert.Equal(t, &VolumeSnapshots{Storage: restored("pg-data"), WalStorage: "pg-wal"}, mapped)
+	require.Len(t, warnings.messages, 1)
+	assert.Contains(t, warnings.messages[0], "VolumeSnapshot pg-wal does not exist")
+}
+
+func TestVolumeSnapshotItems(t *testing.T) {
+	recorded := &VolumeSnapshots{
+		Storage:           "pg-data",
+		WalStorage:        "pg-wal",
+		TablespaceStorage: map[string]string{"logs": "pg-logs", "archive": "pg-tbs"},
+	}
+	mapped := &VolumeSnapshots{
+		Storage:           "restored-data",
+		WalStorage:        "pg-wal",
+		TablespaceStorage: map[string]string{"logs": "restored-logs", "archive": "restored-tbs"},
+	}
+
+	var names []string
+	for _, item := range volumeSnapshotItems(recorded, mapped, "default") {
+		assert.Equal(t, volumeSnapshotGVR.GroupResource(), item.GroupResource)
+		assert.Equal(t, "default", item.Namespace)
+		names = append(names, item.Name)
+	}
+	assert.Equal(t, []string{"pg-data", "pg-tbs", "pg-logs"}, names)
+}
+
+func TestVolumeSnapshotsReady(t *testing.T) {
+	restore := &v1.Restore{
+		ObjectMeta: metav1.ObjectMeta{Name: "restore-1", UID: "3f6a9c1e"},
+		Spec:       v1.RestoreSpec{NamespaceMapping: map[string]string{"default": "restored"}},
+	}
+	items := volumeSnapshotItems(&VolumeSnapshots{Storage: "pg-data"}, &VolumeSnapshots{Storage: "mapped"}, "default")
+	withStatus := func(status map[string]interface{}) *unstructured.Unstructured {
+		snapshot := createMockRestoredVolumeSnapshot(veleroutil.GenerateSha256FromRestoreUIDAndVsName(string(restore.UID), "pg-data"), "restored", nil)
+		snapshot.Object["status"] = status
+		return snapshot
+	}
+
+	tests := []struct {
+		name          string
+		objects       []runtime.Object
+		expectReady   bool
+		expectedError string
+	}{
+		{name: "not restored yet"},
+		{name: "not ready", objects: []runtime.Object{withStatus(map[string]interface{}{"readyToUse": false})}},
+		{name: "ready", objects: []runtime.Object{withStatus(map[string]interface{}{"readyToUse": true})}, expectReady: true},
+		{
+			name:          "failed",
+			objects:       []runtime.Object{withStatus(map[string]interface{}{"error": map[string]interface{}{"message": "content not found"}})},
+			expectedError: "content not found",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plugin := &RestorePluginV2{log: logrus.New(), dynamicClient: newFakeDynamicClient(tt.objects...)}
+
+			ready, err := plugin.AreAdditionalItemsReady(items, restore)
+			if tt.expectedError != "" {
+				assert.ErrorContains(t, err, tt.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectReady, ready)
+		})
+	}
+}
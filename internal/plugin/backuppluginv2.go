@@ -3,18 +3,22 @@ package plugin
 import (
 	"context"
 	"sort"
+	"strconv"
 	"time"
 
 	"github.com/sirupsen/logrus"
 
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 
 	"github.com/pkg/errors"
 	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework/common"
 	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
 )
 
 const (
@@ -25,11 +29,34 @@ const (
 	// AnnotationCurrentBackupID is the annotation key used to store the backup ID
 	// from the latest completed CNPG backup for precise point-in-time recovery
 	AnnotationCurrentBackupID = "velero-cnpg/current-backup-id"
+
+	// AnnotationCurrentBackupName is the annotation key used to store the name of the
+	// CNPG Backup CR the backup ID was taken from
+	AnnotationCurrentBackupName = "velero-cnpg/current-backup-name"
 )
 
+// cnpgBackupGVR identifies CNPG Backup resources
+var cnpgBackupGVR = schema.GroupVersionResource{
+	Group:    "postgresql.cnpg.io",
+	Version:  "v1",
+	Resource: "backups",
+}
+
 // BackupPluginV2 is a v2 backup item action plugin for Velero.
 type BackupPluginV2 struct {
 	log logrus.FieldLogger
+
+	// config overrides the plugin ConfigMap lookup when set
+	config *PluginConfig
+
+	// dynamicClient overrides GetDynamicClient when set
+	dynamicClient dynamic.Interface
+
+	// kubeClient overrides GetClient when set
+	kubeClient kubernetes.Interface
+
+	// podExec overrides getPodExec when set
+	podExec podExecFunc
 }
 
 // NewBackupPluginV2 instantiates a v2 BackupPlugin.
@@ -37,6 +64,27 @@ func NewBackupPluginV2(log logrus.FieldLogger) *BackupPluginV2 {
 	return &BackupPluginV2{log: log}
 }
 
+// getConfig returns the plugin configuration, see loadActionConfig
+func (p *BackupPluginV2) getConfig() (*PluginConfig, error) {
+	return loadActionConfig(p.config, common.PluginKindBackupItemAction, BackupPluginName)
+}
+
+// getDynamicClient returns the dynamic client used to query CNPG resources
+func (p *BackupPluginV2) getDynamicClient() (dynamic.Interface, error) {
+	if p.dynamicClient != nil {
+		return p.dynamicClient, nil
+	}
+	return GetDynamicClient()
+}
+
+// getKubeClient returns the client used to find the barman-cloud plugin Deployment
+func (p *BackupPluginV2) getKubeClient() (kubernetes.Interface, error) {
+	if p.kubeClient != nil {
+		return p.kubeClient, nil
+	}
+	return GetClient()
+}
+
 // Name is required to implement the interface, but the Velero pod does not delegate this
 // method -- it's used to tell velero what name it was registered under. The plugin implementation
 // must define it, but it will never actually be called.
@@ -50,24 +98,29 @@ func (p *BackupPluginV2) Name() string {
 // A BackupPlugin's Execute function will only be invoked on items that match the returned
 // selector. A zero-valued ResourceSelector matches all resources.
 func (p *BackupPluginV2) AppliesTo() (velero.ResourceSelector, error) {
-	return velero.ResourceSelector{
+	config, err := p.getConfig()
+	if err != nil {
+		return noNamespaces(), err
+	}
+	return config.scopeNamespaces(velero.ResourceSelector{
 		IncludedResources: []string{"clusters.postgresql.cnpg.io"},
-	}, nil
+	}), nil
 }
 
-// extractPluginParameters extracts serverName from .spec.plugins[].parameters
-func (p *BackupPluginV2) extractPluginParameters(itemContent map[string]interface{}) (serverName string, err error) {
+// extractPluginParameters extracts serverName from the parameters of the WAL archiver
+// entry in .spec.plugins, handling a disabled entry according to disabledPluginPolicy
+func (p *BackupPluginV2) extractPluginParameters(itemContent map[string]interface{}, disabledPluginPolicy string) (serverName string, err error) {
 	spec, found, err := unstructured.NestedFieldNoCopy(itemContent, "spec")
 	if err != nil {
 		return "", errors.Wrap(err, "failed to get spec field")
 	}
 	if !found {
-		return "", errors.New("spec field not found")
+		return "", specShapeError("spec field not found")
 	}
 
 	specMap, ok := spec.(map[string]interface{})
 	if !ok {
-		return "", errors.New("spec is not a map")
+		return "", specShapeError("spec is not a map")
 	}
 
 	plugins, found := specMap["plugins"]
@@ -78,128 +131,54 @@ func (p *BackupPluginV2) extractPluginParameters(itemContent map[string]interfac
 
 	pluginsList, ok := plugins.([]interface{})
 	if !ok {
-		return "", errors.New("plugins is not a list")
+		return "", specShapeError("plugins is not a list")
 	}
 
-	for _, plugin := range pluginsList {
-		pluginMap, ok := plugin.(map[string]interface{})
-		if !ok {
-			continue
-		}
-
-		parameters, found := pluginMap["parameters"]
-		if !found {
-			continue
-		}
-
-		paramsMap, ok := parameters.(map[string]interface{})
-		if !ok {
-			continue
-		}
-
-		if sn, found := paramsMap["serverName"]; found {
-			if snStr, ok := sn.(string); ok {
-				serverName = snStr
-				break
-			}
-		}
-	}
-
-	return serverName, nil
+	return enabledWALArchiverParameter(pluginsList, "serverName", disabledPluginPolicy, p.log.Warnf)
 }
 
 // addAnnotation adds an annotation to the item's metadata
 func (p *BackupPluginV2) addAnnotation(itemContent map[string]interface{}, key, value string) error {
-	metadata, found, err := unstructured.NestedFieldNoCopy(itemContent, "metadata")
-	if err != nil {
-		return errors.Wrap(err, "failed to get metadata field")
-	}
-	if !found {
-		return errors.New("metadata field not found")
-	}
-
-	metadataMap, ok := metadata.(map[string]interface{})
-	if !ok {
-		return errors.New("metadata is not a map")
-	}
-
-	annotations, found := metadataMap["annotations"]
-	if !found {
-		annotations = make(map[string]interface{})
-	}
-
-	annotationsMap, ok := annotations.(map[string]interface{})
-	if !ok {
-		return errors.New("annotations is not a map")
-	}
-
-	annotationsMap[key] = value
-	metadataMap["annotations"] = annotationsMap
-
-	if err := unstructured.SetNestedField(itemContent, metadataMap, "metadata"); err != nil {
-		return errors.Wrap(err, "failed to set metadata field")
-	}
-
-	return nil
+	return setAnnotation(itemContent, key, value)
 }
 
-// getLatestCompletedBackupID queries the Kubernetes API for the latest completed backup
-// for the specified cluster and returns its backupId from status
-func (p *BackupPluginV2) getLatestCompletedBackupID(ctx context.Context, namespace, clusterName string) (string, error) {
-	// Get dynamic client for querying CRDs
-	dynamicClient, err := GetDynamicClient()
+// listClusterBackups queries the Kubernetes API for the CNPG Backup CRs of the specified
+// cluster, in any phase. Clusters backed up by the same Velero backup share the list of
+// their namespace.
+func (p *BackupPluginV2) listClusterBackups(ctx context.Context, dynamicClient dynamic.Interface, backupUID types.UID, namespace, clusterName string) ([]unstructured.Unstructured, error) {
+	items, err := backupLists.list(ctx, dynamicClient, backupUID, namespace)
 	if err != nil {
-		return "", errors.Wrap(err, "failed to create dynamic client")
-	}
-
-	// Define the GVR for CNPG Backup resources
-	gvr := schema.GroupVersionResource{
-		Group:    "postgresql.cnpg.io",
-		Version:  "v1",
-		Resource: "backups",
+		return nil, err
 	}
 
-	// List all backup resources in the namespace
-	backupList, err := dynamicClient.Resource(gvr).Namespace(namespace).List(ctx, metav1.ListOptions{})
-	if err != nil {
-		return "", errors.Wrap(err, "failed to list CNPG backup resources")
-	}
-
-	if len(backupList.Items) == 0 {
+	if len(items) == 0 {
 		p.log.Warnf("No backup resources found in namespace %s", namespace)
-		return "", nil
+		return nil, nil
 	}
 
-	// Filter and collect completed backups for this cluster
-	var completedBackups []unstructured.Unstructured
-	for _, backup := range backupList.Items {
-		// Check if backup belongs to this cluster
-		spec, found, err := unstructured.NestedFieldNoCopy(backup.Object, "spec")
-		if err != nil || !found {
-			continue
-		}
-		specMap, ok := spec.(map[string]interface{})
-		if !ok {
-			continue
+	var backups []unstructured.Unstructured
+	for _, backup := range items {
+		if backupClusterName, _, _ := unstructured.NestedString(backup.Object, "spec", "cluster", "name"); backupClusterName == clusterName {
+			backups = append(backups, backup)
 		}
+	}
 
-		// Check cluster reference
-		cluster, found := specMap["cluster"]
-		if !found {
-			continue
-		}
-		clusterMap, ok := cluster.(map[string]interface{})
-		if !ok {
-			continue
-		}
-		backupClusterName, found := clusterMap["name"]
-		if !found {
-			continue
-		}
-		if backupClusterName != clusterName {
-			continue
-		}
+	return backups, nil
+}
 
+// completedBackupUnknownError returns the error failing the backup of a cluster whose
+// latest completed CNPG backup cannot be determined while requireCompletedBackup is enabled
+func completedBackupUnknownError(namespace, clusterName string, cause error) error {
+	return errors.Wrapf(cause, "cannot find a completed CNPG backup of cluster %s/%s, the Velero backup may not be restorable (requireCompletedBackup is enabled)", namespace, clusterName)
+}
+
+// latestCompletedBackup returns the latest completed backup among the backups of the
+// specified cluster along with its backupId from status. A nil Backup and empty backupId
+// are returned when no completed backup exists.
+func (p *BackupPluginV2) latestCompletedBackup(backups []unstructured.Unstructured, namespace, clusterName string) (*unstructured.Unstructured, string, error) {
+	// Collect the completed backups
+	var completedBackups []unstructured.Unstructured
+	for _, backup := range backups {
 		// Check if backup is completed
 		status, found, err := unstructured.NestedFieldNoCopy(backup.Object, "status")
 		if err != nil || !found {
@@ -224,7 +203,7 @@ func (p *BackupPluginV2) getLatestCompletedBackupID(ctx context.Context, namespa
 
 	if len(completedBackups) == 0 {
 		p.log.Warnf("No completed backups found for cluster %s in namespace %s", clusterName, namespace)
-		return "", nil
+		return nil, "", nil
 	}
 
 	// Sort by creation timestamp (descending - newest first)
@@ -238,49 +217,116 @@ func (p *BackupPluginV2) getLatestCompletedBackupID(ctx context.Context, namespa
 	latestBackup := completedBackups[0]
 	status, found, err := unstructured.NestedFieldNoCopy(latestBackup.Object, "status")
 	if err != nil || !found {
-		return "", errors.New("failed to get status from latest backup")
+		return nil, "", errors.New("failed to get status from latest backup")
 	}
 	statusMap, ok := status.(map[string]interface{})
 	if !ok {
-		return "", errors.New("status is not a map in latest backup")
+		return nil, "", specShapeError("status is not a map in latest backup")
 	}
 
 	backupID, found := statusMap["backupId"]
 	if !found {
-		return "", errors.New("backupId not found in latest backup status")
+		return nil, "", errors.New("backupId not found in latest backup status")
 	}
 	backupIDStr, ok := backupID.(string)
 	if !ok {
-		return "", errors.New("backupId is not a string")
+		return nil, "", specShapeError("backupId is not a string")
 	}
 
 	p.log.Infof("Found latest completed backup: %s with backupId: %s", latestBackup.GetName(), backupIDStr)
-	return backupIDStr, nil
+	return &latestBackup, backupIDStr, nil
 }
 
 // Execute allows the ItemAction to perform arbitrary logic with the item being backed up
-func (p *BackupPluginV2) Execute(item runtime.Unstructured, backup *v1.Backup) (runtime.Unstructured, []velero.ResourceIdentifier, string, []velero.ResourceIdentifier, error) {
+func (p *BackupPluginV2) Execute(item runtime.Unstructured, backup *v1.Backup) (_ runtime.Unstructured, _ []velero.ResourceIdentifier, _ string, _ []velero.ResourceIdentifier, err error) {
+	defer reportError(p.log, "CNPG backup plugin", item, &err)
+	defer recoverPanic(p.log, "CNPG backup plugin", item, &err)
+
 	p.log.Info("Executing CNPG backup plugin on resource: %s", resourceName(item))
 
 	itemContent := item.UnstructuredContent()
+	var additionalItems []velero.ResourceIdentifier
+
+	config, err := p.getConfig()
+	if err != nil {
+		return nil, nil, "", nil, err
+	}
+
+	if config.OptIn && !optedIn(&unstructured.Unstructured{Object: itemContent}) {
+		p.log.Infof("Cluster has no %s=true annotation, skipping annotation", AnnotationEnabled)
+		return item, nil, "", nil, nil
+	}
+
+	// Every warning logged from here on fails the item in strict mode
+	if config.Strict {
+		recorder := newWarningRecorder(p.log)
+		defer recorder.failStrict(&err)
+		scoped := *p
+		scoped.log = recorder
+		p = &scoped
+	}
+
+	// Record what the action did to the cluster once it is done with it
+	operation := ""
+	if backup != nil {
+		operation = backup.Name
+	}
+	result := newResultRecorder("backup", operation, itemContent, time.Now())
+
+	// Let external systems approve the backup before anything runs against the cluster
+	if _, err := callWebhooks(config.Webhooks, newWebhookEvent(WebhookEventPreBackup, operation, itemContent), p.getKubeClient, p.log.Warnf); err != nil {
+		return nil, nil, "", nil, err
+	}
+
+	// Run the pre hooks now and the post hooks once the cluster has been processed
+	if config.BackupHooks != nil {
+		if err := p.runBackupHooks(itemContent, "pre", config.BackupHooks.Pre); err != nil {
+			return nil, nil, "", nil, err
+		}
+		defer p.runPostBackupHooks(itemContent, config.BackupHooks.Post, &err)
+	}
+
+	// A skip reason recorded by an earlier backup, which a restored cluster carries, no longer applies
+	unstructured.RemoveNestedField(itemContent, "metadata", "annotations", AnnotationSkipReason)
 
 	// Extract serverName from .spec.plugins[].parameters
-	serverName, err := p.extractPluginParameters(itemContent)
+	serverName, err := p.extractPluginParameters(itemContent, config.DisabledPluginPolicy)
 	if err != nil {
 		return nil, nil, "", nil, err
 	}
 
-	if serverName == "" {
-		p.log.Info("No serverName found in plugins.parameters, skipping annotation")
+	// Detect how the cluster is backed up
+	method := detectBackupMethod(itemContent, serverName)
+	if method == BackupMethodBarmanObjectStore {
+		serverName = barmanObjectStoreServerName(itemContent)
+	}
+
+	if method == "" {
+		p.log.Info("No serverName found in plugins.parameters and no backup configured, skipping annotation")
+		if walArchiverDisabled(itemContent) {
+			p.annotateSkipReason(itemContent, SkipReasonPluginDisabled)
+		}
+		p.annotateResult(itemContent, result, ResultSkipped)
+		if _, err := callWebhooks(config.Webhooks, newWebhookEvent(WebhookEventPostBackup, operation, itemContent), p.getKubeClient, p.log.Warnf); err != nil {
+			return nil, nil, "", nil, err
+		}
+		item.SetUnstructuredContent(itemContent)
 		return item, nil, "", nil, nil
 	}
 
-	// Add annotation with the extracted serverName
-	p.log.Infof("Found serverName: %s", serverName)
-	if err := p.addAnnotation(itemContent, AnnotationServerName, serverName); err != nil {
+	// The latest completed backup of a cluster that is not healthy may predate important data
+	if err := p.checkClusterPhase(itemContent, config.UnhealthyClusterPolicy); err != nil {
 		return nil, nil, "", nil, err
 	}
 
+	// Add annotation with the extracted serverName
+	if serverName != "" {
+		p.log.Infof("Found serverName: %s", serverName)
+		if err := p.addAnnotation(itemContent, AnnotationServerName, serverName); err != nil {
+			return nil, nil, "", nil, err
+		}
+	}
+
 	// Get cluster metadata for backup query
 	metadata, found, err := unstructured.NestedFieldNoCopy(itemContent, "metadata")
 	if err == nil && found {
@@ -294,26 +340,170 @@ func (p *BackupPluginV2) Execute(item runtime.Unstructured, backup *v1.Backup) (
 				ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 				defer cancel()
 
-				backupID, err := p.getLatestCompletedBackupID(ctx, namespace, clusterName)
+				dynamicClient, err := p.getDynamicClient()
+				var backups []unstructured.Unstructured
 				if err != nil {
+					if config.RequireCompletedBackup {
+						return nil, nil, "", nil, completedBackupUnknownError(namespace, clusterName, errors.Wrap(err, "failed to create dynamic client"))
+					}
+					p.log.Warnf("Failed to create dynamic client: %v", err)
+					p.annotateSkipReason(itemContent, SkipReasonBackupListFailed)
+				} else if !p.cnpgBackupsServed() {
+					if config.RequireCompletedBackup {
+						return nil, nil, "", nil, completedBackupUnknownError(namespace, clusterName, errors.Errorf("the API server does not serve %s.%s", cnpgResourceBackups, cnpgBackupGVR.Group))
+					}
+					p.annotateSkipReason(itemContent, SkipReasonBackupListFailed)
+				} else if backups, err = p.listClusterBackups(ctx, dynamicClient, veleroBackupUID(backup), namespace, clusterName); err != nil {
+					if config.RequireCompletedBackup {
+						return nil, nil, "", nil, completedBackupUnknownError(namespace, clusterName, err)
+					}
 					p.log.Warnf("Failed to get latest backup ID: %v", err)
+					p.annotateSkipReason(itemContent, SkipReasonBackupListFailed)
+				} else if latestBackup, backupID, err := p.latestCompletedBackup(backups, namespace, clusterName); err != nil {
+					if config.RequireCompletedBackup {
+						return nil, nil, "", nil, completedBackupUnknownError(namespace, clusterName, errors.Wrap(err, "invalid latest completed CNPG backup"))
+					}
+					p.log.Warnf("Failed to get latest backup ID: %v", err)
+					p.annotateSkipReason(itemContent, SkipReasonInvalidBackup)
 				} else if backupID != "" {
 					if err := p.addAnnotation(itemContent, AnnotationCurrentBackupID, backupID); err != nil {
 						p.log.Warnf("Failed to annotate backup ID: %v", err)
+					} else if err := p.addAnnotation(itemContent, AnnotationCurrentBackupName, latestBackup.GetName()); err != nil {
+						p.log.Warnf("Failed to annotate backup name: %v", err)
 					} else {
 						p.log.Infof("Annotated cluster with backup ID: %s", backupID)
+
+						// Include the pinned Backup CR so its status travels with the Velero backup
+						additionalItems = append(additionalItems, backupResourceIdentifier(latestBackup))
+					}
+
+					// The pinned backup decides the method for clusters combining several
+					if backupMethod := backupMethodOf(latestBackup); backupMethod != "" {
+						method = backupMethod
 					}
+					if method == BackupMethodVolumeSnapshot {
+						if err := p.annotateVolumeSnapshots(itemContent, latestBackup); err != nil {
+							p.log.Warnf("Failed to annotate volume snapshots: %v", err)
+						}
+					}
+
+					// Record where the pinned backup ends so restores can be verified against it
+					p.annotateBackupEnd(itemContent, latestBackup)
+				} else if config.RequireCompletedBackup {
+					return nil, nil, "", nil, errors.Errorf("no completed CNPG backup found for cluster %s/%s, the Velero backup would not be restorable (requireCompletedBackup is enabled)", namespace, clusterName)
 				} else {
-					p.log.Warn("No completed backups found for cluster")
+					reason := noCompletedBackupReason(itemContent)
+					p.log.Warnf("No completed backups found for cluster (%s)", reason)
+					p.annotateSkipReason(itemContent, reason)
 				}
+
+				// Record the serverNames earlier backups of the cluster were written to
+				p.annotateBackupServerNames(itemContent, backups)
 			}
 		}
 	}
 
+	if err := p.addAnnotation(itemContent, AnnotationBackupMethod, method); err != nil {
+		return nil, nil, "", nil, err
+	}
+	p.log.Infof("Annotated cluster with backup method: %s", method)
+
+	// Record the object store prefixes the cluster archives to for cleanup tooling
+	if err := appendServerNameHistory(itemContent, time.Now()); err != nil {
+		p.log.Warnf("Failed to record serverName history: %v", err)
+	}
+
+	// Record the backup-critical spec sections so the restore can detect changes to them
+	p.annotateSpecDigest(itemContent)
+
+	// Record the plugin parameters so the restore can reconstruct them
+	p.annotatePluginParameters(itemContent)
+
+	// Record the PostgreSQL major version so the restore can refuse downgrades
+	p.annotateMajorVersion(itemContent)
+
+	// Record the plugin version so the restore can flag parameter changes between versions
+	p.annotatePluginVersion(itemContent)
+
+	// Back up the operator configuration so the restore can compare it with the destination's
+	unstructured.RemoveNestedField(itemContent, "metadata", "annotations", AnnotationOperatorConfig)
+	if config.BackupOperatorConfig {
+		additionalItems = append(additionalItems, p.backupOperatorConfig(itemContent, config.operatorSelector())...)
+	}
+
+	// Back up the image catalog the cluster resolves its PostgreSQL image from
+	if catalog, found := p.imageCatalogItem(itemContent); found {
+		additionalItems = append(additionalItems, catalog)
+	}
+
+	// Record the Poolers so the restore can check they come back bound to the cluster
+	additionalItems = append(additionalItems, p.annotatePoolers(itemContent)...)
+
+	// Record the ScheduledBackups so the restore can tell whether the cluster comes back with one
+	p.annotateScheduledBackups(itemContent)
+
+	// Record the retention policy so the restore can re-apply or adjust it
+	p.annotateRetentionPolicy(itemContent)
+
+	// Record the Velero Schedule and TTL so the restore can trace the policy behind the data
+	p.annotateVeleroSchedule(itemContent, backup)
+
+	// Record the size of the cluster so restores can be planned for its storage and duration.
+	// The recovery the cluster was restored with, if still tracked, is no longer relevant.
+	for _, key := range []string{AnnotationInstances, AnnotationDatabaseSize, AnnotationWALRate, AnnotationRecoveryObserved} {
+		unstructured.RemoveNestedField(itemContent, "metadata", "annotations", key)
+	}
+	if config.RecordSizeMetrics {
+		p.annotateSizeMetrics(itemContent)
+	}
+
+	// Mark the moment of the backup in the WAL so restores can recover to exactly it
+	if config.CreateRestorePoints {
+		p.createRestorePoint(itemContent, backup)
+	}
+
+	if err := p.addAnnotation(itemContent, AnnotationSchemaVersion, strconv.Itoa(CurrentSchemaVersion)); err != nil {
+		return nil, nil, "", nil, err
+	}
+
+	// Seal the annotations so the restore can tell whether the manifest was modified
+	p.annotateIntegrity(itemContent)
+
+	p.annotateResult(itemContent, result, ResultProcessed)
+
+	// Tell external systems what the backup recorded for the cluster
+	if _, err := callWebhooks(config.Webhooks, newWebhookEvent(WebhookEventPostBackup, operation, itemContent), p.getKubeClient, p.log.Warnf); err != nil {
+		return nil, nil, "", nil, err
+	}
+
 	item.SetUnstructuredContent(itemContent)
-	p.log.Infof("Successfully annotated cluster (serverName: %s)", serverName)
+	p.log.Infof("Successfully annotated cluster (serverName: %s, method: %s)", serverName, method)
 
-	return item, nil, "", nil, nil
+	return item, additionalItems, "", nil, nil
+}
+
+// annotateVolumeSnapshots records the VolumeSnapshots of a volumeSnapshot backup
+func (p *BackupPluginV2) annotateVolumeSnapshots(itemContent map[string]interface{}, backup *unstructured.Unstructured) error {
+	snapshots, err := volumeSnapshotsOf(backup)
+	if err != nil {
+		return err
+	}
+
+	value, err := encodeVolumeSnapshots(snapshots)
+	if err != nil {
+		return err
+	}
+
+	return p.addAnnotation(itemContent, AnnotationVolumeSnapshots, value)
+}
+
+// backupResourceIdentifier returns the ResourceIdentifier of a CNPG Backup CR
+func backupResourceIdentifier(backup *unstructured.Unstructured) velero.ResourceIdentifier {
+	return velero.ResourceIdentifier{
+		GroupResource: cnpgBackupGVR.GroupResource(),
+		Namespace:     backup.GetNamespace(),
+		Name:          backup.GetName(),
+	}
 }
 
 func (p *BackupPluginV2) Progress(operationID string, backup *v1.Backup) (velero.OperationProgress, error) {
@@ -325,19 +515,13 @@ func (p *BackupPluginV2) Cancel(operationID string, backup *v1.Backup) error {
 	return nil
 }
 
+// resourceName returns the name of the item for logging, or an empty string when the
+// item has no usable name
 func resourceName(item runtime.Unstructured) string {
-	metadata, found, err := unstructured.NestedFieldNoCopy(item.UnstructuredContent(), "metadata")
-	if err != nil {
-		return ""
-	}
-	if !found {
-		return ""
-	}
-
-	metadataMap, ok := metadata.(map[string]interface{})
-	if !ok {
+	if item == nil {
 		return ""
 	}
 
-	return metadataMap["name"].(string)
+	name, _, _ := unstructured.NestedString(item.UnstructuredContent(), "metadata", "name")
+	return name
 }
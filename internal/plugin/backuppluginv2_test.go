@@ -1,9 +1,11 @@
 package plugin
 
 import (
+	"context"
 	"testing"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -12,11 +14,14 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/dynamic/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
 )
 
 func TestExtractPluginParameters(t *testing.T) {
 	plugin := &BackupPluginV2{
-		log: logrus.New(),
+		log:    logrus.New(),
+		config: DefaultPluginConfig(),
 	}
 
 	tests := []struct {
@@ -152,7 +157,7 @@ func TestExtractPluginParameters(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			serverName, err := plugin.extractPluginParameters(tt.itemContent)
+			serverName, err := plugin.extractPluginParameters(tt.itemContent, "")
 
 			if tt.expectedError {
 				assert.Error(t, err)
@@ -166,7 +171,8 @@ func TestExtractPluginParameters(t *testing.T) {
 
 func TestAddAnnotation(t *testing.T) {
 	plugin := &BackupPluginV2{
-		log: logrus.New(),
+		log:    logrus.New(),
+		config: DefaultPluginConfig(),
 	}
 
 	tests := []struct {
@@ -260,7 +266,8 @@ func TestAddAnnotation(t *testing.T) {
 
 func TestBackupExecute(t *testing.T) {
 	plugin := &BackupPluginV2{
-		log: logrus.New(),
+		log:    logrus.New(),
+		config: DefaultPluginConfig(),
 	}
 
 	tests := []struct {
@@ -380,10 +387,7 @@ func createMockBackup(name, namespace, clusterName, phase, backupID string, crea
 	return backup
 }
 
-func TestGetLatestCompletedBackupID(t *testing.T) {
-	// Note: This test uses a fake dynamic client and won't actually call K8s API
-	// In a real environment, GetDynamicClient() would need to be mocked or dependency-injected
-
+func TestLatestCompletedBackup(t *testing.T) {
 	tests := []struct {
 		name              string
 		namespace         string
@@ -462,39 +466,81 @@ func TestGetLatestCompletedBackupID(t *testing.T) {
 		},
 	}
 
+	plugin := &BackupPluginV2{
+		log:    logrus.New(),
+		config: DefaultPluginConfig(),
+	}
+
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			// Note: This test documents the expected behavior but cannot fully test
-			// the method without mocking GetDynamicClient() or using dependency injection
-			// The actual implementation would need integration tests or mocked client
-
-			// Create scheme and register CNPG backup GVK
-			scheme := runtime.NewScheme()
-			gvk := schema.GroupVersionKind{
-				Group:   "postgresql.cnpg.io",
-				Version: "v1",
-				Kind:    "Backup",
-			}
-			scheme.AddKnownTypeWithName(gvk, &unstructured.Unstructured{})
+			dynamicClient := newFakeDynamicClient(tt.mockBackups...)
 
-			// Create fake dynamic client with mock backups
-			dynamicClient := fake.NewSimpleDynamicClient(scheme, tt.mockBackups...)
+			backups, err := plugin.listClusterBackups(context.Background(), dynamicClient, "", tt.namespace, tt.clusterName)
+			require.NoError(t, err)
+			backup, backupID, err := plugin.latestCompletedBackup(backups, tt.namespace, tt.clusterName)
 
-			// This test validates the logic but would need the plugin method
-			// to accept a client parameter for full testability
-			_ = dynamicClient
+			if tt.expectError {
+				assert.Error(t, err)
+				return
+			}
 
-			// Document expected behavior
-			t.Logf("Expected backup ID: %s", tt.expectedBackupID)
-			t.Logf("Expect error: %v", tt.expectError)
-			t.Logf("Expect empty result: %v", tt.expectEmptyResult)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedBackupID, backupID)
+			if tt.expectEmptyResult {
+				assert.Nil(t, backup)
+			} else {
+				require.NotNil(t, backup)
+				assert.Equal(t, tt.namespace, backup.GetNamespace())
+			}
 		})
 	}
 }
 
+func TestBackupResourceIdentifier(t *testing.T) {
+	backup := createMockBackup("backup-1", "default", "test-cluster", "completed", "backup-id-123", time.Now())
+
+	identifier := backupResourceIdentifier(backup)
+
+	assert.Equal(t, "postgresql.cnpg.io", identifier.Group)
+	assert.Equal(t, "backups", identifier.Resource)
+	assert.Equal(t, "default", identifier.Namespace)
+	assert.Equal(t, "backup-1", identifier.Name)
+}
+
+// newFakeDynamicClient creates a fake dynamic client that knows how to list CNPG Backup resources
+func newFakeDynamicClient(objects ...runtime.Object) *fake.FakeDynamicClient {
+	scheme := runtime.NewScheme()
+	scheme.AddKnownTypeWithName(schema.GroupVersionKind{Group: "postgresql.cnpg.io", Version: "v1", Kind: "Backup"}, &unstructured.Unstructured{})
+	scheme.AddKnownTypeWithName(schema.GroupVersionKind{Group: "postgresql.cnpg.io", Version: "v1", Kind: "Cluster"}, &unstructured.Unstructured{})
+	scheme.AddKnownTypeWithName(schema.GroupVersionKind{Group: "snapshot.storage.k8s.io", Version: "v1", Kind: "VolumeSnapshot"}, &unstructured.Unstructured{})
+	scheme.AddKnownTypeWithName(schema.GroupVersionKind{Group: "snapshot.storage.k8s.io", Version: "v1", Kind: "VolumeSnapshotClass"}, &unstructured.Unstructured{})
+	scheme.AddKnownTypeWithName(schema.GroupVersionKind{Group: "postgresql.cnpg.io", Version: "v1", Kind: "Pooler"}, &unstructured.Unstructured{})
+	scheme.AddKnownTypeWithName(schema.GroupVersionKind{Group: "postgresql.cnpg.io", Version: "v1", Kind: "ScheduledBackup"}, &unstructured.Unstructured{})
+	scheme.AddKnownTypeWithName(schema.GroupVersionKind{Group: "postgresql.cnpg.io", Version: "v1", Kind: "Database"}, &unstructured.Unstructured{})
+	scheme.AddKnownTypeWithName(schema.GroupVersionKind{Group: "barmancloud.cnpg.io", Version: "v1", Kind: "ObjectStore"}, &unstructured.Unstructured{})
+	scheme.AddKnownTypeWithName(schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}, &unstructured.Unstructured{})
+	scheme.AddKnownTypeWithName(schema.GroupVersionKind{Group: "velero.io", Version: "v2alpha1", Kind: "DataUpload"}, &unstructured.Unstructured{})
+
+	return fake.NewSimpleDynamicClientWithCustomListKinds(scheme, map[schema.GroupVersionResource]string{
+		cnpgBackupGVR:          "BackupList",
+		cnpgClusterGVR:         "ClusterList",
+		volumeSnapshotGVR:      "VolumeSnapshotList",
+		volumeSnapshotClassGVR: "VolumeSnapshotClassList",
+		cnpgPoolerGVR:          "PoolerList",
+		cnpgScheduledBackupGVR: "ScheduledBackupList",
+		cnpgDatabaseGVR:        "DatabaseList",
+		cnpgPublicationGVR:     "PublicationList",
+		cnpgSubscriptionGVR:    "SubscriptionList",
+		barmanObjectStoreGVR:   "ObjectStoreList",
+		deploymentGVR:          "DeploymentList",
+		dataUploadGVR:          "DataUploadList",
+	}, objects...)
+}
+
 func TestBackupExecuteWithBackupID(t *testing.T) {
 	plugin := &BackupPluginV2{
-		log: logrus.New(),
+		log:    logrus.New(),
+		config: DefaultPluginConfig(),
 	}
 
 	tests := []struct {
@@ -569,3 +615,152 @@ func TestBackupExecuteWithBackupID(t *testing.T) {
 		})
 	}
 }
+
+func TestBackupExecuteRequireCompletedBackup(t *testing.T) {
+	newItem := func() *unstructured.Unstructured {
+		item := &unstructured.Unstructured{}
+		item.SetUnstructuredContent(map[string]interface{}{
+			"apiVersion": "postgresql.cnpg.io/v1",
+			"kind":       "Cluster",
+			"metadata": map[string]interface{}{
+				"name":      "test-cluster",
+				"namespace": "default",
+			},
+			"spec": map[string]interface{}{
+				"plugins": []interface{}{
+					map[string]interface{}{
+						"name": "barman-cloud.cloudnative-pg.io",
+						"parameters": map[string]interface{}{
+							"barmanObjectName": "test-backup-store",
+							"serverName":       "test-server-123",
+						},
+					},
+				},
+			},
+		})
+		return item
+	}
+
+	backupWithoutID := createMockBackup("backup-1", "default", "test-cluster", "completed", "", time.Now())
+	unstructured.RemoveNestedField(backupWithoutID.Object, "status", "backupId")
+
+	tests := []struct {
+		name                    string
+		requireCompletedBackup  bool
+		mockBackups             []runtime.Object
+		noDynamicClient         bool
+		backupsNotServed        bool
+		listErr                 error
+		expectedError           string
+		expectedBackupID        string
+		expectedAdditionalItems int
+	}{
+		{
+			name:                   "no completed backup - warning only",
+			requireCompletedBackup: false,
+			mockBackups: []runtime.Object{
+				createMockBackup("backup-1", "default", "test-cluster", "running", "backup-id-123", time.Now()),
+			},
+		},
+		{
+			name:                   "no completed backup - strict mode fails",
+			requireCompletedBackup: true,
+			mockBackups: []runtime.Object{
+				createMockBackup("backup-1", "default", "test-cluster", "failed", "backup-id-123", time.Now()),
+			},
+			expectedError: "no completed CNPG backup found for cluster default/test-cluster",
+		},
+		{
+			name:                   "no backups at all - strict mode fails",
+			requireCompletedBackup: true,
+			expectedError:          "no completed CNPG backup found for cluster default/test-cluster",
+		},
+		{
+			name:                   "dynamic client unavailable - strict mode fails",
+			requireCompletedBackup: true,
+			noDynamicClient:        true,
+			expectedError:          "cannot find a completed CNPG backup of cluster default/test-cluster, the Velero backup may not be restorable (requireCompletedBackup is enabled): failed to create dynamic client",
+		},
+		{
+			name:                   "backups not served - strict mode fails",
+			requireCompletedBackup: true,
+			backupsNotServed:       true,
+			expectedError:          "cannot find a completed CNPG backup of cluster default/test-cluster, the Velero backup may not be restorable (requireCompletedBackup is enabled): the API server does not serve backups.postgresql.cnpg.io",
+		},
+		{
+			name:                   "backups not served - warning only",
+			requireCompletedBackup: false,
+			backupsNotServed:       true,
+		},
+		{
+			name:                   "backup list fails - strict mode fails",
+			requireCompletedBackup: true,
+			listErr:                errors.New("timed out waiting for a Backup list slot"),
+			expectedError:          "cannot find a completed CNPG backup of cluster default/test-cluster, the Velero backup may not be restorable (requireCompletedBackup is enabled)",
+		},
+		{
+			name:                   "backup list fails - warning only",
+			requireCompletedBackup: false,
+			listErr:                errors.New("timed out waiting for a Backup list slot"),
+		},
+		{
+			name:                   "invalid latest backup - strict mode fails",
+			requireCompletedBackup: true,
+			mockBackups:            []runtime.Object{backupWithoutID},
+			expectedError:          "cannot find a completed CNPG backup of cluster default/test-cluster, the Velero backup may not be restorable (requireCompletedBackup is enabled): invalid latest completed CNPG backup",
+		},
+		{
+			name:                   "completed backup - strict mode passes",
+			requireCompletedBackup: true,
+			mockBackups: []runtime.Object{
+				createMockBackup("backup-1", "default", "test-cluster", "completed", "backup-id-123", time.Now()),
+			},
+			expectedBackupID:        "backup-id-123",
+			expectedAdditionalItems: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dynamicClient := newFakeDynamicClient(tt.mockBackups...)
+			if tt.listErr != nil {
+				dynamicClient.PrependReactor("list", "backups", func(k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, tt.listErr
+				})
+			}
+			plugin := &BackupPluginV2{
+				log:           logrus.New(),
+				config:        &PluginConfig{RequireCompletedBackup: tt.requireCompletedBackup},
+				dynamicClient: dynamicClient,
+			}
+			if tt.backupsNotServed {
+				plugin.kubeClient = kubefake.NewClientset()
+			}
+			if tt.noDynamicClient {
+				t.Setenv(EnvKubeconfig, "/nonexistent/kubeconfig")
+				plugin.dynamicClient = nil
+			}
+
+			resultItem, additionalItems, _, _, err := plugin.Execute(newItem(), nil)
+
+			if tt.expectedError != "" {
+				assert.ErrorContains(t, err, tt.expectedError)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Len(t, additionalItems, tt.expectedAdditionalItems)
+
+			annotations := resultItem.(*unstructured.Unstructured).GetAnnotations()
+			assert.Equal(t, "test-server-123", annotations[AnnotationServerName])
+			if tt.expectedBackupID != "" {
+				assert.Equal(t, tt.expectedBackupID, annotations[AnnotationCurrentBackupID])
+				assert.Equal(t, "backup-1", annotations[AnnotationCurrentBackupName])
+				assert.Equal(t, "backup-1", additionalItems[0].Name)
+			} else {
+				_, hasBackupID := annotations[AnnotationCurrentBackupID]
+				assert.False(t, hasBackupID)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package plugin
+
+import (
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// AnnotationBackupPhase is the annotation key used to store the status.phase of a cluster
+// that was not healthy when it was backed up
+const AnnotationBackupPhase = "velero-cnpg/backup-phase"
+
+// unhealthyPhase returns the status.phase of a cluster that is not healthy, or "" for
+// healthy clusters. Clusters without a phase, which the operator has not reconciled yet,
+// and hibernated clusters, which are down on purpose, are not reported.
+func unhealthyPhase(itemContent map[string]interface{}) string {
+	if isHibernated(itemContent) {
+		return ""
+	}
+	phase, _, _ := unstructured.NestedString(itemContent, "status", "phase")
+	if phase == clusterPhaseHealthy {
+		return ""
+	}
+	return phase
+}
+
+// checkClusterPhase handles a cluster that is not healthy at backup time according to
+// policy: warn logs a warning, annotate also records the phase for the restore, and fail
+// fails the backup of the cluster. A phase recorded by an earlier backup, which a restored
+// cluster carries, is removed first.
+func (p *BackupPluginV2) checkClusterPhase(itemContent map[string]interface{}, policy string) error {
+	unstructured.RemoveNestedField(itemContent, "metadata", "annotations", AnnotationBackupPhase)
+
+	phase := unhealthyPhase(itemContent)
+	if phase == "" {
+		return nil
+	}
+
+	cluster := &unstructured.Unstructured{Object: itemContent}
+	if policy == UnhealthyClusterFail {
+		return errors.Errorf("cluster %s/%s is in phase %q, its latest completed backup may predate important data (unhealthyClusterPolicy is %s)", cluster.GetNamespace(), cluster.GetName(), phase, UnhealthyClusterFail)
+	}
+
+	p.log.Warnf("Cluster is in phase %q, its latest completed backup may predate important data", phase)
+	if policy == UnhealthyClusterAnnotate {
+		if err := p.addAnnotation(itemContent, AnnotationBackupPhase, phase); err != nil {
+			p.log.Warnf("Failed to annotate backup phase: %v", err)
+		}
+	}
+	return nil
+}
+
+// warnBackupPhase records a restore warning for clusters that were not healthy when they
+// were backed up
+func (p *RestorePluginV2) warnBackupPhase(itemContent map[string]interface{}, warnings *restoreWarnings) error {
+	phase, found, err := p.getAnnotation(itemContent, AnnotationBackupPhase)
+	if err != nil || !found {
+		return err
+	}
+	warnings.Warnf("Cluster was in phase %q when backed up, the backup it recovers from may predate important data", phase)
+	return nil
+}
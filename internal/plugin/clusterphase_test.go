@@ -0,0 +1,78 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestUnhealthyPhase(t *testing.T) {
+	withPhase := func(phase string) map[string]interface{} {
+		cluster := createMockArchivingCluster("pg", "default", "pg", nil)
+		if phase != "" {
+			cluster.Object["status"] = map[string]interface{}{"phase": phase}
+		}
+		return cluster.Object
+	}
+	hibernated := withPhase("Cluster in hibernation")
+	(&unstructured.Unstructured{Object: hibernated}).SetAnnotations(map[string]string{AnnotationHibernation: HibernationOn})
+
+	assert.Equal(t, "", unhealthyPhase(withPhase(clusterPhaseHealthy)))
+	assert.Equal(t, "", unhealthyPhase(withPhase("")))
+	assert.Equal(t, "", unhealthyPhase(hibernated))
+	assert.Equal(t, "Setting up primary", unhealthyPhase(withPhase("Setting up primary")))
+	assert.Equal(t, "Upgrading cluster", unhealthyPhase(withPhase("Upgrading cluster")))
+}
+
+func TestCheckClusterPhase(t *testing.T) {
+	tests := []struct {
+		name             string
+		phase            string
+		policy           string
+		expectedError    string
+		expectAnnotation bool
+	}{
+		{name: "healthy", phase: clusterPhaseHealthy, policy: UnhealthyClusterFail},
+		{name: "warn", phase: "Setting up primary"},
+		{name: "annotate", phase: "Setting up primary", policy: UnhealthyClusterAnnotate, expectAnnotation: true},
+		{name: "fail", phase: "Failing over", policy: UnhealthyClusterFail, expectedError: `cluster default/pg is in phase "Failing over"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := createMockArchivingCluster("pg", "default", "pg", nil)
+			cluster.SetAnnotations(map[string]string{AnnotationBackupPhase: "Failing over"})
+			cluster.Object["status"] = map[string]interface{}{"phase": tt.phase}
+
+			err := (&BackupPluginV2{log: logrus.New()}).checkClusterPhase(cluster.Object, tt.policy)
+			if tt.expectedError != "" {
+				assert.ErrorContains(t, err, tt.expectedError)
+				return
+			}
+			require.NoError(t, err)
+
+			phase, found := cluster.GetAnnotations()[AnnotationBackupPhase]
+			assert.Equal(t, tt.expectAnnotation, found)
+			if tt.expectAnnotation {
+				assert.Equal(t, tt.phase, phase)
+			}
+		})
+	}
+}
+
+func TestWarnBackupPhase(t *testing.T) {
+	plugin := &RestorePluginV2{log: logrus.New()}
+
+	cluster := createMockArchivingCluster("pg", "default", "pg", nil)
+	warnings := &restoreWarnings{log: logrus.New()}
+	require.NoError(t, plugin.warnBackupPhase(cluster.Object, warnings))
+	assert.Empty(t, warnings.messages)
+
+	cluster.SetAnnotations(map[string]string{AnnotationBackupPhase: "Setting up primary"})
+	require.NoError(t, plugin.warnBackupPhase(cluster.Object, warnings))
+	require.Len(t, warnings.messages, 1)
+	assert.Contains(t, warnings.messages[0], `phase "Setting up primary"`)
+}
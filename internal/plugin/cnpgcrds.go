@@ -0,0 +1,130 @@
+package plugin
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// cnpgGroupVersion is the API group and version the CNPG resources are served under
+const cnpgGroupVersion = "postgresql.cnpg.io/v1"
+
+const (
+	// cnpgResourceClusters is the resource of CNPG Clusters
+	cnpgResourceClusters = "clusters"
+
+	// cnpgResourceBackups is the resource of CNPG Backups
+	cnpgResourceBackups = "backups"
+)
+
+// cnpgServed remembers, per Kubernetes client, the CNPG resources discovery found served,
+// so every item after the first is not checked again. Missing resources are checked on
+// every item, since the operator may be installed while a restore runs.
+var cnpgServed sync.Map
+
+// cnpgAPIResources lists the CNPG resources the plugin needs, as discovery serves them
+// once CNPG is installed
+func cnpgAPIResources() []*metav1.APIResourceList {
+	return []*metav1.APIResourceList{{
+		GroupVersion: cnpgGroupVersion,
+		APIResources: []metav1.APIResource{
+			{Name: cnpgResourceClusters, Kind: "Cluster", Namespaced: true},
+			{Name: cnpgResourceBackups, Kind: "Backup", Namespaced: true},
+		},
+	}}
+}
+
+// missingCNPGResources returns the CRD names of the given CNPG resources that the API
+// server does not serve, because CNPG is not installed or is too old to know them
+func missingCNPGResources(client kubernetes.Interface, resources ...string) ([]string, error) {
+	served, _ := cnpgServed.LoadOrStore(client, &sync.Map{})
+
+	var unchecked []string
+	for _, resource := range resources {
+		if _, found := served.(*sync.Map).Load(resource); !found {
+			unchecked = append(unchecked, resource)
+		}
+	}
+	if len(unchecked) == 0 {
+		return nil, nil
+	}
+
+	list, err := client.Discovery().ServerResourcesForGroupVersion(cnpgGroupVersion)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, errors.Wrapf(classifyAPIError(err), "failed to discover the %s resources", cnpgGroupVersion)
+	}
+
+	discovered := map[string]bool{}
+	if list != nil {
+		for _, resource := range list.APIResources {
+			discovered[resource.Name] = true
+		}
+	}
+
+	var missing []string
+	for _, resource := range unchecked {
+		if discovered[resource] {
+			served.(*sync.Map).Store(resource, true)
+		} else {
+			missing = append(missing, resource+".postgresql.cnpg.io")
+		}
+	}
+
+	return missing, nil
+}
+
+// checkCNPGInstalled fails the restore of a cluster into a Kubernetes cluster without CNPG
+// with a clear error, rather than leaving Velero to fail creating it. A missing Backup CRD
+// only breaks the backups taken after the restore, so it is a restore warning. When
+// discovery fails, the check is skipped with a log message.
+func (p *RestorePluginV2) checkCNPGInstalled(warnings *restoreWarnings) error {
+	client, err := p.getKubeClient()
+	if err != nil {
+		p.log.Warnf("Failed to get Kubernetes client, skipping the CNPG installation check: %v", err)
+		return nil
+	}
+
+	missing, err := missingCNPGResources(client, cnpgResourceClusters, cnpgResourceBackups)
+	if err != nil {
+		p.log.Warnf("Skipping the CNPG installation check: %v", err)
+		return nil
+	}
+
+	for _, crd := range missing {
+		if crd == clusterCRDName {
+			return &NotFoundError{Err: errors.Errorf("CNPG is not installed in the destination cluster: the API server does not serve %s, install the CNPG operator before restoring clusters", strings.Join(missing, " or "))}
+		}
+	}
+	if len(missing) > 0 {
+		warnings.Warnf("The destination cluster does not serve %s, so the restored cluster cannot be backed up until CNPG is upgraded", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// cnpgBackupsServed reports whether the backup action can list the CNPG Backups of the
+// cluster. When discovery fails it assumes they are, leaving the list call to report
+// the failure.
+func (p *BackupPluginV2) cnpgBackupsServed() bool {
+	client, err := p.getKubeClient()
+	if err != nil {
+		p.log.Warnf("Failed to get Kubernetes client, skipping the CNPG installation check: %v", err)
+		return true
+	}
+
+	missing, err := missingCNPGResources(client, cnpgResourceBackups)
+	if err != nil {
+		p.log.Warnf("Skipping the CNPG installation check: %v", err)
+		return true
+	}
+	if len(missing) > 0 {
+		p.log.Warnf("The API server does not serve %s, so no CNPG backup can be pinned", strings.Join(missing, ", "))
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,83 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newFakeKubeClient returns a fake clientset of a Kubernetes cluster with CNPG installed
+func newFakeKubeClient(objects ...runtime.Object) *fake.Clientset {
+	client := fake.NewClientset(objects...)
+	client.Resources = cnpgAPIResources()
+	return client
+}
+
+func TestMissingCNPGResources(t *testing.T) {
+	client := fake.NewClientset()
+
+	missing, err := missingCNPGResources(client, cnpgResourceClusters, cnpgResourceBackups)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"clusters.postgresql.cnpg.io", "backups.postgresql.cnpg.io"}, missing)
+
+	// An operator too old to serve Backups
+	client.Resources = []*metav1.APIResourceList{{
+		GroupVersion: cnpgGroupVersion,
+		APIResources: []metav1.APIResource{{Name: cnpgResourceClusters}},
+	}}
+	missing, err = missingCNPGResources(client, cnpgResourceClusters, cnpgResourceBackups)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"backups.postgresql.cnpg.io"}, missing)
+
+	// Served resources are not discovered again
+	client.Resources = cnpgAPIResources()
+	client.PrependReactor("get", "resource", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("connection refused")
+	})
+	missing, err = missingCNPGResources(client, cnpgResourceClusters)
+	require.NoError(t, err)
+	assert.Empty(t, missing)
+
+	_, err = missingCNPGResources(client, cnpgResourceBackups)
+	assert.ErrorContains(t, err, "connection refused")
+}
+
+func TestRestoreExecuteWithoutCNPG(t *testing.T) {
+	plugin := &RestorePluginV2{
+		log:           logrus.New(),
+		config:        DefaultPluginConfig(),
+		dynamicClient: newFakeDynamicClient(),
+		kubeClient:    fake.NewClientset(),
+	}
+
+	_, err := plugin.Execute(&velero.RestoreItemActionExecuteInput{Item: createMockPluginCluster("pg", "default")})
+	assert.ErrorContains(t, err, "CNPG is not installed in the destination cluster")
+	assert.Equal(t, ErrorKindNotFound, ErrorKind(err))
+}
+
+func TestBackupExecuteWithoutCNPGBackups(t *testing.T) {
+	client := fake.NewClientset()
+	client.Resources = []*metav1.APIResourceList{{
+		GroupVersion: cnpgGroupVersion,
+		APIResources: []metav1.APIResource{{Name: cnpgResourceClusters}},
+	}}
+	plugin := &BackupPluginV2{
+		log:           logrus.New(),
+		config:        &PluginConfig{},
+		dynamicClient: newFakeDynamicClient(),
+		kubeClient:    client,
+	}
+
+	result, _, _, _, err := plugin.Execute(createMockPluginCluster("pg", "default"), nil)
+	require.NoError(t, err)
+	assert.Equal(t, SkipReasonBackupListFailed, result.(*unstructured.Unstructured).GetAnnotations()[AnnotationSkipReason])
+}
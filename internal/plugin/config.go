@@ -0,0 +1,1616 @@
+package plugin
+
+import (
+	"encoding/json"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework/common"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// RestorePluginName is the name the CNPG restore action is registered under
+	RestorePluginName = "replicated.com/cnpg-restore-plugin"
+
+	// BackupPluginName is the name the CNPG backup action is registered under
+	BackupPluginName = "replicated.com/cnpg-backup-plugin"
+
+	// DeploymentRestorePluginName is the name the Deployment restore action is registered under
+	DeploymentRestorePluginName = "replicated.com/deployment-restore-plugin"
+
+	// OverrideConfigMapRestorePluginName is the name the override ConfigMap restore action is registered under
+	OverrideConfigMapRestorePluginName = "replicated.com/cnpg-override-configmap-restore-plugin"
+
+	// PDBRestorePluginName is the name the PodDisruptionBudget restore action is registered under
+	PDBRestorePluginName = "replicated.com/cnpg-pdb-restore-plugin"
+
+	// ResourcePatchRestorePluginName is the name the resource patch action is registered under
+	ResourcePatchRestorePluginName = "replicated.com/cnpg-resource-patch-plugin"
+
+	// DependentsRestorePluginName is the name the CNPG dependent resources restore action is registered under
+	DependentsRestorePluginName = "replicated.com/cnpg-dependents-restore-plugin"
+
+	// SnapshotFencingPluginName is the name the PVC snapshot fencing action is registered under
+	SnapshotFencingPluginName = "replicated.com/cnpg-snapshot-fencing-plugin"
+
+	// DefaultVeleroNamespace is used to look up plugin configuration when
+	// VELERO_NAMESPACE is not set in the plugin environment
+	DefaultVeleroNamespace = "velero"
+)
+
+const (
+	// RestoreModeRecovery bootstraps restored clusters from the barman object store (default)
+	RestoreModeRecovery = "recovery"
+
+	// RestoreModePgBaseBackup bootstraps restored clusters by cloning a running source cluster
+	RestoreModePgBaseBackup = "pg_basebackup"
+
+	// RestoreModeImport bootstraps restored clusters with a logical import from a running source cluster
+	RestoreModeImport = "import"
+
+	// RestoreModeStandby bootstraps restored clusters by cloning a running source cluster and
+	// keeps them streaming from it as a replica cluster
+	RestoreModeStandby = "standby"
+)
+
+const (
+	// FencingInstancesPrimary fences only the primary instance while its PVCs are snapshotted
+	FencingInstancesPrimary = "primary"
+
+	// FencingInstancesAll fences every instance while its PVCs are snapshotted
+	FencingInstancesAll = "all"
+)
+
+const (
+	// ArchiveConflictFail fails the restore of a cluster that would archive WAL to the same
+	// location as a live cluster (default)
+	ArchiveConflictFail = "fail"
+
+	// ArchiveConflictRename gives a cluster that would archive WAL to the same location as a
+	// live cluster a new serverName
+	ArchiveConflictRename = "rename"
+)
+
+const (
+	// ServerNameTimestamp names new serverNames after the cluster, the time of the restore
+	// and a random suffix (default)
+	ServerNameTimestamp = "timestamp"
+
+	// ServerNameRestoreUID names new serverNames after the cluster and the UID of the
+	// Velero restore
+	ServerNameRestoreUID = "restoreUID"
+
+	// ServerNameSequence names new serverNames after the cluster and the next number of
+	// the serverNames it archived to before
+	ServerNameSequence = "sequence"
+
+	// ServerNameWebhook asks an external webhook for new serverNames
+	ServerNameWebhook = "webhook"
+)
+
+const (
+	// WebhookEventPreBackup is sent before the backup action processes a cluster
+	WebhookEventPreBackup = "preBackup"
+
+	// WebhookEventPostBackup is sent once the backup action has processed a cluster
+	WebhookEventPostBackup = "postBackup"
+
+	// WebhookEventPreRestore is sent before the restore action changes a cluster
+	WebhookEventPreRestore = "preRestore"
+
+	// WebhookEventPostRestore is sent once the restore action has processed a cluster
+	WebhookEventPostRestore = "postRestore"
+)
+
+const (
+	// WebhookFailureIgnore records a failed webhook call as a warning and carries on (default)
+	WebhookFailureIgnore = "ignore"
+
+	// WebhookFailureFail fails the backup or restore of the cluster when its webhook call fails
+	WebhookFailureFail = "fail"
+)
+
+const (
+	// NotificationFormatJSON POSTs the restore summary as JSON (default)
+	NotificationFormatJSON = "json"
+
+	// NotificationFormatSlack POSTs the restore summary as a Slack incoming webhook message
+	NotificationFormatSlack = "slack"
+)
+
+const (
+	// DisabledPluginSkip ignores plugin entries with enabled: false when reading the
+	// serverName at backup time (default)
+	DisabledPluginSkip = "skip"
+
+	// DisabledPluginWarn records the serverName of a disabled plugin entry with a warning
+	DisabledPluginWarn = "warn"
+
+	// DisabledPluginFail fails the backup of clusters whose WAL archiver plugin entry is disabled
+	DisabledPluginFail = "fail"
+)
+
+const (
+	// WatchScopeWarn records a restore warning for clusters restored into a namespace the
+	// CNPG operator does not watch (default)
+	WatchScopeWarn = "warn"
+
+	// WatchScopeFail fails the restore of clusters restored into a namespace the CNPG
+	// operator does not watch
+	WatchScopeFail = "fail"
+)
+
+const (
+	// TrackingMetadataKeep restores the Argo CD and Flux tracking metadata of CNPG resources
+	// as backed up (default)
+	TrackingMetadataKeep = "keep"
+
+	// TrackingMetadataStrip removes the Argo CD and Flux tracking metadata of restored CNPG
+	// resources, so the controllers of the source cluster's applications do not claim them
+	TrackingMetadataStrip = "strip"
+)
+
+const (
+	// IntegrityFail fails the restore of clusters whose plugin annotations do not match the
+	// digest recorded at backup time (default)
+	IntegrityFail = "fail"
+
+	// IntegrityWarn records a restore warning for clusters whose plugin annotations do not
+	// match the digest recorded at backup time
+	IntegrityWarn = "warn"
+)
+
+const (
+	// OverrideConflictOverwrite replaces the keys an earlier restore wrote for a cluster to
+	// the override ConfigMap (default)
+	OverrideConflictOverwrite = "overwrite"
+
+	// OverrideConflictMerge replaces the keys the restore writes for a cluster to the
+	// override ConfigMap and keeps the other keys of the cluster from earlier restores
+	OverrideConflictMerge = "merge"
+
+	// OverrideConflictFail fails the restore of clusters whose keys an earlier restore
+	// wrote to the override ConfigMap
+	OverrideConflictFail = "fail"
+)
+
+const (
+	// SkipReasonPolicyLatest recovers a cluster backed up without a pinned backup ID from
+	// the latest backup in the object store, with a restore warning (default)
+	SkipReasonPolicyLatest = "latest"
+
+	// SkipReasonPolicyFail fails the restore of a cluster backed up without a pinned backup ID
+	SkipReasonPolicyFail = "fail"
+)
+
+const (
+	// UnhealthyClusterWarn logs a warning when a cluster is not healthy at backup time (default)
+	UnhealthyClusterWarn = "warn"
+
+	// UnhealthyClusterAnnotate also records the phase of a cluster that is not healthy at
+	// backup time, so restores of it carry a restore warning
+	UnhealthyClusterAnnotate = "annotate"
+
+	// UnhealthyClusterFail fails the backup of clusters that are not healthy
+	UnhealthyClusterFail = "fail"
+)
+
+const (
+	// PromotionNever keeps replica clusters in replica mode until they are promoted by hand (default)
+	PromotionNever = "never"
+
+	// PromotionImmediate promotes restored clusters as soon as recovery completes, like a
+	// restore without replica mode
+	PromotionImmediate = "immediate"
+
+	// PromotionAfter promotes replica clusters once they have replicated healthily for
+	// the configured duration
+	PromotionAfter = "after"
+)
+
+const (
+	// HookOnErrorFail fails the backup of the cluster when a hook fails (default)
+	HookOnErrorFail = "fail"
+
+	// HookOnErrorContinue logs a failed hook and carries on with the backup
+	HookOnErrorContinue = "continue"
+)
+
+const (
+	// MutationStepOverrideConfigMap writes the serverNames of a restored cluster to the
+	// override ConfigMap
+	MutationStepOverrideConfigMap = "overrideConfigMap"
+
+	// MutationStepStripEphemeralFields removes the status and server-assigned metadata
+	MutationStepStripEphemeralFields = "stripEphemeralFields"
+
+	// MutationStepRotateServerName gives a restored cluster a new serverName to archive to
+	MutationStepRotateServerName = "rotateServerName"
+
+	// MutationStepExternalClusters adds the externalClusters entry a restored cluster
+	// bootstraps from
+	MutationStepExternalClusters = "externalClusters"
+
+	// MutationStepBootstrap replaces the bootstrap section for the restore mode
+	MutationStepBootstrap = "bootstrap"
+)
+
+// DefaultMutationSteps are the mutations the restore action applies to restored clusters,
+// in order, when mutationSteps is not set
+var DefaultMutationSteps = []string{
+	MutationStepOverrideConfigMap,
+	MutationStepStripEphemeralFields,
+	MutationStepRotateServerName,
+	MutationStepExternalClusters,
+	MutationStepBootstrap,
+}
+
+const (
+	// ManagedPathPlugins is the CNPG-I plugin list, whose WAL archiver entry the restore
+	// action points at the serverName and barmanObjectName to archive to
+	ManagedPathPlugins = "/spec/plugins"
+
+	// ManagedPathBootstrap is the bootstrap section the restore action replaces
+	ManagedPathBootstrap = "/spec/bootstrap"
+
+	// ManagedPathExternalClusters is the list the restore action adds recovery sources to
+	ManagedPathExternalClusters = "/spec/externalClusters"
+)
+
+// ManagedPaths are the fields of restored clusters that the restore action sets and that
+// Velero resource modifiers may patch as well
+var ManagedPaths = []string{ManagedPathPlugins, ManagedPathBootstrap, ManagedPathExternalClusters}
+
+// ResourceProfileOriginal keeps the resources of the backed-up cluster
+const ResourceProfileOriginal = "original"
+
+const (
+	// RetentionPolicyOriginal sets the retention policy recorded at backup time on restored clusters
+	RetentionPolicyOriginal = "original"
+
+	// RetentionPolicyNone removes the retention policy of restored clusters
+	RetentionPolicyNone = "none"
+)
+
+// retentionPolicyPattern matches the retention policies CNPG accepts, e.g. 30d, 4w or 6m
+var retentionPolicyPattern = regexp.MustCompile(`^[1-9][0-9]*[dwm]$`)
+
+const (
+	// ImportTypeMicroservice imports a single database into the application database
+	ImportTypeMicroservice = "microservice"
+
+	// ImportTypeMonolith imports several databases and roles at once
+	ImportTypeMonolith = "monolith"
+)
+
+// PluginConfig holds the settings read from the plugin ConfigMap.
+//
+// The ConfigMap lives in the Velero namespace and follows the Velero plugin
+// configuration convention, e.g. for the restore action:
+//
+//	labels:
+//	  velero.io/plugin-config: ""
+//	  replicated.com/cnpg-restore-plugin: RestoreItemAction
+//
+// Every data key maps to a top-level field below. Values are parsed as YAML,
+// so scalar settings can be written inline and nested sections as YAML blocks.
+type PluginConfig struct {
+	// LabelSelector restricts the restore action to clusters matching the selector, so
+	// several named instances of the action can serve different application tiers
+	LabelSelector string `json:"labelSelector,omitempty"`
+
+	// BarmanObjectNames maps the barman-cloud ObjectStore names of backed-up clusters to
+	// the ObjectStore names to use in the destination cluster
+	BarmanObjectNames map[string]string `json:"barmanObjectNames,omitempty"`
+
+	// ProviderParameters are extra barman-cloud plugin parameters, keyed by the ObjectStore
+	// name used in the destination cluster, merged into the plugin parameters of the
+	// externalClusters entries restored clusters recover from, e.g. for provider settings
+	// such as an S3 endpoint, a GCS credentials mode or an Azure storage account
+	ProviderParameters map[string]map[string]string `json:"providerParameters,omitempty"`
+
+	// RecoveryParameters selects the parameters of the backed-up cluster's WAL archiver
+	// plugin entry copied into the externalClusters entry restored clusters recover from.
+	// Without it, only barmanObjectName and serverName are set there.
+	RecoveryParameters *RecoveryParametersConfig `json:"recoveryParameters,omitempty"`
+
+	// IntegrityPolicy decides what happens to a restored cluster whose plugin annotations
+	// do not match the digest recorded at backup time: fail (default) or warn
+	IntegrityPolicy string `json:"integrityPolicy,omitempty"`
+
+	// Strict fails the backup or restore of a cluster on any warning the backup and
+	// restore actions log for it, instead of continuing with partial protection
+	Strict bool `json:"strict,omitempty"`
+
+	// OptIn limits the backup, restore and snapshot fencing actions to clusters annotated
+	// velero-cnpg/enabled=true, leaving all other clusters unmodified
+	OptIn bool `json:"optIn,omitempty"`
+
+	// IncludedNamespaces limits the action to items in these namespaces, and
+	// ExcludedNamespaces keeps it away from the items of these, so Velero backs them up or
+	// restores them untouched. Both take Velero's namespace globs and exclusions win.
+	IncludedNamespaces []string `json:"includedNamespaces,omitempty"`
+	ExcludedNamespaces []string `json:"excludedNamespaces,omitempty"`
+
+	// RequireCompletedBackup fails the backup of a cluster that has no completed
+	// CNPG backup instead of only logging a warning
+	RequireCompletedBackup bool `json:"requireCompletedBackup,omitempty"`
+
+	// CreateRestorePoints creates a PostgreSQL restore point named after the Velero backup
+	// on the primary of every backed-up cluster
+	CreateRestorePoints bool `json:"createRestorePoints,omitempty"`
+
+	// RecordSizeMetrics records the instance count, database size and WAL rate of every
+	// backed-up cluster, so restores can be planned for their storage and duration
+	RecordSizeMetrics bool `json:"recordSizeMetrics,omitempty"`
+
+	// BackupOperatorConfig backs up the CNPG operator Deployment and its configuration
+	// ConfigMap with each cluster and records the operator settings that affect recovery,
+	// so the restore can warn about a destination operator configured differently
+	BackupOperatorConfig bool `json:"backupOperatorConfig,omitempty"`
+
+	// RecoverToRestorePoint stops the recovery of restored clusters at the restore point
+	// created with the Velero backup, instead of the end of the WAL archive
+	RecoverToRestorePoint bool `json:"recoverToRestorePoint,omitempty"`
+
+	// BackupHooks runs SQL on the primary before and after each cluster is backed up
+	BackupHooks *BackupHooksConfig `json:"backupHooks,omitempty"`
+
+	// Webhooks are HTTP endpoints called before and after clusters are backed up or
+	// restored, which can deny them or, before a restore, set its recovery target
+	Webhooks []WebhookConfig `json:"webhooks,omitempty"`
+
+	// DisasterRecovery adapts clusters restored from a backup of another Kubernetes cluster
+	// to the destination cluster
+	DisasterRecovery *DisasterRecoveryConfig `json:"disasterRecovery,omitempty"`
+
+	// SnapshotFencing fences instances while Velero takes CSI snapshots of their PVCs
+	SnapshotFencing *SnapshotFencingConfig `json:"snapshotFencing,omitempty"`
+
+	// RestoreMode selects how restored clusters are bootstrapped
+	RestoreMode string `json:"restoreMode,omitempty"`
+
+	// SourceCluster describes the live cluster used by connection-based restore modes
+	SourceCluster *SourceClusterConfig `json:"sourceCluster,omitempty"`
+
+	// Import configures bootstrap.initdb.import for the import restore mode
+	Import *ImportConfig `json:"import,omitempty"`
+
+	// Replica restores clusters as replica clusters that keep replaying WAL from the
+	// backup's object store (recovery mode only)
+	Replica *ReplicaConfig `json:"replica,omitempty"`
+
+	// WALRestore tunes how recovered clusters fetch WAL from the backup's object store
+	WALRestore *WALRestoreConfig `json:"walRestore,omitempty"`
+
+	// Scheduling relaxes scheduling constraints on restored clusters
+	Scheduling *SchedulingConfig `json:"scheduling,omitempty"`
+
+	// ResourceProfile names the entry of ResourceProfiles applied to restored clusters.
+	// The built-in "original" profile keeps spec.resources unchanged.
+	ResourceProfile string `json:"resourceProfile,omitempty"`
+
+	// ResourceProfiles are named spec.resources replacements
+	ResourceProfiles map[string]ResourceProfile `json:"resourceProfiles,omitempty"`
+
+	// ExcludeOverrideConfigMapFromBackup labels the override ConfigMap written on restore
+	// so that it is left out of later Velero backups
+	ExcludeOverrideConfigMapFromBackup bool `json:"excludeOverrideConfigMapFromBackup,omitempty"`
+
+	// OverrideConflictPolicy decides what happens when the override ConfigMap already
+	// holds keys of a restored cluster from an earlier restore: overwrite (default), merge
+	// or fail
+	OverrideConflictPolicy string `json:"overrideConflictPolicy,omitempty"`
+
+	// ResumeHibernatedClusters removes the hibernation annotation from restored clusters
+	ResumeHibernatedClusters bool `json:"resumeHibernatedClusters,omitempty"`
+
+	// MutationSteps lists the mutations applied to clusters the restore action configures
+	// for a restore mode, in order. Steps left out are skipped, e.g. to keep a hand-written
+	// bootstrap section. Defaults to DefaultMutationSteps.
+	MutationSteps []string `json:"mutationSteps,omitempty"`
+
+	// PassThroughUnmanagedClusters restores clusters without plugin annotations exactly as
+	// backed up, instead of removing their status and server-assigned metadata
+	PassThroughUnmanagedClusters bool `json:"passThroughUnmanagedClusters,omitempty"`
+
+	// ValidatePoolers waits after the restore for the Poolers recorded at backup time to
+	// be present and bound to the restored cluster
+	ValidatePoolers bool `json:"validatePoolers,omitempty"`
+
+	// TrackRecovery keeps the restore waiting until each restored cluster is healthy,
+	// reporting its ready instances and the LSN its primary has replayed to
+	TrackRecovery bool `json:"trackRecovery,omitempty"`
+
+	// ClusterOnly restores CNPG clusters without their Poolers, ScheduledBackups, Databases,
+	// Publications and Subscriptions, which are left to be re-synced afterwards
+	ClusterOnly bool `json:"clusterOnly,omitempty"`
+
+	// Rehearsal restores CNPG clusters and their dependent resources into a scratch
+	// namespace as a drill, with WAL archiving disabled
+	Rehearsal *RehearsalConfig `json:"rehearsal,omitempty"`
+
+	// GitOps stamps restored clusters with the labels and annotations Argo CD or Flux need
+	// to adopt them rather than prune them
+	GitOps *GitOpsConfig `json:"gitOps,omitempty"`
+
+	// YieldToResourceModifiers lists the ManagedPaths left as backed up when a resource
+	// modifier rule of the restore patches them, so the user's patch applies to the backed-up
+	// spec instead of the one generated for recovery
+	YieldToResourceModifiers []string `json:"yieldToResourceModifiers,omitempty"`
+
+	// ReconstructPluginParameters puts back the spec.plugins parameters recorded at backup
+	// time when the restored spec has them changed
+	ReconstructPluginParameters bool `json:"reconstructPluginParameters,omitempty"`
+
+	// CheckQuotas records a restore warning when the ResourceQuotas or LimitRanges of the
+	// namespace would leave the pods or PVCs of a restored cluster rejected or unschedulable
+	CheckQuotas bool `json:"checkQuotas,omitempty"`
+
+	// SeedBackup takes a CNPG backup of each recovered cluster once it is healthy, so its
+	// new serverName has a base backup and the restore waits for it
+	SeedBackup bool `json:"seedBackup,omitempty"`
+
+	// Notification sends a summary of the restored clusters, what they recovered to and
+	// their health to a webhook once they are healthy, and the restore waits for it
+	Notification *NotificationConfig `json:"notification,omitempty"`
+
+	// ScheduledBackupTemplate is used to create a ScheduledBackup for recovered clusters
+	// that come back without one
+	ScheduledBackupTemplate *ScheduledBackupConfig `json:"scheduledBackupTemplate,omitempty"`
+
+	// RetentionPolicy sets the retention policy of the new serverName of restored clusters:
+	// "original" re-applies the policy recorded at backup time, "none" removes it, and a
+	// CNPG retention policy such as "7d" replaces it. Empty keeps the backed-up spec.
+	RetentionPolicy string `json:"retentionPolicy,omitempty"`
+
+	// CoordinateNamespace treats the clusters restored into a namespace as a unit: the
+	// ScheduledBackups created for them and the Deployments restored next to them are held
+	// until every restored cluster in the namespace is healthy
+	CoordinateNamespace bool `json:"coordinateNamespace,omitempty"`
+
+	// ProvisionOnly restores clusters hibernated, with recovery configured but not started,
+	// so they can be reviewed before recovery is triggered by resuming them
+	ProvisionOnly bool `json:"provisionOnly,omitempty"`
+
+	// SkipSchemaValidation disables checking restored clusters against the installed
+	// Cluster CRD schema
+	SkipSchemaValidation bool `json:"skipSchemaValidation,omitempty"`
+
+	// SkipPluginCheck disables checking that the barman-cloud plugin is installed and
+	// ready in the destination cluster before restoring clusters that use it
+	SkipPluginCheck bool `json:"skipPluginCheck,omitempty"`
+
+	// ArchiveConflictPolicy decides what happens when a restored cluster would archive WAL
+	// to the same serverName and object store as a live cluster in its namespace
+	ArchiveConflictPolicy string `json:"archiveConflictPolicy,omitempty"`
+
+	// ServerNameStrategy decides how the new serverNames of restored clusters are named,
+	// for rotation and archive conflicts
+	ServerNameStrategy *ServerNameStrategyConfig `json:"serverNameStrategy,omitempty"`
+
+	// DisabledPluginPolicy decides how the backup action handles a WAL archiver plugin
+	// entry with enabled: false
+	DisabledPluginPolicy string `json:"disabledPluginPolicy,omitempty"`
+
+	// UnhealthyClusterPolicy decides how the backup action handles a cluster that is not
+	// healthy, e.g. still setting up its primary, failed or upgrading, whose latest
+	// completed backup may predate important data
+	UnhealthyClusterPolicy string `json:"unhealthyClusterPolicy,omitempty"`
+
+	// WatchScopePolicy decides what happens when a cluster is restored into a namespace
+	// outside the CNPG operator's watch scope
+	WatchScopePolicy string `json:"watchScopePolicy,omitempty"`
+
+	// SkipReasonPolicies decide, per skip reason recorded at backup time, how the restore
+	// action handles a cluster backed up without a pinned backup ID: latest (default) or fail
+	SkipReasonPolicies map[string]string `json:"skipReasonPolicies,omitempty"`
+
+	// ResourcePatches are applied by the resource patch action to the restored resources
+	// they select, in order
+	ResourcePatches []ResourcePatch `json:"resourcePatches,omitempty"`
+}
+
+// SnapshotFencingConfig controls instance fencing around CSI snapshots of CNPG PVCs
+type SnapshotFencingConfig struct {
+	// Enabled turns on fencing
+	Enabled bool `json:"enabled,omitempty"`
+
+	// Instances selects which instances are fenced: primary (default) or all
+	Instances string `json:"instances,omitempty"`
+}
+
+// SourceClusterConfig describes how to connect to a running PostgreSQL cluster
+type SourceClusterConfig struct {
+	// ConnectionParameters are copied to externalClusters[].connectionParameters
+	ConnectionParameters map[string]string `json:"connectionParameters,omitempty"`
+
+	// Password references the secret key holding the connection password
+	Password *SecretKeySelector `json:"password,omitempty"`
+
+	// SSLCert references the secret key holding the client TLS certificate
+	SSLCert *SecretKeySelector `json:"sslCert,omitempty"`
+
+	// SSLKey references the secret key holding the client TLS private key
+	SSLKey *SecretKeySelector `json:"sslKey,omitempty"`
+
+	// SSLRootCert references the secret key holding the server CA certificate
+	SSLRootCert *SecretKeySelector `json:"sslRootCert,omitempty"`
+}
+
+// RecoveryParametersConfig selects plugin parameters by name, with the same glob patterns
+// as path.Match
+type RecoveryParametersConfig struct {
+	// Include lists the parameters copied, all of them when empty
+	Include []string `json:"include,omitempty"`
+
+	// Exclude lists the parameters never copied, e.g. compression or tagging settings that
+	// only apply when archiving
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// Validate checks the parameter patterns
+func (c *RecoveryParametersConfig) Validate() error {
+	for _, list := range []struct {
+		field    string
+		patterns []string
+	}{{"include", c.Include}, {"exclude", c.Exclude}} {
+		for _, pattern := range list.patterns {
+			if _, err := path.Match(pattern, ""); pattern == "" || err != nil {
+				return errors.Errorf("invalid recoveryParameters.%s pattern %q", list.field, pattern)
+			}
+		}
+	}
+	for _, pattern := range c.Include {
+		if pattern == "barmanObjectName" || pattern == "serverName" {
+			return errors.Errorf("recoveryParameters.include must not list %s, which the restore action generates", pattern)
+		}
+	}
+	return nil
+}
+
+// selects reports whether a parameter is copied
+func (c *RecoveryParametersConfig) selects(name string) bool {
+	included := len(c.Include) == 0
+	for _, pattern := range c.Include {
+		if matched, _ := path.Match(pattern, name); matched {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return false
+	}
+	for _, pattern := range c.Exclude {
+		if matched, _ := path.Match(pattern, name); matched {
+			return false
+		}
+	}
+	return true
+}
+
+// ImportConfig describes a logical import from the source cluster
+type ImportConfig struct {
+	// Type is either microservice (default) or monolith
+	Type string `json:"type,omitempty"`
+
+	// Databases lists the databases to import. For microservice imports it
+	// defaults to the application database of the restored cluster.
+	Databases []string `json:"databases,omitempty"`
+
+	// Roles lists the roles to import (monolith only)
+	Roles []string `json:"roles,omitempty"`
+
+	// SchemaOnly imports the schema without data
+	SchemaOnly bool `json:"schemaOnly,omitempty"`
+
+	// PostImportApplicationSQL is run in the application database after the import
+	PostImportApplicationSQL []string `json:"postImportApplicationSQL,omitempty"`
+}
+
+// ReplicaConfig describes restores into replica clusters, which keep following the
+// backed-up cluster's WAL archive until they are promoted
+type ReplicaConfig struct {
+	// Enabled restores clusters in replica mode
+	Enabled bool `json:"enabled,omitempty"`
+
+	// Promotion is never (default), immediate or after
+	Promotion string `json:"promotion,omitempty"`
+
+	// PromoteAfter is how long the replica cluster has to be healthy before it is
+	// promoted, as a Go duration (promotion after only)
+	PromoteAfter string `json:"promoteAfter,omitempty"`
+
+	// Source names the externalClusters entry of the backed-up cluster, with
+	// connectionParameters, the replica cluster streams from once it recovered from the
+	// backup. It defaults to replaying the WAL archive of the recovery source.
+	Source string `json:"source,omitempty"`
+}
+
+// ServerNameStrategyConfig selects the strategy naming the new serverNames of restored
+// clusters
+type ServerNameStrategyConfig struct {
+	// Type is timestamp (default), restoreUID, sequence or webhook
+	Type string `json:"type,omitempty"`
+
+	// Webhook is the webhook asked for serverNames (webhook only)
+	Webhook *ServerNameWebhookConfig `json:"webhook,omitempty"`
+}
+
+// ServerNameWebhookConfig describes the webhook of the webhook serverName strategy
+type ServerNameWebhookConfig struct {
+	// URL is the http or https URL the serverName requests are POSTed to
+	URL string `json:"url"`
+
+	// Timeout bounds each request, as a Go duration. It defaults to 10s.
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// WebhookConfig describes an HTTP endpoint called on backup and restore events
+type WebhookConfig struct {
+	// Name identifies the webhook in logs and warnings
+	Name string `json:"name"`
+
+	// URL is the http or https URL the events are POSTed to
+	URL string `json:"url"`
+
+	// Events are the events the webhook is called on: preBackup, postBackup, preRestore
+	// and postRestore
+	Events []string `json:"events"`
+
+	// Timeout bounds each call, as a Go duration. It defaults to 10s.
+	Timeout string `json:"timeout,omitempty"`
+
+	// FailurePolicy is ignore (default) or fail, and decides what a failed call does
+	FailurePolicy string `json:"failurePolicy,omitempty"`
+
+	// SigningSecret references the secret key calls are signed with, as an HMAC-SHA256 of
+	// the body in the X-Velero-CNPG-Signature header. The secret is read from the Velero
+	// namespace.
+	SigningSecret *SecretKeySelector `json:"signingSecret,omitempty"`
+}
+
+// RehearsalConfig configures rehearsal restores
+type RehearsalConfig struct {
+	// Enabled makes every restore a rehearsal. Otherwise only restores annotated with
+	// velero-cnpg/rehearsal=true are.
+	Enabled bool `json:"enabled,omitempty"`
+
+	// Namespace is the scratch namespace drills are restored into, whatever the namespace
+	// mappings of the restore
+	Namespace string `json:"namespace"`
+}
+
+// NotificationConfig describes the webhook the restore summary is sent to
+type NotificationConfig struct {
+	// URLSecret references the secret key holding the webhook URL. The secret is read
+	// from the Velero namespace, since the URL of a Slack webhook is a credential.
+	URLSecret SecretKeySelector `json:"urlSecret"`
+
+	// Format is json (default) or slack
+	Format string `json:"format,omitempty"`
+
+	// WaitTimeout bounds how long the summary waits for the restored clusters to become
+	// healthy before it is sent with the ones that are not. It defaults to 1h.
+	WaitTimeout string `json:"waitTimeout,omitempty"`
+}
+
+// WALRestoreConfig tunes barman-cloud-wal-restore for the recovery source of restored
+// clusters, so large databases replay WAL faster on well-provisioned DR hardware
+type WALRestoreConfig struct {
+	// MaxParallel is the number of WAL files fetched in parallel
+	MaxParallel int `json:"maxParallel,omitempty"`
+
+	// RestoreAdditionalCommandArgs are passed on to barman-cloud-wal-restore
+	RestoreAdditionalCommandArgs []string `json:"restoreAdditionalCommandArgs,omitempty"`
+}
+
+// ScheduledBackupConfig is the template of the ScheduledBackup created for restored clusters
+type ScheduledBackupConfig struct {
+	// Schedule is the cron schedule, in the six-field format with seconds used by CNPG
+	Schedule string `json:"schedule"`
+
+	// Method is the backup method. It defaults to the method the cluster was backed up with.
+	Method string `json:"method,omitempty"`
+
+	// Immediate takes a backup as soon as the ScheduledBackup is created
+	Immediate bool `json:"immediate,omitempty"`
+
+	// BackupOwnerReference is copied to spec.backupOwnerReference (none, self or cluster)
+	BackupOwnerReference string `json:"backupOwnerReference,omitempty"`
+
+	// Target is copied to spec.target (primary or prefer-standby)
+	Target string `json:"target,omitempty"`
+}
+
+// DisasterRecoveryConfig points restored clusters at the destination cluster's equivalents
+// of the backed-up cluster's object store and operator. barman-cloud ObjectStores are
+// mapped with BarmanObjectNames.
+type DisasterRecoveryConfig struct {
+	// ObjectStore replaces settings of the in-tree barmanObjectStore, used both to read the
+	// backup and to archive from the restored cluster
+	ObjectStore *ObjectStoreOverride `json:"objectStore,omitempty"`
+
+	// OperatorSelector is the label selector of the CNPG operator Deployment in the
+	// destination cluster, used by the operator checks
+	OperatorSelector string `json:"operatorSelector,omitempty"`
+
+	// AllowArchivedServerName reports, rather than fails, clusters whose original serverName
+	// the destination cluster has archived under before
+	AllowArchivedServerName bool `json:"allowArchivedServerName,omitempty"`
+
+	// SecretNames renames the secrets the externalClusters of restored clusters reference
+	// (original name -> destination name), for credentials the destination holds elsewhere
+	SecretNames map[string]string `json:"secretNames,omitempty"`
+}
+
+// ObjectStoreOverride holds the barmanObjectStore settings replaced on restore. Setting
+// any credentials replaces all credentials of the object store.
+type ObjectStoreOverride struct {
+	DestinationPath   string                 `json:"destinationPath,omitempty"`
+	EndpointURL       string                 `json:"endpointURL,omitempty"`
+	EndpointCA        *SecretKeySelector     `json:"endpointCA,omitempty"`
+	S3Credentials     map[string]interface{} `json:"s3Credentials,omitempty"`
+	AzureCredentials  map[string]interface{} `json:"azureCredentials,omitempty"`
+	GoogleCredentials map[string]interface{} `json:"googleCredentials,omitempty"`
+}
+
+// BackupHooksConfig holds the SQL run on the primary around the backup of a cluster
+type BackupHooksConfig struct {
+	// Pre runs before the cluster is backed up, in order
+	Pre []SQLHook `json:"pre,omitempty"`
+
+	// Post runs after the cluster is backed up, in order, also when its backup failed
+	Post []SQLHook `json:"post,omitempty"`
+}
+
+// SQLHook is SQL run with psql on the primary of a cluster
+type SQLHook struct {
+	// Name identifies the hook in logs
+	Name string `json:"name,omitempty"`
+
+	// Database is the database the SQL runs in, postgres by default
+	Database string `json:"database,omitempty"`
+
+	// SQL is the statements to run, in a single psql command
+	SQL string `json:"sql"`
+
+	// Timeout bounds the hook as a Go duration, 30s by default
+	Timeout string `json:"timeout,omitempty"`
+
+	// OnError is fail (default) or continue
+	OnError string `json:"onError,omitempty"`
+}
+
+// ResourcePatch is a patch applied to restored resources of one kind. Exactly one of
+// JSONPatch, MergePatch and StrategicMergePatch is set.
+type ResourcePatch struct {
+	// Group is the API group of the patched resources, empty for the core group
+	Group string `json:"group,omitempty"`
+
+	// Version restricts the patch to one version of the group
+	Version string `json:"version,omitempty"`
+
+	// Kind is the kind of the patched resources
+	Kind string `json:"kind"`
+
+	// Namespaces restricts the patch to resources restored into these namespaces
+	Namespaces []string `json:"namespaces,omitempty"`
+
+	// Name restricts the patch to resources of this name
+	Name string `json:"name,omitempty"`
+
+	// JSONPatch is an RFC 6902 JSON patch
+	JSONPatch json.RawMessage `json:"jsonPatch,omitempty"`
+
+	// MergePatch is an RFC 7386 JSON merge patch
+	MergePatch json.RawMessage `json:"mergePatch,omitempty"`
+
+	// StrategicMergePatch is a Kubernetes strategic merge patch, for built-in kinds only
+	StrategicMergePatch json.RawMessage `json:"strategicMergePatch,omitempty"`
+}
+
+// SchedulingConfig relaxes or remaps scheduling constraints, since DR clusters often
+// have fewer nodes or zones than the cluster the backup was taken from
+type SchedulingConfig struct {
+	// RemoveAffinity drops node affinity and additional pod (anti-)affinity rules
+	// and disables the operator-managed pod anti-affinity
+	RemoveAffinity bool `json:"removeAffinity,omitempty"`
+
+	// PodAntiAffinityType overrides spec.affinity.podAntiAffinityType (preferred or required)
+	PodAntiAffinityType string `json:"podAntiAffinityType,omitempty"`
+
+	// TopologyKey overrides spec.affinity.topologyKey
+	TopologyKey string `json:"topologyKey,omitempty"`
+
+	// TopologyKeys renames node label keys (original key -> destination key) in the
+	// topology keys, node selector and node affinity of the cluster
+	TopologyKeys map[string]string `json:"topologyKeys,omitempty"`
+
+	// Zones renames zones (original zone -> destination zone) in the node selector and
+	// node affinity of the cluster, under the zone labels and spec.affinity.topologyKey
+	Zones map[string]string `json:"zones,omitempty"`
+
+	// RemoveTopologySpreadConstraints drops spec.topologySpreadConstraints
+	RemoveTopologySpreadConstraints bool `json:"removeTopologySpreadConstraints,omitempty"`
+
+	// RemoveNodeSelector drops spec.affinity.nodeSelector
+	RemoveNodeSelector bool `json:"removeNodeSelector,omitempty"`
+
+	// NodeSelector replaces spec.affinity.nodeSelector
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+
+	// RemoveTolerations drops spec.affinity.tolerations
+	RemoveTolerations bool `json:"removeTolerations,omitempty"`
+
+	// TolerationKeys renames toleration keys (original key -> destination key)
+	TolerationKeys map[string]string `json:"tolerationKeys,omitempty"`
+
+	// Tolerations replaces spec.affinity.tolerations
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+
+	// RemovePriorityClassName drops spec.priorityClassName
+	RemovePriorityClassName bool `json:"removePriorityClassName,omitempty"`
+
+	// PriorityClassNames renames spec.priorityClassName (original name -> destination name)
+	PriorityClassNames map[string]string `json:"priorityClassNames,omitempty"`
+}
+
+// GitOpsConfig holds the metadata added to restored clusters, so the GitOps controller
+// managing their namespace adopts them on its next sync
+type GitOpsConfig struct {
+	// Labels are added to restored clusters, e.g. the label Argo CD tracks resources by
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Annotations are added to restored clusters, e.g. argocd.argoproj.io/tracking-id
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// PreventPrune adds the Argo CD sync and compare options and the Flux prune annotation
+	// that keep restored clusters missing from Git from being pruned
+	PreventPrune bool `json:"preventPrune,omitempty"`
+
+	// TrackingMetadata is the rule applied to the argocd.argoproj.io/ and
+	// kustomize.toolkit.fluxcd.io/ labels and annotations of restored CNPG resources,
+	// before Labels and Annotations are added
+	TrackingMetadata *TrackingMetadataRule `json:"trackingMetadata,omitempty"`
+
+	// NamespaceTrackingMetadata replaces TrackingMetadata for CNPG resources restored into
+	// the given namespaces
+	NamespaceTrackingMetadata map[string]TrackingMetadataRule `json:"namespaceTrackingMetadata,omitempty"`
+}
+
+// TrackingMetadataRule decides what happens to the Argo CD and Flux tracking metadata of
+// restored CNPG resources
+type TrackingMetadataRule struct {
+	// Policy is keep (default) or strip
+	Policy string `json:"policy,omitempty"`
+
+	// OwnerNames renames the Argo CD Applications and Flux Kustomizations (original name ->
+	// destination name) that kept tracking metadata refers to
+	OwnerNames map[string]string `json:"ownerNames,omitempty"`
+}
+
+// ResourceProfile replaces spec.resources on the restored cluster
+type ResourceProfile struct {
+	Requests map[string]string `json:"requests,omitempty"`
+	Limits   map[string]string `json:"limits,omitempty"`
+}
+
+// SecretKeySelector references a key of a secret in the restored cluster's namespace
+type SecretKeySelector struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
+// DefaultPluginConfig returns the configuration used when no ConfigMap is present
+func DefaultPluginConfig() *PluginConfig {
+	return &PluginConfig{
+		RestoreMode: RestoreModeRecovery,
+	}
+}
+
+// parsePluginConfig builds a PluginConfig from ConfigMap data
+func parsePluginConfig(data map[string]string) (*PluginConfig, error) {
+	fields := make(map[string]interface{}, len(data))
+	for key, value := range data {
+		var field interface{}
+		if err := yaml.Unmarshal([]byte(value), &field); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse config key %s", key)
+		}
+		fields[key] = field
+	}
+
+	raw, err := json.Marshal(fields)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encode config")
+	}
+
+	config := DefaultPluginConfig()
+	if err := json.Unmarshal(raw, config); err != nil {
+		return nil, errors.Wrap(err, "failed to decode config")
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// Validate checks that the configuration is consistent
+func (c *PluginConfig) Validate() error {
+	switch c.RestoreMode {
+	case RestoreModeRecovery:
+	case RestoreModePgBaseBackup, RestoreModeStandby:
+		if c.SourceCluster == nil || c.SourceCluster.ConnectionParameters["host"] == "" {
+			return errors.Errorf("restoreMode %s requires sourceCluster.connectionParameters.host", c.RestoreMode)
+		}
+	case RestoreModeImport:
+		if c.SourceCluster == nil || c.SourceCluster.ConnectionParameters["host"] == "" {
+			return errors.Errorf("restoreMode %s requires sourceCluster.connectionParameters.host", c.RestoreMode)
+		}
+		if c.Import != nil {
+			if err := c.Import.Validate(); err != nil {
+				return err
+			}
+		}
+	default:
+		return errors.Errorf("unknown restoreMode %q", c.RestoreMode)
+	}
+
+	if _, err := labels.Parse(c.LabelSelector); err != nil {
+		return errors.Wrapf(err, "invalid labelSelector %q", c.LabelSelector)
+	}
+
+	for _, namespace := range c.IncludedNamespaces {
+		if _, err := path.Match(namespace, ""); namespace == "" || err != nil {
+			return errors.Errorf("invalid includedNamespaces entry %q", namespace)
+		}
+	}
+	for _, namespace := range c.ExcludedNamespaces {
+		if _, err := path.Match(namespace, ""); namespace == "" || err != nil {
+			return errors.Errorf("invalid excludedNamespaces entry %q", namespace)
+		}
+	}
+
+	if c.SnapshotFencing != nil {
+		switch c.SnapshotFencing.Instances {
+		case "", FencingInstancesPrimary, FencingInstancesAll:
+		default:
+			return errors.Errorf("unknown snapshotFencing.instances %q", c.SnapshotFencing.Instances)
+		}
+	}
+
+	switch c.ArchiveConflictPolicy {
+	case "", ArchiveConflictFail, ArchiveConflictRename:
+	default:
+		return errors.Errorf("unknown archiveConflictPolicy %q", c.ArchiveConflictPolicy)
+	}
+
+	switch c.DisabledPluginPolicy {
+	case "", DisabledPluginSkip, DisabledPluginWarn, DisabledPluginFail:
+	default:
+		return errors.Errorf("unknown disabledPluginPolicy %q", c.DisabledPluginPolicy)
+	}
+
+	switch c.IntegrityPolicy {
+	case "", IntegrityFail, IntegrityWarn:
+	default:
+		return errors.Errorf("unknown integrityPolicy %q", c.IntegrityPolicy)
+	}
+
+	switch c.OverrideConflictPolicy {
+	case "", OverrideConflictOverwrite, OverrideConflictMerge, OverrideConflictFail:
+	default:
+		return errors.Errorf("unknown overrideConflictPolicy %q", c.OverrideConflictPolicy)
+	}
+
+	switch c.UnhealthyClusterPolicy {
+	case "", UnhealthyClusterWarn, UnhealthyClusterAnnotate, UnhealthyClusterFail:
+	default:
+		return errors.Errorf("unknown unhealthyClusterPolicy %q", c.UnhealthyClusterPolicy)
+	}
+
+	switch c.WatchScopePolicy {
+	case "", WatchScopeWarn, WatchScopeFail:
+	default:
+		return errors.Errorf("unknown watchScopePolicy %q", c.WatchScopePolicy)
+	}
+
+	reasons := make([]string, 0, len(c.SkipReasonPolicies))
+	for reason := range c.SkipReasonPolicies {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		if !knownSkipReason(reason) {
+			return errors.Errorf("unknown skip reason %q in skipReasonPolicies", reason)
+		}
+		switch policy := c.SkipReasonPolicies[reason]; policy {
+		case "", SkipReasonPolicyLatest, SkipReasonPolicyFail:
+		default:
+			return errors.Errorf("unknown skipReasonPolicies.%s %q", reason, policy)
+		}
+	}
+
+	if c.Replica != nil && c.Replica.Enabled {
+		if c.RestoreMode != RestoreModeRecovery {
+			return errors.Errorf("replica requires restoreMode %s", RestoreModeRecovery)
+		}
+		if err := c.Replica.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.RecoveryParameters != nil {
+		if err := c.RecoveryParameters.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.ServerNameStrategy != nil {
+		if err := c.ServerNameStrategy.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.Rehearsal != nil {
+		if err := c.Rehearsal.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.Notification != nil {
+		if err := c.Notification.Validate(); err != nil {
+			return err
+		}
+	}
+
+	seenWebhooks := map[string]bool{}
+	for i := range c.Webhooks {
+		if err := c.Webhooks[i].Validate(); err != nil {
+			return err
+		}
+		if seenWebhooks[c.Webhooks[i].Name] {
+			return errors.Errorf("webhook %s is listed more than once", c.Webhooks[i].Name)
+		}
+		seenWebhooks[c.Webhooks[i].Name] = true
+	}
+
+	for objectStore, parameters := range c.ProviderParameters {
+		for _, reserved := range []string{"barmanObjectName", "serverName"} {
+			if _, found := parameters[reserved]; found {
+				return errors.Errorf("providerParameters.%s must not set %s, which the restore action generates", objectStore, reserved)
+			}
+		}
+	}
+
+	seenPaths := map[string]bool{}
+	for _, path := range c.YieldToResourceModifiers {
+		switch path {
+		case ManagedPathPlugins, ManagedPathBootstrap, ManagedPathExternalClusters:
+		default:
+			return errors.Errorf("unknown yieldToResourceModifiers path %q, expected one of %s", path, strings.Join(ManagedPaths, ", "))
+		}
+		if seenPaths[path] {
+			return errors.Errorf("yieldToResourceModifiers path %s is listed more than once", path)
+		}
+		seenPaths[path] = true
+	}
+
+	seenSteps := map[string]bool{}
+	for _, step := range c.MutationSteps {
+		switch step {
+		case MutationStepOverrideConfigMap, MutationStepStripEphemeralFields, MutationStepRotateServerName, MutationStepExternalClusters, MutationStepBootstrap:
+		default:
+			return errors.Errorf("unknown mutation step %q", step)
+		}
+		if seenSteps[step] {
+			return errors.Errorf("mutation step %s is listed more than once", step)
+		}
+		seenSteps[step] = true
+	}
+
+	if c.WALRestore != nil && c.WALRestore.MaxParallel < 0 {
+		return errors.Errorf("walRestore.maxParallel must not be negative, got %d", c.WALRestore.MaxParallel)
+	}
+
+	switch c.RetentionPolicy {
+	case "", RetentionPolicyOriginal, RetentionPolicyNone:
+	default:
+		if !retentionPolicyPattern.MatchString(c.RetentionPolicy) {
+			return errors.Errorf("invalid retentionPolicy %q, expected %s, %s or a number of days, weeks or months such as 30d", c.RetentionPolicy, RetentionPolicyOriginal, RetentionPolicyNone)
+		}
+	}
+
+	if c.ScheduledBackupTemplate != nil {
+		if err := c.ScheduledBackupTemplate.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.Scheduling != nil {
+		if err := c.Scheduling.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.GitOps != nil {
+		if err := c.GitOps.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.BackupHooks != nil {
+		if err := c.BackupHooks.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.DisasterRecovery != nil {
+		if _, err := labels.Parse(c.DisasterRecovery.OperatorSelector); err != nil {
+			return errors.Wrapf(err, "invalid disasterRecovery.operatorSelector %q", c.DisasterRecovery.OperatorSelector)
+		}
+		if store := c.DisasterRecovery.ObjectStore; store != nil && store.EndpointCA != nil && (store.EndpointCA.Name == "" || store.EndpointCA.Key == "") {
+			return errors.New("disasterRecovery.objectStore.endpointCA requires name and key")
+		}
+		for original, renamed := range c.DisasterRecovery.SecretNames {
+			if original == "" || renamed == "" {
+				return errors.Errorf("disasterRecovery.secretNames maps %q to %q, secret names cannot be empty", original, renamed)
+			}
+		}
+	}
+
+	for i := range c.ResourcePatches {
+		if err := c.ResourcePatches[i].Validate(); err != nil {
+			return errors.Wrapf(err, "invalid resource patch %d", i)
+		}
+	}
+
+	for name, profile := range c.ResourceProfiles {
+		if err := profile.Validate(); err != nil {
+			return errors.Wrapf(err, "invalid resource profile %s", name)
+		}
+	}
+
+	if c.ResourceProfile != "" && c.ResourceProfile != ResourceProfileOriginal {
+		if _, found := c.ResourceProfiles[c.ResourceProfile]; !found {
+			return errors.Errorf("resource profile %q is not defined", c.ResourceProfile)
+		}
+	}
+
+	return nil
+}
+
+// scopeNamespaces limits the selector of an action to includedNamespaces and
+// excludedNamespaces, so Velero does not invoke it for items elsewhere
+func (c *PluginConfig) scopeNamespaces(selector velero.ResourceSelector) velero.ResourceSelector {
+	selector.IncludedNamespaces = c.IncludedNamespaces
+	selector.ExcludedNamespaces = c.ExcludedNamespaces
+	return selector
+}
+
+// noNamespaces returns the selector of an action whose configuration could not be loaded.
+// It fails closed: the action applies to no namespace, so the excludedNamespaces denylist
+// is never dropped along with the rest of a broken configuration.
+func noNamespaces() velero.ResourceSelector {
+	return velero.ResourceSelector{ExcludedNamespaces: []string{"*"}}
+}
+
+// mutationSteps returns the mutations the restore action applies, in order. An empty
+// list skips them all, while an unset one applies DefaultMutationSteps.
+func (c *PluginConfig) mutationSteps() []string {
+	if c.MutationSteps == nil {
+		return DefaultMutationSteps
+	}
+	return c.MutationSteps
+}
+
+// mutationStepEnabled reports whether the restore action applies the given mutation
+func (c *PluginConfig) mutationStepEnabled(step string) bool {
+	for _, enabled := range c.mutationSteps() {
+		if enabled == step {
+			return true
+		}
+	}
+	return false
+}
+
+// operatorSelector returns the label selector of the CNPG operator Deployment
+func (c *PluginConfig) operatorSelector() string {
+	if c.DisasterRecovery != nil && c.DisasterRecovery.OperatorSelector != "" {
+		return c.DisasterRecovery.OperatorSelector
+	}
+	return defaultOperatorSelector
+}
+
+// Validate checks the pre and post hooks
+func (c *BackupHooksConfig) Validate() error {
+	for phase, hooks := range map[string][]SQLHook{"pre": c.Pre, "post": c.Post} {
+		for i := range hooks {
+			if err := hooks[i].Validate(); err != nil {
+				return errors.Wrapf(err, "invalid backupHooks.%s hook %d", phase, i)
+			}
+		}
+	}
+	return nil
+}
+
+// Validate checks the SQL, timeout and failure policy of the hook
+func (h *SQLHook) Validate() error {
+	if h.SQL == "" {
+		return errors.New("sql is required")
+	}
+	if h.Timeout != "" {
+		if timeout, err := time.ParseDuration(h.Timeout); err != nil || timeout <= 0 {
+			return errors.Errorf("timeout must be a positive duration, got %q", h.Timeout)
+		}
+	}
+	switch h.OnError {
+	case "", HookOnErrorFail, HookOnErrorContinue:
+	default:
+		return errors.Errorf("unknown onError %q", h.OnError)
+	}
+	return nil
+}
+
+// Validate checks the promotion settings
+func (c *ReplicaConfig) Validate() error {
+	switch c.Promotion {
+	case "", PromotionNever, PromotionImmediate:
+		if c.PromoteAfter != "" {
+			return errors.Errorf("replica.promoteAfter requires promotion %s", PromotionAfter)
+		}
+	case PromotionAfter:
+		promoteAfter, err := time.ParseDuration(c.PromoteAfter)
+		if err != nil || promoteAfter <= 0 {
+			return errors.Errorf("promotion %s requires a positive replica.promoteAfter duration, got %q", PromotionAfter, c.PromoteAfter)
+		}
+	default:
+		return errors.Errorf("unknown replica.promotion %q", c.Promotion)
+	}
+
+	if c.Source != "" && c.Promotion == PromotionImmediate {
+		return errors.Errorf("replica.source requires the cluster to stay a replica cluster, not promotion %s", PromotionImmediate)
+	}
+	if c.Source == recoverySourceName || (c.Source != "" && c.Source == cloneSourceName) {
+		return errors.Errorf("replica.source %s names an externalClusters entry the plugin generates", c.Source)
+	}
+
+	return nil
+}
+
+// Validate checks the serverName strategy
+func (c *ServerNameStrategyConfig) Validate() error {
+	switch c.Type {
+	case "", ServerNameTimestamp, ServerNameRestoreUID, ServerNameSequence:
+		if c.Webhook != nil {
+			return errors.Errorf("serverNameStrategy.webhook requires type %s", ServerNameWebhook)
+		}
+	case ServerNameWebhook:
+		if c.Webhook == nil || c.Webhook.URL == "" {
+			return errors.Errorf("serverNameStrategy type %s requires webhook.url", ServerNameWebhook)
+		}
+		webhookURL, err := url.Parse(c.Webhook.URL)
+		if err != nil || (webhookURL.Scheme != "http" && webhookURL.Scheme != "https") || webhookURL.Host == "" {
+			return errors.Errorf("serverNameStrategy.webhook.url must be an http or https URL, got %q", c.Webhook.URL)
+		}
+		if c.Webhook.Timeout != "" {
+			timeout, err := time.ParseDuration(c.Webhook.Timeout)
+			if err != nil || timeout <= 0 {
+				return errors.Errorf("serverNameStrategy.webhook.timeout must be a positive duration, got %q", c.Webhook.Timeout)
+			}
+		}
+	default:
+		return errors.Errorf("unknown serverNameStrategy type %q", c.Type)
+	}
+
+	return nil
+}
+
+// Validate checks the webhook
+func (c *WebhookConfig) Validate() error {
+	if c.Name == "" {
+		return errors.New("webhooks entries require a name")
+	}
+	webhookURL, err := url.Parse(c.URL)
+	if err != nil || (webhookURL.Scheme != "http" && webhookURL.Scheme != "https") || webhookURL.Host == "" {
+		return errors.Errorf("webhook %s url must be an http or https URL, got %q", c.Name, c.URL)
+	}
+	if len(c.Events) == 0 {
+		return errors.Errorf("webhook %s requires at least one event", c.Name)
+	}
+	for _, event := range c.Events {
+		switch event {
+		case WebhookEventPreBackup, WebhookEventPostBackup, WebhookEventPreRestore, WebhookEventPostRestore:
+		default:
+			return errors.Errorf("unknown webhook %s event %q", c.Name, event)
+		}
+	}
+	if c.Timeout != "" {
+		timeout, err := time.ParseDuration(c.Timeout)
+		if err != nil || timeout <= 0 {
+			return errors.Errorf("webhook %s timeout must be a positive duration, got %q", c.Name, c.Timeout)
+		}
+	}
+	switch c.FailurePolicy {
+	case "", WebhookFailureIgnore, WebhookFailureFail:
+	default:
+		return errors.Errorf("unknown webhook %s failurePolicy %q", c.Name, c.FailurePolicy)
+	}
+	if c.SigningSecret != nil && (c.SigningSecret.Name == "" || c.SigningSecret.Key == "") {
+		return errors.Errorf("webhook %s signingSecret requires a name and a key", c.Name)
+	}
+
+	return nil
+}
+
+// Validate checks the rehearsal settings
+func (c *RehearsalConfig) Validate() error {
+	if errs := validation.IsDNS1123Label(c.Namespace); len(errs) > 0 {
+		return errors.Errorf("invalid rehearsal namespace %q: %s", c.Namespace, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Validate checks the notification
+func (c *NotificationConfig) Validate() error {
+	if c.URLSecret.Name == "" || c.URLSecret.Key == "" {
+		return errors.New("notification urlSecret requires a name and a key")
+	}
+	switch c.Format {
+	case "", NotificationFormatJSON, NotificationFormatSlack:
+	default:
+		return errors.Errorf("unknown notification format %q", c.Format)
+	}
+	if c.WaitTimeout != "" {
+		timeout, err := time.ParseDuration(c.WaitTimeout)
+		if err != nil || timeout <= 0 {
+			return errors.Errorf("notification waitTimeout must be a positive duration, got %q", c.WaitTimeout)
+		}
+	}
+
+	return nil
+}
+
+// promoteAfter returns the duration after which the replica cluster is to be promoted,
+// or zero when it is not promoted automatically
+func (c *ReplicaConfig) promoteAfter() time.Duration {
+	if c == nil || !c.Enabled || c.Promotion != PromotionAfter {
+		return 0
+	}
+	promoteAfter, _ := time.ParseDuration(c.PromoteAfter)
+	return promoteAfter
+}
+
+// Validate checks the ScheduledBackup template
+func (c *ScheduledBackupConfig) Validate() error {
+	if c.Schedule == "" {
+		return errors.New("scheduledBackupTemplate.schedule is required")
+	}
+
+	switch c.Method {
+	case "", BackupMethodPlugin, BackupMethodBarmanObjectStore, BackupMethodVolumeSnapshot:
+	default:
+		return errors.Errorf("unknown scheduledBackupTemplate.method %q", c.Method)
+	}
+
+	return nil
+}
+
+// Validate checks that the patch selects a kind and carries exactly one well-formed patch
+func (r *ResourcePatch) Validate() error {
+	if r.Kind == "" {
+		return errors.New("kind is required")
+	}
+
+	patches := 0
+	for _, patch := range []json.RawMessage{r.JSONPatch, r.MergePatch, r.StrategicMergePatch} {
+		if len(patch) > 0 {
+			patches++
+		}
+	}
+	if patches != 1 {
+		return errors.New("exactly one of jsonPatch, mergePatch and strategicMergePatch is required")
+	}
+
+	if len(r.JSONPatch) > 0 {
+		if _, err := jsonpatch.DecodePatch(r.JSONPatch); err != nil {
+			return errors.Wrap(err, "invalid jsonPatch")
+		}
+	}
+	if len(r.StrategicMergePatch) > 0 && !builtInKind(r.Group, r.Kind) {
+		return errors.Errorf("strategicMergePatch requires a built-in kind, %s is not one", schema.GroupKind{Group: r.Group, Kind: r.Kind})
+	}
+
+	return nil
+}
+
+// Validate checks that all resource quantities parse
+func (r ResourceProfile) Validate() error {
+	for _, quantities := range []map[string]string{r.Requests, r.Limits} {
+		for name, quantity := range quantities {
+			if _, err := resource.ParseQuantity(quantity); err != nil {
+				return errors.Wrapf(err, "invalid quantity %q for %s", quantity, name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Validate checks that the scheduling settings are consistent
+func (c *SchedulingConfig) Validate() error {
+	switch c.PodAntiAffinityType {
+	case "", "preferred", "required":
+	default:
+		return errors.Errorf("unknown podAntiAffinityType %q", c.PodAntiAffinityType)
+	}
+
+	if c.RemoveNodeSelector && len(c.NodeSelector) > 0 {
+		return errors.New("removeNodeSelector and nodeSelector are mutually exclusive")
+	}
+
+	if c.RemoveTolerations && (len(c.Tolerations) > 0 || len(c.TolerationKeys) > 0) {
+		return errors.New("removeTolerations cannot be combined with tolerations or tolerationKeys")
+	}
+
+	if c.RemovePriorityClassName && len(c.PriorityClassNames) > 0 {
+		return errors.New("removePriorityClassName and priorityClassNames are mutually exclusive")
+	}
+
+	return nil
+}
+
+// Validate checks that the GitOps labels and annotations are valid metadata
+func (c *GitOpsConfig) Validate() error {
+	keys := make([]string, 0, len(c.Labels))
+	for key := range c.Labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return errors.Errorf("invalid gitOps.labels key %q: %s", key, strings.Join(errs, ", "))
+		}
+		if errs := validation.IsValidLabelValue(c.Labels[key]); len(errs) > 0 {
+			return errors.Errorf("invalid gitOps.labels.%s value %q: %s", key, c.Labels[key], strings.Join(errs, ", "))
+		}
+	}
+
+	keys = keys[:0]
+	for key := range c.Annotations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return errors.Errorf("invalid gitOps.annotations key %q: %s", key, strings.Join(errs, ", "))
+		}
+	}
+
+	if c.TrackingMetadata != nil {
+		if err := c.TrackingMetadata.Validate(); err != nil {
+			return errors.Wrap(err, "invalid gitOps.trackingMetadata")
+		}
+	}
+
+	keys = keys[:0]
+	for namespace := range c.NamespaceTrackingMetadata {
+		keys = append(keys, namespace)
+	}
+	sort.Strings(keys)
+	for _, namespace := range keys {
+		rule := c.NamespaceTrackingMetadata[namespace]
+		if err := rule.Validate(); err != nil {
+			return errors.Wrapf(err, "invalid gitOps.namespaceTrackingMetadata.%s", namespace)
+		}
+	}
+
+	return nil
+}
+
+// Validate checks that the tracking metadata rule is consistent
+func (r *TrackingMetadataRule) Validate() error {
+	switch r.Policy {
+	case "", TrackingMetadataKeep:
+	case TrackingMetadataStrip:
+		if len(r.OwnerNames) > 0 {
+			return errors.New("ownerNames cannot be combined with policy strip")
+		}
+	default:
+		return errors.Errorf("unknown policy %q", r.Policy)
+	}
+
+	return nil
+}
+
+// Validate checks that the import settings are consistent
+func (c *ImportConfig) Validate() error {
+	switch c.Type {
+	case "", ImportTypeMicroservice:
+		if len(c.Databases) > 1 {
+			return errors.New("microservice import accepts a single database")
+		}
+		if len(c.Roles) > 0 {
+			return errors.New("microservice import does not support roles")
+		}
+	case ImportTypeMonolith:
+		if len(c.Databases) == 0 {
+			return errors.New("monolith import requires at least one database")
+		}
+	default:
+		return errors.Errorf("unknown import type %q", c.Type)
+	}
+
+	return nil
+}
+
+// RestorePluginInstanceName returns the name an additional instance of the restore
+// action is registered under
+func RestorePluginInstanceName(instance string) string {
+	return RestorePluginName + "-" + instance
+}
+
+// veleroNamespace returns the namespace Velero (and therefore the plugin config) runs in
+func veleroNamespace() string {
+	if namespace := os.Getenv("VELERO_NAMESPACE"); namespace != "" {
+		return namespace
+	}
+	return DefaultVeleroNamespace
+}
+
+// LoadPluginConfig reads the ConfigMap labelled for the given action and parses it.
+// The default configuration is returned when no ConfigMap exists.
+func LoadPluginConfig(client kubernetes.Interface, kind common.PluginKind, actionName string) (*PluginConfig, error) {
+	configMap, err := common.GetPluginConfig(kind, actionName, client.CoreV1().ConfigMaps(veleroNamespace()))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get plugin config")
+	}
+	if configMap == nil {
+		return DefaultPluginConfig(), nil
+	}
+
+	return PluginConfigFromConfigMap(configMap)
+}
+
+// loadActionConfig returns the configuration of an action: config when it overrides the
+// lookup, otherwise the plugin ConfigMap labelled for the action. Only a missing ConfigMap
+// yields the defaults. A ConfigMap that cannot be read or parsed is an error rather than
+// the defaults, so a typo cannot silently turn off the settings it holds.
+func loadActionConfig(config *PluginConfig, kind common.PluginKind, actionName string) (*PluginConfig, error) {
+	if config != nil {
+		return config, nil
+	}
+
+	client, err := GetClient()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get Kubernetes client for plugin config")
+	}
+	return LoadPluginConfig(client, kind, actionName)
+}
+
+// PluginConfigFromConfigMap parses the data of a plugin ConfigMap
+func PluginConfigFromConfigMap(configMap *corev1.ConfigMap) (*PluginConfig, error) {
+	config, err := parsePluginConfig(configMap.Data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid plugin config in ConfigMap %s/%s", configMap.Namespace, configMap.Name)
+	}
+
+	return config, nil
+}
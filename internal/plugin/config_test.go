@@ -0,0 +1,1033 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework/common"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParsePluginConfig(t *testing.T) {
+	tests := []struct {
+		name          string
+		data          map[string]string
+		expectedError bool
+		validateFn    func(t *testing.T, config *PluginConfig)
+	}{
+		{
+			name: "empty data - defaults",
+			data: map[string]string{},
+			validateFn: func(t *testing.T, config *PluginConfig) {
+				assert.Equal(t, RestoreModeRecovery, config.RestoreMode)
+				assert.Nil(t, config.SourceCluster)
+			},
+		},
+		{
+			name: "pg_basebackup mode with source cluster",
+			data: map[string]string{
+				"restoreMode": "pg_basebackup",
+				"sourceCluster": `
+connectionParameters:
+  host: prod-rw.prod.svc
+  user: streaming_replica
+  dbname: postgres
+password:
+  name: prod-replication
+  key: password
+`,
+			},
+			validateFn: func(t *testing.T, config *PluginConfig) {
+				assert.Equal(t, RestoreModePgBaseBackup, config.RestoreMode)
+				require.NotNil(t, config.SourceCluster)
+				assert.Equal(t, "prod-rw.prod.svc", config.SourceCluster.ConnectionParameters["host"])
+				assert.Equal(t, "streaming_replica", config.SourceCluster.ConnectionParameters["user"])
+				require.NotNil(t, config.SourceCluster.Password)
+				assert.Equal(t, "prod-replication", config.SourceCluster.Password.Name)
+				assert.Equal(t, "password", config.SourceCluster.Password.Key)
+			},
+		},
+		{
+			name: "standby mode with source cluster",
+			data: map[string]string{
+				"restoreMode":   "standby",
+				"sourceCluster": "connectionParameters:\n  host: prod-rw.prod.svc\n  user: streaming_replica\n",
+			},
+			validateFn: func(t *testing.T, config *PluginConfig) {
+				assert.Equal(t, RestoreModeStandby, config.RestoreMode)
+				assert.Equal(t, "prod-rw.prod.svc", config.SourceCluster.ConnectionParameters["host"])
+			},
+		},
+		{
+			name: "standby mode without source cluster host",
+			data: map[string]string{
+				"restoreMode": "standby",
+			},
+			expectedError: true,
+		},
+		{
+			name: "pg_basebackup mode without source cluster host",
+			data: map[string]string{
+				"restoreMode": "pg_basebackup",
+			},
+			expectedError: true,
+		},
+		{
+			name: "import mode with monolith settings",
+			data: map[string]string{
+				"restoreMode":   "import",
+				"sourceCluster": "connectionParameters:\n  host: legacy-db\n",
+				"import":        "type: monolith\ndatabases: [app, reporting]\nroles: [reader]\n",
+			},
+			validateFn: func(t *testing.T, config *PluginConfig) {
+				assert.Equal(t, RestoreModeImport, config.RestoreMode)
+				require.NotNil(t, config.Import)
+				assert.Equal(t, ImportTypeMonolith, config.Import.Type)
+				assert.Equal(t, []string{"app", "reporting"}, config.Import.Databases)
+				assert.Equal(t, []string{"reader"}, config.Import.Roles)
+			},
+		},
+		{
+			name: "microservice import with several databases",
+			data: map[string]string{
+				"restoreMode":   "import",
+				"sourceCluster": "connectionParameters:\n  host: legacy-db\n",
+				"import":        "databases: [app, reporting]\n",
+			},
+			expectedError: true,
+		},
+		{
+			name: "monolith import without databases",
+			data: map[string]string{
+				"restoreMode":   "import",
+				"sourceCluster": "connectionParameters:\n  host: legacy-db\n",
+				"import":        "type: monolith\n",
+			},
+			expectedError: true,
+		},
+		{
+			name: "import mode without source cluster",
+			data: map[string]string{
+				"restoreMode": "import",
+			},
+			expectedError: true,
+		},
+		{
+			name: "scheduling relaxation",
+			data: map[string]string{
+				"scheduling": "removeTopologySpreadConstraints: true\npodAntiAffinityType: preferred\nnodeSelector:\n  disktype: ssd\n",
+			},
+			validateFn: func(t *testing.T, config *PluginConfig) {
+				require.NotNil(t, config.Scheduling)
+				assert.True(t, config.Scheduling.RemoveTopologySpreadConstraints)
+				assert.Equal(t, "preferred", config.Scheduling.PodAntiAffinityType)
+				assert.Equal(t, map[string]string{"disktype": "ssd"}, config.Scheduling.NodeSelector)
+			},
+		},
+		{
+			name: "scheduling with conflicting node selector settings",
+			data: map[string]string{
+				"scheduling": "removeNodeSelector: true\nnodeSelector:\n  disktype: ssd\n",
+			},
+			expectedError: true,
+		},
+		{
+			name: "scheduling with unknown anti-affinity type",
+			data: map[string]string{
+				"scheduling": "podAntiAffinityType: sometimes\n",
+			},
+			expectedError: true,
+		},
+		{
+			name: "resource profile selection",
+			data: map[string]string{
+				"resourceProfile":  "small",
+				"resourceProfiles": "small:\n  requests:\n    cpu: 500m\n    memory: 1Gi\n",
+			},
+			validateFn: func(t *testing.T, config *PluginConfig) {
+				assert.Equal(t, "small", config.ResourceProfile)
+				assert.Equal(t, "500m", config.ResourceProfiles["small"].Requests["cpu"])
+			},
+		},
+		{
+			name: "original resource profile needs no definition",
+			data: map[string]string{
+				"resourceProfile": "original",
+			},
+			validateFn: func(t *testing.T, config *PluginConfig) {
+				assert.Equal(t, ResourceProfileOriginal, config.ResourceProfile)
+			},
+		},
+		{
+			name: "undefined resource profile",
+			data: map[string]string{
+				"resourceProfile": "medium",
+			},
+			expectedError: true,
+		},
+		{
+			name: "invalid resource quantity",
+			data: map[string]string{
+				"resourceProfiles": "small:\n  limits:\n    memory: lots\n",
+			},
+			expectedError: true,
+		},
+		{
+			name: "toleration and priority class mapping",
+			data: map[string]string{
+				"scheduling": "tolerations:\n- key: dedicated\n  operator: Equal\n  value: dr\npriorityClassNames:\n  prod-critical: dr-default\n",
+			},
+			validateFn: func(t *testing.T, config *PluginConfig) {
+				require.NotNil(t, config.Scheduling)
+				require.Len(t, config.Scheduling.Tolerations, 1)
+				assert.Equal(t, "dedicated", config.Scheduling.Tolerations[0].Key)
+				assert.Equal(t, "dr-default", config.Scheduling.PriorityClassNames["prod-critical"])
+			},
+		},
+		{
+			name: "removing and replacing tolerations",
+			data: map[string]string{
+				"scheduling": "removeTolerations: true\ntolerationKeys:\n  postgres: dr-postgres\n",
+			},
+			expectedError: true,
+		},
+		{
+			name: "require completed backup",
+			data: map[string]string{
+				"requireCompletedBackup": "true",
+			},
+			validateFn: func(t *testing.T, config *PluginConfig) {
+				assert.True(t, config.RequireCompletedBackup)
+			},
+		},
+		{
+			name: "backup hooks",
+			data: map[string]string{
+				"backupHooks": `
+pre:
+  - name: pause-queues
+    database: app
+    sql: SELECT pause_queues()
+    timeout: 1m
+post:
+  - sql: SELECT resume_queues()
+    onError: continue
+`,
+			},
+			validateFn: func(t *testing.T, config *PluginConfig) {
+				require.NotNil(t, config.BackupHooks)
+				require.Len(t, config.BackupHooks.Pre, 1)
+				assert.Equal(t, SQLHook{Name: "pause-queues", Database: "app", SQL: "SELECT pause_queues()", Timeout: "1m"}, config.BackupHooks.Pre[0])
+				assert.Equal(t, []SQLHook{{SQL: "SELECT resume_queues()", OnError: HookOnErrorContinue}}, config.BackupHooks.Post)
+			},
+		},
+		{
+			name: "backup hook without sql",
+			data: map[string]string{
+				"backupHooks": `
+pre:
+  - name: empty
+`,
+			},
+			expectedError: true,
+		},
+		{
+			name: "backup hook with invalid timeout",
+			data: map[string]string{
+				"backupHooks": `
+post:
+  - sql: SELECT 1
+    timeout: soon
+`,
+			},
+			expectedError: true,
+		},
+		{
+			name: "backup hook with unknown onError",
+			data: map[string]string{
+				"backupHooks": `
+pre:
+  - sql: SELECT 1
+    onError: ignore
+`,
+			},
+			expectedError: true,
+		},
+		{
+			name: "disaster recovery",
+			data: map[string]string{
+				"disasterRecovery": `
+objectStore:
+  destinationPath: s3://dr-backups/
+  s3Credentials:
+    inheritFromIAMRole: true
+operatorSelector: app.kubernetes.io/name=cnpg-dr
+secretNames:
+  prod-replication: dr-replication
+`,
+			},
+			validateFn: func(t *testing.T, config *PluginConfig) {
+				require.NotNil(t, config.DisasterRecovery)
+				require.NotNil(t, config.DisasterRecovery.ObjectStore)
+				assert.Equal(t, "s3://dr-backups/", config.DisasterRecovery.ObjectStore.DestinationPath)
+				assert.Equal(t, map[string]interface{}{"inheritFromIAMRole": true}, config.DisasterRecovery.ObjectStore.S3Credentials)
+				assert.Equal(t, "app.kubernetes.io/name=cnpg-dr", config.operatorSelector())
+				assert.Equal(t, map[string]string{"prod-replication": "dr-replication"}, config.DisasterRecovery.SecretNames)
+			},
+		},
+		{
+			name: "recovery parameters",
+			data: map[string]string{
+				"recoveryParameters": "exclude: [compression, \"tag*\"]\n",
+			},
+			validateFn: func(t *testing.T, config *PluginConfig) {
+				require.NotNil(t, config.RecoveryParameters)
+				assert.Equal(t, []string{"compression", "tag*"}, config.RecoveryParameters.Exclude)
+			},
+		},
+		{
+			name: "recovery parameters including a generated parameter",
+			data: map[string]string{
+				"recoveryParameters": "include: [serverName]\n",
+			},
+			expectedError: true,
+		},
+		{
+			name: "recovery parameters with invalid pattern",
+			data: map[string]string{
+				"recoveryParameters": "exclude: [\"[\"]\n",
+			},
+			expectedError: true,
+		},
+		{
+			name: "webhook serverName strategy",
+			data: map[string]string{
+				"serverNameStrategy": "type: webhook\nwebhook:\n  url: https://naming.example.com/serverName\n  timeout: 5s\n",
+			},
+			validateFn: func(t *testing.T, config *PluginConfig) {
+				require.NotNil(t, config.ServerNameStrategy)
+				assert.Equal(t, ServerNameWebhook, config.ServerNameStrategy.Type)
+				assert.Equal(t, "https://naming.example.com/serverName", config.ServerNameStrategy.Webhook.URL)
+			},
+		},
+		{
+			name: "webhook serverName strategy without url",
+			data: map[string]string{
+				"serverNameStrategy": "type: webhook\n",
+			},
+			expectedError: true,
+		},
+		{
+			name: "webhook serverName strategy with invalid url",
+			data: map[string]string{
+				"serverNameStrategy": "type: webhook\nwebhook:\n  url: naming.example.com\n",
+			},
+			expectedError: true,
+		},
+		{
+			name: "webhook settings without webhook serverName strategy",
+			data: map[string]string{
+				"serverNameStrategy": "type: sequence\nwebhook:\n  url: https://naming.example.com\n",
+			},
+			expectedError: true,
+		},
+		{
+			name: "unknown serverName strategy",
+			data: map[string]string{
+				"serverNameStrategy": "type: random\n",
+			},
+			expectedError: true,
+		},
+		{
+			name: "webhooks",
+			data: map[string]string{
+				"webhooks": `
+- name: cmdb
+  url: https://cmdb.example.com/velero
+  events: [postBackup, postRestore]
+- name: approval
+  url: http://approvals.example.com/restore
+  events: [preRestore]
+  timeout: 30s
+  failurePolicy: fail
+  signingSecret:
+    name: webhook-signing
+    key: key
+`,
+			},
+			validateFn: func(t *testing.T, config *PluginConfig) {
+				require.Len(t, config.Webhooks, 2)
+				assert.Equal(t, []string{WebhookEventPostBackup, WebhookEventPostRestore}, config.Webhooks[0].Events)
+				assert.Equal(t, WebhookFailureFail, config.Webhooks[1].FailurePolicy)
+				assert.Equal(t, "30s", config.Webhooks[1].Timeout)
+				assert.Nil(t, config.Webhooks[0].SigningSecret)
+				assert.Equal(t, &SecretKeySelector{Name: "webhook-signing", Key: "key"}, config.Webhooks[1].SigningSecret)
+			},
+		},
+		{
+			name: "webhook signing secret without key",
+			data: map[string]string{
+				"webhooks": "- name: cmdb\n  url: https://cmdb.example.com\n  events: [postBackup]\n  signingSecret:\n    name: webhook-signing\n",
+			},
+			expectedError: true,
+		},
+		{
+			name: "rehearsal",
+			data: map[string]string{
+				"rehearsal": "enabled: true\nnamespace: restore-drills\n",
+			},
+			validateFn: func(t *testing.T, config *PluginConfig) {
+				require.NotNil(t, config.Rehearsal)
+				assert.True(t, config.Rehearsal.Enabled)
+				assert.Equal(t, "restore-drills", config.Rehearsal.Namespace)
+			},
+		},
+		{
+			name: "rehearsal with invalid namespace",
+			data: map[string]string{
+				"rehearsal": "namespace: Restore_Drills\n",
+			},
+			expectedError: true,
+		},
+		{
+			name: "notification",
+			data: map[string]string{
+				"notification": "urlSecret:\n  name: restore-notifications\n  key: slack-url\nformat: slack\nwaitTimeout: 2h\n",
+			},
+			validateFn: func(t *testing.T, config *PluginConfig) {
+				require.NotNil(t, config.Notification)
+				assert.Equal(t, SecretKeySelector{Name: "restore-notifications", Key: "slack-url"}, config.Notification.URLSecret)
+				assert.Equal(t, NotificationFormatSlack, config.Notification.Format)
+			},
+		},
+		{
+			name: "notification without secret key",
+			data: map[string]string{
+				"notification": "urlSecret:\n  name: restore-notifications\n",
+			},
+			expectedError: true,
+		},
+		{
+			name: "notification with unknown format",
+			data: map[string]string{
+				"notification": "urlSecret:\n  name: restore-notifications\n  key: url\nformat: teams\n",
+			},
+			expectedError: true,
+		},
+		{
+			name: "notification with invalid waitTimeout",
+			data: map[string]string{
+				"notification": "urlSecret:\n  name: restore-notifications\n  key: url\nwaitTimeout: -1h\n",
+			},
+			expectedError: true,
+		},
+		{
+			name: "webhook without name",
+			data: map[string]string{
+				"webhooks": "- url: https://cmdb.example.com\n  events: [postBackup]\n",
+			},
+			expectedError: true,
+		},
+		{
+			name: "duplicate webhook",
+			data: map[string]string{
+				"webhooks": "- name: cmdb\n  url: https://cmdb.example.com\n  events: [postBackup]\n- name: cmdb\n  url: https://cmdb.example.com\n  events: [postRestore]\n",
+			},
+			expectedError: true,
+		},
+		{
+			name: "webhook with invalid url",
+			data: map[string]string{
+				"webhooks": "- name: cmdb\n  url: cmdb.example.com\n  events: [postBackup]\n",
+			},
+			expectedError: true,
+		},
+		{
+			name: "webhook without events",
+			data: map[string]string{
+				"webhooks": "- name: cmdb\n  url: https://cmdb.example.com\n",
+			},
+			expectedError: true,
+		},
+		{
+			name: "webhook with unknown event",
+			data: map[string]string{
+				"webhooks": "- name: cmdb\n  url: https://cmdb.example.com\n  events: [preDelete]\n",
+			},
+			expectedError: true,
+		},
+		{
+			name: "webhook with invalid timeout",
+			data: map[string]string{
+				"webhooks": "- name: cmdb\n  url: https://cmdb.example.com\n  events: [postBackup]\n  timeout: 0s\n",
+			},
+			expectedError: true,
+		},
+		{
+			name: "webhook with unknown failure policy",
+			data: map[string]string{
+				"webhooks": "- name: cmdb\n  url: https://cmdb.example.com\n  events: [postBackup]\n  failurePolicy: retry\n",
+			},
+			expectedError: true,
+		},
+		{
+			name: "disaster recovery with empty secret name",
+			data: map[string]string{
+				"disasterRecovery": `
+secretNames:
+  prod-replication: ""
+`,
+			},
+			expectedError: true,
+		},
+		{
+			name: "disaster recovery with invalid operator selector",
+			data: map[string]string{
+				"disasterRecovery": `
+operatorSelector: "app in ("
+`,
+			},
+			expectedError: true,
+		},
+		{
+			name: "restore points",
+			data: map[string]string{
+				"createRestorePoints":   "true",
+				"recoverToRestorePoint": "true",
+			},
+			validateFn: func(t *testing.T, config *PluginConfig) {
+				assert.True(t, config.CreateRestorePoints)
+				assert.True(t, config.RecoverToRestorePoint)
+			},
+		},
+		{
+			name: "retention policy",
+			data: map[string]string{
+				"retentionPolicy": "7d",
+			},
+			validateFn: func(t *testing.T, config *PluginConfig) {
+				assert.Equal(t, "7d", config.RetentionPolicy)
+			},
+		},
+		{
+			name: "original retention policy",
+			data: map[string]string{
+				"retentionPolicy": "original",
+			},
+			validateFn: func(t *testing.T, config *PluginConfig) {
+				assert.Equal(t, RetentionPolicyOriginal, config.RetentionPolicy)
+			},
+		},
+		{
+			name:          "invalid retention policy",
+			data:          map[string]string{"retentionPolicy": "7 days"},
+			expectedError: true,
+		},
+		{
+			name: "coordinated namespace",
+			data: map[string]string{
+				"coordinateNamespace": "true",
+			},
+			validateFn: func(t *testing.T, config *PluginConfig) {
+				assert.True(t, config.CoordinateNamespace)
+			},
+		},
+		{
+			name: "snapshot fencing",
+			data: map[string]string{
+				"snapshotFencing": "enabled: true\ninstances: all\n",
+			},
+			validateFn: func(t *testing.T, config *PluginConfig) {
+				require.NotNil(t, config.SnapshotFencing)
+				assert.True(t, config.SnapshotFencing.Enabled)
+				assert.Equal(t, FencingInstancesAll, config.SnapshotFencing.Instances)
+			},
+		},
+		{
+			name: "snapshot fencing with unknown instances",
+			data: map[string]string{
+				"snapshotFencing": "enabled: true\ninstances: replicas\n",
+			},
+			expectedError: true,
+		},
+		{
+			name: "resume hibernated clusters",
+			data: map[string]string{
+				"resumeHibernatedClusters": "true",
+			},
+			validateFn: func(t *testing.T, config *PluginConfig) {
+				assert.True(t, config.ResumeHibernatedClusters)
+			},
+		},
+		{
+			name: "exclude override ConfigMap from backup",
+			data: map[string]string{
+				"excludeOverrideConfigMapFromBackup": "true",
+			},
+			validateFn: func(t *testing.T, config *PluginConfig) {
+				assert.True(t, config.ExcludeOverrideConfigMapFromBackup)
+			},
+		},
+		{
+			name: "label selector and object store mapping",
+			data: map[string]string{
+				"labelSelector":     "tier in (gold, silver)",
+				"barmanObjectNames": "prod-store: dr-store\n",
+			},
+			validateFn: func(t *testing.T, config *PluginConfig) {
+				assert.Equal(t, "tier in (gold, silver)", config.LabelSelector)
+				assert.Equal(t, map[string]string{"prod-store": "dr-store"}, config.BarmanObjectNames)
+			},
+		},
+		{
+			name: "provider parameters",
+			data: map[string]string{
+				"providerParameters": "dr-store:\n  endpointURL: https://minio.dr:9000\n  region: eu-west-1\n",
+			},
+			validateFn: func(t *testing.T, config *PluginConfig) {
+				assert.Equal(t, map[string]map[string]string{
+					"dr-store": {"endpointURL": "https://minio.dr:9000", "region": "eu-west-1"},
+				}, config.ProviderParameters)
+			},
+		},
+		{
+			name:          "provider parameters overriding serverName",
+			data:          map[string]string{"providerParameters": "dr-store:\n  serverName: pg\n"},
+			expectedError: true,
+		},
+		{
+			name: "mutation steps",
+			data: map[string]string{"mutationSteps": "[externalClusters, bootstrap]"},
+			validateFn: func(t *testing.T, config *PluginConfig) {
+				assert.Equal(t, []string{MutationStepExternalClusters, MutationStepBootstrap}, config.MutationSteps)
+				assert.False(t, config.mutationStepEnabled(MutationStepRotateServerName))
+			},
+		},
+		{
+			name: "no mutation steps",
+			data: map[string]string{"mutationSteps": "[]"},
+			validateFn: func(t *testing.T, config *PluginConfig) {
+				assert.Empty(t, config.mutationSteps())
+			},
+		},
+		{
+			name:          "unknown mutation step",
+			data:          map[string]string{"mutationSteps": "[bootstrap, promote]"},
+			expectedError: true,
+		},
+		{
+			name:          "duplicate mutation step",
+			data:          map[string]string{"mutationSteps": "[bootstrap, bootstrap]"},
+			expectedError: true,
+		},
+		{
+			name: "namespace filters",
+			data: map[string]string{"includedNamespaces": "[app-*]", "excludedNamespaces": "[app-vendor]"},
+			validateFn: func(t *testing.T, config *PluginConfig) {
+				selector := config.scopeNamespaces(velero.ResourceSelector{IncludedResources: []string{"clusters.postgresql.cnpg.io"}})
+				assert.Equal(t, []string{"app-*"}, selector.IncludedNamespaces)
+				assert.Equal(t, []string{"app-vendor"}, selector.ExcludedNamespaces)
+			},
+		},
+		{
+			name:          "invalid namespace filter",
+			data:          map[string]string{"excludedNamespaces": "[\"vendor-[\"]"},
+			expectedError: true,
+		},
+		{
+			name: "yield to resource modifiers",
+			data: map[string]string{"yieldToResourceModifiers": "[/spec/bootstrap, /spec/externalClusters]"},
+			validateFn: func(t *testing.T, config *PluginConfig) {
+				assert.Equal(t, []string{ManagedPathBootstrap, ManagedPathExternalClusters}, config.YieldToResourceModifiers)
+			},
+		},
+		{
+			name:          "yield to resource modifiers for an unmanaged path",
+			data:          map[string]string{"yieldToResourceModifiers": "[/spec/instances]"},
+			expectedError: true,
+		},
+		{
+			name: "integrity policy",
+			data: map[string]string{"integrityPolicy": "warn"},
+			validateFn: func(t *testing.T, config *PluginConfig) {
+				assert.Equal(t, IntegrityWarn, config.IntegrityPolicy)
+			},
+		},
+		{
+			name:          "unknown integrity policy",
+			data:          map[string]string{"integrityPolicy": "ignore"},
+			expectedError: true,
+		},
+		{
+			name: "override conflict policy",
+			data: map[string]string{"overrideConflictPolicy": "merge"},
+			validateFn: func(t *testing.T, config *PluginConfig) {
+				assert.Equal(t, OverrideConflictMerge, config.OverrideConflictPolicy)
+			},
+		},
+		{
+			name:          "unknown override conflict policy",
+			data:          map[string]string{"overrideConflictPolicy": "keep"},
+			expectedError: true,
+		},
+		{
+			name: "invalid label selector",
+			data: map[string]string{
+				"labelSelector": "tier in (gold",
+			},
+			expectedError: true,
+		},
+		{
+			name: "archive conflict policy",
+			data: map[string]string{
+				"archiveConflictPolicy": "rename",
+			},
+			validateFn: func(t *testing.T, config *PluginConfig) {
+				assert.Equal(t, ArchiveConflictRename, config.ArchiveConflictPolicy)
+			},
+		},
+		{
+			name: "unknown archive conflict policy",
+			data: map[string]string{
+				"archiveConflictPolicy": "ignore",
+			},
+			expectedError: true,
+		},
+		{
+			name: "disabled plugin policy",
+			data: map[string]string{
+				"disabledPluginPolicy": "fail",
+			},
+			validateFn: func(t *testing.T, config *PluginConfig) {
+				assert.Equal(t, DisabledPluginFail, config.DisabledPluginPolicy)
+			},
+		},
+		{
+			name: "unknown disabled plugin policy",
+			data: map[string]string{
+				"disabledPluginPolicy": "ignore",
+			},
+			expectedError: true,
+		},
+		{
+			name: "unhealthy cluster policy",
+			data: map[string]string{
+				"unhealthyClusterPolicy": "annotate",
+			},
+			validateFn: func(t *testing.T, config *PluginConfig) {
+				assert.Equal(t, UnhealthyClusterAnnotate, config.UnhealthyClusterPolicy)
+			},
+		},
+		{
+			name: "unknown unhealthy cluster policy",
+			data: map[string]string{
+				"unhealthyClusterPolicy": "skip",
+			},
+			expectedError: true,
+		},
+		{
+			name: "watch scope policy",
+			data: map[string]string{
+				"watchScopePolicy": "fail",
+			},
+			validateFn: func(t *testing.T, config *PluginConfig) {
+				assert.Equal(t, WatchScopeFail, config.WatchScopePolicy)
+			},
+		},
+		{
+			name: "unknown watch scope policy",
+			data: map[string]string{
+				"watchScopePolicy": "ignore",
+			},
+			expectedError: true,
+		},
+		{
+			name: "skip reason policies",
+			data: map[string]string{
+				"skipReasonPolicies": "archiving-failing: fail\nno-completed-backup: latest\n",
+			},
+			validateFn: func(t *testing.T, config *PluginConfig) {
+				assert.Equal(t, map[string]string{
+					SkipReasonArchivingFailing:  SkipReasonPolicyFail,
+					SkipReasonNoCompletedBackup: SkipReasonPolicyLatest,
+				}, config.SkipReasonPolicies)
+			},
+		},
+		{
+			name: "unknown skip reason",
+			data: map[string]string{
+				"skipReasonPolicies": "archiving-broken: fail\n",
+			},
+			expectedError: true,
+		},
+		{
+			name: "unknown skip reason policy",
+			data: map[string]string{
+				"skipReasonPolicies": "archiving-failing: ignore\n",
+			},
+			expectedError: true,
+		},
+		{
+			name: "gitops metadata",
+			data: map[string]string{
+				"gitOps": "labels:\n  app.kubernetes.io/instance: payments\nannotations:\n  argocd.argoproj.io/tracking-id: payments:postgresql.cnpg.io/Cluster:app/pg\npreventPrune: true\n",
+			},
+			validateFn: func(t *testing.T, config *PluginConfig) {
+				assert.Equal(t, &GitOpsConfig{
+					Labels:       map[string]string{"app.kubernetes.io/instance": "payments"},
+					Annotations:  map[string]string{"argocd.argoproj.io/tracking-id": "payments:postgresql.cnpg.io/Cluster:app/pg"},
+					PreventPrune: true,
+				}, config.GitOps)
+			},
+		},
+		{
+			name: "gitops tracking metadata",
+			data: map[string]string{
+				"gitOps": "trackingMetadata:\n  policy: strip\nnamespaceTrackingMetadata:\n  payments:\n    ownerNames:\n      payments: payments-dr\n",
+			},
+			validateFn: func(t *testing.T, config *PluginConfig) {
+				assert.Equal(t, TrackingMetadataStrip, config.GitOps.TrackingMetadata.Policy)
+				assert.Equal(t, map[string]string{"payments": "payments-dr"}, config.GitOps.NamespaceTrackingMetadata["payments"].OwnerNames)
+			},
+		},
+		{
+			name: "unknown tracking metadata policy",
+			data: map[string]string{
+				"gitOps": "namespaceTrackingMetadata:\n  payments:\n    policy: rewrite\n",
+			},
+			expectedError: true,
+		},
+		{
+			name: "owner names of stripped tracking metadata",
+			data: map[string]string{
+				"gitOps": "trackingMetadata:\n  policy: strip\n  ownerNames:\n    payments: payments-dr\n",
+			},
+			expectedError: true,
+		},
+		{
+			name: "invalid gitops label value",
+			data: map[string]string{
+				"gitOps": "labels:\n  app.kubernetes.io/instance: payments/prod\n",
+			},
+			expectedError: true,
+		},
+		{
+			name: "invalid gitops annotation key",
+			data: map[string]string{
+				"gitOps": "annotations:\n  argocd.argoproj.io/tracking id: payments\n",
+			},
+			expectedError: true,
+		},
+		{
+			name: "wal restore tuning",
+			data: map[string]string{
+				"walRestore": "maxParallel: 8\nrestoreAdditionalCommandArgs:\n- --read-timeout=60\n",
+			},
+			validateFn: func(t *testing.T, config *PluginConfig) {
+				assert.Equal(t, &WALRestoreConfig{MaxParallel: 8, RestoreAdditionalCommandArgs: []string{"--read-timeout=60"}}, config.WALRestore)
+			},
+		},
+		{
+			name: "negative wal restore parallelism",
+			data: map[string]string{
+				"walRestore": "maxParallel: -1\n",
+			},
+			expectedError: true,
+		},
+		{
+			name: "resource patches",
+			data: map[string]string{
+				"resourcePatches": "- group: postgresql.cnpg.io\n  kind: Pooler\n  jsonPatch:\n  - op: replace\n    path: /spec/instances\n    value: 1\n- kind: Service\n  strategicMergePatch:\n    spec:\n      type: ClusterIP\n",
+			},
+			validateFn: func(t *testing.T, config *PluginConfig) {
+				require.Len(t, config.ResourcePatches, 2)
+				assert.Equal(t, "Pooler", config.ResourcePatches[0].Kind)
+				assert.JSONEq(t, `[{"op":"replace","path":"/spec/instances","value":1}]`, string(config.ResourcePatches[0].JSONPatch))
+				assert.JSONEq(t, `{"spec":{"type":"ClusterIP"}}`, string(config.ResourcePatches[1].StrategicMergePatch))
+			},
+		},
+		{
+			name: "resource patch without kind",
+			data: map[string]string{
+				"resourcePatches": "- mergePatch:\n    metadata:\n      labels:\n        dr: \"true\"\n",
+			},
+			expectedError: true,
+		},
+		{
+			name: "resource patch with two patches",
+			data: map[string]string{
+				"resourcePatches": "- kind: Secret\n  mergePatch: {}\n  jsonPatch: []\n",
+			},
+			expectedError: true,
+		},
+		{
+			name: "strategic merge patch of a custom resource",
+			data: map[string]string{
+				"resourcePatches": "- group: postgresql.cnpg.io\n  kind: Pooler\n  strategicMergePatch:\n    spec:\n      instances: 1\n",
+			},
+			expectedError: true,
+		},
+		{
+			name: "scheduled backup template",
+			data: map[string]string{
+				"scheduledBackupTemplate": "schedule: \"0 0 0 * * *\"\nimmediate: true\n",
+			},
+			validateFn: func(t *testing.T, config *PluginConfig) {
+				require.NotNil(t, config.ScheduledBackupTemplate)
+				assert.Equal(t, "0 0 0 * * *", config.ScheduledBackupTemplate.Schedule)
+				assert.True(t, config.ScheduledBackupTemplate.Immediate)
+			},
+		},
+		{
+			name: "scheduled backup template without schedule",
+			data: map[string]string{
+				"scheduledBackupTemplate": "immediate: true\n",
+			},
+			expectedError: true,
+		},
+		{
+			name: "replica with delayed promotion",
+			data: map[string]string{
+				"replica": "enabled: true\npromotion: after\npromoteAfter: 30m\n",
+			},
+			validateFn: func(t *testing.T, config *PluginConfig) {
+				assert.Equal(t, &ReplicaConfig{Enabled: true, Promotion: PromotionAfter, PromoteAfter: "30m"}, config.Replica)
+			},
+		},
+		{
+			name: "replica outside recovery mode",
+			data: map[string]string{
+				"restoreMode":   "pg_basebackup",
+				"sourceCluster": "connectionParameters:\n  host: source\n",
+				"replica":       "enabled: true\n",
+			},
+			expectedError: true,
+		},
+		{
+			name: "unknown restore mode",
+			data: map[string]string{
+				"restoreMode": "magic",
+			},
+			expectedError: true,
+		},
+		{
+			name: "malformed section",
+			data: map[string]string{
+				"sourceCluster": "connectionParameters: [",
+			},
+			expectedError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := parsePluginConfig(tt.data)
+
+			if tt.expectedError {
+				assert.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				if tt.validateFn != nil {
+					tt.validateFn(t, config)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadPluginConfig(t *testing.T) {
+	t.Setenv("VELERO_NAMESPACE", "velero")
+
+	t.Run("no ConfigMap - defaults", func(t *testing.T) {
+		client := fake.NewSimpleClientset()
+
+		config, err := LoadPluginConfig(client, common.PluginKindRestoreItemAction, RestorePluginName)
+		require.NoError(t, err)
+		assert.Equal(t, DefaultPluginConfig(), config)
+	})
+
+	t.Run("labelled ConfigMap", func(t *testing.T) {
+		client := fake.NewSimpleClientset(&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "cnpg-plugin-config",
+				Namespace: "velero",
+				Labels: map[string]string{
+					"velero.io/plugin-config": "",
+					RestorePluginName:         string(common.PluginKindRestoreItemAction),
+				},
+			},
+			Data: map[string]string{
+				"restoreMode":   "pg_basebackup",
+				"sourceCluster": "connectionParameters:\n  host: prod-rw\n",
+			},
+		})
+
+		config, err := LoadPluginConfig(client, common.PluginKindRestoreItemAction, RestorePluginName)
+		require.NoError(t, err)
+		assert.Equal(t, RestoreModePgBaseBackup, config.RestoreMode)
+	})
+
+	t.Run("ConfigMap for another action is ignored", func(t *testing.T) {
+		client := fake.NewSimpleClientset(&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "other-plugin-config",
+				Namespace: "velero",
+				Labels: map[string]string{
+					"velero.io/plugin-config": "",
+					"example.com/other":       string(common.PluginKindRestoreItemAction),
+				},
+			},
+			Data: map[string]string{
+				"restoreMode": "magic",
+			},
+		})
+
+		config, err := LoadPluginConfig(client, common.PluginKindRestoreItemAction, RestorePluginName)
+		require.NoError(t, err)
+		assert.Equal(t, RestoreModeRecovery, config.RestoreMode)
+	})
+
+	t.Run("invalid ConfigMap", func(t *testing.T) {
+		client := fake.NewSimpleClientset(&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "cnpg-plugin-config",
+				Namespace: "velero",
+				Labels: map[string]string{
+					"velero.io/plugin-config": "",
+					RestorePluginName:         string(common.PluginKindRestoreItemAction),
+				},
+			},
+			Data: map[string]string{
+				"restoreMode": "magic",
+			},
+		})
+
+		_, err := LoadPluginConfig(client, common.PluginKindRestoreItemAction, RestorePluginName)
+		assert.Error(t, err)
+	})
+}
+
+func TestAppliesToFailsClosed(t *testing.T) {
+	// The plugin ConfigMap cannot be read without a client
+	t.Setenv(EnvKubeconfig, "/nonexistent/kubeconfig")
+
+	actions := map[string]interface {
+		AppliesTo() (velero.ResourceSelector, error)
+	}{
+		"backup":    &BackupPluginV2{log: logrus.New()},
+		"restore":   &RestorePluginV2{log: logrus.New()},
+		"fencing":   &SnapshotFencingPluginV2{log: logrus.New()},
+		"dependent": &DependentsRestorePlugin{log: logrus.New()},
+		"patch":     &ResourcePatchRestorePlugin{log: logrus.New()},
+	}
+	for name, action := range actions {
+		selector, err := action.AppliesTo()
+		assert.ErrorContains(t, err, "failed to get Kubernetes client for plugin config", name)
+		assert.Equal(t, []string{"*"}, selector.ExcludedNamespaces, name)
+	}
+}
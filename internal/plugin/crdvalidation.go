@@ -0,0 +1,119 @@
+package plugin
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/apiextensions-apiserver/pkg/apis/apiextensions"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apiextensions-apiserver/pkg/apiserver/validation"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// clusterCRDName is the name of the CNPG Cluster CustomResourceDefinition
+const clusterCRDName = "clusters.postgresql.cnpg.io"
+
+// schemaFetchTimeout bounds reading the Cluster CRD from the API server
+const schemaFetchTimeout = 10 * time.Second
+
+// crdGVR identifies CustomResourceDefinition resources
+var crdGVR = schema.GroupVersionResource{
+	Group:    "apiextensions.k8s.io",
+	Version:  "v1",
+	Resource: "customresourcedefinitions",
+}
+
+// schemaValidators caches the validators built from the Cluster CRD, keyed by the CRD's
+// UID, resourceVersion and schema version. Building a validator converts the whole CNPG
+// schema, which is too expensive to repeat for every restored cluster.
+var schemaValidators sync.Map
+
+// clusterSchemaValidator reads the OpenAPI schema of the given version of the CNPG
+// Cluster CRD installed in the cluster and builds a validator from it
+func clusterSchemaValidator(ctx context.Context, dynamicClient dynamic.Interface, version string) (validation.SchemaCreateValidator, error) {
+	obj, err := dynamicClient.Resource(crdGVR).Get(ctx, clusterCRDName, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(classifyAPIError(err), "failed to get CRD %s", clusterCRDName)
+	}
+
+	cacheKey := string(obj.GetUID()) + "/" + obj.GetResourceVersion() + "/" + version
+	cacheable := obj.GetResourceVersion() != ""
+	if cacheable {
+		if validator, found := schemaValidators.Load(cacheKey); found {
+			return validator.(validation.SchemaCreateValidator), nil
+		}
+	}
+
+	crd := &apiextensionsv1.CustomResourceDefinition{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, crd); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode CRD %s", clusterCRDName)
+	}
+
+	for _, v := range crd.Spec.Versions {
+		if v.Name != version {
+			continue
+		}
+		if v.Schema == nil || v.Schema.OpenAPIV3Schema == nil {
+			return nil, errors.Errorf("CRD %s has no schema for version %s", clusterCRDName, version)
+		}
+
+		internal := &apiextensions.JSONSchemaProps{}
+		if err := apiextensionsv1.Convert_v1_JSONSchemaProps_To_apiextensions_JSONSchemaProps(v.Schema.OpenAPIV3Schema, internal, nil); err != nil {
+			return nil, errors.Wrapf(err, "failed to convert schema of CRD %s", clusterCRDName)
+		}
+
+		validator, _, err := validation.NewSchemaValidator(internal)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to build validator for CRD %s", clusterCRDName)
+		}
+		if cacheable {
+			schemaValidators.Store(cacheKey, validator)
+		}
+		return validator, nil
+	}
+
+	return nil, errors.Errorf("CRD %s does not serve version %s", clusterCRDName, version)
+}
+
+// validateClusterSchema checks the mutated cluster against the schema of the installed
+// Cluster CRD, so a malformed mutation fails the restore of this item with a clear
+// message instead of being rejected by the API server when Velero applies it. The
+// check is skipped with a warning when the CRD cannot be read.
+func (p *RestorePluginV2) validateClusterSchema(itemContent map[string]interface{}) error {
+	dynamicClient, err := p.getDynamicClient()
+	if err != nil {
+		p.log.Warnf("Failed to create dynamic client, skipping schema validation: %v", err)
+		return nil
+	}
+
+	gv, err := schema.ParseGroupVersion(stringValue(itemContent["apiVersion"]))
+	if err != nil {
+		return errors.Wrap(err, "failed to parse cluster apiVersion")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), schemaFetchTimeout)
+	defer cancel()
+
+	validator, err := clusterSchemaValidator(ctx, dynamicClient, gv.Version)
+	if err != nil {
+		p.log.Warnf("Skipping schema validation: %v", err)
+		return nil
+	}
+
+	if errs := validation.ValidateCustomResource(nil, itemContent, validator); len(errs) > 0 {
+		return errors.Errorf("restored cluster does not match the %s schema: %v", clusterCRDName, errs.ToAggregate())
+	}
+
+	return nil
+}
+
+// stringValue returns v as a string, or an empty string when it is not one
+func stringValue(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
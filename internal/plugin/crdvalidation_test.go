@@ -0,0 +1,171 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/fake"
+)
+
+// createMockClusterCRD creates a reduced Cluster CRD serving v1
+func createMockClusterCRD() *unstructured.Unstructured {
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "apiextensions.k8s.io/v1",
+			"kind":       "CustomResourceDefinition",
+			"metadata":   map[string]interface{}{"name": clusterCRDName},
+			"spec": map[string]interface{}{
+				"group": "postgresql.cnpg.io",
+				"names": map[string]interface{}{"kind": "Cluster", "plural": "clusters"},
+				"scope": "Namespaced",
+				"versions": []interface{}{
+					map[string]interface{}{
+						"name":    "v1",
+						"served":  true,
+						"storage": true,
+						"schema": map[string]interface{}{
+							"openAPIV3Schema": map[string]interface{}{
+								"type": "object",
+								"properties": map[string]interface{}{
+									"spec": map[string]interface{}{
+										"type": "object",
+										"properties": map[string]interface{}{
+											"instances": map[string]interface{}{"type": "integer", "minimum": int64(1)},
+											"bootstrap": map[string]interface{}{
+												"type": "object",
+												"properties": map[string]interface{}{
+													"recovery": map[string]interface{}{
+														"type": "object",
+														"properties": map[string]interface{}{
+															"source": map[string]interface{}{"type": "string"},
+														},
+													},
+												},
+											},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func newFakeCRDClient(objects ...runtime.Object) *fake.FakeDynamicClient {
+	scheme := runtime.NewScheme()
+	scheme.AddKnownTypeWithName(schema.GroupVersionKind{Group: "apiextensions.k8s.io", Version: "v1", Kind: "CustomResourceDefinition"}, &unstructured.Unstructured{})
+
+	return fake.NewSimpleDynamicClientWithCustomListKinds(scheme, map[schema.GroupVersionResource]string{
+		crdGVR: "CustomResourceDefinitionList",
+	}, objects...)
+}
+
+func TestValidateClusterSchema(t *testing.T) {
+	tests := []struct {
+		name          string
+		apiVersion    string
+		spec          map[string]interface{}
+		objects       []runtime.Object
+		expectedError string
+	}{
+		{
+			name:       "valid cluster",
+			apiVersion: "postgresql.cnpg.io/v1",
+			spec: map[string]interface{}{
+				"instances": int64(3),
+				"bootstrap": map[string]interface{}{"recovery": map[string]interface{}{"source": recoverySourceName}},
+			},
+			objects: []runtime.Object{createMockClusterCRD()},
+		},
+		{
+			name:          "wrong type",
+			apiVersion:    "postgresql.cnpg.io/v1",
+			spec:          map[string]interface{}{"instances": "three"},
+			objects:       []runtime.Object{createMockClusterCRD()},
+			expectedError: "spec.instances",
+		},
+		{
+			name:       "malformed bootstrap",
+			apiVersion: "postgresql.cnpg.io/v1",
+			spec: map[string]interface{}{
+				"bootstrap": map[string]interface{}{"recovery": map[string]interface{}{"source": int64(1)}},
+			},
+			objects:       []runtime.Object{createMockClusterCRD()},
+			expectedError: "spec.bootstrap.recovery.source",
+		},
+		{
+			name:          "minimum violated",
+			apiVersion:    "postgresql.cnpg.io/v1",
+			spec:          map[string]interface{}{"instances": int64(0)},
+			objects:       []runtime.Object{createMockClusterCRD()},
+			expectedError: "spec.instances",
+		},
+		{
+			name:       "CRD not installed skips validation",
+			apiVersion: "postgresql.cnpg.io/v1",
+			spec:       map[string]interface{}{"instances": "three"},
+		},
+		{
+			name:       "unserved version skips validation",
+			apiVersion: "postgresql.cnpg.io/v2",
+			spec:       map[string]interface{}{"instances": "three"},
+			objects:    []runtime.Object{createMockClusterCRD()},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plugin := &RestorePluginV2{
+				log:           logrus.New(),
+				dynamicClient: newFakeCRDClient(tt.objects...),
+			}
+			itemContent := map[string]interface{}{
+				"apiVersion": tt.apiVersion,
+				"kind":       "Cluster",
+				"metadata":   map[string]interface{}{"name": "pg", "namespace": "default"},
+				"spec":       tt.spec,
+			}
+
+			err := plugin.validateClusterSchema(itemContent)
+			if tt.expectedError != "" {
+				assert.ErrorContains(t, err, tt.expectedError)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestClusterSchemaValidatorIsCached(t *testing.T) {
+	crd := createMockClusterCRD()
+	crd.SetUID("crd-uid")
+	crd.SetResourceVersion("1")
+	dynamicClient := newFakeCRDClient(crd)
+
+	validator, err := clusterSchemaValidator(context.Background(), dynamicClient, "v1")
+	require.NoError(t, err)
+	again, err := clusterSchemaValidator(context.Background(), dynamicClient, "v1")
+	require.NoError(t, err)
+	assert.Same(t, validator, again)
+
+	// An updated CRD gets a new validator
+	updated := createMockClusterCRD()
+	updated.SetUID("crd-uid")
+	updated.SetResourceVersion("2")
+	_, err = dynamicClient.Resource(crdGVR).Update(context.Background(), updated, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	refreshed, err := clusterSchemaValidator(context.Background(), dynamicClient, "v1")
+	require.NoError(t, err)
+	assert.NotSame(t, validator, refreshed)
+}
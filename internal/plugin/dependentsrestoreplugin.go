@@ -0,0 +1,184 @@
+package plugin
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework/common"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// AnnotationClusterOnly is the annotation on a Velero Restore that restores CNPG clusters
+// without their dependent resources, like the clusterOnly setting does for every restore
+const AnnotationClusterOnly = "velero-cnpg/cluster-only"
+
+// clusterDependentResources are the CNPG resources that depend on a cluster and are left
+// out of cluster-only restores
+var clusterDependentResources = []string{
+	"poolers.postgresql.cnpg.io",
+	"scheduledbackups.postgresql.cnpg.io",
+	"databases.postgresql.cnpg.io",
+	"publications.postgresql.cnpg.io",
+	"subscriptions.postgresql.cnpg.io",
+}
+
+// clusterOnly reports whether the restore brings back CNPG clusters without their
+// dependent resources, because the restore is annotated or the config asks for it
+func clusterOnly(restore *v1.Restore, config *PluginConfig) bool {
+	if restore != nil {
+		if only, err := strconv.ParseBool(restore.Annotations[AnnotationClusterOnly]); err == nil {
+			return only
+		}
+	}
+	return config.ClusterOnly
+}
+
+// DependentsRestorePlugin is a restore item action plugin for Velero that skips the CNPG
+// resources depending on a cluster, such as Poolers, ScheduledBackups and Databases, in
+// cluster-only restores. Those get the data back quickly and leave the rest to a GitOps
+// re-sync. The resources it restores get the GitOps tracking metadata rule of the cluster.
+// In rehearsals they are created in the scratch namespace next to their cluster.
+type DependentsRestorePlugin struct {
+	log logrus.FieldLogger
+
+	// kubeClient overrides GetClient for rehearsal namespaces when set
+	kubeClient kubernetes.Interface
+
+	// dynamicClient overrides GetDynamicClient when set
+	dynamicClient dynamic.Interface
+
+	// config overrides the plugin ConfigMap lookup when set
+	config *PluginConfig
+}
+
+// NewDependentsRestorePlugin instantiates a new DependentsRestorePlugin.
+func NewDependentsRestorePlugin(log logrus.FieldLogger) *DependentsRestorePlugin {
+	return &DependentsRestorePlugin{log: log}
+}
+
+// getKubeClient returns the client used to create rehearsal namespaces
+func (p *DependentsRestorePlugin) getKubeClient() (kubernetes.Interface, error) {
+	if p.kubeClient != nil {
+		return p.kubeClient, nil
+	}
+	return GetClient()
+}
+
+// getDynamicClient returns the dynamic client used to create rehearsed resources
+func (p *DependentsRestorePlugin) getDynamicClient() (dynamic.Interface, error) {
+	if p.dynamicClient != nil {
+		return p.dynamicClient, nil
+	}
+	return GetDynamicClient()
+}
+
+// getConfig returns the plugin configuration, see loadActionConfig
+func (p *DependentsRestorePlugin) getConfig() (*PluginConfig, error) {
+	return loadActionConfig(p.config, common.PluginKindRestoreItemAction, DependentsRestorePluginName)
+}
+
+// Name is required to implement the interface, but the Velero pod does not delegate this
+// method -- it's used to tell velero what name it was registered under. The plugin implementation
+// must define it, but it will never actually be called.
+func (p *DependentsRestorePlugin) Name() string {
+	return "dependentsRestorePlugin"
+}
+
+// AppliesTo returns information about which resources this action should be invoked for.
+func (p *DependentsRestorePlugin) AppliesTo() (velero.ResourceSelector, error) {
+	config, err := p.getConfig()
+	if err != nil {
+		return noNamespaces(), err
+	}
+	return config.scopeNamespaces(velero.ResourceSelector{
+		IncludedResources: clusterDependentResources,
+	}), nil
+}
+
+// Execute skips the restore of CNPG dependent resources in cluster-only restores, and
+// applies the GitOps tracking metadata rule to the others. Rehearsals create them in the
+// scratch namespace instead of restoring them.
+func (p *DependentsRestorePlugin) Execute(input *velero.RestoreItemActionExecuteInput) (_ *velero.RestoreItemActionExecuteOutput, err error) {
+	defer reportError(p.log, "dependents restore plugin", input.Item, &err)
+	defer recoverPanic(p.log, "dependents restore plugin", input.Item, &err)
+
+	if restoreDisabled(input.Restore) {
+		p.log.Infof("Restore has %s set, passing item through unmodified", AnnotationDisable)
+		return velero.NewRestoreItemActionExecuteOutput(input.Item), nil
+	}
+
+	config, err := p.getConfig()
+	if err != nil {
+		return nil, err
+	}
+	item := &unstructured.Unstructured{Object: input.Item.UnstructuredContent()}
+
+	if clusterOnly(input.Restore, config) {
+		p.log.Infof("Skipping %s %s/%s, the restore only brings back CNPG clusters", item.GetKind(), item.GetNamespace(), item.GetName())
+		return velero.NewRestoreItemActionExecuteOutput(input.Item).WithoutRestore(), nil
+	}
+
+	// Dependent resources follow the tracking metadata rule of the clusters they belong to
+	changed, err := applyTrackingMetadata(item.Object, config.GitOps.trackingRule(item.GetNamespace()))
+	if err != nil {
+		return nil, err
+	}
+	if len(changed) > 0 {
+		p.log.Infof("Rewrote GitOps tracking metadata %s of %s %s/%s", strings.Join(changed, ", "), item.GetKind(), item.GetNamespace(), item.GetName())
+		input.Item.SetUnstructuredContent(item.Object)
+	}
+
+	rehearsing, err := rehearsalNamespace(input.Restore, config)
+	if err != nil {
+		return nil, err
+	}
+	if rehearsing != "" {
+		return p.rehearse(input, item, rehearsing)
+	}
+
+	return velero.NewRestoreItemActionExecuteOutput(input.Item), nil
+}
+
+// rehearse creates the dependent resource in the scratch namespace and leaves it out of
+// Velero's restore. ScheduledBackups are left out, since drills do not archive.
+func (p *DependentsRestorePlugin) rehearse(input *velero.RestoreItemActionExecuteInput, item *unstructured.Unstructured, namespace string) (*velero.RestoreItemActionExecuteOutput, error) {
+	if item.GetKind() == "ScheduledBackup" {
+		p.log.Infof("Skipping ScheduledBackup %s/%s, rehearsed clusters do not back up", item.GetNamespace(), item.GetName())
+		return velero.NewRestoreItemActionExecuteOutput(input.Item).WithoutRestore(), nil
+	}
+
+	dynamicClient, err := p.getDynamicClient()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create dynamic client")
+	}
+	kubeClient, err := p.getKubeClient()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get Kubernetes client")
+	}
+
+	rehearse(item.Object, namespace, input.Restore)
+	if err := createRehearsalItem(dynamicClient, kubeClient, item); err != nil {
+		return nil, err
+	}
+	p.log.Infof("Created rehearsal %s %s/%s", item.GetKind(), namespace, item.GetName())
+	return velero.NewRestoreItemActionExecuteOutput(input.Item).WithoutRestore(), nil
+}
+
+func (p *DependentsRestorePlugin) Progress(operationID string, restore *v1.Restore) (velero.OperationProgress, error) {
+	progress := velero.OperationProgress{}
+	return progress, nil
+}
+
+func (p *DependentsRestorePlugin) Cancel(operationID string, restore *v1.Restore) error {
+	return nil
+}
+
+func (p *DependentsRestorePlugin) AreAdditionalItemsReady(additionalItems []velero.ResourceIdentifier, restore *v1.Restore) (bool, error) {
+	return true, nil
+}
@@ -0,0 +1,121 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestDependentsRestorePluginExecute(t *testing.T) {
+	annotatedRestore := func(value string) *v1.Restore {
+		return &v1.Restore{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{AnnotationClusterOnly: value}}}
+	}
+
+	tests := []struct {
+		name        string
+		clusterOnly bool
+		restore     *v1.Restore
+		expectSkip  bool
+	}{
+		{
+			name: "restored by default",
+		},
+		{
+			name:        "skipped with clusterOnly",
+			clusterOnly: true,
+			expectSkip:  true,
+		},
+		{
+			name:       "skipped for an annotated restore",
+			restore:    annotatedRestore("true"),
+			expectSkip: true,
+		},
+		{
+			name:        "the restore annotation wins over the config",
+			clusterOnly: true,
+			restore:     annotatedRestore("false"),
+		},
+		{
+			name:        "disabled restores pass items through",
+			clusterOnly: true,
+			restore:     &v1.Restore{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{AnnotationDisable: "true"}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plugin := &DependentsRestorePlugin{
+				log:    logrus.New(),
+				config: &PluginConfig{ClusterOnly: tt.clusterOnly},
+			}
+
+			item := &unstructured.Unstructured{Object: map[string]interface{}{
+				"apiVersion": "postgresql.cnpg.io/v1",
+				"kind":       "Pooler",
+				"metadata":   map[string]interface{}{"name": "pg-rw", "namespace": "default"},
+			}}
+
+			output, err := plugin.Execute(&velero.RestoreItemActionExecuteInput{Item: item, Restore: tt.restore})
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectSkip, output.SkipRestore)
+		})
+	}
+}
+
+func TestRestoreExecuteClusterOnly(t *testing.T) {
+	for _, only := range []bool{false, true} {
+		item := annotatedCluster("pg", "default", map[string]string{
+			AnnotationServerName:   "pg",
+			AnnotationBackupMethod: BackupMethodPlugin,
+			AnnotationPoolers:      `["pg-rw"]`,
+		})
+		item.Object["spec"] = createMockPluginCluster("pg", "default").Object["spec"]
+
+		plugin := &RestorePluginV2{
+			log: logrus.New(),
+			config: &PluginConfig{
+				RestoreMode:          RestoreModeRecovery,
+				ClusterOnly:          only,
+				ValidatePoolers:      true,
+				SkipSchemaValidation: true,
+				SkipPluginCheck:      true,
+			},
+			dynamicClient: newFakeDynamicClient(),
+			kubeClient:    newFakeKubeClient(),
+		}
+
+		out, err := plugin.Execute(&velero.RestoreItemActionExecuteInput{Item: item})
+		require.NoError(t, err)
+		// Poolers left out of the restore are not waited for
+		assert.Equal(t, only, out.OperationID == "", "clusterOnly %t", only)
+	}
+}
+
+func TestDependentsRestorePluginTrackingMetadata(t *testing.T) {
+	plugin := &DependentsRestorePlugin{
+		log: logrus.New(),
+		config: &PluginConfig{GitOps: &GitOpsConfig{
+			NamespaceTrackingMetadata: map[string]TrackingMetadataRule{"default": {Policy: TrackingMetadataStrip}},
+		}},
+	}
+
+	item := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "postgresql.cnpg.io/v1",
+		"kind":       "Pooler",
+		"metadata": map[string]interface{}{
+			"name":      "pg-rw",
+			"namespace": "default",
+			"labels":    map[string]interface{}{labelFluxName: "payments", "cnpg.io/cluster": "pg"},
+		},
+	}}
+
+	output, err := plugin.Execute(&velero.RestoreItemActionExecuteInput{Item: item})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"cnpg.io/cluster": "pg"}, output.UpdatedItem.(*unstructured.Unstructured).GetLabels())
+}
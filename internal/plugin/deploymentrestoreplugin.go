@@ -1,10 +1,16 @@
 package plugin
 
 import (
+	"time"
+
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework/common"
 	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
 )
 
 const (
@@ -15,6 +21,15 @@ const (
 // DeploymentRestorePlugin is a restore item action plugin for Velero that handles deployments
 type DeploymentRestorePlugin struct {
 	log logrus.FieldLogger
+
+	// kubeClient overrides GetClient for the status ConfigMap when set
+	kubeClient kubernetes.Interface
+
+	// dynamicClient overrides GetDynamicClient when set
+	dynamicClient dynamic.Interface
+
+	// config overrides the plugin ConfigMap lookup when set
+	config *PluginConfig
 }
 
 // NewDeploymentRestorePlugin instantiates a new DeploymentRestorePlugin.
@@ -22,6 +37,27 @@ func NewDeploymentRestorePlugin(log logrus.FieldLogger) *DeploymentRestorePlugin
 	return &DeploymentRestorePlugin{log: log}
 }
 
+// getKubeClient returns the client used to record restore warnings
+func (p *DeploymentRestorePlugin) getKubeClient() (kubernetes.Interface, error) {
+	if p.kubeClient != nil {
+		return p.kubeClient, nil
+	}
+	return GetClient()
+}
+
+// getDynamicClient returns the dynamic client used to scale held deployments
+func (p *DeploymentRestorePlugin) getDynamicClient() (dynamic.Interface, error) {
+	if p.dynamicClient != nil {
+		return p.dynamicClient, nil
+	}
+	return GetDynamicClient()
+}
+
+// getConfig returns the plugin configuration, see loadActionConfig
+func (p *DeploymentRestorePlugin) getConfig() (*PluginConfig, error) {
+	return loadActionConfig(p.config, common.PluginKindRestoreItemAction, DeploymentRestorePluginName)
+}
+
 // Name is required to implement the interface, but the Velero pod does not delegate this
 // method -- it's used to tell velero what name it was registered under. The plugin implementation
 // must define it, but it will never actually be called.
@@ -36,38 +72,79 @@ func (p *DeploymentRestorePlugin) Name() string {
 // selector. A zero-valued ResourceSelector matches all resources.
 func (p *DeploymentRestorePlugin) AppliesTo() (velero.ResourceSelector, error) {
 	p.log.Info("DeploymentRestorePlugin.AppliesTo called")
-	return velero.ResourceSelector{
+	config, err := p.getConfig()
+	if err != nil {
+		return noNamespaces(), err
+	}
+	return config.scopeNamespaces(velero.ResourceSelector{
 		IncludedResources: []string{"deployments"},
-	}, nil
+	}), nil
 }
 
 // Execute allows the DeploymentRestorePlugin to perform arbitrary logic with the item being restored,
-// in this case, removing init containers named "wait-for-migration-job".
-func (p *DeploymentRestorePlugin) Execute(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
+// in this case, removing init containers named "wait-for-migration-job" and, in coordinated
+// namespaces, scaling the deployment down until the restored clusters are healthy.
+func (p *DeploymentRestorePlugin) Execute(input *velero.RestoreItemActionExecuteInput) (_ *velero.RestoreItemActionExecuteOutput, err error) {
+	defer reportError(p.log, "deployment restore plugin", input.Item, &err)
+	defer recoverPanic(p.log, "deployment restore plugin", input.Item, &err)
+
 	p.log.Info("Executing deployment restore plugin on resource: %s", resourceName(input.Item))
 
+	if restoreDisabled(input.Restore) {
+		p.log.Infof("Restore has %s set, passing item through unmodified", AnnotationDisable)
+		return velero.NewRestoreItemActionExecuteOutput(input.Item), nil
+	}
+
+	warnings := &restoreWarnings{log: p.log}
+	defer flushRestoreWarnings(p.log, p.getKubeClient, input.Restore, input.Item, warnings)
+
 	itemContent := input.Item.UnstructuredContent()
+	p.removeMigrationInitContainers(itemContent, warnings)
 
+	// Keep applications down until the databases they depend on are healthy
+	var operationID string
+	config, err := p.getConfig()
+	if err != nil {
+		return nil, err
+	}
+	if config.CoordinateNamespace {
+		held, err := holdDeployment(itemContent)
+		if err != nil {
+			warnings.Warnf("Failed to hold Deployment until the restored clusters are healthy: %v", err)
+		} else if held {
+			deployment := &unstructured.Unstructured{Object: itemContent}
+			p.log.Infof("Scaled Deployment down until the restored clusters in namespace %s are healthy", deployment.GetNamespace())
+			operationID = encodeGateOperationID(&gateOperation{namespace: deployment.GetNamespace(), kind: gateKindDeployment, name: deployment.GetName()})
+		}
+	}
+
+	// Update the item with modified content
+	input.Item.SetUnstructuredContent(itemContent)
+
+	out := velero.NewRestoreItemActionExecuteOutput(input.Item)
+	out.OperationID = withStarted(operationID, time.Now())
+	return out, nil
+}
+
+// removeMigrationInitContainers removes init containers named "wait-for-migration-job". The
+// deployment is left unchanged when its initContainers cannot be read.
+func (p *DeploymentRestorePlugin) removeMigrationInitContainers(itemContent map[string]interface{}, warnings *restoreWarnings) {
 	// Check if this deployment has init containers
 	initContainers, found, err := unstructured.NestedFieldNoCopy(itemContent, "spec", "template", "spec", "initContainers")
 	if err != nil {
-		p.log.Warnf("Failed to get initContainers field: %v", err)
-		// Return unchanged deployment on error
-		out := velero.NewRestoreItemActionExecuteOutput(input.Item)
-		return out, nil
+		warnings.Warnf("Failed to get initContainers field: %v", err)
+		return
 	}
 
 	if !found {
 		p.log.Info("No initContainers found in deployment, skipping")
-		out := velero.NewRestoreItemActionExecuteOutput(input.Item)
-		return out, nil
+		return
 	}
 
 	initContainersList, ok := initContainers.([]interface{})
 	if !ok {
-		p.log.Warn("initContainers is not a list, skipping")
-		out := velero.NewRestoreItemActionExecuteOutput(input.Item)
-		return out, nil
+		warnings.Warnf("initContainers is not a list, skipping")
+		return
 	}
 
 	// Filter out init containers named "wait-for-migration-job"
@@ -115,27 +192,41 @@ func (p *DeploymentRestorePlugin) Execute(input *velero.RestoreItemActionExecute
 			// Set the filtered containers
 			err = unstructured.SetNestedField(itemContent, filteredContainers, "spec", "template", "spec", "initContainers")
 			if err != nil {
-				p.log.Warnf("Failed to update initContainers: %v", err)
-				// Return unchanged deployment on error
-				out := velero.NewRestoreItemActionExecuteOutput(input.Item)
-				return out, nil
+				warnings.Warnf("Failed to update initContainers: %v", err)
+				return
 			}
 		}
 
-		// Update the item with modified content
-		input.Item.SetUnstructuredContent(itemContent)
 		p.log.Info("Successfully removed migration init containers from deployment")
 	} else {
 		p.log.Infof("No '%s' init containers found, deployment unchanged", MigrationInitContainerName)
 	}
-
-	out := velero.NewRestoreItemActionExecuteOutput(input.Item)
-	return out, nil
 }
 
+// Progress scales a held deployment back up once the restored clusters of its namespace
+// are healthy
 func (p *DeploymentRestorePlugin) Progress(operationID string, restore *v1.Restore) (velero.OperationProgress, error) {
-	progress := velero.OperationProgress{}
-	return progress, nil
+	operationID, started, err := splitStarted(operationID)
+	if err != nil {
+		return velero.OperationProgress{}, err
+	}
+	op, err := decodeGateOperationID(operationID)
+	if err != nil {
+		return velero.OperationProgress{}, err
+	}
+	if op.kind != gateKindDeployment {
+		return velero.OperationProgress{}, errors.Errorf("unexpected namespace gate operation ID %q", operationID)
+	}
+
+	dynamicClient, err := p.getDynamicClient()
+	if err != nil {
+		return velero.OperationProgress{}, errors.Wrap(err, "failed to create dynamic client")
+	}
+	progress, err := gateProgress(dynamicClient, op, restore, releaseDeployment)
+	if err != nil {
+		return progress, err
+	}
+	return applyOperationTimeout(progress, started, restoreOperationTimeout(restore), time.Now()), nil
 }
 
 func (p *DeploymentRestorePlugin) Cancel(operationID string, restore *v1.Restore) error {
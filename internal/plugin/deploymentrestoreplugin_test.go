@@ -12,7 +12,8 @@ import (
 
 func TestDeploymentRestorePluginAppliesTo(t *testing.T) {
 	plugin := &DeploymentRestorePlugin{
-		log: logrus.New(),
+		log:    logrus.New(),
+		config: DefaultPluginConfig(),
 	}
 
 	selector, err := plugin.AppliesTo()
@@ -23,7 +24,8 @@ func TestDeploymentRestorePluginAppliesTo(t *testing.T) {
 
 func TestDeploymentRestorePluginExecute(t *testing.T) {
 	plugin := &DeploymentRestorePlugin{
-		log: logrus.New(),
+		log:    logrus.New(),
+		config: DefaultPluginConfig(),
 	}
 
 	tests := []struct {
@@ -0,0 +1,168 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// annotationPrefix prefixes every annotation the plugin reads or writes
+const annotationPrefix = "velero-cnpg/"
+
+// Diagnostics is the plugin's view of a namespace, bundled for support cases
+type Diagnostics struct {
+	Namespace   string    `json:"namespace"`
+	CollectedAt time.Time `json:"collectedAt"`
+
+	Clusters     []ClusterDiagnostics     `json:"clusters"`
+	Backups      []BackupDiagnostics      `json:"backups"`
+	ObjectStores []ObjectStoreDiagnostics `json:"objectStores"`
+
+	// OverrideConfigMap is the data of the override ConfigMap written by restores
+	OverrideConfigMap map[string]string `json:"overrideConfigMap,omitempty"`
+
+	// Errors lists what could not be collected, e.g. because a CRD is not installed
+	Errors []string `json:"errors,omitempty"`
+}
+
+// ClusterDiagnostics holds the parts of a CNPG cluster the plugin reads and writes
+type ClusterDiagnostics struct {
+	Name         string `json:"name"`
+	Phase        string `json:"phase,omitempty"`
+	BackupMethod string `json:"backupMethod,omitempty"`
+	ServerName   string `json:"serverName,omitempty"`
+
+	// Annotations are the velero-cnpg/ annotations of the cluster
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	Plugins          []interface{}          `json:"plugins,omitempty"`
+	Backup           map[string]interface{} `json:"backup,omitempty"`
+	Bootstrap        map[string]interface{} `json:"bootstrap,omitempty"`
+	ExternalClusters []interface{}          `json:"externalClusters,omitempty"`
+}
+
+// BackupDiagnostics summarizes a CNPG Backup CR
+type BackupDiagnostics struct {
+	Name      string `json:"name"`
+	Cluster   string `json:"cluster,omitempty"`
+	Method    string `json:"method,omitempty"`
+	Phase     string `json:"phase,omitempty"`
+	BackupID  string `json:"backupID,omitempty"`
+	StartedAt string `json:"startedAt,omitempty"`
+	StoppedAt string `json:"stoppedAt,omitempty"`
+	EndLSN    string `json:"endLSN,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// ObjectStoreDiagnostics holds a barman-cloud ObjectStore. Credentials are secret
+// references, so the spec is included as it is.
+type ObjectStoreDiagnostics struct {
+	Name   string                 `json:"name"`
+	Spec   map[string]interface{} `json:"spec,omitempty"`
+	Status map[string]interface{} `json:"status,omitempty"`
+}
+
+// CollectDiagnostics collects the clusters, CNPG backups, ObjectStores and override
+// ConfigMap of a namespace. Failing to list one kind of resource is recorded in the
+// bundle, so the rest is still collected.
+func CollectDiagnostics(ctx context.Context, client kubernetes.Interface, dynamicClient dynamic.Interface, namespace string, now time.Time) *Diagnostics {
+	diagnostics := &Diagnostics{
+		Namespace:    namespace,
+		CollectedAt:  now.UTC(),
+		Clusters:     []ClusterDiagnostics{},
+		Backups:      []BackupDiagnostics{},
+		ObjectStores: []ObjectStoreDiagnostics{},
+	}
+	failed := func(what string, err error) {
+		diagnostics.Errors = append(diagnostics.Errors, fmt.Sprintf("failed to list %s: %v", what, classifyAPIError(err)))
+	}
+
+	if clusters, err := dynamicClient.Resource(cnpgClusterGVR).Namespace(namespace).List(ctx, metav1.ListOptions{}); err != nil {
+		failed("clusters", err)
+	} else {
+		for i := range clusters.Items {
+			diagnostics.Clusters = append(diagnostics.Clusters, clusterDiagnostics(&clusters.Items[i]))
+		}
+	}
+
+	if backups, err := dynamicClient.Resource(cnpgBackupGVR).Namespace(namespace).List(ctx, metav1.ListOptions{}); err != nil {
+		failed("backups", err)
+	} else {
+		for i := range backups.Items {
+			diagnostics.Backups = append(diagnostics.Backups, backupDiagnostics(&backups.Items[i]))
+		}
+	}
+
+	if objectStores, err := dynamicClient.Resource(barmanObjectStoreGVR).Namespace(namespace).List(ctx, metav1.ListOptions{}); err != nil {
+		failed("objectstores", err)
+	} else {
+		for _, objectStore := range objectStores.Items {
+			spec, _, _ := unstructured.NestedMap(objectStore.Object, "spec")
+			status, _, _ := unstructured.NestedMap(objectStore.Object, "status")
+			diagnostics.ObjectStores = append(diagnostics.ObjectStores, ObjectStoreDiagnostics{
+				Name:   objectStore.GetName(),
+				Spec:   spec,
+				Status: status,
+			})
+		}
+	}
+
+	configMap, err := client.CoreV1().ConfigMaps(namespace).Get(ctx, OverrideConfigMapName, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		diagnostics.Errors = append(diagnostics.Errors, fmt.Sprintf("failed to get ConfigMap %s: %v", OverrideConfigMapName, classifyAPIError(err)))
+	} else if err == nil {
+		diagnostics.OverrideConfigMap = configMap.Data
+	}
+
+	return diagnostics
+}
+
+// clusterDiagnostics extracts the parts of a cluster the plugin works with
+func clusterDiagnostics(cluster *unstructured.Unstructured) ClusterDiagnostics {
+	result := ClusterDiagnostics{Name: cluster.GetName()}
+	result.Phase, _, _ = unstructured.NestedString(cluster.Object, "status", "phase")
+
+	for key, value := range cluster.GetAnnotations() {
+		if strings.HasPrefix(key, annotationPrefix) {
+			if result.Annotations == nil {
+				result.Annotations = map[string]string{}
+			}
+			result.Annotations[key] = value
+		}
+	}
+
+	result.Plugins, _, _ = unstructured.NestedSlice(cluster.Object, "spec", "plugins")
+	result.Backup, _, _ = unstructured.NestedMap(cluster.Object, "spec", "backup")
+	result.Bootstrap, _, _ = unstructured.NestedMap(cluster.Object, "spec", "bootstrap")
+	result.ExternalClusters, _, _ = unstructured.NestedSlice(cluster.Object, "spec", "externalClusters")
+
+	result.ServerName, _ = walArchiverParameter(result.Plugins, "serverName")
+	result.BackupMethod = detectBackupMethod(cluster.Object, result.ServerName)
+	if result.ServerName == "" && result.BackupMethod == BackupMethodBarmanObjectStore {
+		result.ServerName = barmanObjectStoreServerName(cluster.Object)
+	}
+	return result
+}
+
+// backupDiagnostics summarizes a CNPG Backup CR
+func backupDiagnostics(backup *unstructured.Unstructured) BackupDiagnostics {
+	result := BackupDiagnostics{
+		Name:   backup.GetName(),
+		Method: backupMethodOf(backup),
+	}
+	result.Cluster, _, _ = unstructured.NestedString(backup.Object, "spec", "cluster", "name")
+	result.Phase, _, _ = unstructured.NestedString(backup.Object, "status", "phase")
+	result.BackupID, _, _ = unstructured.NestedString(backup.Object, "status", "backupId")
+	result.StartedAt, _, _ = unstructured.NestedString(backup.Object, "status", "startedAt")
+	result.StoppedAt, _, _ = unstructured.NestedString(backup.Object, "status", "stoppedAt")
+	result.EndLSN, _, _ = unstructured.NestedString(backup.Object, "status", "endLSN")
+	result.Error, _, _ = unstructured.NestedString(backup.Object, "status", "error")
+	return result
+}
@@ -0,0 +1,73 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestCollectDiagnostics(t *testing.T) {
+	now := time.Date(2024, 10, 24, 12, 0, 0, 0, time.UTC)
+
+	cluster := createMockPluginCluster("pg", "app")
+	cluster.SetAnnotations(map[string]string{
+		AnnotationCurrentBackupID:                          "20241024T120000",
+		"kubectl.kubernetes.io/last-applied-configuration": "{}",
+	})
+	cluster.Object["status"] = map[string]interface{}{"phase": clusterPhaseHealthy}
+	backup := createMockBackup("pg-backup", "app", "pg", "completed", "20241024T120000", now)
+	objectStore := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "barmancloud.cnpg.io/v1",
+		"kind":       "ObjectStore",
+		"metadata":   map[string]interface{}{"name": "store", "namespace": "app"},
+		"spec":       map[string]interface{}{"retentionPolicy": "30d"},
+	}}
+	client := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: OverrideConfigMapName, Namespace: "app"},
+		Data:       map[string]string{"pg.write_to_server_name": "pg-1"},
+	})
+
+	diagnostics := CollectDiagnostics(context.Background(), client, newFakeDynamicClient(cluster, backup, objectStore), "app", now)
+
+	assert.Equal(t, now, diagnostics.CollectedAt)
+	require.Len(t, diagnostics.Clusters, 1)
+	assert.Equal(t, "pg", diagnostics.Clusters[0].Name)
+	assert.Equal(t, clusterPhaseHealthy, diagnostics.Clusters[0].Phase)
+	assert.Equal(t, BackupMethodPlugin, diagnostics.Clusters[0].BackupMethod)
+	assert.Equal(t, "pg", diagnostics.Clusters[0].ServerName)
+	assert.Equal(t, map[string]string{AnnotationCurrentBackupID: "20241024T120000"}, diagnostics.Clusters[0].Annotations)
+	assert.Len(t, diagnostics.Clusters[0].Plugins, 1)
+
+	require.Len(t, diagnostics.Backups, 1)
+	assert.Equal(t, BackupDiagnostics{Name: "pg-backup", Cluster: "pg", Phase: "completed", BackupID: "20241024T120000"}, diagnostics.Backups[0])
+
+	require.Len(t, diagnostics.ObjectStores, 1)
+	assert.Equal(t, "30d", diagnostics.ObjectStores[0].Spec["retentionPolicy"])
+	assert.Equal(t, map[string]string{"pg.write_to_server_name": "pg-1"}, diagnostics.OverrideConfigMap)
+	assert.Empty(t, diagnostics.Errors)
+}
+
+func TestCollectDiagnosticsPartial(t *testing.T) {
+	dynamicClient := newFakeDynamicClient(createMockPluginCluster("pg", "app"))
+	dynamicClient.PrependReactor("list", "objectstores", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(barmanObjectStoreGVR.GroupResource(), "", nil)
+	})
+
+	diagnostics := CollectDiagnostics(context.Background(), fake.NewSimpleClientset(), dynamicClient, "app", time.Now())
+
+	assert.Len(t, diagnostics.Clusters, 1)
+	assert.Empty(t, diagnostics.ObjectStores)
+	assert.Nil(t, diagnostics.OverrideConfigMap)
+	require.Len(t, diagnostics.Errors, 1)
+	assert.Contains(t, diagnostics.Errors[0], "failed to list objectstores")
+}
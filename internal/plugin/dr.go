@@ -0,0 +1,152 @@
+package plugin
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// barmanObjectStoreGVR identifies the ObjectStore resources of the barman-cloud plugin
+var barmanObjectStoreGVR = schema.GroupVersionResource{
+	Group:    "barmancloud.cnpg.io",
+	Version:  "v1",
+	Resource: "objectstores",
+}
+
+// objectStoreCredentials are the credential settings of a barmanObjectStore, one per provider
+var objectStoreCredentials = []string{"s3Credentials", "azureCredentials", "googleCredentials"}
+
+// applyObjectStoreOverride replaces the settings of the in-tree barmanObjectStore with the
+// destination's equivalents. It returns false when the cluster has no barmanObjectStore.
+func applyObjectStoreOverride(itemContent map[string]interface{}, override *ObjectStoreOverride) (bool, error) {
+	specMap, err := getSpecMap(itemContent)
+	if err != nil {
+		return false, err
+	}
+	objectStore, found, err := nestedMapNoCopy(specMap, "backup", "barmanObjectStore")
+	if err != nil || !found {
+		return false, err
+	}
+
+	if override.DestinationPath != "" {
+		objectStore["destinationPath"] = override.DestinationPath
+	}
+	if override.EndpointURL != "" {
+		objectStore["endpointURL"] = override.EndpointURL
+	}
+	if override.EndpointCA != nil {
+		objectStore["endpointCA"] = map[string]interface{}{"name": override.EndpointCA.Name, "key": override.EndpointCA.Key}
+	}
+
+	credentials := map[string]map[string]interface{}{
+		"s3Credentials":     override.S3Credentials,
+		"azureCredentials":  override.AzureCredentials,
+		"googleCredentials": override.GoogleCredentials,
+	}
+	replaced := false
+	for _, key := range objectStoreCredentials {
+		replaced = replaced || credentials[key] != nil
+	}
+	if replaced {
+		for _, key := range objectStoreCredentials {
+			delete(objectStore, key)
+			if credentials[key] != nil {
+				objectStore[key] = runtime.DeepCopyJSON(credentials[key])
+			}
+		}
+	}
+
+	return true, nil
+}
+
+// archivedServerName lists where the destination cluster has archived under serverName:
+// CNPG Backups taken there, other than those restored by Velero, and the recovery window
+// of the ObjectStore the restored cluster reads from. WAL the destination archived under
+// the serverName would be mixed with the backed-up cluster's when it is recovered from.
+func (p *RestorePluginV2) archivedServerName(itemContent map[string]interface{}, serverName, barmanObjectName string) ([]string, error) {
+	dynamicClient, err := p.getDynamicClient()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create dynamic client")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	backups, err := dynamicClient.Resource(cnpgBackupGVR).Namespace(metav1.NamespaceAll).List(ctx, metav1.ListOptions{LabelSelector: "!" + v1.RestoreNameLabel})
+	if err != nil {
+		return nil, errors.Wrap(classifyAPIError(err), "failed to list backups")
+	}
+
+	destinationPath, _, _ := unstructured.NestedString(itemContent, "spec", "backup", "barmanObjectStore", "destinationPath")
+	var found []string
+	for _, backup := range backups.Items {
+		if name, _, _ := unstructured.NestedString(backup.Object, "status", "serverName"); name != serverName {
+			continue
+		}
+		// Backups to another object store do not share the archive
+		if path, _, _ := unstructured.NestedString(backup.Object, "status", "destinationPath"); path != "" && destinationPath != "" && !strings.HasPrefix(path, destinationPath) {
+			continue
+		}
+		found = append(found, "Backup "+backup.GetNamespace()+"/"+backup.GetName())
+	}
+	sort.Strings(found)
+
+	if barmanObjectName != "" {
+		namespace := (&unstructured.Unstructured{Object: itemContent}).GetNamespace()
+		objectStore, err := dynamicClient.Resource(barmanObjectStoreGVR).Namespace(namespace).Get(ctx, barmanObjectName, metav1.GetOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return nil, errors.Wrapf(classifyAPIError(err), "failed to get ObjectStore %s/%s", namespace, barmanObjectName)
+		}
+		if err == nil {
+			if _, archived, _ := unstructured.NestedMap(objectStore.Object, "status", "serverRecoveryWindow", serverName); archived {
+				found = append(found, "ObjectStore "+namespace+"/"+barmanObjectName)
+			}
+		}
+	}
+
+	return found, nil
+}
+
+// prepareDisasterRecovery points the restored cluster at the destination's object store
+// and checks that the destination never archived under the serverName the cluster is
+// recovered from. The check is skipped with a warning when it cannot be made.
+func (p *RestorePluginV2) prepareDisasterRecovery(itemContent map[string]interface{}, config *DisasterRecoveryConfig, serverName, barmanObjectName string, warnings *restoreWarnings) error {
+	if config.ObjectStore != nil {
+		applied, err := applyObjectStoreOverride(itemContent, config.ObjectStore)
+		if err != nil {
+			return errors.Wrap(err, "failed to override barmanObjectStore")
+		}
+		if applied {
+			p.log.Info("Pointed barmanObjectStore at the destination object store")
+		}
+	}
+
+	if serverName == "" {
+		return nil
+	}
+	archived, err := p.archivedServerName(itemContent, serverName, barmanObjectName)
+	if err != nil {
+		warnings.Warnf("Skipping archived serverName check: %v", err)
+		return nil
+	}
+	if len(archived) == 0 {
+		return nil
+	}
+
+	err = errors.Errorf("the destination cluster has archived under serverName %s before (%s), so its WAL would be mixed with the backed-up cluster's; "+
+		"clean up the archive or set disasterRecovery.allowArchivedServerName", serverName, strings.Join(archived, ", "))
+	if !config.AllowArchivedServerName {
+		return err
+	}
+	warnings.Warnf("Recovering from an archive the destination wrote to: %v", err)
+	return nil
+}
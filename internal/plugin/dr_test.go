@@ -0,0 +1,126 @@
+package plugin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestApplyObjectStoreOverride(t *testing.T) {
+	cluster := createMockArchivingCluster("pg", "default", "pg", nil)
+	require.NoError(t, unstructured.SetNestedMap(cluster.Object, map[string]interface{}{
+		"accessKeyId": map[string]interface{}{"name": "prod-aws", "key": "ACCESS_KEY_ID"},
+	}, "spec", "backup", "barmanObjectStore", "s3Credentials"))
+
+	applied, err := applyObjectStoreOverride(cluster.Object, &ObjectStoreOverride{
+		DestinationPath: "s3://dr-backups/",
+		EndpointURL:     "https://minio.dr.example.com",
+		EndpointCA:      &SecretKeySelector{Name: "dr-ca", Key: "ca.crt"},
+		AzureCredentials: map[string]interface{}{
+			"connectionString": map[string]interface{}{"name": "dr-azure", "key": "AZURE_CONNECTION_STRING"},
+		},
+	})
+	require.NoError(t, err)
+	assert.True(t, applied)
+
+	objectStore, _, _ := unstructured.NestedMap(cluster.Object, "spec", "backup", "barmanObjectStore")
+	assert.Equal(t, map[string]interface{}{
+		"destinationPath": "s3://dr-backups/",
+		"endpointURL":     "https://minio.dr.example.com",
+		"endpointCA":      map[string]interface{}{"name": "dr-ca", "key": "ca.crt"},
+		"serverName":      "pg",
+		"azureCredentials": map[string]interface{}{
+			"connectionString": map[string]interface{}{"name": "dr-azure", "key": "AZURE_CONNECTION_STRING"},
+		},
+	}, objectStore)
+
+	// Clusters archiving only through the barman-cloud plugin are left alone
+	unstructured.RemoveNestedField(cluster.Object, "spec", "backup")
+	applied, err = applyObjectStoreOverride(cluster.Object, &ObjectStoreOverride{DestinationPath: "s3://dr-backups/"})
+	require.NoError(t, err)
+	assert.False(t, applied)
+}
+
+func TestPrepareDisasterRecovery(t *testing.T) {
+	withStatus := func(backup *unstructured.Unstructured, serverName, destinationPath string) *unstructured.Unstructured {
+		status := backup.Object["status"].(map[string]interface{})
+		status["serverName"] = serverName
+		status["destinationPath"] = destinationPath
+		return backup
+	}
+	restored := withStatus(createMockBackup("restored", "default", "pg", "completed", "1", time.Now()), "pg", "s3://backups/")
+	restored.SetLabels(map[string]string{v1.RestoreNameLabel: "dr"})
+	objectStore := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "barmancloud.cnpg.io/v1",
+		"kind":       "ObjectStore",
+		"metadata":   map[string]interface{}{"name": "dr-store", "namespace": "default"},
+		"status": map[string]interface{}{
+			"serverRecoveryWindow": map[string]interface{}{"pg": map[string]interface{}{}},
+		},
+	}}
+
+	tests := []struct {
+		name             string
+		objects          []runtime.Object
+		barmanObjectName string
+		allow            bool
+		expectedError    string
+		expectedWarnings []string
+	}{
+		{
+			name: "never archived",
+			objects: []runtime.Object{
+				restored,
+				withStatus(createMockBackup("elsewhere", "other", "pg", "completed", "2", time.Now()), "pg", "s3://other-backups/pg"),
+				withStatus(createMockBackup("renamed", "default", "pg", "completed", "3", time.Now()), "pg-20240101-000000-abcde", "s3://backups/"),
+			},
+		},
+		{
+			name:          "backup taken in the destination",
+			objects:       []runtime.Object{withStatus(createMockBackup("failback", "other", "pg", "completed", "4", time.Now()), "pg", "s3://backups/")},
+			expectedError: "the destination cluster has archived under serverName pg before (Backup other/failback)",
+		},
+		{
+			name:             "recovery window of the ObjectStore",
+			objects:          []runtime.Object{objectStore},
+			barmanObjectName: "dr-store",
+			expectedError:    "the destination cluster has archived under serverName pg before (ObjectStore default/dr-store)",
+		},
+		{
+			name:             "allowed",
+			objects:          []runtime.Object{objectStore},
+			barmanObjectName: "dr-store",
+			allow:            true,
+			expectedWarnings: []string{"Recovering from an archive the destination wrote to: the destination cluster has archived under serverName pg before (ObjectStore default/dr-store), " +
+				"so its WAL would be mixed with the backed-up cluster's; clean up the archive or set disasterRecovery.allowArchivedServerName"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plugin := &RestorePluginV2{log: logrus.New(), dynamicClient: newFakeDynamicClient(tt.objects...)}
+			warnings := &restoreWarnings{log: logrus.New()}
+			cluster := createMockArchivingCluster("pg", "default", "pg", nil)
+
+			err := plugin.prepareDisasterRecovery(cluster.Object, &DisasterRecoveryConfig{AllowArchivedServerName: tt.allow}, "pg", tt.barmanObjectName, warnings)
+			if tt.expectedError != "" {
+				assert.ErrorContains(t, err, tt.expectedError)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.expectedWarnings, warnings.messages)
+		})
+	}
+}
+
+func TestOperatorSelector(t *testing.T) {
+	assert.Equal(t, defaultOperatorSelector, (&PluginConfig{}).operatorSelector())
+	assert.Equal(t, defaultOperatorSelector, (&PluginConfig{DisasterRecovery: &DisasterRecoveryConfig{}}).operatorSelector())
+	assert.Equal(t, "app=cnpg-dr", (&PluginConfig{DisasterRecovery: &DisasterRecoveryConfig{OperatorSelector: "app=cnpg-dr"}}).operatorSelector())
+}
@@ -0,0 +1,102 @@
+package plugin
+
+import (
+	"context"
+	"net"
+
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// Error kinds reported alongside failed actions, so RBAC gaps, malformed specs and API
+// flakiness can be told apart in the Velero logs
+const (
+	ErrorKindPermission = "permission"
+	ErrorKindNotFound   = "not_found"
+	ErrorKindTimeout    = "timeout"
+	ErrorKindSpecShape  = "spec_shape"
+)
+
+// PermissionError is returned when the plugin's credentials are not allowed to perform
+// an API request
+type PermissionError struct {
+	Err error
+}
+
+func (e *PermissionError) Error() string { return e.Err.Error() }
+func (e *PermissionError) Unwrap() error { return e.Err }
+
+// NotFoundError is returned when a resource the plugin needs does not exist
+type NotFoundError struct {
+	Err error
+}
+
+func (e *NotFoundError) Error() string { return e.Err.Error() }
+func (e *NotFoundError) Unwrap() error { return e.Err }
+
+// TimeoutError is returned when an API request timed out or was throttled, and retrying
+// later may succeed
+type TimeoutError struct {
+	Err error
+}
+
+func (e *TimeoutError) Error() string { return e.Err.Error() }
+func (e *TimeoutError) Unwrap() error { return e.Err }
+
+// SpecShapeError is returned when an item does not have the structure the plugin expects,
+// such as a spec that is not a map
+type SpecShapeError struct {
+	Err error
+}
+
+func (e *SpecShapeError) Error() string { return e.Err.Error() }
+func (e *SpecShapeError) Unwrap() error { return e.Err }
+
+// specShapeError returns a SpecShapeError with the formatted message
+func specShapeError(format string, args ...interface{}) error {
+	return &SpecShapeError{Err: errors.Errorf(format, args...)}
+}
+
+// classifyAPIError wraps an error returned by the Kubernetes API in the matching error
+// type. Errors that match none are returned unchanged.
+func classifyAPIError(err error) error {
+	if err == nil || ErrorKind(err) != "" {
+		return err
+	}
+
+	var netErr net.Error
+	switch {
+	case apierrors.IsForbidden(err), apierrors.IsUnauthorized(err):
+		return &PermissionError{Err: err}
+	case apierrors.IsNotFound(err):
+		return &NotFoundError{Err: err}
+	case apierrors.IsTimeout(err), apierrors.IsServerTimeout(err), apierrors.IsTooManyRequests(err),
+		errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return &TimeoutError{Err: err}
+	}
+	return err
+}
+
+// ErrorKind returns the kind of the typed error in err's chain, or an empty string when
+// it has none
+func ErrorKind(err error) string {
+	var (
+		permission *PermissionError
+		notFound   *NotFoundError
+		timeout    *TimeoutError
+		specShape  *SpecShapeError
+	)
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &permission):
+		return ErrorKindPermission
+	case errors.As(err, &notFound):
+		return ErrorKindNotFound
+	case errors.As(err, &timeout):
+		return ErrorKindTimeout
+	case errors.As(err, &specShape):
+		return ErrorKindSpecShape
+	}
+	return ""
+}
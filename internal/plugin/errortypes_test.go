@@ -0,0 +1,59 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestClassifyAPIError(t *testing.T) {
+	clusters := schema.GroupResource{Group: "postgresql.cnpg.io", Resource: "clusters"}
+
+	tests := []struct {
+		name         string
+		err          error
+		expectedKind string
+	}{
+		{name: "nil"},
+		{name: "forbidden", err: apierrors.NewForbidden(clusters, "pg", errors.New("denied")), expectedKind: ErrorKindPermission},
+		{name: "unauthorized", err: apierrors.NewUnauthorized("expired token"), expectedKind: ErrorKindPermission},
+		{name: "not found", err: apierrors.NewNotFound(clusters, "pg"), expectedKind: ErrorKindNotFound},
+		{name: "server timeout", err: apierrors.NewServerTimeout(clusters, "list", 1), expectedKind: ErrorKindTimeout},
+		{name: "throttled", err: apierrors.NewTooManyRequests("slow down", 1), expectedKind: ErrorKindTimeout},
+		{name: "deadline", err: errors.Wrap(context.DeadlineExceeded, "list"), expectedKind: ErrorKindTimeout},
+		{name: "other", err: apierrors.NewBadRequest("bad")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			classified := classifyAPIError(tt.err)
+			assert.Equal(t, tt.expectedKind, ErrorKind(classified))
+			if tt.err != nil {
+				// The message is unchanged and the original error stays reachable
+				assert.Equal(t, tt.err.Error(), classified.Error())
+				assert.ErrorIs(t, classified, tt.err)
+			}
+
+			// Wrapping keeps the kind
+			wrapped := errors.Wrap(classified, "failed to list clusters")
+			if tt.err != nil {
+				assert.Equal(t, tt.expectedKind, ErrorKind(wrapped))
+			}
+		})
+	}
+}
+
+func TestSpecShapeError(t *testing.T) {
+	plugin := &RestorePluginV2{}
+	err := plugin.configureExternalCluster(map[string]interface{}{"spec": "invalid"}, "pg", "store")
+	require.Error(t, err)
+	assert.Equal(t, ErrorKindSpecShape, ErrorKind(err))
+
+	var specShape *SpecShapeError
+	assert.True(t, errors.As(err, &specShape))
+}
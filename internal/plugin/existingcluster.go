@@ -0,0 +1,105 @@
+package plugin
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// liveCluster returns the cluster that already exists in the destination when the restore
+// updates existing resources, or nil when Velero will create the cluster
+func (p *RestorePluginV2) liveCluster(restore *v1.Restore, namespace, name string) (*unstructured.Unstructured, error) {
+	if restore == nil || restore.Spec.ExistingResourcePolicy != v1.PolicyTypeUpdate {
+		return nil, nil
+	}
+
+	dynamicClient, err := p.getDynamicClient()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create dynamic client")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	live, err := dynamicClient.Resource(cnpgClusterGVR).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(classifyAPIError(err), "failed to get existing cluster %s/%s", namespace, name)
+	}
+
+	return live, nil
+}
+
+// mergeLiveCluster keeps the fields of a live cluster that must not change when Velero
+// updates it in place: bootstrap and externalClusters, which only take effect when a cluster
+// is created, and the serverNames the cluster archives WAL to
+func (p *RestorePluginV2) mergeLiveCluster(itemContent map[string]interface{}, live *unstructured.Unstructured) error {
+	specMap, err := getSpecMap(itemContent)
+	if err != nil {
+		return err
+	}
+	liveSpec, err := getSpecMap(live.Object)
+	if err != nil {
+		return errors.Wrap(err, "existing cluster")
+	}
+
+	for _, field := range []string{"bootstrap", "externalClusters"} {
+		if value, found := liveSpec[field]; found {
+			specMap[field] = value
+		} else {
+			delete(specMap, field)
+		}
+	}
+
+	objectStore, found, err := nestedMapNoCopy(specMap, "backup", "barmanObjectStore")
+	if err != nil {
+		return errors.Wrap(err, "failed to get backup.barmanObjectStore")
+	}
+	if found {
+		liveObjectStore, _, _ := nestedMapNoCopy(liveSpec, "backup", "barmanObjectStore")
+		copyField(objectStore, liveObjectStore, "serverName")
+	}
+
+	livePlugins := map[string]map[string]interface{}{}
+	for _, plugin := range sliceOfMaps(liveSpec["plugins"]) {
+		name, _ := plugin["name"].(string)
+		params, _ := plugin["parameters"].(map[string]interface{})
+		livePlugins[name] = params
+	}
+	for _, plugin := range sliceOfMaps(specMap["plugins"]) {
+		name, _ := plugin["name"].(string)
+		if params, ok := plugin["parameters"].(map[string]interface{}); ok {
+			copyField(params, livePlugins[name], "serverName")
+		}
+	}
+
+	return nil
+}
+
+// copyField sets key in dst to its value in src, removing it when src does not have it
+func copyField(dst, src map[string]interface{}, key string) {
+	if value, found := src[key]; found {
+		dst[key] = value
+	} else {
+		delete(dst, key)
+	}
+}
+
+// sliceOfMaps returns the map elements of a list, skipping malformed elements
+func sliceOfMaps(value interface{}) []map[string]interface{} {
+	list, _ := value.([]interface{})
+	maps := make([]map[string]interface{}, 0, len(list))
+	for _, element := range list {
+		if m, ok := element.(map[string]interface{}); ok {
+			maps = append(maps, m)
+		}
+	}
+	return maps
+}
@@ -0,0 +1,146 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// createMockArchivingCluster creates a cluster archiving WAL to serverName through both
+// the barman-cloud plugin and the in-tree object store
+func createMockArchivingCluster(name, namespace, serverName string, bootstrap map[string]interface{}) *unstructured.Unstructured {
+	spec := map[string]interface{}{
+		"instances": int64(3),
+		"backup": map[string]interface{}{
+			"barmanObjectStore": map[string]interface{}{
+				"destinationPath": "s3://backups/",
+				"serverName":      serverName,
+			},
+		},
+		"plugins": []interface{}{
+			map[string]interface{}{
+				"name": "barman-cloud.cloudnative-pg.io",
+				"parameters": map[string]interface{}{
+					"barmanObjectName": "store",
+					"serverName":       serverName,
+				},
+			},
+		},
+	}
+	if bootstrap != nil {
+		spec["bootstrap"] = bootstrap
+	}
+
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "postgresql.cnpg.io/v1",
+			"kind":       "Cluster",
+			"metadata": map[string]interface{}{
+				"name":      name,
+				"namespace": namespace,
+			},
+			"spec": spec,
+		},
+	}
+}
+
+func TestLiveCluster(t *testing.T) {
+	live := createMockArchivingCluster("pg", "default", "pg-live", nil)
+	update := &v1.Restore{Spec: v1.RestoreSpec{ExistingResourcePolicy: v1.PolicyTypeUpdate}}
+
+	tests := []struct {
+		name        string
+		restore     *v1.Restore
+		clusterName string
+		expectLive  bool
+	}{
+		{name: "no restore", clusterName: "pg"},
+		{name: "default policy", restore: &v1.Restore{}, clusterName: "pg"},
+		{name: "update policy with existing cluster", restore: update, clusterName: "pg", expectLive: true},
+		{name: "update policy with new cluster", restore: update, clusterName: "other"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plugin := &RestorePluginV2{log: logrus.New(), dynamicClient: newFakeDynamicClient(live)}
+
+			result, err := plugin.liveCluster(tt.restore, "default", tt.clusterName)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectLive, result != nil)
+		})
+	}
+}
+
+func TestMergeLiveCluster(t *testing.T) {
+	liveBootstrap := map[string]interface{}{"initdb": map[string]interface{}{"database": "app"}}
+	live := createMockArchivingCluster("pg", "default", "pg-live", liveBootstrap)
+	item := createMockArchivingCluster("pg", "default", "pg-backup", map[string]interface{}{
+		"recovery": map[string]interface{}{"source": recoverySourceName},
+	})
+	item.Object["spec"].(map[string]interface{})["externalClusters"] = []interface{}{
+		map[string]interface{}{"name": recoverySourceName},
+	}
+	item.Object["spec"].(map[string]interface{})["instances"] = int64(5)
+
+	plugin := &RestorePluginV2{log: logrus.New()}
+	require.NoError(t, plugin.mergeLiveCluster(item.Object, live))
+
+	bootstrap, _, _ := unstructured.NestedMap(item.Object, "spec", "bootstrap")
+	assert.Equal(t, liveBootstrap, bootstrap)
+
+	_, found, _ := unstructured.NestedFieldNoCopy(item.Object, "spec", "externalClusters")
+	assert.False(t, found)
+
+	serverName, _, _ := unstructured.NestedString(item.Object, "spec", "backup", "barmanObjectStore", "serverName")
+	assert.Equal(t, "pg-live", serverName)
+
+	plugins, _, _ := unstructured.NestedSlice(item.Object, "spec", "plugins")
+	assert.Equal(t, "pg-live", plugins[0].(map[string]interface{})["parameters"].(map[string]interface{})["serverName"])
+
+	// Fields that can be updated are taken from the backup
+	instances, _, _ := unstructured.NestedInt64(item.Object, "spec", "instances")
+	assert.Equal(t, int64(5), instances)
+}
+
+func TestRestoreExecuteUpdatesExistingCluster(t *testing.T) {
+	live := createMockArchivingCluster("pg", "default", "pg-live", map[string]interface{}{
+		"initdb": map[string]interface{}{"database": "app"},
+	})
+	item := createMockArchivingCluster("pg", "default", "pg-backup", nil)
+	item.SetAnnotations(map[string]string{
+		AnnotationServerName:      "pg-backup",
+		AnnotationBackupMethod:    BackupMethodPlugin,
+		AnnotationCurrentBackupID: "20240101T000000",
+	})
+	restore := &v1.Restore{
+		ObjectMeta: metav1.ObjectMeta{Name: "restore-1", Namespace: "velero"},
+		Spec:       v1.RestoreSpec{ExistingResourcePolicy: v1.PolicyTypeUpdate},
+	}
+
+	config := DefaultPluginConfig()
+	config.SkipPluginCheck = true
+	plugin := &RestorePluginV2{
+		log:           logrus.New(),
+		config:        config,
+		dynamicClient: newFakeDynamicClient(live),
+		kubeClient:    newFakeKubeClient(),
+	}
+
+	// The override ConfigMap is not written, so no client for it is needed
+	out, err := plugin.Execute(&velero.RestoreItemActionExecuteInput{Item: item, Restore: restore})
+	require.NoError(t, err)
+
+	content := out.UpdatedItem.UnstructuredContent()
+	serverName, _, _ := unstructured.NestedString(content, "spec", "backup", "barmanObjectStore", "serverName")
+	assert.Equal(t, "pg-live", serverName)
+	_, found, _ := unstructured.NestedFieldNoCopy(content, "spec", "bootstrap", "recovery")
+	assert.False(t, found)
+	_, found, _ = unstructured.NestedFieldNoCopy(content, "spec", "bootstrap", "initdb")
+	assert.True(t, found)
+}
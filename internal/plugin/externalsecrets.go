@@ -0,0 +1,131 @@
+package plugin
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// externalClusterSecretFields are the fields of an externalClusters entry referencing a
+// key of a secret in the cluster's namespace
+var externalClusterSecretFields = [][]string{
+	{"password"},
+	{"sslCert"},
+	{"sslKey"},
+	{"sslRootCert"},
+	{"barmanObjectStore", "endpointCA"},
+	{"barmanObjectStore", "s3Credentials", "accessKeyId"},
+	{"barmanObjectStore", "s3Credentials", "secretAccessKey"},
+	{"barmanObjectStore", "s3Credentials", "region"},
+	{"barmanObjectStore", "s3Credentials", "sessionToken"},
+	{"barmanObjectStore", "azureCredentials", "connectionString"},
+	{"barmanObjectStore", "azureCredentials", "storageAccount"},
+	{"barmanObjectStore", "azureCredentials", "storageKey"},
+	{"barmanObjectStore", "azureCredentials", "storageSasToken"},
+	{"barmanObjectStore", "googleCredentials", "applicationCredentials"},
+}
+
+// restoredNamespace returns the namespace a restore restores a namespace into
+func restoredNamespace(restore *v1.Restore, namespace string) string {
+	if restore != nil {
+		if mapped, found := restore.Spec.NamespaceMapping[namespace]; found {
+			return mapped
+		}
+	}
+	return namespace
+}
+
+// rewriteExternalClusterSecrets renames the secrets referenced by the externalClusters of
+// the restored cluster, both generated and backed up, as secretNames maps them. When it
+// renames secrets or the restore maps the cluster's namespace, it also warns about the
+// references to secrets missing from the namespace the cluster is restored into. Velero
+// restores secrets before clusters, so those secrets were not in the backup. The check is
+// skipped with a log message when it cannot be made.
+func (p *RestorePluginV2) rewriteExternalClusterSecrets(itemContent map[string]interface{}, restore *v1.Restore, secretNames map[string]string, warnings *restoreWarnings) error {
+	namespace := (&unstructured.Unstructured{Object: itemContent}).GetNamespace()
+	destination := restoredNamespace(restore, namespace)
+	if len(secretNames) == 0 && destination == namespace {
+		return nil
+	}
+
+	externalClusters, found, err := unstructured.NestedFieldNoCopy(itemContent, "spec", "externalClusters")
+	if err != nil {
+		return specShapeError("failed to get externalClusters: %v", err)
+	}
+	if !found {
+		return nil
+	}
+	entries, ok := externalClusters.([]interface{})
+	if !ok {
+		return specShapeError("externalClusters is not a list")
+	}
+
+	// Entry names referencing each secret, as restored
+	referencedBy := map[string][]string{}
+	for _, entry := range entries {
+		entryMap, ok := entry.(map[string]interface{})
+		if !ok {
+			return specShapeError("externalClusters entry is not a map")
+		}
+		entryName, _ := entryMap["name"].(string)
+
+		for _, fields := range externalClusterSecretFields {
+			selector, found, err := nestedMapNoCopy(entryMap, fields...)
+			if err != nil {
+				return err
+			}
+			if !found {
+				continue
+			}
+			name, _ := selector["name"].(string)
+			if name == "" {
+				continue
+			}
+			if renamed, mapped := secretNames[name]; mapped {
+				selector["name"] = renamed
+				p.log.Infof("Renamed secret %s to %s in %s of externalClusters entry %s", name, renamed, strings.Join(fields, "."), entryName)
+				name = renamed
+			}
+			if names := referencedBy[name]; len(names) == 0 || names[len(names)-1] != entryName {
+				referencedBy[name] = append(names, entryName)
+			}
+		}
+	}
+	if len(referencedBy) == 0 {
+		return nil
+	}
+
+	client, err := p.getKubeClient()
+	if err != nil {
+		p.log.Warnf("Not checking the secrets of externalClusters: failed to get Kubernetes client: %v", err)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	secrets := make([]string, 0, len(referencedBy))
+	for name := range referencedBy {
+		secrets = append(secrets, name)
+	}
+	sort.Strings(secrets)
+	for _, name := range secrets {
+		_, err := client.CoreV1().Secrets(destination).Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			warnings.Warnf("externalClusters entry %s references secret %s, which does not exist in namespace %s; map it to an existing secret with disasterRecovery.secretNames",
+				strings.Join(referencedBy[name], ", "), name, destination)
+			continue
+		}
+		if err != nil {
+			p.log.Warnf("Not checking secret %s/%s of externalClusters: %v", destination, name, classifyAPIError(err))
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// createMockExternalClustersCluster returns a cluster with a connection-based and an
+// object store externalClusters entry referencing secrets
+func createMockExternalClustersCluster() *unstructured.Unstructured {
+	cluster := createMockPluginCluster("pg", "prod")
+	_ = unstructured.SetNestedSlice(cluster.Object, []interface{}{
+		map[string]interface{}{
+			"name":                 "source",
+			"connectionParameters": map[string]interface{}{"host": "pg-rw.prod"},
+			"password":             map[string]interface{}{"name": "pg-replication", "key": "password"},
+			"sslCert":              map[string]interface{}{"name": "pg-replication", "key": "tls.crt"},
+		},
+		map[string]interface{}{
+			"name": recoverySourceName,
+			"barmanObjectStore": map[string]interface{}{
+				"destinationPath": "s3://backups/",
+				"s3Credentials": map[string]interface{}{
+					"accessKeyId":     map[string]interface{}{"name": "aws", "key": "ACCESS_KEY_ID"},
+					"secretAccessKey": map[string]interface{}{"name": "aws", "key": "ACCESS_SECRET_KEY"},
+				},
+			},
+		},
+	}, "spec", "externalClusters")
+	return cluster
+}
+
+func secretNameAt(t *testing.T, cluster *unstructured.Unstructured, entry int, fields ...string) string {
+	entries, _, _ := unstructured.NestedSlice(cluster.Object, "spec", "externalClusters")
+	require.Greater(t, len(entries), entry)
+	name, _, _ := unstructured.NestedString(entries[entry].(map[string]interface{}), append(fields, "name")...)
+	return name
+}
+
+func TestRewriteExternalClusterSecrets(t *testing.T) {
+	secret := func(namespace, name string) *corev1.Secret {
+		return &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}}
+	}
+	mapped := &v1.Restore{Spec: v1.RestoreSpec{NamespaceMapping: map[string]string{"prod": "dr"}}}
+
+	t.Run("renamed secrets", func(t *testing.T) {
+		cluster := createMockExternalClustersCluster()
+		plugin := &RestorePluginV2{log: logrus.New(), kubeClient: fake.NewClientset(secret("prod", "dr-replication"), secret("prod", "dr-aws"))}
+		warnings := &restoreWarnings{log: logrus.New()}
+
+		require.NoError(t, plugin.rewriteExternalClusterSecrets(cluster.Object, nil, map[string]string{"pg-replication": "dr-replication", "aws": "dr-aws"}, warnings))
+		assert.Equal(t, "dr-replication", secretNameAt(t, cluster, 0, "password"))
+		assert.Equal(t, "dr-replication", secretNameAt(t, cluster, 0, "sslCert"))
+		assert.Equal(t, "dr-aws", secretNameAt(t, cluster, 1, "barmanObjectStore", "s3Credentials", "accessKeyId"))
+		assert.Equal(t, "dr-aws", secretNameAt(t, cluster, 1, "barmanObjectStore", "s3Credentials", "secretAccessKey"))
+		assert.Empty(t, warnings.messages)
+	})
+
+	t.Run("secrets missing from the mapped namespace", func(t *testing.T) {
+		cluster := createMockExternalClustersCluster()
+		plugin := &RestorePluginV2{log: logrus.New(), kubeClient: fake.NewClientset(secret("dr", "aws"), secret("prod", "pg-replication"))}
+		warnings := &restoreWarnings{log: logrus.New()}
+
+		require.NoError(t, plugin.rewriteExternalClusterSecrets(cluster.Object, mapped, nil, warnings))
+		assert.Equal(t, "pg-replication", secretNameAt(t, cluster, 0, "password"))
+		require.Len(t, warnings.messages, 1)
+		assert.Contains(t, warnings.messages[0], "externalClusters entry source references secret pg-replication, which does not exist in namespace dr")
+	})
+
+	t.Run("no mapping", func(t *testing.T) {
+		cluster := createMockExternalClustersCluster()
+		plugin := &RestorePluginV2{log: logrus.New(), kubeClient: fake.NewClientset()}
+		warnings := &restoreWarnings{log: logrus.New()}
+
+		require.NoError(t, plugin.rewriteExternalClusterSecrets(cluster.Object, &v1.Restore{}, nil, warnings))
+		assert.Equal(t, "pg-replication", secretNameAt(t, cluster, 0, "password"))
+		assert.Empty(t, warnings.messages)
+	})
+
+	t.Run("no externalClusters", func(t *testing.T) {
+		cluster := createMockPluginCluster("pg", "prod")
+		plugin := &RestorePluginV2{log: logrus.New(), kubeClient: fake.NewClientset()}
+		warnings := &restoreWarnings{log: logrus.New()}
+
+		require.NoError(t, plugin.rewriteExternalClusterSecrets(cluster.Object, mapped, map[string]string{"aws": "dr-aws"}, warnings))
+		assert.Empty(t, warnings.messages)
+	})
+}
@@ -0,0 +1,246 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	// EnvFaultInjection is the environment variable enabling faults in the plugin's API
+	// calls for DR drills, as comma separated delay=<duration>, error=<rate> and
+	// partialApply=<rate> settings
+	EnvFaultInjection = "VELERO_CNPG_FAULT_INJECTION"
+
+	// EnvFaultResources is the environment variable restricting the injected faults to a
+	// comma separated list of resources, such as clusters or configmaps
+	EnvFaultResources = "VELERO_CNPG_FAULT_RESOURCES"
+)
+
+// injectedFaults are the faults injected into the clients of the plugin process, or nil
+// when fault injection is disabled
+var injectedFaults *faultInjection
+
+// faultInjection describes the faults injected into the plugin's API calls
+type faultInjection struct {
+	// delay is added to every call before it is sent
+	delay time.Duration
+
+	// errorRate is the share of calls failing without reaching the API server
+	errorRate float64
+
+	// partialApplyRate is the share of writes sent to the API server and reported as
+	// failed, leaving the plugin unsure whether they were applied
+	partialApplyRate float64
+
+	// resources restricts the faults to these resources, all resources when empty
+	resources map[string]bool
+}
+
+// LoadFaultInjection reads the faults to inject into the plugin's API calls from the
+// plugin environment. It returns a description of the faults, or an empty string when
+// fault injection is disabled.
+func LoadFaultInjection() (string, error) {
+	faults, err := parseFaultInjection(os.Getenv(EnvFaultInjection), os.Getenv(EnvFaultResources))
+	if err != nil {
+		return "", err
+	}
+	injectedFaults = faults
+	if faults == nil {
+		return "", nil
+	}
+	return faults.String(), nil
+}
+
+// parseFaultInjection builds the injected faults from the fault and resource settings,
+// returning nil when no fault is set
+func parseFaultInjection(value, resourcesValue string) (*faultInjection, error) {
+	if strings.TrimSpace(value) == "" {
+		if strings.TrimSpace(resourcesValue) != "" {
+			return nil, errors.Errorf("%s requires %s", EnvFaultResources, EnvFaultInjection)
+		}
+		return nil, nil
+	}
+
+	faults := &faultInjection{}
+	for _, setting := range strings.Split(value, ",") {
+		key, raw, found := strings.Cut(strings.TrimSpace(setting), "=")
+		if !found {
+			return nil, errors.Errorf("%s setting %q is not key=value", EnvFaultInjection, setting)
+		}
+		switch key {
+		case "delay":
+			delay, err := time.ParseDuration(raw)
+			if err != nil || delay < 0 {
+				return nil, errors.Errorf("%s delay must be a non-negative duration, got %q", EnvFaultInjection, raw)
+			}
+			faults.delay = delay
+		case "error", "partialApply":
+			rate, err := strconv.ParseFloat(raw, 64)
+			if err != nil || rate < 0 || rate > 1 {
+				return nil, errors.Errorf("%s %s must be a rate between 0 and 1, got %q", EnvFaultInjection, key, raw)
+			}
+			if key == "error" {
+				faults.errorRate = rate
+			} else {
+				faults.partialApplyRate = rate
+			}
+		default:
+			return nil, errors.Errorf("unknown %s setting %q", EnvFaultInjection, key)
+		}
+	}
+
+	for _, resource := range strings.Split(resourcesValue, ",") {
+		if resource = strings.TrimSpace(resource); resource != "" {
+			if faults.resources == nil {
+				faults.resources = map[string]bool{}
+			}
+			faults.resources[resource] = true
+		}
+	}
+	return faults, nil
+}
+
+// String describes the injected faults for the plugin log
+func (f *faultInjection) String() string {
+	description := "delay " + f.delay.String() +
+		", error rate " + strconv.FormatFloat(f.errorRate, 'g', -1, 64) +
+		", partial apply rate " + strconv.FormatFloat(f.partialApplyRate, 'g', -1, 64)
+	if len(f.resources) > 0 {
+		resources := make([]string, 0, len(f.resources))
+		for resource := range f.resources {
+			resources = append(resources, resource)
+		}
+		sort.Strings(resources)
+		description += " on " + strings.Join(resources, ", ")
+	}
+	return description
+}
+
+// injectFaults makes the clients built from clientConfig inject the configured faults
+func injectFaults(clientConfig *rest.Config) {
+	if injectedFaults == nil {
+		return
+	}
+	faults := injectedFaults
+	clientConfig.Wrap(func(next http.RoundTripper) http.RoundTripper {
+		return &faultRoundTripper{faults: faults, next: next, random: rand.New(rand.NewSource(time.Now().UnixNano())).Float64}
+	})
+}
+
+// faultRoundTripper injects faults into the API calls it sends on to the next round tripper
+type faultRoundTripper struct {
+	faults *faultInjection
+	next   http.RoundTripper
+
+	mu     sync.Mutex
+	random func() float64
+}
+
+// RoundTrip delays, fails or partially applies the request as configured. Injected
+// failures are API status responses, so they reach the plugin like API server errors.
+func (t *faultRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(t.faults.resources) > 0 && !t.faults.resources[requestResource(req.URL.Path)] {
+		return t.next.RoundTrip(req)
+	}
+
+	if t.faults.delay > 0 {
+		timer := time.NewTimer(t.faults.delay)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+
+	if t.roll(t.faults.errorRate) {
+		return faultResponse(req, http.StatusServiceUnavailable, metav1.StatusReasonServiceUnavailable, "injected fault: API call failed"), nil
+	}
+
+	if isWrite(req.Method) && t.roll(t.faults.partialApplyRate) {
+		resp, err := t.next.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return faultResponse(req, http.StatusGatewayTimeout, metav1.StatusReasonTimeout, "injected fault: API call was sent but its response was lost"), nil
+	}
+
+	return t.next.RoundTrip(req)
+}
+
+// roll reports whether a fault with the given rate hits the current call
+func (t *faultRoundTripper) roll(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.random() < rate
+}
+
+// isWrite reports whether a request with the given method changes the cluster
+func isWrite(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// requestResource returns the resource an API path addresses, such as configmaps for
+// /api/v1/namespaces/default/configmaps/name
+func requestResource(path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case len(segments) >= 2 && segments[0] == "api":
+		segments = segments[2:]
+	case len(segments) >= 3 && segments[0] == "apis":
+		segments = segments[3:]
+	default:
+		return ""
+	}
+	if len(segments) >= 3 && segments[0] == "namespaces" {
+		segments = segments[2:]
+	}
+	if len(segments) == 0 {
+		return ""
+	}
+	return segments[0]
+}
+
+// faultResponse returns an API status response failing req with code and reason
+func faultResponse(req *http.Request, code int, reason metav1.StatusReason, message string) *http.Response {
+	body, _ := json.Marshal(&metav1.Status{
+		TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+		Status:   metav1.StatusFailure,
+		Message:  message,
+		Reason:   reason,
+		Code:     int32(code),
+	})
+	return &http.Response{
+		Status:        strconv.Itoa(code) + " " + http.StatusText(code),
+		StatusCode:    code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,143 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+func TestParseFaultInjection(t *testing.T) {
+	tests := []struct {
+		name          string
+		value         string
+		resources     string
+		expected      *faultInjection
+		expectedError bool
+	}{
+		{name: "disabled"},
+		{
+			name:     "all faults",
+			value:    "delay=2s, error=0.1,partialApply=0.05",
+			expected: &faultInjection{delay: 2 * time.Second, errorRate: 0.1, partialApplyRate: 0.05},
+		},
+		{
+			name:      "restricted to resources",
+			value:     "error=1",
+			resources: "clusters, configmaps",
+			expected:  &faultInjection{errorRate: 1, resources: map[string]bool{"clusters": true, "configmaps": true}},
+		},
+		{name: "resources without faults", resources: "clusters", expectedError: true},
+		{name: "not key=value", value: "error", expectedError: true},
+		{name: "unknown setting", value: "crash=1", expectedError: true},
+		{name: "invalid delay", value: "delay=soon", expectedError: true},
+		{name: "negative delay", value: "delay=-1s", expectedError: true},
+		{name: "rate above 1", value: "error=2", expectedError: true},
+		{name: "invalid rate", value: "partialApply=often", expectedError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			faults, err := parseFaultInjection(tt.value, tt.resources)
+			if tt.expectedError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, faults)
+		})
+	}
+}
+
+func TestRequestResource(t *testing.T) {
+	tests := map[string]string{
+		"/api/v1/namespaces/default/configmaps/override":                    "configmaps",
+		"/api/v1/namespaces/default":                                        "namespaces",
+		"/apis/postgresql.cnpg.io/v1/namespaces/default/clusters/db":        "clusters",
+		"/apis/postgresql.cnpg.io/v1/namespaces/default/clusters/db/status": "clusters",
+		"/apis/apiextensions.k8s.io/v1/customresourcedefinitions":           "customresourcedefinitions",
+		"/version": "",
+	}
+	for path, expected := range tests {
+		assert.Equal(t, expected, requestResource(path), path)
+	}
+}
+
+func TestFaultInjectionClient(t *testing.T) {
+	var received int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&received, 1)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"kind":"ConfigMap","apiVersion":"v1","metadata":{"name":"override","namespace":"default"}}`))
+	}))
+	defer server.Close()
+
+	newClient := func(t *testing.T, faults *faultInjection) kubernetes.Interface {
+		previous := injectedFaults
+		injectedFaults = faults
+		t.Cleanup(func() { injectedFaults = previous })
+
+		clientConfig := &rest.Config{Host: server.URL}
+		injectFaults(clientConfig)
+		client, err := kubernetes.NewForConfig(clientConfig)
+		require.NoError(t, err)
+		return client
+	}
+	ctx := context.Background()
+
+	t.Run("disabled", func(t *testing.T) {
+		atomic.StoreInt32(&received, 0)
+		client := newClient(t, nil)
+		_, err := client.CoreV1().ConfigMaps("default").Get(ctx, "override", metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&received))
+	})
+
+	t.Run("error", func(t *testing.T) {
+		atomic.StoreInt32(&received, 0)
+		client := newClient(t, &faultInjection{errorRate: 1})
+		_, err := client.CoreV1().ConfigMaps("default").Get(ctx, "override", metav1.GetOptions{})
+		assert.True(t, apierrors.IsServiceUnavailable(err), "unexpected error %v", err)
+		assert.Zero(t, atomic.LoadInt32(&received))
+	})
+
+	t.Run("partial apply", func(t *testing.T) {
+		atomic.StoreInt32(&received, 0)
+		client := newClient(t, &faultInjection{partialApplyRate: 1})
+
+		// Reads are not affected
+		_, err := client.CoreV1().ConfigMaps("default").Get(ctx, "override", metav1.GetOptions{})
+		require.NoError(t, err)
+
+		// Writes reach the API server and fail
+		_, err = client.CoreV1().ConfigMaps("default").Update(ctx, &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "override"}}, metav1.UpdateOptions{})
+		assert.True(t, apierrors.IsTimeout(err), "unexpected error %v", err)
+		assert.Equal(t, int32(2), atomic.LoadInt32(&received))
+	})
+
+	t.Run("other resources", func(t *testing.T) {
+		atomic.StoreInt32(&received, 0)
+		client := newClient(t, &faultInjection{errorRate: 1, resources: map[string]bool{"secrets": true}})
+		_, err := client.CoreV1().ConfigMaps("default").Get(ctx, "override", metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&received))
+	})
+
+	t.Run("delay", func(t *testing.T) {
+		client := newClient(t, &faultInjection{delay: time.Minute})
+		timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		_, err := client.CoreV1().ConfigMaps("default").Get(timeout, "override", metav1.GetOptions{})
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,166 @@
+package plugin
+
+import (
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// EnvDisabledActions is the environment variable listing actions that should not
+	// be registered, as a comma separated list of action names
+	EnvDisabledActions = "VELERO_CNPG_DISABLED_ACTIONS"
+
+	// EnvEnabledActions is the environment variable listing opt-in actions that should
+	// be registered, as a comma separated list of action names
+	EnvEnabledActions = "VELERO_CNPG_ENABLED_ACTIONS"
+
+	// EnvRestoreInstances is the environment variable listing additional instances of
+	// the restore action, as a comma separated list of instance names
+	EnvRestoreInstances = "VELERO_CNPG_RESTORE_INSTANCES"
+)
+
+// AnnotationDisable is the annotation on a Velero Restore that makes all restore actions
+// of the plugin pass items through unmodified, e.g. for a raw restore while debugging
+const AnnotationDisable = "velero-cnpg/disable"
+
+// AnnotationSkipRestore is the annotation on a Cluster that makes the restore action leave
+// the cluster out of every restore, without editing the restore's resource filters
+const AnnotationSkipRestore = "velero-cnpg/skip-restore"
+
+// AnnotationEnabled is the annotation on a Cluster that opts it into the plugin's backup
+// and restore handling when the optIn setting is on
+const AnnotationEnabled = "velero-cnpg/enabled"
+
+// optInActions are only registered when listed in EnvEnabledActions. The Deployment
+// action rewrites every restored Deployment, and the resource patch action does nothing
+// without configured patches, so they have to be asked for explicitly.
+var optInActions = map[string]bool{
+	DeploymentRestorePluginName:    true,
+	ResourcePatchRestorePluginName: true,
+}
+
+// ActionToggles decides which actions are registered with the plugin server, so
+// operators can enable or disable individual actions without rebuilding the image
+type ActionToggles struct {
+	enabled  map[string]bool
+	disabled map[string]bool
+}
+
+// LoadActionToggles reads the action toggles from the plugin environment
+func LoadActionToggles() *ActionToggles {
+	return parseActionToggles(os.Getenv(EnvEnabledActions), os.Getenv(EnvDisabledActions))
+}
+
+// restoreActionRegistered reports whether the plugin server registers the CNPG restore
+// action or one of its instances, per the plugin environment
+func restoreActionRegistered() bool {
+	toggles := LoadActionToggles()
+	if toggles.Enabled(RestorePluginName) {
+		return true
+	}
+	// The plugin server does not start with invalid instances
+	instances, _ := LoadRestoreInstances()
+	for _, instance := range instances {
+		if toggles.Enabled(RestorePluginInstanceName(instance)) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseActionToggles parses comma separated lists of enabled and disabled action names
+func parseActionToggles(enabledActions, disabledActions string) *ActionToggles {
+	return &ActionToggles{
+		enabled:  parseActionNames(enabledActions),
+		disabled: parseActionNames(disabledActions),
+	}
+}
+
+// parseActionNames parses a comma separated list of action names
+func parseActionNames(value string) map[string]bool {
+	names := map[string]bool{}
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// Enabled reports whether the action should be registered. Disabling an action wins
+// over enabling it, and opt-in actions must be enabled explicitly.
+func (t *ActionToggles) Enabled(actionName string) bool {
+	if matchesActionName(t.disabled, actionName) {
+		return false
+	}
+
+	if optInActions[actionName] {
+		return matchesActionName(t.enabled, actionName)
+	}
+
+	return true
+}
+
+// matchesActionName reports whether names contains the action, either by its registered
+// name (replicated.com/deployment-restore-plugin) or by the part after the domain
+// (deployment-restore-plugin)
+func matchesActionName(names map[string]bool, actionName string) bool {
+	if names[actionName] {
+		return true
+	}
+
+	i := strings.LastIndex(actionName, "/")
+	return i >= 0 && names[actionName[i+1:]]
+}
+
+// LoadRestoreInstances reads the names of additional restore action instances from the
+// plugin environment. Each instance is registered as RestorePluginInstanceName(name)
+// and reads its own plugin ConfigMap.
+func LoadRestoreInstances() ([]string, error) {
+	return parseRestoreInstances(os.Getenv(EnvRestoreInstances))
+}
+
+// parseRestoreInstances parses a comma separated list of restore action instance names
+func parseRestoreInstances(value string) ([]string, error) {
+	names := parseActionNames(value)
+
+	instances := make([]string, 0, len(names))
+	for name := range names {
+		if errs := validation.IsDNS1123Label(name); len(errs) > 0 {
+			return nil, errors.Errorf("invalid restore instance name %q: %s", name, strings.Join(errs, ", "))
+		}
+		instances = append(instances, name)
+	}
+	sort.Strings(instances)
+
+	return instances, nil
+}
+
+// restoreDisabled reports whether the restore asks the plugin to leave its items unmodified
+func restoreDisabled(restore *v1.Restore) bool {
+	if restore == nil {
+		return false
+	}
+
+	disabled, _ := strconv.ParseBool(restore.Annotations[AnnotationDisable])
+	return disabled
+}
+
+// optedIn reports whether the cluster is annotated to be handled by the plugin
+func optedIn(item *unstructured.Unstructured) bool {
+	enabled, _ := strconv.ParseBool(item.GetAnnotations()[AnnotationEnabled])
+	return enabled
+}
+
+// skipRestore reports whether the cluster is annotated to be left out of restores
+func skipRestore(item *unstructured.Unstructured) bool {
+	skip, _ := strconv.ParseBool(item.GetAnnotations()[AnnotationSkipRestore])
+	return skip
+}
@@ -0,0 +1,245 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestActionToggles(t *testing.T) {
+	tests := []struct {
+		name            string
+		enabledActions  string
+		disabledActions string
+		expected        map[string]bool
+	}{
+		{
+			name: "defaults leave opt-in actions disabled",
+			expected: map[string]bool{
+				RestorePluginName:              true,
+				DeploymentRestorePluginName:    false,
+				ResourcePatchRestorePluginName: false,
+			},
+		},
+		{
+			name:           "opt-in action enabled by registered name",
+			enabledActions: DeploymentRestorePluginName,
+			expected: map[string]bool{
+				RestorePluginName:           true,
+				DeploymentRestorePluginName: true,
+			},
+		},
+		{
+			name:            "disabled by short name with whitespace",
+			disabledActions: " cnpg-pdb-restore-plugin , cnpg-snapshot-fencing-plugin",
+			expected: map[string]bool{
+				RestorePluginName:         true,
+				PDBRestorePluginName:      false,
+				SnapshotFencingPluginName: false,
+			},
+		},
+		{
+			name:            "disabling wins over enabling",
+			enabledActions:  "deployment-restore-plugin",
+			disabledActions: "deployment-restore-plugin",
+			expected: map[string]bool{
+				DeploymentRestorePluginName: false,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			toggles := parseActionToggles(tt.enabledActions, tt.disabledActions)
+			for actionName, enabled := range tt.expected {
+				assert.Equal(t, enabled, toggles.Enabled(actionName), actionName)
+			}
+		})
+	}
+}
+
+func TestLoadActionToggles(t *testing.T) {
+	t.Setenv(EnvEnabledActions, "deployment-restore-plugin")
+	t.Setenv(EnvDisabledActions, PDBRestorePluginName)
+
+	toggles := LoadActionToggles()
+	assert.True(t, toggles.Enabled(DeploymentRestorePluginName))
+	assert.False(t, toggles.Enabled(PDBRestorePluginName))
+	assert.True(t, toggles.Enabled(BackupPluginName))
+}
+
+func TestParseRestoreInstances(t *testing.T) {
+	instances, err := parseRestoreInstances("tier-b, tier-a,,tier-a")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"tier-a", "tier-b"}, instances)
+	assert.Equal(t, "replicated.com/cnpg-restore-plugin-tier-a", RestorePluginInstanceName(instances[0]))
+
+	instances, err = parseRestoreInstances("")
+	assert.NoError(t, err)
+	assert.Empty(t, instances)
+
+	_, err = parseRestoreInstances("Tier_A")
+	assert.Error(t, err)
+}
+
+func TestRestoreDisabled(t *testing.T) {
+	newRestore := func(value string) *v1.Restore {
+		return &v1.Restore{ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{AnnotationDisable: value},
+		}}
+	}
+
+	assert.False(t, restoreDisabled(nil))
+	assert.False(t, restoreDisabled(&v1.Restore{}))
+	assert.False(t, restoreDisabled(newRestore("false")))
+	assert.False(t, restoreDisabled(newRestore("yes please")))
+	assert.True(t, restoreDisabled(newRestore("true")))
+}
+
+func TestRestoreActionsHonorDisable(t *testing.T) {
+	restore := &v1.Restore{ObjectMeta: metav1.ObjectMeta{
+		Annotations: map[string]string{AnnotationDisable: "true"},
+	}}
+
+	tests := []struct {
+		name        string
+		execute     func(*velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error)
+		itemContent map[string]interface{}
+	}{
+		{
+			name:    "cluster restore action",
+			execute: (&RestorePluginV2{log: logrus.New()}).Execute,
+			itemContent: map[string]interface{}{
+				"apiVersion": "postgresql.cnpg.io/v1",
+				"kind":       "Cluster",
+				"metadata": map[string]interface{}{
+					"name":        "pg",
+					"namespace":   "default",
+					"annotations": map[string]interface{}{AnnotationServerName: "pg"},
+				},
+				"spec":   map[string]interface{}{"instances": int64(1)},
+				"status": map[string]interface{}{"phase": "Running"},
+			},
+		},
+		{
+			name:    "deployment restore action",
+			execute: (&DeploymentRestorePlugin{log: logrus.New()}).Execute,
+			itemContent: map[string]interface{}{
+				"apiVersion": "apps/v1",
+				"kind":       "Deployment",
+				"metadata":   map[string]interface{}{"name": "app", "namespace": "default"},
+				"spec": map[string]interface{}{
+					"template": map[string]interface{}{
+						"spec": map[string]interface{}{
+							"initContainers": []interface{}{
+								map[string]interface{}{"name": MigrationInitContainerName},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name:    "PDB restore action",
+			execute: (&PDBRestorePlugin{log: logrus.New()}).Execute,
+			itemContent: map[string]interface{}{
+				"apiVersion": "policy/v1",
+				"kind":       "PodDisruptionBudget",
+				"metadata": map[string]interface{}{
+					"name":      "pg-primary",
+					"namespace": "default",
+					"ownerReferences": []interface{}{
+						map[string]interface{}{"apiVersion": "postgresql.cnpg.io/v1", "kind": "Cluster", "name": "pg", "uid": "1"},
+					},
+				},
+			},
+		},
+		{
+			name: "resource patch restore action",
+			execute: (&ResourcePatchRestorePlugin{log: logrus.New(), config: &PluginConfig{ResourcePatches: []ResourcePatch{
+				{Kind: "ConfigMap", MergePatch: []byte(`{"data":{"patched":"true"}}`)},
+			}}}).Execute,
+			itemContent: map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "ConfigMap",
+				"metadata":   map[string]interface{}{"name": "app", "namespace": "default"},
+			},
+		},
+		{
+			name:    "override ConfigMap restore action",
+			execute: (&OverrideConfigMapRestorePlugin{log: logrus.New()}).Execute,
+			itemContent: map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "ConfigMap",
+				"metadata":   map[string]interface{}{"name": OverrideConfigMapName, "namespace": "default"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			original := (&unstructured.Unstructured{Object: tt.itemContent}).DeepCopy()
+			item := &unstructured.Unstructured{Object: tt.itemContent}
+
+			output, err := tt.execute(&velero.RestoreItemActionExecuteInput{Item: item, Restore: restore})
+			require.NoError(t, err)
+			assert.False(t, output.SkipRestore)
+			assert.Equal(t, original.Object, output.UpdatedItem.UnstructuredContent())
+		})
+	}
+}
+
+func TestRestoreExecuteSkipRestore(t *testing.T) {
+	for _, value := range []string{"", "false", "true"} {
+		t.Run("skip-restore="+value, func(t *testing.T) {
+			item := createMockArchivingCluster("pg", "default", "pg", nil)
+			if value != "" {
+				item.SetAnnotations(map[string]string{AnnotationSkipRestore: value})
+			}
+			plugin := &RestorePluginV2{
+				log:           logrus.New(),
+				config:        &PluginConfig{RestoreMode: RestoreModeRecovery, SkipSchemaValidation: true, SkipPluginCheck: true},
+				dynamicClient: newFakeDynamicClient(),
+			}
+
+			output, err := plugin.Execute(&velero.RestoreItemActionExecuteInput{Item: item})
+			require.NoError(t, err)
+			assert.Equal(t, value == "true", output.SkipRestore)
+		})
+	}
+}
+
+func TestExecuteOptIn(t *testing.T) {
+	for _, value := range []string{"", "false", "true"} {
+		t.Run("enabled="+value, func(t *testing.T) {
+			newItem := func() *unstructured.Unstructured {
+				item := createMockArchivingCluster("pg", "default", "pg", nil)
+				if value != "" {
+					item.SetAnnotations(map[string]string{AnnotationEnabled: value})
+				}
+				return item
+			}
+			config := &PluginConfig{OptIn: true, RestoreMode: RestoreModeRecovery, SkipSchemaValidation: true, SkipPluginCheck: true}
+
+			backupPlugin := &BackupPluginV2{log: logrus.New(), config: config, dynamicClient: newFakeDynamicClient()}
+			backedUp, _, _, _, err := backupPlugin.Execute(newItem(), &v1.Backup{})
+			require.NoError(t, err)
+			_, annotated := (&unstructured.Unstructured{Object: backedUp.UnstructuredContent()}).GetAnnotations()[AnnotationServerName]
+			assert.Equal(t, value == "true", annotated)
+
+			item := newItem()
+			item.SetAnnotations(map[string]string{AnnotationEnabled: value, AnnotationBackupMethod: BackupMethodBarmanObjectStore})
+			original := item.DeepCopy()
+			restorePlugin := &RestorePluginV2{log: logrus.New(), config: config, dynamicClient: newFakeDynamicClient(), kubeClient: newFakeKubeClient()}
+			output, err := restorePlugin.Execute(&velero.RestoreItemActionExecuteInput{Item: item})
+			require.NoError(t, err)
+			assert.Equal(t, value != "true", assert.ObjectsAreEqual(original.Object, output.UpdatedItem.UnstructuredContent()))
+		})
+	}
+}
@@ -0,0 +1,250 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/label"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+)
+
+const (
+	// gateOperationPrefix prefixes the IDs of operations waiting for the restored clusters
+	// of a namespace to become healthy
+	gateOperationPrefix = "namespace-gate"
+
+	// gateKindCluster gates the resumption of the ScheduledBackups of a restored cluster
+	gateKindCluster = "cluster"
+
+	// gateKindDeployment gates the scale-up of a restored Deployment
+	gateKindDeployment = "deployment"
+
+	// AnnotationHeld is the annotation key marking ScheduledBackups created suspended until
+	// the restored clusters of their namespace are healthy
+	AnnotationHeld = "velero-cnpg/held"
+
+	// AnnotationHeldReplicas is the annotation key used to store the replicas of a Deployment
+	// restored scaled down until the restored clusters of its namespace are healthy
+	AnnotationHeldReplicas = "velero-cnpg/held-replicas"
+
+	// poolerNameLabel is the label CNPG sets on the Deployments of Poolers
+	poolerNameLabel = "cnpg.io/poolerName"
+)
+
+// deploymentGVR identifies Deployments
+var deploymentGVR = schema.GroupVersionResource{
+	Group:    "apps",
+	Version:  "v1",
+	Resource: "deployments",
+}
+
+// gateOperation identifies a resource held until the restored clusters of its namespace
+// are healthy
+type gateOperation struct {
+	namespace string
+	kind      string
+	name      string
+}
+
+// encodeGateOperationID encodes a gate operation as an operation ID
+func encodeGateOperationID(op *gateOperation) string {
+	return strings.Join([]string{gateOperationPrefix, op.namespace, op.kind, op.name}, "/")
+}
+
+// decodeGateOperationID decodes an operation ID produced by encodeGateOperationID
+func decodeGateOperationID(operationID string) (*gateOperation, error) {
+	parts := strings.Split(operationID, "/")
+	if len(parts) != 4 || parts[0] != gateOperationPrefix || parts[3] == "" {
+		return nil, errors.Errorf("invalid namespace gate operation ID %q", operationID)
+	}
+	switch parts[2] {
+	case gateKindCluster, gateKindDeployment:
+	default:
+		return nil, errors.Errorf("invalid namespace gate operation ID %q", operationID)
+	}
+	return &gateOperation{
+		namespace: parts[1],
+		kind:      parts[2],
+		name:      parts[3],
+	}, nil
+}
+
+// unhealthyRestoredClusters returns the sorted names of the clusters of the namespace
+// created by the restore that are not healthy yet, along with the number of clusters it
+// restored. Hibernated clusters are left out, since they do not start on their own.
+func unhealthyRestoredClusters(ctx context.Context, dynamicClient dynamic.Interface, namespace string, restore *v1.Restore) ([]string, int, error) {
+	options := metav1.ListOptions{}
+	if restore != nil {
+		options.LabelSelector = labels.Set{v1.RestoreNameLabel: label.GetValidName(restore.Name)}.String()
+	}
+	clusters, err := dynamicClient.Resource(cnpgClusterGVR).Namespace(namespace).List(ctx, options)
+	if err != nil {
+		return nil, 0, errors.Wrapf(classifyAPIError(err), "failed to list clusters in namespace %s", namespace)
+	}
+
+	var unhealthy []string
+	total := 0
+	for _, cluster := range clusters.Items {
+		if isHibernated(cluster.Object) {
+			continue
+		}
+		total++
+		if phase, _, _ := unstructured.NestedString(cluster.Object, "status", "phase"); phase != clusterPhaseHealthy {
+			unhealthy = append(unhealthy, cluster.GetName())
+		}
+	}
+	sort.Strings(unhealthy)
+
+	return unhealthy, total, nil
+}
+
+// gateProgress reports the operation as completed once every cluster the restore created
+// in the namespace is healthy, calling release first. A release that fails is retried on
+// the next poll.
+func gateProgress(dynamicClient dynamic.Interface, op *gateOperation, restore *v1.Restore, release func(ctx context.Context, dynamicClient dynamic.Interface, op *gateOperation) error) (velero.OperationProgress, error) {
+	progress := velero.OperationProgress{
+		OperationUnits: "Clusters",
+		Updated:        time.Now(),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	unhealthy, total, err := unhealthyRestoredClusters(ctx, dynamicClient, op.namespace, restore)
+	if err != nil {
+		return progress, err
+	}
+	progress.NTotal = int64(total)
+	progress.NCompleted = int64(total - len(unhealthy))
+	if len(unhealthy) > 0 {
+		progress.Description = fmt.Sprintf("Waiting for clusters %s in namespace %s to become healthy", strings.Join(unhealthy, ", "), op.namespace)
+		return progress, nil
+	}
+
+	if err := release(ctx, dynamicClient, op); err != nil {
+		return progress, err
+	}
+	progress.Completed = true
+	progress.Description = fmt.Sprintf("Restored clusters in namespace %s are healthy, released %s %s", op.namespace, op.kind, op.name)
+	return progress, nil
+}
+
+// releaseScheduledBackups resumes the ScheduledBackups of the cluster held by the restore
+func releaseScheduledBackups(ctx context.Context, dynamicClient dynamic.Interface, op *gateOperation) error {
+	scheduledBackups := dynamicClient.Resource(cnpgScheduledBackupGVR).Namespace(op.namespace)
+	list, err := scheduledBackups.List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return errors.Wrapf(classifyAPIError(err), "failed to list scheduled backups in namespace %s", op.namespace)
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": map[string]interface{}{AnnotationHeld: nil}},
+		"spec":     map[string]interface{}{"suspend": false},
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, scheduledBackup := range list.Items {
+		if scheduledBackup.GetAnnotations()[AnnotationHeld] != "true" {
+			continue
+		}
+		if name, _, _ := unstructured.NestedString(scheduledBackup.Object, "spec", "cluster", "name"); name != op.name {
+			continue
+		}
+		if _, err := scheduledBackups.Patch(ctx, scheduledBackup.GetName(), types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+			return errors.Wrapf(classifyAPIError(err), "failed to resume ScheduledBackup %s/%s", op.namespace, scheduledBackup.GetName())
+		}
+	}
+	return nil
+}
+
+// releaseDeployment scales the Deployment back to the replicas it was backed up with. A
+// Deployment without the held replicas annotation was not created by the restore, or was
+// already released, and is left alone.
+func releaseDeployment(ctx context.Context, dynamicClient dynamic.Interface, op *gateOperation) error {
+	deployments := dynamicClient.Resource(deploymentGVR).Namespace(op.namespace)
+	deployment, err := deployments.Get(ctx, op.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(classifyAPIError(err), "failed to get Deployment %s/%s", op.namespace, op.name)
+	}
+
+	value, found := deployment.GetAnnotations()[AnnotationHeldReplicas]
+	if !found {
+		return nil
+	}
+	replicas, err := strconv.ParseInt(value, 10, 32)
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse %s annotation of Deployment %s/%s", AnnotationHeldReplicas, op.namespace, op.name)
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": map[string]interface{}{AnnotationHeldReplicas: nil}},
+		"spec":     map[string]interface{}{"replicas": replicas},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := deployments.Patch(ctx, op.name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return errors.Wrapf(classifyAPIError(err), "failed to scale Deployment %s/%s", op.namespace, op.name)
+	}
+	return nil
+}
+
+// holdDeployment scales a restored Deployment down to zero, recording its replicas so the
+// namespace gate can scale it back up. Deployments already at zero and the Deployments of
+// Poolers, which only route to the clusters, are not held. It reports whether the
+// Deployment is held.
+func holdDeployment(itemContent map[string]interface{}) (bool, error) {
+	deployment := &unstructured.Unstructured{Object: itemContent}
+	if _, found := deployment.GetLabels()[poolerNameLabel]; found {
+		return false, nil
+	}
+
+	// Deployments without replicas default to one
+	replicas, found, err := unstructured.NestedFieldNoCopy(itemContent, "spec", "replicas")
+	if err != nil {
+		return false, errors.Wrap(err, "failed to get replicas")
+	}
+	count := int64(1)
+	if found {
+		switch value := replicas.(type) {
+		case int64:
+			count = value
+		case int:
+			count = int64(value)
+		case float64:
+			count = int64(value)
+		default:
+			return false, specShapeError("replicas is not a number")
+		}
+	}
+	if count == 0 {
+		return false, nil
+	}
+
+	if err := setAnnotation(itemContent, AnnotationHeldReplicas, strconv.FormatInt(count, 10)); err != nil {
+		return false, err
+	}
+	if err := unstructured.SetNestedField(itemContent, int64(0), "spec", "replicas"); err != nil {
+		return false, errors.Wrap(err, "failed to set replicas")
+	}
+	return true, nil
+}
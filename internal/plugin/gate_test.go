@@ -0,0 +1,190 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func createMockDeployment(name, namespace string, replicas interface{}) *unstructured.Unstructured {
+	spec := map[string]interface{}{}
+	if replicas != nil {
+		spec["replicas"] = replicas
+	}
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata": map[string]interface{}{
+			"name":      name,
+			"namespace": namespace,
+		},
+		"spec": spec,
+	}}
+}
+
+// restoredCluster returns a cluster created by restore-1 in the given phase
+func restoredCluster(name, phase string) *unstructured.Unstructured {
+	cluster := createMockArchivingCluster(name, "app", name, nil)
+	cluster.SetLabels(map[string]string{v1.RestoreNameLabel: "restore-1"})
+	cluster.Object["status"] = map[string]interface{}{"phase": phase}
+	return cluster
+}
+
+func TestGateOperationID(t *testing.T) {
+	op := &gateOperation{namespace: "app", kind: gateKindDeployment, name: "web"}
+	id := encodeGateOperationID(op)
+	assert.Equal(t, "namespace-gate/app/deployment/web", id)
+
+	decoded, err := decodeGateOperationID(id)
+	require.NoError(t, err)
+	assert.Equal(t, op, decoded)
+
+	for _, invalid := range []string{"namespace-gate/app/deployment", "namespace-gate/app/pod/web", "seed-backup/app/deployment/web"} {
+		_, err := decodeGateOperationID(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestHoldDeployment(t *testing.T) {
+	tests := []struct {
+		name             string
+		deployment       *unstructured.Unstructured
+		expectHeld       bool
+		expectedReplicas int64
+		expectedHeld     string
+	}{
+		{name: "replicas", deployment: createMockDeployment("web", "app", int64(3)), expectHeld: true, expectedHeld: "3"},
+		{name: "default replicas", deployment: createMockDeployment("web", "app", nil), expectHeld: true, expectedHeld: "1"},
+		{name: "scaled down", deployment: createMockDeployment("web", "app", int64(0))},
+		{
+			name: "pooler",
+			deployment: func() *unstructured.Unstructured {
+				deployment := createMockDeployment("pg-pooler", "app", int64(2))
+				deployment.SetLabels(map[string]string{poolerNameLabel: "pg-pooler"})
+				return deployment
+			}(),
+			expectedReplicas: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			held, err := holdDeployment(tt.deployment.Object)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectHeld, held)
+
+			replicas, _, _ := unstructured.NestedInt64(tt.deployment.Object, "spec", "replicas")
+			assert.Equal(t, tt.expectedReplicas, replicas)
+			value, found := tt.deployment.GetAnnotations()[AnnotationHeldReplicas]
+			assert.Equal(t, tt.expectHeld, found)
+			assert.Equal(t, tt.expectedHeld, value)
+		})
+	}
+}
+
+func TestClusterGateProgress(t *testing.T) {
+	restore := &v1.Restore{ObjectMeta: metav1.ObjectMeta{Name: "restore-1"}}
+	op := &gateOperation{namespace: "app", kind: gateKindCluster, name: "users"}
+
+	held := scheduledBackup(&ScheduledBackupConfig{Schedule: "0 0 0 * * *"}, "app", "users", BackupMethodPlugin, restore, true)
+	other := scheduledBackup(&ScheduledBackupConfig{Schedule: "0 0 0 * * *"}, "app", "orders", BackupMethodPlugin, restore, true)
+
+	// A cluster of another restore and a hibernated one are not waited for
+	unrelated := createMockArchivingCluster("legacy", "app", "legacy", nil)
+	hibernated := restoredCluster("archive", "")
+	hibernated.SetAnnotations(map[string]string{AnnotationHibernation: HibernationOn})
+
+	dynamicClient := newFakeDynamicClient(restoredCluster("users", clusterPhaseHealthy), restoredCluster("orders", "Setting up primary"), unrelated, hibernated, held, other)
+	plugin := &RestorePluginV2{log: logrus.New(), dynamicClient: dynamicClient}
+	id := encodeGateOperationID(op)
+
+	progress, err := plugin.Progress(id, restore)
+	require.NoError(t, err)
+	assert.False(t, progress.Completed)
+	assert.Equal(t, int64(2), progress.NTotal)
+	assert.Equal(t, int64(1), progress.NCompleted)
+	assert.Equal(t, "Waiting for clusters orders in namespace app to become healthy", progress.Description)
+
+	scheduledBackups := dynamicClient.Resource(cnpgScheduledBackupGVR).Namespace("app")
+	_, err = dynamicClient.Resource(cnpgClusterGVR).Namespace("app").Update(context.Background(), restoredCluster("orders", clusterPhaseHealthy), metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	progress, err = plugin.Progress(id, restore)
+	require.NoError(t, err)
+	assert.True(t, progress.Completed)
+	assert.Empty(t, progress.Err)
+
+	resumed, err := scheduledBackups.Get(context.Background(), held.GetName(), metav1.GetOptions{})
+	require.NoError(t, err)
+	suspend, _, _ := unstructured.NestedBool(resumed.Object, "spec", "suspend")
+	assert.False(t, suspend)
+	assert.NotContains(t, resumed.GetAnnotations(), AnnotationHeld)
+
+	// The ScheduledBackups of other clusters are resumed by their own gate
+	untouched, err := scheduledBackups.Get(context.Background(), other.GetName(), metav1.GetOptions{})
+	require.NoError(t, err)
+	suspend, _, _ = unstructured.NestedBool(untouched.Object, "spec", "suspend")
+	assert.True(t, suspend)
+}
+
+func TestDeploymentGateProgress(t *testing.T) {
+	restore := &v1.Restore{ObjectMeta: metav1.ObjectMeta{Name: "restore-1"}}
+	deployment := createMockDeployment("web", "app", int64(3))
+	_, err := holdDeployment(deployment.Object)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name             string
+		objects          []runtime.Object
+		expectCompleted  bool
+		expectedReplicas int64
+	}{
+		{name: "cluster recovering", objects: []runtime.Object{restoredCluster("pg", "Setting up primary")}},
+		{name: "cluster healthy", objects: []runtime.Object{restoredCluster("pg", clusterPhaseHealthy)}, expectCompleted: true, expectedReplicas: 3},
+		{name: "no restored clusters", expectCompleted: true, expectedReplicas: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dynamicClient := newFakeDynamicClient(append(tt.objects, deployment.DeepCopy())...)
+			plugin := &DeploymentRestorePlugin{log: logrus.New(), dynamicClient: dynamicClient}
+
+			progress, err := plugin.Progress(encodeGateOperationID(&gateOperation{namespace: "app", kind: gateKindDeployment, name: "web"}), restore)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectCompleted, progress.Completed)
+
+			updated, err := dynamicClient.Resource(deploymentGVR).Namespace("app").Get(context.Background(), "web", metav1.GetOptions{})
+			require.NoError(t, err)
+			replicas, _, _ := unstructured.NestedInt64(updated.Object, "spec", "replicas")
+			assert.Equal(t, tt.expectedReplicas, replicas)
+			assert.Equal(t, !tt.expectCompleted, updated.GetAnnotations()[AnnotationHeldReplicas] == "3")
+		})
+	}
+}
+
+func TestDeploymentRestorePluginExecuteCoordinated(t *testing.T) {
+	config := DefaultPluginConfig()
+	config.CoordinateNamespace = true
+	plugin := &DeploymentRestorePlugin{log: logrus.New(), config: config}
+
+	output, err := plugin.Execute(&velero.RestoreItemActionExecuteInput{
+		Item:    createMockDeployment("web", "app", int64(2)),
+		Restore: &v1.Restore{},
+	})
+	require.NoError(t, err)
+	operationID, started, err := splitStarted(output.OperationID)
+	require.NoError(t, err)
+	assert.Equal(t, "namespace-gate/app/deployment/web", operationID)
+	assert.False(t, started.IsZero())
+
+	replicas, _, _ := unstructured.NestedInt64(output.UpdatedItem.UnstructuredContent(), "spec", "replicas")
+	assert.Equal(t, int64(0), replicas)
+}
@@ -0,0 +1,184 @@
+package plugin
+
+import (
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	// annotationArgoCDSyncOptions holds the comma separated Argo CD sync options of a resource
+	annotationArgoCDSyncOptions = "argocd.argoproj.io/sync-options"
+
+	// annotationArgoCDCompareOptions holds the comma separated Argo CD compare options of a resource
+	annotationArgoCDCompareOptions = "argocd.argoproj.io/compare-options"
+
+	// annotationFluxPrune disables the garbage collection of a resource by a Flux Kustomization
+	annotationFluxPrune = "kustomize.toolkit.fluxcd.io/prune"
+
+	// labelArgoCDInstance holds the Argo CD Application of a resource, when Argo CD tracks
+	// resources by this label
+	labelArgoCDInstance = "argocd.argoproj.io/instance"
+
+	// annotationArgoCDTrackingID holds the Argo CD Application of a resource followed by its
+	// group, kind, namespace and name
+	annotationArgoCDTrackingID = "argocd.argoproj.io/tracking-id"
+
+	// labelFluxName holds the Flux Kustomization of a resource
+	labelFluxName = "kustomize.toolkit.fluxcd.io/name"
+)
+
+// trackingPrefixes are the prefixes of the labels and annotations Argo CD and Flux keep on
+// the resources they manage
+var trackingPrefixes = []string{"argocd.argoproj.io/", "kustomize.toolkit.fluxcd.io/"}
+
+// applyGitOps stamps the restored cluster with the labels and annotations GitOps
+// controllers need to adopt it, rather than prune it on their next sync
+func (p *RestorePluginV2) applyGitOps(itemContent map[string]interface{}, gitOps *GitOpsConfig) error {
+	if gitOps == nil {
+		return nil
+	}
+
+	// The tracking metadata of the source cluster goes before the metadata added for the destination
+	namespace := (&unstructured.Unstructured{Object: itemContent}).GetNamespace()
+	changed, err := applyTrackingMetadata(itemContent, gitOps.trackingRule(namespace))
+	if err != nil {
+		return err
+	}
+	if len(changed) > 0 {
+		p.log.Infof("Rewrote GitOps tracking metadata %s of the restored cluster", strings.Join(changed, ", "))
+	}
+
+	if len(gitOps.Labels) > 0 {
+		labels, err := ensureNestedMapNoCopy(itemContent, "metadata", "labels")
+		if err != nil {
+			return err
+		}
+		for key, value := range gitOps.Labels {
+			labels[key] = value
+		}
+	}
+
+	for key, value := range gitOps.Annotations {
+		if err := setAnnotation(itemContent, key, value); err != nil {
+			return err
+		}
+	}
+
+	if gitOps.PreventPrune {
+		// Argo CD keeps options already set on the cluster, so those are extended
+		if err := p.addAnnotationOption(itemContent, annotationArgoCDSyncOptions, "Prune=false"); err != nil {
+			return err
+		}
+		if err := p.addAnnotationOption(itemContent, annotationArgoCDCompareOptions, "IgnoreExtraneous"); err != nil {
+			return err
+		}
+		if err := setAnnotation(itemContent, annotationFluxPrune, "disabled"); err != nil {
+			return err
+		}
+	}
+
+	p.log.Infof("Added %d GitOps labels and annotations to the restored cluster", len(gitOps.Labels)+len(gitOps.Annotations))
+	return nil
+}
+
+// addAnnotationOption adds an option to an annotation holding a comma separated list,
+// unless it is already listed
+func (p *RestorePluginV2) addAnnotationOption(itemContent map[string]interface{}, key, option string) error {
+	value, _, err := p.getAnnotation(itemContent, key)
+	if err != nil {
+		return err
+	}
+
+	var options []string
+	for _, existing := range strings.Split(value, ",") {
+		existing = strings.TrimSpace(existing)
+		if existing == option {
+			return nil
+		}
+		if existing != "" {
+			options = append(options, existing)
+		}
+	}
+
+	return setAnnotation(itemContent, key, strings.Join(append(options, option), ","))
+}
+
+// trackingRule returns the tracking metadata rule for CNPG resources restored into the
+// namespace, if any
+func (c *GitOpsConfig) trackingRule(namespace string) *TrackingMetadataRule {
+	if c == nil {
+		return nil
+	}
+	if rule, found := c.NamespaceTrackingMetadata[namespace]; found {
+		return &rule
+	}
+	return c.TrackingMetadata
+}
+
+// applyTrackingMetadata strips the Argo CD and Flux tracking labels and annotations of a
+// restored CNPG resource, or renames the owners they refer to, returning the fields changed
+func applyTrackingMetadata(itemContent map[string]interface{}, rule *TrackingMetadataRule) ([]string, error) {
+	if rule == nil {
+		return nil, nil
+	}
+
+	var changed []string
+	for _, field := range []string{"labels", "annotations"} {
+		metadata, found, err := nestedMapNoCopy(itemContent, "metadata", field)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			continue
+		}
+
+		for key, value := range metadata {
+			if !isTrackingKey(key) {
+				continue
+			}
+			if rule.Policy == TrackingMetadataStrip {
+				delete(metadata, key)
+				changed = append(changed, field+"."+key)
+				continue
+			}
+			if owner, ok := value.(string); ok {
+				if renamed := renameTrackingOwner(key, owner, rule.OwnerNames); renamed != owner {
+					metadata[key] = renamed
+					changed = append(changed, field+"."+key)
+				}
+			}
+		}
+	}
+	sort.Strings(changed)
+
+	return changed, nil
+}
+
+// isTrackingKey reports whether a label or annotation key belongs to Argo CD or Flux
+func isTrackingKey(key string) bool {
+	for _, prefix := range trackingPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// renameTrackingOwner renames the Application or Kustomization a tracking label or
+// annotation value refers to
+func renameTrackingOwner(key, value string, ownerNames map[string]string) string {
+	switch key {
+	case labelArgoCDInstance, labelFluxName:
+		if renamed, found := ownerNames[value]; found {
+			return renamed
+		}
+	case annotationArgoCDTrackingID:
+		owner, resource, found := strings.Cut(value, ":")
+		if renamed, mapped := ownerNames[owner]; found && mapped {
+			return renamed + ":" + resource
+		}
+	}
+	return value
+}
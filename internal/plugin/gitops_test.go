@@ -0,0 +1,135 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestApplyGitOps(t *testing.T) {
+	tests := []struct {
+		name                string
+		annotations         map[string]string
+		gitOps              *GitOpsConfig
+		expectedLabels      map[string]string
+		expectedAnnotations map[string]string
+	}{
+		{
+			name:                "not configured",
+			annotations:         map[string]string{"team": "payments"},
+			expectedAnnotations: map[string]string{"team": "payments"},
+		},
+		{
+			name: "labels and annotations",
+			gitOps: &GitOpsConfig{
+				Labels:      map[string]string{"app.kubernetes.io/instance": "payments"},
+				Annotations: map[string]string{"argocd.argoproj.io/tracking-id": "payments:postgresql.cnpg.io/Cluster:default/pg"},
+			},
+			expectedLabels:      map[string]string{"app.kubernetes.io/instance": "payments"},
+			expectedAnnotations: map[string]string{"argocd.argoproj.io/tracking-id": "payments:postgresql.cnpg.io/Cluster:default/pg"},
+		},
+		{
+			name:        "prevent prune",
+			annotations: map[string]string{annotationArgoCDSyncOptions: "ServerSideApply=true, Prune=false"},
+			gitOps:      &GitOpsConfig{PreventPrune: true},
+			expectedAnnotations: map[string]string{
+				annotationArgoCDSyncOptions:    "ServerSideApply=true, Prune=false",
+				annotationArgoCDCompareOptions: "IgnoreExtraneous",
+				annotationFluxPrune:            "disabled",
+			},
+		},
+		{
+			name:        "tracking metadata stripped before prevent prune",
+			annotations: map[string]string{annotationArgoCDTrackingID: "payments:postgresql.cnpg.io/Cluster:default/pg"},
+			gitOps:      &GitOpsConfig{PreventPrune: true, TrackingMetadata: &TrackingMetadataRule{Policy: TrackingMetadataStrip}},
+			expectedAnnotations: map[string]string{
+				annotationArgoCDSyncOptions:    "Prune=false",
+				annotationArgoCDCompareOptions: "IgnoreExtraneous",
+				annotationFluxPrune:            "disabled",
+			},
+		},
+		{
+			name:        "prevent prune extends existing options",
+			annotations: map[string]string{annotationArgoCDSyncOptions: "ServerSideApply=true"},
+			gitOps:      &GitOpsConfig{PreventPrune: true},
+			expectedAnnotations: map[string]string{
+				annotationArgoCDSyncOptions:    "ServerSideApply=true,Prune=false",
+				annotationArgoCDCompareOptions: "IgnoreExtraneous",
+				annotationFluxPrune:            "disabled",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := annotatedCluster("pg", "default", tt.annotations)
+
+			require.NoError(t, (&RestorePluginV2{log: logrus.New()}).applyGitOps(cluster.Object, tt.gitOps))
+			assert.Equal(t, tt.expectedLabels, cluster.GetLabels())
+			assert.Equal(t, tt.expectedAnnotations, cluster.GetAnnotations())
+		})
+	}
+}
+
+func TestApplyTrackingMetadata(t *testing.T) {
+	newItem := func() *unstructured.Unstructured {
+		item := annotatedCluster("pg", "app", map[string]string{
+			annotationArgoCDTrackingID:  "payments:postgresql.cnpg.io/Cluster:app/pg",
+			annotationArgoCDSyncOptions: "Prune=false",
+			"team":                      "payments",
+		})
+		item.SetLabels(map[string]string{
+			labelFluxName:                           "payments",
+			"kustomize.toolkit.fluxcd.io/namespace": "flux-system",
+			"app.kubernetes.io/name":                "pg",
+		})
+		return item
+	}
+
+	t.Run("keep renames owners", func(t *testing.T) {
+		item := newItem()
+		changed, err := applyTrackingMetadata(item.Object, &TrackingMetadataRule{OwnerNames: map[string]string{"payments": "payments-dr"}})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"annotations." + annotationArgoCDTrackingID, "labels." + labelFluxName}, changed)
+		assert.Equal(t, "payments-dr:postgresql.cnpg.io/Cluster:app/pg", item.GetAnnotations()[annotationArgoCDTrackingID])
+		assert.Equal(t, "payments-dr", item.GetLabels()[labelFluxName])
+	})
+
+	t.Run("strip", func(t *testing.T) {
+		item := newItem()
+		changed, err := applyTrackingMetadata(item.Object, &TrackingMetadataRule{Policy: TrackingMetadataStrip})
+		require.NoError(t, err)
+		assert.Len(t, changed, 4)
+		assert.Equal(t, map[string]string{"team": "payments"}, item.GetAnnotations())
+		assert.Equal(t, map[string]string{"app.kubernetes.io/name": "pg"}, item.GetLabels())
+	})
+
+	t.Run("namespace rule", func(t *testing.T) {
+		gitOps := &GitOpsConfig{
+			TrackingMetadata:          &TrackingMetadataRule{Policy: TrackingMetadataStrip},
+			NamespaceTrackingMetadata: map[string]TrackingMetadataRule{"app": {Policy: TrackingMetadataKeep}},
+		}
+		assert.Equal(t, TrackingMetadataKeep, gitOps.trackingRule("app").Policy)
+		assert.Equal(t, TrackingMetadataStrip, gitOps.trackingRule("other").Policy)
+		assert.Nil(t, (*GitOpsConfig)(nil).trackingRule("app"))
+	})
+}
+
+func TestRestoreExecuteGitOpsUnmanagedCluster(t *testing.T) {
+	plugin := &RestorePluginV2{
+		log: logrus.New(),
+		config: &PluginConfig{
+			RestoreMode: RestoreModeRecovery,
+			GitOps:      &GitOpsConfig{Labels: map[string]string{"app.kubernetes.io/instance": "payments"}},
+		},
+		kubeClient: newFakeKubeClient(),
+	}
+
+	out, err := plugin.Execute(&velero.RestoreItemActionExecuteInput{Item: annotatedCluster("pg", "default", nil)})
+	require.NoError(t, err)
+	assert.Equal(t, "payments", out.UpdatedItem.(*unstructured.Unstructured).GetLabels()["app.kubernetes.io/instance"])
+}
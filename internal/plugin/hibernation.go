@@ -0,0 +1,44 @@
+package plugin
+
+import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	// AnnotationHibernation is the CNPG annotation declaring a cluster hibernated
+	AnnotationHibernation = "cnpg.io/hibernation"
+
+	// HibernationOn is the AnnotationHibernation value of a hibernated cluster
+	HibernationOn = "on"
+)
+
+// isHibernated reports whether the cluster was hibernated when it was backed up
+func isHibernated(itemContent map[string]interface{}) bool {
+	value, _, _ := unstructured.NestedString(itemContent, "metadata", "annotations", AnnotationHibernation)
+	return value == HibernationOn
+}
+
+// resumeHibernation removes the hibernation annotation so the operator starts the
+// restored cluster instead of leaving it dormant
+func (p *RestorePluginV2) resumeHibernation(itemContent map[string]interface{}) {
+	annotations, found, _ := nestedMapNoCopy(itemContent, "metadata", "annotations")
+	if !found {
+		return
+	}
+
+	delete(annotations, AnnotationHibernation)
+	if len(annotations) == 0 {
+		unstructured.RemoveNestedField(itemContent, "metadata", "annotations")
+	}
+	p.log.Infof("Removed %s annotation, the restored cluster will be resumed", AnnotationHibernation)
+}
+
+// hibernate sets the hibernation annotation so the operator creates the restored cluster
+// without bootstrapping it, leaving recovery to be started by removing the annotation
+func (p *RestorePluginV2) hibernate(itemContent map[string]interface{}) error {
+	if err := setAnnotation(itemContent, AnnotationHibernation, HibernationOn); err != nil {
+		return err
+	}
+	p.log.Infof("Set %s annotation, the restored cluster will be provisioned without recovery", AnnotationHibernation)
+	return nil
+}
@@ -0,0 +1,156 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestResumeHibernation(t *testing.T) {
+	plugin := &RestorePluginV2{
+		log: logrus.New(),
+	}
+
+	itemContent := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{
+				AnnotationHibernation: HibernationOn,
+				"other":               "value",
+			},
+		},
+	}
+	require.True(t, isHibernated(itemContent))
+
+	plugin.resumeHibernation(itemContent)
+	assert.False(t, isHibernated(itemContent))
+	assert.Equal(t, map[string]interface{}{"other": "value"}, itemContent["metadata"].(map[string]interface{})["annotations"])
+
+	// The annotations map is dropped when hibernation was the only annotation
+	onlyHibernation := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{AnnotationHibernation: HibernationOn},
+		},
+	}
+	plugin.resumeHibernation(onlyHibernation)
+	_, hasAnnotations := onlyHibernation["metadata"].(map[string]interface{})["annotations"]
+	assert.False(t, hasAnnotations)
+
+	assert.False(t, isHibernated(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{AnnotationHibernation: "off"},
+		},
+	}))
+}
+
+func TestRestoreExecuteHibernation(t *testing.T) {
+	tests := []struct {
+		name             string
+		config           *PluginConfig
+		expectHibernated bool
+	}{
+		{
+			name:             "hibernated cluster stays hibernated by default",
+			config:           DefaultPluginConfig(),
+			expectHibernated: true,
+		},
+		{
+			name:   "hibernated cluster is resumed",
+			config: &PluginConfig{RestoreMode: RestoreModeRecovery, ResumeHibernatedClusters: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plugin := &RestorePluginV2{
+				log:    logrus.New(),
+				config: tt.config,
+			}
+
+			// A cold backup without a backup method is still resumed
+			item := &unstructured.Unstructured{}
+			item.SetUnstructuredContent(map[string]interface{}{
+				"apiVersion": "postgresql.cnpg.io/v1",
+				"kind":       "Cluster",
+				"metadata": map[string]interface{}{
+					"name": "test-cluster",
+					"annotations": map[string]interface{}{
+						AnnotationHibernation: HibernationOn,
+					},
+				},
+				"spec": map[string]interface{}{},
+			})
+
+			output, err := plugin.Execute(&velero.RestoreItemActionExecuteInput{Item: item})
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectHibernated, isHibernated(output.UpdatedItem.UnstructuredContent()))
+		})
+	}
+}
+
+func TestRestoreExecuteProvisionOnly(t *testing.T) {
+	tests := []struct {
+		name             string
+		config           *PluginConfig
+		hibernated       bool
+		expectHibernated bool
+	}{
+		{
+			name:   "recovery starts by default",
+			config: DefaultPluginConfig(),
+		},
+		{
+			name:             "provisioned hibernated",
+			config:           &PluginConfig{RestoreMode: RestoreModeRecovery, ProvisionOnly: true},
+			expectHibernated: true,
+		},
+		{
+			name:             "provision only wins over resuming",
+			config:           &PluginConfig{RestoreMode: RestoreModeRecovery, ProvisionOnly: true, ResumeHibernatedClusters: true},
+			hibernated:       true,
+			expectHibernated: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plugin := &RestorePluginV2{
+				log:           logrus.New(),
+				config:        tt.config,
+				dynamicClient: newFakeDynamicClient(),
+			}
+
+			annotations := map[string]interface{}{AnnotationBackupMethod: BackupMethodBarmanObjectStore}
+			if tt.hibernated {
+				annotations[AnnotationHibernation] = HibernationOn
+			}
+			item := &unstructured.Unstructured{}
+			item.SetUnstructuredContent(map[string]interface{}{
+				"apiVersion": "postgresql.cnpg.io/v1",
+				"kind":       "Cluster",
+				"metadata": map[string]interface{}{
+					"name":        "test-cluster",
+					"namespace":   "default",
+					"annotations": annotations,
+				},
+				"spec": map[string]interface{}{
+					"backup": map[string]interface{}{
+						"barmanObjectStore": map[string]interface{}{"destinationPath": "s3://bucket"},
+					},
+				},
+			})
+
+			output, err := plugin.Execute(&velero.RestoreItemActionExecuteInput{Item: item})
+			require.NoError(t, err)
+			content := output.UpdatedItem.UnstructuredContent()
+
+			// Recovery is configured either way, only starting it is deferred
+			_, found, _ := unstructured.NestedFieldNoCopy(content, "spec", "bootstrap", "recovery")
+			assert.True(t, found)
+			assert.Equal(t, tt.expectHibernated, isHibernated(content))
+		})
+	}
+}
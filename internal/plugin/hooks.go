@@ -0,0 +1,103 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	// defaultHookTimeout bounds hooks without a timeout
+	defaultHookTimeout = 30 * time.Second
+
+	// defaultHookDatabase is the database hooks run in when none is configured
+	defaultHookDatabase = "postgres"
+)
+
+// hookName returns the name of a hook for logs
+func hookName(phase string, index int, hook *SQLHook) string {
+	if hook.Name != "" {
+		return fmt.Sprintf("%s hook %s", phase, hook.Name)
+	}
+	return fmt.Sprintf("%s hook %d", phase, index)
+}
+
+// hookCommand returns the psql command running the SQL of a hook
+func hookCommand(hook *SQLHook) []string {
+	database := hook.Database
+	if database == "" {
+		database = defaultHookDatabase
+	}
+	return []string{"psql", "-XAtq", "-v", "ON_ERROR_STOP=1", "-d", database, "-c", hook.SQL}
+}
+
+// runBackupHooks runs hooks on the primary of the cluster in order. A failing hook with
+// onError fail stops the remaining hooks and returns its error, other failures are logged.
+// Hibernated clusters have no instance to run them on and are skipped.
+func (p *BackupPluginV2) runBackupHooks(itemContent map[string]interface{}, phase string, hooks []SQLHook) error {
+	if len(hooks) == 0 {
+		return nil
+	}
+	if isHibernated(itemContent) {
+		p.log.Infof("Cluster is hibernated, not running %s hooks", phase)
+		return nil
+	}
+
+	cluster := &unstructured.Unstructured{Object: itemContent}
+	primary, _, _ := unstructured.NestedString(itemContent, "status", "currentPrimary")
+
+	var podExec podExecFunc
+	for i := range hooks {
+		hook := &hooks[i]
+		name := hookName(phase, i, hook)
+
+		err := func() error {
+			if primary == "" {
+				return errors.New("cluster has no primary")
+			}
+			if podExec == nil {
+				var err error
+				if podExec, err = p.getPodExec(); err != nil {
+					return errors.Wrap(err, "failed to create pod exec client")
+				}
+			}
+
+			timeout := defaultHookTimeout
+			if hook.Timeout != "" {
+				timeout, _ = time.ParseDuration(hook.Timeout)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+
+			_, err := podExec(ctx, cluster.GetNamespace(), primary, postgresContainer, hookCommand(hook))
+			return err
+		}()
+
+		if err == nil {
+			p.log.Infof("Ran %s on %s", name, primary)
+			continue
+		}
+		if hook.OnError == HookOnErrorContinue {
+			p.log.Warnf("Failed to run %s, continuing: %v", name, err)
+			continue
+		}
+		return errors.Wrapf(err, "failed to run %s", name)
+	}
+
+	return nil
+}
+
+// runPostBackupHooks runs the post hooks once the cluster has been backed up. Deferred by
+// Execute, it reports a failing hook through err unless the backup already failed.
+func (p *BackupPluginV2) runPostBackupHooks(itemContent map[string]interface{}, hooks []SQLHook, err *error) {
+	if hookErr := p.runBackupHooks(itemContent, "post", hooks); hookErr != nil {
+		if *err == nil {
+			*err = hookErr
+		} else {
+			p.log.Error(hookErr)
+		}
+	}
+}
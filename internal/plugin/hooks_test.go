@@ -0,0 +1,158 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// recordingPodExec returns a podExecFunc recording the SQL it runs and failing the SQL
+// listed in failing
+func recordingPodExec(ran *[]string, failing ...string) podExecFunc {
+	return func(_ context.Context, _, _, _ string, command []string) (string, error) {
+		sql := command[len(command)-1]
+		*ran = append(*ran, sql)
+		for _, failed := range failing {
+			if sql == failed {
+				return "", errors.New("ERROR: boom")
+			}
+		}
+		return "", nil
+	}
+}
+
+func newHookCluster(t *testing.T) *unstructured.Unstructured {
+	cluster := createMockArchivingCluster("pg", "default", "pg", nil)
+	require.NoError(t, unstructured.SetNestedField(cluster.Object, "pg-1", "status", "currentPrimary"))
+	return cluster
+}
+
+func TestRunBackupHooks(t *testing.T) {
+	tests := []struct {
+		name          string
+		hooks         []SQLHook
+		failing       []string
+		expectedRan   []string
+		expectedError string
+	}{
+		{
+			name:        "runs in order",
+			hooks:       []SQLHook{{SQL: "SELECT 1"}, {SQL: "SELECT 2"}},
+			expectedRan: []string{"SELECT 1", "SELECT 2"},
+		},
+		{
+			name:          "failing hook stops the remaining ones",
+			hooks:         []SQLHook{{Name: "pause", SQL: "SELECT 1"}, {SQL: "SELECT 2"}},
+			failing:       []string{"SELECT 1"},
+			expectedRan:   []string{"SELECT 1"},
+			expectedError: "failed to run pre hook pause: ERROR: boom",
+		},
+		{
+			name:        "continue on error",
+			hooks:       []SQLHook{{SQL: "SELECT 1", OnError: HookOnErrorContinue}, {SQL: "SELECT 2"}},
+			failing:     []string{"SELECT 1"},
+			expectedRan: []string{"SELECT 1", "SELECT 2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ran []string
+			plugin := &BackupPluginV2{log: logrus.New(), podExec: recordingPodExec(&ran, tt.failing...)}
+
+			err := plugin.runBackupHooks(newHookCluster(t).Object, "pre", tt.hooks)
+			if tt.expectedError != "" {
+				assert.EqualError(t, err, tt.expectedError)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.expectedRan, ran)
+		})
+	}
+}
+
+func TestRunBackupHooksCommand(t *testing.T) {
+	plugin := &BackupPluginV2{log: logrus.New(), podExec: func(ctx context.Context, namespace, pod, container string, command []string) (string, error) {
+		deadline, ok := ctx.Deadline()
+		require.True(t, ok)
+		assert.WithinDuration(t, time.Now().Add(5*time.Second), deadline, time.Second)
+		assert.Equal(t, "default", namespace)
+		assert.Equal(t, "pg-1", pod)
+		assert.Equal(t, postgresContainer, container)
+		assert.Equal(t, []string{"psql", "-XAtq", "-v", "ON_ERROR_STOP=1", "-d", "app", "-c", "REFRESH MATERIALIZED VIEW totals"}, command)
+		return "", nil
+	}}
+
+	hooks := []SQLHook{{Database: "app", SQL: "REFRESH MATERIALIZED VIEW totals", Timeout: "5s"}}
+	require.NoError(t, plugin.runBackupHooks(newHookCluster(t).Object, "pre", hooks))
+}
+
+func TestRunBackupHooksWithoutPrimary(t *testing.T) {
+	var ran []string
+	plugin := &BackupPluginV2{log: logrus.New(), podExec: recordingPodExec(&ran)}
+	cluster := createMockArchivingCluster("pg", "default", "pg", nil)
+
+	err := plugin.runBackupHooks(cluster.Object, "pre", []SQLHook{{SQL: "SELECT 1"}})
+	assert.EqualError(t, err, "failed to run pre hook 0: cluster has no primary")
+
+	// Hibernated clusters are skipped
+	cluster.SetAnnotations(map[string]string{AnnotationHibernation: "on"})
+	assert.NoError(t, plugin.runBackupHooks(cluster.Object, "pre", []SQLHook{{SQL: "SELECT 1"}}))
+	assert.Empty(t, ran)
+}
+
+func TestExecuteBackupHooks(t *testing.T) {
+	t.Run("post hooks run after the cluster is backed up", func(t *testing.T) {
+		var ran []string
+		plugin := &BackupPluginV2{
+			log:           logrus.New(),
+			dynamicClient: newFakeDynamicClient(),
+			podExec:       recordingPodExec(&ran),
+			config: &PluginConfig{BackupHooks: &BackupHooksConfig{
+				Pre:  []SQLHook{{SQL: "SELECT pause()"}},
+				Post: []SQLHook{{SQL: "SELECT resume()"}},
+			}},
+		}
+
+		_, _, _, _, err := plugin.Execute(newHookCluster(t), &v1.Backup{})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"SELECT pause()", "SELECT resume()"}, ran)
+	})
+
+	t.Run("failing post hook fails the item", func(t *testing.T) {
+		var ran []string
+		plugin := &BackupPluginV2{
+			log:           logrus.New(),
+			dynamicClient: newFakeDynamicClient(),
+			podExec:       recordingPodExec(&ran, "SELECT resume()"),
+			config:        &PluginConfig{BackupHooks: &BackupHooksConfig{Post: []SQLHook{{SQL: "SELECT resume()"}}}},
+		}
+
+		_, _, _, _, err := plugin.Execute(newHookCluster(t), &v1.Backup{})
+		assert.EqualError(t, err, "failed to run post hook 0: ERROR: boom")
+	})
+
+	t.Run("failing pre hook skips the post hooks", func(t *testing.T) {
+		var ran []string
+		plugin := &BackupPluginV2{
+			log:           logrus.New(),
+			dynamicClient: newFakeDynamicClient(),
+			podExec:       recordingPodExec(&ran, "SELECT pause()"),
+			config: &PluginConfig{BackupHooks: &BackupHooksConfig{
+				Pre:  []SQLHook{{SQL: "SELECT pause()"}},
+				Post: []SQLHook{{SQL: "SELECT resume()"}},
+			}},
+		}
+
+		_, _, _, _, err := plugin.Execute(newHookCluster(t), &v1.Backup{})
+		assert.EqualError(t, err, "failed to run pre hook 0: ERROR: boom")
+		assert.Equal(t, []string{"SELECT pause()"}, ran)
+	})
+}
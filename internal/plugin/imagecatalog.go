@@ -0,0 +1,43 @@
+package plugin
+
+import (
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// Group resources of the CNPG image catalogs a cluster can resolve its PostgreSQL image from
+var (
+	cnpgClusterImageCatalogResource = schema.GroupResource{Group: "postgresql.cnpg.io", Resource: "clusterimagecatalogs"}
+	cnpgImageCatalogResource        = schema.GroupResource{Group: "postgresql.cnpg.io", Resource: "imagecatalogs"}
+)
+
+// imageCatalogItem returns the image catalog referenced by the cluster's imageCatalogRef,
+// so it is backed up with the cluster: restored without it into a fresh cluster, the
+// operator cannot resolve the PostgreSQL image and never creates the instances.
+// ClusterImageCatalogs are cluster-scoped and would otherwise only be backed up when the
+// backup includes cluster-scoped resources.
+func (p *BackupPluginV2) imageCatalogItem(itemContent map[string]interface{}) (velero.ResourceIdentifier, bool) {
+	name, _, _ := unstructured.NestedString(itemContent, "spec", "imageCatalogRef", "name")
+	if name == "" {
+		return velero.ResourceIdentifier{}, false
+	}
+	if apiGroup, _, _ := unstructured.NestedString(itemContent, "spec", "imageCatalogRef", "apiGroup"); apiGroup != "" && apiGroup != cnpgClusterImageCatalogResource.Group {
+		p.log.Warnf("Cluster references image catalog %s of unknown API group %q, not backing it up", name, apiGroup)
+		return velero.ResourceIdentifier{}, false
+	}
+
+	kind, _, _ := unstructured.NestedString(itemContent, "spec", "imageCatalogRef", "kind")
+	switch kind {
+	case "ClusterImageCatalog":
+		p.log.Infof("Backing up ClusterImageCatalog %s referenced by the cluster", name)
+		return velero.ResourceIdentifier{GroupResource: cnpgClusterImageCatalogResource, Name: name}, true
+	case "ImageCatalog":
+		namespace := (&unstructured.Unstructured{Object: itemContent}).GetNamespace()
+		p.log.Infof("Backing up ImageCatalog %s/%s referenced by the cluster", namespace, name)
+		return velero.ResourceIdentifier{GroupResource: cnpgImageCatalogResource, Namespace: namespace, Name: name}, true
+	default:
+		p.log.Warnf("Cluster references image catalog %s of unknown kind %q, not backing it up", name, kind)
+		return velero.ResourceIdentifier{}, false
+	}
+}
@@ -0,0 +1,59 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestImageCatalogItem(t *testing.T) {
+	tests := []struct {
+		name     string
+		ref      map[string]interface{}
+		expected *velero.ResourceIdentifier
+	}{
+		{
+			name:     "ClusterImageCatalog",
+			ref:      map[string]interface{}{"apiGroup": "postgresql.cnpg.io", "kind": "ClusterImageCatalog", "name": "postgresql", "major": int64(16)},
+			expected: &velero.ResourceIdentifier{GroupResource: cnpgClusterImageCatalogResource, Name: "postgresql"},
+		},
+		{
+			name:     "ImageCatalog",
+			ref:      map[string]interface{}{"kind": "ImageCatalog", "name": "postgresql", "major": int64(16)},
+			expected: &velero.ResourceIdentifier{GroupResource: cnpgImageCatalogResource, Namespace: "default", Name: "postgresql"},
+		},
+		{
+			name: "unknown API group",
+			ref:  map[string]interface{}{"apiGroup": "example.com", "kind": "ClusterImageCatalog", "name": "postgresql"},
+		},
+		{
+			name: "unknown kind",
+			ref:  map[string]interface{}{"kind": "Catalog", "name": "postgresql"},
+		},
+		{
+			name: "no imageCatalogRef",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := createMockPluginCluster("pg", "default")
+			if tt.ref != nil {
+				require.NoError(t, unstructured.SetNestedField(cluster.Object, tt.ref, "spec", "imageCatalogRef"))
+			}
+
+			plugin := &BackupPluginV2{log: logrus.New()}
+			item, found := plugin.imageCatalogItem(cluster.Object)
+			if tt.expected == nil {
+				assert.False(t, found)
+				return
+			}
+			assert.True(t, found)
+			assert.Equal(t, *tt.expected, item)
+		})
+	}
+}
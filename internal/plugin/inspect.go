@@ -0,0 +1,246 @@
+package plugin
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	// archiveResourceDir is the directory of backed-up resources in a Velero backup archive
+	archiveResourceDir = "resources/"
+
+	// clusterResource is the resource of CNPG clusters
+	clusterResource = "clusters.postgresql.cnpg.io"
+
+	// cnpgGroupSuffix ends the resources of the CNPG API group
+	cnpgGroupSuffix = ".postgresql.cnpg.io"
+)
+
+// ClusterInspection describes a CNPG cluster found in a Velero backup archive and how the
+// restore action would handle it
+type ClusterInspection struct {
+	Namespace    string `json:"namespace"`
+	Name         string `json:"name"`
+	BackupMethod string `json:"backupMethod,omitempty"`
+	ServerName   string `json:"serverName,omitempty"`
+	BackupID     string `json:"backupID,omitempty"`
+	Schedule     string `json:"schedule,omitempty"`
+	BackupTTL    string `json:"backupTTL,omitempty"`
+	SkipReason   string `json:"skipReason,omitempty"`
+
+	// Instances, DatabaseSize and WALRate are the size metrics recorded at backup time,
+	// with the size in bytes and the rate in bytes per second
+	Instances    int64 `json:"instances,omitempty"`
+	DatabaseSize int64 `json:"databaseSize,omitempty"`
+	WALRate      int64 `json:"walRate,omitempty"`
+
+	// Restorable is true when the restore action configures recovery for the cluster
+	Restorable bool `json:"restorable"`
+
+	// Problems explains why the cluster is not restorable
+	Problems []string `json:"problems,omitempty"`
+
+	// Warnings are restore warnings the cluster would get in recovery mode
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// InspectBackupArchive reads a gzipped Velero backup archive, as written by velero backup
+// download, and inspects every CNPG cluster in it
+func InspectBackupArchive(r io.Reader) ([]*ClusterInspection, error) {
+	clusters, err := ReadArchiveClusters(r)
+	if err != nil {
+		return nil, err
+	}
+
+	inspections := make([]*ClusterInspection, 0, len(clusters))
+	for _, cluster := range clusters {
+		inspections = append(inspections, InspectCluster(cluster))
+	}
+	return inspections, nil
+}
+
+// ReadArchiveClusters returns the CNPG clusters of a gzipped Velero backup archive, sorted
+// by namespace and name. Clusters stored under several API versions are returned once.
+func ReadArchiveClusters(r io.Reader) ([]*unstructured.Unstructured, error) {
+	return readArchiveItems(r, func(resource string) bool { return resource == clusterResource })
+}
+
+// ReadArchiveCNPGItems returns the namespaced items of the CNPG API group in a gzipped
+// Velero backup archive, such as clusters, poolers and scheduled backups, sorted by
+// kind, namespace and name
+func ReadArchiveCNPGItems(r io.Reader) ([]*unstructured.Unstructured, error) {
+	return readArchiveItems(r, func(resource string) bool { return strings.HasSuffix(resource, cnpgGroupSuffix) })
+}
+
+// readArchiveItems returns the namespaced items of the resources selected by include.
+// Items stored under several API versions are returned once.
+func readArchiveItems(r io.Reader, include func(resource string) bool) ([]*unstructured.Unstructured, error) {
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read backup archive")
+	}
+	defer gzipReader.Close()
+
+	seen := map[string]bool{}
+	var items []*unstructured.Unstructured
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read backup archive")
+		}
+
+		resource, namespace, name, ok := archiveItemPath(header.Name)
+		key := resource + "/" + namespace + "/" + name
+		if !ok || header.Typeflag != tar.TypeReg || !include(resource) || seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		item := &unstructured.Unstructured{}
+		if err := json.NewDecoder(tarReader).Decode(&item.Object); err != nil {
+			return nil, errors.Wrapf(err, "failed to decode %s", header.Name)
+		}
+		items = append(items, item)
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].GetKind() != items[j].GetKind() {
+			return items[i].GetKind() < items[j].GetKind()
+		}
+		if items[i].GetNamespace() != items[j].GetNamespace() {
+			return items[i].GetNamespace() < items[j].GetNamespace()
+		}
+		return items[i].GetName() < items[j].GetName()
+	})
+	return items, nil
+}
+
+// archiveItemPath returns the resource, namespace and name of a namespaced item stored at
+// the given archive path, either resources/<resource>/namespaces/<ns>/<name>.json or the
+// same below a version directory such as v1-preferredversion
+func archiveItemPath(name string) (string, string, string, bool) {
+	rest, found := strings.CutPrefix(path.Clean(name), archiveResourceDir)
+	if !found || path.Ext(rest) != ".json" {
+		return "", "", "", false
+	}
+
+	parts := strings.Split(rest, "/")
+	if len(parts) == 5 {
+		parts = append(parts[:1], parts[2:]...)
+	}
+	if len(parts) != 4 || parts[1] != "namespaces" {
+		return "", "", "", false
+	}
+	return parts[0], parts[2], strings.TrimSuffix(parts[3], ".json"), true
+}
+
+// InspectCluster reports whether the restore action configures recovery for a backed-up
+// cluster in recovery mode, applying the same checks to its annotations and spec
+func InspectCluster(cluster *unstructured.Unstructured) *ClusterInspection {
+	inspection := &ClusterInspection{
+		Namespace: cluster.GetNamespace(),
+		Name:      cluster.GetName(),
+	}
+	problem := func(format string, args ...interface{}) {
+		inspection.Problems = append(inspection.Problems, fmt.Sprintf(format, args...))
+	}
+	warn := func(format string, args ...interface{}) {
+		inspection.Warnings = append(inspection.Warnings, fmt.Sprintf(format, args...))
+	}
+
+	// Judge the annotations as the restore action sees them, after migrating older schemas
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	p := &RestorePluginV2{log: log}
+	itemContent := cluster.DeepCopy().Object
+	if err := p.migrateAnnotations(itemContent); err != nil {
+		problem("%v", err)
+		return inspection
+	}
+	annotations := (&unstructured.Unstructured{Object: itemContent}).GetAnnotations()
+
+	inspection.BackupMethod = annotations[AnnotationBackupMethod]
+	inspection.ServerName = annotations[AnnotationServerName]
+	inspection.BackupID = annotations[AnnotationCurrentBackupID]
+	inspection.Schedule = annotations[AnnotationVeleroSchedule]
+	inspection.BackupTTL = annotations[AnnotationBackupTTL]
+	inspection.SkipReason = annotations[AnnotationSkipReason]
+
+	for _, metric := range []struct {
+		annotation string
+		value      *int64
+	}{
+		{AnnotationInstances, &inspection.Instances},
+		{AnnotationDatabaseSize, &inspection.DatabaseSize},
+		{AnnotationWALRate, &inspection.WALRate},
+	} {
+		value, found := annotations[metric.annotation]
+		if !found {
+			continue
+		}
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 0 {
+			warn("invalid %s annotation %q", metric.annotation, value)
+			continue
+		}
+		*metric.value = parsed
+	}
+
+	if skipRestore(cluster) {
+		problem("%s is set, the cluster is left out of restores", AnnotationSkipRestore)
+	}
+	if phase := annotations[AnnotationBackupPhase]; phase != "" {
+		warn("cluster was in phase %q when backed up", phase)
+	}
+	if isHibernated(itemContent) {
+		warn("cluster was hibernated when backed up and is restored hibernated unless resumeHibernatedClusters is set")
+	}
+
+	switch inspection.BackupMethod {
+	case "":
+		problem("no %s annotation, the cluster was not backed up by the plugin and is restored without recovery", AnnotationBackupMethod)
+	case BackupMethodPlugin:
+		if _, err := p.extractBarmanObjectName(itemContent); err != nil && annotations[AnnotationBarmanObjectName] == "" {
+			problem("no barmanObjectName in the plugin parameters: %v", err)
+		}
+	case BackupMethodBarmanObjectStore:
+		if _, found, _ := unstructured.NestedMap(itemContent, "spec", "backup", "barmanObjectStore"); !found {
+			problem("backup method %s but no spec.backup.barmanObjectStore", BackupMethodBarmanObjectStore)
+		}
+	case BackupMethodVolumeSnapshot:
+		value, found := annotations[AnnotationVolumeSnapshots]
+		if !found {
+			problem("backup method %s requires the %s annotation", BackupMethodVolumeSnapshot, AnnotationVolumeSnapshots)
+		} else if _, err := decodeVolumeSnapshots(value); err != nil {
+			problem("invalid %s annotation: %v", AnnotationVolumeSnapshots, err)
+		}
+	default:
+		problem("unknown backup method %q", inspection.BackupMethod)
+	}
+
+	if inspection.BackupMethod != "" && inspection.BackupMethod != BackupMethodVolumeSnapshot && inspection.BackupID == "" {
+		if inspection.SkipReason != "" {
+			warn("no %s annotation (%s), recovery uses the latest backup in the object store", AnnotationCurrentBackupID, inspection.SkipReason)
+		} else {
+			warn("no %s annotation, recovery uses the latest backup in the object store", AnnotationCurrentBackupID)
+		}
+	}
+
+	inspection.Restorable = len(inspection.Problems) == 0
+	return inspection
+}
@@ -0,0 +1,193 @@
+package plugin
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// createBackupArchive returns a gzipped tar archive holding the given files
+func createBackupArchive(t *testing.T, files map[string]interface{}) *bytes.Buffer {
+	var buffer bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buffer)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for name, content := range files {
+		raw, err := json.Marshal(content)
+		require.NoError(t, err)
+		require.NoError(t, tarWriter.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(raw)), Typeflag: tar.TypeReg}))
+		_, err = tarWriter.Write(raw)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tarWriter.Close())
+	require.NoError(t, gzipWriter.Close())
+	return &buffer
+}
+
+// annotatedCluster returns a cluster backed up by the plugin with the given annotations
+func annotatedCluster(name, namespace string, annotations map[string]string) *unstructured.Unstructured {
+	cluster := createMockPluginCluster(name, namespace)
+	cluster.SetAnnotations(annotations)
+	return cluster
+}
+
+func TestInspectBackupArchive(t *testing.T) {
+	backedUp := annotatedCluster("pg", "app", map[string]string{
+		AnnotationSchemaVersion:   strconv.Itoa(CurrentSchemaVersion),
+		AnnotationServerName:      "pg",
+		AnnotationBackupMethod:    BackupMethodPlugin,
+		AnnotationCurrentBackupID: "20241024T120000",
+		AnnotationVeleroSchedule:  "nightly",
+		AnnotationBackupTTL:       "720h0m0s",
+	})
+	unmanaged := createMockPluginCluster("legacy", "app")
+
+	archive := createBackupArchive(t, map[string]interface{}{
+		"metadata/version": "1.1.0",
+		"resources/clusters.postgresql.cnpg.io/namespaces/app/pg.json":                         backedUp.Object,
+		"resources/clusters.postgresql.cnpg.io/v1-preferredversion/namespaces/app/pg.json":     backedUp.Object,
+		"resources/clusters.postgresql.cnpg.io/v1-preferredversion/namespaces/app/legacy.json": unmanaged.Object,
+		"resources/backups.postgresql.cnpg.io/namespaces/app/pg-backup.json":                   map[string]interface{}{},
+	})
+
+	inspections, err := InspectBackupArchive(archive)
+	require.NoError(t, err)
+	require.Len(t, inspections, 2)
+
+	assert.Equal(t, "legacy", inspections[0].Name)
+	assert.False(t, inspections[0].Restorable)
+	assert.Contains(t, inspections[0].Problems[0], AnnotationBackupMethod)
+
+	assert.Equal(t, &ClusterInspection{
+		Namespace:    "app",
+		Name:         "pg",
+		BackupMethod: BackupMethodPlugin,
+		ServerName:   "pg",
+		BackupID:     "20241024T120000",
+		Schedule:     "nightly",
+		BackupTTL:    "720h0m0s",
+		Restorable:   true,
+	}, inspections[1])
+
+	_, err = InspectBackupArchive(bytes.NewBufferString("not an archive"))
+	assert.Error(t, err)
+}
+
+func TestArchiveItemPath(t *testing.T) {
+	tests := []struct {
+		path      string
+		resource  string
+		namespace string
+		name      string
+		ok        bool
+	}{
+		{path: "resources/clusters.postgresql.cnpg.io/namespaces/app/pg.json", resource: clusterResource, namespace: "app", name: "pg", ok: true},
+		{path: "resources/clusters.postgresql.cnpg.io/v1-preferredversion/namespaces/app/pg.json", resource: clusterResource, namespace: "app", name: "pg", ok: true},
+		{path: "resources/poolers.postgresql.cnpg.io/namespaces/app/pg-rw.json", resource: "poolers.postgresql.cnpg.io", namespace: "app", name: "pg-rw", ok: true},
+		{path: "resources/clusters.postgresql.cnpg.io/v1-preferredversion/cluster/pg.json"},
+		{path: "resources/clusters.postgresql.cnpg.io/namespaces/app/pg.yaml"},
+		{path: "metadata/version"},
+	}
+
+	for _, tt := range tests {
+		resource, namespace, name, ok := archiveItemPath(tt.path)
+		assert.Equal(t, tt.ok, ok, tt.path)
+		assert.Equal(t, tt.resource, resource, tt.path)
+		assert.Equal(t, tt.namespace, namespace, tt.path)
+		assert.Equal(t, tt.name, name, tt.path)
+	}
+}
+
+func TestInspectCluster(t *testing.T) {
+	tests := []struct {
+		name             string
+		annotations      map[string]string
+		expectRestorable bool
+		expectedProblem  string
+		expectedWarning  string
+	}{
+		{
+			name:             "no backup ID",
+			annotations:      map[string]string{AnnotationServerName: "pg", AnnotationBackupMethod: BackupMethodPlugin},
+			expectRestorable: true,
+			expectedWarning:  AnnotationCurrentBackupID,
+		},
+		{
+			name:             "no backup ID with a skip reason",
+			annotations:      map[string]string{AnnotationServerName: "pg", AnnotationBackupMethod: BackupMethodPlugin, AnnotationSkipReason: SkipReasonArchivingFailing},
+			expectRestorable: true,
+			expectedWarning:  "(archiving-failing)",
+		},
+		{
+			name:            "skipped",
+			annotations:     map[string]string{AnnotationBackupMethod: BackupMethodPlugin, AnnotationCurrentBackupID: "id", AnnotationSkipRestore: "true"},
+			expectedProblem: AnnotationSkipRestore,
+		},
+		{
+			name:            "volume snapshots without annotation",
+			annotations:     map[string]string{AnnotationBackupMethod: BackupMethodVolumeSnapshot},
+			expectedProblem: AnnotationVolumeSnapshots,
+		},
+		{
+			name:            "newer schema",
+			annotations:     map[string]string{AnnotationSchemaVersion: strconv.Itoa(CurrentSchemaVersion + 1), AnnotationBackupMethod: BackupMethodPlugin},
+			expectedProblem: "this plugin supports up to",
+		},
+		{
+			name:            "unknown method",
+			annotations:     map[string]string{AnnotationBackupMethod: "tape"},
+			expectedProblem: `unknown backup method "tape"`,
+		},
+		{
+			name:             "unhealthy at backup time",
+			annotations:      map[string]string{AnnotationBackupMethod: BackupMethodPlugin, AnnotationCurrentBackupID: "id", AnnotationBackupPhase: "Setting up primary"},
+			expectRestorable: true,
+			expectedWarning:  "Setting up primary",
+		},
+		{
+			name:             "invalid size metric",
+			annotations:      map[string]string{AnnotationBackupMethod: BackupMethodPlugin, AnnotationCurrentBackupID: "id", AnnotationInstances: "3", AnnotationDatabaseSize: "large"},
+			expectRestorable: true,
+			expectedWarning:  AnnotationDatabaseSize,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inspection := InspectCluster(annotatedCluster("pg", "app", tt.annotations))
+
+			assert.Equal(t, tt.expectRestorable, inspection.Restorable)
+			if tt.expectedProblem != "" {
+				require.Len(t, inspection.Problems, 1)
+				assert.Contains(t, inspection.Problems[0], tt.expectedProblem)
+			} else {
+				assert.Empty(t, inspection.Problems)
+			}
+			if tt.expectedWarning != "" {
+				require.Len(t, inspection.Warnings, 1)
+				assert.Contains(t, inspection.Warnings[0], tt.expectedWarning)
+			}
+		})
+	}
+}
+
+func TestInspectClusterSizeMetrics(t *testing.T) {
+	inspection := InspectCluster(annotatedCluster("pg", "app", map[string]string{
+		AnnotationBackupMethod:    BackupMethodPlugin,
+		AnnotationCurrentBackupID: "id",
+		AnnotationInstances:       "3",
+		AnnotationDatabaseSize:    "1610612736",
+		AnnotationWALRate:         "2048",
+	}))
+
+	assert.Empty(t, inspection.Warnings)
+	assert.Equal(t, int64(3), inspection.Instances)
+	assert.Equal(t, int64(1610612736), inspection.DatabaseSize)
+	assert.Equal(t, int64(2048), inspection.WALRate)
+}
@@ -0,0 +1,130 @@
+package plugin
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// AnnotationIntegrity is the annotation key used to store a digest of the plugin's other
+// annotations at backup time, as <algorithm>:<hex digest>
+const AnnotationIntegrity = "velero-cnpg/integrity"
+
+// EnvIntegrityKey is the environment variable holding the key the annotation digest is an
+// HMAC with. Without it the digest is a plain SHA-256, which catches accidental changes only.
+const EnvIntegrityKey = "VELERO_CNPG_INTEGRITY_KEY"
+
+const (
+	// integritySHA256 is the algorithm of digests computed without a key
+	integritySHA256 = "sha256"
+
+	// integrityHMACSHA256 is the algorithm of digests computed with EnvIntegrityKey
+	integrityHMACSHA256 = "hmac-sha256"
+)
+
+// annotationsDigest returns the digest of the velero-cnpg/ annotations other than the
+// digest itself and the result annotation written after it, as <algorithm>:<hex digest>.
+// The annotations are encoded as a JSON object, whose keys encoding/json sorts.
+func annotationsDigest(annotations map[string]string, key []byte) (string, error) {
+	raw, err := json.Marshal(coveredAnnotations(annotations))
+	if err != nil {
+		return "", errors.Wrap(err, "failed to encode annotations")
+	}
+
+	if len(key) == 0 {
+		sum := sha256.Sum256(raw)
+		return integritySHA256 + ":" + hex.EncodeToString(sum[:]), nil
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(raw)
+	return integrityHMACSHA256 + ":" + hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// coveredAnnotations returns the annotations the integrity digest covers
+func coveredAnnotations(annotations map[string]string) map[string]string {
+	covered := map[string]string{}
+	for name, value := range annotations {
+		if strings.HasPrefix(name, annotationPrefix) && name != AnnotationIntegrity && name != AnnotationResult {
+			covered[name] = value
+		}
+	}
+	return covered
+}
+
+// annotateIntegrity records the digest of the plugin's annotations. It must run after
+// every other annotation is written. Failing to compute it is logged rather than failing
+// the backup.
+func (p *BackupPluginV2) annotateIntegrity(itemContent map[string]interface{}) {
+	digest, err := annotationsDigest((&unstructured.Unstructured{Object: itemContent}).GetAnnotations(), []byte(os.Getenv(EnvIntegrityKey)))
+	if err == nil {
+		err = p.addAnnotation(itemContent, AnnotationIntegrity, digest)
+	}
+	if err != nil {
+		p.log.Warnf("Failed to annotate integrity digest: %v", err)
+	}
+}
+
+// verifyIntegrity compares the plugin's annotations of the restored item with the digest
+// recorded at backup time, so edits to the backed-up manifest that would change the
+// recovery source are caught before they are acted on. A mismatch fails the restore of
+// the cluster, or is reported as a restore warning with the warn policy. With a key set,
+// plugin annotations without a digest are a mismatch too, since removing the digest would
+// otherwise bypass the check, unless their schema version predates the digest. The digest
+// is removed afterwards, since the restore changes the annotations it covers.
+func (p *RestorePluginV2) verifyIntegrity(itemContent map[string]interface{}, policy string, warnings *restoreWarnings) error {
+	recorded, found, err := p.getAnnotation(itemContent, AnnotationIntegrity)
+	if err != nil {
+		return err
+	}
+	unstructured.RemoveNestedField(itemContent, "metadata", "annotations", AnnotationIntegrity)
+
+	algorithm, _, _ := strings.Cut(recorded, ":")
+	key := []byte(os.Getenv(EnvIntegrityKey))
+	covered := coveredAnnotations((&unstructured.Unstructured{Object: itemContent}).GetAnnotations())
+
+	var mismatch error
+	switch {
+	case !found && (len(key) == 0 || len(covered) == 0):
+		p.log.Infof("No %s annotation found, skipping annotation integrity check", AnnotationIntegrity)
+		return nil
+	case !found:
+		version, err := annotationSchemaVersion(stringMapToInterfaces(covered))
+		if err != nil {
+			mismatch = err
+			break
+		}
+		if version < SchemaVersionIntegrity {
+			warnings.Warnf("The plugin annotations have annotation schema version %d, which predates %s, skipping annotation integrity check", version, AnnotationIntegrity)
+			return nil
+		}
+		mismatch = errors.Errorf("the plugin annotations have no %s annotation although %s is set, so they cannot be trusted", AnnotationIntegrity, EnvIntegrityKey)
+	case algorithm == integrityHMACSHA256 && len(key) == 0:
+		warnings.Warnf("Annotation digest is an HMAC but %s is not set, skipping annotation integrity check", EnvIntegrityKey)
+		return nil
+	case algorithm == integritySHA256 && len(key) > 0:
+		mismatch = errors.Errorf("the %s annotation is not an HMAC with %s, so the plugin annotations cannot be trusted", AnnotationIntegrity, EnvIntegrityKey)
+	case algorithm != integritySHA256 && algorithm != integrityHMACSHA256:
+		mismatch = errors.Errorf("unknown %s algorithm %q", AnnotationIntegrity, algorithm)
+	default:
+		current, err := annotationsDigest((&unstructured.Unstructured{Object: itemContent}).GetAnnotations(), key)
+		if err != nil {
+			return err
+		}
+		if hmac.Equal([]byte(current), []byte(recorded)) {
+			return nil
+		}
+		mismatch = errors.New("the plugin annotations differ from the ones recorded at backup time, the backed-up manifest was modified and may recover from the wrong source")
+	}
+
+	if policy == IntegrityWarn {
+		warnings.Warnf("Annotation integrity check failed: %v", mismatch)
+		return nil
+	}
+	return errors.Wrapf(mismatch, "annotation integrity check failed (integrityPolicy is %s)", IntegrityFail)
+}
@@ -0,0 +1,122 @@
+package plugin
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnnotationsDigest(t *testing.T) {
+	annotations := map[string]string{
+		AnnotationServerName:   "pg",
+		AnnotationBackupMethod: BackupMethodPlugin,
+		"example.com/owner":    "team-a",
+	}
+
+	digest, err := annotationsDigest(annotations, nil)
+	require.NoError(t, err)
+	assert.Regexp(t, `^sha256:[0-9a-f]{64}$`, digest)
+
+	// Other annotations and the digest itself are not covered
+	annotations["example.com/owner"] = "team-b"
+	annotations[AnnotationIntegrity] = digest
+	unchanged, err := annotationsDigest(annotations, nil)
+	require.NoError(t, err)
+	assert.Equal(t, digest, unchanged)
+
+	annotations[AnnotationServerName] = "pg-other"
+	changed, err := annotationsDigest(annotations, nil)
+	require.NoError(t, err)
+	assert.NotEqual(t, digest, changed)
+
+	signed, err := annotationsDigest(annotations, []byte("secret"))
+	require.NoError(t, err)
+	assert.Regexp(t, `^hmac-sha256:[0-9a-f]{64}$`, signed)
+	otherKey, err := annotationsDigest(annotations, []byte("other"))
+	require.NoError(t, err)
+	assert.NotEqual(t, signed, otherKey)
+}
+
+func TestVerifyIntegrity(t *testing.T) {
+	tests := []struct {
+		name          string
+		backupKey     string
+		restoreKey    string
+		policy        string
+		noDigest      bool
+		noAnnotations bool
+		schemaVersion int
+		modify        bool
+		algorithm     string
+		expectedError string
+		expectWarning string
+	}{
+		{name: "unchanged"},
+		{name: "unchanged with key", backupKey: "secret", restoreKey: "secret"},
+		{name: "no digest", noDigest: true},
+		{name: "no digest with key", noDigest: true, restoreKey: "secret", expectedError: "have no velero-cnpg/integrity annotation"},
+		{name: "no digest with key and warn policy", noDigest: true, restoreKey: "secret", policy: IntegrityWarn, expectWarning: "have no velero-cnpg/integrity annotation"},
+		{name: "no digest with key before the digest existed", noDigest: true, restoreKey: "secret", schemaVersion: SchemaVersionBackupMethod, expectWarning: "schema version 2, which predates velero-cnpg/integrity"},
+		{name: "no digest with key before the schema version existed", noDigest: true, restoreKey: "secret", schemaVersion: SchemaVersionInitial, expectWarning: "schema version 1, which predates velero-cnpg/integrity"},
+		{name: "no plugin annotations with key", noDigest: true, noAnnotations: true, restoreKey: "secret"},
+		{name: "modified", modify: true, expectedError: "differ from the ones recorded"},
+		{name: "modified with warn policy", modify: true, policy: IntegrityWarn, expectWarning: "differ from the ones recorded"},
+		{name: "other key", backupKey: "secret", restoreKey: "other", expectedError: "differ from the ones recorded"},
+		{name: "HMAC without key", backupKey: "secret", expectWarning: EnvIntegrityKey},
+		{name: "unsigned with key", restoreKey: "secret", expectedError: "is not an HMAC"},
+		{name: "unknown algorithm", algorithm: "md5:abc", expectedError: `unknown velero-cnpg/integrity algorithm "md5"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			annotations := map[string]string{
+				AnnotationServerName:    "pg",
+				AnnotationBackupMethod:  BackupMethodPlugin,
+				AnnotationSchemaVersion: strconv.Itoa(CurrentSchemaVersion),
+			}
+			if tt.schemaVersion == SchemaVersionInitial {
+				// The initial schema has no version annotation
+				delete(annotations, AnnotationSchemaVersion)
+			} else if tt.schemaVersion != 0 {
+				annotations[AnnotationSchemaVersion] = strconv.Itoa(tt.schemaVersion)
+			}
+			cluster := annotatedCluster("pg", "default", annotations)
+			if tt.noAnnotations {
+				cluster.SetAnnotations(map[string]string{"example.com/owner": "team-a"})
+			}
+
+			t.Setenv(EnvIntegrityKey, tt.backupKey)
+			if !tt.noDigest {
+				(&BackupPluginV2{log: logrus.New()}).annotateIntegrity(cluster.Object)
+			}
+			if tt.algorithm != "" {
+				require.NoError(t, (&BackupPluginV2{log: logrus.New()}).addAnnotation(cluster.Object, AnnotationIntegrity, tt.algorithm))
+			}
+			if tt.modify {
+				annotations := cluster.GetAnnotations()
+				annotations[AnnotationServerName] = "pg-other"
+				cluster.SetAnnotations(annotations)
+			}
+
+			t.Setenv(EnvIntegrityKey, tt.restoreKey)
+			warnings := &restoreWarnings{log: logrus.New()}
+			err := (&RestorePluginV2{log: logrus.New()}).verifyIntegrity(cluster.Object, tt.policy, warnings)
+			if tt.expectedError != "" {
+				assert.ErrorContains(t, err, tt.expectedError)
+				return
+			}
+			require.NoError(t, err)
+
+			if tt.expectWarning != "" {
+				require.Len(t, warnings.messages, 1)
+				assert.Contains(t, warnings.messages[0], tt.expectWarning)
+			} else {
+				assert.Empty(t, warnings.messages)
+			}
+			assert.NotContains(t, cluster.GetAnnotations(), AnnotationIntegrity)
+		})
+	}
+}
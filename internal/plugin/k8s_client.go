@@ -1,14 +1,64 @@
 package plugin
 
 import (
+	"net"
+	"os"
+	"sync"
+
 	"github.com/pkg/errors"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
-// GetClient creates a Kubernetes clientset using kubeconfig
-func GetClient() (*kubernetes.Clientset, error) {
+const (
+	// EnvKubeconfig is the environment variable holding the path of a kubeconfig the
+	// plugin authenticates with instead of Velero's identity
+	EnvKubeconfig = "VELERO_CNPG_KUBECONFIG"
+
+	// EnvTokenFile is the environment variable holding the path of a ServiceAccount token,
+	// such as a projected token, the plugin authenticates with against the in-cluster API
+	// server instead of Velero's identity
+	EnvTokenFile = "VELERO_CNPG_TOKEN_FILE"
+
+	// EnvCAFile is the environment variable holding the path of the CA bundle used with
+	// EnvTokenFile. It defaults to the CA of the pod's ServiceAccount.
+	EnvCAFile = "VELERO_CNPG_CA_FILE"
+)
+
+// clients caches the clients of the plugin process. Velero calls the actions once per
+// item, and building a client for every call re-reads the kubeconfig and sets up a new
+// transport. Errors are not cached, so a failed call is retried on the next item.
+var clients struct {
+	sync.Mutex
+	client        *kubernetes.Clientset
+	dynamicClient dynamic.Interface
+}
+
+// serviceAccountCAFile is the CA bundle mounted with the pod's ServiceAccount
+const serviceAccountCAFile = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+
+// restConfig returns the client configuration for plugin API calls. A kubeconfig or
+// token configured for the plugin takes precedence over the default loading rules, so
+// the plugin's access can be scoped separately from Velero's.
+func restConfig() (*rest.Config, error) {
+	kubeconfigPath := os.Getenv(EnvKubeconfig)
+	tokenFile := os.Getenv(EnvTokenFile)
+
+	switch {
+	case kubeconfigPath != "" && tokenFile != "":
+		return nil, errors.Errorf("only one of %s and %s can be set", EnvKubeconfig, EnvTokenFile)
+	case kubeconfigPath != "":
+		clientConfig, err := clientcmd.BuildConfigFromFlags("", kubeconfigPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load kubeconfig %s", kubeconfigPath)
+		}
+		return clientConfig, nil
+	case tokenFile != "":
+		return tokenFileConfig(tokenFile)
+	}
+
 	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
 	configOverrides := &clientcmd.ConfigOverrides{}
 	kubeConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, configOverrides)
@@ -17,28 +67,78 @@ func GetClient() (*kubernetes.Clientset, error) {
 		return nil, errors.WithStack(err)
 	}
 
+	return clientConfig, nil
+}
+
+// tokenFileConfig returns an in-cluster configuration authenticating with the token in
+// tokenFile. The token is re-read as it rotates.
+func tokenFileConfig(tokenFile string) (*rest.Config, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.Errorf("%s requires running in a cluster", EnvTokenFile)
+	}
+
+	if _, err := os.Stat(tokenFile); err != nil {
+		return nil, errors.Wrapf(err, "failed to read token file %s", tokenFile)
+	}
+
+	caFile := os.Getenv(EnvCAFile)
+	if caFile == "" {
+		caFile = serviceAccountCAFile
+	}
+
+	return &rest.Config{
+		Host:            "https://" + net.JoinHostPort(host, port),
+		BearerTokenFile: tokenFile,
+		TLSClientConfig: rest.TLSClientConfig{CAFile: caFile},
+	}, nil
+}
+
+// GetClient returns the Kubernetes clientset of the plugin process
+func GetClient() (*kubernetes.Clientset, error) {
+	clients.Lock()
+	defer clients.Unlock()
+
+	if clients.client != nil {
+		return clients.client, nil
+	}
+
+	clientConfig, err := restConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	injectFaults(clientConfig)
 	client, err := kubernetes.NewForConfig(clientConfig)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
+	clients.client = client
 	return client, nil
 }
 
-// GetDynamicClient creates a dynamic Kubernetes client for working with CRDs
+// GetDynamicClient returns the dynamic Kubernetes client of the plugin process, used for
+// working with CRDs
 func GetDynamicClient() (dynamic.Interface, error) {
-	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
-	configOverrides := &clientcmd.ConfigOverrides{}
-	kubeConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, configOverrides)
-	clientConfig, err := kubeConfig.ClientConfig()
+	clients.Lock()
+	defer clients.Unlock()
+
+	if clients.dynamicClient != nil {
+		return clients.dynamicClient, nil
+	}
+
+	clientConfig, err := restConfig()
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return nil, err
 	}
 
+	injectFaults(clientConfig)
 	dynamicClient, err := dynamic.NewForConfig(clientConfig)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
+	clients.dynamicClient = dynamicClient
 	return dynamicClient, nil
 }
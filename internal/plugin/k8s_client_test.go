@@ -0,0 +1,135 @@
+package plugin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: dr
+  cluster:
+    server: https://dr.example.com:6443
+users:
+- name: cnpg-plugin
+  user:
+    token: plugin-token
+contexts:
+- name: dr
+  context:
+    cluster: dr
+    user: cnpg-plugin
+current-context: dr
+`
+
+func TestRestConfig(t *testing.T) {
+	dir := t.TempDir()
+	kubeconfigPath := filepath.Join(dir, "kubeconfig")
+	require.NoError(t, os.WriteFile(kubeconfigPath, []byte(testKubeconfig), 0o600))
+	tokenFile := filepath.Join(dir, "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("projected-token"), 0o600))
+
+	t.Run("kubeconfig", func(t *testing.T) {
+		t.Setenv(EnvKubeconfig, kubeconfigPath)
+		t.Setenv(EnvTokenFile, "")
+
+		config, err := restConfig()
+		require.NoError(t, err)
+		assert.Equal(t, "https://dr.example.com:6443", config.Host)
+		assert.Equal(t, "plugin-token", config.BearerToken)
+	})
+
+	t.Run("missing kubeconfig", func(t *testing.T) {
+		t.Setenv(EnvKubeconfig, filepath.Join(dir, "missing"))
+		t.Setenv(EnvTokenFile, "")
+
+		_, err := restConfig()
+		assert.ErrorContains(t, err, "failed to load kubeconfig")
+	})
+
+	t.Run("token file", func(t *testing.T) {
+		t.Setenv(EnvKubeconfig, "")
+		t.Setenv(EnvTokenFile, tokenFile)
+		t.Setenv(EnvCAFile, "")
+		t.Setenv("KUBERNETES_SERVICE_HOST", "10.0.0.1")
+		t.Setenv("KUBERNETES_SERVICE_PORT", "443")
+
+		config, err := restConfig()
+		require.NoError(t, err)
+		assert.Equal(t, "https://10.0.0.1:443", config.Host)
+		assert.Equal(t, tokenFile, config.BearerTokenFile)
+		assert.Equal(t, serviceAccountCAFile, config.TLSClientConfig.CAFile)
+	})
+
+	t.Run("token file with CA", func(t *testing.T) {
+		t.Setenv(EnvKubeconfig, "")
+		t.Setenv(EnvTokenFile, tokenFile)
+		t.Setenv(EnvCAFile, "/etc/plugin/ca.crt")
+		t.Setenv("KUBERNETES_SERVICE_HOST", "10.0.0.1")
+		t.Setenv("KUBERNETES_SERVICE_PORT", "443")
+
+		config, err := restConfig()
+		require.NoError(t, err)
+		assert.Equal(t, "/etc/plugin/ca.crt", config.TLSClientConfig.CAFile)
+	})
+
+	t.Run("token file outside a cluster", func(t *testing.T) {
+		t.Setenv(EnvKubeconfig, "")
+		t.Setenv(EnvTokenFile, tokenFile)
+		t.Setenv("KUBERNETES_SERVICE_HOST", "")
+
+		_, err := restConfig()
+		assert.ErrorContains(t, err, "requires running in a cluster")
+	})
+
+	t.Run("missing token file", func(t *testing.T) {
+		t.Setenv(EnvKubeconfig, "")
+		t.Setenv(EnvTokenFile, filepath.Join(dir, "missing"))
+		t.Setenv("KUBERNETES_SERVICE_HOST", "10.0.0.1")
+		t.Setenv("KUBERNETES_SERVICE_PORT", "443")
+
+		_, err := restConfig()
+		assert.ErrorContains(t, err, "failed to read token file")
+	})
+
+	t.Run("both set", func(t *testing.T) {
+		t.Setenv(EnvKubeconfig, kubeconfigPath)
+		t.Setenv(EnvTokenFile, tokenFile)
+
+		_, err := restConfig()
+		assert.ErrorContains(t, err, "only one of")
+	})
+}
+
+func TestClientsAreCached(t *testing.T) {
+	kubeconfigPath := filepath.Join(t.TempDir(), "kubeconfig")
+	require.NoError(t, os.WriteFile(kubeconfigPath, []byte(testKubeconfig), 0o600))
+	t.Setenv(EnvKubeconfig, kubeconfigPath)
+	t.Setenv(EnvTokenFile, "")
+
+	resetClients := func() {
+		clients.Lock()
+		defer clients.Unlock()
+		clients.client = nil
+		clients.dynamicClient = nil
+	}
+	resetClients()
+	t.Cleanup(resetClients)
+
+	client, err := GetClient()
+	require.NoError(t, err)
+	again, err := GetClient()
+	require.NoError(t, err)
+	assert.Same(t, client, again)
+
+	dynamicClient, err := GetDynamicClient()
+	require.NoError(t, err)
+	dynamicAgain, err := GetDynamicClient()
+	require.NoError(t, err)
+	assert.Same(t, dynamicClient, dynamicAgain)
+}
@@ -0,0 +1,102 @@
+package plugin
+
+import (
+	"context"
+	"os"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// EnvMaxConcurrentBackupLists is the environment variable limiting how many CNPG
+	// Backup list calls the plugin makes at the same time
+	EnvMaxConcurrentBackupLists = "VELERO_CNPG_MAX_CONCURRENT_BACKUP_LISTS"
+
+	// EnvBackupListQPS is the environment variable limiting the rate of CNPG Backup list
+	// calls, in calls per second. 0 removes the rate limit.
+	EnvBackupListQPS = "VELERO_CNPG_BACKUP_LIST_QPS"
+)
+
+const (
+	// defaultMaxConcurrentBackupLists is the default of EnvMaxConcurrentBackupLists
+	defaultMaxConcurrentBackupLists = 4
+
+	// defaultBackupListQPS is the default of EnvBackupListQPS
+	defaultBackupListQPS = 5
+)
+
+// backupListLimiter is shared by all actions of the plugin process, so Velero's parallel
+// item backups cannot fan out Backup list calls beyond the configured limits
+var backupListLimiter = newAPILimiter(defaultMaxConcurrentBackupLists, defaultBackupListQPS)
+
+// apiLimiter bounds the concurrency and rate of a kind of API call
+type apiLimiter struct {
+	slots   chan struct{}
+	limiter *rate.Limiter
+}
+
+// newAPILimiter returns a limiter allowing concurrency calls at a time and qps calls per
+// second, with bursts of up to concurrency calls. A qps of 0 disables the rate limit.
+func newAPILimiter(concurrency int, qps float64) *apiLimiter {
+	limit := rate.Limit(qps)
+	if qps == 0 {
+		limit = rate.Inf
+	}
+
+	return &apiLimiter{
+		slots:   make(chan struct{}, concurrency),
+		limiter: rate.NewLimiter(limit, concurrency),
+	}
+}
+
+// acquire waits until a call is allowed and returns the function releasing it
+func (l *apiLimiter) acquire(ctx context.Context) (func(), error) {
+	select {
+	case l.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, errors.Wrap(ctx.Err(), "timed out waiting for a concurrent API call slot")
+	}
+
+	if err := l.limiter.Wait(ctx); err != nil {
+		<-l.slots
+		return nil, errors.Wrap(err, "timed out waiting for the API rate limit")
+	}
+
+	return func() { <-l.slots }, nil
+}
+
+// LoadAPILimits reads the limits on the plugin's API calls from the plugin environment
+func LoadAPILimits() error {
+	limiter, err := parseAPILimits(os.Getenv(EnvMaxConcurrentBackupLists), os.Getenv(EnvBackupListQPS))
+	if err != nil {
+		return err
+	}
+	backupListLimiter = limiter
+	return nil
+}
+
+// parseAPILimits builds the Backup list limiter from the concurrency and QPS settings,
+// using the defaults for empty values
+func parseAPILimits(concurrencyValue, qpsValue string) (*apiLimiter, error) {
+	concurrency := defaultMaxConcurrentBackupLists
+	if concurrencyValue != "" {
+		parsed, err := strconv.Atoi(concurrencyValue)
+		if err != nil || parsed < 1 {
+			return nil, errors.Errorf("%s must be a positive integer, got %q", EnvMaxConcurrentBackupLists, concurrencyValue)
+		}
+		concurrency = parsed
+	}
+
+	qps := float64(defaultBackupListQPS)
+	if qpsValue != "" {
+		parsed, err := strconv.ParseFloat(qpsValue, 64)
+		if err != nil || parsed < 0 {
+			return nil, errors.Errorf("%s must be a non-negative number, got %q", EnvBackupListQPS, qpsValue)
+		}
+		qps = parsed
+	}
+
+	return newAPILimiter(concurrency, qps), nil
+}
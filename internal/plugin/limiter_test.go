@@ -0,0 +1,99 @@
+package plugin
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAPILimits(t *testing.T) {
+	tests := []struct {
+		name                string
+		concurrency         string
+		qps                 string
+		expectedConcurrency int
+		expectedError       bool
+	}{
+		{name: "defaults", expectedConcurrency: defaultMaxConcurrentBackupLists},
+		{name: "custom", concurrency: "2", qps: "0.5", expectedConcurrency: 2},
+		{name: "unlimited rate", concurrency: "8", qps: "0", expectedConcurrency: 8},
+		{name: "zero concurrency", concurrency: "0", expectedError: true},
+		{name: "invalid concurrency", concurrency: "many", expectedError: true},
+		{name: "negative qps", qps: "-1", expectedError: true},
+		{name: "invalid qps", qps: "fast", expectedError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter, err := parseAPILimits(tt.concurrency, tt.qps)
+			if tt.expectedError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedConcurrency, cap(limiter.slots))
+		})
+	}
+}
+
+func TestAPILimiterConcurrency(t *testing.T) {
+	limiter := newAPILimiter(2, 0)
+
+	var running, maxRunning int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := limiter.acquire(context.Background())
+			require.NoError(t, err)
+			defer release()
+
+			current := atomic.AddInt32(&running, 1)
+			for {
+				seen := atomic.LoadInt32(&maxRunning)
+				if current <= seen || atomic.CompareAndSwapInt32(&maxRunning, seen, current) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+		}()
+	}
+	wg.Wait()
+
+	assert.LessOrEqual(t, maxRunning, int32(2))
+}
+
+func TestAPILimiterTimeout(t *testing.T) {
+	limiter := newAPILimiter(1, 0)
+	release, err := limiter.acquire(context.Background())
+	require.NoError(t, err)
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err = limiter.acquire(ctx)
+	assert.ErrorContains(t, err, "concurrent API call slot")
+}
+
+func TestAPILimiterRate(t *testing.T) {
+	// One call per second with a burst of one: the second call has to wait
+	limiter := newAPILimiter(1, 1)
+	release, err := limiter.acquire(context.Background())
+	require.NoError(t, err)
+	release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err = limiter.acquire(ctx)
+	assert.ErrorContains(t, err, "rate limit")
+	assert.Len(t, limiter.slots, 0, "a call rejected by the rate limit releases its slot")
+}
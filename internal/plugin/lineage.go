@@ -0,0 +1,228 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	// AnnotationServerNameLineage is the annotation key used to store the serverNames earlier
+	// generations of a restored cluster archived to, as a JSON list from oldest to newest
+	AnnotationServerNameLineage = "velero-cnpg/serverName-lineage"
+
+	// AnnotationBackupServerNames is the annotation key used to store the serverNames found
+	// in the status of the cluster's CNPG Backup CRs at backup time, as a JSON list from
+	// oldest to newest backup
+	AnnotationBackupServerNames = "velero-cnpg/backup-serverNames"
+
+	// AnnotationServerNameHistory is the annotation key used to store every serverName the
+	// cluster has archived to, as an append-only JSON list of serverNameHistoryEntry
+	AnnotationServerNameHistory = "velero-cnpg/serverName-history"
+)
+
+// serverNameHistoryEntry is an entry of the serverName history
+type serverNameHistoryEntry struct {
+	// ServerName is the serverName the cluster archived to
+	ServerName string `json:"serverName"`
+
+	// Since is when a backup or restore first saw the cluster archiving to it, in RFC 3339
+	Since string `json:"since"`
+}
+
+// serverNameLineage returns the serverNames recorded by earlier restores of the cluster
+func (p *RestorePluginV2) serverNameLineage(itemContent map[string]interface{}) ([]string, error) {
+	value, found, err := p.getAnnotation(itemContent, AnnotationServerNameLineage)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	var lineage []string
+	if err := json.Unmarshal([]byte(value), &lineage); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode %s annotation", AnnotationServerNameLineage)
+	}
+	return lineage, nil
+}
+
+// backupServerNames returns the serverNames the backups of a cluster were written to,
+// ordered by their first backup
+func backupServerNames(backups []unstructured.Unstructured) []string {
+	sorted := append([]unstructured.Unstructured(nil), backups...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		timeI := sorted[i].GetCreationTimestamp()
+		timeJ := sorted[j].GetCreationTimestamp()
+		return timeI.Time.Before(timeJ.Time)
+	})
+
+	var serverNames []string
+	seen := map[string]bool{}
+	for _, backup := range sorted {
+		serverName, _, _ := unstructured.NestedString(backup.Object, "status", "serverName")
+		if serverName != "" && !seen[serverName] {
+			seen[serverName] = true
+			serverNames = append(serverNames, serverName)
+		}
+	}
+	return serverNames
+}
+
+// annotateBackupServerNames records the serverNames the backups of the cluster were written
+// to, including those of generations from before the plugin recorded a lineage. Failing to
+// record them is logged rather than failing the backup.
+func (p *BackupPluginV2) annotateBackupServerNames(itemContent map[string]interface{}, backups []unstructured.Unstructured) {
+	serverNames := backupServerNames(backups)
+	if len(serverNames) == 0 {
+		return
+	}
+
+	raw, err := json.Marshal(serverNames)
+	if err == nil {
+		err = p.addAnnotation(itemContent, AnnotationBackupServerNames, string(raw))
+	}
+	if err != nil {
+		p.log.Warnf("Failed to annotate backup serverNames: %v", err)
+	}
+}
+
+// recordServerNameLineage appends the serverName the cluster was backed up with to its
+// lineage, since the restored cluster archives to a new one. serverNames found in the
+// cluster's Backup CRs but missing from the lineage are taken to be older and prepended.
+// It returns the lineage before the append, i.e. the serverNames of the generations before
+// the backed-up one.
+func (p *RestorePluginV2) recordServerNameLineage(itemContent map[string]interface{}, serverName string) ([]string, error) {
+	lineage, err := p.serverNameLineage(itemContent)
+	if err != nil {
+		return nil, err
+	}
+
+	value, found, err := p.getAnnotation(itemContent, AnnotationBackupServerNames)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		var discovered []string
+		if err := json.Unmarshal([]byte(value), &discovered); err != nil {
+			return nil, errors.Wrapf(err, "failed to decode %s annotation", AnnotationBackupServerNames)
+		}
+
+		known := map[string]bool{serverName: true}
+		for _, name := range lineage {
+			known[name] = true
+		}
+		var missing []string
+		for _, name := range discovered {
+			if !known[name] {
+				missing = append(missing, name)
+			}
+		}
+		lineage = append(missing, lineage...)
+	}
+
+	earlier := lineage
+	if len(lineage) == 0 || lineage[len(lineage)-1] != serverName {
+		lineage = append(lineage[:len(lineage):len(lineage)], serverName)
+	} else {
+		earlier = lineage[:len(lineage)-1]
+	}
+
+	raw, err := json.Marshal(lineage)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to encode %s annotation", AnnotationServerNameLineage)
+	}
+	if err := setAnnotation(itemContent, AnnotationServerNameLineage, string(raw)); err != nil {
+		return nil, err
+	}
+
+	return earlier, nil
+}
+
+// configureChainedRecovery adds an externalClusters entry for every earlier serverName of
+// the cluster, copied from the recovery source with only the serverName changed. The entry
+// of the generation before the backed-up one is named clusterBackup-1, the one before that
+// clusterBackup-2 and so on, so WAL archived by earlier generations can still be recovered
+// from by pointing bootstrap.recovery at them. Clusters without a recovery source are left
+// unchanged.
+func (p *RestorePluginV2) configureChainedRecovery(itemContent map[string]interface{}, earlier []string) error {
+	if len(earlier) == 0 {
+		return nil
+	}
+
+	specMap, err := getSpecMap(itemContent)
+	if err != nil {
+		return err
+	}
+
+	var source map[string]interface{}
+	for _, externalCluster := range sliceOfMaps(specMap["externalClusters"]) {
+		if externalCluster["name"] == recoverySourceName {
+			source = externalCluster
+			break
+		}
+	}
+	if source == nil {
+		return nil
+	}
+
+	externalClusters, _ := specMap["externalClusters"].([]interface{})
+	for generation := 1; generation <= len(earlier); generation++ {
+		serverName := earlier[len(earlier)-generation]
+
+		entry := runtime.DeepCopyJSONValue(source).(map[string]interface{})
+		entry["name"] = fmt.Sprintf("%s-%d", recoverySourceName, generation)
+		if objectStore, ok := entry["barmanObjectStore"].(map[string]interface{}); ok {
+			objectStore["serverName"] = serverName
+		}
+		if parameters, found, _ := nestedMapNoCopy(entry, "plugin", "parameters"); found {
+			parameters["serverName"] = serverName
+		}
+
+		externalClusters = append(externalClusters, entry)
+	}
+	specMap["externalClusters"] = externalClusters
+
+	p.log.Infof("Configured externalClusters for %d earlier serverNames", len(earlier))
+	return nil
+}
+
+// appendServerNameHistory appends the serverNames the cluster currently archives to to its
+// history, unless they are already its latest entries. Entries are never removed, so the
+// history lists every object store prefix the cluster has written to.
+func appendServerNameHistory(itemContent map[string]interface{}, now time.Time) error {
+	var history []serverNameHistoryEntry
+	cluster := &unstructured.Unstructured{Object: itemContent}
+	if value, found := cluster.GetAnnotations()[AnnotationServerNameHistory]; found {
+		if err := json.Unmarshal([]byte(value), &history); err != nil {
+			return errors.Wrapf(err, "failed to decode %s annotation", AnnotationServerNameHistory)
+		}
+	}
+
+	current := map[string]bool{}
+	for _, location := range archiveLocations(itemContent) {
+		current[location.serverName] = true
+	}
+	// Entries already at the end of the history are still current
+	for i := len(history) - 1; i >= 0 && current[history[i].ServerName]; i-- {
+		delete(current, history[i].ServerName)
+	}
+	if len(current) == 0 {
+		return nil
+	}
+
+	for _, location := range archiveLocations(itemContent) {
+		if current[location.serverName] {
+			history = append(history, serverNameHistoryEntry{ServerName: location.serverName, Since: now.UTC().Format(time.RFC3339)})
+			delete(current, location.serverName)
+		}
+	}
+
+	raw, err := json.Marshal(history)
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode %s annotation", AnnotationServerNameHistory)
+	}
+	return setAnnotation(itemContent, AnnotationServerNameHistory, string(raw))
+}
@@ -0,0 +1,179 @@
+package plugin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestRecordServerNameLineage(t *testing.T) {
+	tests := []struct {
+		name            string
+		annotation      string
+		serverName      string
+		expectedEarlier []string
+		expectedLineage string
+	}{
+		{
+			name:            "first restore",
+			serverName:      "pg",
+			expectedLineage: `["pg"]`,
+		},
+		{
+			name:            "restore of a restored cluster",
+			annotation:      `["pg"]`,
+			serverName:      "pg-20240101-000000-abcde",
+			expectedEarlier: []string{"pg"},
+			expectedLineage: `["pg","pg-20240101-000000-abcde"]`,
+		},
+		{
+			name:            "same backup restored twice",
+			annotation:      `["pg","pg-20240101-000000-abcde"]`,
+			serverName:      "pg-20240101-000000-abcde",
+			expectedEarlier: []string{"pg"},
+			expectedLineage: `["pg","pg-20240101-000000-abcde"]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := createMockArchivingCluster("pg", "default", tt.serverName, nil)
+			if tt.annotation != "" {
+				cluster.SetAnnotations(map[string]string{AnnotationServerNameLineage: tt.annotation})
+			}
+
+			earlier, err := (&RestorePluginV2{log: logrus.New()}).recordServerNameLineage(cluster.Object, tt.serverName)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedEarlier, earlier)
+			assert.Equal(t, tt.expectedLineage, cluster.GetAnnotations()[AnnotationServerNameLineage])
+		})
+	}
+}
+
+func TestRecordServerNameLineageInvalidAnnotation(t *testing.T) {
+	cluster := createMockArchivingCluster("pg", "default", "pg", nil)
+	cluster.SetAnnotations(map[string]string{AnnotationServerNameLineage: "not json"})
+
+	_, err := (&RestorePluginV2{log: logrus.New()}).recordServerNameLineage(cluster.Object, "pg")
+	assert.ErrorContains(t, err, "failed to decode velero-cnpg/serverName-lineage annotation")
+}
+
+func TestConfigureChainedRecovery(t *testing.T) {
+	plugin := &RestorePluginV2{log: logrus.New()}
+
+	t.Run("plugin source", func(t *testing.T) {
+		cluster := createMockArchivingCluster("pg", "default", "pg-new", nil)
+		require.NoError(t, plugin.configureExternalCluster(cluster.Object, "pg-2", "store"))
+
+		require.NoError(t, plugin.configureChainedRecovery(cluster.Object, []string{"pg-0", "pg-1"}))
+
+		externalClusters, _, _ := unstructured.NestedSlice(cluster.Object, "spec", "externalClusters")
+		require.Len(t, externalClusters, 3)
+		for i, expected := range []struct{ name, serverName string }{
+			{recoverySourceName, "pg-2"},
+			{recoverySourceName + "-1", "pg-1"},
+			{recoverySourceName + "-2", "pg-0"},
+		} {
+			entry := externalClusters[i].(map[string]interface{})
+			assert.Equal(t, expected.name, entry["name"])
+			serverName, _, _ := unstructured.NestedString(entry, "plugin", "parameters", "serverName")
+			assert.Equal(t, expected.serverName, serverName)
+			barmanObjectName, _, _ := unstructured.NestedString(entry, "plugin", "parameters", "barmanObjectName")
+			assert.Equal(t, "store", barmanObjectName)
+		}
+	})
+
+	t.Run("in-tree object store source", func(t *testing.T) {
+		cluster := createMockArchivingCluster("pg", "default", "pg-1", nil)
+		require.NoError(t, plugin.configureExternalClusterObjectStore(cluster.Object, "pg-1"))
+
+		require.NoError(t, plugin.configureChainedRecovery(cluster.Object, []string{"pg-0"}))
+
+		externalClusters, _, _ := unstructured.NestedSlice(cluster.Object, "spec", "externalClusters")
+		require.Len(t, externalClusters, 2)
+		serverName, _, _ := unstructured.NestedString(externalClusters[0].(map[string]interface{}), "barmanObjectStore", "serverName")
+		assert.Equal(t, "pg-1", serverName)
+		serverName, _, _ = unstructured.NestedString(externalClusters[1].(map[string]interface{}), "barmanObjectStore", "serverName")
+		assert.Equal(t, "pg-0", serverName)
+	})
+
+	t.Run("no recovery source", func(t *testing.T) {
+		cluster := createMockArchivingCluster("pg", "default", "pg-1", nil)
+
+		require.NoError(t, plugin.configureChainedRecovery(cluster.Object, []string{"pg-0"}))
+
+		_, found, _ := unstructured.NestedFieldNoCopy(cluster.Object, "spec", "externalClusters")
+		assert.False(t, found)
+	})
+}
+
+func TestAppendServerNameHistory(t *testing.T) {
+	first := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	second := first.Add(24 * time.Hour)
+
+	cluster := createMockArchivingCluster("pg", "default", "pg", nil)
+	require.NoError(t, appendServerNameHistory(cluster.Object, first))
+	assert.Equal(t, `[{"serverName":"pg","since":"2024-01-01T00:00:00Z"}]`, cluster.GetAnnotations()[AnnotationServerNameHistory])
+
+	// An unchanged serverName is not recorded again
+	require.NoError(t, appendServerNameHistory(cluster.Object, second))
+	assert.Equal(t, `[{"serverName":"pg","since":"2024-01-01T00:00:00Z"}]`, cluster.GetAnnotations()[AnnotationServerNameHistory])
+
+	// A rotated serverName is appended
+	require.NoError(t, (&RestorePluginV2{log: logrus.New()}).updatePluginServerName(cluster.Object, "pg-new"))
+	require.NoError(t, (&RestorePluginV2{log: logrus.New()}).updateBarmanObjectStoreServerName(cluster.Object, "pg-new"))
+	require.NoError(t, appendServerNameHistory(cluster.Object, second))
+	assert.Equal(t, `[{"serverName":"pg","since":"2024-01-01T00:00:00Z"},{"serverName":"pg-new","since":"2024-01-02T00:00:00Z"}]`,
+		cluster.GetAnnotations()[AnnotationServerNameHistory])
+}
+
+func TestAppendServerNameHistoryWithoutArchive(t *testing.T) {
+	cluster := createMockArchivingCluster("pg", "default", "pg", nil)
+	delete(cluster.Object["spec"].(map[string]interface{}), "backup")
+	delete(cluster.Object["spec"].(map[string]interface{}), "plugins")
+
+	require.NoError(t, appendServerNameHistory(cluster.Object, time.Now()))
+	assert.NotContains(t, cluster.GetAnnotations(), AnnotationServerNameHistory)
+}
+
+func TestAppendServerNameHistoryInvalidAnnotation(t *testing.T) {
+	cluster := createMockArchivingCluster("pg", "default", "pg", nil)
+	cluster.SetAnnotations(map[string]string{AnnotationServerNameHistory: "not json"})
+
+	err := appendServerNameHistory(cluster.Object, time.Now())
+	assert.ErrorContains(t, err, "failed to decode velero-cnpg/serverName-history annotation")
+}
+
+func TestBackupServerNames(t *testing.T) {
+	now := time.Now()
+	withServerName := func(backup *unstructured.Unstructured, serverName string) *unstructured.Unstructured {
+		backup.Object["status"].(map[string]interface{})["serverName"] = serverName
+		return backup
+	}
+
+	backups := []unstructured.Unstructured{
+		*withServerName(createMockBackup("backup-3", "default", "pg", "completed", "3", now), "pg-20240201-000000-abcde"),
+		*withServerName(createMockBackup("backup-1", "default", "pg", "completed", "1", now.Add(-2*time.Hour)), "pg"),
+		*withServerName(createMockBackup("backup-2", "default", "pg", "failed", "2", now.Add(-time.Hour)), "pg"),
+		*createMockBackup("backup-4", "default", "pg", "running", "", now),
+	}
+
+	assert.Equal(t, []string{"pg", "pg-20240201-000000-abcde"}, backupServerNames(backups))
+}
+
+func TestRecordServerNameLineageWithBackupServerNames(t *testing.T) {
+	cluster := createMockArchivingCluster("pg", "default", "pg-2", nil)
+	cluster.SetAnnotations(map[string]string{
+		AnnotationServerNameLineage: `["pg-1"]`,
+		AnnotationBackupServerNames: `["pg-0","pg-1","pg-2"]`,
+	})
+
+	earlier, err := (&RestorePluginV2{log: logrus.New()}).recordServerNameLineage(cluster.Object, "pg-2")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"pg-0", "pg-1"}, earlier)
+	assert.Equal(t, `["pg-0","pg-1","pg-2"]`, cluster.GetAnnotations()[AnnotationServerNameLineage])
+}
@@ -0,0 +1,136 @@
+package plugin
+
+import (
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestNestedMapNoCopy(t *testing.T) {
+	obj := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{"a": "b"},
+			"name":        "test-cluster",
+		},
+	}
+
+	annotations, found, err := nestedMapNoCopy(obj, "metadata", "annotations")
+	require.NoError(t, err)
+	require.True(t, found)
+	annotations["c"] = "d"
+	assert.Equal(t, "d", obj["metadata"].(map[string]interface{})["annotations"].(map[string]interface{})["c"])
+
+	_, found, err = nestedMapNoCopy(obj, "metadata", "labels")
+	require.NoError(t, err)
+	assert.False(t, found)
+
+	_, _, err = nestedMapNoCopy(obj, "metadata", "name")
+	assert.Error(t, err)
+}
+
+func TestEnsureNestedMapNoCopy(t *testing.T) {
+	obj := map[string]interface{}{
+		"spec": map[string]interface{}{"instances": 3},
+	}
+
+	bootstrap, err := ensureNestedMapNoCopy(obj, "spec", "bootstrap", "recovery")
+	require.NoError(t, err)
+	bootstrap["source"] = "clusterBackup"
+
+	source, _, _ := unstructured.NestedString(obj, "spec", "bootstrap", "recovery", "source")
+	assert.Equal(t, "clusterBackup", source)
+
+	_, err = ensureNestedMapNoCopy(obj, "spec", "instances", "x")
+	assert.Error(t, err)
+}
+
+func TestSetAnnotation(t *testing.T) {
+	obj := map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "test-cluster"},
+	}
+
+	require.NoError(t, setAnnotation(obj, AnnotationServerName, "server-1"))
+	require.NoError(t, setAnnotation(obj, AnnotationBackupMethod, BackupMethodPlugin))
+
+	annotations := obj["metadata"].(map[string]interface{})["annotations"].(map[string]interface{})
+	assert.Equal(t, "server-1", annotations[AnnotationServerName])
+	assert.Equal(t, BackupMethodPlugin, annotations[AnnotationBackupMethod])
+
+	assert.Error(t, setAnnotation(map[string]interface{}{}, "key", "value"))
+	assert.Error(t, setAnnotation(map[string]interface{}{"metadata": "invalid"}, "key", "value"))
+}
+
+// newLargeCluster returns a cluster with large metadata, as found on clusters managed
+// by several tools that each record their own annotations
+func newLargeCluster() map[string]interface{} {
+	annotations := make(map[string]interface{}, 200)
+	labels := make(map[string]interface{}, 50)
+	for i := 0; i < 200; i++ {
+		annotations[fmt.Sprintf("example.com/annotation-%d", i)] = fmt.Sprintf("value-%d", i)
+	}
+	for i := 0; i < 50; i++ {
+		labels[fmt.Sprintf("example.com/label-%d", i)] = fmt.Sprintf("value-%d", i)
+	}
+
+	return map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"name":        "test-cluster",
+			"namespace":   "default",
+			"annotations": annotations,
+			"labels":      labels,
+		},
+		"spec": map[string]interface{}{"instances": int64(3)},
+	}
+}
+
+func BenchmarkSetAnnotation(b *testing.B) {
+	obj := newLargeCluster()
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := setAnnotation(obj, AnnotationServerName, "server-1"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkSetNestedFieldAnnotation is the copying approach setAnnotation replaces
+func BenchmarkSetNestedFieldAnnotation(b *testing.B) {
+	obj := newLargeCluster()
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		metadata, _, _ := unstructured.NestedFieldNoCopy(obj, "metadata")
+		metadataMap := metadata.(map[string]interface{})
+		metadataMap["annotations"].(map[string]interface{})[AnnotationServerName] = "server-1"
+		if err := unstructured.SetNestedField(obj, metadataMap, "metadata"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMigrateAnnotations(b *testing.B) {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	plugin := &RestorePluginV2{log: log}
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		obj := newLargeCluster()
+		annotations := obj["metadata"].(map[string]interface{})["annotations"].(map[string]interface{})
+		annotations[LegacyAnnotationServerName] = "server-1"
+		b.StartTimer()
+
+		if err := plugin.migrateAnnotations(obj); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,349 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/label"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// notificationOperationPrefix prefixes the IDs of notification operations
+	notificationOperationPrefix = "notification"
+
+	// notificationStatusKey is the status ConfigMap key recording when the summary of a
+	// restore was claimed and sent, so the clusters of the restore send it only once
+	notificationStatusKey = "notification"
+
+	// notificationSendingPrefix prefixes the notification status of a summary a poll
+	// claimed and is sending
+	notificationSendingPrefix = "sending "
+
+	// notificationSentPrefix prefixes the notification status of a summary that was sent
+	notificationSentPrefix = "sent "
+
+	// notificationFailedPrefix prefixes the notification status of a summary that failed
+	// to send, which the next poll claims again
+	notificationFailedPrefix = "failed "
+
+	// defaultNotificationWaitTimeout bounds the wait for restored clusters to become
+	// healthy when waitTimeout is not set
+	defaultNotificationWaitTimeout = time.Hour
+
+	// notificationTimeout bounds sending the summary
+	notificationTimeout = 10 * time.Second
+
+	// notificationClaimTimeout is how long a claim to send the summary is held. A poll
+	// stopped between claiming and sending leaves its claim behind, which the next poll
+	// claims again once it is older than that.
+	notificationClaimTimeout = notificationTimeout + time.Minute
+)
+
+// notificationOperation identifies the notification of a restore, sent once its clusters
+// are healthy or, at the latest, at the deadline
+type notificationOperation struct {
+	deadline time.Time
+}
+
+// encodeNotificationOperationID encodes a notification as an operation ID
+func encodeNotificationOperationID(op *notificationOperation) string {
+	return notificationOperationPrefix + "/" + strconv.FormatInt(op.deadline.Unix(), 10)
+}
+
+// decodeNotificationOperationID decodes an operation ID produced by encodeNotificationOperationID
+func decodeNotificationOperationID(operationID string) (*notificationOperation, error) {
+	prefix, deadline, found := strings.Cut(operationID, "/")
+	if !found || prefix != notificationOperationPrefix {
+		return nil, errors.Errorf("invalid notification operation ID %q", operationID)
+	}
+	seconds, err := strconv.ParseInt(deadline, 10, 64)
+	if err != nil {
+		return nil, errors.Errorf("invalid notification operation ID %q", operationID)
+	}
+	return &notificationOperation{deadline: time.Unix(seconds, 0)}, nil
+}
+
+// waitTimeout returns how long the summary waits for the restored clusters
+func (c *NotificationConfig) waitTimeout() time.Duration {
+	if timeout, err := time.ParseDuration(c.WaitTimeout); err == nil && timeout > 0 {
+		return timeout
+	}
+	return defaultNotificationWaitTimeout
+}
+
+// restoreSummary is the summary of a restore sent in the json format
+type restoreSummary struct {
+	// Restore is the name of the Velero restore
+	Restore string `json:"restore"`
+
+	// Backup is the name of the Velero backup it restored
+	Backup string `json:"backup"`
+
+	// Clusters are the CNPG clusters the restore created
+	Clusters []restoredClusterSummary `json:"clusters"`
+
+	// Healthy is the number of those clusters that are healthy
+	Healthy int `json:"healthy"`
+}
+
+// restoredClusterSummary summarizes a restored cluster
+type restoredClusterSummary struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+
+	// BackupID is the CNPG backup the cluster recovered from, empty when it did not
+	BackupID string `json:"backupID,omitempty"`
+
+	// RecoveryTarget is where recovery stopped, as <target kind>=<value>, empty when the
+	// cluster recovered to the end of its WAL archive
+	RecoveryTarget string `json:"recoveryTarget,omitempty"`
+
+	// Phase is the status.phase of the cluster
+	Phase string `json:"phase"`
+
+	// ReadyInstances and Instances are the ready and desired instances of the cluster
+	ReadyInstances int64 `json:"readyInstances"`
+	Instances      int64 `json:"instances"`
+
+	// Healthy is whether the cluster is healthy
+	Healthy bool `json:"healthy"`
+
+	// Hibernated is whether the cluster was restored hibernated
+	Hibernated bool `json:"hibernated,omitempty"`
+}
+
+// slackMessage is the message POSTed in the slack format
+type slackMessage struct {
+	Text string `json:"text"`
+}
+
+// summarizeRestoredCluster summarizes a cluster created by the restore
+func summarizeRestoredCluster(cluster *unstructured.Unstructured) restoredClusterSummary {
+	summary := restoredClusterSummary{
+		Namespace: cluster.GetNamespace(),
+		Name:      cluster.GetName(),
+	}
+	summary.Phase, _, _ = unstructured.NestedString(cluster.Object, "status", "phase")
+	summary.ReadyInstances, _, _ = unstructured.NestedInt64(cluster.Object, "status", "readyInstances")
+	summary.Instances, _, _ = unstructured.NestedInt64(cluster.Object, "spec", "instances")
+	summary.Healthy = summary.Phase == clusterPhaseHealthy
+	summary.Hibernated = isHibernated(cluster.Object)
+
+	if _, recovered, _ := unstructured.NestedMap(cluster.Object, "spec", "bootstrap", "recovery"); !recovered {
+		return summary
+	}
+	target, _, _ := unstructured.NestedMap(cluster.Object, "spec", "bootstrap", "recovery", "recoveryTarget")
+	summary.BackupID, _ = target["backupID"].(string)
+	if summary.BackupID == "" {
+		summary.BackupID = cluster.GetAnnotations()[AnnotationCurrentBackupID]
+	}
+	for _, kind := range webhookRecoveryTargetKinds {
+		if value, set := target[kind]; set {
+			summary.RecoveryTarget = fmt.Sprintf("%s=%v", kind, value)
+			break
+		}
+	}
+	return summary
+}
+
+// slackText formats the summary of a restore as a Slack message
+func (s *restoreSummary) slackText() string {
+	var text strings.Builder
+	fmt.Fprintf(&text, "Velero restore %s of backup %s restored %d CNPG clusters, %d healthy:", s.Restore, s.Backup, len(s.Clusters), s.Healthy)
+	for _, cluster := range s.Clusters {
+		health := "healthy"
+		if cluster.Hibernated {
+			health = "hibernated"
+		} else if !cluster.Healthy {
+			health = "not healthy"
+			if cluster.Phase != "" {
+				health += " (" + cluster.Phase + ")"
+			}
+		}
+		target := "end of the WAL archive"
+		if cluster.RecoveryTarget != "" {
+			target = cluster.RecoveryTarget
+		}
+		fmt.Fprintf(&text, "\n• %s/%s: %s, %d/%d instances ready", cluster.Namespace, cluster.Name, health, cluster.ReadyInstances, cluster.Instances)
+		if cluster.BackupID != "" {
+			fmt.Fprintf(&text, ", recovered from backup %s to %s", cluster.BackupID, target)
+		}
+	}
+	return text.String()
+}
+
+// summarizeRestore summarizes the clusters created by the restore, in every namespace
+func (p *RestorePluginV2) summarizeRestore(ctx context.Context, restore *v1.Restore) (*restoreSummary, error) {
+	dynamicClient, err := p.getDynamicClient()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create dynamic client")
+	}
+	clusters, err := dynamicClient.Resource(cnpgClusterGVR).Namespace(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+		LabelSelector: labels.Set{v1.RestoreNameLabel: label.GetValidName(restore.Name)}.String(),
+	})
+	if err != nil {
+		return nil, errors.Wrap(classifyAPIError(err), "failed to list restored clusters")
+	}
+
+	summary := &restoreSummary{Restore: restore.Name, Backup: restore.Spec.BackupName, Clusters: []restoredClusterSummary{}}
+	for i := range clusters.Items {
+		cluster := summarizeRestoredCluster(&clusters.Items[i])
+		if cluster.Healthy {
+			summary.Healthy++
+		}
+		summary.Clusters = append(summary.Clusters, cluster)
+	}
+	sort.Slice(summary.Clusters, func(i, j int) bool {
+		if summary.Clusters[i].Namespace != summary.Clusters[j].Namespace {
+			return summary.Clusters[i].Namespace < summary.Clusters[j].Namespace
+		}
+		return summary.Clusters[i].Name < summary.Clusters[j].Name
+	})
+	return summary, nil
+}
+
+// notificationClaimable reports whether a poll may claim the summary for the notification
+// status of the restore: when it was never claimed, failed to send, or was claimed more
+// than notificationClaimTimeout ago without being sent. Earlier versions of the plugin
+// claimed with the bare time.
+func notificationClaimable(status string, found bool, now time.Time) bool {
+	switch {
+	case !found, strings.HasPrefix(status, notificationFailedPrefix):
+		return true
+	case strings.HasPrefix(status, notificationSentPrefix):
+		return false
+	}
+	claimed, err := time.Parse(time.RFC3339, strings.TrimPrefix(status, notificationSendingPrefix))
+	return err != nil || now.Sub(claimed) > notificationClaimTimeout
+}
+
+// notificationProgress sends the summary of the restore once every cluster it created is
+// healthy, or once the deadline has passed, and reports the operation as completed once
+// the summary has been sent by this or another cluster of the restore. Hibernated
+// clusters are not waited for, since they do not start on their own. The summary is
+// claimed in the status ConfigMap before it is sent, so only one cluster of the restore
+// sends it, and recorded as sent once the webhook accepted it. A summary that fails to
+// send is released and retried on the next poll, as is a claim left by a poll that
+// stopped before sending.
+func (p *RestorePluginV2) notificationProgress(op *notificationOperation, restore *v1.Restore, config *NotificationConfig) (velero.OperationProgress, error) {
+	progress := velero.OperationProgress{
+		NTotal:         1,
+		OperationUnits: "Notifications",
+		Updated:        time.Now(),
+	}
+	if restore == nil {
+		return progress, errors.New("notification requires the restore")
+	}
+	if config == nil {
+		progress.Completed = true
+		progress.Description = "Notification is no longer configured"
+		return progress, nil
+	}
+
+	kubeClient, err := p.getKubeClient()
+	if err != nil {
+		return progress, errors.Wrap(err, "failed to get Kubernetes client")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	status, found, err := statusValue(ctx, kubeClient, restore, notificationStatusKey)
+	if err != nil {
+		return progress, errors.Wrap(classifyAPIError(err), "failed to read restore status")
+	}
+	if found && strings.HasPrefix(status, notificationSentPrefix) {
+		progress.Completed = true
+		progress.NCompleted = 1
+		progress.Description = "Restore notification sent"
+		return progress, nil
+	}
+	if !notificationClaimable(status, found, time.Now()) {
+		progress.Description = "Restore notification is being sent"
+		return progress, nil
+	}
+
+	summary, err := p.summarizeRestore(ctx, restore)
+	if err != nil {
+		return progress, err
+	}
+	var waiting []string
+	for _, cluster := range summary.Clusters {
+		if !cluster.Healthy && !cluster.Hibernated {
+			waiting = append(waiting, cluster.Namespace+"/"+cluster.Name)
+		}
+	}
+	if len(waiting) > 0 && progress.Updated.Before(op.deadline) {
+		progress.Description = fmt.Sprintf("Waiting for clusters %s to become healthy before notifying", strings.Join(waiting, ", "))
+		return progress, nil
+	}
+
+	secret, err := kubeClient.CoreV1().Secrets(restore.Namespace).Get(ctx, config.URLSecret.Name, metav1.GetOptions{})
+	if err != nil {
+		return progress, errors.Wrapf(classifyAPIError(err), "failed to get notification secret %s/%s", restore.Namespace, config.URLSecret.Name)
+	}
+	url := strings.TrimSpace(string(secret.Data[config.URLSecret.Key]))
+	if url == "" {
+		return progress, errors.Errorf("notification secret %s/%s has no key %s", restore.Namespace, config.URLSecret.Name, config.URLSecret.Key)
+	}
+
+	// Claim the summary before sending it. The status ConfigMap is updated at the version the
+	// claim was decided on, so of concurrent polls of the clusters of the restore only one
+	// claims it.
+	claim := notificationSendingPrefix + time.Now().UTC().Format(time.RFC3339)
+	claimed, err := updateStatusValue(ctx, kubeClient, restore, notificationStatusKey, func(status string, found bool) (string, bool) {
+		return claim, notificationClaimable(status, found, time.Now())
+	})
+	if err != nil {
+		return progress, errors.Wrap(classifyAPIError(err), "failed to claim restore notification")
+	}
+	if !claimed {
+		progress.Description = "Restore notification is being sent"
+		return progress, nil
+	}
+
+	var message interface{} = summary
+	if config.Format == NotificationFormatSlack {
+		message = &slackMessage{Text: summary.slackText()}
+	}
+	sendCtx, sendCancel := context.WithTimeout(ctx, notificationTimeout)
+	defer sendCancel()
+	if sendErr := postJSON(sendCtx, http.DefaultClient, url, "notification webhook", message, nil); sendErr != nil {
+		// Release the claim, unless another poll already released and claimed it again
+		_, err := updateStatusValue(ctx, kubeClient, restore, notificationStatusKey, func(status string, found bool) (string, bool) {
+			return notificationFailedPrefix + time.Now().UTC().Format(time.RFC3339), found && status == claim
+		})
+		if err != nil {
+			return progress, errors.Wrapf(classifyAPIError(err), "failed to release restore notification after it failed to send: %v", sendErr)
+		}
+		p.log.Warnf("Failed to send restore notification, retrying: %v", sendErr)
+		progress.Description = fmt.Sprintf("Failed to send restore notification: %v", sendErr)
+		return progress, nil
+	}
+
+	// Record the summary as sent, unless the claim was taken over as stale and the summary
+	// is sent again
+	_, err = updateStatusValue(ctx, kubeClient, restore, notificationStatusKey, func(status string, found bool) (string, bool) {
+		return notificationSentPrefix + time.Now().UTC().Format(time.RFC3339), found && status == claim
+	})
+	if err != nil {
+		return progress, errors.Wrap(classifyAPIError(err), "failed to record restore notification as sent")
+	}
+
+	p.log.Infof("Sent restore notification for %d clusters, %d healthy", len(summary.Clusters), summary.Healthy)
+	progress.Completed = true
+	progress.NCompleted = 1
+	progress.Description = "Restore notification sent"
+	return progress, nil
+}
@@ -0,0 +1,280 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestNotificationOperationID(t *testing.T) {
+	op := &notificationOperation{deadline: time.Unix(1729771200, 0)}
+	id := encodeNotificationOperationID(op)
+	assert.Equal(t, "notification/1729771200", id)
+
+	decoded, err := decodeNotificationOperationID(id)
+	require.NoError(t, err)
+	assert.Equal(t, op, decoded)
+
+	for _, invalid := range []string{"notification", "notification/soon", "recovery/1729771200"} {
+		_, err := decodeNotificationOperationID(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestSummarizeRestoredCluster(t *testing.T) {
+	cluster := createMockArchivingCluster("pg", "prod", "pg", map[string]interface{}{
+		"recovery": map[string]interface{}{
+			"source":         "origin",
+			"recoveryTarget": map[string]interface{}{"backupID": "20241024T120000", "targetTime": "2024-10-24 12:00:00+00"},
+		},
+	})
+	cluster.Object["status"] = map[string]interface{}{"phase": clusterPhaseHealthy, "readyInstances": int64(3)}
+
+	assert.Equal(t, restoredClusterSummary{
+		Namespace:      "prod",
+		Name:           "pg",
+		BackupID:       "20241024T120000",
+		RecoveryTarget: "targetTime=2024-10-24 12:00:00+00",
+		Phase:          clusterPhaseHealthy,
+		ReadyInstances: 3,
+		Instances:      3,
+		Healthy:        true,
+	}, summarizeRestoredCluster(cluster))
+
+	summary := &restoreSummary{Restore: "dr-drill", Backup: "nightly", Healthy: 1, Clusters: []restoredClusterSummary{
+		summarizeRestoredCluster(cluster),
+		{Namespace: "prod", Name: "reports", BackupID: "20241024T110000", Phase: "Setting up primary", Instances: 1},
+		{Namespace: "prod", Name: "archive", Hibernated: true, Instances: 1},
+	}}
+	assert.Equal(t, "Velero restore dr-drill of backup nightly restored 3 CNPG clusters, 1 healthy:"+
+		"\n• prod/pg: healthy, 3/3 instances ready, recovered from backup 20241024T120000 to targetTime=2024-10-24 12:00:00+00"+
+		"\n• prod/reports: not healthy (Setting up primary), 0/1 instances ready, recovered from backup 20241024T110000 to end of the WAL archive"+
+		"\n• prod/archive: hibernated, 0/1 instances ready", summary.slackText())
+}
+
+func TestNotificationProgress(t *testing.T) {
+	var received []string
+	failing := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		var body map[string]interface{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		raw, _ := json.Marshal(body)
+		received = append(received, string(raw))
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	restore := &v1.Restore{
+		ObjectMeta: metav1.ObjectMeta{Name: "dr-drill", Namespace: "velero"},
+		Spec:       v1.RestoreSpec{BackupName: "nightly"},
+	}
+	restored := func(name, phase string) *unstructured.Unstructured {
+		cluster := createMockArchivingCluster(name, "prod", name, nil)
+		cluster.SetLabels(map[string]string{v1.RestoreNameLabel: "dr-drill"})
+		cluster.Object["status"] = map[string]interface{}{"phase": phase}
+		return cluster
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "restore-notifications", Namespace: "velero"},
+		Data:       map[string][]byte{"url": []byte(server.URL + "\n")},
+	}
+	config := &NotificationConfig{URLSecret: SecretKeySelector{Name: "restore-notifications", Key: "url"}, Format: NotificationFormatSlack}
+	later := &notificationOperation{deadline: time.Now().Add(time.Hour)}
+
+	t.Run("waits for the clusters", func(t *testing.T) {
+		received = nil
+		plugin := &RestorePluginV2{
+			log:           logrus.New(),
+			dynamicClient: newFakeDynamicClient(restored("pg", clusterPhaseHealthy), restored("reports", "Setting up primary")),
+			kubeClient:    fake.NewClientset(secret),
+		}
+		progress, err := plugin.notificationProgress(later, restore, config)
+		require.NoError(t, err)
+		assert.False(t, progress.Completed)
+		assert.Equal(t, "Waiting for clusters prod/reports to become healthy before notifying", progress.Description)
+		assert.Empty(t, received)
+
+		// Past the deadline the summary reports the clusters that are not healthy
+		progress, err = plugin.notificationProgress(&notificationOperation{deadline: time.Now().Add(-time.Minute)}, restore, config)
+		require.NoError(t, err)
+		assert.True(t, progress.Completed)
+		require.Len(t, received, 1)
+		assert.Contains(t, received[0], "restored 2 CNPG clusters, 1 healthy")
+	})
+
+	t.Run("sends once", func(t *testing.T) {
+		received = nil
+		kubeClient := fake.NewClientset(secret)
+		plugin := &RestorePluginV2{
+			log:           logrus.New(),
+			dynamicClient: newFakeDynamicClient(restored("pg", clusterPhaseHealthy), restored("other", "Setting up primary")),
+			kubeClient:    kubeClient,
+		}
+		// Clusters of other restores are left out
+		other, err := plugin.dynamicClient.Resource(cnpgClusterGVR).Namespace("prod").Get(context.Background(), "other", metav1.GetOptions{})
+		require.NoError(t, err)
+		other.SetLabels(map[string]string{v1.RestoreNameLabel: "earlier"})
+		_, err = plugin.dynamicClient.Resource(cnpgClusterGVR).Namespace("prod").Update(context.Background(), other, metav1.UpdateOptions{})
+		require.NoError(t, err)
+
+		progress, err := plugin.notificationProgress(later, restore, &NotificationConfig{URLSecret: config.URLSecret})
+		require.NoError(t, err)
+		assert.True(t, progress.Completed)
+		require.Len(t, received, 1)
+		var summary restoreSummary
+		require.NoError(t, json.Unmarshal([]byte(received[0]), &summary))
+		assert.Equal(t, "nightly", summary.Backup)
+		require.Len(t, summary.Clusters, 1)
+		assert.Equal(t, "pg", summary.Clusters[0].Name)
+
+		status, _, err := statusValue(context.Background(), kubeClient, restore, notificationStatusKey)
+		require.NoError(t, err)
+		assert.Regexp(t, `^sent \d{4}-`, status)
+
+		progress, err = plugin.notificationProgress(later, restore, config)
+		require.NoError(t, err)
+		assert.True(t, progress.Completed)
+		assert.Len(t, received, 1)
+	})
+
+	t.Run("retries failed sends", func(t *testing.T) {
+		failing = true
+		defer func() { failing = false }()
+		plugin := &RestorePluginV2{
+			log:           logrus.New(),
+			dynamicClient: newFakeDynamicClient(restored("pg", clusterPhaseHealthy)),
+			kubeClient:    fake.NewClientset(secret),
+		}
+		progress, err := plugin.notificationProgress(later, restore, config)
+		require.NoError(t, err)
+		assert.False(t, progress.Completed)
+		assert.Contains(t, progress.Description, "503 Service Unavailable")
+
+		// The claim is released, so the next poll sends the summary
+		status, _, err := statusValue(context.Background(), plugin.kubeClient, restore, notificationStatusKey)
+		require.NoError(t, err)
+		assert.Contains(t, status, notificationFailedPrefix)
+
+		received = nil
+		failing = false
+		progress, err = plugin.notificationProgress(later, restore, config)
+		require.NoError(t, err)
+		assert.True(t, progress.Completed)
+		assert.Len(t, received, 1)
+	})
+
+	t.Run("claimed concurrently", func(t *testing.T) {
+		received = nil
+		kubeClient := fake.NewClientset(secret, &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: StatusConfigMapName(restore.Name), Namespace: "velero"},
+			Data:       map[string]string{"cluster.prod.pg": "warning"},
+		})
+		// Another cluster of the restore claims the summary between the read and the update of
+		// this one, whose update then conflicts
+		claimedElsewhere := false
+		claim := notificationSendingPrefix + time.Now().UTC().Format(time.RFC3339)
+		kubeClient.PrependReactor("update", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			if claimedElsewhere {
+				return false, nil, nil
+			}
+			claimedElsewhere = true
+			configMap := action.(k8stesting.UpdateAction).GetObject().(*corev1.ConfigMap).DeepCopy()
+			configMap.Data[notificationStatusKey] = claim
+			require.NoError(t, kubeClient.Tracker().Update(corev1.SchemeGroupVersion.WithResource("configmaps"), configMap, "velero"))
+			return true, nil, apierrors.NewConflict(corev1.Resource("configmaps"), configMap.Name, errors.New("modified"))
+		})
+		plugin := &RestorePluginV2{
+			log:           logrus.New(),
+			dynamicClient: newFakeDynamicClient(restored("pg", clusterPhaseHealthy)),
+			kubeClient:    kubeClient,
+		}
+
+		// The summary is not reported as sent until the other cluster records it as sent
+		progress, err := plugin.notificationProgress(later, restore, config)
+		require.NoError(t, err)
+		assert.False(t, progress.Completed)
+		assert.Equal(t, "Restore notification is being sent", progress.Description)
+		assert.Empty(t, received)
+		status, _, err := statusValue(context.Background(), kubeClient, restore, notificationStatusKey)
+		require.NoError(t, err)
+		assert.Equal(t, claim, status)
+	})
+
+	t.Run("reclaims a claim left before sending", func(t *testing.T) {
+		received = nil
+		stale := notificationSendingPrefix + time.Now().Add(-notificationClaimTimeout-time.Minute).UTC().Format(time.RFC3339)
+		kubeClient := fake.NewClientset(secret, &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: StatusConfigMapName(restore.Name), Namespace: "velero"},
+			Data:       map[string]string{notificationStatusKey: stale},
+		})
+		plugin := &RestorePluginV2{
+			log:           logrus.New(),
+			dynamicClient: newFakeDynamicClient(restored("pg", clusterPhaseHealthy)),
+			kubeClient:    kubeClient,
+		}
+
+		progress, err := plugin.notificationProgress(later, restore, config)
+		require.NoError(t, err)
+		assert.True(t, progress.Completed)
+		assert.Len(t, received, 1)
+		status, _, err := statusValue(context.Background(), kubeClient, restore, notificationStatusKey)
+		require.NoError(t, err)
+		assert.Regexp(t, `^sent \d{4}-`, status)
+	})
+
+	t.Run("missing secret", func(t *testing.T) {
+		plugin := &RestorePluginV2{
+			log:           logrus.New(),
+			dynamicClient: newFakeDynamicClient(restored("pg", clusterPhaseHealthy)),
+			kubeClient:    fake.NewClientset(),
+		}
+		_, err := plugin.notificationProgress(later, restore, config)
+		assert.ErrorContains(t, err, "failed to get notification secret velero/restore-notifications")
+	})
+}
+
+func TestNotificationClaimable(t *testing.T) {
+	now := time.Date(2024, 10, 24, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		status   string
+		found    bool
+		expected bool
+	}{
+		{name: "never claimed", expected: true},
+		{name: "failed to send", status: "failed 2024-10-24T11:59:50Z", found: true, expected: true},
+		{name: "sent", status: "sent 2024-10-24T11:00:00Z", found: true, expected: false},
+		{name: "being sent", status: "sending 2024-10-24T11:59:50Z", found: true, expected: false},
+		{name: "left before sending", status: "sending 2024-10-24T11:58:00Z", found: true, expected: true},
+		{name: "claimed by an earlier version", status: "2024-10-24T11:59:50Z", found: true, expected: false},
+		{name: "left by an earlier version", status: "2024-10-24T11:00:00Z", found: true, expected: true},
+		{name: "unreadable", status: "sending soon", found: true, expected: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, notificationClaimable(tt.status, tt.found, now))
+		})
+	}
+}
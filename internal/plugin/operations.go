@@ -0,0 +1,165 @@
+package plugin
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+)
+
+// operationSeparator separates the operations combined into the operation ID of an item,
+// since Velero tracks a single operation per item
+const operationSeparator = ";"
+
+// startedSeparator separates the operation ID of an item from the time its operations
+// started, in Unix seconds
+const startedSeparator = "@"
+
+// joinOperationIDs combines the operations started for an item into one operation ID
+func joinOperationIDs(operationIDs []string) string {
+	return strings.Join(operationIDs, operationSeparator)
+}
+
+// withStarted appends the time the operations of an item started to its operation ID, so
+// their progress can be held against the itemOperationTimeout. Items without operations
+// keep an empty ID.
+func withStarted(operationID string, started time.Time) string {
+	if operationID == "" {
+		return ""
+	}
+	return operationID + startedSeparator + strconv.FormatInt(started.Unix(), 10)
+}
+
+// splitStarted splits an operation ID produced by withStarted. IDs of older plugin
+// versions carry no start time and return the zero time.
+func splitStarted(operationID string) (string, time.Time, error) {
+	ids, started, found := strings.Cut(operationID, startedSeparator)
+	if !found {
+		return operationID, time.Time{}, nil
+	}
+	seconds, err := strconv.ParseInt(started, 10, 64)
+	if err != nil {
+		return "", time.Time{}, errors.Errorf("invalid start time in operation ID %q", operationID)
+	}
+	return ids, time.Unix(seconds, 0), nil
+}
+
+// restoreOperationTimeout returns the itemOperationTimeout of a restore, which Velero fills
+// in from its server default, or 0 when it is unknown
+func restoreOperationTimeout(restore *v1.Restore) time.Duration {
+	if restore == nil {
+		return 0
+	}
+	return restore.Spec.ItemOperationTimeout.Duration
+}
+
+// applyOperationTimeout reports when the operations started and fails them once they have
+// run for longer than timeout. Velero would time them out at about the same moment, but
+// only with a generic error; this one says what was still pending.
+func applyOperationTimeout(progress velero.OperationProgress, started time.Time, timeout time.Duration, now time.Time) velero.OperationProgress {
+	if started.IsZero() {
+		return progress
+	}
+	progress.Started = started
+	if progress.Completed || timeout <= 0 || now.Sub(started) < timeout {
+		return progress
+	}
+
+	pending := progress.Description
+	if pending == "" {
+		pending = "operation not completed"
+	}
+	progress.Completed = true
+	progress.Err = fmt.Sprintf("timed out after the restore's itemOperationTimeout of %s: %s", timeout, pending)
+	return progress
+}
+
+// operationProgress reports the progress of a single operation
+func (p *RestorePluginV2) operationProgress(operationID string, restore *v1.Restore) (velero.OperationProgress, error) {
+	switch {
+	case strings.HasPrefix(operationID, recoveryOperationPrefix+"/"):
+		op, err := decodeRecoveryOperationID(operationID)
+		if err != nil {
+			return velero.OperationProgress{}, err
+		}
+		return p.recoveryProgress(op)
+	case strings.HasPrefix(operationID, poolerOperationPrefix+"/"):
+		op, err := decodePoolerOperationID(operationID)
+		if err != nil {
+			return velero.OperationProgress{}, err
+		}
+		return p.poolerProgress(op)
+	case strings.HasPrefix(operationID, seedBackupOperationPrefix+"/"):
+		op, err := decodeSeedBackupOperationID(operationID)
+		if err != nil {
+			return velero.OperationProgress{}, err
+		}
+		return p.seedBackupProgress(op, restore)
+	case strings.HasPrefix(operationID, notificationOperationPrefix+"/"):
+		op, err := decodeNotificationOperationID(operationID)
+		if err != nil {
+			return velero.OperationProgress{}, err
+		}
+		config, err := p.getConfig()
+		if err != nil {
+			return velero.OperationProgress{}, err
+		}
+		return p.notificationProgress(op, restore, config.Notification)
+	case strings.HasPrefix(operationID, gateOperationPrefix+"/"):
+		op, err := decodeGateOperationID(operationID)
+		if err != nil {
+			return velero.OperationProgress{}, err
+		}
+		if op.kind != gateKindCluster {
+			return velero.OperationProgress{}, errors.Errorf("unexpected namespace gate operation ID %q", operationID)
+		}
+		dynamicClient, err := p.getDynamicClient()
+		if err != nil {
+			return velero.OperationProgress{}, errors.Wrap(err, "failed to create dynamic client")
+		}
+		return gateProgress(dynamicClient, op, restore, releaseScheduledBackups)
+	default:
+		return velero.OperationProgress{}, errors.Errorf("unknown operation ID %q", operationID)
+	}
+}
+
+// combineProgress merges the progress of the operations of an item. The item's operation
+// completes once all of them have, or as soon as one of them fails.
+func combineProgress(progresses []velero.OperationProgress) velero.OperationProgress {
+	if len(progresses) == 1 {
+		return progresses[0]
+	}
+
+	combined := velero.OperationProgress{Completed: true}
+	var descriptions, errs []string
+	for i, progress := range progresses {
+		combined.Completed = combined.Completed && progress.Completed
+		combined.NTotal += progress.NTotal
+		combined.NCompleted += progress.NCompleted
+		if i == 0 || combined.OperationUnits == progress.OperationUnits {
+			combined.OperationUnits = progress.OperationUnits
+		} else {
+			combined.OperationUnits = ""
+		}
+		if progress.Updated.After(combined.Updated) {
+			combined.Updated = progress.Updated
+		}
+		if progress.Description != "" {
+			descriptions = append(descriptions, progress.Description)
+		}
+		if progress.Err != "" {
+			errs = append(errs, progress.Err)
+		}
+	}
+
+	combined.Description = strings.Join(descriptions, "; ")
+	if len(errs) > 0 {
+		combined.Completed = true
+		combined.Err = strings.Join(errs, "; ")
+	}
+	return combined
+}
@@ -0,0 +1,107 @@
+package plugin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCombineProgress(t *testing.T) {
+	pending := velero.OperationProgress{NTotal: 2, NCompleted: 1, OperationUnits: "Poolers", Description: "Waiting for poolers pg-ro"}
+	done := velero.OperationProgress{Completed: true, NTotal: 1, NCompleted: 1, OperationUnits: "Backups", Description: "Seed backup pg-seed completed"}
+	failed := velero.OperationProgress{Completed: true, NTotal: 1, OperationUnits: "Backups", Err: "seed backup failed"}
+
+	assert.Equal(t, pending, combineProgress([]velero.OperationProgress{pending}))
+
+	combined := combineProgress([]velero.OperationProgress{pending, done})
+	assert.False(t, combined.Completed)
+	assert.Equal(t, int64(3), combined.NTotal)
+	assert.Equal(t, int64(2), combined.NCompleted)
+	assert.Empty(t, combined.OperationUnits)
+	assert.Equal(t, "Waiting for poolers pg-ro; Seed backup pg-seed completed", combined.Description)
+
+	// A failed operation fails the item without waiting for the others
+	combined = combineProgress([]velero.OperationProgress{pending, failed})
+	assert.True(t, combined.Completed)
+	assert.Equal(t, "seed backup failed", combined.Err)
+}
+
+func TestRestoreProgressCombinesOperations(t *testing.T) {
+	plugin := &RestorePluginV2{log: logrus.New(), dynamicClient: newFakeDynamicClient(createMockPooler("pg-rw", "default", "pg"))}
+
+	operationID := joinOperationIDs([]string{
+		encodePoolerOperationID("default", "pg", []string{"pg-rw"}),
+		encodeSeedBackupOperationID(&seedBackupOperation{namespace: "default", clusterName: "pg", backupName: "pg-seed", method: BackupMethodPlugin}),
+	})
+
+	progress, err := plugin.Progress(operationID, nil)
+	require.NoError(t, err)
+	assert.False(t, progress.Completed)
+	assert.Equal(t, int64(1), progress.NCompleted)
+	assert.Contains(t, progress.Description, "Waiting for cluster pg to become healthy")
+
+	_, err = plugin.Progress("unknown/default/pg", nil)
+	assert.Error(t, err)
+}
+
+func TestOperationStarted(t *testing.T) {
+	started := time.Unix(1729771200, 0)
+
+	operationID := withStarted("poolers/default/pg/pg-rw", started)
+	assert.Equal(t, "poolers/default/pg/pg-rw@1729771200", operationID)
+	ids, decoded, err := splitStarted(operationID)
+	require.NoError(t, err)
+	assert.Equal(t, "poolers/default/pg/pg-rw", ids)
+	assert.True(t, started.Equal(decoded))
+
+	assert.Empty(t, withStarted("", started))
+
+	// Operation IDs of older plugin versions carry no start time
+	ids, decoded, err = splitStarted("poolers/default/pg/pg-rw")
+	require.NoError(t, err)
+	assert.Equal(t, "poolers/default/pg/pg-rw", ids)
+	assert.True(t, decoded.IsZero())
+
+	_, _, err = splitStarted("poolers/default/pg/pg-rw@yesterday")
+	assert.Error(t, err)
+}
+
+func TestApplyOperationTimeout(t *testing.T) {
+	started := time.Unix(1729771200, 0)
+	pending := velero.OperationProgress{NTotal: 1, Description: "Waiting for cluster pg to become healthy"}
+
+	progress := applyOperationTimeout(pending, started, time.Hour, started.Add(30*time.Minute))
+	assert.False(t, progress.Completed)
+	assert.Equal(t, started, progress.Started)
+
+	progress = applyOperationTimeout(pending, started, time.Hour, started.Add(time.Hour))
+	assert.True(t, progress.Completed)
+	assert.Equal(t, "timed out after the restore's itemOperationTimeout of 1h0m0s: Waiting for cluster pg to become healthy", progress.Err)
+
+	// Completed operations, unknown timeouts and unknown start times are left alone
+	done := velero.OperationProgress{Completed: true, NTotal: 1, NCompleted: 1}
+	assert.Empty(t, applyOperationTimeout(done, started, time.Hour, started.Add(2*time.Hour)).Err)
+	assert.False(t, applyOperationTimeout(pending, started, 0, started.Add(2*time.Hour)).Completed)
+	assert.Equal(t, pending, applyOperationTimeout(pending, time.Time{}, time.Hour, started))
+}
+
+func TestRestoreProgressTimesOut(t *testing.T) {
+	plugin := &RestorePluginV2{log: logrus.New(), dynamicClient: newFakeDynamicClient()}
+	restore := &v1.Restore{Spec: v1.RestoreSpec{ItemOperationTimeout: metav1.Duration{Duration: time.Hour}}}
+	operationID := encodePoolerOperationID("default", "pg", []string{"pg-rw"})
+
+	progress, err := plugin.Progress(withStarted(operationID, time.Now()), restore)
+	require.NoError(t, err)
+	assert.False(t, progress.Completed)
+
+	progress, err = plugin.Progress(withStarted(operationID, time.Now().Add(-2*time.Hour)), restore)
+	require.NoError(t, err)
+	assert.True(t, progress.Completed)
+	assert.Contains(t, progress.Err, "Waiting for poolers pg-rw")
+}
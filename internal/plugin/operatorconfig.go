@@ -0,0 +1,243 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+)
+
+// AnnotationOperatorConfig is the annotation key used to store the CNPG operator settings
+// that affect recovery, as a JSON object, at backup time
+const AnnotationOperatorConfig = "velero-cnpg/operator-config"
+
+const (
+	// operatorConfigMapArg is the operator flag naming its configuration ConfigMap
+	operatorConfigMapArg = "--config-map-name"
+
+	// defaultOperatorConfigMapName is the configuration ConfigMap of the operator when the
+	// flag is not set
+	defaultOperatorConfigMapName = "cnpg-controller-manager-config"
+)
+
+// operatorParityKeys are the operator settings that change how restored clusters are
+// bootstrapped and run: the default PostgreSQL image, the metadata inherited by the
+// instances, certificates, the cluster domain and in-place updates
+var operatorParityKeys = []string{
+	postgresImageEnv,
+	"INHERITED_ANNOTATIONS",
+	"INHERITED_LABELS",
+	"CERTIFICATE_DURATION",
+	"EXPIRING_CHECK_THRESHOLD",
+	"KUBERNETES_CLUSTER_DOMAIN",
+	"ENABLE_INSTANCE_MANAGER_INPLACE_UPDATES",
+	"MONITORING_QUERIES_CONFIGMAP",
+	"CREATE_ANY_SERVICE",
+	"STANDBY_TCP_USER_TIMEOUT",
+}
+
+// operatorConfig is the configuration of a CNPG operator Deployment
+type operatorConfig struct {
+	deployment *appsv1.Deployment
+
+	// configMap is nil when the operator has no configuration ConfigMap
+	configMap *corev1.ConfigMap
+
+	// settings are the operatorParityKeys the operator sets
+	settings map[string]string
+}
+
+// readOperatorConfig returns the configuration of the first CNPG operator Deployment
+// selected by selector, or nil when there is none. Settings are read from the environment
+// of the operator container and then its configuration ConfigMap, which takes precedence.
+func readOperatorConfig(ctx context.Context, client kubernetes.Interface, selector string) (*operatorConfig, error) {
+	deployments, err := client.AppsV1().Deployments(metav1.NamespaceAll).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, errors.Wrap(classifyAPIError(err), "failed to list CNPG operator Deployments")
+	}
+	if len(deployments.Items) == 0 {
+		return nil, nil
+	}
+	sort.Slice(deployments.Items, func(i, j int) bool {
+		a, b := deployments.Items[i], deployments.Items[j]
+		return a.Namespace+"/"+a.Name < b.Namespace+"/"+b.Name
+	})
+
+	config := &operatorConfig{deployment: &deployments.Items[0], settings: map[string]string{}}
+	configMapName := defaultOperatorConfigMapName
+	for _, container := range config.deployment.Spec.Template.Spec.Containers {
+		for _, env := range container.Env {
+			if env.ValueFrom == nil && isOperatorParityKey(env.Name) {
+				config.settings[env.Name] = env.Value
+			}
+		}
+		if name, found := containerArg(container, operatorConfigMapArg); found {
+			configMapName = name
+		}
+	}
+
+	configMap, err := client.CoreV1().ConfigMaps(config.deployment.Namespace).Get(ctx, configMapName, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+	case err != nil:
+		return nil, errors.Wrapf(classifyAPIError(err), "failed to get CNPG operator ConfigMap %s/%s", config.deployment.Namespace, configMapName)
+	default:
+		config.configMap = configMap
+		for key, value := range configMap.Data {
+			if isOperatorParityKey(key) {
+				config.settings[key] = value
+			}
+		}
+	}
+
+	return config, nil
+}
+
+// isOperatorParityKey reports whether key is one of operatorParityKeys
+func isOperatorParityKey(key string) bool {
+	for _, parityKey := range operatorParityKeys {
+		if key == parityKey {
+			return true
+		}
+	}
+	return false
+}
+
+// containerArg returns the value of a flag passed to a container as --flag=value or
+// --flag value
+func containerArg(container corev1.Container, flag string) (string, bool) {
+	args := append(append([]string{}, container.Command...), container.Args...)
+	for i, arg := range args {
+		if value, found := strings.CutPrefix(arg, flag+"="); found {
+			return value, true
+		}
+		if arg == flag && i+1 < len(args) {
+			return args[i+1], true
+		}
+	}
+	return "", false
+}
+
+// additionalItems returns the operator Deployment and its configuration ConfigMap, to be
+// backed up with the cluster
+func (c *operatorConfig) additionalItems() []velero.ResourceIdentifier {
+	items := []velero.ResourceIdentifier{{
+		GroupResource: schema.GroupResource{Group: "apps", Resource: "deployments"},
+		Namespace:     c.deployment.Namespace,
+		Name:          c.deployment.Name,
+	}}
+	if c.configMap != nil {
+		items = append(items, velero.ResourceIdentifier{
+			GroupResource: schema.GroupResource{Resource: "configmaps"},
+			Namespace:     c.configMap.Namespace,
+			Name:          c.configMap.Name,
+		})
+	}
+	return items
+}
+
+// operatorConfigDifferences describes the settings the destination operator sets
+// differently from the source operator, in the order of operatorParityKeys
+func operatorConfigDifferences(source, destination map[string]string) []string {
+	var differences []string
+	for _, key := range operatorParityKeys {
+		was, wasSet := source[key]
+		is, isSet := destination[key]
+		switch {
+		case wasSet && !isSet:
+			differences = append(differences, key+" is unset, was "+was)
+		case !wasSet && isSet:
+			differences = append(differences, key+" is "+is+", was unset")
+		case was != is:
+			differences = append(differences, key+" is "+is+", was "+was)
+		}
+	}
+	return differences
+}
+
+// backupOperatorConfig records the recovery-relevant settings of the CNPG operator on the
+// cluster and returns the operator Deployment and ConfigMap to back up with it. Failing to
+// read them is logged rather than failing the backup.
+func (p *BackupPluginV2) backupOperatorConfig(itemContent map[string]interface{}, selector string) []velero.ResourceIdentifier {
+	client, err := p.getKubeClient()
+	if err != nil {
+		p.log.Warnf("Failed to create Kubernetes client, not backing up the operator configuration: %v", err)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	config, err := readOperatorConfig(ctx, client, selector)
+	if err != nil {
+		p.log.Warnf("Not backing up the operator configuration: %v", err)
+		return nil
+	}
+	if config == nil {
+		p.log.Warnf("No CNPG operator Deployment matches %s, not backing up the operator configuration", selector)
+		return nil
+	}
+
+	raw, err := json.Marshal(config.settings)
+	if err != nil {
+		p.log.Warnf("Failed to encode the operator configuration: %v", err)
+		return nil
+	}
+	if err := p.addAnnotation(itemContent, AnnotationOperatorConfig, string(raw)); err != nil {
+		p.log.Warnf("Failed to annotate the operator configuration: %v", err)
+		return nil
+	}
+	p.log.Infof("Annotated cluster with the configuration of CNPG operator %s/%s", config.deployment.Namespace, config.deployment.Name)
+
+	return config.additionalItems()
+}
+
+// compareOperatorConfig warns when the CNPG operator of the destination cluster sets the
+// recovery-relevant settings recorded at backup time differently, since the restored
+// cluster may then come back with another image, metadata or certificates
+func (p *RestorePluginV2) compareOperatorConfig(itemContent map[string]interface{}, selector string, warnings *restoreWarnings) {
+	value, found, err := p.getAnnotation(itemContent, AnnotationOperatorConfig)
+	if err != nil || !found {
+		return
+	}
+
+	var source map[string]string
+	if err := json.Unmarshal([]byte(value), &source); err != nil {
+		warnings.Warnf("Invalid %s annotation, not comparing the operator configuration: %v", AnnotationOperatorConfig, err)
+		return
+	}
+
+	client, err := p.getKubeClient()
+	if err != nil {
+		p.log.Warnf("Failed to create Kubernetes client, not comparing the operator configuration: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	config, err := readOperatorConfig(ctx, client, selector)
+	if err != nil {
+		p.log.Warnf("Not comparing the operator configuration: %v", err)
+		return
+	}
+	if config == nil {
+		p.log.Warnf("No CNPG operator Deployment matches %s, not comparing the operator configuration", selector)
+		return
+	}
+
+	if differences := operatorConfigDifferences(source, config.settings); len(differences) > 0 {
+		warnings.Warnf("CNPG operator %s/%s is configured differently from the source cluster's: %s",
+			config.deployment.Namespace, config.deployment.Name, strings.Join(differences, "; "))
+	}
+}
@@ -0,0 +1,107 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// createMockConfiguredOperator returns a CNPG operator Deployment with the given container
+// args and environment, and its configuration ConfigMap with data when data is not nil
+func createMockConfiguredOperator(args []string, env map[string]string, data map[string]string) []runtime.Object {
+	deployment := createMockOperator("cnpg-system", nil)
+	container := &deployment.Spec.Template.Spec.Containers[0]
+	container.Args = args
+	for name, value := range env {
+		container.Env = append(container.Env, corev1.EnvVar{Name: name, Value: value})
+	}
+
+	objects := []runtime.Object{deployment}
+	if data != nil {
+		objects = append(objects, &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: defaultOperatorConfigMapName, Namespace: "cnpg-system"},
+			Data:       data,
+		})
+	}
+	return objects
+}
+
+func TestReadOperatorConfig(t *testing.T) {
+	t.Run("environment and ConfigMap", func(t *testing.T) {
+		client := fake.NewClientset(createMockConfiguredOperator(
+			[]string{"controller", "--leader-elect"},
+			map[string]string{postgresImageEnv: "ghcr.io/cloudnative-pg/postgresql:16.4", "OPERATOR_IMAGE_NAME": "ghcr.io/cloudnative-pg/cloudnative-pg:1.24.1"},
+			map[string]string{postgresImageEnv: "ghcr.io/cloudnative-pg/postgresql:17.0", "INHERITED_LABELS": "team"},
+		)...)
+
+		config, err := readOperatorConfig(context.Background(), client, defaultOperatorSelector)
+		require.NoError(t, err)
+		// The ConfigMap takes precedence and settings not affecting recovery are left out
+		assert.Equal(t, map[string]string{postgresImageEnv: "ghcr.io/cloudnative-pg/postgresql:17.0", "INHERITED_LABELS": "team"}, config.settings)
+		assert.Equal(t, []velero.ResourceIdentifier{
+			{GroupResource: schema.GroupResource{Group: "apps", Resource: "deployments"}, Namespace: "cnpg-system", Name: "cnpg-controller-manager"},
+			{GroupResource: schema.GroupResource{Resource: "configmaps"}, Namespace: "cnpg-system", Name: defaultOperatorConfigMapName},
+		}, config.additionalItems())
+	})
+
+	t.Run("ConfigMap named by flag", func(t *testing.T) {
+		client := fake.NewClientset(createMockConfiguredOperator([]string{"controller", "--config-map-name", "operator-config"}, nil, map[string]string{"INHERITED_LABELS": "team"})...)
+
+		config, err := readOperatorConfig(context.Background(), client, defaultOperatorSelector)
+		require.NoError(t, err)
+		assert.Nil(t, config.configMap)
+		assert.Empty(t, config.settings)
+	})
+
+	t.Run("no operator", func(t *testing.T) {
+		config, err := readOperatorConfig(context.Background(), fake.NewClientset(), defaultOperatorSelector)
+		require.NoError(t, err)
+		assert.Nil(t, config)
+	})
+}
+
+func TestOperatorConfigDifferences(t *testing.T) {
+	assert.Equal(t, []string{
+		"POSTGRES_IMAGE_NAME is ghcr.io/cloudnative-pg/postgresql:17.0, was ghcr.io/cloudnative-pg/postgresql:16.4",
+		"INHERITED_ANNOTATIONS is unset, was backup.example.com/*",
+		"KUBERNETES_CLUSTER_DOMAIN is dr.local, was unset",
+	}, operatorConfigDifferences(
+		map[string]string{postgresImageEnv: "ghcr.io/cloudnative-pg/postgresql:16.4", "INHERITED_ANNOTATIONS": "backup.example.com/*", "INHERITED_LABELS": "team"},
+		map[string]string{postgresImageEnv: "ghcr.io/cloudnative-pg/postgresql:17.0", "KUBERNETES_CLUSTER_DOMAIN": "dr.local", "INHERITED_LABELS": "team"},
+	))
+}
+
+func TestOperatorConfigParity(t *testing.T) {
+	source := fake.NewClientset(createMockConfiguredOperator(nil, map[string]string{postgresImageEnv: "ghcr.io/cloudnative-pg/postgresql:16.4"}, map[string]string{})...)
+	backupPlugin := &BackupPluginV2{log: logrus.New(), kubeClient: source}
+
+	cluster := createMockPluginCluster("pg", "default")
+	items := backupPlugin.backupOperatorConfig(cluster.Object, defaultOperatorSelector)
+	assert.Len(t, items, 2)
+	assert.JSONEq(t, `{"POSTGRES_IMAGE_NAME":"ghcr.io/cloudnative-pg/postgresql:16.4"}`, cluster.GetAnnotations()[AnnotationOperatorConfig])
+
+	t.Run("same configuration", func(t *testing.T) {
+		restorePlugin := &RestorePluginV2{log: logrus.New(), kubeClient: source}
+		warnings := &restoreWarnings{log: logrus.New()}
+		restorePlugin.compareOperatorConfig(cluster.Object, defaultOperatorSelector, warnings)
+		assert.Empty(t, warnings.messages)
+	})
+
+	t.Run("different configuration", func(t *testing.T) {
+		destination := fake.NewClientset(createMockConfiguredOperator(nil, map[string]string{postgresImageEnv: "ghcr.io/cloudnative-pg/postgresql:17.0"}, nil)...)
+		restorePlugin := &RestorePluginV2{log: logrus.New(), kubeClient: destination}
+		warnings := &restoreWarnings{log: logrus.New()}
+		restorePlugin.compareOperatorConfig(cluster.Object, defaultOperatorSelector, warnings)
+		require.Len(t, warnings.messages, 1)
+		assert.Contains(t, warnings.messages[0], "CNPG operator cnpg-system/cnpg-controller-manager is configured differently from the source cluster's: POSTGRES_IMAGE_NAME is ghcr.io/cloudnative-pg/postgresql:17.0")
+	})
+}
@@ -0,0 +1,96 @@
+package plugin
+
+import (
+	"github.com/nvanthao/velero-plugin-cnpg-restore/pkg/override"
+	"github.com/sirupsen/logrus"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework/common"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// OverrideConfigMapName is the name of the ConfigMap the restore action writes the
+// serverName mapping of a restored cluster to
+const OverrideConfigMapName = override.ConfigMapName
+
+// LabelOverrideConfigMap labels the override ConfigMaps the restore action writes, so the
+// override ConfigMap action is only invoked for them rather than for every ConfigMap
+const LabelOverrideConfigMap = "velero-cnpg/override"
+
+// OverrideConfigMapRestorePlugin is a restore item action plugin for Velero that skips
+// cnpg-velero-override ConfigMaps contained in a backup. The CNPG restore action writes
+// a fresh one with the current serverNames, which the stale copy would otherwise overwrite.
+// When the CNPG restore action is not registered, nothing writes a fresh one, so the copy
+// from the backup is restored.
+type OverrideConfigMapRestorePlugin struct {
+	log logrus.FieldLogger
+
+	// config overrides the plugin ConfigMap lookup when set
+	config *PluginConfig
+}
+
+// NewOverrideConfigMapRestorePlugin instantiates a new OverrideConfigMapRestorePlugin.
+func NewOverrideConfigMapRestorePlugin(log logrus.FieldLogger) *OverrideConfigMapRestorePlugin {
+	return &OverrideConfigMapRestorePlugin{log: log}
+}
+
+// getConfig returns the plugin configuration, see loadActionConfig
+func (p *OverrideConfigMapRestorePlugin) getConfig() (*PluginConfig, error) {
+	return loadActionConfig(p.config, common.PluginKindRestoreItemAction, OverrideConfigMapRestorePluginName)
+}
+
+// Name is required to implement the interface, but the Velero pod does not delegate this
+// method -- it's used to tell velero what name it was registered under. The plugin implementation
+// must define it, but it will never actually be called.
+func (p *OverrideConfigMapRestorePlugin) Name() string {
+	return "overrideConfigMapRestorePlugin"
+}
+
+// AppliesTo returns information about which resources this action should be invoked for.
+func (p *OverrideConfigMapRestorePlugin) AppliesTo() (velero.ResourceSelector, error) {
+	config, err := p.getConfig()
+	if err != nil {
+		return noNamespaces(), err
+	}
+	return config.scopeNamespaces(velero.ResourceSelector{
+		IncludedResources: []string{"configmaps"},
+		LabelSelector:     LabelOverrideConfigMap,
+	}), nil
+}
+
+// Execute skips the restore of cnpg-velero-override ConfigMaps
+func (p *OverrideConfigMapRestorePlugin) Execute(input *velero.RestoreItemActionExecuteInput) (_ *velero.RestoreItemActionExecuteOutput, err error) {
+	defer reportError(p.log, "override ConfigMap restore plugin", input.Item, &err)
+	defer recoverPanic(p.log, "override ConfigMap restore plugin", input.Item, &err)
+
+	if restoreDisabled(input.Restore) {
+		p.log.Infof("Restore has %s set, passing item through unmodified", AnnotationDisable)
+		return velero.NewRestoreItemActionExecuteOutput(input.Item), nil
+	}
+
+	configMap := &unstructured.Unstructured{Object: input.Item.UnstructuredContent()}
+
+	if configMap.GetName() == OverrideConfigMapName {
+		if !restoreActionRegistered() {
+			p.log.Infof("Restoring ConfigMap %s/%s from the backup, the CNPG restore action is not registered to write a current one", configMap.GetNamespace(), configMap.GetName())
+			return velero.NewRestoreItemActionExecuteOutput(input.Item), nil
+		}
+		p.log.Infof("Skipping ConfigMap %s/%s from the backup, the CNPG restore action writes a current one", configMap.GetNamespace(), configMap.GetName())
+		return velero.NewRestoreItemActionExecuteOutput(input.Item).WithoutRestore(), nil
+	}
+
+	return velero.NewRestoreItemActionExecuteOutput(input.Item), nil
+}
+
+func (p *OverrideConfigMapRestorePlugin) Progress(operationID string, restore *v1.Restore) (velero.OperationProgress, error) {
+	progress := velero.OperationProgress{}
+	return progress, nil
+}
+
+func (p *OverrideConfigMapRestorePlugin) Cancel(operationID string, restore *v1.Restore) error {
+	return nil
+}
+
+func (p *OverrideConfigMapRestorePlugin) AreAdditionalItemsReady(additionalItems []velero.ResourceIdentifier, restore *v1.Restore) (bool, error) {
+	return true, nil
+}
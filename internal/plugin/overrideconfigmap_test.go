@@ -0,0 +1,88 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestOverrideConfigMapRestorePluginAppliesTo(t *testing.T) {
+	plugin := &OverrideConfigMapRestorePlugin{
+		log:    logrus.New(),
+		config: &PluginConfig{ExcludedNamespaces: []string{"kube-system"}},
+	}
+
+	selector, err := plugin.AppliesTo()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"configmaps"}, selector.IncludedResources)
+	assert.Equal(t, LabelOverrideConfigMap, selector.LabelSelector)
+	assert.Equal(t, []string{"kube-system"}, selector.ExcludedNamespaces)
+}
+
+func TestOverrideConfigMapRestorePluginExecute(t *testing.T) {
+	plugin := &OverrideConfigMapRestorePlugin{
+		log: logrus.New(),
+	}
+
+	tests := []struct {
+		name             string
+		configMap        string
+		disabledActions  string
+		restoreInstances string
+		expectSkip       bool
+	}{
+		{
+			name:       "override ConfigMap is skipped",
+			configMap:  OverrideConfigMapName,
+			expectSkip: true,
+		},
+		{
+			name:      "other ConfigMaps are restored",
+			configMap: "app-config",
+		},
+		{
+			name:            "override ConfigMap is restored without the CNPG restore action",
+			configMap:       OverrideConfigMapName,
+			disabledActions: "cnpg-restore-plugin",
+		},
+		{
+			name:             "override ConfigMap is skipped with an instance of the CNPG restore action",
+			configMap:        OverrideConfigMapName,
+			disabledActions:  "cnpg-restore-plugin",
+			restoreInstances: "tier-a",
+			expectSkip:       true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(EnvDisabledActions, tt.disabledActions)
+			t.Setenv(EnvRestoreInstances, tt.restoreInstances)
+
+			item := &unstructured.Unstructured{}
+			item.SetUnstructuredContent(map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "ConfigMap",
+				"metadata": map[string]interface{}{
+					"name":      tt.configMap,
+					"namespace": "default",
+					"labels": map[string]interface{}{
+						LabelOverrideConfigMap: "true",
+					},
+				},
+				"data": map[string]interface{}{
+					"write_to_server_name":  "pg-20250101-000000",
+					"read_from_server_name": "pg",
+				},
+			})
+
+			output, err := plugin.Execute(&velero.RestoreItemActionExecuteInput{Item: item})
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectSkip, output.SkipRestore)
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package plugin
+
+import (
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework/common"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// PDBRestorePlugin is a restore item action plugin for Velero that skips PodDisruptionBudgets
+// owned by CNPG Clusters. The operator recreates them for the restored cluster, and stale
+// copies can block node drains or conflict on ownership.
+type PDBRestorePlugin struct {
+	log logrus.FieldLogger
+
+	// config overrides the plugin ConfigMap lookup when set
+	config *PluginConfig
+}
+
+// NewPDBRestorePlugin instantiates a new PDBRestorePlugin.
+func NewPDBRestorePlugin(log logrus.FieldLogger) *PDBRestorePlugin {
+	return &PDBRestorePlugin{log: log}
+}
+
+// getConfig returns the plugin configuration, see loadActionConfig
+func (p *PDBRestorePlugin) getConfig() (*PluginConfig, error) {
+	return loadActionConfig(p.config, common.PluginKindRestoreItemAction, PDBRestorePluginName)
+}
+
+// Name is required to implement the interface, but the Velero pod does not delegate this
+// method -- it's used to tell velero what name it was registered under. The plugin implementation
+// must define it, but it will never actually be called.
+func (p *PDBRestorePlugin) Name() string {
+	return "pdbRestorePlugin"
+}
+
+// AppliesTo returns information about which resources this action should be invoked for.
+func (p *PDBRestorePlugin) AppliesTo() (velero.ResourceSelector, error) {
+	config, err := p.getConfig()
+	if err != nil {
+		return noNamespaces(), err
+	}
+	return config.scopeNamespaces(velero.ResourceSelector{
+		IncludedResources: []string{"poddisruptionbudgets.policy"},
+	}), nil
+}
+
+// Execute skips the restore of PodDisruptionBudgets owned by a CNPG Cluster
+func (p *PDBRestorePlugin) Execute(input *velero.RestoreItemActionExecuteInput) (_ *velero.RestoreItemActionExecuteOutput, err error) {
+	defer reportError(p.log, "PDB restore plugin", input.Item, &err)
+	defer recoverPanic(p.log, "PDB restore plugin", input.Item, &err)
+
+	if restoreDisabled(input.Restore) {
+		p.log.Infof("Restore has %s set, passing item through unmodified", AnnotationDisable)
+		return velero.NewRestoreItemActionExecuteOutput(input.Item), nil
+	}
+
+	pdb := &unstructured.Unstructured{Object: input.Item.UnstructuredContent()}
+
+	if clusterName, owned := cnpgClusterOwner(pdb); owned {
+		p.log.Infof("Skipping PodDisruptionBudget %s/%s owned by CNPG cluster %s, the operator recreates it", pdb.GetNamespace(), pdb.GetName(), clusterName)
+		return velero.NewRestoreItemActionExecuteOutput(input.Item).WithoutRestore(), nil
+	}
+
+	return velero.NewRestoreItemActionExecuteOutput(input.Item), nil
+}
+
+// cnpgClusterOwner returns the name of the CNPG Cluster owning the object, if any
+func cnpgClusterOwner(obj *unstructured.Unstructured) (string, bool) {
+	for _, owner := range obj.GetOwnerReferences() {
+		if owner.Kind == "Cluster" && strings.HasPrefix(owner.APIVersion, cnpgClusterGVR.Group+"/") {
+			return owner.Name, true
+		}
+	}
+	return "", false
+}
+
+func (p *PDBRestorePlugin) Progress(operationID string, restore *v1.Restore) (velero.OperationProgress, error) {
+	progress := velero.OperationProgress{}
+	return progress, nil
+}
+
+func (p *PDBRestorePlugin) Cancel(operationID string, restore *v1.Restore) error {
+	return nil
+}
+
+func (p *PDBRestorePlugin) AreAdditionalItemsReady(additionalItems []velero.ResourceIdentifier, restore *v1.Restore) (bool, error) {
+	return true, nil
+}
@@ -0,0 +1,81 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestPDBRestorePluginAppliesTo(t *testing.T) {
+	plugin := &PDBRestorePlugin{
+		log:    logrus.New(),
+		config: &PluginConfig{ExcludedNamespaces: []string{"kube-system", "vendor-*"}},
+	}
+
+	selector, err := plugin.AppliesTo()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"poddisruptionbudgets.policy"}, selector.IncludedResources)
+	assert.Equal(t, []string{"kube-system", "vendor-*"}, selector.ExcludedNamespaces)
+}
+
+func TestPDBRestorePluginExecute(t *testing.T) {
+	plugin := &PDBRestorePlugin{
+		log: logrus.New(),
+	}
+
+	tests := []struct {
+		name           string
+		ownerReference map[string]interface{}
+		expectSkip     bool
+	}{
+		{
+			name: "PDB owned by a CNPG cluster is skipped",
+			ownerReference: map[string]interface{}{
+				"apiVersion": "postgresql.cnpg.io/v1",
+				"kind":       "Cluster",
+				"name":       "pg",
+				"uid":        "1234",
+			},
+			expectSkip: true,
+		},
+		{
+			name: "PDB owned by another Cluster kind is restored",
+			ownerReference: map[string]interface{}{
+				"apiVersion": "example.com/v1",
+				"kind":       "Cluster",
+				"name":       "pg",
+				"uid":        "1234",
+			},
+		},
+		{
+			name: "PDB without owner is restored",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metadata := map[string]interface{}{
+				"name":      "pg-primary",
+				"namespace": "default",
+			}
+			if tt.ownerReference != nil {
+				metadata["ownerReferences"] = []interface{}{tt.ownerReference}
+			}
+
+			item := &unstructured.Unstructured{}
+			item.SetUnstructuredContent(map[string]interface{}{
+				"apiVersion": "policy/v1",
+				"kind":       "PodDisruptionBudget",
+				"metadata":   metadata,
+			})
+
+			output, err := plugin.Execute(&velero.RestoreItemActionExecuteInput{Item: item})
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectSkip, output.SkipRestore)
+		})
+	}
+}
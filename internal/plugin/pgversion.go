@@ -0,0 +1,146 @@
+package plugin
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes"
+)
+
+// AnnotationPostgresMajorVersion is the annotation key used to store the PostgreSQL major
+// version the cluster ran at backup time
+const AnnotationPostgresMajorVersion = "velero-cnpg/postgres-major-version"
+
+// postgresImageEnv is the operator environment variable holding the default PostgreSQL
+// image for clusters without imageName or imageCatalogRef
+const postgresImageEnv = "POSTGRES_IMAGE_NAME"
+
+// majorFromImage parses the PostgreSQL major version from an image tag such as 16.2,
+// 16.2-bookworm or 17-standard-bookworm
+func majorFromImage(image string) (int, bool) {
+	tag := imageTag(image)
+	end := 0
+	for end < len(tag) && tag[end] >= '0' && tag[end] <= '9' {
+		end++
+	}
+	if end == 0 || (end < len(tag) && tag[end] != '.' && tag[end] != '-') {
+		return 0, false
+	}
+
+	major, err := strconv.Atoi(tag[:end])
+	return major, err == nil
+}
+
+// specMajorVersion returns the PostgreSQL major version requested by the cluster spec,
+// through imageCatalogRef or imageName
+func specMajorVersion(itemContent map[string]interface{}) (int, bool) {
+	if major, found, _ := unstructured.NestedInt64(itemContent, "spec", "imageCatalogRef", "major"); found {
+		return int(major), true
+	}
+	if image, found, _ := unstructured.NestedString(itemContent, "spec", "imageName"); found && image != "" {
+		return majorFromImage(image)
+	}
+	return 0, false
+}
+
+// clusterMajorVersion returns the PostgreSQL major version a cluster runs, preferring the
+// spec and falling back to the image reported in its status
+func clusterMajorVersion(itemContent map[string]interface{}) (int, bool) {
+	if major, found := specMajorVersion(itemContent); found {
+		return major, true
+	}
+	if major, found, _ := unstructured.NestedInt64(itemContent, "status", "pgDataImageInfo", "majorVersion"); found {
+		return int(major), true
+	}
+	if image, found, _ := unstructured.NestedString(itemContent, "status", "image"); found && image != "" {
+		return majorFromImage(image)
+	}
+	return 0, false
+}
+
+// operatorDefaultMajorVersion returns the PostgreSQL major version of the default image of
+// the CNPG operator, for clusters that do not pick an image themselves
+func operatorDefaultMajorVersion(ctx context.Context, client kubernetes.Interface, selector string) (int, bool, error) {
+	deployments, err := client.AppsV1().Deployments(metav1.NamespaceAll).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return 0, false, errors.Wrap(classifyAPIError(err), "failed to list CNPG operator Deployments")
+	}
+
+	for _, deployment := range deployments.Items {
+		for _, container := range deployment.Spec.Template.Spec.Containers {
+			for _, env := range container.Env {
+				if env.Name == postgresImageEnv && env.Value != "" {
+					major, found := majorFromImage(env.Value)
+					return major, found, nil
+				}
+			}
+		}
+	}
+	return 0, false, nil
+}
+
+// annotateMajorVersion records the PostgreSQL major version of the cluster, when it can be
+// determined from the cluster itself
+func (p *BackupPluginV2) annotateMajorVersion(itemContent map[string]interface{}) {
+	major, found := clusterMajorVersion(itemContent)
+	if !found {
+		p.log.Info("Could not determine the PostgreSQL major version, not annotating it")
+		return
+	}
+
+	if err := p.addAnnotation(itemContent, AnnotationPostgresMajorVersion, strconv.Itoa(major)); err != nil {
+		p.log.Warnf("Failed to annotate PostgreSQL major version: %v", err)
+		return
+	}
+	p.log.Infof("Annotated cluster with PostgreSQL major version: %d", major)
+}
+
+// checkMajorVersion refuses to recover a cluster onto an older PostgreSQL major version
+// than it was backed up with, since a data directory cannot be downgraded and WAL cannot
+// be replayed across major versions. The target version comes from the cluster spec, or
+// the operator's default image. The check is skipped when either version is unknown.
+func (p *RestorePluginV2) checkMajorVersion(itemContent map[string]interface{}, operatorSelector string) error {
+	value, found, err := p.getAnnotation(itemContent, AnnotationPostgresMajorVersion)
+	if err != nil || !found {
+		return err
+	}
+	backupMajor, err := strconv.Atoi(value)
+	if err != nil {
+		return errors.Wrapf(err, "invalid %s annotation %q", AnnotationPostgresMajorVersion, value)
+	}
+
+	targetMajor, found := specMajorVersion(itemContent)
+	source := "cluster spec"
+	if !found {
+		client, err := p.getKubeClient()
+		if err != nil {
+			p.log.Warnf("Failed to create Kubernetes client, skipping PostgreSQL major version check: %v", err)
+			return nil
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		targetMajor, found, err = operatorDefaultMajorVersion(ctx, client, operatorSelector)
+		if err != nil {
+			p.log.Warnf("Skipping PostgreSQL major version check: %v", err)
+			return nil
+		}
+		if !found {
+			p.log.Info("Could not determine the target PostgreSQL major version, skipping major version check")
+			return nil
+		}
+		source = "operator's default image"
+	}
+
+	if targetMajor < backupMajor {
+		return errors.Errorf("cluster was backed up with PostgreSQL %d but the %s resolves to PostgreSQL %d; "+
+			"recovery cannot downgrade a major version, set imageName or imageCatalogRef to PostgreSQL %d or later",
+			backupMajor, source, targetMajor, backupMajor)
+	}
+	return nil
+}
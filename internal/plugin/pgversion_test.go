@@ -0,0 +1,181 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestMajorFromImage(t *testing.T) {
+	tests := []struct {
+		image         string
+		expected      int
+		expectedFound bool
+	}{
+		{image: "ghcr.io/cloudnative-pg/postgresql:16.2", expected: 16, expectedFound: true},
+		{image: "ghcr.io/cloudnative-pg/postgresql:16.2-bookworm", expected: 16, expectedFound: true},
+		{image: "ghcr.io/cloudnative-pg/postgresql:17-standard-bookworm", expected: 17, expectedFound: true},
+		{image: "registry.local:5000/postgresql:15", expected: 15, expectedFound: true},
+		{image: "ghcr.io/cloudnative-pg/postgresql:latest"},
+		{image: "ghcr.io/cloudnative-pg/postgresql"},
+		{image: "ghcr.io/cloudnative-pg/postgresql:16rc1"},
+	}
+
+	for _, tt := range tests {
+		major, found := majorFromImage(tt.image)
+		assert.Equal(t, tt.expected, major, tt.image)
+		assert.Equal(t, tt.expectedFound, found, tt.image)
+	}
+}
+
+func TestClusterMajorVersion(t *testing.T) {
+	tests := []struct {
+		name          string
+		cluster       map[string]interface{}
+		expected      int
+		expectedFound bool
+	}{
+		{
+			name: "image catalog",
+			cluster: map[string]interface{}{
+				"spec": map[string]interface{}{
+					"imageCatalogRef": map[string]interface{}{"kind": "ClusterImageCatalog", "name": "postgresql", "major": int64(17)},
+				},
+			},
+			expected:      17,
+			expectedFound: true,
+		},
+		{
+			name: "image name",
+			cluster: map[string]interface{}{
+				"spec": map[string]interface{}{"imageName": "ghcr.io/cloudnative-pg/postgresql:16.4"},
+			},
+			expected:      16,
+			expectedFound: true,
+		},
+		{
+			name: "status image info",
+			cluster: map[string]interface{}{
+				"spec":   map[string]interface{}{},
+				"status": map[string]interface{}{"pgDataImageInfo": map[string]interface{}{"majorVersion": int64(15)}},
+			},
+			expected:      15,
+			expectedFound: true,
+		},
+		{
+			name: "status image",
+			cluster: map[string]interface{}{
+				"spec":   map[string]interface{}{},
+				"status": map[string]interface{}{"image": "ghcr.io/cloudnative-pg/postgresql:14.12"},
+			},
+			expected:      14,
+			expectedFound: true,
+		},
+		{
+			name:    "unknown",
+			cluster: map[string]interface{}{"spec": map[string]interface{}{}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			major, found := clusterMajorVersion(tt.cluster)
+			assert.Equal(t, tt.expected, major)
+			assert.Equal(t, tt.expectedFound, found)
+		})
+	}
+}
+
+func TestAnnotateMajorVersion(t *testing.T) {
+	plugin := &BackupPluginV2{log: logrus.New()}
+
+	cluster := createMockArchivingCluster("pg", "default", "pg", nil)
+	cluster.Object["status"] = map[string]interface{}{"image": "ghcr.io/cloudnative-pg/postgresql:16.4"}
+	plugin.annotateMajorVersion(cluster.Object)
+	assert.Equal(t, "16", cluster.GetAnnotations()[AnnotationPostgresMajorVersion])
+
+	cluster = createMockArchivingCluster("pg", "default", "pg", nil)
+	plugin.annotateMajorVersion(cluster.Object)
+	assert.NotContains(t, cluster.GetAnnotations(), AnnotationPostgresMajorVersion)
+}
+
+func TestCheckMajorVersion(t *testing.T) {
+	operator := func(image string) []runtime.Object {
+		return []runtime.Object{createMockOperator("cnpg-system", &corev1.EnvVar{Name: postgresImageEnv, Value: image})}
+	}
+
+	tests := []struct {
+		name          string
+		annotation    string
+		imageName     string
+		objects       []runtime.Object
+		expectedError string
+	}{
+		{
+			name:      "no version recorded",
+			imageName: "ghcr.io/cloudnative-pg/postgresql:15",
+		},
+		{
+			name:       "same major",
+			annotation: "16",
+			imageName:  "ghcr.io/cloudnative-pg/postgresql:16.4",
+		},
+		{
+			name:       "newer major",
+			annotation: "16",
+			imageName:  "ghcr.io/cloudnative-pg/postgresql:17.0",
+		},
+		{
+			name:          "older major in spec",
+			annotation:    "16",
+			imageName:     "ghcr.io/cloudnative-pg/postgresql:15.8",
+			expectedError: "backed up with PostgreSQL 16 but the cluster spec resolves to PostgreSQL 15",
+		},
+		{
+			name:          "older operator default",
+			annotation:    "17",
+			objects:       operator("ghcr.io/cloudnative-pg/postgresql:16.4"),
+			expectedError: "operator's default image resolves to PostgreSQL 16",
+		},
+		{
+			name:       "operator default matches",
+			annotation: "16",
+			objects:    operator("ghcr.io/cloudnative-pg/postgresql:16.4"),
+		},
+		{
+			name:       "target unknown",
+			annotation: "16",
+		},
+		{
+			name:          "invalid annotation",
+			annotation:    "sixteen",
+			expectedError: "invalid velero-cnpg/postgres-major-version annotation",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plugin := &RestorePluginV2{log: logrus.New(), kubeClient: fake.NewSimpleClientset(tt.objects...)}
+
+			cluster := createMockArchivingCluster("pg", "default", "pg", nil)
+			if tt.annotation != "" {
+				cluster.SetAnnotations(map[string]string{AnnotationPostgresMajorVersion: tt.annotation})
+			}
+			if tt.imageName != "" {
+				cluster.Object["spec"].(map[string]interface{})["imageName"] = tt.imageName
+			}
+
+			err := plugin.checkMajorVersion(cluster.Object, defaultOperatorSelector)
+			if tt.expectedError != "" {
+				assert.ErrorContains(t, err, tt.expectedError)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package plugin
+
+import "github.com/pkg/errors"
+
+// walArchiverParameter returns the string parameter key of the plugin entry that archives
+// WAL. A cluster can list several plugins carrying the same parameter, so entries are
+// ranked: isWALArchiver first, then the barman-cloud plugin name. Ties go to the entry
+// listed first, so the choice does not depend on anything but the spec.
+func walArchiverParameter(plugins []interface{}, key string) (string, bool) {
+	entry := walArchiverEntry(plugins, key, true)
+	if entry == nil {
+		return "", false
+	}
+	return entryParameter(entry, key), true
+}
+
+// walArchiverEntry returns the highest ranked plugin entry carrying the string parameter key,
+// leaving out disabled entries unless includeDisabled is set
+func walArchiverEntry(plugins []interface{}, key string, includeDisabled bool) map[string]interface{} {
+	var best map[string]interface{}
+	bestRank := -1
+	for _, plugin := range sliceOfMaps(plugins) {
+		params, ok := plugin["parameters"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if _, ok := params[key].(string); !ok {
+			continue
+		}
+		if !includeDisabled && !pluginEnabled(plugin) {
+			continue
+		}
+
+		rank := 0
+		if archiver, _ := plugin["isWALArchiver"].(bool); archiver {
+			rank += 2
+		}
+		if plugin["name"] == BarmanCloudPluginName {
+			rank++
+		}
+		if rank > bestRank {
+			best, bestRank = plugin, rank
+		}
+	}
+
+	return best
+}
+
+// pluginEnabled reports whether a plugin entry is enabled, which CNPG defaults to true
+func pluginEnabled(plugin map[string]interface{}) bool {
+	enabled, ok := plugin["enabled"].(bool)
+	return !ok || enabled
+}
+
+// enabledWALArchiverParameter returns the string parameter key of the WAL archiver entry,
+// handling a disabled entry according to policy: skip uses the best enabled entry instead,
+// warn keeps the disabled entry, and fail returns an error. warn is called for the first two.
+func enabledWALArchiverParameter(plugins []interface{}, key, policy string, warn func(format string, args ...interface{})) (string, error) {
+	entry := walArchiverEntry(plugins, key, true)
+	if entry == nil {
+		return "", nil
+	}
+	if pluginEnabled(entry) {
+		return entryParameter(entry, key), nil
+	}
+
+	name, _ := entry["name"].(string)
+	switch policy {
+	case DisabledPluginFail:
+		return "", errors.Errorf("plugin %s is disabled (enabled: false), the Velero backup would not be restorable from it", name)
+	case DisabledPluginWarn:
+		warn("Plugin %s is disabled (enabled: false), recording its %s anyway", name, key)
+		return entryParameter(entry, key), nil
+	default:
+		warn("Plugin %s is disabled (enabled: false), ignoring its %s", name, key)
+		entry = walArchiverEntry(plugins, key, false)
+		if entry == nil {
+			return "", nil
+		}
+		return entryParameter(entry, key), nil
+	}
+}
+
+// entryParameter returns a parameter of a plugin entry returned by walArchiverEntry
+func entryParameter(entry map[string]interface{}, key string) string {
+	params, _ := entry["parameters"].(map[string]interface{})
+	value, _ := params[key].(string)
+	return value
+}
@@ -0,0 +1,155 @@
+package plugin
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWALArchiverParameter(t *testing.T) {
+	entry := func(name string, archiver bool, serverName string) interface{} {
+		plugin := map[string]interface{}{
+			"name":       name,
+			"parameters": map[string]interface{}{"serverName": serverName},
+		}
+		if archiver {
+			plugin["isWALArchiver"] = true
+		}
+		return plugin
+	}
+
+	tests := []struct {
+		name          string
+		plugins       []interface{}
+		expected      string
+		expectedFound bool
+	}{
+		{
+			name: "no plugins",
+		},
+		{
+			name: "parameter missing",
+			plugins: []interface{}{
+				map[string]interface{}{"name": BarmanCloudPluginName, "parameters": map[string]interface{}{"barmanObjectName": "store"}},
+			},
+		},
+		{
+			name:          "single entry",
+			plugins:       []interface{}{entry("other.example.com", false, "pg")},
+			expected:      "pg",
+			expectedFound: true,
+		},
+		{
+			name: "WAL archiver wins over earlier entries",
+			plugins: []interface{}{
+				entry(BarmanCloudPluginName, false, "pg-secondary"),
+				entry("other.example.com", true, "pg-archiver"),
+			},
+			expected:      "pg-archiver",
+			expectedFound: true,
+		},
+		{
+			name: "barman-cloud plugin breaks ties",
+			plugins: []interface{}{
+				entry("other.example.com", true, "pg-other"),
+				entry(BarmanCloudPluginName, true, "pg-barman"),
+			},
+			expected:      "pg-barman",
+			expectedFound: true,
+		},
+		{
+			name: "first entry wins remaining ties",
+			plugins: []interface{}{
+				entry("other.example.com", false, "pg-first"),
+				entry("another.example.com", false, "pg-second"),
+			},
+			expected:      "pg-first",
+			expectedFound: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, found := walArchiverParameter(tt.plugins, "serverName")
+			assert.Equal(t, tt.expected, value)
+			assert.Equal(t, tt.expectedFound, found)
+		})
+	}
+}
+
+func TestEnabledWALArchiverParameter(t *testing.T) {
+	plugins := []interface{}{
+		map[string]interface{}{
+			"name":          BarmanCloudPluginName,
+			"enabled":       false,
+			"isWALArchiver": true,
+			"parameters":    map[string]interface{}{"serverName": "pg-disabled"},
+		},
+		map[string]interface{}{
+			"name":       "other.example.com",
+			"enabled":    true,
+			"parameters": map[string]interface{}{"serverName": "pg-enabled"},
+		},
+	}
+
+	tests := []struct {
+		name           string
+		plugins        []interface{}
+		policy         string
+		expected       string
+		expectedError  string
+		expectWarnings int
+	}{
+		{
+			name:           "disabled entry skipped by default",
+			plugins:        plugins,
+			expected:       "pg-enabled",
+			expectWarnings: 1,
+		},
+		{
+			name:           "only entry disabled",
+			plugins:        plugins[:1],
+			policy:         DisabledPluginSkip,
+			expectWarnings: 1,
+		},
+		{
+			name:           "disabled entry kept with warn",
+			plugins:        plugins,
+			policy:         DisabledPluginWarn,
+			expected:       "pg-disabled",
+			expectWarnings: 1,
+		},
+		{
+			name:          "disabled entry fails",
+			plugins:       plugins,
+			policy:        DisabledPluginFail,
+			expectedError: "plugin barman-cloud.cloudnative-pg.io is disabled",
+		},
+		{
+			name:     "enabled entry",
+			plugins:  plugins[1:],
+			policy:   DisabledPluginFail,
+			expected: "pg-enabled",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var warnings []string
+			warn := func(format string, args ...interface{}) {
+				warnings = append(warnings, fmt.Sprintf(format, args...))
+			}
+
+			value, err := enabledWALArchiverParameter(tt.plugins, "serverName", tt.policy, warn)
+			if tt.expectedError != "" {
+				assert.ErrorContains(t, err, tt.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, value)
+			assert.Len(t, warnings, tt.expectWarnings)
+		})
+	}
+}
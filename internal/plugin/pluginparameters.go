@@ -0,0 +1,118 @@
+package plugin
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// AnnotationPluginParameters is the annotation key used to store the parameters of the
+// spec.plugins entries at backup time, as a JSON object keyed by plugin name
+const AnnotationPluginParameters = "velero-cnpg/plugin-parameters"
+
+// pluginParameters returns the string parameters of each spec.plugins entry, keyed by
+// plugin name. Entries without a name or parameters are left out.
+func pluginParameters(itemContent map[string]interface{}) map[string]map[string]string {
+	plugins, _, _ := unstructured.NestedFieldNoCopy(itemContent, "spec", "plugins")
+	parameters := map[string]map[string]string{}
+	for _, plugin := range sliceOfMaps(plugins) {
+		name, _ := plugin["name"].(string)
+		params, ok := plugin["parameters"].(map[string]interface{})
+		if name == "" || !ok {
+			continue
+		}
+		values := make(map[string]string, len(params))
+		for key, value := range params {
+			if value, ok := value.(string); ok {
+				values[key] = value
+			}
+		}
+		parameters[name] = values
+	}
+	return parameters
+}
+
+// annotatePluginParameters records the parameters of the cluster's plugins, so the restore
+// can reconstruct them from the backup. Failing to record them is logged rather than
+// failing the backup.
+func (p *BackupPluginV2) annotatePluginParameters(itemContent map[string]interface{}) {
+	unstructured.RemoveNestedField(itemContent, "metadata", "annotations", AnnotationPluginParameters)
+
+	parameters := pluginParameters(itemContent)
+	if len(parameters) == 0 {
+		return
+	}
+	raw, err := json.Marshal(parameters)
+	if err == nil {
+		err = p.addAnnotation(itemContent, AnnotationPluginParameters, string(raw))
+	}
+	if err != nil {
+		p.log.Warnf("Failed to annotate plugin parameters: %v", err)
+	}
+}
+
+// reconstructPluginParameters puts back the parameters of the spec.plugins entries as
+// recorded at backup time, when edits to the backup, or an operator defaulting them on
+// an existing cluster, changed them. Each reconstructed entry is reported as a restore
+// warning naming the parameters that changed. Entries removed since the backup are
+// reported and not added back, since only their parameters were recorded.
+func (p *RestorePluginV2) reconstructPluginParameters(itemContent map[string]interface{}, warnings *restoreWarnings) error {
+	value, found, err := p.getAnnotation(itemContent, AnnotationPluginParameters)
+	if err != nil || !found {
+		return err
+	}
+
+	var recorded map[string]map[string]string
+	if err := json.Unmarshal([]byte(value), &recorded); err != nil {
+		return errors.Wrapf(err, "failed to decode %s annotation", AnnotationPluginParameters)
+	}
+
+	plugins, _, _ := unstructured.NestedFieldNoCopy(itemContent, "spec", "plugins")
+	entries := map[string]map[string]interface{}{}
+	for _, plugin := range sliceOfMaps(plugins) {
+		if name, _ := plugin["name"].(string); name != "" {
+			entries[name] = plugin
+		}
+	}
+
+	names := make([]string, 0, len(recorded))
+	for name := range recorded {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		entry, found := entries[name]
+		if !found {
+			warnings.Warnf("Plugin %s was removed from spec.plugins since the backup, not reconstructing its parameters", name)
+			continue
+		}
+
+		current, _ := entry["parameters"].(map[string]interface{})
+		var changed []string
+		parameters := make(map[string]interface{}, len(recorded[name]))
+		for key, value := range recorded[name] {
+			parameters[key] = value
+			if current[key] != value {
+				changed = append(changed, key)
+			}
+		}
+		for key := range current {
+			if _, found := recorded[name][key]; !found {
+				changed = append(changed, key)
+			}
+		}
+		if len(changed) == 0 {
+			continue
+		}
+
+		sort.Strings(changed)
+		entry["parameters"] = parameters
+		warnings.Warnf("Reconstructed the parameters of plugin %s as backed up, %s had changed", name, strings.Join(changed, ", "))
+	}
+
+	return nil
+}
@@ -0,0 +1,91 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestAnnotatePluginParameters(t *testing.T) {
+	plugin := &BackupPluginV2{log: logrus.New()}
+
+	t.Run("records the parameters of every plugin", func(t *testing.T) {
+		cluster := createMockPluginCluster("pg", "default")
+		plugins, _, _ := unstructured.NestedSlice(cluster.Object, "spec", "plugins")
+		plugins = append(plugins, map[string]interface{}{"name": "example.com/audit", "parameters": map[string]interface{}{"level": "ddl"}})
+		require.NoError(t, unstructured.SetNestedSlice(cluster.Object, plugins, "spec", "plugins"))
+
+		plugin.annotatePluginParameters(cluster.Object)
+		assert.JSONEq(t, `{"barman-cloud.cloudnative-pg.io":{"barmanObjectName":"store","serverName":"pg"},"example.com/audit":{"level":"ddl"}}`,
+			cluster.GetAnnotations()[AnnotationPluginParameters])
+	})
+
+	t.Run("removes a stale annotation", func(t *testing.T) {
+		cluster := createMockPluginCluster("pg", "default")
+		unstructured.RemoveNestedField(cluster.Object, "spec", "plugins")
+		cluster.SetAnnotations(map[string]string{AnnotationPluginParameters: `{"old":{}}`})
+
+		plugin.annotatePluginParameters(cluster.Object)
+		assert.NotContains(t, cluster.GetAnnotations(), AnnotationPluginParameters)
+	})
+}
+
+func TestReconstructPluginParameters(t *testing.T) {
+	backedUp := func() *unstructured.Unstructured {
+		cluster := createMockPluginCluster("pg", "default")
+		(&BackupPluginV2{log: logrus.New()}).annotatePluginParameters(cluster.Object)
+		return cluster
+	}
+	parameters := func(cluster *unstructured.Unstructured) map[string]interface{} {
+		plugins, _, _ := unstructured.NestedFieldNoCopy(cluster.Object, "spec", "plugins")
+		return plugins.([]interface{})[0].(map[string]interface{})["parameters"].(map[string]interface{})
+	}
+
+	t.Run("unchanged", func(t *testing.T) {
+		cluster := backedUp()
+		plugin := &RestorePluginV2{log: logrus.New()}
+		warnings := &restoreWarnings{log: logrus.New()}
+
+		require.NoError(t, plugin.reconstructPluginParameters(cluster.Object, warnings))
+		assert.Empty(t, warnings.messages)
+	})
+
+	t.Run("changed parameters", func(t *testing.T) {
+		cluster := backedUp()
+		params := parameters(cluster)
+		params["barmanObjectName"] = "other-store"
+		params["extra"] = "added"
+		delete(params, "serverName")
+
+		plugin := &RestorePluginV2{log: logrus.New()}
+		warnings := &restoreWarnings{log: logrus.New()}
+
+		require.NoError(t, plugin.reconstructPluginParameters(cluster.Object, warnings))
+		assert.Equal(t, map[string]interface{}{"barmanObjectName": "store", "serverName": "pg"}, parameters(cluster))
+		require.Len(t, warnings.messages, 1)
+		assert.Contains(t, warnings.messages[0], "barman-cloud.cloudnative-pg.io as backed up, barmanObjectName, extra, serverName had changed")
+	})
+
+	t.Run("removed plugin", func(t *testing.T) {
+		cluster := backedUp()
+		unstructured.RemoveNestedField(cluster.Object, "spec", "plugins")
+
+		plugin := &RestorePluginV2{log: logrus.New()}
+		warnings := &restoreWarnings{log: logrus.New()}
+
+		require.NoError(t, plugin.reconstructPluginParameters(cluster.Object, warnings))
+		require.Len(t, warnings.messages, 1)
+		assert.Contains(t, warnings.messages[0], "Plugin barman-cloud.cloudnative-pg.io was removed from spec.plugins")
+	})
+
+	t.Run("invalid annotation", func(t *testing.T) {
+		cluster := createMockPluginCluster("pg", "default")
+		cluster.SetAnnotations(map[string]string{AnnotationPluginParameters: "not json"})
+
+		plugin := &RestorePluginV2{log: logrus.New()}
+		assert.Error(t, plugin.reconstructPluginParameters(cluster.Object, &restoreWarnings{log: logrus.New()}))
+	})
+}
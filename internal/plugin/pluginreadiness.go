@@ -0,0 +1,107 @@
+package plugin
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// BarmanCloudPluginName is the name of the barman-cloud CNPG-I plugin
+const BarmanCloudPluginName = "barman-cloud.cloudnative-pg.io"
+
+// objectStoreCRDName is the name of the barman-cloud plugin's ObjectStore CustomResourceDefinition
+const objectStoreCRDName = "objectstores.barmancloud.cnpg.io"
+
+// pluginNameLabel is the label the CNPG operator uses to discover CNPG-I plugin Services
+const pluginNameLabel = "cnpg.io/pluginName"
+
+// usesBarmanCloudPlugin reports whether the cluster archives WAL or recovers through the
+// barman-cloud plugin
+func usesBarmanCloudPlugin(itemContent map[string]interface{}) bool {
+	specMap, err := getSpecMap(itemContent)
+	if err != nil {
+		return false
+	}
+
+	for _, plugin := range sliceOfMaps(specMap["plugins"]) {
+		if plugin["name"] == BarmanCloudPluginName {
+			return true
+		}
+	}
+	for _, externalCluster := range sliceOfMaps(specMap["externalClusters"]) {
+		if plugin, ok := externalCluster["plugin"].(map[string]interface{}); ok && plugin["name"] == BarmanCloudPluginName {
+			return true
+		}
+	}
+	return false
+}
+
+// checkBarmanCloudPlugin fails when the restored cluster needs the barman-cloud plugin and
+// the plugin is not installed or not serving in the destination cluster. Without it, the
+// operator accepts the cluster but never bootstraps it. The check is skipped with a warning
+// when the plugin's resources cannot be read.
+func (p *RestorePluginV2) checkBarmanCloudPlugin(itemContent map[string]interface{}, warnings *restoreWarnings) error {
+	if !usesBarmanCloudPlugin(itemContent) {
+		return nil
+	}
+
+	dynamicClient, err := p.getDynamicClient()
+	if err != nil {
+		warnings.Warnf("Skipping barman-cloud plugin check: failed to create dynamic client: %v", err)
+		return nil
+	}
+	client, err := p.getKubeClient()
+	if err != nil {
+		warnings.Warnf("Skipping barman-cloud plugin check: failed to create Kubernetes client: %v", err)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err = dynamicClient.Resource(crdGVR).Get(ctx, objectStoreCRDName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return errors.Errorf("the %s CNPG-I plugin is not installed in the destination cluster: CRD %s not found; "+
+			"install plugin-barman-cloud before restoring, or set skipPluginCheck", BarmanCloudPluginName, objectStoreCRDName)
+	}
+	if err != nil {
+		warnings.Warnf("Skipping barman-cloud plugin check: failed to get CRD %s: %v", objectStoreCRDName, err)
+		return nil
+	}
+
+	services, err := client.CoreV1().Services(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+		LabelSelector: pluginNameLabel + "=" + BarmanCloudPluginName,
+	})
+	if err != nil {
+		warnings.Warnf("Skipping barman-cloud plugin check: failed to list plugin Services: %v", err)
+		return nil
+	}
+	if len(services.Items) == 0 {
+		return errors.Errorf("the %s CNPG-I plugin is not installed in the destination cluster: no Service labelled %s=%s; "+
+			"install plugin-barman-cloud before restoring, or set skipPluginCheck", BarmanCloudPluginName, pluginNameLabel, BarmanCloudPluginName)
+	}
+
+	for _, service := range services.Items {
+		slices, err := client.DiscoveryV1().EndpointSlices(service.Namespace).List(ctx, metav1.ListOptions{
+			LabelSelector: "kubernetes.io/service-name=" + service.Name,
+		})
+		if err != nil {
+			warnings.Warnf("Skipping barman-cloud plugin check: failed to list endpoints of Service %s/%s: %v", service.Namespace, service.Name, err)
+			return nil
+		}
+		for _, slice := range slices.Items {
+			for _, endpoint := range slice.Endpoints {
+				if endpoint.Conditions.Ready == nil || *endpoint.Conditions.Ready {
+					return nil
+				}
+			}
+		}
+	}
+
+	service := services.Items[0]
+	return errors.Errorf("the %s CNPG-I plugin is not ready in the destination cluster: Service %s/%s has no ready endpoints; "+
+		"wait for the plugin Deployment to become available, or set skipPluginCheck", BarmanCloudPluginName, service.Namespace, service.Name)
+}
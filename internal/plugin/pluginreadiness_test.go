@@ -0,0 +1,130 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/utils/ptr"
+)
+
+func createMockObjectStoreCRD() *unstructured.Unstructured {
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "apiextensions.k8s.io/v1",
+			"kind":       "CustomResourceDefinition",
+			"metadata":   map[string]interface{}{"name": objectStoreCRDName},
+		},
+	}
+}
+
+func createMockPluginService() *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "barman-cloud",
+			Namespace: "cnpg-system",
+			Labels:    map[string]string{pluginNameLabel: BarmanCloudPluginName},
+		},
+	}
+}
+
+func createMockPluginEndpoints(ready bool) *discoveryv1.EndpointSlice {
+	return &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "barman-cloud-abcde",
+			Namespace: "cnpg-system",
+			Labels:    map[string]string{"kubernetes.io/service-name": "barman-cloud"},
+		},
+		Endpoints: []discoveryv1.Endpoint{
+			{Addresses: []string{"10.0.0.5"}, Conditions: discoveryv1.EndpointConditions{Ready: ptr.To(ready)}},
+		},
+	}
+}
+
+func TestUsesBarmanCloudPlugin(t *testing.T) {
+	assert.True(t, usesBarmanCloudPlugin(createMockArchivingCluster("pg", "default", "pg", nil).Object))
+
+	recovering := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"externalClusters": []interface{}{
+				map[string]interface{}{"name": recoverySourceName, "plugin": map[string]interface{}{"name": BarmanCloudPluginName}},
+			},
+		},
+	}
+	assert.True(t, usesBarmanCloudPlugin(recovering))
+
+	inTree := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"backup": map[string]interface{}{"barmanObjectStore": map[string]interface{}{"destinationPath": "s3://bucket"}},
+		},
+	}
+	assert.False(t, usesBarmanCloudPlugin(inTree))
+}
+
+func TestCheckBarmanCloudPlugin(t *testing.T) {
+	tests := []struct {
+		name           string
+		crds           []runtime.Object
+		objects        []runtime.Object
+		inTree         bool
+		expectedError  string
+		expectWarnings int
+	}{
+		{
+			name:    "plugin ready",
+			crds:    []runtime.Object{createMockObjectStoreCRD()},
+			objects: []runtime.Object{createMockPluginService(), createMockPluginEndpoints(true)},
+		},
+		{
+			name:   "cluster not using the plugin",
+			inTree: true,
+		},
+		{
+			name:          "plugin CRD missing",
+			objects:       []runtime.Object{createMockPluginService(), createMockPluginEndpoints(true)},
+			expectedError: "CRD objectstores.barmancloud.cnpg.io not found",
+		},
+		{
+			name:          "plugin Service missing",
+			crds:          []runtime.Object{createMockObjectStoreCRD()},
+			expectedError: "no Service labelled cnpg.io/pluginName=barman-cloud.cloudnative-pg.io",
+		},
+		{
+			name:          "plugin not ready",
+			crds:          []runtime.Object{createMockObjectStoreCRD()},
+			objects:       []runtime.Object{createMockPluginService(), createMockPluginEndpoints(false)},
+			expectedError: "Service cnpg-system/barman-cloud has no ready endpoints",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plugin := &RestorePluginV2{
+				log:           logrus.New(),
+				dynamicClient: newFakeCRDClient(tt.crds...),
+				kubeClient:    fake.NewSimpleClientset(tt.objects...),
+			}
+			warnings := &restoreWarnings{log: logrus.New()}
+
+			item := createMockArchivingCluster("pg", "default", "pg", nil)
+			if tt.inTree {
+				unstructured.RemoveNestedField(item.Object, "spec", "plugins")
+			}
+
+			err := plugin.checkBarmanCloudPlugin(item.Object, warnings)
+			if tt.expectedError != "" {
+				assert.ErrorContains(t, err, tt.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Len(t, warnings.messages, tt.expectWarnings)
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package plugin
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+// AnnotationBarmanCloudPluginVersion is the annotation key used to store the version of the
+// barman-cloud plugin installed in the source cluster at backup time
+const AnnotationBarmanCloudPluginVersion = "velero-cnpg/barman-cloud-plugin-version"
+
+// barmanCloudPluginVersion returns the image tag of the Deployment serving the barman-cloud
+// plugin Service, or an empty string when the plugin is not installed
+func barmanCloudPluginVersion(ctx context.Context, client kubernetes.Interface) (string, error) {
+	services, err := client.CoreV1().Services(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+		LabelSelector: pluginNameLabel + "=" + BarmanCloudPluginName,
+	})
+	if err != nil {
+		return "", errors.Wrap(classifyAPIError(err), "failed to list plugin Services")
+	}
+
+	for _, service := range services.Items {
+		if len(service.Spec.Selector) == 0 {
+			continue
+		}
+		deployments, err := client.AppsV1().Deployments(service.Namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return "", errors.Wrapf(classifyAPIError(err), "failed to list Deployments in namespace %s", service.Namespace)
+		}
+
+		selector := labels.SelectorFromSet(service.Spec.Selector)
+		for _, deployment := range deployments.Items {
+			containers := deployment.Spec.Template.Spec.Containers
+			if len(containers) == 0 || !selector.Matches(labels.Set(deployment.Spec.Template.Labels)) {
+				continue
+			}
+			return imageTag(containers[0].Image), nil
+		}
+	}
+
+	return "", nil
+}
+
+// imageTag returns the tag of an image reference, or the digest when it has no tag
+func imageTag(image string) string {
+	if i := strings.Index(image, "@"); i >= 0 {
+		if tag := imageTag(image[:i]); tag != "" {
+			return tag
+		}
+		return image[i+1:]
+	}
+	name := image[strings.LastIndex(image, "/")+1:]
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		return name[i+1:]
+	}
+	return ""
+}
+
+// minorVersion returns the major.minor part of a version such as v0.5.1, which is what
+// plugin parameter changes follow
+func minorVersion(version string) string {
+	parts := strings.SplitN(strings.TrimPrefix(version, "v"), ".", 3)
+	if len(parts) < 2 {
+		return version
+	}
+	return parts[0] + "." + parts[1]
+}
+
+// annotatePluginVersion records the barman-cloud plugin version for clusters using the
+// plugin. Failing to read it is logged rather than failing the backup.
+func (p *BackupPluginV2) annotatePluginVersion(itemContent map[string]interface{}) {
+	if !usesBarmanCloudPlugin(itemContent) {
+		return
+	}
+
+	client, err := p.getKubeClient()
+	if err != nil {
+		p.log.Warnf("Failed to create Kubernetes client, not annotating plugin version: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	version, err := barmanCloudPluginVersion(ctx, client)
+	if err != nil {
+		p.log.Warnf("Not annotating plugin version: %v", err)
+		return
+	}
+	if version == "" {
+		p.log.Warnf("No %s plugin Deployment found, not annotating plugin version", BarmanCloudPluginName)
+		return
+	}
+
+	if err := p.addAnnotation(itemContent, AnnotationBarmanCloudPluginVersion, version); err != nil {
+		p.log.Warnf("Failed to annotate plugin version: %v", err)
+		return
+	}
+	p.log.Infof("Annotated cluster with %s plugin version: %s", BarmanCloudPluginName, version)
+}
+
+// comparePluginVersion warns when the barman-cloud plugin in the destination cluster is a
+// different minor version than the one the backup was taken with, since the plugin
+// parameters of the restored cluster may not match what the destination plugin expects
+func (p *RestorePluginV2) comparePluginVersion(itemContent map[string]interface{}, warnings *restoreWarnings) {
+	backupVersion, found, err := p.getAnnotation(itemContent, AnnotationBarmanCloudPluginVersion)
+	if err != nil || !found || !usesBarmanCloudPlugin(itemContent) {
+		return
+	}
+
+	client, err := p.getKubeClient()
+	if err != nil {
+		p.log.Warnf("Failed to create Kubernetes client, not comparing plugin versions: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	version, err := barmanCloudPluginVersion(ctx, client)
+	if err != nil {
+		p.log.Warnf("Not comparing plugin versions: %v", err)
+		return
+	}
+	if version == "" {
+		p.log.Warnf("No %s plugin Deployment found, not comparing plugin versions", BarmanCloudPluginName)
+		return
+	}
+
+	if minorVersion(version) != minorVersion(backupVersion) {
+		warnings.Warnf("Backed up with %s plugin %s but the destination runs %s, plugin parameters may need updating",
+			BarmanCloudPluginName, backupVersion, version)
+	}
+}
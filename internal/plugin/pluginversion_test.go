@@ -0,0 +1,135 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// createMockPluginDeployment creates a barman-cloud plugin Service and the Deployment
+// serving it, running the given image
+func createMockPluginDeployment(image string) []runtime.Object {
+	service := createMockPluginService()
+	service.Spec.Selector = map[string]string{"app": "barman-cloud"}
+
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "barman-cloud", Namespace: "cnpg-system"},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "barman-cloud"}},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "barman-cloud", Image: image}},
+				},
+			},
+		},
+	}
+	other := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "cnpg-controller-manager", Namespace: "cnpg-system"},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "cnpg"}},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "manager", Image: "ghcr.io/cloudnative-pg/cloudnative-pg:1.26.0"}},
+				},
+			},
+		},
+	}
+
+	return []runtime.Object{service, other, deployment}
+}
+
+func TestImageTag(t *testing.T) {
+	tests := map[string]string{
+		"ghcr.io/cloudnative-pg/plugin-barman-cloud:v0.5.0":             "v0.5.0",
+		"registry.local:5000/plugin-barman-cloud:v0.5.0":                "v0.5.0",
+		"registry.local:5000/plugin-barman-cloud":                       "",
+		"ghcr.io/cloudnative-pg/plugin-barman-cloud:v0.5.0@sha256:abcd": "v0.5.0",
+		"ghcr.io/cloudnative-pg/plugin-barman-cloud@sha256:abcd":        "sha256:abcd",
+	}
+	for image, expected := range tests {
+		assert.Equal(t, expected, imageTag(image), image)
+	}
+}
+
+func TestMinorVersion(t *testing.T) {
+	assert.Equal(t, "0.5", minorVersion("v0.5.1"))
+	assert.Equal(t, "1.2", minorVersion("1.2"))
+	assert.Equal(t, "latest", minorVersion("latest"))
+}
+
+func TestAnnotatePluginVersion(t *testing.T) {
+	plugin := &BackupPluginV2{
+		log:        logrus.New(),
+		kubeClient: fake.NewSimpleClientset(createMockPluginDeployment("ghcr.io/cloudnative-pg/plugin-barman-cloud:v0.5.0")...),
+	}
+
+	cluster := createMockArchivingCluster("pg", "default", "pg", nil)
+	plugin.annotatePluginVersion(cluster.Object)
+	assert.Equal(t, "v0.5.0", cluster.GetAnnotations()[AnnotationBarmanCloudPluginVersion])
+
+	// Plugin not installed
+	plugin.kubeClient = fake.NewSimpleClientset()
+	cluster = createMockArchivingCluster("pg", "default", "pg", nil)
+	plugin.annotatePluginVersion(cluster.Object)
+	assert.NotContains(t, cluster.GetAnnotations(), AnnotationBarmanCloudPluginVersion)
+}
+
+func TestComparePluginVersion(t *testing.T) {
+	tests := []struct {
+		name          string
+		backupVersion string
+		objects       []runtime.Object
+		expectWarning bool
+	}{
+		{
+			name:          "same version",
+			backupVersion: "v0.5.0",
+			objects:       createMockPluginDeployment("ghcr.io/cloudnative-pg/plugin-barman-cloud:v0.5.0"),
+		},
+		{
+			name:          "patch release",
+			backupVersion: "v0.5.0",
+			objects:       createMockPluginDeployment("ghcr.io/cloudnative-pg/plugin-barman-cloud:v0.5.2"),
+		},
+		{
+			name:          "minor release",
+			backupVersion: "v0.4.1",
+			objects:       createMockPluginDeployment("ghcr.io/cloudnative-pg/plugin-barman-cloud:v0.5.0"),
+			expectWarning: true,
+		},
+		{
+			name:          "plugin not installed",
+			backupVersion: "v0.4.1",
+		},
+		{
+			name:    "no version recorded",
+			objects: createMockPluginDeployment("ghcr.io/cloudnative-pg/plugin-barman-cloud:v0.5.0"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plugin := &RestorePluginV2{log: logrus.New(), kubeClient: fake.NewSimpleClientset(tt.objects...)}
+			warnings := &restoreWarnings{log: logrus.New()}
+
+			cluster := createMockArchivingCluster("pg", "default", "pg", nil)
+			if tt.backupVersion != "" {
+				cluster.SetAnnotations(map[string]string{AnnotationBarmanCloudPluginVersion: tt.backupVersion})
+			}
+
+			plugin.comparePluginVersion(cluster.Object, warnings)
+			if tt.expectWarning {
+				assert.Len(t, warnings.messages, 1)
+				assert.Contains(t, warnings.messages[0], "v0.4.1")
+			} else {
+				assert.Empty(t, warnings.messages)
+			}
+		})
+	}
+}
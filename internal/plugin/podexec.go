@@ -0,0 +1,89 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+	utilexec "k8s.io/client-go/util/exec"
+)
+
+// postgresContainer is the container of CNPG instance pods running PostgreSQL
+const postgresContainer = "postgres"
+
+// podExecFunc runs a command in a container of a pod and returns its standard output.
+// A command exiting non-zero returns an error including its standard error.
+type podExecFunc func(ctx context.Context, namespace, pod, container string, command []string) (string, error)
+
+// remotePodExec returns a podExecFunc calling the exec subresource of pods with client-go,
+// over a websocket and falling back to SPDY for API servers that cannot upgrade to one.
+// The exec requests are authenticated, impersonated and proxied like the other API calls
+// made with the configuration.
+func remotePodExec(config *rest.Config) (podExecFunc, error) {
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return func(ctx context.Context, namespace, pod, container string, command []string) (string, error) {
+		request := client.CoreV1().RESTClient().Post().
+			Resource("pods").
+			Namespace(namespace).
+			Name(pod).
+			SubResource("exec").
+			VersionedParams(&corev1.PodExecOptions{
+				Container: container,
+				Command:   command,
+				Stdout:    true,
+				Stderr:    true,
+			}, scheme.ParameterCodec)
+
+		websocketExecutor, err := remotecommand.NewWebSocketExecutor(config, http.MethodGet, request.URL().String())
+		if err != nil {
+			return "", errors.Wrap(err, "failed to create websocket executor")
+		}
+		spdyExecutor, err := remotecommand.NewSPDYExecutor(config, http.MethodPost, request.URL())
+		if err != nil {
+			return "", errors.Wrap(err, "failed to create SPDY executor")
+		}
+		executor, err := remotecommand.NewFallbackExecutor(websocketExecutor, spdyExecutor, func(err error) bool {
+			return httpstream.IsUpgradeFailure(err) || httpstream.IsHTTPSProxyError(err)
+		})
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+
+		var stdout, stderr bytes.Buffer
+		err = executor.StreamWithContext(ctx, remotecommand.StreamOptions{Stdout: &stdout, Stderr: &stderr})
+		var exitErr utilexec.ExitError
+		switch {
+		case errors.As(err, &exitErr):
+			if detail := strings.TrimSpace(stderr.String()); detail != "" {
+				err = errors.Wrap(err, detail)
+			}
+			return "", errors.Wrapf(err, "command failed in pod %s/%s", namespace, pod)
+		case err != nil:
+			return "", errors.Wrapf(err, "failed to exec into pod %s/%s", namespace, pod)
+		}
+		return stdout.String(), nil
+	}, nil
+}
+
+// getPodExec returns the podExecFunc for commands in pods, built from the plugin's client
+// configuration
+func getPodExec() (podExecFunc, error) {
+	config, err := restConfig()
+	if err != nil {
+		return nil, err
+	}
+	injectFaults(config)
+	return remotePodExec(config)
+}
@@ -0,0 +1,95 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/util/httpstream/wsstream"
+	"k8s.io/client-go/rest"
+)
+
+// Streams of the exec channel protocol
+const (
+	execStdout = 1
+	execStderr = 2
+	execError  = 3
+)
+
+// newExecServer returns an API server answering exec requests over websockets with the
+// given output, per stream
+func newExecServer(t *testing.T, output map[int]string) *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "/api/v1/namespaces/default/pods/pg-1/exec", req.URL.Path)
+		assert.Equal(t, "postgres", req.URL.Query().Get("container"))
+		assert.Equal(t, []string{"psql", "-c", "SELECT 1"}, req.URL.Query()["command"])
+		assert.Equal(t, "Bearer token", req.Header.Get("Authorization"))
+
+		conn := wsstream.NewConn(map[string]wsstream.ChannelProtocolConfig{
+			"v5.channel.k8s.io": {
+				Binary:   true,
+				Channels: []wsstream.ChannelType{wsstream.ReadChannel, wsstream.WriteChannel, wsstream.WriteChannel, wsstream.WriteChannel, wsstream.IgnoreChannel},
+			},
+		})
+		_, channels, err := conn.Open(w, req)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		for _, stream := range []int{execStdout, execStderr, execError} {
+			if data, found := output[stream]; found {
+				_, err := channels[stream].Write([]byte(data))
+				require.NoError(t, err)
+			}
+		}
+	}))
+}
+
+func TestRemotePodExec(t *testing.T) {
+	tests := []struct {
+		name           string
+		output         map[int]string
+		expectedOutput string
+		expectedError  string
+	}{
+		{
+			name: "success",
+			output: map[int]string{
+				execStdout: "1\n",
+				execError:  `{"status":"Success"}`,
+			},
+			expectedOutput: "1\n",
+		},
+		{
+			name: "failure",
+			output: map[int]string{
+				execStderr: "ERROR:  syntax error\n",
+				execError:  `{"status":"Failure","message":"command terminated with non-zero exit code: exit status 1","reason":"NonZeroExitCode","details":{"causes":[{"reason":"ExitCode","message":"1"}]}}`,
+			},
+			expectedError: "command failed in pod default/pg-1: ERROR:  syntax error: command terminated with exit code 1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newExecServer(t, tt.output)
+			defer server.Close()
+
+			podExec, err := remotePodExec(&rest.Config{
+				Host:            server.URL,
+				BearerToken:     "token",
+				TLSClientConfig: rest.TLSClientConfig{Insecure: true},
+			})
+			require.NoError(t, err)
+			output, err := podExec(context.Background(), "default", "pg-1", "postgres", []string{"psql", "-c", "SELECT 1"})
+			if tt.expectedError != "" {
+				assert.EqualError(t, err, tt.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedOutput, output)
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// AnnotationPoolers is the annotation key used to store the names of the Poolers
+// referencing the cluster at backup time, as a JSON list
+const AnnotationPoolers = "velero-cnpg/poolers"
+
+// poolerOperationPrefix prefixes the IDs of pooler validation operations
+const poolerOperationPrefix = "poolers"
+
+// cnpgPoolerGVR identifies CNPG Pooler resources
+var cnpgPoolerGVR = schema.GroupVersionResource{
+	Group:    "postgresql.cnpg.io",
+	Version:  "v1",
+	Resource: "poolers",
+}
+
+// clusterPoolers returns the sorted names of the Poolers in the namespace bound to the cluster
+func clusterPoolers(ctx context.Context, dynamicClient dynamic.Interface, namespace, clusterName string) ([]string, error) {
+	poolers, err := dynamicClient.Resource(cnpgPoolerGVR).Namespace(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(classifyAPIError(err), "failed to list poolers in namespace %s", namespace)
+	}
+
+	var names []string
+	for _, pooler := range poolers.Items {
+		if boundCluster(&pooler) == clusterName {
+			names = append(names, pooler.GetName())
+		}
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// boundCluster returns the name of the cluster a Pooler is bound to
+func boundCluster(pooler *unstructured.Unstructured) string {
+	name, _, _ := unstructured.NestedString(pooler.Object, "spec", "cluster", "name")
+	return name
+}
+
+// annotatePoolers records the Poolers bound to the cluster and returns them as additional
+// items, so they travel with the cluster even when the backup selects only the cluster.
+// Failing to list them is logged rather than failing the backup.
+func (p *BackupPluginV2) annotatePoolers(itemContent map[string]interface{}) []velero.ResourceIdentifier {
+	cluster := &unstructured.Unstructured{Object: itemContent}
+
+	dynamicClient, err := p.getDynamicClient()
+	if err != nil {
+		p.log.Warnf("Failed to create dynamic client, not annotating poolers: %v", err)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	names, err := clusterPoolers(ctx, dynamicClient, cluster.GetNamespace(), cluster.GetName())
+	if err != nil {
+		p.log.Warnf("Not annotating poolers: %v", err)
+		return nil
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	raw, err := json.Marshal(names)
+	if err != nil {
+		p.log.Warnf("Failed to encode poolers: %v", err)
+		return nil
+	}
+	if err := setAnnotation(itemContent, AnnotationPoolers, string(raw)); err != nil {
+		p.log.Warnf("Failed to annotate poolers: %v", err)
+		return nil
+	}
+	p.log.Infof("Annotated cluster with poolers: %v", names)
+
+	additionalItems := make([]velero.ResourceIdentifier, 0, len(names))
+	for _, name := range names {
+		additionalItems = append(additionalItems, velero.ResourceIdentifier{
+			GroupResource: cnpgPoolerGVR.GroupResource(),
+			Namespace:     cluster.GetNamespace(),
+			Name:          name,
+		})
+	}
+	return additionalItems
+}
+
+// expectedPoolers returns the Poolers recorded at backup time
+func (p *RestorePluginV2) expectedPoolers(itemContent map[string]interface{}) ([]string, error) {
+	value, found, err := p.getAnnotation(itemContent, AnnotationPoolers)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	var names []string
+	if err := json.Unmarshal([]byte(value), &names); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode %s annotation", AnnotationPoolers)
+	}
+	return names, nil
+}
+
+// poolerOperation identifies the validation of the Poolers of a restored cluster
+type poolerOperation struct {
+	namespace   string
+	clusterName string
+	poolers     []string
+}
+
+// encodePoolerOperationID encodes a pooler validation as an operation ID
+func encodePoolerOperationID(namespace, clusterName string, poolers []string) string {
+	return strings.Join([]string{poolerOperationPrefix, namespace, clusterName, strings.Join(poolers, ",")}, "/")
+}
+
+// decodePoolerOperationID decodes an operation ID produced by encodePoolerOperationID
+func decodePoolerOperationID(operationID string) (*poolerOperation, error) {
+	parts := strings.Split(operationID, "/")
+	if len(parts) != 4 || parts[0] != poolerOperationPrefix || parts[3] == "" {
+		return nil, errors.Errorf("invalid pooler operation ID %q", operationID)
+	}
+	return &poolerOperation{
+		namespace:   parts[1],
+		clusterName: parts[2],
+		poolers:     strings.Split(parts[3], ","),
+	}, nil
+}
+
+// poolerProgress reports the pooler validation as completed once every expected Pooler
+// exists, failing it when one is bound to another cluster
+func (p *RestorePluginV2) poolerProgress(op *poolerOperation) (velero.OperationProgress, error) {
+	progress := velero.OperationProgress{
+		NTotal:         int64(len(op.poolers)),
+		OperationUnits: "Poolers",
+		Updated:        time.Now(),
+	}
+
+	dynamicClient, err := p.getDynamicClient()
+	if err != nil {
+		return progress, errors.Wrap(err, "failed to create dynamic client")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	list, err := dynamicClient.Resource(cnpgPoolerGVR).Namespace(op.namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return progress, errors.Wrapf(classifyAPIError(err), "failed to list poolers in namespace %s", op.namespace)
+	}
+	existing := map[string]*unstructured.Unstructured{}
+	for i := range list.Items {
+		existing[list.Items[i].GetName()] = &list.Items[i]
+	}
+
+	var missing, misbound []string
+	for _, name := range op.poolers {
+		pooler, found := existing[name]
+		switch {
+		case !found:
+			missing = append(missing, name)
+		case boundCluster(pooler) != op.clusterName:
+			misbound = append(misbound, fmt.Sprintf("%s (bound to %q)", name, boundCluster(pooler)))
+		default:
+			progress.NCompleted++
+		}
+	}
+
+	switch {
+	case len(misbound) > 0:
+		progress.Completed = true
+		progress.Err = fmt.Sprintf("poolers of cluster %s/%s are bound to another cluster: %s", op.namespace, op.clusterName, strings.Join(misbound, ", "))
+	case len(missing) > 0:
+		progress.Description = fmt.Sprintf("Waiting for poolers %s", strings.Join(missing, ", "))
+	default:
+		progress.Completed = true
+		progress.Description = "All poolers are present"
+	}
+
+	return progress, nil
+}
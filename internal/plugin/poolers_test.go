@@ -0,0 +1,180 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// createMockPooler creates a Pooler bound to clusterName
+func createMockPooler(name, namespace, clusterName string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "postgresql.cnpg.io/v1",
+			"kind":       "Pooler",
+			"metadata": map[string]interface{}{
+				"name":      name,
+				"namespace": namespace,
+			},
+			"spec": map[string]interface{}{
+				"cluster": map[string]interface{}{"name": clusterName},
+				"type":    "rw",
+			},
+		},
+	}
+}
+
+func TestAnnotatePoolers(t *testing.T) {
+	tests := []struct {
+		name               string
+		poolers            []runtime.Object
+		expectedAnnotation string
+		expectedItems      []string
+	}{
+		{
+			name: "no poolers",
+		},
+		{
+			name: "poolers bound to the cluster",
+			poolers: []runtime.Object{
+				createMockPooler("pg-ro", "default", "pg"),
+				createMockPooler("pg-rw", "default", "pg"),
+				createMockPooler("other-rw", "default", "other"),
+				createMockPooler("pg-rw", "staging", "pg"),
+			},
+			expectedAnnotation: `["pg-ro","pg-rw"]`,
+			expectedItems:      []string{"pg-ro", "pg-rw"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plugin := &BackupPluginV2{log: logrus.New(), dynamicClient: newFakeDynamicClient(tt.poolers...)}
+			cluster := createMockArchivingCluster("pg", "default", "pg", nil)
+
+			items := plugin.annotatePoolers(cluster.Object)
+
+			var names []string
+			for _, item := range items {
+				assert.Equal(t, cnpgPoolerGVR.GroupResource(), item.GroupResource)
+				assert.Equal(t, "default", item.Namespace)
+				names = append(names, item.Name)
+			}
+			assert.Equal(t, tt.expectedItems, names)
+			assert.Equal(t, tt.expectedAnnotation, cluster.GetAnnotations()[AnnotationPoolers])
+		})
+	}
+}
+
+func TestPoolerOperationID(t *testing.T) {
+	id := encodePoolerOperationID("default", "pg", []string{"pg-ro", "pg-rw"})
+	assert.Equal(t, "poolers/default/pg/pg-ro,pg-rw", id)
+
+	op, err := decodePoolerOperationID(id)
+	require.NoError(t, err)
+	assert.Equal(t, &poolerOperation{namespace: "default", clusterName: "pg", poolers: []string{"pg-ro", "pg-rw"}}, op)
+
+	for _, invalid := range []string{"", "poolers/default/pg/", "fence/default/pg/pg-rw", "poolers/default/pg"} {
+		_, err := decodePoolerOperationID(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestPoolerProgress(t *testing.T) {
+	op := &poolerOperation{namespace: "default", clusterName: "pg", poolers: []string{"pg-ro", "pg-rw"}}
+
+	tests := []struct {
+		name              string
+		poolers           []runtime.Object
+		expectCompleted   bool
+		expectedCompleted int64
+		expectedErr       string
+	}{
+		{
+			name:    "poolers missing",
+			poolers: []runtime.Object{createMockPooler("pg-rw", "default", "pg")},
+			// pg-ro has not been restored yet
+			expectedCompleted: 1,
+		},
+		{
+			name: "all poolers bound",
+			poolers: []runtime.Object{
+				createMockPooler("pg-ro", "default", "pg"),
+				createMockPooler("pg-rw", "default", "pg"),
+			},
+			expectCompleted:   true,
+			expectedCompleted: 2,
+		},
+		{
+			name: "pooler bound to another cluster",
+			poolers: []runtime.Object{
+				createMockPooler("pg-ro", "default", "other"),
+				createMockPooler("pg-rw", "default", "pg"),
+			},
+			expectCompleted:   true,
+			expectedCompleted: 1,
+			expectedErr:       `pg-ro (bound to "other")`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plugin := &RestorePluginV2{log: logrus.New(), dynamicClient: newFakeDynamicClient(tt.poolers...)}
+
+			progress, err := plugin.poolerProgress(op)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectCompleted, progress.Completed)
+			assert.Equal(t, tt.expectedCompleted, progress.NCompleted)
+			assert.Equal(t, int64(2), progress.NTotal)
+			if tt.expectedErr != "" {
+				assert.Contains(t, progress.Err, tt.expectedErr)
+			} else {
+				assert.Empty(t, progress.Err)
+			}
+		})
+	}
+}
+
+func TestRestoreExecuteValidatesPoolers(t *testing.T) {
+	for _, validate := range []bool{false, true} {
+		// Without a serverName annotation the override ConfigMap is not written
+		item := &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "postgresql.cnpg.io/v1",
+			"kind":       "Cluster",
+			"metadata": map[string]interface{}{
+				"name":      "pg",
+				"namespace": "default",
+				"annotations": map[string]interface{}{
+					AnnotationBackupMethod: BackupMethodBarmanObjectStore,
+					AnnotationPoolers:      `["pg-rw"]`,
+				},
+			},
+			"spec": map[string]interface{}{
+				"backup": map[string]interface{}{
+					"barmanObjectStore": map[string]interface{}{"destinationPath": "s3://bucket"},
+				},
+			},
+		}}
+
+		plugin := &RestorePluginV2{
+			log:           logrus.New(),
+			config:        &PluginConfig{RestoreMode: RestoreModeRecovery, ValidatePoolers: validate, SkipSchemaValidation: true},
+			dynamicClient: newFakeDynamicClient(),
+		}
+
+		out, err := plugin.Execute(&velero.RestoreItemActionExecuteInput{Item: item})
+		require.NoError(t, err)
+		if validate {
+			operationID, _, err := splitStarted(out.OperationID)
+			require.NoError(t, err)
+			assert.Equal(t, "poolers/default/pg/pg-rw", operationID)
+		} else {
+			assert.Empty(t, out.OperationID)
+		}
+	}
+}
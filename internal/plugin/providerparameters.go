@@ -0,0 +1,117 @@
+package plugin
+
+import (
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// applyProviderParameters merges the provider parameters configured for the ObjectStore of
+// the recovery source into its plugin parameters. The generated barmanObjectName and
+// serverName are kept. In-tree object store sources take provider settings in their own
+// fields, so they are left unchanged.
+func (p *RestorePluginV2) applyProviderParameters(itemContent map[string]interface{}, providerParameters map[string]map[string]string) error {
+	if len(providerParameters) == 0 {
+		return nil
+	}
+
+	specMap, err := getSpecMap(itemContent)
+	if err != nil {
+		return err
+	}
+
+	var source map[string]interface{}
+	for _, externalCluster := range sliceOfMaps(specMap["externalClusters"]) {
+		if externalCluster["name"] == recoverySourceName {
+			source = externalCluster
+			break
+		}
+	}
+	if source == nil {
+		return nil
+	}
+
+	parameters, found, _ := nestedMapNoCopy(source, "plugin", "parameters")
+	if !found {
+		return nil
+	}
+	barmanObjectName, _, _ := unstructured.NestedString(source, "plugin", "parameters", "barmanObjectName")
+	extra, found := providerParameters[barmanObjectName]
+	if !found {
+		return nil
+	}
+
+	keys := make([]string, 0, len(extra))
+	for key, value := range extra {
+		if key == "barmanObjectName" || key == "serverName" {
+			continue
+		}
+		parameters[key] = value
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	p.log.Infof("Merged provider parameters %s of ObjectStore %s into %s", strings.Join(keys, ", "), barmanObjectName, recoverySourceName)
+	return nil
+}
+
+// copyRecoveryParameters copies the parameters of the WAL archiver plugin entry that
+// recoveryParameters selects into the plugin parameters of the recovery source, which
+// otherwise only gets barmanObjectName and serverName. Those two are kept as generated.
+// In-tree object store sources copy the whole object store, so they are left unchanged.
+func (p *RestorePluginV2) copyRecoveryParameters(itemContent map[string]interface{}, selection *RecoveryParametersConfig) error {
+	if selection == nil {
+		return nil
+	}
+
+	specMap, err := getSpecMap(itemContent)
+	if err != nil {
+		return err
+	}
+
+	var source map[string]interface{}
+	for _, externalCluster := range sliceOfMaps(specMap["externalClusters"]) {
+		if externalCluster["name"] == recoverySourceName {
+			source = externalCluster
+			break
+		}
+	}
+	if source == nil {
+		return nil
+	}
+
+	parameters, found, _ := nestedMapNoCopy(source, "plugin", "parameters")
+	if !found {
+		return nil
+	}
+	plugins, _ := specMap["plugins"].([]interface{})
+	entry := walArchiverEntry(plugins, "barmanObjectName", true)
+	if entry == nil {
+		return nil
+	}
+	original, _ := entry["parameters"].(map[string]interface{})
+
+	var copied, skipped []string
+	for key, value := range original {
+		if key == "barmanObjectName" || key == "serverName" {
+			continue
+		}
+		if !selection.selects(key) {
+			skipped = append(skipped, key)
+			continue
+		}
+		parameters[key] = value
+		copied = append(copied, key)
+	}
+	sort.Strings(copied)
+	sort.Strings(skipped)
+
+	if len(copied) > 0 {
+		p.log.Infof("Copied plugin parameters %s into %s", strings.Join(copied, ", "), recoverySourceName)
+	}
+	if len(skipped) > 0 {
+		p.log.Infof("Left plugin parameters %s out of %s", strings.Join(skipped, ", "), recoverySourceName)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestApplyProviderParameters(t *testing.T) {
+	plugin := &RestorePluginV2{log: logrus.New()}
+	providerParameters := map[string]map[string]string{
+		"dr-store": {"endpointURL": "https://minio.dr:9000", "serverName": "ignored"},
+	}
+
+	tests := []struct {
+		name      string
+		configure func(itemContent map[string]interface{}) error
+		expected  map[string]interface{}
+	}{
+		{
+			name: "plugin source of the configured ObjectStore",
+			configure: func(itemContent map[string]interface{}) error {
+				return plugin.configureExternalCluster(itemContent, "pg", "dr-store")
+			},
+			expected: map[string]interface{}{
+				"barmanObjectName": "dr-store",
+				"serverName":       "pg",
+				"endpointURL":      "https://minio.dr:9000",
+			},
+		},
+		{
+			name: "plugin source of another ObjectStore",
+			configure: func(itemContent map[string]interface{}) error {
+				return plugin.configureExternalCluster(itemContent, "pg", "prod-store")
+			},
+			expected: map[string]interface{}{
+				"barmanObjectName": "prod-store",
+				"serverName":       "pg",
+			},
+		},
+		{
+			name: "in-tree object store source",
+			configure: func(itemContent map[string]interface{}) error {
+				itemContent["spec"].(map[string]interface{})["backup"] = map[string]interface{}{
+					"barmanObjectStore": map[string]interface{}{"destinationPath": "s3://bucket"},
+				}
+				return plugin.configureExternalClusterObjectStore(itemContent, "pg")
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			itemContent := map[string]interface{}{"spec": map[string]interface{}{}}
+			require.NoError(t, tt.configure(itemContent))
+
+			require.NoError(t, plugin.applyProviderParameters(itemContent, providerParameters))
+
+			externalClusters, _, _ := unstructured.NestedSlice(itemContent, "spec", "externalClusters")
+			require.Len(t, externalClusters, 1)
+			parameters, found, _ := unstructured.NestedMap(externalClusters[0].(map[string]interface{}), "plugin", "parameters")
+			assert.Equal(t, tt.expected != nil, found)
+			if tt.expected != nil {
+				assert.Equal(t, tt.expected, parameters)
+			}
+		})
+	}
+}
+
+func TestApplyProviderParametersChainedRecovery(t *testing.T) {
+	plugin := &RestorePluginV2{log: logrus.New()}
+	itemContent := map[string]interface{}{"spec": map[string]interface{}{}}
+	require.NoError(t, plugin.configureExternalCluster(itemContent, "pg-2", "dr-store"))
+
+	require.NoError(t, plugin.applyProviderParameters(itemContent, map[string]map[string]string{"dr-store": {"region": "eu-west-1"}}))
+	require.NoError(t, plugin.configureChainedRecovery(itemContent, []string{"pg-1"}))
+
+	// Earlier generations are read from the same ObjectStore with the same settings
+	externalClusters, _, _ := unstructured.NestedSlice(itemContent, "spec", "externalClusters")
+	require.Len(t, externalClusters, 2)
+	region, _, _ := unstructured.NestedString(externalClusters[1].(map[string]interface{}), "plugin", "parameters", "region")
+	assert.Equal(t, "eu-west-1", region)
+}
+
+func TestCopyRecoveryParameters(t *testing.T) {
+	plugin := &RestorePluginV2{log: logrus.New()}
+
+	tests := []struct {
+		name      string
+		selection *RecoveryParametersConfig
+		expected  map[string]interface{}
+	}{
+		{
+			name: "not configured",
+			expected: map[string]interface{}{
+				"barmanObjectName": "store",
+				"serverName":       "pg",
+			},
+		},
+		{
+			name:      "all but excluded",
+			selection: &RecoveryParametersConfig{Exclude: []string{"compression", "tag*"}},
+			expected: map[string]interface{}{
+				"barmanObjectName": "store",
+				"serverName":       "pg",
+				"endpointURL":      "https://minio.prod:9000",
+			},
+		},
+		{
+			name:      "included only",
+			selection: &RecoveryParametersConfig{Include: []string{"endpoint*", "compression"}, Exclude: []string{"compression"}},
+			expected: map[string]interface{}{
+				"barmanObjectName": "store",
+				"serverName":       "pg",
+				"endpointURL":      "https://minio.prod:9000",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := createMockPluginCluster("pg", "default")
+			plugins, _, _ := unstructured.NestedFieldNoCopy(cluster.Object, "spec", "plugins")
+			parameters := plugins.([]interface{})[0].(map[string]interface{})["parameters"].(map[string]interface{})
+			parameters["serverName"] = "pg-20241024-123456-x7k2p"
+			parameters["endpointURL"] = "https://minio.prod:9000"
+			parameters["compression"] = "gzip"
+			parameters["tags"] = "env=prod"
+			require.NoError(t, plugin.configureExternalCluster(cluster.Object, "pg", "store"))
+
+			require.NoError(t, plugin.copyRecoveryParameters(cluster.Object, tt.selection))
+
+			externalClusters, _, _ := unstructured.NestedSlice(cluster.Object, "spec", "externalClusters")
+			actual, _, _ := unstructured.NestedMap(externalClusters[0].(map[string]interface{}), "plugin", "parameters")
+			assert.Equal(t, tt.expected, actual)
+		})
+	}
+}
@@ -0,0 +1,323 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// clusterDemand is what the instances of a cluster ask of their namespace. Requests and
+// limits are those of the postgres container of one instance, and volumes are the PVCs
+// of one instance.
+type clusterDemand struct {
+	instances int64
+	requests  corev1.ResourceList
+	limits    corev1.ResourceList
+	volumes   []clusterVolume
+}
+
+// clusterVolume is a PVC every instance of a cluster gets
+type clusterVolume struct {
+	name         string
+	size         resource.Quantity
+	storageClass string
+}
+
+// clusterDemandOf reads the instances, spec.resources and volumes of a cluster: storage,
+// walStorage and the storage of each tablespace
+func clusterDemandOf(itemContent map[string]interface{}) (*clusterDemand, error) {
+	demand := &clusterDemand{instances: 1}
+	if instances, found, _ := unstructured.NestedInt64(itemContent, "spec", "instances"); found {
+		demand.instances = instances
+	}
+
+	var err error
+	requests, _, _ := unstructured.NestedMap(itemContent, "spec", "resources", "requests")
+	if demand.requests, err = resourceList(requests); err != nil {
+		return nil, errors.Wrap(err, "invalid spec.resources.requests")
+	}
+	limits, _, _ := unstructured.NestedMap(itemContent, "spec", "resources", "limits")
+	if demand.limits, err = resourceList(limits); err != nil {
+		return nil, errors.Wrap(err, "invalid spec.resources.limits")
+	}
+	// Kubernetes defaults the requests of a container that only sets limits to the limits
+	for name, limit := range demand.limits {
+		if _, found := demand.requests[name]; !found {
+			demand.requests[name] = limit
+		}
+	}
+
+	addVolume := func(name string, storage map[string]interface{}) error {
+		size, _ := storage["size"].(string)
+		if size == "" {
+			return nil
+		}
+		quantity, err := resource.ParseQuantity(size)
+		if err != nil {
+			return errors.Wrapf(err, "invalid size of %s", name)
+		}
+		storageClass, _ := storage["storageClass"].(string)
+		demand.volumes = append(demand.volumes, clusterVolume{name: name, size: quantity, storageClass: storageClass})
+		return nil
+	}
+	for _, field := range []string{"storage", "walStorage"} {
+		storage, _, _ := unstructured.NestedMap(itemContent, "spec", field)
+		if err := addVolume(field, storage); err != nil {
+			return nil, err
+		}
+	}
+	tablespaces, _, _ := unstructured.NestedFieldNoCopy(itemContent, "spec", "tablespaces")
+	for _, tablespace := range sliceOfMaps(tablespaces) {
+		name, _ := tablespace["name"].(string)
+		storage, _ := tablespace["storage"].(map[string]interface{})
+		if err := addVolume("tablespace "+name, storage); err != nil {
+			return nil, err
+		}
+	}
+
+	return demand, nil
+}
+
+// resourceList parses the quantities of a requests or limits section
+func resourceList(values map[string]interface{}) (corev1.ResourceList, error) {
+	list := corev1.ResourceList{}
+	for name, value := range values {
+		quantity, err := resource.ParseQuantity(fmt.Sprint(value))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %s", name)
+		}
+		list[corev1.ResourceName(name)] = quantity
+	}
+	return list, nil
+}
+
+// times returns quantity multiplied by n
+func times(quantity resource.Quantity, n int64) resource.Quantity {
+	result := quantity.DeepCopy()
+	result.Mul(n)
+	return result
+}
+
+// quotaNeeds returns the quota usage every instance of the cluster adds up to, keyed by
+// the resource names a ResourceQuota can limit
+func (d *clusterDemand) quotaNeeds() map[corev1.ResourceName]resource.Quantity {
+	needs := map[corev1.ResourceName]resource.Quantity{
+		corev1.ResourcePods:                   *resource.NewQuantity(d.instances, resource.DecimalSI),
+		corev1.ResourcePersistentVolumeClaims: *resource.NewQuantity(d.instances*int64(len(d.volumes)), resource.DecimalSI),
+	}
+	for _, name := range []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory} {
+		if request, found := d.requests[name]; found {
+			needs[name] = times(request, d.instances)
+			needs[corev1.ResourceName("requests."+name)] = times(request, d.instances)
+		}
+		if limit, found := d.limits[name]; found {
+			needs[corev1.ResourceName("limits."+name)] = times(limit, d.instances)
+		}
+	}
+
+	add := func(name corev1.ResourceName, quantity resource.Quantity) {
+		total := needs[name]
+		total.Add(quantity)
+		needs[name] = total
+	}
+	for _, volume := range d.volumes {
+		add(corev1.ResourceRequestsStorage, times(volume.size, d.instances))
+		if volume.storageClass != "" {
+			prefix := volume.storageClass + ".storageclass.storage.k8s.io/"
+			add(corev1.ResourceName(prefix+string(corev1.ResourceRequestsStorage)), times(volume.size, d.instances))
+			add(corev1.ResourceName(prefix+string(corev1.ResourcePersistentVolumeClaims)), *resource.NewQuantity(d.instances, resource.DecimalSI))
+		}
+	}
+	return needs
+}
+
+// quotaProblems returns why a ResourceQuota would reject the pods or PVCs of the cluster:
+// what it has left of a resource is less than the cluster needs, or it limits a compute
+// resource the cluster sets no request or limit for and no LimitRange defaults. Scoped
+// quotas, which only apply to some pods, are not checked.
+func quotaProblems(quota *corev1.ResourceQuota, demand *clusterDemand, defaulted corev1.ResourceList) []string {
+	if len(quota.Spec.Scopes) > 0 || quota.Spec.ScopeSelector != nil {
+		return nil
+	}
+	hard := quota.Status.Hard
+	if len(hard) == 0 {
+		hard = quota.Spec.Hard
+	}
+
+	needs := demand.quotaNeeds()
+	var problems []string
+	for _, name := range sortedResourceNames(hard) {
+		limit := hard[name]
+		need, found := needs[name]
+		if !found {
+			if compute, ok := computeResource(name); ok {
+				if _, found := defaulted[name]; !found {
+					problems = append(problems, fmt.Sprintf("ResourceQuota %s limits %s but the cluster sets no %s and no LimitRange defaults it, so its pods are rejected", quota.Name, name, compute))
+				}
+			}
+			continue
+		}
+
+		left := limit.DeepCopy()
+		left.Sub(quota.Status.Used[name])
+		if need.Cmp(left) > 0 {
+			problems = append(problems, fmt.Sprintf("ResourceQuota %s has %s of %s left, the restored cluster needs %s", quota.Name, left.String(), name, need.String()))
+		}
+	}
+	return problems
+}
+
+// computeResource returns how the cluster would set a compute resource a ResourceQuota
+// limits, e.g. spec.resources.limits.memory for limits.memory
+func computeResource(name corev1.ResourceName) (string, bool) {
+	switch name {
+	case corev1.ResourceCPU, corev1.ResourceRequestsCPU:
+		return "spec.resources.requests.cpu", true
+	case corev1.ResourceMemory, corev1.ResourceRequestsMemory:
+		return "spec.resources.requests.memory", true
+	case corev1.ResourceLimitsCPU:
+		return "spec.resources.limits.cpu", true
+	case corev1.ResourceLimitsMemory:
+		return "spec.resources.limits.memory", true
+	}
+	return "", false
+}
+
+// limitRangeDefaults returns the quota resource names LimitRanges default for containers
+// that set no request or limit of their own
+func limitRangeDefaults(limitRanges []corev1.LimitRange) corev1.ResourceList {
+	defaulted := corev1.ResourceList{}
+	for _, limitRange := range limitRanges {
+		for _, item := range limitRange.Spec.Limits {
+			if item.Type != corev1.LimitTypeContainer {
+				continue
+			}
+			for name, quantity := range item.DefaultRequest {
+				defaulted[name] = quantity
+				defaulted[corev1.ResourceName("requests."+name)] = quantity
+			}
+			for name, quantity := range item.Default {
+				defaulted[corev1.ResourceName("limits."+name)] = quantity
+				// A default limit is the request of containers without one
+				if _, found := item.DefaultRequest[name]; !found {
+					defaulted[name] = quantity
+					defaulted[corev1.ResourceName("requests."+name)] = quantity
+				}
+			}
+		}
+	}
+	return defaulted
+}
+
+// limitRangeProblems returns why a LimitRange would reject the instances or PVCs of the
+// cluster: a container or pod request or limit above its max or below its min, or a
+// volume size outside its PVC bounds. Pods are compared with the postgres container alone.
+func limitRangeProblems(limitRange *corev1.LimitRange, demand *clusterDemand) []string {
+	var problems []string
+	for _, item := range limitRange.Spec.Limits {
+		switch item.Type {
+		case corev1.LimitTypeContainer, corev1.LimitTypePod:
+			kind := "containers"
+			if item.Type == corev1.LimitTypePod {
+				kind = "pods"
+			}
+			for _, name := range sortedResourceNames(item.Max) {
+				upper := item.Max[name]
+				value, found := demand.limits[name]
+				if !found {
+					value, found = demand.requests[name]
+				}
+				if found && value.Cmp(upper) > 0 {
+					problems = append(problems, fmt.Sprintf("LimitRange %s allows %s at most %s of %s, the cluster's instances ask for %s", limitRange.Name, kind, upper.String(), name, value.String()))
+				}
+			}
+			if item.Type == corev1.LimitTypePod {
+				continue
+			}
+			for _, name := range sortedResourceNames(item.Min) {
+				lower := item.Min[name]
+				value, found := demand.requests[name]
+				if !found {
+					value, found = demand.limits[name]
+				}
+				if found && value.Cmp(lower) < 0 {
+					problems = append(problems, fmt.Sprintf("LimitRange %s requires containers to ask for at least %s of %s, the cluster's instances ask for %s", limitRange.Name, lower.String(), name, value.String()))
+				}
+			}
+		case corev1.LimitTypePersistentVolumeClaim:
+			upper, hasMax := item.Max[corev1.ResourceStorage]
+			lower, hasMin := item.Min[corev1.ResourceStorage]
+			for _, volume := range demand.volumes {
+				if hasMax && volume.size.Cmp(upper) > 0 {
+					problems = append(problems, fmt.Sprintf("LimitRange %s allows PVCs of at most %s, the cluster's %s is %s", limitRange.Name, upper.String(), volume.name, volume.size.String()))
+				}
+				if hasMin && volume.size.Cmp(lower) < 0 {
+					problems = append(problems, fmt.Sprintf("LimitRange %s requires PVCs of at least %s, the cluster's %s is %s", limitRange.Name, lower.String(), volume.name, volume.size.String()))
+				}
+			}
+		}
+	}
+	return problems
+}
+
+// sortedResourceNames returns the names of a resource list in order, so problems are
+// reported the same way every time
+func sortedResourceNames(list corev1.ResourceList) []corev1.ResourceName {
+	names := make([]corev1.ResourceName, 0, len(list))
+	for name := range list {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	return names
+}
+
+// checkQuotas records a restore warning for every ResourceQuota or LimitRange of the
+// namespace that would leave the instances of the restored cluster unschedulable or have
+// its pods or PVCs rejected. The check is skipped when the cluster's resources cannot be
+// parsed or the namespace's policies cannot be listed.
+func (p *RestorePluginV2) checkQuotas(itemContent map[string]interface{}, namespace string, warnings *restoreWarnings) {
+	demand, err := clusterDemandOf(itemContent)
+	if err != nil {
+		p.log.Warnf("Skipping ResourceQuota and LimitRange check: %v", err)
+		return
+	}
+
+	client, err := p.getKubeClient()
+	if err != nil {
+		p.log.Warnf("Failed to create Kubernetes client, skipping ResourceQuota and LimitRange check: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	quotas, err := client.CoreV1().ResourceQuotas(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		p.log.Warnf("Skipping ResourceQuota and LimitRange check: %v", errors.Wrap(classifyAPIError(err), "failed to list ResourceQuotas"))
+		return
+	}
+	limitRanges, err := client.CoreV1().LimitRanges(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		p.log.Warnf("Skipping ResourceQuota and LimitRange check: %v", errors.Wrap(classifyAPIError(err), "failed to list LimitRanges"))
+		return
+	}
+
+	var problems []string
+	defaulted := limitRangeDefaults(limitRanges.Items)
+	for i := range quotas.Items {
+		problems = append(problems, quotaProblems(&quotas.Items[i], demand, defaulted)...)
+	}
+	for i := range limitRanges.Items {
+		problems = append(problems, limitRangeProblems(&limitRanges.Items[i], demand)...)
+	}
+	for _, problem := range problems {
+		warnings.Warnf("Namespace %s cannot host the restored cluster: %s", namespace, problem)
+	}
+}
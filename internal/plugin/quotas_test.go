@@ -0,0 +1,190 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// sizedCluster returns a cluster of three instances with the given spec.resources, 10Gi
+// of storage and 2Gi of WAL storage on the fast storage class
+func sizedCluster(resources map[string]interface{}) map[string]interface{} {
+	cluster := createMockPluginCluster("pg", "app")
+	spec := cluster.Object["spec"].(map[string]interface{})
+	spec["storage"] = map[string]interface{}{"size": "10Gi", "storageClass": "fast"}
+	spec["walStorage"] = map[string]interface{}{"size": "2Gi", "storageClass": "fast"}
+	if resources != nil {
+		spec["resources"] = resources
+	}
+	return cluster.Object
+}
+
+func newResourceQuota(name string, hard, used corev1.ResourceList) *corev1.ResourceQuota {
+	return &corev1.ResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "app"},
+		Spec:       corev1.ResourceQuotaSpec{Hard: hard},
+		Status:     corev1.ResourceQuotaStatus{Hard: hard, Used: used},
+	}
+}
+
+func newLimitRange(name string, limits ...corev1.LimitRangeItem) *corev1.LimitRange {
+	return &corev1.LimitRange{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "app"},
+		Spec:       corev1.LimitRangeSpec{Limits: limits},
+	}
+}
+
+func TestClusterDemandOf(t *testing.T) {
+	cluster := sizedCluster(map[string]interface{}{
+		"requests": map[string]interface{}{"cpu": "500m"},
+		"limits":   map[string]interface{}{"cpu": "1", "memory": "2Gi"},
+	})
+	cluster["spec"].(map[string]interface{})["tablespaces"] = []interface{}{
+		map[string]interface{}{"name": "archive", "storage": map[string]interface{}{"size": "5Gi"}},
+	}
+
+	demand, err := clusterDemandOf(cluster)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), demand.instances)
+	assert.Len(t, demand.volumes, 3)
+
+	needs := demand.quotaNeeds()
+	for name, expected := range map[corev1.ResourceName]string{
+		corev1.ResourcePods:                   "3",
+		corev1.ResourcePersistentVolumeClaims: "9",
+		corev1.ResourceRequestsCPU:            "1500m",
+		corev1.ResourceLimitsCPU:              "3",
+		// Requests default to the limits
+		corev1.ResourceRequestsMemory:                             "6Gi",
+		corev1.ResourceRequestsStorage:                            "51Gi",
+		"fast.storageclass.storage.k8s.io/requests.storage":       "36Gi",
+		"fast.storageclass.storage.k8s.io/persistentvolumeclaims": "6",
+	} {
+		quantity := needs[name]
+		assert.Equal(t, expected, quantity.String(), name)
+	}
+
+	cluster["spec"].(map[string]interface{})["storage"] = map[string]interface{}{"size": "lots"}
+	_, err = clusterDemandOf(cluster)
+	assert.ErrorContains(t, err, "invalid size of storage")
+}
+
+func TestQuotaProblems(t *testing.T) {
+	tests := []struct {
+		name             string
+		resources        map[string]interface{}
+		quota            *corev1.ResourceQuota
+		limitRanges      []corev1.LimitRange
+		expectedProblems []string
+	}{
+		{
+			name:      "room left",
+			resources: map[string]interface{}{"requests": map[string]interface{}{"cpu": "1", "memory": "1Gi"}},
+			quota: newResourceQuota("compute",
+				corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("8"), corev1.ResourceRequestsStorage: resource.MustParse("100Gi")},
+				corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("4")}),
+		},
+		{
+			name:      "exhausted",
+			resources: map[string]interface{}{"requests": map[string]interface{}{"cpu": "2", "memory": "1Gi"}},
+			quota: newResourceQuota("compute",
+				corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("8"), "fast.storageclass.storage.k8s.io/requests.storage": resource.MustParse("20Gi")},
+				corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("4")}),
+			expectedProblems: []string{
+				"ResourceQuota compute has 20Gi of fast.storageclass.storage.k8s.io/requests.storage left, the restored cluster needs 36Gi",
+				"ResourceQuota compute has 4 of requests.cpu left, the restored cluster needs 6",
+			},
+		},
+		{
+			name:  "unset compute resource",
+			quota: newResourceQuota("compute", corev1.ResourceList{corev1.ResourceLimitsMemory: resource.MustParse("16Gi")}, nil),
+			expectedProblems: []string{
+				"ResourceQuota compute limits limits.memory but the cluster sets no spec.resources.limits.memory",
+			},
+		},
+		{
+			name:  "compute resource defaulted by a LimitRange",
+			quota: newResourceQuota("compute", corev1.ResourceList{corev1.ResourceLimitsMemory: resource.MustParse("16Gi")}, nil),
+			limitRanges: []corev1.LimitRange{*newLimitRange("defaults", corev1.LimitRangeItem{
+				Type:    corev1.LimitTypeContainer,
+				Default: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("1Gi")},
+			})},
+		},
+		{
+			name: "scoped quota",
+			quota: func() *corev1.ResourceQuota {
+				quota := newResourceQuota("best-effort", corev1.ResourceList{corev1.ResourcePods: resource.MustParse("1")}, nil)
+				quota.Spec.Scopes = []corev1.ResourceQuotaScope{corev1.ResourceQuotaScopeBestEffort}
+				return quota
+			}(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			demand, err := clusterDemandOf(sizedCluster(tt.resources))
+			require.NoError(t, err)
+
+			problems := quotaProblems(tt.quota, demand, limitRangeDefaults(tt.limitRanges))
+			require.Len(t, problems, len(tt.expectedProblems))
+			for i, expected := range tt.expectedProblems {
+				assert.Contains(t, problems[i], expected)
+			}
+		})
+	}
+}
+
+func TestLimitRangeProblems(t *testing.T) {
+	demand, err := clusterDemandOf(sizedCluster(map[string]interface{}{
+		"requests": map[string]interface{}{"cpu": "100m", "memory": "1Gi"},
+		"limits":   map[string]interface{}{"memory": "8Gi"},
+	}))
+	require.NoError(t, err)
+
+	limitRange := newLimitRange("bounds",
+		corev1.LimitRangeItem{
+			Type: corev1.LimitTypeContainer,
+			Max:  corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("4Gi")},
+			Min:  corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("250m")},
+		},
+		corev1.LimitRangeItem{
+			Type: corev1.LimitTypePersistentVolumeClaim,
+			Min:  corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("5Gi")},
+		},
+	)
+
+	assert.Equal(t, []string{
+		"LimitRange bounds allows containers at most 4Gi of memory, the cluster's instances ask for 8Gi",
+		"LimitRange bounds requires containers to ask for at least 250m of cpu, the cluster's instances ask for 100m",
+		"LimitRange bounds requires PVCs of at least 5Gi, the cluster's walStorage is 2Gi",
+	}, limitRangeProblems(limitRange, demand))
+}
+
+func TestCheckQuotas(t *testing.T) {
+	objects := []runtime.Object{
+		newResourceQuota("pods", corev1.ResourceList{corev1.ResourcePods: resource.MustParse("10")}, corev1.ResourceList{corev1.ResourcePods: resource.MustParse("8")}),
+		newLimitRange("volumes", corev1.LimitRangeItem{
+			Type: corev1.LimitTypePersistentVolumeClaim,
+			Max:  corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("5Gi")},
+		}),
+	}
+	plugin := &RestorePluginV2{log: logrus.New(), kubeClient: fake.NewClientset(objects...)}
+
+	warnings := &restoreWarnings{log: logrus.New()}
+	plugin.checkQuotas(sizedCluster(nil), "app", warnings)
+	require.Len(t, warnings.messages, 2)
+	assert.Contains(t, warnings.messages[0], "Namespace app cannot host the restored cluster: ResourceQuota pods has 2 of pods left, the restored cluster needs 3")
+	assert.Contains(t, warnings.messages[1], "LimitRange volumes allows PVCs of at most 5Gi, the cluster's storage is 10Gi")
+
+	// Namespaces without quotas have nothing to report
+	warnings = &restoreWarnings{log: logrus.New()}
+	plugin.checkQuotas(sizedCluster(nil), "other", warnings)
+	assert.Empty(t, warnings.messages)
+}
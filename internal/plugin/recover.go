@@ -0,0 +1,39 @@
+package plugin
+
+import (
+	"runtime/debug"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// recoverPanic converts a panic in an action method into an error carrying the stack
+// trace, so a malformed item fails its own backup or restore instead of crashing the
+// plugin process and every item after it. It must be deferred with the address of the
+// method's named error result.
+func recoverPanic(log logrus.FieldLogger, action string, item runtime.Unstructured, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	stack := debug.Stack()
+	*err = errors.Errorf("%s panicked on %s: %v\n%s", action, resourceName(item), r, stack)
+	log.Errorf("%s panicked on %s: %v\n%s", action, resourceName(item), r, stack)
+}
+
+// reportError logs a failed action with the kind of its error, so permission, not found,
+// timeout and spec shape failures can be told apart in the Velero logs. It must be
+// deferred before recoverPanic so that it also reports recovered panics.
+func reportError(log logrus.FieldLogger, action string, item runtime.Unstructured, err *error) {
+	if *err == nil {
+		return
+	}
+
+	kind := ErrorKind(*err)
+	if kind == "" {
+		kind = "unknown"
+	}
+	log.WithField("errorKind", kind).Errorf("%s failed on %s: %v", action, resourceName(item), *err)
+}
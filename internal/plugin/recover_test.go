@@ -0,0 +1,102 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestRecoverPanic(t *testing.T) {
+	item := &unstructured.Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "pg"},
+	}}
+
+	run := func(item runtime.Unstructured, panics bool) (err error) {
+		defer recoverPanic(logrus.New(), "test action", item, &err)
+		if panics {
+			var m map[string]interface{}
+			m["boom"] = true
+		}
+		return nil
+	}
+
+	t.Run("no panic", func(t *testing.T) {
+		assert.NoError(t, run(item, false))
+	})
+
+	t.Run("panic becomes error", func(t *testing.T) {
+		err := run(item, true)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "test action panicked on pg")
+		assert.Contains(t, err.Error(), "assignment to entry in nil map")
+		assert.Contains(t, err.Error(), "recover_test.go")
+	})
+
+	t.Run("panic on nil item", func(t *testing.T) {
+		err := run(nil, true)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "test action panicked on :")
+	})
+}
+
+func TestReportError(t *testing.T) {
+	item := &unstructured.Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "pg"},
+	}}
+
+	tests := []struct {
+		name         string
+		err          error
+		expectedKind interface{}
+	}{
+		{name: "no error"},
+		{name: "typed error", err: specShapeError("spec is not a map"), expectedKind: ErrorKindSpecShape},
+		{name: "untyped error", err: assert.AnError, expectedKind: "unknown"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log, hook := test.NewNullLogger()
+			err := tt.err
+			reportError(log, "test action", item, &err)
+
+			if tt.err == nil {
+				assert.Empty(t, hook.Entries)
+				return
+			}
+			require.Len(t, hook.Entries, 1)
+			assert.Equal(t, tt.expectedKind, hook.LastEntry().Data["errorKind"])
+			assert.Contains(t, hook.LastEntry().Message, "test action failed on pg")
+		})
+	}
+}
+
+func TestResourceName(t *testing.T) {
+	assert.Equal(t, "pg", resourceName(&unstructured.Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "pg"},
+	}}))
+	assert.Equal(t, "", resourceName(&unstructured.Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{"name": int64(1)},
+	}}))
+	assert.Equal(t, "", resourceName(&unstructured.Unstructured{Object: map[string]interface{}{}}))
+	assert.Equal(t, "", resourceName(nil))
+}
+
+func TestExecuteRecoversPanic(t *testing.T) {
+	// metadata that is not a map panics in the backup plugin's type assertions
+	item := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "postgresql.cnpg.io/v1",
+		"kind":       "Backup",
+		"metadata":   "not-a-map",
+	}}
+	plugin := &BackupPluginV2{log: logrus.New(), config: DefaultPluginConfig()}
+
+	assert.NotPanics(t, func() {
+		_, _, _, _, _ = plugin.Execute(item, nil)
+	})
+}
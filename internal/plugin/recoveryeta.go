@@ -0,0 +1,129 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+)
+
+// AnnotationRecoveryObserved is the annotation key used to store the LSN the primary of a
+// restored cluster had replayed to when its recovery was first tracked, and when, as
+// <LSN>@<Unix seconds>. Velero restarts the plugin between progress polls, so the replay
+// rate is measured against it.
+const AnnotationRecoveryObserved = "velero-cnpg/recovery-observed"
+
+// lsnObservation is an LSN an instance had replayed to at a point in time
+type lsnObservation struct {
+	lsn uint64
+	at  time.Time
+}
+
+// formatLSNObservation formats an observation for AnnotationRecoveryObserved
+func formatLSNObservation(lsn string, at time.Time) string {
+	return lsn + "@" + strconv.FormatInt(at.Unix(), 10)
+}
+
+// parseLSNObservation parses a value produced by formatLSNObservation
+func parseLSNObservation(value string) (*lsnObservation, error) {
+	lsn, seconds, found := strings.Cut(value, "@")
+	if !found {
+		return nil, errors.Errorf("invalid %s annotation %q", AnnotationRecoveryObserved, value)
+	}
+	parsedLSN, err := parseLSN(lsn)
+	if err != nil {
+		return nil, errors.Errorf("invalid %s annotation %q", AnnotationRecoveryObserved, value)
+	}
+	parsedSeconds, err := strconv.ParseInt(seconds, 10, 64)
+	if err != nil {
+		return nil, errors.Errorf("invalid %s annotation %q", AnnotationRecoveryObserved, value)
+	}
+	return &lsnObservation{lsn: parsedLSN, at: time.Unix(parsedSeconds, 0)}, nil
+}
+
+// recoveryEstimate describes how fast a restored cluster replays WAL since it was first
+// observed, and how long it has left to reach the end of the backup at target, 0 when
+// unknown. Past the end of the backup, recovery replays the WAL archived after it, whose
+// end is unknown, so the rate is held against the walRate the source cluster wrote WAL at
+// instead: replaying no faster than that, recovery may never catch up.
+func recoveryEstimate(observed *lsnObservation, replayed, target uint64, walRate int64, now time.Time) string {
+	elapsed := now.Sub(observed.at)
+	if elapsed <= 0 {
+		return ""
+	}
+	if replayed <= observed.lsn {
+		return fmt.Sprintf("no WAL replayed since %s", observed.at.UTC().Format(time.RFC3339))
+	}
+
+	rate := float64(replayed-observed.lsn) / elapsed.Seconds()
+	speed := FormatBytes(int64(rate)) + "/s"
+	if target > replayed {
+		remaining := time.Duration(float64(target-replayed) / rate * float64(time.Second))
+		return fmt.Sprintf("about %s left to the end of the backup at %s", remaining.Round(time.Second), speed)
+	}
+	if walRate > 0 && rate <= float64(walRate) {
+		return fmt.Sprintf("replaying %s, no faster than the source cluster wrote WAL at %s/s", speed, FormatBytes(walRate))
+	}
+	return "replaying " + speed
+}
+
+// estimateRecovery returns the recoveryEstimate of a restored cluster replaying WAL, or an
+// empty string when it cannot be estimated yet. The first call records the replayed LSN on
+// the cluster; an observation ahead of the replayed LSN was left by an earlier restore and
+// is replaced.
+func (p *RestorePluginV2) estimateRecovery(ctx context.Context, client dynamic.Interface, cluster *unstructured.Unstructured, replayedLSN, targetLSN string, now time.Time) string {
+	replayed, err := parseLSN(replayedLSN)
+	if err != nil {
+		return ""
+	}
+
+	annotations := cluster.GetAnnotations()
+	if value, found := annotations[AnnotationRecoveryObserved]; found {
+		observed, err := parseLSNObservation(value)
+		if err == nil && observed.lsn <= replayed {
+			var target uint64
+			if targetLSN != "" {
+				target, _ = parseLSN(targetLSN)
+			}
+			walRate, _ := strconv.ParseInt(annotations[AnnotationWALRate], 10, 64)
+			return recoveryEstimate(observed, replayed, target, walRate, now)
+		}
+	}
+
+	if err := patchClusterAnnotation(ctx, client, cluster, AnnotationRecoveryObserved, formatLSNObservation(replayedLSN, now)); err != nil {
+		p.log.Warnf("Failed to record the recovery progress of cluster %s/%s: %v", cluster.GetNamespace(), cluster.GetName(), err)
+	}
+	return ""
+}
+
+// clearRecoveryObserved removes AnnotationRecoveryObserved from a cluster that has left
+// recovery, so later backups of it do not carry it
+func (p *RestorePluginV2) clearRecoveryObserved(ctx context.Context, client dynamic.Interface, cluster *unstructured.Unstructured) {
+	if _, found := cluster.GetAnnotations()[AnnotationRecoveryObserved]; !found {
+		return
+	}
+	if err := patchClusterAnnotation(ctx, client, cluster, AnnotationRecoveryObserved, nil); err != nil {
+		p.log.Warnf("Failed to remove the %s annotation of cluster %s/%s: %v", AnnotationRecoveryObserved, cluster.GetNamespace(), cluster.GetName(), err)
+	}
+}
+
+// patchClusterAnnotation sets an annotation of a CNPG cluster with a merge patch, or
+// removes it when value is nil
+func patchClusterAnnotation(ctx context.Context, client dynamic.Interface, cluster *unstructured.Unstructured, key string, value interface{}) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": map[string]interface{}{key: value}},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = client.Resource(cnpgClusterGVR).Namespace(cluster.GetNamespace()).Patch(ctx, cluster.GetName(), types.MergePatchType, patch, metav1.PatchOptions{})
+	return classifyAPIError(err)
+}
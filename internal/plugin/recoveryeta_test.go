@@ -0,0 +1,111 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestLSNObservation(t *testing.T) {
+	at := time.Unix(1729771200, 0)
+	value := formatLSNObservation("0/4000000", at)
+	assert.Equal(t, "0/4000000@1729771200", value)
+
+	observed, err := parseLSNObservation(value)
+	require.NoError(t, err)
+	assert.Equal(t, &lsnObservation{lsn: 0x4000000, at: at}, observed)
+
+	for _, invalid := range []string{"0/4000000", "not-an-lsn@1729771200", "0/4000000@soon"} {
+		_, err := parseLSNObservation(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestRecoveryEstimate(t *testing.T) {
+	observed := &lsnObservation{lsn: 0, at: time.Unix(1729771200, 0)}
+	now := observed.at.Add(time.Minute)
+
+	tests := []struct {
+		name     string
+		replayed uint64
+		target   uint64
+		walRate  int64
+		now      time.Time
+		expected string
+	}{
+		{
+			name:     "replaying to the end of the backup",
+			replayed: 60 << 20,
+			target:   180 << 20,
+			now:      now,
+			expected: "about 2m0s left to the end of the backup at 1.0 MiB/s",
+		},
+		{
+			name:     "past the end of the backup",
+			replayed: 60 << 20,
+			target:   30 << 20,
+			walRate:  512 << 10,
+			now:      now,
+			expected: "replaying 1.0 MiB/s",
+		},
+		{
+			name:     "slower than the source wrote WAL",
+			replayed: 60 << 20,
+			walRate:  2 << 20,
+			now:      now,
+			expected: "replaying 1.0 MiB/s, no faster than the source cluster wrote WAL at 2.0 MiB/s",
+		},
+		{
+			name:     "stalled",
+			target:   180 << 20,
+			now:      now,
+			expected: "no WAL replayed since 2024-10-24T12:00:00Z",
+		},
+		{
+			name:     "observed just now",
+			replayed: 60 << 20,
+			now:      observed.at,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, recoveryEstimate(observed, tt.replayed, tt.target, tt.walRate, tt.now))
+		})
+	}
+}
+
+func TestEstimateRecovery(t *testing.T) {
+	now := time.Unix(1729771200, 0)
+	cluster := annotatedCluster("pg", "app", map[string]string{AnnotationWALRate: "1024"})
+	dynamicClient := newFakeDynamicClient(cluster)
+	plugin := &RestorePluginV2{log: logrus.New(), dynamicClient: dynamicClient}
+
+	// The first poll records where replay is
+	assert.Empty(t, plugin.estimateRecovery(context.Background(), dynamicClient, cluster, "0/4000000", "0/5000000", now))
+	live, err := dynamicClient.Resource(cnpgClusterGVR).Namespace("app").Get(context.Background(), "pg", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "0/4000000@1729771200", live.GetAnnotations()[AnnotationRecoveryObserved])
+
+	// Later polls estimate from it
+	assert.Equal(t, "about 16s left to the end of the backup at 1.0 MiB/s",
+		plugin.estimateRecovery(context.Background(), dynamicClient, live, "0/5000000", "0/6000000", now.Add(16*time.Second)))
+
+	// An observation ahead of replay, left by an earlier restore, is replaced
+	assert.Empty(t, plugin.estimateRecovery(context.Background(), dynamicClient, live, "0/3000000", "0/5000000", now.Add(time.Minute)))
+	live, err = dynamicClient.Resource(cnpgClusterGVR).Namespace("app").Get(context.Background(), "pg", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "0/3000000@1729771260", live.GetAnnotations()[AnnotationRecoveryObserved])
+
+	// The observation is removed once the cluster has left recovery
+	plugin.clearRecoveryObserved(context.Background(), dynamicClient, live)
+	live, err = dynamicClient.Resource(cnpgClusterGVR).Namespace("app").Get(context.Background(), "pg", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.NotContains(t, live.GetAnnotations(), AnnotationRecoveryObserved)
+	assert.Equal(t, "1024", live.GetAnnotations()[AnnotationWALRate])
+}
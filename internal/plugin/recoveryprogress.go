@@ -0,0 +1,156 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// recoveryOperationPrefix prefixes the IDs of operations tracking the recovery of a
+// restored cluster
+const recoveryOperationPrefix = "recovery"
+
+// recoveryOperation identifies a restored cluster whose recovery is tracked, and the LSN
+// it has to replay to, empty when the cluster does not recover from a backup
+type recoveryOperation struct {
+	namespace   string
+	clusterName string
+	targetLSN   string
+}
+
+// encodeRecoveryOperationID encodes a recovery as an operation ID. LSNs contain a slash,
+// which is kept as the last part of the ID.
+func encodeRecoveryOperationID(op *recoveryOperation) string {
+	return strings.Join([]string{recoveryOperationPrefix, op.namespace, op.clusterName, op.targetLSN}, "/")
+}
+
+// decodeRecoveryOperationID decodes an operation ID produced by encodeRecoveryOperationID
+func decodeRecoveryOperationID(operationID string) (*recoveryOperation, error) {
+	parts := strings.SplitN(operationID, "/", 4)
+	if len(parts) != 4 || parts[0] != recoveryOperationPrefix || parts[2] == "" {
+		return nil, errors.Errorf("invalid recovery operation ID %q", operationID)
+	}
+	if parts[3] != "" {
+		if _, err := parseLSN(parts[3]); err != nil {
+			return nil, errors.Errorf("invalid recovery operation ID %q", operationID)
+		}
+	}
+	return &recoveryOperation{
+		namespace:   parts[1],
+		clusterName: parts[2],
+		targetLSN:   parts[3],
+	}, nil
+}
+
+// newRecoveryOperation returns the recovery of a restored cluster to track, or nil when the
+// cluster will not come up on its own: hibernated clusters, and replica clusters, which
+// never leave recovery. In recovery mode the target is the end of the pinned backup.
+func newRecoveryOperation(itemContent map[string]interface{}, restoreMode, namespace, clusterName string) *recoveryOperation {
+	if isHibernated(itemContent) {
+		return nil
+	}
+	if enabled, _, _ := unstructured.NestedBool(itemContent, "spec", "replica", "enabled"); enabled {
+		return nil
+	}
+
+	op := &recoveryOperation{namespace: namespace, clusterName: clusterName}
+	if restoreMode == RestoreModeRecovery {
+		op.targetLSN = (&unstructured.Unstructured{Object: itemContent}).GetAnnotations()[AnnotationBackupEndLSN]
+	}
+	return op
+}
+
+// recoveryProgress reports the ready instances of a restored cluster, and the LSN its
+// primary has replayed to against the target with an estimate of the time left. The
+// operation completes once the cluster is healthy with every instance ready and its
+// primary has left recovery at or past the target, and fails when the primary left
+// recovery short of it. Instance status that cannot be read yet, while pods are created,
+// is reported and retried on the next poll.
+func (p *RestorePluginV2) recoveryProgress(op *recoveryOperation) (velero.OperationProgress, error) {
+	progress := velero.OperationProgress{
+		OperationUnits: "Instances",
+		Updated:        time.Now(),
+	}
+
+	dynamicClient, err := p.getDynamicClient()
+	if err != nil {
+		return progress, errors.Wrap(err, "failed to create dynamic client")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cluster, err := dynamicClient.Resource(cnpgClusterGVR).Namespace(op.namespace).Get(ctx, op.clusterName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		progress.Description = fmt.Sprintf("Waiting for cluster %s to be created", op.clusterName)
+		return progress, nil
+	}
+	if err != nil {
+		return progress, errors.Wrapf(classifyAPIError(err), "failed to get cluster %s/%s", op.namespace, op.clusterName)
+	}
+
+	instances, _, _ := unstructured.NestedInt64(cluster.Object, "spec", "instances")
+	readyInstances, _, _ := unstructured.NestedInt64(cluster.Object, "status", "readyInstances")
+	phase, _, _ := unstructured.NestedString(cluster.Object, "status", "phase")
+	primary, _, _ := unstructured.NestedString(cluster.Object, "status", "currentPrimary")
+	progress.NTotal = instances
+	progress.NCompleted = readyInstances
+
+	target := ""
+	if op.targetLSN != "" {
+		target = ", backup ends at " + op.targetLSN
+	}
+	if primary == "" || readyInstances == 0 {
+		size := ""
+		if databaseSize, err := strconv.ParseInt(cluster.GetAnnotations()[AnnotationDatabaseSize], 10, 64); err == nil && databaseSize > 0 {
+			size = ", restoring " + FormatBytes(databaseSize)
+		}
+		progress.Description = fmt.Sprintf("Cluster %s is recovering (%s)%s%s", op.clusterName, phase, size, target)
+		return progress, nil
+	}
+
+	status, err := p.getInstanceStatus()(ctx, op.namespace, primary)
+	if err != nil {
+		progress.Description = fmt.Sprintf("Cluster %s is recovering (%s)%s, primary %s status unavailable: %v", op.clusterName, phase, target, primary, err)
+		return progress, nil
+	}
+	replayedLSN := status.CurrentLSN
+	if !status.IsPrimary {
+		replayedLSN = status.ReplayLSN
+	}
+
+	if status.IsPrimary && op.targetLSN != "" {
+		replayed, err := parseLSN(replayedLSN)
+		if err != nil {
+			return progress, errors.Wrapf(err, "invalid LSN reported by instance %s", primary)
+		}
+		expected, err := parseLSN(op.targetLSN)
+		if err != nil {
+			return progress, err
+		}
+		if replayed < expected {
+			progress.Completed = true
+			progress.Err = fmt.Sprintf("cluster %s/%s left recovery at %s, short of the end of the backup at %s", op.namespace, op.clusterName, replayedLSN, op.targetLSN)
+			return progress, nil
+		}
+	}
+
+	state := "replayed to"
+	if status.IsPrimary {
+		state = "left recovery at"
+		p.clearRecoveryObserved(ctx, dynamicClient, cluster)
+	} else if estimate := p.estimateRecovery(ctx, dynamicClient, cluster, replayedLSN, op.targetLSN, time.Now()); estimate != "" {
+		target += ", " + estimate
+	}
+	progress.Description = fmt.Sprintf("Cluster %s (%s): primary %s %s %s%s", op.clusterName, phase, primary, state, replayedLSN, target)
+	progress.Completed = status.IsPrimary && phase == clusterPhaseHealthy && readyInstances >= instances
+	return progress, nil
+}
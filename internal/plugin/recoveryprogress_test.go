@@ -0,0 +1,200 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestRecoveryOperationID(t *testing.T) {
+	op := &recoveryOperation{namespace: "app", clusterName: "pg", targetLSN: "0/5000138"}
+	operationID := encodeRecoveryOperationID(op)
+	assert.Equal(t, "recovery/app/pg/0/5000138", operationID)
+
+	decoded, err := decodeRecoveryOperationID(operationID)
+	require.NoError(t, err)
+	assert.Equal(t, op, decoded)
+
+	decoded, err = decodeRecoveryOperationID("recovery/app/pg/")
+	require.NoError(t, err)
+	assert.Empty(t, decoded.targetLSN)
+
+	for _, invalid := range []string{"recovery/app", "recovery/app//0/1", "poolers/app/pg/pg-rw", "recovery/app/pg/not-an-lsn"} {
+		_, err := decodeRecoveryOperationID(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestNewRecoveryOperation(t *testing.T) {
+	cluster := annotatedCluster("pg", "app", map[string]string{AnnotationBackupEndLSN: "0/5000138"})
+
+	op := newRecoveryOperation(cluster.Object, RestoreModeRecovery, "app", "pg")
+	require.NotNil(t, op)
+	assert.Equal(t, "0/5000138", op.targetLSN)
+
+	// Clusters not recovering from the backup have no target
+	op = newRecoveryOperation(cluster.Object, RestoreModeImport, "app", "pg")
+	require.NotNil(t, op)
+	assert.Empty(t, op.targetLSN)
+
+	replica := cluster.DeepCopy()
+	require.NoError(t, unstructured.SetNestedField(replica.Object, true, "spec", "replica", "enabled"))
+	assert.Nil(t, newRecoveryOperation(replica.Object, RestoreModeRecovery, "app", "pg"))
+
+	hibernated := annotatedCluster("pg", "app", map[string]string{AnnotationHibernation: "on"})
+	assert.Nil(t, newRecoveryOperation(hibernated.Object, RestoreModeRecovery, "app", "pg"))
+}
+
+func TestRecoveryProgress(t *testing.T) {
+	restoredCluster := func(phase, primary string, ready int64) *unstructured.Unstructured {
+		cluster := annotatedCluster("pg", "app", nil)
+		cluster.Object["spec"] = map[string]interface{}{"instances": int64(3)}
+		cluster.Object["status"] = map[string]interface{}{"phase": phase, "currentPrimary": primary, "readyInstances": ready}
+		return cluster
+	}
+
+	tests := []struct {
+		name                string
+		cluster             *unstructured.Unstructured
+		status              *InstanceStatus
+		statusErr           error
+		targetLSN           string
+		expectedCompleted   bool
+		expectedReady       int64
+		expectedDescription string
+		expectedErr         string
+	}{
+		{
+			name:                "not created yet",
+			expectedDescription: "Waiting for cluster pg to be created",
+		},
+		{
+			name:                "full recovery running",
+			cluster:             restoredCluster("Setting up primary", "", 0),
+			targetLSN:           "0/5000138",
+			expectedDescription: "Cluster pg is recovering (Setting up primary), backup ends at 0/5000138",
+		},
+		{
+			name: "base backup restoring",
+			cluster: func() *unstructured.Unstructured {
+				cluster := restoredCluster("Setting up primary", "", 0)
+				cluster.SetAnnotations(map[string]string{AnnotationDatabaseSize: "1610612736"})
+				return cluster
+			}(),
+			targetLSN:           "0/5000138",
+			expectedDescription: "Cluster pg is recovering (Setting up primary), restoring 1.5 GiB, backup ends at 0/5000138",
+		},
+		{
+			name:                "primary replaying",
+			cluster:             restoredCluster("Setting up primary", "pg-1", 1),
+			status:              &InstanceStatus{ReplayLSN: "0/4000000"},
+			targetLSN:           "0/5000138",
+			expectedReady:       1,
+			expectedDescription: "Cluster pg (Setting up primary): primary pg-1 replayed to 0/4000000, backup ends at 0/5000138",
+		},
+		{
+			name:                "status unavailable",
+			cluster:             restoredCluster("Setting up primary", "pg-1", 1),
+			statusErr:           errors.New("connection refused"),
+			expectedReady:       1,
+			expectedDescription: "primary pg-1 status unavailable: connection refused",
+		},
+		{
+			name:                "replicas joining",
+			cluster:             restoredCluster("Creating a new replica", "pg-1", 2),
+			status:              &InstanceStatus{IsPrimary: true, CurrentLSN: "0/6000060"},
+			targetLSN:           "0/5000138",
+			expectedReady:       2,
+			expectedDescription: "primary pg-1 left recovery at 0/6000060",
+		},
+		{
+			name:                "recovered",
+			cluster:             restoredCluster(clusterPhaseHealthy, "pg-1", 3),
+			status:              &InstanceStatus{IsPrimary: true, CurrentLSN: "0/6000060"},
+			targetLSN:           "0/5000138",
+			expectedCompleted:   true,
+			expectedReady:       3,
+			expectedDescription: "primary pg-1 left recovery at 0/6000060, backup ends at 0/5000138",
+		},
+		{
+			name:                "recovered without target",
+			cluster:             restoredCluster(clusterPhaseHealthy, "pg-1", 3),
+			status:              &InstanceStatus{IsPrimary: true, CurrentLSN: "0/6000060"},
+			expectedCompleted:   true,
+			expectedReady:       3,
+			expectedDescription: "primary pg-1 left recovery at 0/6000060",
+		},
+		{
+			name:              "recovered short of the target",
+			cluster:           restoredCluster(clusterPhaseHealthy, "pg-1", 3),
+			status:            &InstanceStatus{IsPrimary: true, CurrentLSN: "0/4000000"},
+			targetLSN:         "0/5000138",
+			expectedCompleted: true,
+			expectedReady:     3,
+			expectedErr:       "left recovery at 0/4000000, short of the end of the backup at 0/5000138",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dynamicClient := newFakeDynamicClient()
+			if tt.cluster != nil {
+				dynamicClient = newFakeDynamicClient(tt.cluster)
+			}
+			plugin := &RestorePluginV2{
+				log:           logrus.New(),
+				dynamicClient: dynamicClient,
+				instanceStatus: func(ctx context.Context, namespace, pod string) (*InstanceStatus, error) {
+					return tt.status, tt.statusErr
+				},
+			}
+
+			progress, err := plugin.recoveryProgress(&recoveryOperation{namespace: "app", clusterName: "pg", targetLSN: tt.targetLSN})
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedCompleted, progress.Completed)
+			assert.Equal(t, tt.expectedReady, progress.NCompleted)
+			assert.Equal(t, "Instances", progress.OperationUnits)
+			assert.Contains(t, progress.Description, tt.expectedDescription)
+			if tt.expectedErr != "" {
+				assert.Contains(t, progress.Err, tt.expectedErr)
+			} else {
+				assert.Empty(t, progress.Err)
+			}
+		})
+	}
+}
+
+func TestRestoreExecuteTracksRecovery(t *testing.T) {
+	for _, track := range []bool{false, true} {
+		item := annotatedCluster("pg", "default", map[string]string{
+			AnnotationServerName:      "pg",
+			AnnotationBackupMethod:    BackupMethodPlugin,
+			AnnotationCurrentBackupID: "20241024T120000",
+			AnnotationBackupEndLSN:    "0/5000138",
+		})
+		item.Object["spec"] = createMockPluginCluster("pg", "default").Object["spec"]
+
+		plugin := &RestorePluginV2{
+			log:           logrus.New(),
+			config:        &PluginConfig{RestoreMode: RestoreModeRecovery, TrackRecovery: track, SkipSchemaValidation: true, SkipPluginCheck: true},
+			dynamicClient: newFakeDynamicClient(),
+			kubeClient:    newFakeKubeClient(),
+		}
+
+		out, err := plugin.Execute(&velero.RestoreItemActionExecuteInput{Item: item})
+		require.NoError(t, err)
+		if track {
+			operationID, _, err := splitStarted(out.OperationID)
+			require.NoError(t, err)
+			assert.Equal(t, "recovery/default/pg/0/5000138", operationID)
+		} else {
+			assert.Empty(t, out.OperationID)
+		}
+	}
+}
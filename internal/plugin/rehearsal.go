@@ -0,0 +1,147 @@
+package plugin
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/label"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// AnnotationRehearsal is the annotation on a Velero Restore that makes it a rehearsal, or
+// a regular restore when set to false, whatever rehearsal.enabled says
+const AnnotationRehearsal = "velero-cnpg/rehearsal"
+
+// LabelRehearsal labels the resources a rehearsal creates with the name of its restore,
+// so drills can be told apart from real restores and cleaned up
+const LabelRehearsal = "velero-cnpg/rehearsal"
+
+// rehearsalNamespace returns the scratch namespace the restore rehearses into, or "" when
+// it is a regular restore. Restores are rehearsals when annotated, or when the config
+// enables rehearsals for every restore.
+func rehearsalNamespace(restore *v1.Restore, config *PluginConfig) (string, error) {
+	if restore == nil {
+		return "", nil
+	}
+	enabled := config.Rehearsal != nil && config.Rehearsal.Enabled
+	if annotated, err := strconv.ParseBool(restore.Annotations[AnnotationRehearsal]); err == nil {
+		enabled = annotated
+	}
+	if !enabled {
+		return "", nil
+	}
+	if config.Rehearsal == nil || config.Rehearsal.Namespace == "" {
+		return "", errors.Errorf("restore %s is a rehearsal, but no rehearsal namespace is configured", restore.Name)
+	}
+	return config.Rehearsal.Namespace, nil
+}
+
+// rehearse moves a CNPG item into the scratch namespace and labels it as a drill, with the
+// restore and backup labels Velero would have added had it created the item
+func rehearse(itemContent map[string]interface{}, namespace string, restore *v1.Restore) {
+	item := &unstructured.Unstructured{Object: itemContent}
+	item.SetNamespace(namespace)
+
+	labels := item.GetLabels()
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labels[LabelRehearsal] = label.GetValidName(restore.Name)
+	labels[v1.RestoreNameLabel] = label.GetValidName(restore.Name)
+	labels[v1.BackupNameLabel] = label.GetValidName(restore.Spec.BackupName)
+	item.SetLabels(labels)
+}
+
+// rehearseCluster prepares a rehearsed cluster: its WAL archiving is disabled, so the drill
+// cannot write to the archive of the cluster it was restored from, and the drill label is
+// inherited by the pods, PVCs and other resources the operator creates for it
+func rehearseCluster(itemContent map[string]interface{}, restore *v1.Restore) error {
+	specMap, err := getSpecMap(itemContent)
+	if err != nil {
+		return err
+	}
+
+	delete(specMap, "backup")
+	plugins, ok := specMap["plugins"].([]interface{})
+	if _, found := specMap["plugins"]; found && !ok {
+		return specShapeError("plugins is not a list")
+	}
+	if entry := walArchiverEntry(plugins, "serverName", true); entry != nil {
+		entry["enabled"] = false
+	}
+	for _, plugin := range sliceOfMaps(plugins) {
+		if archiver, _ := plugin["isWALArchiver"].(bool); archiver {
+			plugin["enabled"] = false
+		}
+	}
+
+	inherited, err := ensureNestedMapNoCopy(specMap, "inheritedMetadata", "labels")
+	if err != nil {
+		return errors.Wrap(err, "failed to label inherited metadata")
+	}
+	inherited[LabelRehearsal] = label.GetValidName(restore.Name)
+	return nil
+}
+
+// createRehearsalItem creates a rehearsed item in the scratch namespace, creating the
+// namespace when it is missing. Velero sets the namespace of the items it restores after
+// the restore item actions ran, so rehearsed items are created by the action and left out
+// of Velero's restore. An item left over from an earlier drill is an error rather than
+// overwritten.
+func createRehearsalItem(dynamicClient dynamic.Interface, kubeClient kubernetes.Interface, item *unstructured.Unstructured) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	namespace := item.GetNamespace()
+	if _, err := kubeClient.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{}); apierrors.IsNotFound(err) {
+		_, err = kubeClient.CoreV1().Namespaces().Create(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}}, metav1.CreateOptions{})
+		if err != nil && !apierrors.IsAlreadyExists(err) {
+			return errors.Wrapf(classifyAPIError(err), "failed to create rehearsal namespace %s", namespace)
+		}
+	} else if err != nil {
+		return errors.Wrapf(classifyAPIError(err), "failed to get rehearsal namespace %s", namespace)
+	}
+
+	gvk := item.GroupVersionKind()
+	// CNPG resources are named after the lowercase plural of their kind
+	gvr := schema.GroupVersionResource{Group: gvk.Group, Version: gvk.Version, Resource: strings.ToLower(gvk.Kind) + "s"}
+	_, err := dynamicClient.Resource(gvr).Namespace(namespace).Create(ctx, item, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		return errors.Errorf("%s %s/%s already exists in the rehearsal namespace, delete the earlier drill first", gvk.Kind, namespace, item.GetName())
+	}
+	if err != nil {
+		return errors.Wrapf(classifyAPIError(err), "failed to create %s %s/%s", gvk.Kind, namespace, item.GetName())
+	}
+	return nil
+}
+
+// createRehearsal creates the rehearsed cluster of the output and leaves it out of
+// Velero's restore, keeping the operations started for it
+func (p *RestorePluginV2) createRehearsal(out *velero.RestoreItemActionExecuteOutput) (*velero.RestoreItemActionExecuteOutput, error) {
+	dynamicClient, err := p.getDynamicClient()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create dynamic client")
+	}
+	kubeClient, err := p.getKubeClient()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get Kubernetes client")
+	}
+
+	item := &unstructured.Unstructured{Object: out.UpdatedItem.UnstructuredContent()}
+	if err := createRehearsalItem(dynamicClient, kubeClient, item); err != nil {
+		return nil, err
+	}
+	p.log.Infof("Created rehearsal cluster %s/%s", item.GetNamespace(), item.GetName())
+	return out.WithoutRestore(), nil
+}
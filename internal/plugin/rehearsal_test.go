@@ -0,0 +1,182 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRehearsalNamespace(t *testing.T) {
+	annotated := func(value string) *v1.Restore {
+		return &v1.Restore{ObjectMeta: metav1.ObjectMeta{Name: "dr-drill", Annotations: map[string]string{AnnotationRehearsal: value}}}
+	}
+	plain := &v1.Restore{ObjectMeta: metav1.ObjectMeta{Name: "dr-drill"}}
+	scratch := &RehearsalConfig{Namespace: "restore-drills"}
+
+	tests := []struct {
+		name          string
+		restore       *v1.Restore
+		rehearsal     *RehearsalConfig
+		expected      string
+		expectedError string
+	}{
+		{name: "no restore", rehearsal: &RehearsalConfig{Enabled: true, Namespace: "restore-drills"}},
+		{name: "regular restore", restore: plain, rehearsal: scratch},
+		{name: "enabled for every restore", restore: plain, rehearsal: &RehearsalConfig{Enabled: true, Namespace: "restore-drills"}, expected: "restore-drills"},
+		{name: "annotated restore", restore: annotated("true"), rehearsal: scratch, expected: "restore-drills"},
+		{name: "annotation wins over the config", restore: annotated("false"), rehearsal: &RehearsalConfig{Enabled: true, Namespace: "restore-drills"}},
+		{name: "annotated without namespace", restore: annotated("true"), expectedError: "no rehearsal namespace is configured"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			namespace, err := rehearsalNamespace(tt.restore, &PluginConfig{Rehearsal: tt.rehearsal})
+			if tt.expectedError != "" {
+				assert.ErrorContains(t, err, tt.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, namespace)
+		})
+	}
+}
+
+func TestRehearseCluster(t *testing.T) {
+	restore := &v1.Restore{
+		ObjectMeta: metav1.ObjectMeta{Name: "dr-drill"},
+		Spec:       v1.RestoreSpec{BackupName: "nightly"},
+	}
+	cluster := createMockArchivingCluster("pg", "prod", "pg", nil)
+	plugins, _, _ := unstructured.NestedSlice(cluster.Object, "spec", "plugins")
+	plugins = append(plugins, map[string]interface{}{"name": "custom-archiver", "isWALArchiver": true})
+	require.NoError(t, unstructured.SetNestedSlice(cluster.Object, plugins, "spec", "plugins"))
+
+	rehearse(cluster.Object, "restore-drills", restore)
+	require.NoError(t, rehearseCluster(cluster.Object, restore))
+
+	assert.Equal(t, "restore-drills", cluster.GetNamespace())
+	assert.Equal(t, map[string]string{
+		LabelRehearsal:      "dr-drill",
+		v1.RestoreNameLabel: "dr-drill",
+		v1.BackupNameLabel:  "nightly",
+	}, cluster.GetLabels())
+
+	_, found, _ := unstructured.NestedMap(cluster.Object, "spec", "backup")
+	assert.False(t, found)
+	plugins, _, _ = unstructured.NestedSlice(cluster.Object, "spec", "plugins")
+	for _, plugin := range plugins {
+		assert.Equal(t, false, plugin.(map[string]interface{})["enabled"])
+	}
+	inherited, _, _ := unstructured.NestedStringMap(cluster.Object, "spec", "inheritedMetadata", "labels")
+	assert.Equal(t, map[string]string{LabelRehearsal: "dr-drill"}, inherited)
+}
+
+func TestCreateRehearsalItem(t *testing.T) {
+	dynamicClient := newFakeDynamicClient()
+	kubeClient := fake.NewClientset()
+
+	require.NoError(t, createRehearsalItem(dynamicClient, kubeClient, createMockPluginCluster("pg", "restore-drills")))
+	_, err := kubeClient.CoreV1().Namespaces().Get(context.Background(), "restore-drills", metav1.GetOptions{})
+	require.NoError(t, err)
+	_, err = dynamicClient.Resource(cnpgClusterGVR).Namespace("restore-drills").Get(context.Background(), "pg", metav1.GetOptions{})
+	require.NoError(t, err)
+
+	// An existing namespace is used as is, a cluster left over from an earlier drill is not replaced
+	require.NoError(t, createRehearsalItem(dynamicClient, kubeClient, createMockPluginCluster("reports", "restore-drills")))
+	err = createRehearsalItem(dynamicClient, kubeClient, createMockPluginCluster("pg", "restore-drills"))
+	assert.ErrorContains(t, err, "Cluster restore-drills/pg already exists in the rehearsal namespace")
+}
+
+func TestExecuteRehearsal(t *testing.T) {
+	config := DefaultPluginConfig()
+	config.SkipPluginCheck = true
+	config.Rehearsal = &RehearsalConfig{Namespace: "restore-drills"}
+	restore := &v1.Restore{
+		ObjectMeta: metav1.ObjectMeta{Name: "dr-drill", Namespace: "velero", Annotations: map[string]string{AnnotationRehearsal: "true"}},
+		Spec:       v1.RestoreSpec{BackupName: "nightly"},
+	}
+	newItem := func(method string) *unstructured.Unstructured {
+		item := createMockPluginCluster("pg", "prod")
+		item.SetAnnotations(map[string]string{
+			AnnotationServerName:   "pg",
+			AnnotationBackupMethod: method,
+		})
+		return item
+	}
+
+	dynamicClient := newFakeDynamicClient()
+	kubeClient := newFakeKubeClient()
+	plugin := &RestorePluginV2{
+		log:           logrus.New(),
+		config:        config,
+		dynamicClient: dynamicClient,
+		kubeClient:    kubeClient,
+	}
+
+	output, err := plugin.Execute(&velero.RestoreItemActionExecuteInput{Item: newItem(BackupMethodPlugin), Restore: restore})
+	require.NoError(t, err)
+	assert.True(t, output.SkipRestore)
+
+	_, err = dynamicClient.Resource(cnpgClusterGVR).Namespace("prod").Get(context.Background(), "pg", metav1.GetOptions{})
+	assert.Error(t, err)
+	cluster, err := dynamicClient.Resource(cnpgClusterGVR).Namespace("restore-drills").Get(context.Background(), "pg", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "dr-drill", cluster.GetLabels()[LabelRehearsal])
+	_, recovered, _ := unstructured.NestedMap(cluster.Object, "spec", "bootstrap", "recovery")
+	assert.True(t, recovered)
+	plugins, _, _ := unstructured.NestedSlice(cluster.Object, "spec", "plugins")
+	require.Len(t, plugins, 1)
+	assert.Equal(t, false, plugins[0].(map[string]interface{})["enabled"])
+
+	configMap, err := kubeClient.CoreV1().ConfigMaps("restore-drills").Get(context.Background(), OverrideConfigMapName, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "dr-drill", configMap.Labels[LabelRehearsal])
+
+	_, err = plugin.Execute(&velero.RestoreItemActionExecuteInput{Item: newItem(BackupMethodPlugin), Restore: restore})
+	assert.ErrorContains(t, err, "already exists in the rehearsal namespace")
+
+	_, err = plugin.Execute(&velero.RestoreItemActionExecuteInput{Item: newItem(BackupMethodVolumeSnapshot), Restore: restore})
+	assert.ErrorContains(t, err, "cannot be rehearsed")
+}
+
+func TestDependentsRestorePluginRehearsal(t *testing.T) {
+	restore := &v1.Restore{ObjectMeta: metav1.ObjectMeta{Name: "dr-drill", Annotations: map[string]string{AnnotationRehearsal: "true"}}}
+	dynamicClient := newFakeDynamicClient()
+	kubeClient := fake.NewClientset(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "restore-drills"}})
+	plugin := &DependentsRestorePlugin{
+		log:           logrus.New(),
+		config:        &PluginConfig{Rehearsal: &RehearsalConfig{Namespace: "restore-drills"}},
+		dynamicClient: dynamicClient,
+		kubeClient:    kubeClient,
+	}
+	dependent := func(kind string) *unstructured.Unstructured {
+		return &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "postgresql.cnpg.io/v1",
+			"kind":       kind,
+			"metadata":   map[string]interface{}{"name": "pg", "namespace": "prod"},
+			"spec":       map[string]interface{}{"cluster": map[string]interface{}{"name": "pg"}},
+		}}
+	}
+
+	output, err := plugin.Execute(&velero.RestoreItemActionExecuteInput{Item: dependent("Pooler"), Restore: restore})
+	require.NoError(t, err)
+	assert.True(t, output.SkipRestore)
+	pooler, err := dynamicClient.Resource(cnpgPoolerGVR).Namespace("restore-drills").Get(context.Background(), "pg", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "dr-drill", pooler.GetLabels()[LabelRehearsal])
+
+	output, err = plugin.Execute(&velero.RestoreItemActionExecuteInput{Item: dependent("ScheduledBackup"), Restore: restore})
+	require.NoError(t, err)
+	assert.True(t, output.SkipRestore)
+	_, err = dynamicClient.Resource(cnpgScheduledBackupGVR).Namespace("restore-drills").Get(context.Background(), "pg", metav1.GetOptions{})
+	assert.Error(t, err)
+}
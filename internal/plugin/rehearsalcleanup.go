@@ -0,0 +1,270 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// AnnotationRehearsalVerified is the annotation the rehearsal cleanup sets on a rehearsed
+// cluster once it was verified to have replayed WAL up to the end of its backup, with the
+// time of the verification in RFC 3339
+const AnnotationRehearsalVerified = "velero-cnpg/rehearsal-verified"
+
+// Outcomes of the cleanup of a rehearsed cluster
+const (
+	// RehearsalVerifying is a drill that was not verified yet and is kept
+	RehearsalVerifying = "verifying"
+
+	// RehearsalVerified is a verified drill kept until its TTL has passed
+	RehearsalVerified = "verified"
+
+	// RehearsalDeleted is a verified drill deleted once its TTL has passed
+	RehearsalDeleted = "deleted"
+
+	// RehearsalExpired is a drill deleted because it was not verified within the max age
+	RehearsalExpired = "expired"
+)
+
+// cnpgDatabaseGVR, cnpgPublicationGVR and cnpgSubscriptionGVR identify the CNPG resources
+// declaring databases and logical replication of a cluster
+var (
+	cnpgDatabaseGVR     = schema.GroupVersionResource{Group: "postgresql.cnpg.io", Version: "v1", Resource: "databases"}
+	cnpgPublicationGVR  = schema.GroupVersionResource{Group: "postgresql.cnpg.io", Version: "v1", Resource: "publications"}
+	cnpgSubscriptionGVR = schema.GroupVersionResource{Group: "postgresql.cnpg.io", Version: "v1", Resource: "subscriptions"}
+)
+
+// rehearsalDependentGVRs are the CNPG resources rehearsals create next to their cluster
+var rehearsalDependentGVRs = []schema.GroupVersionResource{cnpgPoolerGVR, cnpgDatabaseGVR, cnpgPublicationGVR, cnpgSubscriptionGVR}
+
+// RehearsalCleanupOptions configures the cleanup of rehearsal restores
+type RehearsalCleanupOptions struct {
+	// TTL is how long a drill is kept after it was verified
+	TTL time.Duration
+
+	// MaxAge is how long after its creation a drill that was not verified is deleted.
+	// Zero keeps such drills for investigation.
+	MaxAge time.Duration
+
+	// DryRun reports what would be deleted without deleting or annotating anything
+	DryRun bool
+}
+
+// RehearsalCleanupResult reports what the cleanup did with a rehearsed cluster
+type RehearsalCleanupResult struct {
+	Namespace string `json:"namespace"`
+	Cluster   string `json:"cluster"`
+
+	// Restore is the name of the rehearsal restore, from the drill label
+	Restore string `json:"restore"`
+
+	// Outcome is one of verifying, verified, deleted and expired
+	Outcome string `json:"outcome"`
+
+	// VerifiedAt is when the drill was verified
+	VerifiedAt *time.Time `json:"verifiedAt,omitempty"`
+
+	// Problems explains why the drill is not verified yet
+	Problems []string `json:"problems,omitempty"`
+
+	// Deleted lists the resources deleted with the drill, as <resource>/<name>. The
+	// override ConfigMap is listed when the keys of the cluster were removed from it.
+	Deleted []string `json:"deleted,omitempty"`
+
+	// Error is why the drill could not be annotated or deleted, retried on the next pass
+	Error string `json:"error,omitempty"`
+}
+
+// CleanupRehearsals verifies the rehearsed clusters of the namespace and deletes them,
+// along with their PVCs, dependent resources and override ConfigMap keys, once the TTL
+// has passed since their verification. The verification is recorded on the cluster, so
+// the TTL holds across passes. Failing to clean up one drill is reported in its result,
+// so the others are still cleaned up.
+func CleanupRehearsals(ctx context.Context, client kubernetes.Interface, dynamicClient dynamic.Interface, instanceStatus InstanceStatusFunc, namespace string, options RehearsalCleanupOptions, now time.Time) ([]RehearsalCleanupResult, error) {
+	clusters, err := dynamicClient.Resource(cnpgClusterGVR).Namespace(namespace).List(ctx, metav1.ListOptions{LabelSelector: LabelRehearsal})
+	if err != nil {
+		return nil, errors.Wrapf(classifyAPIError(err), "failed to list rehearsed clusters in namespace %s", namespace)
+	}
+
+	results := []RehearsalCleanupResult{}
+	for i := range clusters.Items {
+		cluster := &clusters.Items[i]
+		result := RehearsalCleanupResult{
+			Namespace: namespace,
+			Cluster:   cluster.GetName(),
+			Restore:   cluster.GetLabels()[LabelRehearsal],
+		}
+
+		verifiedAt, verified := rehearsalVerifiedAt(cluster)
+		if !verified {
+			verify, err := VerifyRestoredCluster(ctx, dynamicClient, instanceStatus, namespace, cluster.GetName())
+			switch {
+			case err != nil:
+				result.Problems = []string{err.Error()}
+			case !verify.Reached:
+				result.Problems = verify.Problems
+			default:
+				verifiedAt, verified = now, true
+				if !options.DryRun {
+					if err := patchClusterAnnotation(ctx, dynamicClient, cluster, AnnotationRehearsalVerified, now.UTC().Format(time.RFC3339)); err != nil {
+						result.Outcome = RehearsalVerified
+						result.VerifiedAt = &verifiedAt
+						result.Error = fmt.Sprintf("failed to record the verification: %v", err)
+						results = append(results, result)
+						continue
+					}
+				}
+			}
+		}
+		if verified {
+			result.VerifiedAt = &verifiedAt
+		}
+
+		switch {
+		case verified && !now.Before(verifiedAt.Add(options.TTL)):
+			result.Outcome = RehearsalDeleted
+		case verified:
+			result.Outcome = RehearsalVerified
+		case options.MaxAge > 0 && !now.Before(cluster.GetCreationTimestamp().Add(options.MaxAge)):
+			result.Outcome = RehearsalExpired
+		default:
+			result.Outcome = RehearsalVerifying
+		}
+
+		if result.Outcome == RehearsalDeleted || result.Outcome == RehearsalExpired {
+			result.Deleted, err = deleteRehearsal(ctx, client, dynamicClient, cluster, options.DryRun)
+			if err != nil {
+				result.Error = err.Error()
+			}
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// rehearsalVerifiedAt returns when the rehearsed cluster was verified. An annotation that
+// cannot be parsed is ignored, so the cluster is verified again.
+func rehearsalVerifiedAt(cluster *unstructured.Unstructured) (time.Time, bool) {
+	value, found := cluster.GetAnnotations()[AnnotationRehearsalVerified]
+	if !found {
+		return time.Time{}, false
+	}
+	verifiedAt, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return verifiedAt, true
+}
+
+// deleteRehearsal deletes a rehearsed cluster and what was restored or created for it,
+// and returns what it deleted. The cluster is deleted last, so a failed cleanup is found
+// and retried on the next pass. Only resources carrying the drill label are deleted.
+func deleteRehearsal(ctx context.Context, client kubernetes.Interface, dynamicClient dynamic.Interface, cluster *unstructured.Unstructured, dryRun bool) ([]string, error) {
+	namespace, name := cluster.GetNamespace(), cluster.GetName()
+	var deleted []string
+
+	for _, gvr := range rehearsalDependentGVRs {
+		dependents, err := dynamicClient.Resource(gvr).Namespace(namespace).List(ctx, metav1.ListOptions{LabelSelector: LabelRehearsal})
+		if err != nil {
+			return deleted, errors.Wrapf(classifyAPIError(err), "failed to list %s in namespace %s", gvr.Resource, namespace)
+		}
+		for i := range dependents.Items {
+			dependent := &dependents.Items[i]
+			if boundCluster(dependent) != name {
+				continue
+			}
+			if !dryRun {
+				err := dynamicClient.Resource(gvr).Namespace(namespace).Delete(ctx, dependent.GetName(), metav1.DeleteOptions{})
+				if err != nil && !apierrors.IsNotFound(err) {
+					return deleted, errors.Wrapf(classifyAPIError(err), "failed to delete %s %s/%s", gvr.Resource, namespace, dependent.GetName())
+				}
+			}
+			deleted = append(deleted, gvr.Resource+"/"+dependent.GetName())
+		}
+	}
+
+	cleaned, err := cleanupRehearsalOverride(ctx, client, namespace, name, dryRun)
+	if err != nil {
+		return deleted, err
+	}
+	if cleaned {
+		deleted = append(deleted, "configmaps/"+OverrideConfigMapName)
+	}
+
+	pvcs, err := client.CoreV1().PersistentVolumeClaims(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s,%s=%s", LabelRehearsal, LabelCluster, name),
+	})
+	if err != nil {
+		return deleted, errors.Wrapf(classifyAPIError(err), "failed to list PVCs of cluster %s/%s", namespace, name)
+	}
+	for _, pvc := range pvcs.Items {
+		if !dryRun {
+			err := client.CoreV1().PersistentVolumeClaims(namespace).Delete(ctx, pvc.Name, metav1.DeleteOptions{})
+			if err != nil && !apierrors.IsNotFound(err) {
+				return deleted, errors.Wrapf(classifyAPIError(err), "failed to delete PVC %s/%s", namespace, pvc.Name)
+			}
+		}
+		deleted = append(deleted, "persistentvolumeclaims/"+pvc.Name)
+	}
+
+	if !dryRun {
+		err := dynamicClient.Resource(cnpgClusterGVR).Namespace(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return deleted, errors.Wrapf(classifyAPIError(err), "failed to delete cluster %s/%s", namespace, name)
+		}
+	}
+	deleted = append(deleted, "clusters/"+name)
+	return deleted, nil
+}
+
+// cleanupRehearsalOverride removes the keys of a rehearsed cluster from the override
+// ConfigMap of the scratch namespace, and deletes the ConfigMap once no other cluster has
+// keys in it. ConfigMaps not labelled as drills are left alone. It reports whether the
+// ConfigMap held keys of the cluster.
+func cleanupRehearsalOverride(ctx context.Context, client kubernetes.Interface, namespace, clusterName string, dryRun bool) (bool, error) {
+	configMaps := client.CoreV1().ConfigMaps(namespace)
+	configMap, err := configMaps.Get(ctx, OverrideConfigMapName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(classifyAPIError(err), "failed to get ConfigMap %s/%s", namespace, OverrideConfigMapName)
+	}
+	if _, drill := configMap.Labels[LabelRehearsal]; !drill {
+		return false, nil
+	}
+
+	prefix := clusterName + "."
+	found, others := false, false
+	for key := range configMap.Data {
+		switch {
+		case strings.HasPrefix(key, prefix):
+			found = true
+			delete(configMap.Data, key)
+		case strings.Contains(key, "."):
+			others = true
+		}
+	}
+	if !found || dryRun {
+		return found, nil
+	}
+
+	if others {
+		_, err = configMaps.Update(ctx, configMap, metav1.UpdateOptions{})
+	} else {
+		err = configMaps.Delete(ctx, OverrideConfigMapName, metav1.DeleteOptions{})
+	}
+	if err != nil && !apierrors.IsNotFound(err) {
+		return false, errors.Wrapf(classifyAPIError(err), "failed to clean up ConfigMap %s/%s", namespace, OverrideConfigMapName)
+	}
+	return true, nil
+}
@@ -0,0 +1,169 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCleanupRehearsals(t *testing.T) {
+	now := time.Date(2024, 10, 24, 12, 0, 0, 0, time.UTC)
+	drill := func(name string, created time.Time, annotations map[string]string) *unstructured.Unstructured {
+		cluster := createMockPluginCluster(name, "restore-drills")
+		cluster.SetLabels(map[string]string{LabelRehearsal: "drill-1"})
+		cluster.SetCreationTimestamp(metav1.NewTime(created))
+		cluster.SetAnnotations(annotations)
+		cluster.Object["status"] = map[string]interface{}{"currentPrimary": name + "-1"}
+		return cluster
+	}
+	instanceStatus := func(ctx context.Context, namespace, pod string) (*InstanceStatus, error) {
+		return &InstanceStatus{IsPrimary: pod == "fresh-1", CurrentLSN: "0/4000000", ReplayLSN: "0/2000000", TimeLineID: 2}, nil
+	}
+	pooler := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "postgresql.cnpg.io/v1",
+		"kind":       "Pooler",
+		"metadata":   map[string]interface{}{"name": "done-rw", "namespace": "restore-drills", "labels": map[string]interface{}{LabelRehearsal: "drill-1"}},
+		"spec":       map[string]interface{}{"cluster": map[string]interface{}{"name": "done"}},
+	}}
+	pvc := func(cluster, name string) *corev1.PersistentVolumeClaim {
+		return &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "restore-drills",
+			Labels:    map[string]string{LabelRehearsal: "drill-1", LabelCluster: cluster},
+		}}
+	}
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: OverrideConfigMapName, Namespace: "restore-drills", Labels: map[string]string{LabelRehearsal: "drill-1"}},
+		Data: map[string]string{
+			"write_to_server_name":       "fresh-a1b2",
+			"done.write_to_server_name":  "done-c3d4",
+			"done.read_from_server_name": "done",
+			"fresh.write_to_server_name": "fresh-a1b2",
+		},
+	}
+	verified := now.Add(-2 * time.Hour).Format(time.RFC3339)
+	backupEnd := map[string]string{AnnotationBackupEndLSN: "0/3000000"}
+
+	newClients := func() (*fake.Clientset, []runtime.Object) {
+		notDrill := createMockPluginCluster("prod", "restore-drills")
+		return fake.NewClientset(pvc("done", "done-1"), pvc("fresh", "fresh-1"), configMap.DeepCopy()), []runtime.Object{
+			drill("done", now.Add(-3*time.Hour), map[string]string{AnnotationRehearsalVerified: verified}),
+			drill("fresh", now.Add(-time.Hour), backupEnd),
+			drill("stuck", now.Add(-48*time.Hour), backupEnd),
+			notDrill,
+			pooler,
+		}
+	}
+
+	t.Run("cleanup", func(t *testing.T) {
+		client, objects := newClients()
+		dynamicClient := newFakeDynamicClient(objects...)
+		options := RehearsalCleanupOptions{TTL: time.Hour}
+
+		results, err := CleanupRehearsals(context.Background(), client, dynamicClient, instanceStatus, "restore-drills", options, now)
+		require.NoError(t, err)
+		require.Len(t, results, 3)
+
+		assert.Equal(t, RehearsalDeleted, results[0].Outcome)
+		assert.Equal(t, "drill-1", results[0].Restore)
+		assert.Equal(t, []string{"poolers/done-rw", "configmaps/" + OverrideConfigMapName, "persistentvolumeclaims/done-1", "clusters/done"}, results[0].Deleted)
+		assert.Empty(t, results[0].Error)
+
+		assert.Equal(t, RehearsalVerified, results[1].Outcome)
+		require.NotNil(t, results[1].VerifiedAt)
+		assert.Equal(t, now, *results[1].VerifiedAt)
+
+		assert.Equal(t, RehearsalVerifying, results[2].Outcome)
+		assert.Equal(t, []string{"primary stuck-1 is still in recovery", "replayed up to 0/2000000, short of the end of the backup at 0/3000000"}, results[2].Problems)
+
+		for _, name := range []string{"fresh", "stuck", "prod"} {
+			_, err := dynamicClient.Resource(cnpgClusterGVR).Namespace("restore-drills").Get(context.Background(), name, metav1.GetOptions{})
+			assert.NoError(t, err, name)
+		}
+		_, err = dynamicClient.Resource(cnpgClusterGVR).Namespace("restore-drills").Get(context.Background(), "done", metav1.GetOptions{})
+		assert.True(t, apierrors.IsNotFound(err))
+		_, err = dynamicClient.Resource(cnpgPoolerGVR).Namespace("restore-drills").Get(context.Background(), "done-rw", metav1.GetOptions{})
+		assert.True(t, apierrors.IsNotFound(err))
+		pvcs, err := client.CoreV1().PersistentVolumeClaims("restore-drills").List(context.Background(), metav1.ListOptions{})
+		require.NoError(t, err)
+		require.Len(t, pvcs.Items, 1)
+		assert.Equal(t, "fresh-1", pvcs.Items[0].Name)
+		cm, err := client.CoreV1().ConfigMaps("restore-drills").Get(context.Background(), OverrideConfigMapName, metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"write_to_server_name": "fresh-a1b2", "fresh.write_to_server_name": "fresh-a1b2"}, cm.Data)
+
+		// The verification is recorded, so the TTL of the drill holds on the next pass
+		fresh, err := dynamicClient.Resource(cnpgClusterGVR).Namespace("restore-drills").Get(context.Background(), "fresh", metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, now.Format(time.RFC3339), fresh.GetAnnotations()[AnnotationRehearsalVerified])
+
+		results, err = CleanupRehearsals(context.Background(), client, dynamicClient, instanceStatus, "restore-drills", options, now.Add(time.Hour))
+		require.NoError(t, err)
+		require.Len(t, results, 2)
+		assert.Equal(t, RehearsalDeleted, results[0].Outcome)
+		assert.Equal(t, []string{"configmaps/" + OverrideConfigMapName, "persistentvolumeclaims/fresh-1", "clusters/fresh"}, results[0].Deleted)
+		_, err = client.CoreV1().ConfigMaps("restore-drills").Get(context.Background(), OverrideConfigMapName, metav1.GetOptions{})
+		assert.True(t, apierrors.IsNotFound(err))
+	})
+
+	t.Run("max age", func(t *testing.T) {
+		client, objects := newClients()
+		dynamicClient := newFakeDynamicClient(objects...)
+
+		results, err := CleanupRehearsals(context.Background(), client, dynamicClient, instanceStatus, "restore-drills", RehearsalCleanupOptions{TTL: time.Hour, MaxAge: 24 * time.Hour}, now)
+		require.NoError(t, err)
+		require.Len(t, results, 3)
+		assert.Equal(t, RehearsalExpired, results[2].Outcome)
+		assert.Equal(t, []string{"clusters/stuck"}, results[2].Deleted)
+		_, err = dynamicClient.Resource(cnpgClusterGVR).Namespace("restore-drills").Get(context.Background(), "stuck", metav1.GetOptions{})
+		assert.True(t, apierrors.IsNotFound(err))
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		client, objects := newClients()
+		dynamicClient := newFakeDynamicClient(objects...)
+
+		results, err := CleanupRehearsals(context.Background(), client, dynamicClient, instanceStatus, "restore-drills", RehearsalCleanupOptions{TTL: 0, DryRun: true}, now)
+		require.NoError(t, err)
+		require.Len(t, results, 3)
+		assert.Equal(t, RehearsalDeleted, results[0].Outcome)
+		assert.Equal(t, RehearsalDeleted, results[1].Outcome)
+		assert.Equal(t, []string{"configmaps/" + OverrideConfigMapName, "persistentvolumeclaims/fresh-1", "clusters/fresh"}, results[1].Deleted)
+
+		clusters, err := dynamicClient.Resource(cnpgClusterGVR).Namespace("restore-drills").List(context.Background(), metav1.ListOptions{})
+		require.NoError(t, err)
+		assert.Len(t, clusters.Items, 4)
+		fresh, err := dynamicClient.Resource(cnpgClusterGVR).Namespace("restore-drills").Get(context.Background(), "fresh", metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.NotContains(t, fresh.GetAnnotations(), AnnotationRehearsalVerified)
+		cm, err := client.CoreV1().ConfigMaps("restore-drills").Get(context.Background(), OverrideConfigMapName, metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Len(t, cm.Data, 4)
+	})
+}
+
+func TestCleanupRehearsalOverride(t *testing.T) {
+	// ConfigMaps of regular restores are left alone
+	client := fake.NewClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: OverrideConfigMapName, Namespace: "prod"},
+		Data:       map[string]string{"pg.write_to_server_name": "pg-a1b2"},
+	})
+	cleaned, err := cleanupRehearsalOverride(context.Background(), client, "prod", "pg", false)
+	require.NoError(t, err)
+	assert.False(t, cleaned)
+	_, err = client.CoreV1().ConfigMaps("prod").Get(context.Background(), OverrideConfigMapName, metav1.GetOptions{})
+	assert.NoError(t, err)
+
+	cleaned, err = cleanupRehearsalOverride(context.Background(), fake.NewClientset(), "restore-drills", "pg", false)
+	require.NoError(t, err)
+	assert.False(t, cleaned)
+}
@@ -0,0 +1,91 @@
+package plugin
+
+import (
+	"github.com/pkg/errors"
+)
+
+// configureReplica turns the restored cluster into a replica cluster replaying WAL from
+// the recovery source, or streaming from the backed-up externalClusters entry named by
+// replica.source, unless it is to be promoted immediately. Replica clusters with
+// promotion after are promoted by whoever acts on the override ConfigMap's instructions.
+func (p *RestorePluginV2) configureReplica(itemContent map[string]interface{}, replica *ReplicaConfig) error {
+	if replica.Promotion == PromotionImmediate {
+		p.log.Info("Replica cluster is promoted immediately, restoring without replica mode")
+		return nil
+	}
+
+	specMap, err := getSpecMap(itemContent)
+	if err != nil {
+		return err
+	}
+
+	source := recoverySourceName
+	if replica.Source != "" {
+		source = replica.Source
+	}
+	var sourceEntry map[string]interface{}
+	for _, externalCluster := range sliceOfMaps(specMap["externalClusters"]) {
+		if externalCluster["name"] == source {
+			sourceEntry = externalCluster
+			break
+		}
+	}
+	if replica.Source != "" {
+		// Streaming replicas need a reachable primary rather than a WAL archive
+		if _, streaming := sourceEntry["connectionParameters"]; !streaming {
+			return errors.Errorf("replica.source %s is not an externalClusters entry with connectionParameters", replica.Source)
+		}
+	} else if sourceEntry == nil {
+		// Replica clusters need a WAL archive to keep replaying
+		return errors.New("replica mode requires a backup with a WAL archive in an object store")
+	}
+
+	specMap["replica"] = map[string]interface{}{
+		"enabled": true,
+		"source":  source,
+	}
+	p.log.Infof("Configured spec.replica to follow %s", source)
+
+	return nil
+}
+
+// streamingSources returns the externalClusters entries of the backed-up cluster that
+// connect to a running cluster with connectionParameters, such as the primary a replica
+// cluster streams from. Entries named like the generated ones are left out.
+func streamingSources(specMap map[string]interface{}) []interface{} {
+	var sources []interface{}
+	for _, externalCluster := range sliceOfMaps(specMap["externalClusters"]) {
+		if name := externalCluster["name"]; name == recoverySourceName || name == cloneSourceName {
+			continue
+		}
+		if _, streaming := externalCluster["connectionParameters"]; !streaming {
+			continue
+		}
+		if _, archive := externalCluster["barmanObjectStore"]; archive {
+			continue
+		}
+		if _, archive := externalCluster["plugin"]; archive {
+			continue
+		}
+		sources = append(sources, externalCluster)
+	}
+	return sources
+}
+
+// configureStandby turns the restored cluster into a replica cluster streaming from the
+// running source cluster it was cloned from, so a DR site is resynced from the live
+// primary. It stays a standby until it is promoted by hand.
+func (p *RestorePluginV2) configureStandby(itemContent map[string]interface{}) error {
+	specMap, err := getSpecMap(itemContent)
+	if err != nil {
+		return err
+	}
+
+	specMap["replica"] = map[string]interface{}{
+		"enabled": true,
+		"source":  cloneSourceName,
+	}
+	p.log.Infof("Configured spec.replica to stream from %s", cloneSourceName)
+
+	return nil
+}
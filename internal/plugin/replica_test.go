@@ -0,0 +1,230 @@
+package plugin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestConfigureReplica(t *testing.T) {
+	withSource := func() map[string]interface{} {
+		return map[string]interface{}{
+			"spec": map[string]interface{}{
+				"externalClusters": []interface{}{
+					map[string]interface{}{"name": recoverySourceName},
+				},
+			},
+		}
+	}
+	withStreamingSource := func() map[string]interface{} {
+		return map[string]interface{}{
+			"spec": map[string]interface{}{
+				"externalClusters": []interface{}{
+					map[string]interface{}{"name": recoverySourceName},
+					map[string]interface{}{
+						"name":                 "prod-db",
+						"connectionParameters": map[string]interface{}{"host": "prod-db-rw.example.com"},
+					},
+				},
+			},
+		}
+	}
+
+	tests := []struct {
+		name           string
+		itemContent    map[string]interface{}
+		replica        *ReplicaConfig
+		expectReplica  bool
+		expectedSource string
+		expectedError  bool
+	}{
+		{
+			name:          "never promoted",
+			itemContent:   withSource(),
+			replica:       &ReplicaConfig{Enabled: true},
+			expectReplica: true,
+		},
+		{
+			name:          "promoted after a delay",
+			itemContent:   withSource(),
+			replica:       &ReplicaConfig{Enabled: true, Promotion: PromotionAfter, PromoteAfter: "30m"},
+			expectReplica: true,
+		},
+		{
+			name:        "promoted immediately",
+			itemContent: withSource(),
+			replica:     &ReplicaConfig{Enabled: true, Promotion: PromotionImmediate},
+		},
+		{
+			name:          "no WAL archive",
+			itemContent:   map[string]interface{}{"spec": map[string]interface{}{}},
+			replica:       &ReplicaConfig{Enabled: true},
+			expectedError: true,
+		},
+		{
+			name:           "streaming from a surviving primary",
+			itemContent:    withStreamingSource(),
+			replica:        &ReplicaConfig{Enabled: true, Source: "prod-db"},
+			expectReplica:  true,
+			expectedSource: "prod-db",
+		},
+		{
+			name:          "streaming source missing",
+			itemContent:   withSource(),
+			replica:       &ReplicaConfig{Enabled: true, Source: "prod-db"},
+			expectedError: true,
+		},
+		{
+			name: "streaming source without connectionParameters",
+			itemContent: map[string]interface{}{
+				"spec": map[string]interface{}{
+					"externalClusters": []interface{}{
+						map[string]interface{}{"name": "prod-db", "barmanObjectStore": map[string]interface{}{}},
+					},
+				},
+			},
+			replica:       &ReplicaConfig{Enabled: true, Source: "prod-db"},
+			expectedError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plugin := &RestorePluginV2{log: logrus.New()}
+
+			err := plugin.configureReplica(tt.itemContent, tt.replica)
+			if tt.expectedError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			replica, found, _ := unstructured.NestedMap(tt.itemContent, "spec", "replica")
+			assert.Equal(t, tt.expectReplica, found)
+			if tt.expectReplica {
+				source := recoverySourceName
+				if tt.expectedSource != "" {
+					source = tt.expectedSource
+				}
+				assert.Equal(t, map[string]interface{}{"enabled": true, "source": source}, replica)
+			}
+		})
+	}
+}
+
+func TestReplicaConfigValidate(t *testing.T) {
+	tests := []struct {
+		name          string
+		replica       ReplicaConfig
+		expectedAfter time.Duration
+		expectedError bool
+	}{
+		{name: "default", replica: ReplicaConfig{Enabled: true}},
+		{name: "immediate", replica: ReplicaConfig{Enabled: true, Promotion: PromotionImmediate}},
+		{name: "after", replica: ReplicaConfig{Enabled: true, Promotion: PromotionAfter, PromoteAfter: "1h30m"}, expectedAfter: 90 * time.Minute},
+		{name: "after without duration", replica: ReplicaConfig{Enabled: true, Promotion: PromotionAfter}, expectedError: true},
+		{name: "after with invalid duration", replica: ReplicaConfig{Enabled: true, Promotion: PromotionAfter, PromoteAfter: "later"}, expectedError: true},
+		{name: "duration without after", replica: ReplicaConfig{Enabled: true, PromoteAfter: "1h"}, expectedError: true},
+		{name: "unknown promotion", replica: ReplicaConfig{Enabled: true, Promotion: "sometimes"}, expectedError: true},
+		{name: "streaming source", replica: ReplicaConfig{Enabled: true, Source: "prod-db"}},
+		{name: "streaming source promoted immediately", replica: ReplicaConfig{Enabled: true, Promotion: PromotionImmediate, Source: "prod-db"}, expectedError: true},
+		{name: "generated source", replica: ReplicaConfig{Enabled: true, Source: recoverySourceName}, expectedError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.replica.Validate()
+			if tt.expectedError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedAfter, tt.replica.promoteAfter())
+		})
+	}
+
+	var none *ReplicaConfig
+	assert.Zero(t, none.promoteAfter())
+}
+
+func TestStreamingSources(t *testing.T) {
+	primary := map[string]interface{}{
+		"name":                 "prod-db",
+		"connectionParameters": map[string]interface{}{"host": "prod-db-rw.example.com", "user": "streaming_replica"},
+		"password":             map[string]interface{}{"name": "prod-db-replication", "key": "password"},
+	}
+	itemContent := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"externalClusters": []interface{}{
+				primary,
+				map[string]interface{}{"name": recoverySourceName, "connectionParameters": map[string]interface{}{}},
+				map[string]interface{}{"name": "archive", "barmanObjectStore": map[string]interface{}{}},
+				map[string]interface{}{
+					"name":                 "both",
+					"connectionParameters": map[string]interface{}{},
+					"plugin":               map[string]interface{}{"name": "barman-cloud.cloudnative-pg.io"},
+				},
+			},
+		},
+	}
+
+	assert.Equal(t, []interface{}{primary}, streamingSources(itemContent["spec"].(map[string]interface{})))
+
+	// The generated recovery source replaces the backed-up entries, except the streaming ones
+	plugin := &RestorePluginV2{log: logrus.New()}
+	require.NoError(t, plugin.configureExternalCluster(itemContent, "server", "store"))
+	externalClusters, _, _ := unstructured.NestedSlice(itemContent, "spec", "externalClusters")
+	require.Len(t, externalClusters, 2)
+	assert.Equal(t, recoverySourceName, externalClusters[0].(map[string]interface{})["name"])
+	assert.Equal(t, primary, externalClusters[1])
+}
+
+func TestRestoreExecuteReplica(t *testing.T) {
+	plugin := &RestorePluginV2{
+		log: logrus.New(),
+		config: &PluginConfig{
+			RestoreMode: RestoreModeRecovery,
+			Replica:     &ReplicaConfig{Enabled: true},
+		},
+		dynamicClient: newFakeDynamicClient(),
+	}
+
+	item := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "postgresql.cnpg.io/v1",
+		"kind":       "Cluster",
+		"metadata": map[string]interface{}{
+			"name":        "pg",
+			"namespace":   "default",
+			"annotations": map[string]interface{}{AnnotationBackupMethod: BackupMethodBarmanObjectStore},
+		},
+		"spec": map[string]interface{}{
+			"backup": map[string]interface{}{
+				"barmanObjectStore": map[string]interface{}{"destinationPath": "s3://bucket"},
+			},
+		},
+	}}
+
+	output, err := plugin.Execute(&velero.RestoreItemActionExecuteInput{Item: item})
+	require.NoError(t, err)
+
+	content := output.UpdatedItem.UnstructuredContent()
+	enabled, _, _ := unstructured.NestedBool(content, "spec", "replica", "enabled")
+	assert.True(t, enabled)
+	source, _, _ := unstructured.NestedString(content, "spec", "bootstrap", "recovery", "source")
+	assert.Equal(t, recoverySourceName, source)
+}
+
+func TestConfigureStandby(t *testing.T) {
+	plugin := &RestorePluginV2{log: logrus.New()}
+
+	itemContent := map[string]interface{}{"spec": map[string]interface{}{}}
+	require.NoError(t, plugin.configureStandby(itemContent))
+	assert.Equal(t, map[string]interface{}{"enabled": true, "source": cloneSourceName}, itemContent["spec"].(map[string]interface{})["replica"])
+
+	assert.Error(t, plugin.configureStandby(map[string]interface{}{}))
+}
@@ -0,0 +1,293 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"github.com/pkg/errors"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+)
+
+// resourceModifiers is the part of a Velero resource modifier ConfigMap the restore action
+// reads. Velero applies the rules after the restore item actions, so they win over the
+// changes the plugin makes.
+type resourceModifiers struct {
+	Version string                 `json:"version"`
+	Rules   []resourceModifierRule `json:"resourceModifierRules"`
+}
+
+// resourceModifierRule is a rule of a Velero resource modifier ConfigMap
+type resourceModifierRule struct {
+	Conditions struct {
+		Namespaces        []string              `json:"namespaces,omitempty"`
+		GroupResource     string                `json:"groupResource"`
+		ResourceNameRegex string                `json:"resourceNameRegex,omitempty"`
+		LabelSelector     *metav1.LabelSelector `json:"labelSelector,omitempty"`
+		Matches           []struct {
+			Path  string `json:"path"`
+			Value string `json:"value,omitempty"`
+		} `json:"matches,omitempty"`
+	} `json:"conditions"`
+	Patches []struct {
+		Path string `json:"path"`
+		From string `json:"from,omitempty"`
+	} `json:"patches,omitempty"`
+	MergePatches []struct {
+		PatchData string `json:"patchData"`
+	} `json:"mergePatches,omitempty"`
+	StrategicPatches []struct {
+		PatchData string `json:"patchData"`
+	} `json:"strategicPatches,omitempty"`
+}
+
+// readResourceModifiers returns the resource modifier rules of a restore, or nil when it
+// has none. Like Velero, it reads the only key of the ConfigMap in the Velero namespace.
+func (p *RestorePluginV2) readResourceModifiers(restore *v1.Restore) (*resourceModifiers, string, error) {
+	if restore == nil || restore.Spec.ResourceModifier == nil {
+		return nil, "", nil
+	}
+	ref := restore.Spec.ResourceModifier
+	name := restore.Namespace + "/" + ref.Name
+	if !strings.EqualFold(ref.Kind, "ConfigMap") {
+		return nil, name, errors.Errorf("unsupported resource modifier kind %q", ref.Kind)
+	}
+
+	client, err := p.getKubeClient()
+	if err != nil {
+		return nil, name, errors.Wrap(err, "failed to get Kubernetes client")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	configMap, err := client.CoreV1().ConfigMaps(restore.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, name, errors.Wrapf(classifyAPIError(err), "failed to get resource modifier ConfigMap %s", name)
+	}
+	if len(configMap.Data) != 1 {
+		return nil, name, errors.Errorf("resource modifier ConfigMap %s must have exactly one key", name)
+	}
+
+	modifiers := &resourceModifiers{}
+	for _, data := range configMap.Data {
+		if err := yaml.Unmarshal([]byte(data), modifiers); err != nil {
+			return nil, name, errors.Wrapf(err, "failed to parse resource modifier ConfigMap %s", name)
+		}
+	}
+	return modifiers, name, nil
+}
+
+// selects reports whether Velero applies the rule to a CNPG cluster, matching its
+// conditions the way Velero does
+func (r *resourceModifierRule) selects(cluster *unstructured.Unstructured) (bool, error) {
+	conditions := r.Conditions
+
+	if len(conditions.Namespaces) > 0 {
+		included := false
+		for _, namespace := range conditions.Namespaces {
+			if matched, _ := path.Match(namespace, cluster.GetNamespace()); matched {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false, nil
+		}
+	}
+
+	// Velero globs the group resource with '.' as separator, which path.Match does with '/'
+	matched, err := path.Match(strings.ReplaceAll(conditions.GroupResource, ".", "/"), strings.ReplaceAll(clusterCRDName, ".", "/"))
+	if err != nil {
+		return false, errors.Wrapf(err, "invalid groupResource %q", conditions.GroupResource)
+	}
+	if !matched {
+		return false, nil
+	}
+
+	if conditions.ResourceNameRegex != "" {
+		matched, err := regexp.MatchString(conditions.ResourceNameRegex, cluster.GetName())
+		if err != nil {
+			return false, errors.Wrapf(err, "invalid resourceNameRegex %q", conditions.ResourceNameRegex)
+		}
+		if !matched {
+			return false, nil
+		}
+	}
+
+	if conditions.LabelSelector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(conditions.LabelSelector)
+		if err != nil {
+			return false, errors.Wrap(err, "invalid labelSelector")
+		}
+		if !selector.Matches(labels.Set(cluster.GetLabels())) {
+			return false, nil
+		}
+	}
+
+	if len(conditions.Matches) > 0 {
+		var tests []map[string]string
+		for _, match := range conditions.Matches {
+			tests = append(tests, map[string]string{"op": "test", "path": match.Path, "value": match.Value})
+		}
+		raw, err := json.Marshal(tests)
+		if err != nil {
+			return false, err
+		}
+		patch, err := jsonpatch.DecodePatch(raw)
+		if err != nil {
+			return false, errors.Wrap(err, "invalid matches")
+		}
+		doc, err := cluster.MarshalJSON()
+		if err != nil {
+			return false, err
+		}
+		if _, err := patch.Apply(doc); err != nil {
+			if errors.Is(err, jsonpatch.ErrTestFailed) || errors.Is(err, jsonpatch.ErrMissing) {
+				return false, nil
+			}
+			return false, errors.Wrap(err, "failed to evaluate matches")
+		}
+	}
+
+	return true, nil
+}
+
+// patchedPaths returns the paths the rule's patches change: the path and source of its
+// JSON patches, and the spec fields its merge and strategic merge patches set
+func (r *resourceModifierRule) patchedPaths() []string {
+	var paths []string
+	for _, patch := range r.Patches {
+		paths = append(paths, patch.Path)
+		if patch.From != "" {
+			paths = append(paths, patch.From)
+		}
+	}
+
+	var patchData []string
+	for _, patch := range r.MergePatches {
+		patchData = append(patchData, patch.PatchData)
+	}
+	for _, patch := range r.StrategicPatches {
+		patchData = append(patchData, patch.PatchData)
+	}
+	for _, data := range patchData {
+		var doc map[string]interface{}
+		if err := yaml.Unmarshal([]byte(data), &doc); err != nil {
+			continue
+		}
+		value, found := doc["spec"]
+		if !found {
+			continue
+		}
+		spec, ok := value.(map[string]interface{})
+		if !ok {
+			paths = append(paths, "/spec")
+			continue
+		}
+		fields := make([]string, 0, len(spec))
+		for field := range spec {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			paths = append(paths, "/spec/"+field)
+		}
+	}
+	return paths
+}
+
+// pathsOverlap reports whether two JSON pointers address the same field or one contains
+// the other
+func pathsOverlap(a, b string) bool {
+	return a == b || strings.HasPrefix(a, b+"/") || strings.HasPrefix(b, a+"/")
+}
+
+// snapshotManagedPaths copies the ManagedPaths of a cluster as backed up, before the
+// restore action changes them
+func snapshotManagedPaths(itemContent map[string]interface{}) map[string]interface{} {
+	snapshot := map[string]interface{}{}
+	for _, managed := range ManagedPaths {
+		field := strings.TrimPrefix(managed, "/spec/")
+		if value, found, _ := unstructured.NestedFieldCopy(itemContent, "spec", field); found {
+			snapshot[managed] = value
+		}
+	}
+	return snapshot
+}
+
+// checkResourceModifiers warns about the resource modifier rules of the restore that patch
+// the fields the restore action set on the cluster, since Velero applies them afterwards
+// and they silently replace or break the recovery configuration. Fields listed in yield are
+// put back as backed up instead, leaving them to the rule. Rules that cannot be read are
+// logged rather than failing the restore.
+func (p *RestorePluginV2) checkResourceModifiers(restore *v1.Restore, itemContent, backedUp map[string]interface{}, yield []string, warnings *restoreWarnings) {
+	modifiers, name, err := p.readResourceModifiers(restore)
+	if err != nil {
+		p.log.Warnf("Not checking the resource modifiers of the restore: %v", err)
+		return
+	}
+	if modifiers == nil {
+		return
+	}
+
+	cluster := &unstructured.Unstructured{Object: itemContent}
+	yielding := map[string]bool{}
+	for _, managed := range yield {
+		yielding[managed] = true
+	}
+	yielded := map[string]bool{}
+	for i, rule := range modifiers.Rules {
+		selected, err := rule.selects(cluster)
+		if err != nil {
+			p.log.Warnf("Not checking resource modifier rule %d of ConfigMap %s: %v", i, name, err)
+			continue
+		}
+		if !selected {
+			continue
+		}
+
+		patchedPaths := rule.patchedPaths()
+		for _, managed := range ManagedPaths {
+			var overlapping []string
+			for _, patched := range patchedPaths {
+				if pathsOverlap(patched, managed) {
+					overlapping = append(overlapping, patched)
+				}
+			}
+			if len(overlapping) == 0 {
+				continue
+			}
+
+			if yielding[managed] {
+				yielded[managed] = true
+				p.log.Infof("Resource modifier rule %d of ConfigMap %s patches %s, leaving %s as backed up", i, name, strings.Join(overlapping, ", "), managed)
+				continue
+			}
+			warnings.Warnf("Resource modifier rule %d of ConfigMap %s patches %s after the restore action set %s for recovery; list %s in yieldToResourceModifiers to patch the backed-up spec instead",
+				i, name, strings.Join(overlapping, ", "), managed, managed)
+		}
+	}
+
+	for _, managed := range ManagedPaths {
+		if !yielded[managed] {
+			continue
+		}
+		field := strings.TrimPrefix(managed, "/spec/")
+		if value, found := backedUp[managed]; found {
+			_ = unstructured.SetNestedField(itemContent, runtime.DeepCopyJSONValue(value), "spec", field)
+		} else {
+			unstructured.RemoveNestedField(itemContent, "spec", field)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+)
+
+func TestResourceModifierRuleSelects(t *testing.T) {
+	cluster := createMockPluginCluster("pg-main", "app")
+	cluster.SetLabels(map[string]string{"tier": "gold"})
+
+	tests := []struct {
+		name     string
+		rule     string
+		expected bool
+	}{
+		{name: "cluster resource", rule: "conditions:\n  groupResource: clusters.postgresql.cnpg.io\n", expected: true},
+		{name: "wildcard group", rule: "conditions:\n  groupResource: clusters.*.*.*\n", expected: true},
+		{name: "wildcard not spanning dots", rule: "conditions:\n  groupResource: '*'\n"},
+		{name: "other resource", rule: "conditions:\n  groupResource: persistentvolumeclaims\n"},
+		{name: "other namespace", rule: "conditions:\n  groupResource: '*.postgresql.cnpg.io'\n  namespaces: [db]\n"},
+		{name: "name regex", rule: "conditions:\n  groupResource: '*.postgresql.cnpg.io'\n  resourceNameRegex: ^pg-\n", expected: true},
+		{name: "label selector", rule: "conditions:\n  groupResource: '*.postgresql.cnpg.io'\n  labelSelector:\n    matchLabels:\n      tier: silver\n"},
+		{name: "matching value", rule: "conditions:\n  groupResource: '*.postgresql.cnpg.io'\n  matches:\n  - path: /metadata/name\n    value: pg-main\n", expected: true},
+		{name: "missing field", rule: "conditions:\n  groupResource: '*.postgresql.cnpg.io'\n  matches:\n  - path: /spec/replica/enabled\n    value: \"true\"\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rule resourceModifierRule
+			require.NoError(t, yaml.Unmarshal([]byte(tt.rule), &rule))
+			selected, err := rule.selects(cluster)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, selected)
+		})
+	}
+}
+
+func TestResourceModifierRulePatchedPaths(t *testing.T) {
+	var rule resourceModifierRule
+	require.NoError(t, yaml.Unmarshal([]byte(`
+patches:
+- operation: replace
+  path: /spec/bootstrap/recovery/source
+  value: origin
+- operation: copy
+  from: /spec/externalClusters/0
+  path: /metadata/annotations/source
+mergePatches:
+- patchData: |
+    {"spec": {"plugins": null, "instances": 1}}
+strategicPatches:
+- patchData: |
+    metadata:
+      labels:
+        tier: gold
+`), &rule))
+
+	assert.Equal(t, []string{"/spec/bootstrap/recovery/source", "/metadata/annotations/source", "/spec/externalClusters/0", "/spec/instances", "/spec/plugins"}, rule.patchedPaths())
+}
+
+func TestCheckResourceModifiers(t *testing.T) {
+	modifiers := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "cnpg-modifiers", Namespace: "velero"},
+		Data: map[string]string{"modifiers.yaml": `
+version: v1
+resourceModifierRules:
+- conditions:
+    groupResource: clusters.postgresql.cnpg.io
+  patches:
+  - operation: replace
+    path: /spec/bootstrap/recovery/source
+    value: origin
+- conditions:
+    groupResource: clusters.postgresql.cnpg.io
+    namespaces: [other]
+  patches:
+  - operation: remove
+    path: /spec/plugins
+`},
+	}
+	restore := &v1.Restore{
+		ObjectMeta: metav1.ObjectMeta{Name: "restore", Namespace: "velero"},
+		Spec:       v1.RestoreSpec{ResourceModifier: &corev1.TypedLocalObjectReference{Kind: "configmap", Name: "cnpg-modifiers"}},
+	}
+
+	restored := func() (*unstructured.Unstructured, map[string]interface{}) {
+		cluster := createMockPluginCluster("pg", "app")
+		backedUp := snapshotManagedPaths(cluster.Object)
+		require.NoError(t, unstructured.SetNestedField(cluster.Object, map[string]interface{}{"source": "clusterBackup"}, "spec", "bootstrap", "recovery"))
+		return cluster, backedUp
+	}
+
+	t.Run("overlap", func(t *testing.T) {
+		plugin := &RestorePluginV2{log: logrus.New(), kubeClient: newFakeKubeClient(modifiers)}
+		warnings := &restoreWarnings{log: logrus.New()}
+		cluster, backedUp := restored()
+
+		plugin.checkResourceModifiers(restore, cluster.Object, backedUp, nil, warnings)
+		require.Len(t, warnings.messages, 1)
+		assert.Contains(t, warnings.messages[0], "Resource modifier rule 0 of ConfigMap velero/cnpg-modifiers patches /spec/bootstrap/recovery/source after the restore action set /spec/bootstrap")
+		source, _, _ := unstructured.NestedString(cluster.Object, "spec", "bootstrap", "recovery", "source")
+		assert.Equal(t, "clusterBackup", source)
+	})
+
+	t.Run("yield", func(t *testing.T) {
+		plugin := &RestorePluginV2{log: logrus.New(), kubeClient: newFakeKubeClient(modifiers)}
+		warnings := &restoreWarnings{log: logrus.New()}
+		cluster, backedUp := restored()
+
+		plugin.checkResourceModifiers(restore, cluster.Object, backedUp, []string{ManagedPathBootstrap}, warnings)
+		assert.Empty(t, warnings.messages)
+		// The backed-up cluster had no bootstrap section
+		assert.NotContains(t, cluster.Object["spec"], "bootstrap")
+	})
+
+	t.Run("no resource modifiers", func(t *testing.T) {
+		plugin := &RestorePluginV2{log: logrus.New(), kubeClient: newFakeKubeClient()}
+		warnings := &restoreWarnings{log: logrus.New()}
+		cluster, backedUp := restored()
+
+		plugin.checkResourceModifiers(&v1.Restore{}, cluster.Object, backedUp, nil, warnings)
+		assert.Empty(t, warnings.messages)
+	})
+}
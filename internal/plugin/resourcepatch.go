@@ -0,0 +1,186 @@
+package plugin
+
+import (
+	"sort"
+	"strings"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework/common"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+// ResourcePatchRestorePlugin is a restore item action plugin for Velero that applies the
+// patches configured in resourcePatches to the restored resources they select, so
+// CNPG-adjacent resources can be adjusted on restore without changing the plugin
+type ResourcePatchRestorePlugin struct {
+	log logrus.FieldLogger
+
+	// config overrides the plugin ConfigMap lookup when set
+	config *PluginConfig
+}
+
+// NewResourcePatchRestorePlugin instantiates a new ResourcePatchRestorePlugin.
+func NewResourcePatchRestorePlugin(log logrus.FieldLogger) *ResourcePatchRestorePlugin {
+	return &ResourcePatchRestorePlugin{log: log}
+}
+
+// getConfig returns the plugin configuration, see loadActionConfig
+func (p *ResourcePatchRestorePlugin) getConfig() (*PluginConfig, error) {
+	return loadActionConfig(p.config, common.PluginKindRestoreItemAction, ResourcePatchRestorePluginName)
+}
+
+// Name is required to implement the interface, but the Velero pod does not delegate this
+// method -- it's used to tell velero what name it was registered under. The plugin implementation
+// must define it, but it will never actually be called.
+func (p *ResourcePatchRestorePlugin) Name() string {
+	return "resourcePatchRestorePlugin"
+}
+
+// AppliesTo returns information about which resources this action should be invoked for.
+// Velero resolves the lowercase kind of each patch as a singular resource name.
+func (p *ResourcePatchRestorePlugin) AppliesTo() (velero.ResourceSelector, error) {
+	config, err := p.getConfig()
+	if err != nil {
+		return noNamespaces(), err
+	}
+	seen := map[string]bool{}
+	var resources []string
+	for _, patch := range config.ResourcePatches {
+		resource := strings.ToLower(patch.Kind)
+		if patch.Group != "" {
+			resource += "." + patch.Group
+		}
+		if !seen[resource] {
+			seen[resource] = true
+			resources = append(resources, resource)
+		}
+	}
+	sort.Strings(resources)
+
+	// A zero-valued ResourceSelector matches all resources, so without patches the
+	// action only sees CNPG clusters and passes them through
+	if len(resources) == 0 {
+		resources = []string{"clusters.postgresql.cnpg.io"}
+	}
+
+	return config.scopeNamespaces(velero.ResourceSelector{
+		IncludedResources: resources,
+	}), nil
+}
+
+// Execute applies the configured patches selecting the item, in order
+func (p *ResourcePatchRestorePlugin) Execute(input *velero.RestoreItemActionExecuteInput) (_ *velero.RestoreItemActionExecuteOutput, err error) {
+	defer reportError(p.log, "resource patch plugin", input.Item, &err)
+	defer recoverPanic(p.log, "resource patch plugin", input.Item, &err)
+
+	if restoreDisabled(input.Restore) {
+		p.log.Infof("Restore has %s set, passing item through unmodified", AnnotationDisable)
+		return velero.NewRestoreItemActionExecuteOutput(input.Item), nil
+	}
+
+	item := &unstructured.Unstructured{Object: input.Item.UnstructuredContent()}
+	gvk := item.GroupVersionKind()
+
+	var doc []byte
+	config, err := p.getConfig()
+	if err != nil {
+		return nil, err
+	}
+	for i, patch := range config.ResourcePatches {
+		if !patch.selects(item) {
+			continue
+		}
+
+		if doc == nil {
+			if doc, err = item.MarshalJSON(); err != nil {
+				return nil, errors.Wrap(err, "failed to encode item")
+			}
+		}
+		if doc, err = patch.apply(doc, gvk); err != nil {
+			return nil, errors.Wrapf(err, "failed to apply resource patch %d", i)
+		}
+		p.log.Infof("Applied resource patch %d to %s %s/%s", i, gvk.Kind, item.GetNamespace(), item.GetName())
+	}
+
+	if doc == nil {
+		return velero.NewRestoreItemActionExecuteOutput(input.Item), nil
+	}
+
+	patched := &unstructured.Unstructured{}
+	if err := patched.UnmarshalJSON(doc); err != nil {
+		return nil, errors.Wrap(err, "failed to decode patched item")
+	}
+	return velero.NewRestoreItemActionExecuteOutput(patched), nil
+}
+
+// selects reports whether the patch applies to the item
+func (r *ResourcePatch) selects(item *unstructured.Unstructured) bool {
+	gvk := item.GroupVersionKind()
+	if gvk.Group != r.Group || gvk.Kind != r.Kind || (r.Version != "" && gvk.Version != r.Version) {
+		return false
+	}
+	if r.Name != "" && item.GetName() != r.Name {
+		return false
+	}
+	if len(r.Namespaces) > 0 {
+		for _, namespace := range r.Namespaces {
+			if item.GetNamespace() == namespace {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// apply applies the patch to the JSON document of an item of the given kind
+func (r *ResourcePatch) apply(doc []byte, gvk schema.GroupVersionKind) ([]byte, error) {
+	switch {
+	case len(r.JSONPatch) > 0:
+		patch, err := jsonpatch.DecodePatch(r.JSONPatch)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid jsonPatch")
+		}
+		return patch.Apply(doc)
+	case len(r.MergePatch) > 0:
+		return jsonpatch.MergePatch(doc, r.MergePatch)
+	case len(r.StrategicMergePatch) > 0:
+		dataStruct, err := scheme.Scheme.New(gvk)
+		if err != nil {
+			return nil, errors.Wrapf(err, "strategicMergePatch requires a built-in kind")
+		}
+		return strategicpatch.StrategicMergePatch(doc, r.StrategicMergePatch, dataStruct)
+	}
+	return doc, nil
+}
+
+// builtInKind reports whether the kind is served by Kubernetes itself, so that strategic
+// merge patches know its patch strategies
+func builtInKind(group, kind string) bool {
+	for gvk := range scheme.Scheme.AllKnownTypes() {
+		if gvk.Group == group && gvk.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *ResourcePatchRestorePlugin) Progress(operationID string, restore *v1.Restore) (velero.OperationProgress, error) {
+	progress := velero.OperationProgress{}
+	return progress, nil
+}
+
+func (p *ResourcePatchRestorePlugin) Cancel(operationID string, restore *v1.Restore) error {
+	return nil
+}
+
+func (p *ResourcePatchRestorePlugin) AreAdditionalItemsReady(additionalItems []velero.ResourceIdentifier, restore *v1.Restore) (bool, error) {
+	return true, nil
+}
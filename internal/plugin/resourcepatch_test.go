@@ -0,0 +1,144 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestResourcePatchAppliesTo(t *testing.T) {
+	plugin := &ResourcePatchRestorePlugin{log: logrus.New(), config: &PluginConfig{ResourcePatches: []ResourcePatch{
+		{Group: "postgresql.cnpg.io", Kind: "Pooler"},
+		{Kind: "Secret"},
+		{Group: "postgresql.cnpg.io", Version: "v1", Kind: "Pooler"},
+	}}}
+
+	selector, err := plugin.AppliesTo()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"pooler.postgresql.cnpg.io", "secret"}, selector.IncludedResources)
+
+	// Without patches the action must not select every resource
+	selector, err = (&ResourcePatchRestorePlugin{log: logrus.New(), config: DefaultPluginConfig()}).AppliesTo()
+	require.NoError(t, err)
+	assert.NotEmpty(t, selector.IncludedResources)
+}
+
+func TestResourcePatchExecute(t *testing.T) {
+	pooler := func(namespace string) *unstructured.Unstructured {
+		return &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "postgresql.cnpg.io/v1",
+			"kind":       "Pooler",
+			"metadata": map[string]interface{}{
+				"name":        "pg-rw",
+				"namespace":   namespace,
+				"annotations": map[string]interface{}{"team": "a", "argocd.argoproj.io/tracking-id": "app"},
+			},
+			"spec": map[string]interface{}{"instances": int64(3), "type": "rw"},
+		}}
+	}
+
+	tests := []struct {
+		name     string
+		patches  []ResourcePatch
+		item     *unstructured.Unstructured
+		expected func(item *unstructured.Unstructured)
+	}{
+		{
+			name: "JSON patch",
+			patches: []ResourcePatch{
+				{Group: "postgresql.cnpg.io", Kind: "Pooler", JSONPatch: []byte(`[{"op":"replace","path":"/spec/instances","value":1}]`)},
+			},
+			item: pooler("default"),
+			expected: func(item *unstructured.Unstructured) {
+				item.Object["spec"].(map[string]interface{})["instances"] = int64(1)
+			},
+		},
+		{
+			name: "merge patch removing an annotation",
+			patches: []ResourcePatch{
+				{Group: "postgresql.cnpg.io", Kind: "Pooler", MergePatch: []byte(`{"metadata":{"annotations":{"argocd.argoproj.io/tracking-id":null}}}`)},
+			},
+			item: pooler("default"),
+			expected: func(item *unstructured.Unstructured) {
+				item.SetAnnotations(map[string]string{"team": "a"})
+			},
+		},
+		{
+			name: "patches are applied in order",
+			patches: []ResourcePatch{
+				{Group: "postgresql.cnpg.io", Kind: "Pooler", MergePatch: []byte(`{"spec":{"instances":2}}`)},
+				{Group: "postgresql.cnpg.io", Kind: "Pooler", JSONPatch: []byte(`[{"op":"test","path":"/spec/instances","value":2},{"op":"replace","path":"/spec/type","value":"ro"}]`)},
+			},
+			item: pooler("default"),
+			expected: func(item *unstructured.Unstructured) {
+				item.Object["spec"] = map[string]interface{}{"instances": int64(2), "type": "ro"}
+			},
+		},
+		{
+			name: "other namespaces are left alone",
+			patches: []ResourcePatch{
+				{Group: "postgresql.cnpg.io", Kind: "Pooler", Namespaces: []string{"team-a"}, MergePatch: []byte(`{"spec":{"instances":1}}`)},
+			},
+			item:     pooler("default"),
+			expected: func(item *unstructured.Unstructured) {},
+		},
+		{
+			name: "other versions are left alone",
+			patches: []ResourcePatch{
+				{Group: "postgresql.cnpg.io", Version: "v2", Kind: "Pooler", MergePatch: []byte(`{"spec":{"instances":1}}`)},
+			},
+			item:     pooler("default"),
+			expected: func(item *unstructured.Unstructured) {},
+		},
+		{
+			name: "strategic merge patch of a built-in kind",
+			patches: []ResourcePatch{
+				{Kind: "Service", StrategicMergePatch: []byte(`{"spec":{"ports":[{"port":5432,"nodePort":null}]}}`)},
+			},
+			item: &unstructured.Unstructured{Object: map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "Service",
+				"metadata":   map[string]interface{}{"name": "pg", "namespace": "default"},
+				"spec": map[string]interface{}{
+					"ports": []interface{}{
+						map[string]interface{}{"name": "postgres", "port": int64(5432), "nodePort": int64(30432)},
+						map[string]interface{}{"name": "metrics", "port": int64(9187)},
+					},
+				},
+			}},
+			expected: func(item *unstructured.Unstructured) {
+				delete(item.Object["spec"].(map[string]interface{})["ports"].([]interface{})[0].(map[string]interface{}), "nodePort")
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expected := tt.item.DeepCopy()
+			tt.expected(expected)
+			plugin := &ResourcePatchRestorePlugin{log: logrus.New(), config: &PluginConfig{ResourcePatches: tt.patches}}
+
+			output, err := plugin.Execute(&velero.RestoreItemActionExecuteInput{Item: tt.item})
+			require.NoError(t, err)
+			assert.Equal(t, expected.Object, output.UpdatedItem.UnstructuredContent())
+		})
+	}
+}
+
+func TestResourcePatchExecuteFailure(t *testing.T) {
+	plugin := &ResourcePatchRestorePlugin{log: logrus.New(), config: &PluginConfig{ResourcePatches: []ResourcePatch{
+		{Kind: "ConfigMap", JSONPatch: []byte(`[{"op":"remove","path":"/data/missing"}]`)},
+	}}}
+	item := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata":   map[string]interface{}{"name": "app", "namespace": "default"},
+	}}
+
+	_, err := plugin.Execute(&velero.RestoreItemActionExecuteInput{Item: item})
+	assert.ErrorContains(t, err, "failed to apply resource patch 0")
+}
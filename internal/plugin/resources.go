@@ -0,0 +1,50 @@
+package plugin
+
+import (
+	"github.com/pkg/errors"
+)
+
+// applyResourceProfile rewrites spec.resources on the restored cluster with the
+// selected profile, so a production-sized database can be recovered into a smaller
+// validation environment
+func (p *RestorePluginV2) applyResourceProfile(itemContent map[string]interface{}, config *PluginConfig) error {
+	if config.ResourceProfile == "" || config.ResourceProfile == ResourceProfileOriginal {
+		return nil
+	}
+
+	profile, found := config.ResourceProfiles[config.ResourceProfile]
+	if !found {
+		return errors.Errorf("resource profile %q is not defined", config.ResourceProfile)
+	}
+
+	specMap, err := getSpecMap(itemContent)
+	if err != nil {
+		return err
+	}
+
+	resources := map[string]interface{}{}
+	if len(profile.Requests) > 0 {
+		resources["requests"] = stringMapToInterfaces(profile.Requests)
+	}
+	if len(profile.Limits) > 0 {
+		resources["limits"] = stringMapToInterfaces(profile.Limits)
+	}
+
+	if len(resources) > 0 {
+		specMap["resources"] = resources
+	} else {
+		delete(specMap, "resources")
+	}
+	p.log.Infof("Applied resource profile %s to spec.resources", config.ResourceProfile)
+
+	return nil
+}
+
+// stringMapToInterfaces converts a string map into the map form used by unstructured content
+func stringMapToInterfaces(values map[string]string) map[string]interface{} {
+	result := make(map[string]interface{}, len(values))
+	for key, value := range values {
+		result[key] = value
+	}
+	return result
+}
@@ -0,0 +1,109 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyResourceProfile(t *testing.T) {
+	plugin := &RestorePluginV2{
+		log: logrus.New(),
+	}
+
+	profiles := map[string]ResourceProfile{
+		"small": {
+			Requests: map[string]string{"cpu": "500m", "memory": "1Gi"},
+			Limits:   map[string]string{"memory": "2Gi"},
+		},
+		"unbounded": {},
+	}
+
+	newItemContent := func() map[string]interface{} {
+		return map[string]interface{}{
+			"spec": map[string]interface{}{
+				"resources": map[string]interface{}{
+					"requests": map[string]interface{}{"cpu": "8", "memory": "64Gi"},
+					"limits":   map[string]interface{}{"cpu": "8", "memory": "64Gi"},
+				},
+			},
+		}
+	}
+
+	tests := []struct {
+		name          string
+		itemContent   map[string]interface{}
+		profile       string
+		expectedError bool
+		validateFn    func(t *testing.T, spec map[string]interface{})
+	}{
+		{
+			name:        "no profile leaves resources unchanged",
+			itemContent: newItemContent(),
+			validateFn: func(t *testing.T, spec map[string]interface{}) {
+				assert.Equal(t, newItemContent()["spec"], spec)
+			},
+		},
+		{
+			name:        "original profile leaves resources unchanged",
+			itemContent: newItemContent(),
+			profile:     ResourceProfileOriginal,
+			validateFn: func(t *testing.T, spec map[string]interface{}) {
+				assert.Equal(t, newItemContent()["spec"], spec)
+			},
+		},
+		{
+			name:        "small profile replaces requests and limits",
+			itemContent: newItemContent(),
+			profile:     "small",
+			validateFn: func(t *testing.T, spec map[string]interface{}) {
+				resources := spec["resources"].(map[string]interface{})
+				assert.Equal(t, map[string]interface{}{"cpu": "500m", "memory": "1Gi"}, resources["requests"])
+				assert.Equal(t, map[string]interface{}{"memory": "2Gi"}, resources["limits"])
+			},
+		},
+		{
+			name:        "empty profile removes resources",
+			itemContent: newItemContent(),
+			profile:     "unbounded",
+			validateFn: func(t *testing.T, spec map[string]interface{}) {
+				_, hasResources := spec["resources"]
+				assert.False(t, hasResources)
+			},
+		},
+		{
+			name:          "undefined profile",
+			itemContent:   newItemContent(),
+			profile:       "huge",
+			expectedError: true,
+		},
+		{
+			name:          "no spec field",
+			itemContent:   map[string]interface{}{},
+			profile:       "small",
+			expectedError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &PluginConfig{
+				ResourceProfile:  tt.profile,
+				ResourceProfiles: profiles,
+			}
+
+			err := plugin.applyResourceProfile(tt.itemContent, config)
+
+			if tt.expectedError {
+				assert.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				if tt.validateFn != nil {
+					tt.validateFn(t, tt.itemContent["spec"].(map[string]interface{}))
+				}
+			}
+		})
+	}
+}
@@ -2,22 +2,57 @@ package plugin
 
 import (
 	"context"
-	"fmt"
+	"strings"
 	"time"
 
+	"github.com/nvanthao/velero-plugin-cnpg-restore/pkg/override"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/label"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework/common"
 	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	corev1apply "k8s.io/client-go/applyconfigurations/core/v1"
 	metav1apply "k8s.io/client-go/applyconfigurations/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// recoverySourceName is the externalClusters entry pointing at the barman object store
+	recoverySourceName = "clusterBackup"
+
+	// cloneSourceName is the externalClusters entry pointing at a running source cluster
+	cloneSourceName = "clusterSource"
+
+	// serverNameSuffixLength is the length of the random suffix of generated serverNames
+	serverNameSuffixLength = 5
 )
 
 // RestorePlugin is a restore item action plugin for Velero
 type RestorePluginV2 struct {
 	log logrus.FieldLogger
+
+	// name is the name the action is registered under, which selects its plugin
+	// ConfigMap. It defaults to RestorePluginName.
+	name string
+
+	// config overrides the plugin ConfigMap lookup when set
+	config *PluginConfig
+
+	// dynamicClient overrides GetDynamicClient when set
+	dynamicClient dynamic.Interface
+
+	// kubeClient overrides GetClient for the status and override ConfigMaps when set
+	kubeClient kubernetes.Interface
+
+	// instanceStatus overrides reading the status of CNPG instances through the pod proxy
+	// when set
+	instanceStatus InstanceStatusFunc
 }
 
 // NewRestorePluginV2 instantiates a v2 RestorePlugin.
@@ -25,20 +60,88 @@ func NewRestorePluginV2(log logrus.FieldLogger) *RestorePluginV2 {
 	return &RestorePluginV2{log: log}
 }
 
+// NewNamedRestorePluginV2 instantiates a v2 RestorePlugin registered under the given
+// name, so several instances can apply different configurations.
+func NewNamedRestorePluginV2(log logrus.FieldLogger, name string) *RestorePluginV2 {
+	return &RestorePluginV2{log: log, name: name}
+}
 
-// createOrUpdateConfigMap creates or updates the cnpg-velero-override ConfigMap
-func (p *RestorePluginV2) createOrUpdateConfigMap(namespace, writeServerName, readServerName string) error {
-	client, err := GetClient()
+// actionName returns the name the action is registered under
+func (p *RestorePluginV2) actionName() string {
+	if p.name != "" {
+		return p.name
+	}
+	return RestorePluginName
+}
+
+// getConfig returns the plugin configuration, see loadActionConfig
+func (p *RestorePluginV2) getConfig() (*PluginConfig, error) {
+	return loadActionConfig(p.config, common.PluginKindRestoreItemAction, p.actionName())
+}
+
+// getDynamicClient returns the dynamic client used to query CNPG resources
+func (p *RestorePluginV2) getDynamicClient() (dynamic.Interface, error) {
+	if p.dynamicClient != nil {
+		return p.dynamicClient, nil
+	}
+	return GetDynamicClient()
+}
+
+// getKubeClient returns the client used to record restore warnings and write the override ConfigMap
+func (p *RestorePluginV2) getKubeClient() (kubernetes.Interface, error) {
+	if p.kubeClient != nil {
+		return p.kubeClient, nil
+	}
+	return GetClient()
+}
+
+// getInstanceStatus returns the function reading the status of CNPG instances
+func (p *RestorePluginV2) getInstanceStatus() InstanceStatusFunc {
+	if p.instanceStatus != nil {
+		return p.instanceStatus
+	}
+	return func(ctx context.Context, namespace, pod string) (*InstanceStatus, error) {
+		client, err := p.getKubeClient()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get Kubernetes client")
+		}
+		return PodProxyInstanceStatus(client)(ctx, namespace, pod)
+	}
+}
+
+// createOrUpdateConfigMap creates or updates the keys of the cluster in the cnpg-velero-override
+// ConfigMap. Each cluster applies its keys with a field manager of its own, so applying them
+// leaves the keys of other clusters restored into the namespace in place. Keys an earlier
+// restore wrote for the cluster are handled according to conflictPolicy. labels are added
+// to the ConfigMap.
+func (p *RestorePluginV2) createOrUpdateConfigMap(namespace, clusterName string, data *override.Override, labels map[string]string, conflictPolicy string) error {
+	client, err := p.getKubeClient()
 	if err != nil {
 		return errors.Wrap(err, "failed to get Kubernetes client")
 	}
 
-	configMapName := "cnpg-velero-override"
+	configMapName := OverrideConfigMapName
 
 	// Create context with timeout for K8s API operations
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
+	existing, err := client.CoreV1().ConfigMaps(namespace).Get(ctx, configMapName, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrap(classifyAPIError(err), "failed to get ConfigMap")
+	}
+	found := err == nil
+	if found {
+		data = p.withOverrideHistory(existing, clusterName, data)
+	}
+
+	clusterData := data.ClusterData(clusterName)
+	if found && (conflictPolicy == OverrideConflictMerge || conflictPolicy == OverrideConflictFail) {
+		if err := mergeOverrideData(clusterData, existing.Data, clusterName, conflictPolicy); err != nil {
+			return errors.Wrapf(err, "ConfigMap %s/%s", namespace, configMapName)
+		}
+	}
+
 	// create or update the ConfigMap
 	_, err = client.CoreV1().ConfigMaps(namespace).Apply(ctx,
 		&corev1apply.ConfigMapApplyConfiguration{
@@ -49,43 +152,83 @@ func (p *RestorePluginV2) createOrUpdateConfigMap(namespace, writeServerName, re
 			ObjectMetaApplyConfiguration: &metav1apply.ObjectMetaApplyConfiguration{
 				Name:      &configMapName,
 				Namespace: &namespace,
+				Labels:    labels,
 				Annotations: map[string]string{
 					"helm.sh/resource-policy": "keep",
 				},
 			},
-			Data: map[string]string{
-				"write_to_server_name":  writeServerName,
-				"read_from_server_name": readServerName,
-			},
+			Data: clusterData,
 		},
-		metav1.ApplyOptions{FieldManager: "velero-cnpg-plugin", Force: true})
+		metav1.ApplyOptions{FieldManager: "velero-cnpg-plugin-" + clusterName, Force: true})
 
 	if err != nil {
-		return errors.Wrap(err, "failed to apply ConfigMap")
+		return errors.Wrap(classifyAPIError(err), "failed to apply ConfigMap")
 	}
 
 	p.log.Infof("Applied ConfigMap %s/%s", namespace, configMapName)
 	return nil
 }
 
+// withOverrideHistory returns data with a history carrying over the serverNames an earlier
+// restore wrote for the cluster to the existing override ConfigMap, so the sequence of
+// restores can be reconstructed from it. A history that cannot be parsed is dropped with
+// a warning rather than failing the restore.
+func (p *RestorePluginV2) withOverrideHistory(existing *corev1.ConfigMap, clusterName string, data *override.Override) *override.Override {
+	if _, found := existing.Data[override.ClusterKey(clusterName, override.KeyWriteToServerName)]; !found {
+		return data
+	}
+	previous, err := override.FromConfigMapForCluster(existing, clusterName)
+	if err != nil {
+		p.log.Warnf("Starting a new override history for cluster %s: %v", clusterName, err)
+		delete(existing.Data, override.ClusterKey(clusterName, override.KeyHistory))
+		if previous, err = override.FromConfigMapForCluster(existing, clusterName); err != nil {
+			return data
+		}
+	}
+	return previous.Replace(data, time.Now())
+}
+
+// mergeOverrideData applies conflictPolicy to the keys an earlier restore wrote for the
+// cluster to the override ConfigMap. With merge, the prefixed keys of the cluster that
+// clusterData does not set are carried over into it, since applying without them would
+// remove them. With fail, finding the cluster's serverName keys is an error.
+func mergeOverrideData(clusterData, existing map[string]string, clusterName, conflictPolicy string) error {
+	if conflictPolicy == OverrideConflictFail {
+		key := override.ClusterKey(clusterName, override.KeyWriteToServerName)
+		if previous, found := existing[key]; found {
+			return errors.Errorf("already holds the keys of cluster %s from an earlier restore, %s is %q (overrideConflictPolicy is %s)", clusterName, key, previous, OverrideConflictFail)
+		}
+		return nil
+	}
+
+	prefix := override.ClusterKey(clusterName, "")
+	for key, value := range existing {
+		if _, set := clusterData[key]; !set && strings.HasPrefix(key, prefix) {
+			clusterData[key] = value
+		}
+	}
+	return nil
+}
+
 // stringPtr is a helper to get string pointer
 func stringPtr(s string) *string {
 	return &s
 }
 
-// extractBarmanObjectName extracts barmanObjectName from .spec.plugins[].parameters
+// extractBarmanObjectName extracts barmanObjectName from the parameters of the WAL archiver
+// entry in .spec.plugins
 func (p *RestorePluginV2) extractBarmanObjectName(itemContent map[string]interface{}) (string, error) {
 	spec, found, err := unstructured.NestedFieldNoCopy(itemContent, "spec")
 	if err != nil {
 		return "", errors.Wrap(err, "failed to get spec field")
 	}
 	if !found {
-		return "", errors.New("spec field not found")
+		return "", specShapeError("spec field not found")
 	}
 
 	specMap, ok := spec.(map[string]interface{})
 	if !ok {
-		return "", errors.New("spec is not a map")
+		return "", specShapeError("spec is not a map")
 	}
 
 	plugins, found := specMap["plugins"]
@@ -95,30 +238,11 @@ func (p *RestorePluginV2) extractBarmanObjectName(itemContent map[string]interfa
 
 	pluginsList, ok := plugins.([]interface{})
 	if !ok {
-		return "", errors.New("plugins is not a list")
+		return "", specShapeError("plugins is not a list")
 	}
 
-	for _, plugin := range pluginsList {
-		pluginMap, ok := plugin.(map[string]interface{})
-		if !ok {
-			continue
-		}
-
-		parameters, found := pluginMap["parameters"]
-		if !found {
-			continue
-		}
-
-		paramsMap, ok := parameters.(map[string]interface{})
-		if !ok {
-			continue
-		}
-
-		if bon, found := paramsMap["barmanObjectName"]; found {
-			if bonStr, ok := bon.(string); ok {
-				return bonStr, nil
-			}
-		}
+	if barmanObjectName, found := walArchiverParameter(pluginsList, "barmanObjectName"); found {
+		return barmanObjectName, nil
 	}
 
 	return "", errors.New("barmanObjectName not found in plugin parameters")
@@ -138,9 +262,14 @@ func (p *RestorePluginV2) Name() string {
 // selector. A zero-valued ResourceSelector matches all resources.
 func (p *RestorePluginV2) AppliesTo() (velero.ResourceSelector, error) {
 	p.log.Info("RestorePluginV2.AppliesTo called")
-	return velero.ResourceSelector{
+	config, err := p.getConfig()
+	if err != nil {
+		return noNamespaces(), err
+	}
+	return config.scopeNamespaces(velero.ResourceSelector{
 		IncludedResources: []string{"clusters.postgresql.cnpg.io"},
-	}, nil
+		LabelSelector:     config.LabelSelector,
+	}), nil
 }
 
 // getAnnotation retrieves an annotation value from the item's metadata
@@ -155,7 +284,7 @@ func (p *RestorePluginV2) getAnnotation(itemContent map[string]interface{}, key
 
 	metadataMap, ok := metadata.(map[string]interface{})
 	if !ok {
-		return "", false, errors.New("metadata is not a map")
+		return "", false, specShapeError("metadata is not a map")
 	}
 
 	annotations, found := metadataMap["annotations"]
@@ -165,7 +294,7 @@ func (p *RestorePluginV2) getAnnotation(itemContent map[string]interface{}, key
 
 	annotationsMap, ok := annotations.(map[string]interface{})
 	if !ok {
-		return "", false, errors.New("annotations is not a map")
+		return "", false, specShapeError("annotations is not a map")
 	}
 
 	value, found := annotationsMap[key]
@@ -175,18 +304,12 @@ func (p *RestorePluginV2) getAnnotation(itemContent map[string]interface{}, key
 
 	valueStr, ok := value.(string)
 	if !ok {
-		return "", false, errors.New("annotation value is not a string")
+		return "", false, specShapeError("annotation value is not a string")
 	}
 
 	return valueStr, true, nil
 }
 
-// generateNewServerName creates a unique serverName using the cluster name and timestamp
-func (p *RestorePluginV2) generateNewServerName(clusterName string) string {
-	timestamp := time.Now().Format("20060102-150405")
-	return fmt.Sprintf("%s-%s", clusterName, timestamp)
-}
-
 // removeEphemeralFields removes status and other ephemeral fields from the cluster CR
 func (p *RestorePluginV2) removeEphemeralFields(itemContent map[string]interface{}) {
 	// Remove status field
@@ -211,20 +334,20 @@ func (p *RestorePluginV2) configureExternalCluster(itemContent map[string]interf
 		return errors.Wrap(err, "failed to get spec field")
 	}
 	if !found {
-		return errors.New("spec field not found")
+		return specShapeError("spec field not found")
 	}
 
 	specMap, ok := spec.(map[string]interface{})
 	if !ok {
-		return errors.New("spec is not a map")
+		return specShapeError("spec is not a map")
 	}
 
 	// Create externalClusters configuration
 	externalClusters := []interface{}{
 		map[string]interface{}{
-			"name": "clusterBackup",
+			"name": recoverySourceName,
 			"plugin": map[string]interface{}{
-				"name": "barman-cloud.cloudnative-pg.io",
+				"name": BarmanCloudPluginName,
 				"parameters": map[string]interface{}{
 					"barmanObjectName": barmanObjectName,
 					"serverName":       serverName,
@@ -233,8 +356,9 @@ func (p *RestorePluginV2) configureExternalCluster(itemContent map[string]interf
 		},
 	}
 
-	// Directly modify the spec map instead of using SetNestedField
-	specMap["externalClusters"] = externalClusters
+	// Directly modify the spec map instead of using SetNestedField, keeping the streaming
+	// sources of the backed-up cluster
+	specMap["externalClusters"] = append(externalClusters, streamingSources(specMap)...)
 
 	return nil
 }
@@ -246,12 +370,12 @@ func (p *RestorePluginV2) updatePluginServerName(itemContent map[string]interfac
 		return errors.Wrap(err, "failed to get spec field")
 	}
 	if !found {
-		return errors.New("spec field not found")
+		return specShapeError("spec field not found")
 	}
 
 	specMap, ok := spec.(map[string]interface{})
 	if !ok {
-		return errors.New("spec is not a map")
+		return specShapeError("spec is not a map")
 	}
 
 	plugins, found := specMap["plugins"]
@@ -262,7 +386,7 @@ func (p *RestorePluginV2) updatePluginServerName(itemContent map[string]interfac
 
 	pluginsList, ok := plugins.([]interface{})
 	if !ok {
-		return errors.New("plugins is not a list")
+		return specShapeError("plugins is not a list")
 	}
 
 	// Update serverName in all plugins that have it
@@ -298,6 +422,43 @@ func (p *RestorePluginV2) updatePluginServerName(itemContent map[string]interfac
 	return nil
 }
 
+// updatePluginBarmanObjectName renames barmanObjectName in .spec.plugins[].parameters
+// according to the configured object store mapping
+func (p *RestorePluginV2) updatePluginBarmanObjectName(itemContent map[string]interface{}, barmanObjectNames map[string]string) error {
+	plugins, found, err := unstructured.NestedFieldNoCopy(itemContent, "spec", "plugins")
+	if err != nil {
+		return errors.Wrap(err, "failed to get plugins field")
+	}
+	if !found {
+		return nil
+	}
+
+	pluginsList, ok := plugins.([]interface{})
+	if !ok {
+		return specShapeError("plugins is not a list")
+	}
+
+	for _, plugin := range pluginsList {
+		pluginMap, ok := plugin.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		paramsMap, ok := pluginMap["parameters"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		name, _ := paramsMap["barmanObjectName"].(string)
+		if mapped, found := barmanObjectNames[name]; found {
+			paramsMap["barmanObjectName"] = mapped
+			p.log.Infof("Updated plugin barmanObjectName to: %s", mapped)
+		}
+	}
+
+	return nil
+}
+
 // configureBootstrapRecovery updates bootstrap configuration to use recovery from backup
 func (p *RestorePluginV2) configureBootstrapRecovery(itemContent map[string]interface{}, backupID string) error {
 	spec, found, err := unstructured.NestedFieldNoCopy(itemContent, "spec")
@@ -305,17 +466,17 @@ func (p *RestorePluginV2) configureBootstrapRecovery(itemContent map[string]inte
 		return errors.Wrap(err, "failed to get spec field")
 	}
 	if !found {
-		return errors.New("spec field not found")
+		return specShapeError("spec field not found")
 	}
 
 	specMap, ok := spec.(map[string]interface{})
 	if !ok {
-		return errors.New("spec is not a map")
+		return specShapeError("spec is not a map")
 	}
 
 	// Create recovery configuration
 	recovery := map[string]interface{}{
-		"source": "clusterBackup",
+		"source": recoverySourceName,
 	}
 
 	// Add recoveryTarget if backupID is provided
@@ -337,29 +498,391 @@ func (p *RestorePluginV2) configureBootstrapRecovery(itemContent map[string]inte
 	return nil
 }
 
+// configureSourceCluster adds an externalClusters entry connecting to a running source cluster
+func (p *RestorePluginV2) configureSourceCluster(itemContent map[string]interface{}, source *SourceClusterConfig) error {
+	spec, found, err := unstructured.NestedFieldNoCopy(itemContent, "spec")
+	if err != nil {
+		return errors.Wrap(err, "failed to get spec field")
+	}
+	if !found {
+		return specShapeError("spec field not found")
+	}
+
+	specMap, ok := spec.(map[string]interface{})
+	if !ok {
+		return specShapeError("spec is not a map")
+	}
+
+	if source == nil {
+		return errors.New("source cluster connection is not configured")
+	}
+
+	connectionParameters := make(map[string]interface{}, len(source.ConnectionParameters))
+	for key, value := range source.ConnectionParameters {
+		connectionParameters[key] = value
+	}
+
+	externalCluster := map[string]interface{}{
+		"name":                 cloneSourceName,
+		"connectionParameters": connectionParameters,
+	}
+
+	secretRefs := map[string]*SecretKeySelector{
+		"password":    source.Password,
+		"sslCert":     source.SSLCert,
+		"sslKey":      source.SSLKey,
+		"sslRootCert": source.SSLRootCert,
+	}
+	for field, ref := range secretRefs {
+		if ref == nil {
+			continue
+		}
+		externalCluster[field] = map[string]interface{}{
+			"name": ref.Name,
+			"key":  ref.Key,
+		}
+	}
+
+	specMap["externalClusters"] = append([]interface{}{externalCluster}, streamingSources(specMap)...)
+
+	return nil
+}
+
+// configureBootstrapPgBaseBackup updates bootstrap configuration to clone the running source cluster
+func (p *RestorePluginV2) configureBootstrapPgBaseBackup(itemContent map[string]interface{}) error {
+	spec, found, err := unstructured.NestedFieldNoCopy(itemContent, "spec")
+	if err != nil {
+		return errors.Wrap(err, "failed to get spec field")
+	}
+	if !found {
+		return specShapeError("spec field not found")
+	}
+
+	specMap, ok := spec.(map[string]interface{})
+	if !ok {
+		return specShapeError("spec is not a map")
+	}
+
+	// Replace bootstrap configuration with pg_basebackup
+	specMap["bootstrap"] = map[string]interface{}{
+		"pg_basebackup": map[string]interface{}{
+			"source": cloneSourceName,
+		},
+	}
+
+	return nil
+}
+
+// configureBootstrapImport updates bootstrap configuration to run initdb with a logical
+// import from the running source cluster. Existing initdb settings (database, owner,
+// secret) are preserved so the application database matches the original cluster.
+func (p *RestorePluginV2) configureBootstrapImport(itemContent map[string]interface{}, importConfig *ImportConfig) error {
+	spec, found, err := unstructured.NestedFieldNoCopy(itemContent, "spec")
+	if err != nil {
+		return errors.Wrap(err, "failed to get spec field")
+	}
+	if !found {
+		return specShapeError("spec field not found")
+	}
+
+	specMap, ok := spec.(map[string]interface{})
+	if !ok {
+		return specShapeError("spec is not a map")
+	}
+
+	if importConfig == nil {
+		importConfig = &ImportConfig{}
+	}
+
+	initdb := map[string]interface{}{}
+	if bootstrap, ok := specMap["bootstrap"].(map[string]interface{}); ok {
+		if existing, ok := bootstrap["initdb"].(map[string]interface{}); ok {
+			initdb = existing
+		}
+	}
+
+	importType := importConfig.Type
+	if importType == "" {
+		importType = ImportTypeMicroservice
+	}
+
+	databases := importConfig.Databases
+	if len(databases) == 0 {
+		database, _ := initdb["database"].(string)
+		if database == "" {
+			database = "app"
+		}
+		databases = []string{database}
+	}
+
+	importSpec := map[string]interface{}{
+		"type":      importType,
+		"databases": stringsToInterfaces(databases),
+		"source": map[string]interface{}{
+			"externalCluster": cloneSourceName,
+		},
+	}
+	if len(importConfig.Roles) > 0 {
+		importSpec["roles"] = stringsToInterfaces(importConfig.Roles)
+	}
+	if importConfig.SchemaOnly {
+		importSpec["schemaOnly"] = true
+	}
+	if len(importConfig.PostImportApplicationSQL) > 0 {
+		importSpec["postImportApplicationSQL"] = stringsToInterfaces(importConfig.PostImportApplicationSQL)
+	}
+
+	initdb["import"] = importSpec
+	p.log.Infof("Configured %s import of databases %v", importType, databases)
+
+	// Replace bootstrap configuration with initdb import
+	specMap["bootstrap"] = map[string]interface{}{
+		"initdb": initdb,
+	}
+
+	return nil
+}
+
+// stringsToInterfaces converts a string slice into the list form used by unstructured content
+func stringsToInterfaces(values []string) []interface{} {
+	result := make([]interface{}, 0, len(values))
+	for _, value := range values {
+		result = append(result, value)
+	}
+	return result
+}
+
+// configureRecoverySource configures the externalClusters entry recovery reads the backup
+// from, for the backup method the cluster was backed up with. Volume snapshot backups only
+// get one when the cluster also archives WAL to an object store.
+func (p *RestorePluginV2) configureRecoverySource(itemContent map[string]interface{}, method, serverName, barmanObjectName string) error {
+	switch method {
+	case BackupMethodBarmanObjectStore:
+		// Configure external cluster for the in-tree object store
+		if err := p.configureExternalClusterObjectStore(itemContent, serverName); err != nil {
+			return errors.Wrap(err, "failed to configure external cluster")
+		}
+		p.log.Info("Configured externalClusters with barmanObjectStore backup source")
+	case BackupMethodVolumeSnapshot:
+		// Replay WAL from the object store when the cluster also archives there
+		if barmanObjectName != "" {
+			if err := p.configureExternalCluster(itemContent, serverName, barmanObjectName); err != nil {
+				return errors.Wrap(err, "failed to configure external cluster")
+			}
+		} else if _, found, _ := unstructured.NestedMap(itemContent, "spec", "backup", "barmanObjectStore"); found && serverName != "" {
+			if err := p.configureExternalClusterObjectStore(itemContent, serverName); err != nil {
+				return errors.Wrap(err, "failed to configure external cluster")
+			}
+		}
+	default:
+		// Configure external cluster for backup source
+		if err := p.configureExternalCluster(itemContent, serverName, barmanObjectName); err != nil {
+			return errors.Wrap(err, "failed to configure external cluster")
+		}
+		p.log.Info("Configured externalClusters with backup source")
+	}
+
+	return nil
+}
+
+// configureRecoveryBootstrap configures bootstrap.recovery for the backup method the
+// cluster was backed up with. Recovery from volume snapshots replays WAL from the
+// clusterBackup externalClusters entry when the spec has one.
+func (p *RestorePluginV2) configureRecoveryBootstrap(itemContent map[string]interface{}, method, backupID string, snapshots *VolumeSnapshots) error {
+	if method != BackupMethodVolumeSnapshot {
+		// Update bootstrap to use recovery with optional backup ID
+		if err := p.configureBootstrapRecovery(itemContent, backupID); err != nil {
+			return errors.Wrap(err, "failed to configure bootstrap recovery")
+		}
+		p.log.Info("Configured bootstrap.recovery to restore from backup")
+		return nil
+	}
+
+	specMap, err := getSpecMap(itemContent)
+	if err != nil {
+		return err
+	}
+	source := ""
+	for _, externalCluster := range sliceOfMaps(specMap["externalClusters"]) {
+		if externalCluster["name"] == recoverySourceName {
+			source = recoverySourceName
+			break
+		}
+	}
+
+	if err := p.configureBootstrapVolumeSnapshots(itemContent, snapshots, source); err != nil {
+		return errors.Wrap(err, "failed to configure bootstrap volume snapshots")
+	}
+	p.log.Infof("Configured bootstrap.recovery to restore from volume snapshot %s", snapshots.Storage)
+	return nil
+}
+
 // Execute allows the RestorePlugin to perform arbitrary logic with the item being restored,
 // in this case, configuring the cluster for recovery from backup.
-func (p *RestorePluginV2) Execute(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
+func (p *RestorePluginV2) Execute(input *velero.RestoreItemActionExecuteInput) (_ *velero.RestoreItemActionExecuteOutput, err error) {
+	defer reportError(p.log, "CNPG restore plugin", input.Item, &err)
+	defer recoverPanic(p.log, "CNPG restore plugin", input.Item, &err)
+
 	p.log.Info("Executing CNPG restore plugin on resource: %s", resourceName(input.Item))
 
+	if restoreDisabled(input.Restore) {
+		p.log.Infof("Restore has %s set, passing item through unmodified", AnnotationDisable)
+		return velero.NewRestoreItemActionExecuteOutput(input.Item), nil
+	}
+
+	if skipRestore(&unstructured.Unstructured{Object: input.Item.UnstructuredContent()}) {
+		p.log.Infof("Cluster has %s set, leaving it out of the restore", AnnotationSkipRestore)
+		return velero.NewRestoreItemActionExecuteOutput(input.Item).WithoutRestore(), nil
+	}
+
+	config, err := p.getConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if config.OptIn && !optedIn(&unstructured.Unstructured{Object: input.Item.UnstructuredContent()}) {
+		p.log.Infof("Cluster has no %s=true annotation, passing it through unmodified", AnnotationEnabled)
+		return velero.NewRestoreItemActionExecuteOutput(input.Item), nil
+	}
+
+	// Every warning logged from here on fails the item in strict mode
+	if config.Strict {
+		recorder := newWarningRecorder(p.log)
+		defer recorder.failStrict(&err)
+		scoped := *p
+		scoped.log = recorder
+		p = &scoped
+	}
+
+	warnings := &restoreWarnings{log: p.log}
+	defer flushRestoreWarnings(p.log, p.getKubeClient, input.Restore, input.Item, warnings)
+
+	// Report a destination without CNPG before anything fails on the missing resources
+	if err := p.checkCNPGInstalled(warnings); err != nil {
+		return nil, err
+	}
+
 	itemContent := input.Item.UnstructuredContent()
 
+	// Record what the action did to the cluster once it is done with it
+	operation := ""
+	if input.Restore != nil {
+		operation = input.Restore.Name
+	}
+	result := newResultRecorder("restore", operation, itemContent, time.Now())
+
+	// Drills are restored into the scratch namespace, whatever the namespace mappings
+	rehearsing, err := rehearsalNamespace(input.Restore, config)
+	if err != nil {
+		return nil, err
+	}
+	if rehearsing != "" {
+		p.log.Infof("Rehearsing the restore of the cluster into namespace %s", rehearsing)
+		rehearse(itemContent, rehearsing, input.Restore)
+	}
+
+	// Check the annotations as they were backed up, before anything rewrites them
+	if err := p.verifyIntegrity(itemContent, config.IntegrityPolicy, warnings); err != nil {
+		return nil, err
+	}
+
+	// Bring annotations written by older plugin versions up to the current schema
+	if err := p.migrateAnnotations(itemContent); err != nil {
+		return nil, err
+	}
+
+	// Let external systems approve the restore and choose where recovery stops
+	webhookTarget, err := callWebhooks(config.Webhooks, newWebhookEvent(WebhookEventPreRestore, operation, itemContent), p.getKubeClient, warnings.Warnf)
+	if err != nil {
+		return nil, err
+	}
+
+	// Compare with the backed-up spec before this action changes it
+	if err := p.detectSpecDrift(itemContent, warnings); err != nil {
+		return nil, err
+	}
+
+	// Put back the plugin parameters as backed up, before they are rewritten for the restore
+	if config.ReconstructPluginParameters {
+		if err := p.reconstructPluginParameters(itemContent, warnings); err != nil {
+			return nil, err
+		}
+	}
+
+	// Keep the fields resource modifiers may take over as they were backed up
+	backedUp := snapshotManagedPaths(itemContent)
+
+	// Carry a warning about clusters backed up while they were not healthy
+	if err := p.warnBackupPhase(itemContent, warnings); err != nil {
+		return nil, err
+	}
+
+	// Trace the policy that produced the data being restored
+	if err := p.logVeleroSchedule(itemContent); err != nil {
+		return nil, err
+	}
+
 	// Check if this cluster was backed up with our plugin
 	serverName, hasServerName, err := p.getAnnotation(itemContent, AnnotationServerName)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to get serverName annotation")
 	}
 
-	if !hasServerName {
-		p.log.Infof("No %s annotation found, skipping restore modifications", AnnotationServerName)
+	method, _, err := p.getAnnotation(itemContent, AnnotationBackupMethod)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get backup method annotation")
+	}
+
+	// Hibernated clusters are resumed whether or not a backup method was recorded
+	if isHibernated(itemContent) {
+		if config.ResumeHibernatedClusters {
+			p.resumeHibernation(itemContent)
+		} else {
+			warnings.Warnf("Cluster was hibernated when backed up and will be restored hibernated")
+		}
+	}
+
+	if method == "" {
+		warnings.Warnf("No %s annotation found, cluster restored without recovery configuration", AnnotationBackupMethod)
+		// Stale status and server-assigned metadata would otherwise be restored as-is
+		if !config.PassThroughUnmanagedClusters {
+			p.removeEphemeralFields(itemContent)
+		}
+		if err := p.applyGitOps(itemContent, config.GitOps); err != nil {
+			return nil, errors.Wrap(err, "failed to apply GitOps metadata")
+		}
+		if rehearsing != "" {
+			if err := rehearseCluster(itemContent, input.Restore); err != nil {
+				return nil, errors.Wrap(err, "failed to prepare rehearsal")
+			}
+		}
+		if len(webhookTarget) > 0 {
+			warnings.Warnf("Cluster is restored without recovery, ignoring the recovery target from webhooks")
+		}
+		p.annotateResult(itemContent, result, ResultSkipped)
+		if _, err := callWebhooks(config.Webhooks, newWebhookEvent(WebhookEventPostRestore, operation, itemContent), p.getKubeClient, warnings.Warnf); err != nil {
+			return nil, err
+		}
+		input.Item.SetUnstructuredContent(itemContent)
 		out := velero.NewRestoreItemActionExecuteOutput(input.Item)
+		if rehearsing != "" {
+			return p.createRehearsal(out)
+		}
 		return out, nil
 	}
 
-	p.log.Infof("Found serverName annotation: %s", serverName)
+	if hasServerName {
+		p.log.Infof("Found serverName annotation: %s", serverName)
+	}
+	p.log.Infof("Using backup method: %s", method)
+
+	// Volumes are provisioned from snapshots in the namespace they were taken in
+	if rehearsing != "" && method == BackupMethodVolumeSnapshot {
+		return nil, errors.Errorf("clusters backed up with %s cannot be rehearsed in another namespace", BackupMethodVolumeSnapshot)
+	}
 
 	// Check for backup ID annotation (optional)
-	backupID, hasBackupID, err := p.getAnnotation(itemContent, "velero-cnpg/current-backup-id")
+	backupID, hasBackupID, err := p.getAnnotation(itemContent, AnnotationCurrentBackupID)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to get backup ID annotation")
 	}
@@ -367,13 +890,64 @@ func (p *RestorePluginV2) Execute(input *velero.RestoreItemActionExecuteInput) (
 		p.log.Infof("Found backup ID annotation: %s", backupID)
 	}
 
-	// Extract barmanObjectName from .spec.plugins[].parameters
-	barmanObjectName, err := p.extractBarmanObjectName(itemContent)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to extract barmanObjectName from plugin parameters")
+	p.log.Infof("Using restore mode: %s", config.RestoreMode)
+
+	if !hasBackupID && config.RestoreMode == RestoreModeRecovery && method != BackupMethodVolumeSnapshot {
+		if err := p.handleSkipReason(itemContent, config.SkipReasonPolicies, warnings); err != nil {
+			return nil, err
+		}
 	}
 
-	p.log.Infof("Found barmanObjectName in plugin parameters: %s", barmanObjectName)
+	var barmanObjectName string
+	var snapshots, recordedSnapshots *VolumeSnapshots
+	if config.RestoreMode == RestoreModeRecovery {
+		switch method {
+		case BackupMethodPlugin:
+			// Extract barmanObjectName from .spec.plugins[].parameters
+			barmanObjectName, err = p.extractBarmanObjectName(itemContent)
+			if err != nil {
+				// Early releases recorded it in an annotation, which migrateAnnotations carried over
+				annotated, found, annotationErr := p.getAnnotation(itemContent, AnnotationBarmanObjectName)
+				if annotationErr != nil || !found {
+					return nil, errors.Wrap(err, "failed to extract barmanObjectName from plugin parameters")
+				}
+				barmanObjectName = annotated
+			}
+
+			p.log.Infof("Found barmanObjectName in plugin parameters: %s", barmanObjectName)
+		case BackupMethodVolumeSnapshot:
+			value, found, err := p.getAnnotation(itemContent, AnnotationVolumeSnapshots)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to get volume snapshots annotation")
+			}
+			if !found {
+				return nil, errors.Errorf("backup method %s requires the %s annotation", method, AnnotationVolumeSnapshots)
+			}
+			recordedSnapshots, err = decodeVolumeSnapshots(value)
+			if err != nil {
+				return nil, err
+			}
+			// Velero restores VolumeSnapshots under new names before it restores clusters
+			snapshots = p.mapRestoredVolumeSnapshots(recordedSnapshots, input.Restore, (&unstructured.Unstructured{Object: itemContent}).GetNamespace(), warnings)
+
+			// WAL archived through the barman plugin is replayed on top of the snapshots
+			if hasServerName {
+				barmanObjectName, _ = p.extractBarmanObjectName(itemContent)
+			}
+		case BackupMethodBarmanObjectStore:
+		default:
+			return nil, errors.Errorf("unknown backup method %q", method)
+		}
+
+		// The object store may be known under another name in the destination cluster
+		if mapped, found := config.BarmanObjectNames[barmanObjectName]; found && barmanObjectName != "" {
+			p.log.Infof("Mapped barmanObjectName %s to %s", barmanObjectName, mapped)
+			barmanObjectName = mapped
+			if err := p.updatePluginBarmanObjectName(itemContent, config.BarmanObjectNames); err != nil {
+				return nil, errors.Wrap(err, "failed to update plugin barmanObjectName")
+			}
+		}
+	}
 
 	// Get cluster name from metadata
 	metadata, found, err := unstructured.NestedFieldNoCopy(itemContent, "metadata")
@@ -385,64 +959,413 @@ func (p *RestorePluginV2) Execute(input *velero.RestoreItemActionExecuteInput) (
 	}
 	metadataMap, ok := metadata.(map[string]interface{})
 	if !ok {
-		return nil, errors.New("metadata is not a map")
+		return nil, specShapeError("metadata is not a map")
 	}
 	clusterName, found := metadataMap["name"]
 	if !found {
-		return nil, errors.New("cluster name not found in metadata")
+		return nil, specShapeError("cluster name not found in metadata")
 	}
 	clusterNameStr, ok := clusterName.(string)
 	if !ok {
-		return nil, errors.New("cluster name is not a string")
+		return nil, specShapeError("cluster name is not a string")
+	}
+
+	namespace, _ := metadataMap["namespace"].(string)
+
+	// Snapshots still to be restored are restored before the cluster that recovers from them
+	var snapshotItems []velero.ResourceIdentifier
+
+	// An existing cluster is updated in place, so it keeps its identity and bootstrap
+	live, err := p.liveCluster(input.Restore, namespace, clusterNameStr)
+	if err != nil {
+		return nil, err
+	}
+	if live != nil {
+		if err := p.mergeLiveCluster(itemContent, live); err != nil {
+			return nil, errors.Wrap(err, "failed to merge existing cluster")
+		}
+		warnings.Warnf("Cluster %s/%s already exists, updating it in place without recovery", namespace, clusterNameStr)
+		if len(webhookTarget) > 0 {
+			warnings.Warnf("Cluster is updated in place, ignoring the recovery target from webhooks")
+		}
+	} else {
+		// Recovery reads from the original serverName and the restored cluster writes to a new one
+		newServerName := serverName
+		if serverName != "" && config.mutationStepEnabled(MutationStepRotateServerName) {
+			newServerName, err = p.nextServerName(itemContent, input.Restore, config.ServerNameStrategy)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to name new serverName")
+			}
+			p.log.Infof("Generated new serverName for restored cluster: %s (original: %s)", newServerName, serverName)
+		}
+		var earlierServerNames []string
+
+		// Keep the backups of the new serverName as long as the setting asks for
+		if config.RetentionPolicy != "" {
+			if err := p.configureRetentionPolicy(itemContent, config.RetentionPolicy, warnings); err != nil {
+				return nil, errors.Wrap(err, "failed to configure retention policy")
+			}
+		}
+
+		// Point the object store at the destination's before the recovery source copies it
+		if config.DisasterRecovery != nil {
+			recoveredFrom := ""
+			if config.RestoreMode == RestoreModeRecovery {
+				recoveredFrom = serverName
+			}
+			if err := p.prepareDisasterRecovery(itemContent, config.DisasterRecovery, recoveredFrom, barmanObjectName, warnings); err != nil {
+				return nil, err
+			}
+		}
+
+		// Physical recovery needs the same or a newer PostgreSQL major version
+		if config.RestoreMode == RestoreModeRecovery {
+			if err := p.checkMajorVersion(itemContent, config.operatorSelector()); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, step := range config.mutationSteps() {
+			switch step {
+			case MutationStepOverrideConfigMap:
+				if serverName == "" {
+					if config.Replica.promoteAfter() > 0 {
+						warnings.Warnf("Cluster has no serverName, so no override ConfigMap with promotion instructions is written")
+					}
+					continue
+				}
+
+				// Create or update ConfigMap with serverName and promotion information
+				data := &override.Override{
+					WriteToServerName:  newServerName,
+					ReadFromServerName: serverName,
+					PromoteAfter:       config.Replica.promoteAfter(),
+				}
+				// The label selects the copies in later backups for the override ConfigMap action
+				labels := map[string]string{LabelOverrideConfigMap: "true"}
+				// Keep the ConfigMap out of later backups so restoring them cannot bring back stale serverNames
+				if config.ExcludeOverrideConfigMapFromBackup {
+					labels[v1.ExcludeFromBackupLabel] = "true"
+				}
+				if rehearsing != "" {
+					labels[LabelRehearsal] = label.GetValidName(input.Restore.Name)
+				}
+				if err := p.createOrUpdateConfigMap(namespace, clusterNameStr, data, labels, config.OverrideConflictPolicy); err != nil {
+					return nil, errors.Wrap(err, "failed to create/update ConfigMap")
+				}
+			case MutationStepStripEphemeralFields:
+				p.removeEphemeralFields(itemContent)
+			case MutationStepRotateServerName:
+				if newServerName == serverName {
+					continue
+				}
+
+				// Update the plugin serverName to the new unique value
+				if err := p.updatePluginServerName(itemContent, newServerName); err != nil {
+					return nil, errors.Wrap(err, "failed to update plugin serverName")
+				}
+				p.log.Infof("Updated spec.plugins[].parameters.serverName to: %s", newServerName)
+
+				// Update the in-tree object store serverName to the new unique value
+				if err := p.updateBarmanObjectStoreServerName(itemContent, newServerName); err != nil {
+					return nil, errors.Wrap(err, "failed to update barmanObjectStore serverName")
+				}
+
+				// Remember the serverName being left behind for restores of later generations
+				earlierServerNames, err = p.recordServerNameLineage(itemContent, serverName)
+				if err != nil {
+					return nil, errors.Wrap(err, "failed to record serverName lineage")
+				}
+			case MutationStepExternalClusters:
+				switch config.RestoreMode {
+				case RestoreModePgBaseBackup, RestoreModeImport, RestoreModeStandby:
+					// Configure external cluster for the running source
+					if err := p.configureSourceCluster(itemContent, config.SourceCluster); err != nil {
+						return nil, errors.Wrap(err, "failed to configure source cluster")
+					}
+					p.log.Info("Configured externalClusters with running source cluster")
+				default:
+					if err := p.configureRecoverySource(itemContent, method, serverName, barmanObjectName); err != nil {
+						return nil, err
+					}
+				}
+			case MutationStepBootstrap:
+				switch config.RestoreMode {
+				case RestoreModePgBaseBackup:
+					// Update bootstrap to clone the source with pg_basebackup
+					if err := p.configureBootstrapPgBaseBackup(itemContent); err != nil {
+						return nil, errors.Wrap(err, "failed to configure bootstrap pg_basebackup")
+					}
+					p.log.Info("Configured bootstrap.pg_basebackup to clone the source cluster")
+				case RestoreModeStandby:
+					// Clone the source with pg_basebackup and keep streaming from it
+					if err := p.configureBootstrapPgBaseBackup(itemContent); err != nil {
+						return nil, errors.Wrap(err, "failed to configure bootstrap pg_basebackup")
+					}
+					if err := p.configureStandby(itemContent); err != nil {
+						return nil, errors.Wrap(err, "failed to configure standby")
+					}
+				case RestoreModeImport:
+					// Update bootstrap to run initdb with a logical import of the source
+					if err := p.configureBootstrapImport(itemContent, config.Import); err != nil {
+						return nil, errors.Wrap(err, "failed to configure bootstrap import")
+					}
+					p.log.Info("Configured bootstrap.initdb.import to import from the source cluster")
+				default:
+					if err := p.configureRecoveryBootstrap(itemContent, method, backupID, snapshots); err != nil {
+						return nil, err
+					}
+					if method == BackupMethodVolumeSnapshot {
+						backupNamespace := namespace
+						if input.ItemFromBackup != nil {
+							backupNamespace = (&unstructured.Unstructured{Object: input.ItemFromBackup.UnstructuredContent()}).GetNamespace()
+						}
+						snapshotItems = volumeSnapshotItems(recordedSnapshots, snapshots, backupNamespace)
+					}
+				}
+			}
+		}
+
+		if config.RestoreMode == RestoreModeRecovery {
+			// Carry the backed-up plugin parameters that apply to reading WAL over to the recovery source
+			if err := p.copyRecoveryParameters(itemContent, config.RecoveryParameters); err != nil {
+				return nil, errors.Wrap(err, "failed to copy recovery parameters")
+			}
+			// Pass provider settings of the destination's ObjectStore on to the recovery source
+			if err := p.applyProviderParameters(itemContent, config.ProviderParameters); err != nil {
+				return nil, errors.Wrap(err, "failed to apply provider parameters")
+			}
+			// Stop recovery at the restore point created with the Velero backup
+			if config.RecoverToRestorePoint {
+				if err := p.configureRestorePointTarget(itemContent, warnings); err != nil {
+					return nil, errors.Wrap(err, "failed to configure restore point target")
+				}
+			}
+			// A recovery target chosen by the preRestore webhooks overrides the restore point
+			if len(webhookTarget) > 0 {
+				if err := p.applyWebhookRecoveryTarget(itemContent, webhookTarget, warnings); err != nil {
+					return nil, errors.Wrap(err, "failed to apply recovery target from webhooks")
+				}
+			}
+			// Tune WAL replay before the recovery source is copied for earlier serverNames
+			if err := p.tuneWALRestore(itemContent, config.WALRestore, warnings); err != nil {
+				return nil, errors.Wrap(err, "failed to tune WAL restore")
+			}
+			// Keep the WAL of clusters restored before reachable
+			if err := p.configureChainedRecovery(itemContent, earlierServerNames); err != nil {
+				return nil, errors.Wrap(err, "failed to configure chained recovery")
+			}
+		} else if len(webhookTarget) > 0 {
+			warnings.Warnf("Cluster is restored in %s mode, ignoring the recovery target from webhooks", config.RestoreMode)
+		}
+
+		// A live cluster archiving to the same location would have its WAL overwritten.
+		// Drills do not archive.
+		if rehearsing == "" {
+			if err := p.resolveArchiveConflicts(itemContent, input.Restore, namespace, clusterNameStr, config.ArchiveConflictPolicy, config.ServerNameStrategy, warnings); err != nil {
+				return nil, err
+			}
+		}
+
+		// Keep the restored cluster following the backed-up cluster's WAL archive
+		if config.Replica != nil && config.Replica.Enabled {
+			if err := p.configureReplica(itemContent, config.Replica); err != nil {
+				return nil, errors.Wrap(err, "failed to configure replica mode")
+			}
+		}
+
+		// Leave starting recovery to the operator after reviewing the provisioned cluster
+		if config.ProvisionOnly {
+			if err := p.hibernate(itemContent); err != nil {
+				return nil, errors.Wrap(err, "failed to hibernate cluster")
+			}
+			warnings.Warnf("Cluster provisioned hibernated, remove the %s annotation to start recovery", AnnotationHibernation)
+		}
+	}
+
+	// Point externalClusters at the credentials the destination namespace holds
+	var secretNames map[string]string
+	if config.DisasterRecovery != nil {
+		secretNames = config.DisasterRecovery.SecretNames
+	}
+	if err := p.rewriteExternalClusterSecrets(itemContent, input.Restore, secretNames, warnings); err != nil {
+		return nil, errors.Wrap(err, "failed to rewrite externalClusters secrets")
+	}
+
+	// Record the serverName the restored cluster archives to, which may be new
+	if err := appendServerNameHistory(itemContent, time.Now()); err != nil {
+		warnings.Warnf("Failed to record serverName history: %v", err)
+	}
+
+	// Clusters of a coordinated namespace wait for each other before resuming backups
+	gated := config.CoordinateNamespace && live == nil && !isHibernated(itemContent)
+
+	// Dependent resources are left out of cluster-only restores, to be re-synced afterwards
+	dependents := !clusterOnly(input.Restore, config)
+
+	// Keep recovered clusters under ongoing backups
+	if config.ScheduledBackupTemplate != nil && live == nil && dependents && rehearsing == "" {
+		if err := p.ensureScheduledBackup(itemContent, input.Restore, config.ScheduledBackupTemplate, namespace, clusterNameStr, method, gated, warnings); err != nil {
+			warnings.Warnf("Failed to create ScheduledBackup: %v", err)
+		}
 	}
 
-	// Generate new serverName for the restored cluster
-	newServerName := p.generateNewServerName(clusterNameStr)
-	p.log.Infof("Generated new serverName for restored cluster: %s (original: %s)", newServerName, serverName)
+	// Relax scheduling constraints that the destination cluster may not satisfy
+	before := schedulingSnapshot(itemContent)
+	if err := p.relaxScheduling(itemContent, config.Scheduling); err != nil {
+		return nil, errors.Wrap(err, "failed to relax scheduling constraints")
+	}
+	if relaxed := changedSchedulingFields(before, schedulingSnapshot(itemContent)); len(relaxed) > 0 {
+		warnings.Warnf("Relaxed scheduling settings: %s", strings.Join(relaxed, ", "))
+	}
 
-	// Create or update ConfigMap with serverName information
-	namespace := metadataMap["namespace"].(string)
-	if err := p.createOrUpdateConfigMap(namespace, newServerName, serverName); err != nil {
-		return nil, errors.Wrap(err, "failed to create/update ConfigMap")
+	// Resize the cluster according to the selected resource profile
+	if err := p.applyResourceProfile(itemContent, config); err != nil {
+		return nil, errors.Wrap(err, "failed to apply resource profile")
 	}
 
-	p.removeEphemeralFields(itemContent)
+	// Warn before the instances get stuck on the namespace's quotas, sized as restored
+	if config.CheckQuotas && live == nil {
+		p.checkQuotas(itemContent, namespace, warnings)
+	}
 
-	// Update the plugin serverName to the new unique value
-	if err := p.updatePluginServerName(itemContent, newServerName); err != nil {
-		return nil, errors.Wrap(err, "failed to update plugin serverName")
+	// Let the GitOps controller of the namespace adopt the restored cluster
+	if err := p.applyGitOps(itemContent, config.GitOps); err != nil {
+		return nil, errors.Wrap(err, "failed to apply GitOps metadata")
 	}
-	p.log.Infof("Updated spec.plugins[].parameters.serverName to: %s", newServerName)
 
-	// Configure external cluster for backup source
-	if err := p.configureExternalCluster(itemContent, serverName, barmanObjectName); err != nil {
-		return nil, errors.Wrap(err, "failed to configure external cluster")
+	// Fail early when the cluster depends on a CNPG-I plugin the destination cannot serve
+	if !config.SkipPluginCheck {
+		if err := p.checkBarmanCloudPlugin(itemContent, warnings); err != nil {
+			return nil, err
+		}
 	}
-	p.log.Info("Configured externalClusters with backup source")
 
-	// Update bootstrap to use recovery with optional backup ID
-	if err := p.configureBootstrapRecovery(itemContent, backupID); err != nil {
-		return nil, errors.Wrap(err, "failed to configure bootstrap recovery")
+	// A cluster outside the operator's watch scope would never be reconciled
+	if err := p.checkWatchScope(namespace, config.WatchScopePolicy, config.operatorSelector(), warnings); err != nil {
+		return nil, err
+	}
+
+	// Flag plugin parameters written for another version of the barman-cloud plugin
+	p.comparePluginVersion(itemContent, warnings)
+
+	// Flag a destination operator that would bootstrap or run the cluster differently
+	p.compareOperatorConfig(itemContent, config.operatorSelector(), warnings)
+
+	// Velero applies the restore's resource modifiers after this action, over its changes
+	p.checkResourceModifiers(input.Restore, itemContent, backedUp, config.YieldToResourceModifiers, warnings)
+
+	// Keep the drill from archiving WAL and label what the operator creates for it
+	if rehearsing != "" {
+		if err := rehearseCluster(itemContent, input.Restore); err != nil {
+			return nil, errors.Wrap(err, "failed to prepare rehearsal")
+		}
+	}
+
+	// Catch malformed mutations before the API server rejects them at apply time
+	if !config.SkipSchemaValidation {
+		if err := p.validateClusterSchema(itemContent); err != nil {
+			return nil, err
+		}
+	}
+
+	outcome := ResultProcessed
+	if live != nil {
+		outcome = ResultUpdatedInPlace
+	}
+	p.annotateResult(itemContent, result, outcome)
+
+	// Tell external systems what the restore did with the cluster
+	if _, err := callWebhooks(config.Webhooks, newWebhookEvent(WebhookEventPostRestore, operation, itemContent), p.getKubeClient, warnings.Warnf); err != nil {
+		return nil, err
 	}
-	p.log.Info("Configured bootstrap.recovery to restore from backup")
 
 	// Update the item with modified content
 	input.Item.SetUnstructuredContent(itemContent)
-	p.log.Info("Successfully configured cluster for recovery from backup")
+	p.log.Info("Successfully configured cluster for restore")
 
 	out := velero.NewRestoreItemActionExecuteOutput(input.Item)
+
+	// Hold the cluster back until CNPG can provision its volumes from the snapshots
+	if len(snapshotItems) > 0 {
+		out.AdditionalItems = snapshotItems
+		out.WaitForAdditionalItems = true
+	}
+
+	var operationIDs []string
+
+	// Report the recovery of the restored cluster until it is healthy
+	if config.TrackRecovery && live == nil {
+		if op := newRecoveryOperation(itemContent, config.RestoreMode, namespace, clusterNameStr); op != nil {
+			operationIDs = append(operationIDs, encodeRecoveryOperationID(op))
+		}
+	}
+
+	// Check the Poolers recorded at backup time once the restore has created them
+	if config.ValidatePoolers && dependents {
+		poolers, err := p.expectedPoolers(itemContent)
+		if err != nil {
+			return nil, err
+		}
+		if len(poolers) > 0 {
+			operationIDs = append(operationIDs, encodePoolerOperationID(namespace, clusterNameStr, poolers))
+		}
+	}
+
+	// Give the new serverName a base backup once the restored cluster is healthy
+	if config.SeedBackup && live == nil && rehearsing == "" {
+		if op := newSeedBackupOperation(itemContent, namespace, clusterNameStr, method, time.Now()); op != nil {
+			operationIDs = append(operationIDs, encodeSeedBackupOperationID(op))
+		} else {
+			warnings.Warnf("Cluster is restored hibernated or as a replica cluster, no seed backup is taken")
+		}
+	}
+
+	// Send the summary of the restore once its clusters are healthy
+	if config.Notification != nil && live == nil {
+		deadline := time.Now().Add(config.Notification.waitTimeout())
+		operationIDs = append(operationIDs, encodeNotificationOperationID(&notificationOperation{deadline: deadline}))
+	}
+
+	// Resume the cluster's held ScheduledBackups once every restored cluster in the namespace is healthy
+	if gated {
+		operationIDs = append(operationIDs, encodeGateOperationID(&gateOperation{namespace: namespace, kind: gateKindCluster, name: clusterNameStr}))
+	}
+
+	out.OperationID = withStarted(joinOperationIDs(operationIDs), time.Now())
+
+	if rehearsing != "" {
+		return p.createRehearsal(out)
+	}
 	return out, nil
 }
 
+// Progress reports the recovery of the restored cluster, the validation of its Poolers,
+// its seed backup, the namespace gate and the restore notification, failing them once the
+// restore's itemOperationTimeout has passed
 func (p *RestorePluginV2) Progress(operationID string, restore *v1.Restore) (velero.OperationProgress, error) {
-	progress := velero.OperationProgress{}
-	return progress, nil
+	operationIDs, started, err := splitStarted(operationID)
+	if err != nil {
+		return velero.OperationProgress{}, err
+	}
+
+	var progresses []velero.OperationProgress
+	for _, id := range strings.Split(operationIDs, operationSeparator) {
+		progress, err := p.operationProgress(id, restore)
+		if err != nil {
+			return progress, err
+		}
+		progresses = append(progresses, progress)
+	}
+	return applyOperationTimeout(combineProgress(progresses), started, restoreOperationTimeout(restore), time.Now()), nil
 }
 
 func (p *RestorePluginV2) Cancel(operationID string, restore *v1.Restore) error {
 	return nil
 }
 
+// AreAdditionalItemsReady reports whether the VolumeSnapshots a cluster recovers from are
+// ready to use
 func (p *RestorePluginV2) AreAdditionalItemsReady(additionalItems []velero.ResourceIdentifier, restore *v1.Restore) (bool, error) {
-	return true, nil
+	return p.volumeSnapshotsReady(additionalItems, restore)
 }
@@ -1,13 +1,19 @@
 package plugin
 
 import (
+	"context"
 	"testing"
+	"time"
 
+	"github.com/nvanthao/velero-plugin-cnpg-restore/pkg/override"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes/fake"
 )
 
 func TestGetAnnotation(t *testing.T) {
@@ -217,9 +223,7 @@ func TestConfigureExternalCluster(t *testing.T) {
 }
 
 func TestGenerateNewServerName(t *testing.T) {
-	plugin := &RestorePluginV2{
-		log: logrus.New(),
-	}
+	strategy := timestampServerNames{}
 
 	tests := []struct {
 		name        string
@@ -241,16 +245,22 @@ func TestGenerateNewServerName(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			serverName := plugin.generateNewServerName(tt.clusterName)
+			serverName, err := strategy.ServerName(context.Background(), ServerNameRequest{ClusterName: tt.clusterName})
+			require.NoError(t, err)
 
 			// Check that it starts with the cluster name
 			assert.Contains(t, serverName, tt.clusterName)
 
-			// Check that it has a timestamp suffix (format: clusterName-YYYYMMDD-HHMMSS)
-			assert.Regexp(t, `^`+tt.clusterName+`-\d{8}-\d{6}$`, serverName)
+			// Check that it has a timestamp and random suffix (format: clusterName-YYYYMMDD-HHMMSS-xxxxx)
+			assert.Regexp(t, `^`+tt.clusterName+`-\d{8}-\d{6}-[a-z0-9]{5}$`, serverName)
 
-			// Generate another one and ensure they're different (different timestamps)
-			// Note: In rare cases this could fail if both are generated in the same second
+			// Names generated within the same second still differ
+			seen := map[string]bool{serverName: true}
+			for i := 0; i < 20; i++ {
+				next, _ := strategy.ServerName(context.Background(), ServerNameRequest{ClusterName: tt.clusterName})
+				assert.False(t, seen[next], "duplicate serverName %s", next)
+				seen[next] = true
+			}
 		})
 	}
 }
@@ -421,6 +431,56 @@ func TestUpdatePluginServerName(t *testing.T) {
 	}
 }
 
+func TestUpdatePluginBarmanObjectName(t *testing.T) {
+	plugin := &RestorePluginV2{
+		log: logrus.New(),
+	}
+
+	itemContent := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"plugins": []interface{}{
+				map[string]interface{}{
+					"name": "barman-cloud.cloudnative-pg.io",
+					"parameters": map[string]interface{}{
+						"serverName":       "server-1",
+						"barmanObjectName": "prod-store",
+					},
+				},
+				map[string]interface{}{
+					"name": "other-plugin",
+					"parameters": map[string]interface{}{
+						"barmanObjectName": "other-store",
+					},
+				},
+			},
+		},
+	}
+
+	err := plugin.updatePluginBarmanObjectName(itemContent, map[string]string{"prod-store": "dr-store"})
+	require.NoError(t, err)
+
+	plugins := itemContent["spec"].(map[string]interface{})["plugins"].([]interface{})
+	assert.Equal(t, "dr-store", plugins[0].(map[string]interface{})["parameters"].(map[string]interface{})["barmanObjectName"])
+	assert.Equal(t, "other-store", plugins[1].(map[string]interface{})["parameters"].(map[string]interface{})["barmanObjectName"])
+
+	// Clusters without plugins are left unchanged
+	require.NoError(t, plugin.updatePluginBarmanObjectName(map[string]interface{}{"spec": map[string]interface{}{}}, map[string]string{"prod-store": "dr-store"}))
+}
+
+func TestNamedRestorePluginV2(t *testing.T) {
+	plugin := NewNamedRestorePluginV2(logrus.New(), RestorePluginInstanceName("gold"))
+	assert.Equal(t, "replicated.com/cnpg-restore-plugin-gold", plugin.actionName())
+	assert.Equal(t, RestorePluginName, NewRestorePluginV2(logrus.New()).actionName())
+
+	plugin.config = &PluginConfig{RestoreMode: RestoreModeRecovery, LabelSelector: "tier=gold", IncludedNamespaces: []string{"gold-*"}}
+	selector, err := plugin.AppliesTo()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"clusters.postgresql.cnpg.io"}, selector.IncludedResources)
+	assert.Equal(t, "tier=gold", selector.LabelSelector)
+	assert.Equal(t, []string{"gold-*"}, selector.IncludedNamespaces)
+	assert.Empty(t, selector.ExcludedNamespaces)
+}
+
 func TestConfigureBootstrapRecovery(t *testing.T) {
 	plugin := &RestorePluginV2{
 		log: logrus.New(),
@@ -526,11 +586,219 @@ func TestConfigureBootstrapRecovery(t *testing.T) {
 	}
 }
 
-func TestRestoreExecute(t *testing.T) {
+func TestConfigureSourceCluster(t *testing.T) {
 	plugin := &RestorePluginV2{
 		log: logrus.New(),
 	}
 
+	tests := []struct {
+		name          string
+		itemContent   map[string]interface{}
+		source        *SourceClusterConfig
+		expectedError bool
+		validateFn    func(t *testing.T, itemContent map[string]interface{})
+	}{
+		{
+			name: "connection parameters and password secret",
+			itemContent: map[string]interface{}{
+				"spec": map[string]interface{}{
+					"instances": 1,
+				},
+			},
+			source: &SourceClusterConfig{
+				ConnectionParameters: map[string]string{
+					"host":   "prod-rw.prod.svc",
+					"user":   "streaming_replica",
+					"dbname": "postgres",
+				},
+				Password: &SecretKeySelector{Name: "prod-replication", Key: "password"},
+			},
+			validateFn: func(t *testing.T, itemContent map[string]interface{}) {
+				spec := itemContent["spec"].(map[string]interface{})
+				externalClusters := spec["externalClusters"].([]interface{})
+				require.Len(t, externalClusters, 1)
+
+				cluster := externalClusters[0].(map[string]interface{})
+				assert.Equal(t, "clusterSource", cluster["name"])
+
+				params := cluster["connectionParameters"].(map[string]interface{})
+				assert.Equal(t, "prod-rw.prod.svc", params["host"])
+				assert.Equal(t, "streaming_replica", params["user"])
+
+				password := cluster["password"].(map[string]interface{})
+				assert.Equal(t, "prod-replication", password["name"])
+				assert.Equal(t, "password", password["key"])
+
+				_, hasSSLKey := cluster["sslKey"]
+				assert.False(t, hasSSLKey)
+				_, hasPlugin := cluster["plugin"]
+				assert.False(t, hasPlugin)
+			},
+		},
+		{
+			name: "missing source configuration",
+			itemContent: map[string]interface{}{
+				"spec": map[string]interface{}{},
+			},
+			expectedError: true,
+		},
+		{
+			name:          "no spec field",
+			itemContent:   map[string]interface{}{},
+			source:        &SourceClusterConfig{},
+			expectedError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := plugin.configureSourceCluster(tt.itemContent, tt.source)
+
+			if tt.expectedError {
+				assert.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				if tt.validateFn != nil {
+					tt.validateFn(t, tt.itemContent)
+				}
+			}
+		})
+	}
+}
+
+func TestConfigureBootstrapPgBaseBackup(t *testing.T) {
+	plugin := &RestorePluginV2{
+		log: logrus.New(),
+	}
+
+	itemContent := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"bootstrap": map[string]interface{}{
+				"initdb": map[string]interface{}{
+					"database": "app",
+				},
+			},
+		},
+	}
+
+	require.NoError(t, plugin.configureBootstrapPgBaseBackup(itemContent))
+
+	bootstrap := itemContent["spec"].(map[string]interface{})["bootstrap"].(map[string]interface{})
+	_, hasInitDB := bootstrap["initdb"]
+	assert.False(t, hasInitDB, "initdb should be replaced")
+
+	pgBaseBackup := bootstrap["pg_basebackup"].(map[string]interface{})
+	assert.Equal(t, "clusterSource", pgBaseBackup["source"])
+
+	assert.Error(t, plugin.configureBootstrapPgBaseBackup(map[string]interface{}{}))
+}
+
+func TestConfigureBootstrapImport(t *testing.T) {
+	plugin := &RestorePluginV2{
+		log: logrus.New(),
+	}
+
+	tests := []struct {
+		name          string
+		itemContent   map[string]interface{}
+		importConfig  *ImportConfig
+		expectedError bool
+		validateFn    func(t *testing.T, initdb map[string]interface{})
+	}{
+		{
+			name: "microservice import defaults to the application database",
+			itemContent: map[string]interface{}{
+				"spec": map[string]interface{}{
+					"bootstrap": map[string]interface{}{
+						"initdb": map[string]interface{}{
+							"database": "chef",
+							"owner":    "chef",
+						},
+					},
+				},
+			},
+			validateFn: func(t *testing.T, initdb map[string]interface{}) {
+				assert.Equal(t, "chef", initdb["database"])
+				assert.Equal(t, "chef", initdb["owner"])
+
+				importSpec := initdb["import"].(map[string]interface{})
+				assert.Equal(t, ImportTypeMicroservice, importSpec["type"])
+				assert.Equal(t, []interface{}{"chef"}, importSpec["databases"])
+				source := importSpec["source"].(map[string]interface{})
+				assert.Equal(t, "clusterSource", source["externalCluster"])
+				_, hasRoles := importSpec["roles"]
+				assert.False(t, hasRoles)
+			},
+		},
+		{
+			name: "monolith import replaces recovery bootstrap",
+			itemContent: map[string]interface{}{
+				"spec": map[string]interface{}{
+					"bootstrap": map[string]interface{}{
+						"recovery": map[string]interface{}{
+							"source": "clusterBackup",
+						},
+					},
+				},
+			},
+			importConfig: &ImportConfig{
+				Type:       ImportTypeMonolith,
+				Databases:  []string{"app", "reporting"},
+				Roles:      []string{"reader"},
+				SchemaOnly: true,
+			},
+			validateFn: func(t *testing.T, initdb map[string]interface{}) {
+				importSpec := initdb["import"].(map[string]interface{})
+				assert.Equal(t, ImportTypeMonolith, importSpec["type"])
+				assert.Equal(t, []interface{}{"app", "reporting"}, importSpec["databases"])
+				assert.Equal(t, []interface{}{"reader"}, importSpec["roles"])
+				assert.Equal(t, true, importSpec["schemaOnly"])
+			},
+		},
+		{
+			name: "no existing bootstrap",
+			itemContent: map[string]interface{}{
+				"spec": map[string]interface{}{},
+			},
+			validateFn: func(t *testing.T, initdb map[string]interface{}) {
+				importSpec := initdb["import"].(map[string]interface{})
+				assert.Equal(t, []interface{}{"app"}, importSpec["databases"])
+			},
+		},
+		{
+			name:          "no spec field",
+			itemContent:   map[string]interface{}{},
+			expectedError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := plugin.configureBootstrapImport(tt.itemContent, tt.importConfig)
+
+			if tt.expectedError {
+				assert.Error(t, err)
+			} else {
+				require.NoError(t, err)
+
+				bootstrap := tt.itemContent["spec"].(map[string]interface{})["bootstrap"].(map[string]interface{})
+				_, hasRecovery := bootstrap["recovery"]
+				assert.False(t, hasRecovery, "recovery should be replaced")
+
+				if tt.validateFn != nil {
+					tt.validateFn(t, bootstrap["initdb"].(map[string]interface{}))
+				}
+			}
+		})
+	}
+}
+
+func TestRestoreExecute(t *testing.T) {
+	plugin := &RestorePluginV2{
+		log:    logrus.New(),
+		config: DefaultPluginConfig(),
+	}
+
 	tests := []struct {
 		name          string
 		itemContent   map[string]interface{}
@@ -543,12 +811,17 @@ func TestRestoreExecute(t *testing.T) {
 				"apiVersion": "postgresql.cnpg.io/v1",
 				"kind":       "Cluster",
 				"metadata": map[string]interface{}{
-					"name":      "test-cluster",
-					"namespace": "default",
+					"name":            "test-cluster",
+					"namespace":       "default",
+					"uid":             "abc-123",
+					"resourceVersion": "12345",
 				},
 				"spec": map[string]interface{}{
 					"instances": 1,
 				},
+				"status": map[string]interface{}{
+					"phase": "Cluster in healthy state",
+				},
 			},
 			expectedError: false,
 			validateFn: func(t *testing.T, output *velero.RestoreItemActionExecuteOutput) {
@@ -558,6 +831,13 @@ func TestRestoreExecute(t *testing.T) {
 				spec := itemContent["spec"].(map[string]interface{})
 				_, hasExternalClusters := spec["externalClusters"]
 				assert.False(t, hasExternalClusters)
+
+				// Stale status and server-assigned metadata are still removed
+				_, hasStatus := itemContent["status"]
+				assert.False(t, hasStatus)
+				metadata := itemContent["metadata"].(map[string]interface{})
+				assert.NotContains(t, metadata, "uid")
+				assert.NotContains(t, metadata, "resourceVersion")
 			},
 		},
 		{
@@ -578,6 +858,42 @@ func TestRestoreExecute(t *testing.T) {
 			},
 			expectedError: true,
 		},
+		{
+			name: "volumeSnapshot method without snapshots annotation - error",
+			itemContent: map[string]interface{}{
+				"apiVersion": "postgresql.cnpg.io/v1",
+				"kind":       "Cluster",
+				"metadata": map[string]interface{}{
+					"name":      "test-cluster",
+					"namespace": "default",
+					"annotations": map[string]interface{}{
+						"velero-cnpg/backup-method": "volumeSnapshot",
+					},
+				},
+				"spec": map[string]interface{}{
+					"instances": 1,
+				},
+			},
+			expectedError: true,
+		},
+		{
+			name: "unknown backup method - error",
+			itemContent: map[string]interface{}{
+				"apiVersion": "postgresql.cnpg.io/v1",
+				"kind":       "Cluster",
+				"metadata": map[string]interface{}{
+					"name":      "test-cluster",
+					"namespace": "default",
+					"annotations": map[string]interface{}{
+						"velero-cnpg/backup-method": "tape",
+					},
+				},
+				"spec": map[string]interface{}{
+					"instances": 1,
+				},
+			},
+			expectedError: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -604,3 +920,191 @@ func TestRestoreExecute(t *testing.T) {
 		})
 	}
 }
+
+func TestRestoreExecutePassThroughUnmanagedClusters(t *testing.T) {
+	plugin := &RestorePluginV2{
+		log:    logrus.New(),
+		config: &PluginConfig{RestoreMode: RestoreModeRecovery, PassThroughUnmanagedClusters: true},
+	}
+
+	item := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "postgresql.cnpg.io/v1",
+		"kind":       "Cluster",
+		"metadata": map[string]interface{}{
+			"name":      "test-cluster",
+			"namespace": "default",
+			"uid":       "abc-123",
+		},
+		"spec":   map[string]interface{}{"instances": int64(1)},
+		"status": map[string]interface{}{"phase": "Cluster in healthy state"},
+	}}
+
+	output, err := plugin.Execute(&velero.RestoreItemActionExecuteInput{Item: item})
+	require.NoError(t, err)
+
+	itemContent := output.UpdatedItem.UnstructuredContent()
+	assert.Contains(t, itemContent, "status")
+	assert.Equal(t, "abc-123", itemContent["metadata"].(map[string]interface{})["uid"])
+}
+
+func TestRestoreExecuteMutationSteps(t *testing.T) {
+	tests := []struct {
+		name       string
+		steps      []string
+		validateFn func(t *testing.T, cluster *unstructured.Unstructured, client *fake.Clientset)
+	}{
+		{
+			name: "default steps",
+			validateFn: func(t *testing.T, cluster *unstructured.Unstructured, client *fake.Clientset) {
+				assert.NotContains(t, cluster.Object, "status")
+				serverName, _ := walArchiverParameter(cluster.Object["spec"].(map[string]interface{})["plugins"].([]interface{}), "serverName")
+				assert.NotEqual(t, "pg", serverName)
+				source, _, _ := unstructured.NestedString(cluster.Object, "spec", "bootstrap", "recovery", "source")
+				assert.Equal(t, recoverySourceName, source)
+
+				configMap, err := client.CoreV1().ConfigMaps("default").Get(context.Background(), OverrideConfigMapName, metav1.GetOptions{})
+				require.NoError(t, err)
+				assert.Equal(t, serverName, configMap.Data["pg.write_to_server_name"])
+				assert.Equal(t, "true", configMap.Labels[LabelOverrideConfigMap])
+			},
+		},
+		{
+			name:  "recovery only",
+			steps: []string{MutationStepBootstrap, MutationStepExternalClusters},
+			validateFn: func(t *testing.T, cluster *unstructured.Unstructured, client *fake.Clientset) {
+				assert.Contains(t, cluster.Object, "status")
+				serverName, _ := walArchiverParameter(cluster.Object["spec"].(map[string]interface{})["plugins"].([]interface{}), "serverName")
+				assert.Equal(t, "pg", serverName)
+				source, _, _ := unstructured.NestedString(cluster.Object, "spec", "bootstrap", "recovery", "source")
+				assert.Equal(t, recoverySourceName, source)
+				externalClusters, _, _ := unstructured.NestedSlice(cluster.Object, "spec", "externalClusters")
+				assert.Len(t, externalClusters, 1)
+
+				_, err := client.CoreV1().ConfigMaps("default").Get(context.Background(), OverrideConfigMapName, metav1.GetOptions{})
+				assert.True(t, apierrors.IsNotFound(err))
+			},
+		},
+		{
+			name:  "override ConfigMap without rotation",
+			steps: []string{MutationStepOverrideConfigMap},
+			validateFn: func(t *testing.T, cluster *unstructured.Unstructured, client *fake.Clientset) {
+				assert.NotContains(t, cluster.Object["spec"], "bootstrap")
+				assert.NotContains(t, cluster.Object["spec"], "externalClusters")
+
+				configMap, err := client.CoreV1().ConfigMaps("default").Get(context.Background(), OverrideConfigMapName, metav1.GetOptions{})
+				require.NoError(t, err)
+				assert.Equal(t, "pg", configMap.Data["pg.write_to_server_name"])
+			},
+		},
+		{
+			name:  "no steps",
+			steps: []string{},
+			validateFn: func(t *testing.T, cluster *unstructured.Unstructured, client *fake.Clientset) {
+				assert.Contains(t, cluster.Object, "status")
+				assert.NotContains(t, cluster.Object["spec"], "bootstrap")
+				assert.NotContains(t, cluster.Object["spec"], "externalClusters")
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := createMockPluginCluster("pg", "default")
+			cluster.SetAnnotations(map[string]string{
+				AnnotationServerName:      "pg",
+				AnnotationBackupMethod:    BackupMethodPlugin,
+				AnnotationCurrentBackupID: "20241024T120000",
+			})
+			cluster.Object["status"] = map[string]interface{}{"phase": clusterPhaseHealthy}
+
+			config := DefaultPluginConfig()
+			config.MutationSteps = tt.steps
+			config.SkipPluginCheck = true
+			client := newFakeKubeClient()
+			plugin := &RestorePluginV2{log: logrus.New(), config: config, dynamicClient: newFakeDynamicClient(), kubeClient: client}
+
+			output, err := plugin.Execute(&velero.RestoreItemActionExecuteInput{Item: cluster})
+			require.NoError(t, err)
+
+			tt.validateFn(t, &unstructured.Unstructured{Object: output.UpdatedItem.UnstructuredContent()}, client)
+		})
+	}
+}
+
+func TestCreateOrUpdateConfigMapConflictPolicy(t *testing.T) {
+	tests := []struct {
+		policy               string
+		expectedError        string
+		expectedPromoteAfter string
+	}{
+		{policy: ""},
+		{policy: OverrideConflictOverwrite},
+		{policy: OverrideConflictMerge, expectedPromoteAfter: "1h0m0s"},
+		{policy: OverrideConflictFail, expectedError: `already holds the keys of cluster pg from an earlier restore, pg.write_to_server_name is "pg-first"`},
+	}
+
+	for _, tt := range tests {
+		t.Run("policy "+tt.policy, func(t *testing.T) {
+			client := fake.NewClientset()
+			plugin := &RestorePluginV2{log: logrus.New(), kubeClient: client}
+
+			// An earlier restore of the cluster, as a replica cluster, and of another cluster
+			require.NoError(t, plugin.createOrUpdateConfigMap("default", "pg", &override.Override{WriteToServerName: "pg-first", ReadFromServerName: "pg", PromoteAfter: time.Hour}, nil, ""))
+			require.NoError(t, plugin.createOrUpdateConfigMap("default", "other", &override.Override{WriteToServerName: "other-first", ReadFromServerName: "other"}, nil, ""))
+
+			err := plugin.createOrUpdateConfigMap("default", "pg", &override.Override{WriteToServerName: "pg-second", ReadFromServerName: "pg"}, nil, tt.policy)
+			configMap, getErr := client.CoreV1().ConfigMaps("default").Get(context.Background(), OverrideConfigMapName, metav1.GetOptions{})
+			require.NoError(t, getErr)
+			if tt.expectedError != "" {
+				assert.ErrorContains(t, err, tt.expectedError)
+				assert.Equal(t, "pg-first", configMap.Data["pg.write_to_server_name"])
+				return
+			}
+			require.NoError(t, err)
+
+			assert.Equal(t, "pg-second", configMap.Data["pg.write_to_server_name"])
+			assert.Equal(t, "other-first", configMap.Data["other.write_to_server_name"])
+			assert.Equal(t, tt.expectedPromoteAfter, configMap.Data["pg.promote_after"])
+		})
+	}
+}
+
+func TestCreateOrUpdateConfigMapHistory(t *testing.T) {
+	client := fake.NewClientset()
+	plugin := &RestorePluginV2{log: logrus.New(), kubeClient: client}
+
+	restores := []*override.Override{
+		{WriteToServerName: "pg-first", ReadFromServerName: "pg"},
+		{WriteToServerName: "pg-second", ReadFromServerName: "pg-first"},
+		{WriteToServerName: "pg-third", ReadFromServerName: "pg-second"},
+	}
+	for _, restore := range restores {
+		require.NoError(t, plugin.createOrUpdateConfigMap("default", "pg", restore, nil, ""))
+	}
+
+	configMap, err := client.CoreV1().ConfigMaps("default").Get(context.Background(), OverrideConfigMapName, metav1.GetOptions{})
+	require.NoError(t, err)
+	got, err := override.FromConfigMapForCluster(configMap, "pg")
+	require.NoError(t, err)
+	assert.Equal(t, "pg-third", got.WriteToServerName)
+	require.Len(t, got.History, 2)
+	assert.Equal(t, "pg-first", got.History[0].WriteToServerName)
+	assert.Equal(t, "pg", got.History[0].ReadFromServerName)
+	assert.Equal(t, "pg-second", got.History[1].WriteToServerName)
+	assert.Equal(t, "pg-first", got.History[1].ReadFromServerName)
+	_, err = time.Parse(time.RFC3339, got.History[1].ReplacedAt)
+	assert.NoError(t, err)
+
+	// A history that cannot be parsed is started again
+	configMap.Data["pg.history"] = "not json"
+	_, err = client.CoreV1().ConfigMaps("default").Update(context.Background(), configMap, metav1.UpdateOptions{})
+	require.NoError(t, err)
+	require.NoError(t, plugin.createOrUpdateConfigMap("default", "pg", &override.Override{WriteToServerName: "pg-fourth", ReadFromServerName: "pg-third"}, nil, ""))
+
+	configMap, err = client.CoreV1().ConfigMaps("default").Get(context.Background(), OverrideConfigMapName, metav1.GetOptions{})
+	require.NoError(t, err)
+	got, err = override.FromConfigMapForCluster(configMap, "pg")
+	require.NoError(t, err)
+	require.Len(t, got.History, 1)
+	assert.Equal(t, "pg-third", got.History[0].WriteToServerName)
+}
@@ -0,0 +1,130 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	// AnnotationRestorePoint is the annotation key used to store the name of the PostgreSQL
+	// restore point created on the primary when the cluster was backed up
+	AnnotationRestorePoint = "velero-cnpg/restore-point"
+
+	// AnnotationRestorePointLSN is the annotation key used to store the LSN of that restore point
+	AnnotationRestorePointLSN = "velero-cnpg/restore-point-lsn"
+)
+
+// maxRestorePointName is the longest restore point name PostgreSQL accepts
+const maxRestorePointName = 63
+
+// restorePointCommand returns the psql command creating a restore point. The WAL segment
+// is switched afterwards so the restore point is archived without waiting for more writes.
+func restorePointCommand(name string) []string {
+	quoted := "'" + strings.ReplaceAll(name, "'", "''") + "'"
+	return []string{
+		"psql", "-XAtq", "-v", "ON_ERROR_STOP=1",
+		"-c", fmt.Sprintf("SELECT pg_create_restore_point(%s)", quoted),
+		"-c", "SELECT pg_switch_wal()",
+	}
+}
+
+// createRestorePoint creates a restore point named after the Velero backup on the primary,
+// so a restore can recover to exactly the moment of the backup. Replica and hibernated
+// clusters are skipped, and failures are logged rather than failing the backup.
+func (p *BackupPluginV2) createRestorePoint(itemContent map[string]interface{}, backup *v1.Backup) {
+	if backup == nil {
+		return
+	}
+	name := backup.Name
+	if len(name) > maxRestorePointName {
+		p.log.Warnf("Backup name %s is longer than %d characters, not creating a restore point", name, maxRestorePointName)
+		return
+	}
+	if enabled, _, _ := unstructured.NestedBool(itemContent, "spec", "replica", "enabled"); enabled {
+		p.log.Info("Cluster is a replica cluster, not creating a restore point")
+		return
+	}
+	if isHibernated(itemContent) {
+		p.log.Info("Cluster is hibernated, not creating a restore point")
+		return
+	}
+
+	cluster := &unstructured.Unstructured{Object: itemContent}
+	primary, _, _ := unstructured.NestedString(itemContent, "status", "currentPrimary")
+	if primary == "" {
+		p.log.Warn("Cluster has no primary, not creating a restore point")
+		return
+	}
+
+	podExec, err := p.getPodExec()
+	if err != nil {
+		p.log.Warnf("Failed to create pod exec client, not creating a restore point: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	output, err := podExec(ctx, cluster.GetNamespace(), primary, postgresContainer, restorePointCommand(name))
+	if err != nil {
+		p.log.Warnf("Failed to create restore point %s: %v", name, err)
+		return
+	}
+	lsn, _, _ := strings.Cut(strings.TrimSpace(output), "\n")
+
+	err = p.addAnnotation(itemContent, AnnotationRestorePoint, name)
+	if err == nil && lsn != "" {
+		err = p.addAnnotation(itemContent, AnnotationRestorePointLSN, lsn)
+	}
+	if err != nil {
+		p.log.Warnf("Failed to annotate restore point: %v", err)
+		return
+	}
+	p.log.Infof("Created restore point %s at %s on %s", name, lsn, primary)
+}
+
+// getPodExec returns the podExecFunc used to run commands in instance pods
+func (p *BackupPluginV2) getPodExec() (podExecFunc, error) {
+	if p.podExec != nil {
+		return p.podExec, nil
+	}
+	return getPodExec()
+}
+
+// configureRestorePointTarget stops recovery at the restore point created when the cluster
+// was backed up. Clusters without a restore point, or recovering without a WAL archive to
+// find it in, recover as before with a restore warning.
+func (p *RestorePluginV2) configureRestorePointTarget(itemContent map[string]interface{}, warnings *restoreWarnings) error {
+	name, found, err := p.getAnnotation(itemContent, AnnotationRestorePoint)
+	if err != nil {
+		return err
+	}
+	if !found || name == "" {
+		warnings.Warnf("No %s annotation found, recovering to the end of the WAL archive", AnnotationRestorePoint)
+		return nil
+	}
+
+	recovery, found, err := nestedMapNoCopy(itemContent, "spec", "bootstrap", "recovery")
+	if err != nil {
+		return err
+	}
+	if source, _ := recovery["source"].(string); !found || source == "" {
+		warnings.Warnf("Cluster recovers without a WAL archive, ignoring restore point %s", name)
+		return nil
+	}
+
+	target, err := ensureNestedMapNoCopy(recovery, "recoveryTarget")
+	if err != nil {
+		return errors.Wrap(err, "failed to configure recovery target")
+	}
+	target["targetName"] = name
+
+	p.log.Infof("Configured recovery target with restore point: %s", name)
+	return nil
+}
@@ -0,0 +1,128 @@
+package plugin
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestCreateRestorePoint(t *testing.T) {
+	backup := &v1.Backup{ObjectMeta: metav1.ObjectMeta{Name: "nightly-20240101"}}
+
+	t.Run("creates and annotates the restore point", func(t *testing.T) {
+		cluster := createMockArchivingCluster("pg", "default", "pg", nil)
+		require.NoError(t, unstructured.SetNestedField(cluster.Object, "pg-2", "status", "currentPrimary"))
+
+		var called bool
+		plugin := &BackupPluginV2{log: logrus.New(), podExec: func(_ context.Context, namespace, pod, container string, command []string) (string, error) {
+			called = true
+			assert.Equal(t, "default", namespace)
+			assert.Equal(t, "pg-2", pod)
+			assert.Equal(t, postgresContainer, container)
+			assert.Contains(t, command, "SELECT pg_create_restore_point('nightly-20240101')")
+			assert.Contains(t, command, "SELECT pg_switch_wal()")
+			return "0/5000138\n0/5000150\n", nil
+		}}
+
+		plugin.createRestorePoint(cluster.Object, backup)
+		assert.True(t, called)
+		assert.Equal(t, "nightly-20240101", cluster.GetAnnotations()[AnnotationRestorePoint])
+		assert.Equal(t, "0/5000138", cluster.GetAnnotations()[AnnotationRestorePointLSN])
+	})
+
+	t.Run("skipped clusters", func(t *testing.T) {
+		plugin := &BackupPluginV2{log: logrus.New(), podExec: func(context.Context, string, string, string, []string) (string, error) {
+			t.Fatal("unexpected exec")
+			return "", nil
+		}}
+
+		noPrimary := createMockArchivingCluster("pg", "default", "pg", nil)
+
+		replica := createMockArchivingCluster("pg", "default", "pg", nil)
+		require.NoError(t, unstructured.SetNestedField(replica.Object, "pg-1", "status", "currentPrimary"))
+		require.NoError(t, unstructured.SetNestedField(replica.Object, true, "spec", "replica", "enabled"))
+
+		hibernated := createMockArchivingCluster("pg", "default", "pg", nil)
+		require.NoError(t, unstructured.SetNestedField(hibernated.Object, "pg-1", "status", "currentPrimary"))
+		hibernated.SetAnnotations(map[string]string{AnnotationHibernation: "on"})
+
+		for _, cluster := range []*unstructured.Unstructured{noPrimary, replica, hibernated} {
+			plugin.createRestorePoint(cluster.Object, backup)
+			assert.NotContains(t, cluster.GetAnnotations(), AnnotationRestorePoint)
+		}
+
+		cluster := createMockArchivingCluster("pg", "default", "pg", nil)
+		require.NoError(t, unstructured.SetNestedField(cluster.Object, "pg-1", "status", "currentPrimary"))
+		plugin.createRestorePoint(cluster.Object, &v1.Backup{ObjectMeta: metav1.ObjectMeta{Name: strings.Repeat("b", 64)}})
+		assert.NotContains(t, cluster.GetAnnotations(), AnnotationRestorePoint)
+	})
+
+	t.Run("failed exec", func(t *testing.T) {
+		cluster := createMockArchivingCluster("pg", "default", "pg", nil)
+		require.NoError(t, unstructured.SetNestedField(cluster.Object, "pg-1", "status", "currentPrimary"))
+
+		plugin := &BackupPluginV2{log: logrus.New(), podExec: func(context.Context, string, string, string, []string) (string, error) {
+			return "", errors.New("recovery is in progress")
+		}}
+
+		plugin.createRestorePoint(cluster.Object, backup)
+		assert.NotContains(t, cluster.GetAnnotations(), AnnotationRestorePoint)
+	})
+}
+
+func TestRestorePointCommandQuotesName(t *testing.T) {
+	command := restorePointCommand("it's")
+	assert.Contains(t, command, "SELECT pg_create_restore_point('it''s')")
+}
+
+func TestConfigureRestorePointTarget(t *testing.T) {
+	plugin := &RestorePluginV2{log: logrus.New()}
+
+	t.Run("restore point recorded", func(t *testing.T) {
+		cluster := createMockArchivingCluster("pg", "default", "pg", nil)
+		cluster.SetAnnotations(map[string]string{AnnotationRestorePoint: "nightly-20240101"})
+		require.NoError(t, plugin.configureBootstrapRecovery(cluster.Object, "20240101T000000"))
+
+		warnings := &restoreWarnings{log: logrus.New()}
+		require.NoError(t, plugin.configureRestorePointTarget(cluster.Object, warnings))
+
+		target, _, _ := unstructured.NestedStringMap(cluster.Object, "spec", "bootstrap", "recovery", "recoveryTarget")
+		assert.Equal(t, map[string]string{"backupID": "20240101T000000", "targetName": "nightly-20240101"}, target)
+		assert.Empty(t, warnings.messages)
+	})
+
+	t.Run("no restore point recorded", func(t *testing.T) {
+		cluster := createMockArchivingCluster("pg", "default", "pg", nil)
+		require.NoError(t, plugin.configureBootstrapRecovery(cluster.Object, ""))
+
+		warnings := &restoreWarnings{log: logrus.New()}
+		require.NoError(t, plugin.configureRestorePointTarget(cluster.Object, warnings))
+
+		_, found, _ := unstructured.NestedFieldNoCopy(cluster.Object, "spec", "bootstrap", "recovery", "recoveryTarget")
+		assert.False(t, found)
+		assert.Equal(t, []string{"No velero-cnpg/restore-point annotation found, recovering to the end of the WAL archive"}, warnings.messages)
+	})
+
+	t.Run("no WAL archive", func(t *testing.T) {
+		cluster := createMockArchivingCluster("pg", "default", "pg", nil)
+		cluster.SetAnnotations(map[string]string{AnnotationRestorePoint: "nightly-20240101"})
+		require.NoError(t, unstructured.SetNestedMap(cluster.Object, map[string]interface{}{
+			"recovery": map[string]interface{}{"volumeSnapshots": map[string]interface{}{}},
+		}, "spec", "bootstrap"))
+
+		warnings := &restoreWarnings{log: logrus.New()}
+		require.NoError(t, plugin.configureRestorePointTarget(cluster.Object, warnings))
+
+		_, found, _ := unstructured.NestedFieldNoCopy(cluster.Object, "spec", "bootstrap", "recovery", "recoveryTarget")
+		assert.False(t, found)
+		assert.Equal(t, []string{"Cluster recovers without a WAL archive, ignoring restore point nightly-20240101"}, warnings.messages)
+	})
+}
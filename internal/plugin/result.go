@@ -0,0 +1,153 @@
+package plugin
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AnnotationResult is the annotation key used to record what the backup or restore action
+// did to an item, as a JSON actionResult, so compliance tooling can check that every CNPG
+// cluster of a backup or restore was processed by the plugin
+const AnnotationResult = "velero-cnpg/result"
+
+// Outcomes recorded in the result annotation
+const (
+	// ResultProcessed marks a cluster the action fully processed
+	ResultProcessed = "processed"
+
+	// ResultUpdatedInPlace marks a restored cluster that already existed and was updated
+	// in place without recovery
+	ResultUpdatedInPlace = "updatedInPlace"
+
+	// ResultSkipped marks a cluster the action saw but did not configure for recovery,
+	// since it has no backup method
+	ResultSkipped = "skipped"
+)
+
+// actionResult is the content of the result annotation
+type actionResult struct {
+	// Action is the action that processed the item, backup or restore
+	Action string `json:"action"`
+
+	// Operation is the name of the Velero backup or restore
+	Operation string `json:"operation"`
+
+	// Outcome is what the action did with the item
+	Outcome string `json:"outcome"`
+
+	// Changed lists the fields the action changed, as JSON pointers
+	Changed []string `json:"changed,omitempty"`
+
+	// DurationMs is how long the action took on the item, in milliseconds
+	DurationMs int64 `json:"durationMs"`
+}
+
+// resultRecorder remembers an item as the action received it, to record the result of
+// the action once it is done with the item
+type resultRecorder struct {
+	action    string
+	operation string
+	before    map[string]string
+	started   time.Time
+}
+
+// newResultRecorder starts recording the result of action on the item of the named
+// Velero backup or restore
+func newResultRecorder(action, operation string, itemContent map[string]interface{}, now time.Time) *resultRecorder {
+	return &resultRecorder{
+		action:    action,
+		operation: operation,
+		before:    resultFields(itemContent),
+		started:   now,
+	}
+}
+
+// annotate records the result annotation on the item. It runs after every other change
+// to the item, so the changes are complete.
+func (r *resultRecorder) annotate(itemContent map[string]interface{}, outcome string, now time.Time) error {
+	after := resultFields(itemContent)
+	var changed []string
+	for field, value := range after {
+		if before, found := r.before[field]; !found || before != value {
+			changed = append(changed, field)
+		}
+	}
+	for field := range r.before {
+		if _, found := after[field]; !found {
+			changed = append(changed, field)
+		}
+	}
+	sort.Strings(changed)
+
+	raw, err := json.Marshal(&actionResult{
+		Action:     r.action,
+		Operation:  r.operation,
+		Outcome:    outcome,
+		Changed:    changed,
+		DurationMs: now.Sub(r.started).Milliseconds(),
+	})
+	if err != nil {
+		return err
+	}
+	return setAnnotation(itemContent, AnnotationResult, string(raw))
+}
+
+// resultFields returns the fields of an item the result annotation reports changes to,
+// as JSON encodings keyed by JSON pointer: each annotation and label, each other field
+// of metadata and spec, and each other top-level field. The result annotation itself is
+// left out.
+func resultFields(itemContent map[string]interface{}) map[string]string {
+	fields := map[string]string{}
+	add := func(pointer string, value interface{}) {
+		raw, err := json.Marshal(value)
+		if err != nil {
+			raw = []byte(err.Error())
+		}
+		fields[pointer] = string(raw)
+	}
+
+	for field, value := range itemContent {
+		nested, ok := value.(map[string]interface{})
+		if !ok || (field != "metadata" && field != "spec") {
+			add("/"+escapePointer(field), value)
+			continue
+		}
+		for key, value := range nested {
+			values, ok := value.(map[string]interface{})
+			if !ok || field != "metadata" || (key != "annotations" && key != "labels") {
+				add("/"+field+"/"+escapePointer(key), value)
+				continue
+			}
+			for name, value := range values {
+				if key == "annotations" && name == AnnotationResult {
+					continue
+				}
+				add("/metadata/"+key+"/"+escapePointer(name), value)
+			}
+		}
+	}
+	return fields
+}
+
+// escapePointer escapes a key for use as a JSON pointer token
+func escapePointer(key string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
+
+// annotateResult records the result of the backup action on the cluster. Failing to
+// record it is logged rather than failing the backup.
+func (p *BackupPluginV2) annotateResult(itemContent map[string]interface{}, result *resultRecorder, outcome string) {
+	if err := result.annotate(itemContent, outcome, time.Now()); err != nil {
+		p.log.Warnf("Failed to annotate action result: %v", err)
+	}
+}
+
+// annotateResult records the result of the restore action on the cluster. Failing to
+// record it is logged rather than failing the restore.
+func (p *RestorePluginV2) annotateResult(itemContent map[string]interface{}, result *resultRecorder, outcome string) {
+	if err := result.annotate(itemContent, outcome, time.Now()); err != nil {
+		p.log.Warnf("Failed to annotate action result: %v", err)
+	}
+}
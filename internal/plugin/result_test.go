@@ -0,0 +1,140 @@
+package plugin
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// decodeResult returns the result annotation of an item
+func decodeResult(t *testing.T, item map[string]interface{}) actionResult {
+	t.Helper()
+	value, found, _ := unstructured.NestedString(item, "metadata", "annotations", AnnotationResult)
+	require.True(t, found, "no %s annotation", AnnotationResult)
+	var result actionResult
+	require.NoError(t, json.Unmarshal([]byte(value), &result))
+	return result
+}
+
+func TestResultRecorder(t *testing.T) {
+	itemContent := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"name":            "pg",
+			"resourceVersion": "12345",
+			"labels":          map[string]interface{}{"app": "db"},
+			"annotations": map[string]interface{}{
+				AnnotationServerName: "pg",
+				AnnotationResult:     `{"action":"backup"}`,
+			},
+		},
+		"spec":   map[string]interface{}{"instances": 3, "bootstrap": map[string]interface{}{"initdb": map[string]interface{}{}}},
+		"status": map[string]interface{}{"phase": "Cluster in healthy state"},
+	}
+	started := time.Date(2024, 10, 24, 12, 0, 0, 0, time.UTC)
+	recorder := newResultRecorder("restore", "nightly-restore", itemContent, started)
+
+	metadata := itemContent["metadata"].(map[string]interface{})
+	delete(metadata, "resourceVersion")
+	metadata["labels"].(map[string]interface{})["restored"] = "true"
+	metadata["annotations"].(map[string]interface{})[AnnotationServerName] = "pg-new"
+	itemContent["spec"].(map[string]interface{})["bootstrap"] = map[string]interface{}{"recovery": map[string]interface{}{}}
+	delete(itemContent, "status")
+
+	require.NoError(t, recorder.annotate(itemContent, ResultProcessed, started.Add(1500*time.Millisecond)))
+	assert.Equal(t, actionResult{
+		Action:    "restore",
+		Operation: "nightly-restore",
+		Outcome:   ResultProcessed,
+		Changed: []string{
+			"/metadata/annotations/velero-cnpg~1serverName",
+			"/metadata/labels/restored",
+			"/metadata/resourceVersion",
+			"/spec/bootstrap",
+			"/status",
+		},
+		DurationMs: 1500,
+	}, decodeResult(t, itemContent))
+
+	// The result annotation is written after the integrity digest and not covered by it
+	annotations := (&unstructured.Unstructured{Object: itemContent}).GetAnnotations()
+	digest, err := annotationsDigest(annotations, nil)
+	require.NoError(t, err)
+	delete(annotations, AnnotationResult)
+	withoutResult, err := annotationsDigest(annotations, nil)
+	require.NoError(t, err)
+	assert.Equal(t, withoutResult, digest)
+}
+
+func TestBackupExecuteResult(t *testing.T) {
+	client := fake.NewClientset()
+	client.Resources = []*metav1.APIResourceList{{
+		GroupVersion: cnpgGroupVersion,
+		APIResources: []metav1.APIResource{{Name: cnpgResourceClusters}},
+	}}
+	plugin := &BackupPluginV2{
+		log:           logrus.New(),
+		config:        &PluginConfig{},
+		dynamicClient: newFakeDynamicClient(),
+		kubeClient:    client,
+	}
+
+	t.Run("processed", func(t *testing.T) {
+		backup := &v1.Backup{ObjectMeta: metav1.ObjectMeta{Name: "nightly", Namespace: "velero"}}
+		item, _, _, _, err := plugin.Execute(createMockPluginCluster("pg", "default"), backup)
+		require.NoError(t, err)
+
+		result := decodeResult(t, item.UnstructuredContent())
+		assert.Equal(t, "backup", result.Action)
+		assert.Equal(t, "nightly", result.Operation)
+		assert.Equal(t, ResultProcessed, result.Outcome)
+		assert.Contains(t, result.Changed, "/metadata/annotations/velero-cnpg~1serverName")
+		assert.Contains(t, result.Changed, "/metadata/annotations/velero-cnpg~1integrity")
+	})
+
+	t.Run("skipped", func(t *testing.T) {
+		item, _, _, _, err := plugin.Execute(createMockCluster("pg", "default", "pg-1", nil), nil)
+		require.NoError(t, err)
+
+		result := decodeResult(t, item.UnstructuredContent())
+		assert.Equal(t, ResultSkipped, result.Outcome)
+		assert.Empty(t, result.Changed)
+	})
+}
+
+func TestRestoreExecuteResult(t *testing.T) {
+	plugin := &RestorePluginV2{
+		log:    logrus.New(),
+		config: DefaultPluginConfig(),
+	}
+
+	item := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "postgresql.cnpg.io/v1",
+		"kind":       "Cluster",
+		"metadata": map[string]interface{}{
+			"name":            "pg",
+			"namespace":       "default",
+			"resourceVersion": "12345",
+		},
+		"spec":   map[string]interface{}{"instances": 1},
+		"status": map[string]interface{}{"phase": "Cluster in healthy state"},
+	}}
+	restore := &v1.Restore{ObjectMeta: metav1.ObjectMeta{Name: "dr-drill", Namespace: "velero"}}
+
+	output, err := plugin.Execute(&velero.RestoreItemActionExecuteInput{Item: item, Restore: restore})
+	require.NoError(t, err)
+
+	result := decodeResult(t, output.UpdatedItem.UnstructuredContent())
+	assert.Equal(t, "restore", result.Action)
+	assert.Equal(t, "dr-drill", result.Operation)
+	assert.Equal(t, ResultSkipped, result.Outcome)
+	assert.Equal(t, []string{"/metadata/resourceVersion", "/status"}, result.Changed)
+}
@@ -0,0 +1,130 @@
+package plugin
+
+import (
+	"context"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// AnnotationRetentionPolicy is the annotation key used to store the retention policy the
+// cluster's backups were kept under at backup time
+const AnnotationRetentionPolicy = "velero-cnpg/retention-policy"
+
+// retentionPolicyParameter is the plugin parameter holding the retention policy
+const retentionPolicyParameter = "retentionPolicy"
+
+// inlineRetentionPolicy returns the retention policy set in the cluster spec: in
+// spec.backup for the in-tree object store, or in the parameters of the WAL archiver entry
+func inlineRetentionPolicy(itemContent map[string]interface{}) string {
+	if policy, _, _ := unstructured.NestedString(itemContent, "spec", "backup", "retentionPolicy"); policy != "" {
+		return policy
+	}
+	plugins, _, _ := unstructured.NestedFieldNoCopy(itemContent, "spec", "plugins")
+	pluginsList, _ := plugins.([]interface{})
+	policy, _ := walArchiverParameter(pluginsList, retentionPolicyParameter)
+	return policy
+}
+
+// annotateRetentionPolicy records the retention policy of the cluster's backups, taken from
+// the cluster spec or else from the barman-cloud ObjectStore it archives to. Failing to read
+// the ObjectStore is logged rather than failing the backup.
+func (p *BackupPluginV2) annotateRetentionPolicy(itemContent map[string]interface{}) {
+	policy := inlineRetentionPolicy(itemContent)
+
+	if policy == "" {
+		plugins, _, _ := unstructured.NestedFieldNoCopy(itemContent, "spec", "plugins")
+		pluginsList, _ := plugins.([]interface{})
+		barmanObjectName, found := walArchiverParameter(pluginsList, "barmanObjectName")
+		if !found || barmanObjectName == "" {
+			return
+		}
+
+		dynamicClient, err := p.getDynamicClient()
+		if err != nil {
+			p.log.Warnf("Failed to create dynamic client, not annotating retention policy: %v", err)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		namespace := (&unstructured.Unstructured{Object: itemContent}).GetNamespace()
+		objectStore, err := dynamicClient.Resource(barmanObjectStoreGVR).Namespace(namespace).Get(ctx, barmanObjectName, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return
+		}
+		if err != nil {
+			p.log.Warnf("Failed to get ObjectStore %s/%s, not annotating retention policy: %v", namespace, barmanObjectName, classifyAPIError(err))
+			return
+		}
+		policy, _, _ = unstructured.NestedString(objectStore.Object, "spec", "retentionPolicy")
+	}
+
+	if policy == "" {
+		return
+	}
+	if err := p.addAnnotation(itemContent, AnnotationRetentionPolicy, policy); err != nil {
+		p.log.Warnf("Failed to annotate retention policy: %v", err)
+	}
+}
+
+// configureRetentionPolicy sets the retention policy of the new serverName of a restored
+// cluster according to the retentionPolicy setting: original re-applies the policy recorded
+// at backup time, none removes it, and any other value replaces it. The policy is written
+// to spec.backup for the in-tree object store and to the parameters of the WAL archiver
+// entry otherwise.
+func (p *RestorePluginV2) configureRetentionPolicy(itemContent map[string]interface{}, setting string, warnings *restoreWarnings) error {
+	policy := setting
+	switch setting {
+	case RetentionPolicyOriginal:
+		recorded, found, err := p.getAnnotation(itemContent, AnnotationRetentionPolicy)
+		if err != nil {
+			return err
+		}
+		if !found || recorded == "" {
+			warnings.Warnf("No %s annotation found, keeping the retention policy of the backed-up spec", AnnotationRetentionPolicy)
+			return nil
+		}
+		policy = recorded
+	case RetentionPolicyNone:
+		policy = ""
+	}
+
+	specMap, err := getSpecMap(itemContent)
+	if err != nil {
+		return err
+	}
+
+	if _, found, _ := nestedMapNoCopy(specMap, "backup", "barmanObjectStore"); found {
+		backup := specMap["backup"].(map[string]interface{})
+		if policy == "" {
+			delete(backup, "retentionPolicy")
+		} else {
+			backup["retentionPolicy"] = policy
+		}
+		p.log.Infof("Set spec.backup.retentionPolicy to %q", policy)
+		return nil
+	}
+
+	plugins, _ := specMap["plugins"].([]interface{})
+	entry := walArchiverEntry(plugins, "barmanObjectName", true)
+	if entry == nil {
+		warnings.Warnf("Cluster archives to no object store, ignoring retentionPolicy %s", setting)
+		return nil
+	}
+	parameters := entry["parameters"].(map[string]interface{})
+	if policy == "" {
+		delete(parameters, retentionPolicyParameter)
+	} else {
+		parameters[retentionPolicyParameter] = policy
+	}
+	p.log.Infof("Set spec.plugins[].parameters.retentionPolicy to %q", policy)
+	// The barman-cloud plugin enforces the retentionPolicy of the ObjectStore, which may be
+	// shared with other clusters, so it is left alone and the parameter only informs tooling
+	warnings.Warnf("The barman-cloud plugin ignores spec.plugins[].parameters.retentionPolicy, set spec.retentionPolicy of ObjectStore %v to apply retentionPolicy %s",
+		parameters["barmanObjectName"], setting)
+	return nil
+}
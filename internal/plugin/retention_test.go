@@ -0,0 +1,136 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// createMockPluginCluster returns a cluster archiving through the barman-cloud plugin only
+func createMockPluginCluster(name, namespace string) *unstructured.Unstructured {
+	cluster := createMockArchivingCluster(name, namespace, name, nil)
+	delete(cluster.Object["spec"].(map[string]interface{}), "backup")
+	return cluster
+}
+
+func TestAnnotateRetentionPolicy(t *testing.T) {
+	objectStore := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "barmancloud.cnpg.io/v1",
+		"kind":       "ObjectStore",
+		"metadata":   map[string]interface{}{"name": "store", "namespace": "default"},
+		"spec":       map[string]interface{}{"retentionPolicy": "30d"},
+	}}
+
+	tests := []struct {
+		name     string
+		cluster  *unstructured.Unstructured
+		objects  []runtime.Object
+		expected string
+	}{
+		{
+			name: "in-tree object store",
+			cluster: func() *unstructured.Unstructured {
+				cluster := createMockArchivingCluster("pg", "default", "pg", nil)
+				require.NoError(t, unstructured.SetNestedField(cluster.Object, "14d", "spec", "backup", "retentionPolicy"))
+				return cluster
+			}(),
+			expected: "14d",
+		},
+		{
+			name: "plugin parameter",
+			cluster: func() *unstructured.Unstructured {
+				cluster := createMockPluginCluster("pg", "default")
+				plugins, _, _ := unstructured.NestedSlice(cluster.Object, "spec", "plugins")
+				require.NoError(t, unstructured.SetNestedField(plugins[0].(map[string]interface{}), "2w", "parameters", retentionPolicyParameter))
+				require.NoError(t, unstructured.SetNestedSlice(cluster.Object, plugins, "spec", "plugins"))
+				return cluster
+			}(),
+			objects:  []runtime.Object{objectStore},
+			expected: "2w",
+		},
+		{name: "ObjectStore", cluster: createMockPluginCluster("pg", "default"), objects: []runtime.Object{objectStore}, expected: "30d"},
+		{name: "no ObjectStore", cluster: createMockPluginCluster("pg", "default")},
+		{name: "no retention policy", cluster: createMockArchivingCluster("pg", "default", "pg", nil)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plugin := &BackupPluginV2{log: logrus.New(), dynamicClient: newFakeDynamicClient(tt.objects...)}
+
+			plugin.annotateRetentionPolicy(tt.cluster.Object)
+
+			value, found := tt.cluster.GetAnnotations()[AnnotationRetentionPolicy]
+			assert.Equal(t, tt.expected != "", found)
+			assert.Equal(t, tt.expected, value)
+		})
+	}
+}
+
+func TestConfigureRetentionPolicy(t *testing.T) {
+	pluginPolicy := func(cluster *unstructured.Unstructured) (string, bool) {
+		plugins, _, _ := unstructured.NestedSlice(cluster.Object, "spec", "plugins")
+		policy, found, _ := unstructured.NestedString(plugins[0].(map[string]interface{}), "parameters", retentionPolicyParameter)
+		return policy, found
+	}
+
+	t.Run("override in plugin parameters", func(t *testing.T) {
+		cluster := createMockPluginCluster("pg", "default")
+		warnings := &restoreWarnings{log: logrus.New()}
+
+		require.NoError(t, (&RestorePluginV2{log: logrus.New()}).configureRetentionPolicy(cluster.Object, "7d", warnings))
+
+		policy, found := pluginPolicy(cluster)
+		assert.True(t, found)
+		assert.Equal(t, "7d", policy)
+		require.Len(t, warnings.messages, 1)
+		assert.Contains(t, warnings.messages[0], "ObjectStore store")
+	})
+
+	t.Run("original in the in-tree object store", func(t *testing.T) {
+		cluster := createMockArchivingCluster("pg", "default", "pg", nil)
+		cluster.SetAnnotations(map[string]string{AnnotationRetentionPolicy: "30d"})
+		warnings := &restoreWarnings{log: logrus.New()}
+
+		require.NoError(t, (&RestorePluginV2{log: logrus.New()}).configureRetentionPolicy(cluster.Object, RetentionPolicyOriginal, warnings))
+
+		policy, _, _ := unstructured.NestedString(cluster.Object, "spec", "backup", "retentionPolicy")
+		assert.Equal(t, "30d", policy)
+		_, found := pluginPolicy(cluster)
+		assert.False(t, found)
+	})
+
+	t.Run("original without annotation", func(t *testing.T) {
+		cluster := createMockPluginCluster("pg", "default")
+		warnings := &restoreWarnings{log: logrus.New()}
+
+		require.NoError(t, (&RestorePluginV2{log: logrus.New()}).configureRetentionPolicy(cluster.Object, RetentionPolicyOriginal, warnings))
+
+		_, found := pluginPolicy(cluster)
+		assert.False(t, found)
+		require.Len(t, warnings.messages, 1)
+		assert.Contains(t, warnings.messages[0], AnnotationRetentionPolicy)
+	})
+
+	t.Run("none", func(t *testing.T) {
+		cluster := createMockArchivingCluster("pg", "default", "pg", nil)
+		require.NoError(t, unstructured.SetNestedField(cluster.Object, "14d", "spec", "backup", "retentionPolicy"))
+
+		require.NoError(t, (&RestorePluginV2{log: logrus.New()}).configureRetentionPolicy(cluster.Object, RetentionPolicyNone, &restoreWarnings{log: logrus.New()}))
+
+		_, found, _ := unstructured.NestedString(cluster.Object, "spec", "backup", "retentionPolicy")
+		assert.False(t, found)
+	})
+
+	t.Run("no object store", func(t *testing.T) {
+		cluster := createMockPluginCluster("pg", "default")
+		delete(cluster.Object["spec"].(map[string]interface{}), "plugins")
+		warnings := &restoreWarnings{log: logrus.New()}
+
+		require.NoError(t, (&RestorePluginV2{log: logrus.New()}).configureRetentionPolicy(cluster.Object, "7d", warnings))
+		assert.Len(t, warnings.messages, 1)
+	})
+}
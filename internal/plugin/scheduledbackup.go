@@ -0,0 +1,196 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/label"
+	"github.com/vmware-tanzu/velero/pkg/util/collections"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// AnnotationScheduledBackups is the annotation key used to store the names of the
+// ScheduledBackups of the cluster at backup time, as a JSON list
+const AnnotationScheduledBackups = "velero-cnpg/scheduled-backups"
+
+// cnpgScheduledBackupGVR identifies CNPG ScheduledBackup resources
+var cnpgScheduledBackupGVR = schema.GroupVersionResource{
+	Group:    "postgresql.cnpg.io",
+	Version:  "v1",
+	Resource: "scheduledbackups",
+}
+
+// clusterScheduledBackups returns the sorted names of the ScheduledBackups in the namespace
+// backing up the cluster
+func clusterScheduledBackups(ctx context.Context, dynamicClient dynamic.Interface, namespace, clusterName string) ([]string, error) {
+	scheduledBackups, err := dynamicClient.Resource(cnpgScheduledBackupGVR).Namespace(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(classifyAPIError(err), "failed to list scheduled backups in namespace %s", namespace)
+	}
+
+	var names []string
+	for _, scheduledBackup := range scheduledBackups.Items {
+		if name, _, _ := unstructured.NestedString(scheduledBackup.Object, "spec", "cluster", "name"); name == clusterName {
+			names = append(names, scheduledBackup.GetName())
+		}
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// annotateScheduledBackups records the ScheduledBackups of the cluster, so the restore can
+// tell whether the cluster comes back with one. Failing to list them is logged rather than
+// failing the backup.
+func (p *BackupPluginV2) annotateScheduledBackups(itemContent map[string]interface{}) {
+	cluster := &unstructured.Unstructured{Object: itemContent}
+
+	dynamicClient, err := p.getDynamicClient()
+	if err != nil {
+		p.log.Warnf("Failed to create dynamic client, not annotating scheduled backups: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	names, err := clusterScheduledBackups(ctx, dynamicClient, cluster.GetNamespace(), cluster.GetName())
+	if err != nil {
+		p.log.Warnf("Not annotating scheduled backups: %v", err)
+		return
+	}
+
+	// An empty list records that the cluster had none
+	if names == nil {
+		names = []string{}
+	}
+	raw, err := json.Marshal(names)
+	if err == nil {
+		err = setAnnotation(itemContent, AnnotationScheduledBackups, string(raw))
+	}
+	if err != nil {
+		p.log.Warnf("Failed to annotate scheduled backups: %v", err)
+	}
+}
+
+// restoresScheduledBackups reports whether the resource filters of the restore let
+// ScheduledBackups through
+func restoresScheduledBackups(restore *v1.Restore) bool {
+	if restore == nil {
+		return true
+	}
+
+	names := []string{cnpgScheduledBackupGVR.Resource, cnpgScheduledBackupGVR.GroupResource().String()}
+	excludes := collections.NewIncludesExcludes().Excludes(restore.Spec.ExcludedResources...)
+	includes := collections.NewIncludesExcludes().Includes(restore.Spec.IncludedResources...)
+	for _, name := range names {
+		if !excludes.ShouldInclude(name) {
+			return false
+		}
+	}
+	return includes.ShouldInclude(names[0]) || includes.ShouldInclude(names[1])
+}
+
+// needsScheduledBackup reports whether a restored cluster comes back without a
+// ScheduledBackup: none was recorded at backup time, or the restore leaves them out
+func (p *RestorePluginV2) needsScheduledBackup(itemContent map[string]interface{}, restore *v1.Restore) (bool, error) {
+	value, found, err := p.getAnnotation(itemContent, AnnotationScheduledBackups)
+	if err != nil || !found {
+		return true, err
+	}
+
+	var names []string
+	if err := json.Unmarshal([]byte(value), &names); err != nil {
+		return false, errors.Wrapf(err, "failed to decode %s annotation", AnnotationScheduledBackups)
+	}
+	return len(names) == 0 || !restoresScheduledBackups(restore), nil
+}
+
+// scheduledBackup returns the ScheduledBackup created for a restored cluster from the
+// template. The method defaults to the one the cluster was backed up with. A held
+// ScheduledBackup is created suspended, for the namespace gate to resume.
+func scheduledBackup(template *ScheduledBackupConfig, namespace, clusterName, method string, restore *v1.Restore, hold bool) *unstructured.Unstructured {
+	if template.Method != "" {
+		method = template.Method
+	}
+
+	spec := map[string]interface{}{
+		"cluster":  map[string]interface{}{"name": clusterName},
+		"schedule": template.Schedule,
+	}
+	if method != "" {
+		spec["method"] = method
+	}
+	if method == BackupMethodPlugin {
+		spec["pluginConfiguration"] = map[string]interface{}{"name": BarmanCloudPluginName}
+	}
+	if template.Immediate {
+		spec["immediate"] = true
+	}
+	if template.BackupOwnerReference != "" {
+		spec["backupOwnerReference"] = template.BackupOwnerReference
+	}
+	if template.Target != "" {
+		spec["target"] = template.Target
+	}
+	if hold {
+		spec["suspend"] = true
+	}
+
+	scheduled := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": cnpgScheduledBackupGVR.GroupVersion().String(),
+		"kind":       "ScheduledBackup",
+		"metadata": map[string]interface{}{
+			"name":      fmt.Sprintf("%s-scheduled-backup", clusterName),
+			"namespace": namespace,
+		},
+		"spec": spec,
+	}}
+	if restore != nil {
+		scheduled.SetLabels(map[string]string{v1.RestoreNameLabel: label.GetValidName(restore.Name)})
+	}
+	if hold {
+		scheduled.SetAnnotations(map[string]string{AnnotationHeld: "true"})
+	}
+	return scheduled
+}
+
+// ensureScheduledBackup creates a ScheduledBackup from the template for a restored cluster
+// that comes back without one, so it does not silently run without ongoing backups. An
+// existing ScheduledBackup of the same name is left alone.
+func (p *RestorePluginV2) ensureScheduledBackup(itemContent map[string]interface{}, restore *v1.Restore, template *ScheduledBackupConfig, namespace, clusterName, method string, hold bool, warnings *restoreWarnings) error {
+	needed, err := p.needsScheduledBackup(itemContent, restore)
+	if err != nil || !needed {
+		return err
+	}
+
+	dynamicClient, err := p.getDynamicClient()
+	if err != nil {
+		return errors.Wrap(err, "failed to create dynamic client")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	scheduled := scheduledBackup(template, namespace, clusterName, method, restore, hold)
+	_, err = dynamicClient.Resource(cnpgScheduledBackupGVR).Namespace(namespace).Create(ctx, scheduled, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		p.log.Infof("ScheduledBackup %s/%s already exists", namespace, scheduled.GetName())
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(classifyAPIError(err), "failed to create ScheduledBackup %s/%s", namespace, scheduled.GetName())
+	}
+
+	warnings.Warnf("Cluster has no ScheduledBackup in this restore, created %s from the template", scheduled.GetName())
+	return nil
+}
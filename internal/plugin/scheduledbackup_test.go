@@ -0,0 +1,160 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// createMockScheduledBackup creates a ScheduledBackup of clusterName
+func createMockScheduledBackup(name, namespace, clusterName string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "postgresql.cnpg.io/v1",
+			"kind":       "ScheduledBackup",
+			"metadata": map[string]interface{}{
+				"name":      name,
+				"namespace": namespace,
+			},
+			"spec": map[string]interface{}{
+				"cluster":  map[string]interface{}{"name": clusterName},
+				"schedule": "0 0 0 * * *",
+			},
+		},
+	}
+}
+
+func TestAnnotateScheduledBackups(t *testing.T) {
+	plugin := &BackupPluginV2{
+		log: logrus.New(),
+		dynamicClient: newFakeDynamicClient(
+			createMockScheduledBackup("pg-nightly", "default", "pg"),
+			createMockScheduledBackup("pg-hourly", "default", "pg"),
+			createMockScheduledBackup("other-nightly", "default", "other"),
+		),
+	}
+
+	cluster := createMockArchivingCluster("pg", "default", "pg", nil)
+	plugin.annotateScheduledBackups(cluster.Object)
+	assert.Equal(t, `["pg-hourly","pg-nightly"]`, cluster.GetAnnotations()[AnnotationScheduledBackups])
+
+	// Clusters without ScheduledBackups are annotated with an empty list
+	other := createMockArchivingCluster("lonely", "default", "lonely", nil)
+	plugin.annotateScheduledBackups(other.Object)
+	assert.Equal(t, `[]`, other.GetAnnotations()[AnnotationScheduledBackups])
+}
+
+func TestRestoresScheduledBackups(t *testing.T) {
+	tests := []struct {
+		name     string
+		restore  *v1.Restore
+		expected bool
+	}{
+		{name: "no restore", expected: true},
+		{name: "no filters", restore: &v1.Restore{}, expected: true},
+		{
+			name:     "excluded",
+			restore:  &v1.Restore{Spec: v1.RestoreSpec{ExcludedResources: []string{"scheduledbackups.postgresql.cnpg.io"}}},
+			expected: false,
+		},
+		{
+			name:     "excluded by short name",
+			restore:  &v1.Restore{Spec: v1.RestoreSpec{ExcludedResources: []string{"scheduledbackups"}}},
+			expected: false,
+		},
+		{
+			name:     "not included",
+			restore:  &v1.Restore{Spec: v1.RestoreSpec{IncludedResources: []string{"clusters.postgresql.cnpg.io"}}},
+			expected: false,
+		},
+		{
+			name:     "included",
+			restore:  &v1.Restore{Spec: v1.RestoreSpec{IncludedResources: []string{"clusters", "scheduledbackups"}}},
+			expected: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, restoresScheduledBackups(tt.restore))
+		})
+	}
+}
+
+func TestEnsureScheduledBackup(t *testing.T) {
+	template := &ScheduledBackupConfig{Schedule: "0 0 0 * * *", BackupOwnerReference: "self"}
+	excluding := &v1.Restore{
+		ObjectMeta: metav1.ObjectMeta{Name: "restore-1"},
+		Spec:       v1.RestoreSpec{ExcludedResources: []string{"scheduledbackups"}},
+	}
+
+	tests := []struct {
+		name          string
+		annotation    string
+		restore       *v1.Restore
+		existing      []runtime.Object
+		expectCreated bool
+	}{
+		{name: "no scheduled backups recorded", annotation: `[]`, restore: &v1.Restore{}, expectCreated: true},
+		{name: "backup from before the annotation", restore: &v1.Restore{}, expectCreated: true},
+		{name: "scheduled backup restored", annotation: `["pg-nightly"]`, restore: &v1.Restore{}},
+		{name: "scheduled backup excluded", annotation: `["pg-nightly"]`, restore: excluding, expectCreated: true},
+		{
+			name:       "already exists",
+			annotation: `[]`,
+			restore:    &v1.Restore{},
+			existing:   []runtime.Object{createMockScheduledBackup("pg-scheduled-backup", "default", "pg")},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dynamicClient := newFakeDynamicClient(tt.existing...)
+			plugin := &RestorePluginV2{log: logrus.New(), dynamicClient: dynamicClient}
+			cluster := createMockArchivingCluster("pg", "default", "pg", nil)
+			if tt.annotation != "" {
+				cluster.SetAnnotations(map[string]string{AnnotationScheduledBackups: tt.annotation})
+			}
+			warnings := &restoreWarnings{log: logrus.New()}
+
+			require.NoError(t, plugin.ensureScheduledBackup(cluster.Object, tt.restore, template, "default", "pg", BackupMethodPlugin, false, warnings))
+
+			created, err := dynamicClient.Resource(cnpgScheduledBackupGVR).Namespace("default").Get(context.Background(), "pg-scheduled-backup", metav1.GetOptions{})
+			if !tt.expectCreated {
+				assert.Empty(t, warnings.messages)
+				return
+			}
+			require.NoError(t, err)
+			assert.Len(t, warnings.messages, 1)
+
+			method, _, _ := unstructured.NestedString(created.Object, "spec", "method")
+			assert.Equal(t, BackupMethodPlugin, method)
+			ownerReference, _, _ := unstructured.NestedString(created.Object, "spec", "backupOwnerReference")
+			assert.Equal(t, "self", ownerReference)
+			clusterName, _, _ := unstructured.NestedString(created.Object, "spec", "cluster", "name")
+			assert.Equal(t, "pg", clusterName)
+		})
+	}
+}
+
+func TestEnsureScheduledBackupHeld(t *testing.T) {
+	dynamicClient := newFakeDynamicClient()
+	plugin := &RestorePluginV2{log: logrus.New(), dynamicClient: dynamicClient}
+	cluster := createMockArchivingCluster("pg", "default", "pg", nil)
+	warnings := &restoreWarnings{log: logrus.New()}
+
+	require.NoError(t, plugin.ensureScheduledBackup(cluster.Object, &v1.Restore{}, &ScheduledBackupConfig{Schedule: "0 0 0 * * *"}, "default", "pg", BackupMethodPlugin, true, warnings))
+
+	created, err := dynamicClient.Resource(cnpgScheduledBackupGVR).Namespace("default").Get(context.Background(), "pg-scheduled-backup", metav1.GetOptions{})
+	require.NoError(t, err)
+	suspend, _, _ := unstructured.NestedBool(created.Object, "spec", "suspend")
+	assert.True(t, suspend)
+	assert.Equal(t, "true", created.GetAnnotations()[AnnotationHeld])
+}
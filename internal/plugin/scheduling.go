@@ -0,0 +1,291 @@
+package plugin
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// getSpecMap returns the spec of the item as a map that can be modified in place
+func getSpecMap(itemContent map[string]interface{}) (map[string]interface{}, error) {
+	spec, found, err := unstructured.NestedFieldNoCopy(itemContent, "spec")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get spec field")
+	}
+	if !found {
+		return nil, specShapeError("spec field not found")
+	}
+
+	specMap, ok := spec.(map[string]interface{})
+	if !ok {
+		return nil, specShapeError("spec is not a map")
+	}
+
+	return specMap, nil
+}
+
+// relaxScheduling removes or remaps scheduling constraints on the restored cluster so
+// its instances can be scheduled on a DR cluster with a different node/zone layout
+func (p *RestorePluginV2) relaxScheduling(itemContent map[string]interface{}, scheduling *SchedulingConfig) error {
+	if scheduling == nil {
+		return nil
+	}
+
+	specMap, err := getSpecMap(itemContent)
+	if err != nil {
+		return err
+	}
+
+	if scheduling.RemoveTopologySpreadConstraints {
+		if _, found := specMap["topologySpreadConstraints"]; found {
+			delete(specMap, "topologySpreadConstraints")
+			p.log.Info("Removed spec.topologySpreadConstraints")
+		}
+	}
+
+	affinity, found := specMap["affinity"]
+	if !found {
+		affinity = map[string]interface{}{}
+	}
+	affinityMap, ok := affinity.(map[string]interface{})
+	if !ok {
+		return specShapeError("affinity is not a map")
+	}
+
+	if scheduling.RemoveAffinity {
+		delete(affinityMap, "nodeAffinity")
+		delete(affinityMap, "additionalPodAffinity")
+		delete(affinityMap, "additionalPodAntiAffinity")
+		affinityMap["enablePodAntiAffinity"] = false
+		p.log.Info("Removed affinity rules from spec.affinity")
+	}
+
+	if scheduling.PodAntiAffinityType != "" {
+		affinityMap["podAntiAffinityType"] = scheduling.PodAntiAffinityType
+		p.log.Infof("Set spec.affinity.podAntiAffinityType to %s", scheduling.PodAntiAffinityType)
+	}
+
+	if scheduling.TopologyKey != "" {
+		affinityMap["topologyKey"] = scheduling.TopologyKey
+		p.log.Infof("Set spec.affinity.topologyKey to %s", scheduling.TopologyKey)
+	}
+
+	p.rewriteTopology(specMap, affinityMap, scheduling)
+
+	if scheduling.RemoveNodeSelector {
+		delete(affinityMap, "nodeSelector")
+		p.log.Info("Removed spec.affinity.nodeSelector")
+	}
+
+	if len(scheduling.NodeSelector) > 0 {
+		affinityMap["nodeSelector"] = stringMapToInterfaces(scheduling.NodeSelector)
+		p.log.Infof("Replaced spec.affinity.nodeSelector with %v", scheduling.NodeSelector)
+	}
+
+	if err := p.rewriteTolerations(affinityMap, scheduling); err != nil {
+		return err
+	}
+
+	if len(affinityMap) > 0 {
+		specMap["affinity"] = affinityMap
+	} else {
+		delete(specMap, "affinity")
+	}
+
+	p.rewritePriorityClassName(specMap, scheduling)
+
+	return nil
+}
+
+// zoneLabels are the well-known node labels holding a node's zone
+var zoneLabels = []string{"topology.kubernetes.io/zone", "failure-domain.beta.kubernetes.io/zone"}
+
+// rewriteTopology renames the node label keys of scheduling.TopologyKeys and the zones of
+// scheduling.Zones, so a multi-zone cluster can be recovered into a cluster whose zones
+// or topology labels are named differently. Keys are renamed in the topology keys of
+// spec.affinity, its additional pod (anti-)affinity terms and spec.topologySpreadConstraints,
+// and in the node selector and node affinity. Zones are renamed in the node selector and
+// node affinity values of the zone labels and of spec.affinity.topologyKey.
+func (p *RestorePluginV2) rewriteTopology(specMap, affinityMap map[string]interface{}, scheduling *SchedulingConfig) {
+	if len(scheduling.TopologyKeys) == 0 && len(scheduling.Zones) == 0 {
+		return
+	}
+
+	renameKey := func(holder map[string]interface{}, field string) {
+		key, _ := holder[field].(string)
+		if newKey, found := scheduling.TopologyKeys[key]; found && key != "" {
+			holder[field] = newKey
+			p.log.Infof("Renamed topology key %s to %s", key, newKey)
+		}
+	}
+	renameKey(affinityMap, "topologyKey")
+	for _, constraint := range sliceOfMaps(specMap["topologySpreadConstraints"]) {
+		renameKey(constraint, "topologyKey")
+	}
+	for _, field := range []string{"additionalPodAffinity", "additionalPodAntiAffinity"} {
+		podAffinity, _ := affinityMap[field].(map[string]interface{})
+		for _, term := range sliceOfMaps(podAffinity["requiredDuringSchedulingIgnoredDuringExecution"]) {
+			renameKey(term, "topologyKey")
+		}
+		for _, weighted := range sliceOfMaps(podAffinity["preferredDuringSchedulingIgnoredDuringExecution"]) {
+			term, _ := weighted["podAffinityTerm"].(map[string]interface{})
+			renameKey(term, "topologyKey")
+		}
+	}
+
+	zoneKeys := map[string]bool{}
+	for _, key := range zoneLabels {
+		zoneKeys[key] = true
+	}
+	if key, _ := affinityMap["topologyKey"].(string); key != "" {
+		zoneKeys[key] = true
+	}
+	renameZone := func(key, zone string) string {
+		if newZone, found := scheduling.Zones[zone]; found && zoneKeys[key] {
+			p.log.Infof("Renamed zone %s to %s under %s", zone, newZone, key)
+			return newZone
+		}
+		return zone
+	}
+
+	if nodeSelector, ok := affinityMap["nodeSelector"].(map[string]interface{}); ok {
+		renamed := make(map[string]interface{}, len(nodeSelector))
+		for key, value := range nodeSelector {
+			if newKey, found := scheduling.TopologyKeys[key]; found {
+				p.log.Infof("Renamed node selector key %s to %s", key, newKey)
+				key = newKey
+			}
+			if zone, ok := value.(string); ok {
+				value = renameZone(key, zone)
+			}
+			renamed[key] = value
+		}
+		affinityMap["nodeSelector"] = renamed
+	}
+
+	rewriteTerm := func(term map[string]interface{}) {
+		for _, expression := range sliceOfMaps(term["matchExpressions"]) {
+			renameKey(expression, "key")
+			key, _ := expression["key"].(string)
+			values, _ := expression["values"].([]interface{})
+			for i, value := range values {
+				if zone, ok := value.(string); ok {
+					values[i] = renameZone(key, zone)
+				}
+			}
+		}
+	}
+	nodeAffinity, _ := affinityMap["nodeAffinity"].(map[string]interface{})
+	required, _ := nodeAffinity["requiredDuringSchedulingIgnoredDuringExecution"].(map[string]interface{})
+	for _, term := range sliceOfMaps(required["nodeSelectorTerms"]) {
+		rewriteTerm(term)
+	}
+	for _, weighted := range sliceOfMaps(nodeAffinity["preferredDuringSchedulingIgnoredDuringExecution"]) {
+		term, _ := weighted["preference"].(map[string]interface{})
+		rewriteTerm(term)
+	}
+}
+
+// rewriteTolerations strips, renames, or replaces spec.affinity.tolerations when the
+// destination cluster lacks the original taints
+func (p *RestorePluginV2) rewriteTolerations(affinityMap map[string]interface{}, scheduling *SchedulingConfig) error {
+	if scheduling.RemoveTolerations {
+		delete(affinityMap, "tolerations")
+		p.log.Info("Removed spec.affinity.tolerations")
+		return nil
+	}
+
+	if len(scheduling.Tolerations) > 0 {
+		tolerations := make([]interface{}, 0, len(scheduling.Tolerations))
+		for i := range scheduling.Tolerations {
+			toleration, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&scheduling.Tolerations[i])
+			if err != nil {
+				return errors.Wrap(err, "failed to convert toleration")
+			}
+			tolerations = append(tolerations, toleration)
+		}
+		affinityMap["tolerations"] = tolerations
+		p.log.Infof("Replaced spec.affinity.tolerations with %d configured toleration(s)", len(tolerations))
+		return nil
+	}
+
+	if len(scheduling.TolerationKeys) == 0 {
+		return nil
+	}
+
+	tolerations, found := affinityMap["tolerations"]
+	if !found {
+		return nil
+	}
+	tolerationsList, ok := tolerations.([]interface{})
+	if !ok {
+		return specShapeError("tolerations is not a list")
+	}
+
+	for _, toleration := range tolerationsList {
+		tolerationMap, ok := toleration.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		key, _ := tolerationMap["key"].(string)
+		if newKey, found := scheduling.TolerationKeys[key]; found {
+			tolerationMap["key"] = newKey
+			p.log.Infof("Renamed toleration key %s to %s", key, newKey)
+		}
+	}
+
+	return nil
+}
+
+// rewritePriorityClassName strips or renames spec.priorityClassName when the destination
+// cluster lacks the original priority class
+func (p *RestorePluginV2) rewritePriorityClassName(specMap map[string]interface{}, scheduling *SchedulingConfig) {
+	priorityClassName, _ := specMap["priorityClassName"].(string)
+	if priorityClassName == "" {
+		return
+	}
+
+	if scheduling.RemovePriorityClassName {
+		delete(specMap, "priorityClassName")
+		p.log.Infof("Removed spec.priorityClassName %s", priorityClassName)
+		return
+	}
+
+	if newName, found := scheduling.PriorityClassNames[priorityClassName]; found {
+		specMap["priorityClassName"] = newName
+		p.log.Infof("Renamed spec.priorityClassName %s to %s", priorityClassName, newName)
+	}
+}
+
+// schedulingFields are the spec fields relaxScheduling may change
+var schedulingFields = []string{"affinity", "topologySpreadConstraints", "priorityClassName"}
+
+// schedulingSnapshot encodes the scheduling fields of the item's spec, so they can be
+// compared after relaxScheduling modified the spec in place
+func schedulingSnapshot(itemContent map[string]interface{}) map[string]string {
+	snapshot := map[string]string{}
+	specMap, err := getSpecMap(itemContent)
+	if err != nil {
+		return snapshot
+	}
+	for _, field := range schedulingFields {
+		if value, found := specMap[field]; found {
+			encoded, _ := json.Marshal(value)
+			snapshot[field] = string(encoded)
+		}
+	}
+	return snapshot
+}
+
+// changedSchedulingFields lists the spec fields that differ between two snapshots
+func changedSchedulingFields(before, after map[string]string) []string {
+	var changed []string
+	for _, field := range schedulingFields {
+		if before[field] != after[field] {
+			changed = append(changed, "spec."+field)
+		}
+	}
+	return changed
+}
@@ -0,0 +1,260 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestRelaxScheduling(t *testing.T) {
+	plugin := &RestorePluginV2{
+		log: logrus.New(),
+	}
+
+	newItemContent := func() map[string]interface{} {
+		return map[string]interface{}{
+			"spec": map[string]interface{}{
+				"instances": 3,
+				"affinity": map[string]interface{}{
+					"enablePodAntiAffinity": true,
+					"podAntiAffinityType":   "required",
+					"topologyKey":           "topology.kubernetes.io/zone",
+					"nodeSelector": map[string]interface{}{
+						"node-role.kubernetes.io/postgres": "",
+					},
+					"nodeAffinity": map[string]interface{}{
+						"requiredDuringSchedulingIgnoredDuringExecution": map[string]interface{}{},
+					},
+					"tolerations": []interface{}{
+						map[string]interface{}{"key": "postgres", "operator": "Exists"},
+					},
+				},
+				"priorityClassName": "prod-critical",
+				"topologySpreadConstraints": []interface{}{
+					map[string]interface{}{"maxSkew": 1, "topologyKey": "topology.kubernetes.io/zone"},
+				},
+			},
+		}
+	}
+
+	tests := []struct {
+		name          string
+		itemContent   map[string]interface{}
+		scheduling    *SchedulingConfig
+		expectedError bool
+		validateFn    func(t *testing.T, spec map[string]interface{})
+	}{
+		{
+			name:        "nil config leaves spec unchanged",
+			itemContent: newItemContent(),
+			validateFn: func(t *testing.T, spec map[string]interface{}) {
+				assert.Equal(t, newItemContent()["spec"], spec)
+			},
+		},
+		{
+			name:        "remove affinity rules and spread constraints",
+			itemContent: newItemContent(),
+			scheduling: &SchedulingConfig{
+				RemoveAffinity:                  true,
+				RemoveTopologySpreadConstraints: true,
+			},
+			validateFn: func(t *testing.T, spec map[string]interface{}) {
+				_, hasSpread := spec["topologySpreadConstraints"]
+				assert.False(t, hasSpread)
+
+				affinity := spec["affinity"].(map[string]interface{})
+				assert.Equal(t, false, affinity["enablePodAntiAffinity"])
+				_, hasNodeAffinity := affinity["nodeAffinity"]
+				assert.False(t, hasNodeAffinity)
+
+				// nodeSelector and tolerations are handled separately
+				assert.NotNil(t, affinity["nodeSelector"])
+				assert.NotNil(t, affinity["tolerations"])
+			},
+		},
+		{
+			name:        "remap topology key and anti-affinity type",
+			itemContent: newItemContent(),
+			scheduling: &SchedulingConfig{
+				PodAntiAffinityType: "preferred",
+				TopologyKey:         "kubernetes.io/hostname",
+			},
+			validateFn: func(t *testing.T, spec map[string]interface{}) {
+				affinity := spec["affinity"].(map[string]interface{})
+				assert.Equal(t, "preferred", affinity["podAntiAffinityType"])
+				assert.Equal(t, "kubernetes.io/hostname", affinity["topologyKey"])
+				assert.Equal(t, true, affinity["enablePodAntiAffinity"])
+			},
+		},
+		{
+			name:        "remove node selector",
+			itemContent: newItemContent(),
+			scheduling:  &SchedulingConfig{RemoveNodeSelector: true},
+			validateFn: func(t *testing.T, spec map[string]interface{}) {
+				affinity := spec["affinity"].(map[string]interface{})
+				_, hasNodeSelector := affinity["nodeSelector"]
+				assert.False(t, hasNodeSelector)
+			},
+		},
+		{
+			name: "replace node selector without existing affinity",
+			itemContent: map[string]interface{}{
+				"spec": map[string]interface{}{},
+			},
+			scheduling: &SchedulingConfig{
+				NodeSelector: map[string]string{"disktype": "ssd"},
+			},
+			validateFn: func(t *testing.T, spec map[string]interface{}) {
+				affinity := spec["affinity"].(map[string]interface{})
+				assert.Equal(t, map[string]interface{}{"disktype": "ssd"}, affinity["nodeSelector"])
+			},
+		},
+		{
+			name: "removing from absent affinity does not add it",
+			itemContent: map[string]interface{}{
+				"spec": map[string]interface{}{},
+			},
+			scheduling: &SchedulingConfig{RemoveNodeSelector: true},
+			validateFn: func(t *testing.T, spec map[string]interface{}) {
+				_, hasAffinity := spec["affinity"]
+				assert.False(t, hasAffinity)
+			},
+		},
+		{
+			name:        "remove tolerations and priority class",
+			itemContent: newItemContent(),
+			scheduling: &SchedulingConfig{
+				RemoveTolerations:       true,
+				RemovePriorityClassName: true,
+			},
+			validateFn: func(t *testing.T, spec map[string]interface{}) {
+				affinity := spec["affinity"].(map[string]interface{})
+				_, hasTolerations := affinity["tolerations"]
+				assert.False(t, hasTolerations)
+				_, hasPriorityClassName := spec["priorityClassName"]
+				assert.False(t, hasPriorityClassName)
+			},
+		},
+		{
+			name:        "rename toleration keys and priority class",
+			itemContent: newItemContent(),
+			scheduling: &SchedulingConfig{
+				TolerationKeys:     map[string]string{"postgres": "dr-postgres"},
+				PriorityClassNames: map[string]string{"prod-critical": "dr-default"},
+			},
+			validateFn: func(t *testing.T, spec map[string]interface{}) {
+				affinity := spec["affinity"].(map[string]interface{})
+				tolerations := affinity["tolerations"].([]interface{})
+				require.Len(t, tolerations, 1)
+				toleration := tolerations[0].(map[string]interface{})
+				assert.Equal(t, "dr-postgres", toleration["key"])
+				assert.Equal(t, "Exists", toleration["operator"])
+				assert.Equal(t, "dr-default", spec["priorityClassName"])
+			},
+		},
+		{
+			name:        "replace tolerations",
+			itemContent: newItemContent(),
+			scheduling: &SchedulingConfig{
+				Tolerations: []corev1.Toleration{
+					{Key: "dedicated", Operator: corev1.TolerationOpEqual, Value: "dr", Effect: corev1.TaintEffectNoSchedule},
+				},
+			},
+			validateFn: func(t *testing.T, spec map[string]interface{}) {
+				affinity := spec["affinity"].(map[string]interface{})
+				tolerations := affinity["tolerations"].([]interface{})
+				require.Len(t, tolerations, 1)
+				toleration := tolerations[0].(map[string]interface{})
+				assert.Equal(t, "dedicated", toleration["key"])
+				assert.Equal(t, "Equal", toleration["operator"])
+				assert.Equal(t, "dr", toleration["value"])
+				assert.Equal(t, "NoSchedule", toleration["effect"])
+
+				// unmapped priority class is kept
+				assert.Equal(t, "prod-critical", spec["priorityClassName"])
+			},
+		},
+		{
+			name: "rename zones and topology keys",
+			itemContent: map[string]interface{}{
+				"spec": map[string]interface{}{
+					"affinity": map[string]interface{}{
+						"topologyKey":  "example.com/rack-zone",
+						"nodeSelector": map[string]interface{}{"topology.kubernetes.io/zone": "us-east-1a", "disktype": "us-east-1a"},
+						"nodeAffinity": map[string]interface{}{
+							"requiredDuringSchedulingIgnoredDuringExecution": map[string]interface{}{
+								"nodeSelectorTerms": []interface{}{
+									map[string]interface{}{"matchExpressions": []interface{}{
+										map[string]interface{}{"key": "example.com/rack-zone", "operator": "In", "values": []interface{}{"us-east-1a", "us-east-1b"}},
+									}},
+								},
+							},
+							"preferredDuringSchedulingIgnoredDuringExecution": []interface{}{
+								map[string]interface{}{"weight": int64(10), "preference": map[string]interface{}{"matchExpressions": []interface{}{
+									map[string]interface{}{"key": "topology.kubernetes.io/zone", "operator": "In", "values": []interface{}{"us-east-1c"}},
+								}}},
+							},
+						},
+						"additionalPodAntiAffinity": map[string]interface{}{
+							"preferredDuringSchedulingIgnoredDuringExecution": []interface{}{
+								map[string]interface{}{"weight": int64(1), "podAffinityTerm": map[string]interface{}{"topologyKey": "example.com/rack-zone"}},
+							},
+						},
+					},
+					"topologySpreadConstraints": []interface{}{
+						map[string]interface{}{"maxSkew": int64(1), "topologyKey": "example.com/rack-zone"},
+					},
+				},
+			},
+			scheduling: &SchedulingConfig{
+				TopologyKeys: map[string]string{"example.com/rack-zone": "topology.kubernetes.io/zone"},
+				Zones:        map[string]string{"us-east-1a": "eu-west-1a", "us-east-1b": "eu-west-1b"},
+			},
+			validateFn: func(t *testing.T, spec map[string]interface{}) {
+				affinity := spec["affinity"].(map[string]interface{})
+				assert.Equal(t, "topology.kubernetes.io/zone", affinity["topologyKey"])
+				// Only values of zone labels are zones
+				assert.Equal(t, map[string]interface{}{"topology.kubernetes.io/zone": "eu-west-1a", "disktype": "us-east-1a"}, affinity["nodeSelector"])
+
+				nodeAffinity := affinity["nodeAffinity"].(map[string]interface{})
+				required := nodeAffinity["requiredDuringSchedulingIgnoredDuringExecution"].(map[string]interface{})
+				expression := required["nodeSelectorTerms"].([]interface{})[0].(map[string]interface{})["matchExpressions"].([]interface{})[0].(map[string]interface{})
+				assert.Equal(t, "topology.kubernetes.io/zone", expression["key"])
+				assert.Equal(t, []interface{}{"eu-west-1a", "eu-west-1b"}, expression["values"])
+				preferred := nodeAffinity["preferredDuringSchedulingIgnoredDuringExecution"].([]interface{})[0].(map[string]interface{})
+				expression = preferred["preference"].(map[string]interface{})["matchExpressions"].([]interface{})[0].(map[string]interface{})
+				assert.Equal(t, []interface{}{"us-east-1c"}, expression["values"])
+
+				antiAffinity := affinity["additionalPodAntiAffinity"].(map[string]interface{})
+				term := antiAffinity["preferredDuringSchedulingIgnoredDuringExecution"].([]interface{})[0].(map[string]interface{})["podAffinityTerm"].(map[string]interface{})
+				assert.Equal(t, "topology.kubernetes.io/zone", term["topologyKey"])
+				constraint := spec["topologySpreadConstraints"].([]interface{})[0].(map[string]interface{})
+				assert.Equal(t, "topology.kubernetes.io/zone", constraint["topologyKey"])
+			},
+		},
+		{
+			name:          "no spec field",
+			itemContent:   map[string]interface{}{},
+			scheduling:    &SchedulingConfig{RemoveAffinity: true},
+			expectedError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := plugin.relaxScheduling(tt.itemContent, tt.scheduling)
+
+			if tt.expectedError {
+				assert.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				if tt.validateFn != nil {
+					tt.validateFn(t, tt.itemContent["spec"].(map[string]interface{}))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package plugin
+
+import (
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// AnnotationSchemaVersion is the annotation key used to store the version of the
+// velero-cnpg annotation schema a cluster was backed up with
+const AnnotationSchemaVersion = "velero-cnpg/schema-version"
+
+const (
+	// SchemaVersionInitial is the schema of releases that predate the version annotation:
+	// serverName and backup ID only, always backed up through the barman plugin
+	SchemaVersionInitial = 1
+
+	// SchemaVersionBackupMethod adds the backup method, the pinned Backup CR name
+	// and the VolumeSnapshots of snapshot backups
+	SchemaVersionBackupMethod = 2
+
+	// SchemaVersionIntegrity adds the velero-cnpg/integrity digest of the other annotations
+	SchemaVersionIntegrity = 3
+
+	// CurrentSchemaVersion is the schema written by this release
+	CurrentSchemaVersion = SchemaVersionIntegrity
+)
+
+const (
+	// AnnotationBarmanObjectName is the annotation key holding the barmanObjectName of
+	// clusters backed up by releases that recorded it, for when the spec lacks it
+	AnnotationBarmanObjectName = "velero-cnpg/barmanObjectName"
+
+	// LegacyAnnotationServerName is the serverName key written by early releases
+	LegacyAnnotationServerName = "cnpg.io/serverName"
+
+	// LegacyAnnotationBarmanObjectName is the barmanObjectName key written by early releases
+	LegacyAnnotationBarmanObjectName = "cnpg.io/barmanObjectName"
+)
+
+// legacyAnnotationKeys maps the keys of early releases to their velero-cnpg equivalents
+var legacyAnnotationKeys = map[string]string{
+	LegacyAnnotationServerName:       AnnotationServerName,
+	LegacyAnnotationBarmanObjectName: AnnotationBarmanObjectName,
+}
+
+// annotationMigrations upgrade annotations from the version they are keyed by to the next one
+var annotationMigrations = map[int]func(annotations map[string]interface{}){
+	SchemaVersionInitial: migrateInitialAnnotations,
+}
+
+// migrateInitialAnnotations renames the legacy cnpg.io keys and records the backup
+// method, which the initial schema implied
+func migrateInitialAnnotations(annotations map[string]interface{}) {
+	for legacyKey, key := range legacyAnnotationKeys {
+		value, found := annotations[legacyKey]
+		if !found {
+			continue
+		}
+		if _, found := annotations[key]; !found {
+			annotations[key] = value
+		}
+		delete(annotations, legacyKey)
+	}
+
+	if _, found := annotations[AnnotationBackupMethod]; found {
+		return
+	}
+	if _, found := annotations[AnnotationServerName]; found {
+		annotations[AnnotationBackupMethod] = BackupMethodPlugin
+	}
+}
+
+// annotationSchemaVersion returns the schema version of the annotations. Annotations
+// without a version were written before versioning and use the initial schema.
+func annotationSchemaVersion(annotations map[string]interface{}) (int, error) {
+	value, found := annotations[AnnotationSchemaVersion]
+	if !found {
+		return SchemaVersionInitial, nil
+	}
+
+	valueStr, ok := value.(string)
+	if !ok {
+		return 0, errors.Errorf("%s annotation is not a string", AnnotationSchemaVersion)
+	}
+
+	version, err := strconv.Atoi(valueStr)
+	if err != nil || version < SchemaVersionInitial {
+		return 0, errors.Errorf("invalid %s annotation %q", AnnotationSchemaVersion, valueStr)
+	}
+
+	return version, nil
+}
+
+// migrateAnnotations upgrades the velero-cnpg annotations of a backed-up cluster to the
+// current schema, so the rest of the restore only has to understand the current schema
+func (p *RestorePluginV2) migrateAnnotations(itemContent map[string]interface{}) error {
+	annotations, found, err := nestedMapNoCopy(itemContent, "metadata", "annotations")
+	if err != nil {
+		return errors.Wrap(err, "failed to get annotations")
+	}
+	if !found {
+		return nil
+	}
+
+	version, err := annotationSchemaVersion(annotations)
+	if err != nil {
+		return err
+	}
+	if version > CurrentSchemaVersion {
+		return errors.Errorf("cluster was backed up with annotation schema version %d, this plugin supports up to %d", version, CurrentSchemaVersion)
+	}
+	if version == CurrentSchemaVersion {
+		return nil
+	}
+
+	for ; version < CurrentSchemaVersion; version++ {
+		if migrate, found := annotationMigrations[version]; found {
+			migrate(annotations)
+		}
+	}
+	p.log.Infof("Migrated annotations to schema version %d", CurrentSchemaVersion)
+
+	// Velero-cnpg annotations are only present on clusters backed up by the plugin
+	if hasPluginAnnotations(annotations) {
+		annotations[AnnotationSchemaVersion] = strconv.Itoa(CurrentSchemaVersion)
+	}
+
+	return nil
+}
+
+// hasPluginAnnotations reports whether any annotation was written by the backup plugin
+func hasPluginAnnotations(annotations map[string]interface{}) bool {
+	for _, key := range []string{AnnotationServerName, AnnotationBackupMethod, AnnotationCurrentBackupID} {
+		if _, found := annotations[key]; found {
+			return true
+		}
+	}
+	return false
+}
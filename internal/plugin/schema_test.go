@@ -0,0 +1,116 @@
+package plugin
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrateAnnotations(t *testing.T) {
+	plugin := &RestorePluginV2{
+		log: logrus.New(),
+	}
+
+	tests := []struct {
+		name          string
+		annotations   map[string]interface{}
+		expectedError bool
+		validateFn    func(t *testing.T, annotations map[string]interface{})
+	}{
+		{
+			name: "initial schema is migrated to the plugin backup method",
+			annotations: map[string]interface{}{
+				AnnotationServerName:      "server-1",
+				AnnotationCurrentBackupID: "backup-id-123",
+			},
+			validateFn: func(t *testing.T, annotations map[string]interface{}) {
+				assert.Equal(t, BackupMethodPlugin, annotations[AnnotationBackupMethod])
+				assert.Equal(t, strconv.Itoa(CurrentSchemaVersion), annotations[AnnotationSchemaVersion])
+			},
+		},
+		{
+			name: "legacy cnpg.io keys are renamed",
+			annotations: map[string]interface{}{
+				LegacyAnnotationServerName:       "server-1",
+				LegacyAnnotationBarmanObjectName: "backup-store",
+			},
+			validateFn: func(t *testing.T, annotations map[string]interface{}) {
+				assert.Equal(t, "server-1", annotations[AnnotationServerName])
+				assert.Equal(t, "backup-store", annotations[AnnotationBarmanObjectName])
+				assert.Equal(t, BackupMethodPlugin, annotations[AnnotationBackupMethod])
+				_, hasLegacyServerName := annotations[LegacyAnnotationServerName]
+				assert.False(t, hasLegacyServerName)
+			},
+		},
+		{
+			name: "current keys win over legacy keys",
+			annotations: map[string]interface{}{
+				LegacyAnnotationServerName: "old-server",
+				AnnotationServerName:       "server-1",
+			},
+			validateFn: func(t *testing.T, annotations map[string]interface{}) {
+				assert.Equal(t, "server-1", annotations[AnnotationServerName])
+			},
+		},
+		{
+			name: "current schema is unchanged",
+			annotations: map[string]interface{}{
+				AnnotationServerName:    "server-1",
+				AnnotationBackupMethod:  BackupMethodBarmanObjectStore,
+				AnnotationSchemaVersion: strconv.Itoa(CurrentSchemaVersion),
+			},
+			validateFn: func(t *testing.T, annotations map[string]interface{}) {
+				assert.Equal(t, BackupMethodBarmanObjectStore, annotations[AnnotationBackupMethod])
+			},
+		},
+		{
+			name: "clusters not backed up by the plugin are unchanged",
+			annotations: map[string]interface{}{
+				"other": "value",
+			},
+			validateFn: func(t *testing.T, annotations map[string]interface{}) {
+				assert.Equal(t, map[string]interface{}{"other": "value"}, annotations)
+			},
+		},
+		{
+			name: "newer schema is rejected",
+			annotations: map[string]interface{}{
+				AnnotationServerName:    "server-1",
+				AnnotationSchemaVersion: strconv.Itoa(CurrentSchemaVersion + 1),
+			},
+			expectedError: true,
+		},
+		{
+			name: "invalid schema version",
+			annotations: map[string]interface{}{
+				AnnotationSchemaVersion: "two",
+			},
+			expectedError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			itemContent := map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"name":        "test-cluster",
+					"annotations": tt.annotations,
+				},
+			}
+
+			err := plugin.migrateAnnotations(itemContent)
+
+			if tt.expectedError {
+				assert.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				if tt.validateFn != nil {
+					tt.validateFn(t, itemContent["metadata"].(map[string]interface{})["annotations"].(map[string]interface{}))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/label"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	// seedBackupOperationPrefix prefixes the IDs of seed backup operations
+	seedBackupOperationPrefix = "seed-backup"
+
+	// clusterPhaseHealthy is the status.phase of a CNPG cluster that is up and running
+	clusterPhaseHealthy = "Cluster in healthy state"
+)
+
+// seedBackupOperation identifies the seed backup of a restored cluster
+type seedBackupOperation struct {
+	namespace   string
+	clusterName string
+	backupName  string
+	method      string
+}
+
+// encodeSeedBackupOperationID encodes a seed backup as an operation ID
+func encodeSeedBackupOperationID(op *seedBackupOperation) string {
+	return strings.Join([]string{seedBackupOperationPrefix, op.namespace, op.clusterName, op.backupName, op.method}, "/")
+}
+
+// decodeSeedBackupOperationID decodes an operation ID produced by encodeSeedBackupOperationID
+func decodeSeedBackupOperationID(operationID string) (*seedBackupOperation, error) {
+	parts := strings.Split(operationID, "/")
+	if len(parts) != 5 || parts[0] != seedBackupOperationPrefix || parts[3] == "" {
+		return nil, errors.Errorf("invalid seed backup operation ID %q", operationID)
+	}
+	return &seedBackupOperation{
+		namespace:   parts[1],
+		clusterName: parts[2],
+		backupName:  parts[3],
+		method:      parts[4],
+	}, nil
+}
+
+// newSeedBackupOperation returns the seed backup of a restored cluster, or nil when the
+// cluster will not become healthy on its own: hibernated clusters and replica clusters,
+// which do not archive WAL of their own until they are promoted
+func newSeedBackupOperation(itemContent map[string]interface{}, namespace, clusterName, method string, now time.Time) *seedBackupOperation {
+	if isHibernated(itemContent) {
+		return nil
+	}
+	if enabled, _, _ := unstructured.NestedBool(itemContent, "spec", "replica", "enabled"); enabled {
+		return nil
+	}
+
+	return &seedBackupOperation{
+		namespace:   namespace,
+		clusterName: clusterName,
+		backupName:  fmt.Sprintf("%s-seed-%s", clusterName, now.UTC().Format("20060102150405")),
+		method:      method,
+	}
+}
+
+// seedBackup returns the CNPG Backup CR of a seed backup
+func seedBackup(op *seedBackupOperation, restore *v1.Restore) *unstructured.Unstructured {
+	spec := map[string]interface{}{
+		"cluster": map[string]interface{}{"name": op.clusterName},
+	}
+	if op.method != "" {
+		spec["method"] = op.method
+	}
+	if op.method == BackupMethodPlugin {
+		spec["pluginConfiguration"] = map[string]interface{}{"name": BarmanCloudPluginName}
+	}
+
+	backup := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": cnpgBackupGVR.GroupVersion().String(),
+		"kind":       "Backup",
+		"metadata": map[string]interface{}{
+			"name":      op.backupName,
+			"namespace": op.namespace,
+		},
+		"spec": spec,
+	}}
+	if restore != nil {
+		backup.SetLabels(map[string]string{v1.RestoreNameLabel: label.GetValidName(restore.Name)})
+	}
+	return backup
+}
+
+// seedBackupProgress creates the seed backup once the restored cluster is healthy and
+// reports the operation as completed once the backup has completed, failing it when the
+// backup fails
+func (p *RestorePluginV2) seedBackupProgress(op *seedBackupOperation, restore *v1.Restore) (velero.OperationProgress, error) {
+	progress := velero.OperationProgress{
+		NTotal:         1,
+		OperationUnits: "Backups",
+		Updated:        time.Now(),
+	}
+
+	dynamicClient, err := p.getDynamicClient()
+	if err != nil {
+		return progress, errors.Wrap(err, "failed to create dynamic client")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	backups := dynamicClient.Resource(cnpgBackupGVR).Namespace(op.namespace)
+	backup, err := backups.Get(ctx, op.backupName, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return progress, errors.Wrapf(classifyAPIError(err), "failed to get backup %s/%s", op.namespace, op.backupName)
+	}
+
+	if apierrors.IsNotFound(err) {
+		cluster, err := dynamicClient.Resource(cnpgClusterGVR).Namespace(op.namespace).Get(ctx, op.clusterName, metav1.GetOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return progress, errors.Wrapf(classifyAPIError(err), "failed to get cluster %s/%s", op.namespace, op.clusterName)
+		}
+		var phase string
+		if err == nil {
+			phase, _, _ = unstructured.NestedString(cluster.Object, "status", "phase")
+		}
+		if phase != clusterPhaseHealthy {
+			progress.Description = fmt.Sprintf("Waiting for cluster %s to become healthy", op.clusterName)
+			return progress, nil
+		}
+
+		if _, err := backups.Create(ctx, seedBackup(op, restore), metav1.CreateOptions{}); err != nil && !apierrors.IsAlreadyExists(err) {
+			return progress, errors.Wrapf(classifyAPIError(err), "failed to create backup %s/%s", op.namespace, op.backupName)
+		}
+		p.log.Infof("Created seed backup %s/%s", op.namespace, op.backupName)
+		progress.Description = fmt.Sprintf("Waiting for seed backup %s", op.backupName)
+		return progress, nil
+	}
+
+	phase, _, _ := unstructured.NestedString(backup.Object, "status", "phase")
+	switch phase {
+	case "completed":
+		progress.Completed = true
+		progress.NCompleted = 1
+		progress.Description = fmt.Sprintf("Seed backup %s completed", op.backupName)
+	case "failed":
+		message, _, _ := unstructured.NestedString(backup.Object, "status", "error")
+		progress.Completed = true
+		progress.Err = fmt.Sprintf("seed backup %s/%s of cluster %s failed: %s", op.namespace, op.backupName, op.clusterName, message)
+	default:
+		progress.Description = fmt.Sprintf("Waiting for seed backup %s", op.backupName)
+	}
+
+	return progress, nil
+}
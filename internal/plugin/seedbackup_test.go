@@ -0,0 +1,131 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestNewSeedBackupOperation(t *testing.T) {
+	now := time.Date(2024, 10, 24, 12, 34, 56, 0, time.UTC)
+
+	cluster := createMockArchivingCluster("pg", "default", "pg", nil)
+	op := newSeedBackupOperation(cluster.Object, "default", "pg", BackupMethodPlugin, now)
+	require.NotNil(t, op)
+	assert.Equal(t, "pg-seed-20241024123456", op.backupName)
+
+	decoded, err := decodeSeedBackupOperationID(encodeSeedBackupOperationID(op))
+	require.NoError(t, err)
+	assert.Equal(t, op, decoded)
+
+	_, err = decodeSeedBackupOperationID("poolers/default/pg/pg-rw")
+	assert.Error(t, err)
+
+	hibernated := createMockArchivingCluster("pg", "default", "pg", nil)
+	hibernated.SetAnnotations(map[string]string{AnnotationHibernation: "on"})
+	assert.Nil(t, newSeedBackupOperation(hibernated.Object, "default", "pg", BackupMethodPlugin, now))
+
+	replica := createMockArchivingCluster("pg", "default", "pg", nil)
+	replica.Object["spec"].(map[string]interface{})["replica"] = map[string]interface{}{"enabled": true}
+	assert.Nil(t, newSeedBackupOperation(replica.Object, "default", "pg", BackupMethodPlugin, now))
+}
+
+func TestSeedBackup(t *testing.T) {
+	op := &seedBackupOperation{namespace: "default", clusterName: "pg", backupName: "pg-seed", method: BackupMethodPlugin}
+
+	backup := seedBackup(op, &v1.Restore{ObjectMeta: metav1.ObjectMeta{Name: "restore-1"}})
+	assert.Equal(t, "restore-1", backup.GetLabels()[v1.RestoreNameLabel])
+	method, _, _ := unstructured.NestedString(backup.Object, "spec", "method")
+	assert.Equal(t, BackupMethodPlugin, method)
+	pluginName, _, _ := unstructured.NestedString(backup.Object, "spec", "pluginConfiguration", "name")
+	assert.Equal(t, BarmanCloudPluginName, pluginName)
+
+	op.method = BackupMethodBarmanObjectStore
+	backup = seedBackup(op, nil)
+	_, found, _ := unstructured.NestedFieldNoCopy(backup.Object, "spec", "pluginConfiguration")
+	assert.False(t, found)
+}
+
+func TestSeedBackupProgress(t *testing.T) {
+	op := &seedBackupOperation{namespace: "default", clusterName: "pg", backupName: "pg-seed", method: BackupMethodPlugin}
+	withPhase := func(obj *unstructured.Unstructured, phase string) *unstructured.Unstructured {
+		obj.Object["status"] = map[string]interface{}{"phase": phase}
+		return obj
+	}
+	backup := func(phase string) *unstructured.Unstructured {
+		return withPhase(seedBackup(op, nil), phase)
+	}
+
+	tests := []struct {
+		name              string
+		objects           []runtime.Object
+		expectCompleted   bool
+		expectCreated     bool
+		expectedErr       string
+		expectDescription string
+	}{
+		{
+			name:              "cluster not restored yet",
+			expectDescription: "Waiting for cluster pg to become healthy",
+		},
+		{
+			name:              "cluster recovering",
+			objects:           []runtime.Object{withPhase(createMockArchivingCluster("pg", "default", "pg", nil), "Setting up primary")},
+			expectDescription: "Waiting for cluster pg to become healthy",
+		},
+		{
+			name:              "cluster healthy",
+			objects:           []runtime.Object{withPhase(createMockArchivingCluster("pg", "default", "pg", nil), clusterPhaseHealthy)},
+			expectCreated:     true,
+			expectDescription: "Waiting for seed backup pg-seed",
+		},
+		{
+			name:              "backup running",
+			objects:           []runtime.Object{backup("running")},
+			expectCreated:     true,
+			expectDescription: "Waiting for seed backup pg-seed",
+		},
+		{
+			name:              "backup completed",
+			objects:           []runtime.Object{backup("completed")},
+			expectCreated:     true,
+			expectCompleted:   true,
+			expectDescription: "Seed backup pg-seed completed",
+		},
+		{
+			name:            "backup failed",
+			objects:         []runtime.Object{backup("failed")},
+			expectCreated:   true,
+			expectCompleted: true,
+			expectedErr:     "seed backup default/pg-seed of cluster pg failed",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dynamicClient := newFakeDynamicClient(tt.objects...)
+			plugin := &RestorePluginV2{log: logrus.New(), dynamicClient: dynamicClient}
+
+			progress, err := plugin.seedBackupProgress(op, nil)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectCompleted, progress.Completed)
+			assert.Equal(t, tt.expectDescription, progress.Description)
+			if tt.expectedErr != "" {
+				assert.Contains(t, progress.Err, tt.expectedErr)
+			} else {
+				assert.Empty(t, progress.Err)
+			}
+
+			_, err = dynamicClient.Resource(cnpgBackupGVR).Namespace("default").Get(context.Background(), "pg-seed", metav1.GetOptions{})
+			assert.Equal(t, tt.expectCreated, err == nil)
+		})
+	}
+}
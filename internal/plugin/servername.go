@@ -0,0 +1,276 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+)
+
+// defaultServerNameWebhookTimeout bounds the requests of the webhook serverName strategy
+// when its timeout is not set
+const defaultServerNameWebhookTimeout = 10 * time.Second
+
+// serverNamePattern matches the serverNames a strategy may return. serverNames are object
+// store prefixes, so they are restricted to characters safe in every provider's paths.
+var serverNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+
+// ServerNameStrategy names the new serverName a restored cluster archives WAL to, so
+// organizations with their own barman prefix conventions can plug them in
+type ServerNameStrategy interface {
+	// ServerName returns the new serverName of the restored cluster
+	ServerName(ctx context.Context, request ServerNameRequest) (string, error)
+}
+
+// ServerNameRequest describes the restored cluster a new serverName is named for. It is
+// also the body POSTed to the webhook strategy.
+type ServerNameRequest struct {
+	// Namespace is the namespace of the cluster in the backup
+	Namespace string `json:"namespace"`
+
+	// ClusterName is the name of the cluster
+	ClusterName string `json:"clusterName"`
+
+	// ServerName is the serverName the cluster was backed up with, empty when it had none
+	ServerName string `json:"serverName,omitempty"`
+
+	// KnownServerNames are the serverNames the cluster and its earlier generations are
+	// known to have archived to, which the new one must not reuse
+	KnownServerNames []string `json:"knownServerNames,omitempty"`
+
+	// LiveServerNames are the serverNames other live clusters archive to in the object
+	// stores of the cluster, which the new one must not reuse either
+	LiveServerNames []string `json:"liveServerNames,omitempty"`
+
+	// RestoreName is the name of the Velero restore
+	RestoreName string `json:"restoreName,omitempty"`
+
+	// RestoreUID is the UID of the Velero restore
+	RestoreUID string `json:"restoreUID,omitempty"`
+}
+
+// serverNameResponse is the response of the webhook strategy
+type serverNameResponse struct {
+	ServerName string `json:"serverName"`
+}
+
+// serverNameStrategy returns the strategy the configuration selects
+func (c *ServerNameStrategyConfig) serverNameStrategy() ServerNameStrategy {
+	if c == nil {
+		return timestampServerNames{}
+	}
+	switch c.Type {
+	case ServerNameRestoreUID:
+		return restoreUIDServerNames{}
+	case ServerNameSequence:
+		return sequenceServerNames{}
+	case ServerNameWebhook:
+		timeout := defaultServerNameWebhookTimeout
+		if parsed, err := time.ParseDuration(c.Webhook.Timeout); err == nil && parsed > 0 {
+			timeout = parsed
+		}
+		return &webhookServerNames{url: c.Webhook.URL, client: &http.Client{Timeout: timeout}}
+	default:
+		return timestampServerNames{}
+	}
+}
+
+// timestampServerNames names serverNames <cluster>-<YYYYMMDD-HHMMSS>-<random suffix>
+type timestampServerNames struct{}
+
+// ServerName returns a new timestamped serverName
+func (timestampServerNames) ServerName(_ context.Context, request ServerNameRequest) (string, error) {
+	timestamp := time.Now().Format("20060102-150405")
+	// The random suffix keeps clusters restored within the same second apart
+	return fmt.Sprintf("%s-%s-%s", request.ClusterName, timestamp, utilrand.String(serverNameSuffixLength)), nil
+}
+
+// restoreUIDServerNames names serverNames <namespace>-<cluster>-<restore UID>, so every
+// serverName of a restore can be traced back to it. The namespace keeps apart clusters of
+// the same name restored from different namespaces to a shared destinationPath.
+type restoreUIDServerNames struct{}
+
+// ServerName returns the serverName of the cluster for the restore
+func (restoreUIDServerNames) ServerName(_ context.Context, request ServerNameRequest) (string, error) {
+	if request.RestoreUID == "" {
+		return "", errors.Errorf("serverNameStrategy %s requires the UID of the Velero restore", ServerNameRestoreUID)
+	}
+	return request.Namespace + "-" + request.ClusterName + "-" + request.RestoreUID, nil
+}
+
+// sequenceServerNames names serverNames <cluster>-<n>, numbering the generations of a
+// cluster from the highest number among its known serverNames and those live clusters
+// archive to, so restoring the same backup again moves on to the next number. Restores
+// running at the same time can still both name the same number before either cluster
+// exists.
+type sequenceServerNames struct{}
+
+// ServerName returns the serverName following the known and live ones
+func (sequenceServerNames) ServerName(_ context.Context, request ServerNameRequest) (string, error) {
+	prefix := request.ClusterName + "-"
+	highest := 0
+	for _, known := range append(append([]string{}, request.KnownServerNames...), request.LiveServerNames...) {
+		if !strings.HasPrefix(known, prefix) {
+			continue
+		}
+		if number, err := strconv.Atoi(strings.TrimPrefix(known, prefix)); err == nil && number > highest {
+			highest = number
+		}
+	}
+	return prefix + strconv.Itoa(highest+1), nil
+}
+
+// webhookServerNames asks an external webhook for serverNames. The request is POSTed as
+// JSON and the webhook answers with {"serverName": "..."}.
+type webhookServerNames struct {
+	url    string
+	client *http.Client
+}
+
+// ServerName returns the serverName the webhook names
+func (w *webhookServerNames) ServerName(ctx context.Context, request ServerNameRequest) (string, error) {
+	var response serverNameResponse
+	if err := postJSON(ctx, w.client, w.url, "serverName webhook", request, &response); err != nil {
+		return "", err
+	}
+	return response.ServerName, nil
+}
+
+// knownServerNames returns the serverNames a cluster is known to have archived to: its
+// current ones, and those recorded in its lineage, history and backups
+func (p *RestorePluginV2) knownServerNames(itemContent map[string]interface{}) []string {
+	var known []string
+	seen := map[string]bool{}
+	add := func(serverName string) {
+		if serverName != "" && !seen[serverName] {
+			seen[serverName] = true
+			known = append(known, serverName)
+		}
+	}
+
+	annotations := (&unstructured.Unstructured{Object: itemContent}).GetAnnotations()
+	for _, key := range []string{AnnotationServerNameLineage, AnnotationBackupServerNames} {
+		var serverNames []string
+		if err := json.Unmarshal([]byte(annotations[key]), &serverNames); err == nil {
+			for _, serverName := range serverNames {
+				add(serverName)
+			}
+		}
+	}
+	var history []serverNameHistoryEntry
+	if err := json.Unmarshal([]byte(annotations[AnnotationServerNameHistory]), &history); err == nil {
+		for _, entry := range history {
+			add(entry.ServerName)
+		}
+	}
+	add(annotations[AnnotationServerName])
+	for _, location := range archiveLocations(itemContent) {
+		add(location.serverName)
+	}
+	return known
+}
+
+// liveServerNames returns the serverNames other live clusters archive to in the object
+// stores of the cluster. A destinationPath may be shared by clusters of every namespace,
+// while an ObjectStore is only used by clusters of its own namespace.
+func (p *RestorePluginV2) liveServerNames(ctx context.Context, itemContent map[string]interface{}) ([]string, error) {
+	locations := archiveLocations(itemContent)
+	if len(locations) == 0 {
+		return nil, nil
+	}
+
+	dynamicClient, err := p.getDynamicClient()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create dynamic client")
+	}
+	clusters, err := dynamicClient.Resource(cnpgClusterGVR).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrap(classifyAPIError(err), "failed to list clusters")
+	}
+
+	cluster := &unstructured.Unstructured{Object: itemContent}
+	var live []string
+	seen := map[string]bool{}
+	for _, other := range clusters.Items {
+		if other.GetNamespace() == cluster.GetNamespace() && other.GetName() == cluster.GetName() {
+			continue
+		}
+		for _, otherLocation := range archiveLocations(other.Object) {
+			for _, location := range locations {
+				if otherLocation.store != location.store || seen[otherLocation.serverName] {
+					continue
+				}
+				if strings.HasPrefix(location.store, "ObjectStore ") && other.GetNamespace() != cluster.GetNamespace() {
+					continue
+				}
+				seen[otherLocation.serverName] = true
+				live = append(live, otherLocation.serverName)
+			}
+		}
+	}
+	sort.Strings(live)
+
+	return live, nil
+}
+
+// nextServerName names a new serverName for the restored cluster with the configured
+// strategy. A serverName that is not a safe object store prefix, that the cluster already
+// archived to or that a live cluster archives to is an error, since archiving to it could
+// overwrite WAL. When the live clusters cannot be listed, the sequence strategy fails, as
+// it would name the serverName an earlier restore of the same backup took, and the other
+// strategies go on with a warning in the plugin log.
+func (p *RestorePluginV2) nextServerName(itemContent map[string]interface{}, restore *v1.Restore, strategy *ServerNameStrategyConfig) (string, error) {
+	cluster := &unstructured.Unstructured{Object: itemContent}
+	request := ServerNameRequest{
+		Namespace:        cluster.GetNamespace(),
+		ClusterName:      cluster.GetName(),
+		ServerName:       cluster.GetAnnotations()[AnnotationServerName],
+		KnownServerNames: p.knownServerNames(itemContent),
+	}
+	if restore != nil {
+		request.RestoreName = restore.Name
+		request.RestoreUID = string(restore.UID)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	live, err := p.liveServerNames(ctx, itemContent)
+	if err != nil {
+		if strategy != nil && strategy.Type == ServerNameSequence {
+			return "", errors.Wrapf(err, "serverNameStrategy %s cannot check the serverNames of live clusters", ServerNameSequence)
+		}
+		p.log.Warnf("Cannot check the serverNames of live clusters, naming a new serverName without them: %v", err)
+	}
+	request.LiveServerNames = live
+
+	serverName, err := strategy.serverNameStrategy().ServerName(ctx, request)
+	if err != nil {
+		return "", err
+	}
+	if !serverNamePattern.MatchString(serverName) {
+		return "", errors.Errorf("invalid serverName %q, expected up to 128 letters, digits, '.', '_' or '-'", serverName)
+	}
+	for _, known := range request.KnownServerNames {
+		if serverName == known {
+			return "", errors.Errorf("serverName %s was already archived to by the cluster", serverName)
+		}
+	}
+	for _, other := range request.LiveServerNames {
+		if serverName == other {
+			return "", errors.Errorf("serverName %s is archived to by a live cluster", serverName)
+		}
+	}
+	return serverName, nil
+}
@@ -0,0 +1,186 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestServerNameStrategies(t *testing.T) {
+	request := ServerNameRequest{
+		Namespace:        "default",
+		ClusterName:      "pg",
+		KnownServerNames: []string{"pg", "pg-2", "pg-10", "pg-old", "other-12"},
+		RestoreUID:       "3f2a1c9e-0000-4000-8000-000000000000",
+	}
+	ctx := context.Background()
+
+	serverName, err := restoreUIDServerNames{}.ServerName(ctx, request)
+	require.NoError(t, err)
+	assert.Equal(t, "default-pg-3f2a1c9e-0000-4000-8000-000000000000", serverName)
+
+	_, err = restoreUIDServerNames{}.ServerName(ctx, ServerNameRequest{ClusterName: "pg"})
+	assert.Error(t, err)
+
+	serverName, err = sequenceServerNames{}.ServerName(ctx, request)
+	require.NoError(t, err)
+	assert.Equal(t, "pg-11", serverName)
+
+	serverName, err = sequenceServerNames{}.ServerName(ctx, ServerNameRequest{ClusterName: "pg", KnownServerNames: []string{"pg"}})
+	require.NoError(t, err)
+	assert.Equal(t, "pg-1", serverName)
+
+	request.LiveServerNames = []string{"pg-12", "other-20"}
+	serverName, err = sequenceServerNames{}.ServerName(ctx, request)
+	require.NoError(t, err)
+	assert.Equal(t, "pg-13", serverName)
+}
+
+func TestWebhookServerNames(t *testing.T) {
+	var received ServerNameRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+		switch received.ClusterName {
+		case "pg":
+			_, _ = w.Write([]byte(`{"serverName":"team-a/pg"}`))
+		case "broken":
+			_, _ = w.Write([]byte(`not json`))
+		default:
+			http.Error(w, "unknown cluster", http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	strategy := (&ServerNameStrategyConfig{Type: ServerNameWebhook, Webhook: &ServerNameWebhookConfig{URL: server.URL}}).serverNameStrategy()
+
+	serverName, err := strategy.ServerName(context.Background(), ServerNameRequest{Namespace: "default", ClusterName: "pg", ServerName: "pg"})
+	require.NoError(t, err)
+	assert.Equal(t, "team-a/pg", serverName)
+	assert.Equal(t, ServerNameRequest{Namespace: "default", ClusterName: "pg", ServerName: "pg"}, received)
+
+	_, err = strategy.ServerName(context.Background(), ServerNameRequest{ClusterName: "broken"})
+	assert.ErrorContains(t, err, "failed to decode")
+
+	_, err = strategy.ServerName(context.Background(), ServerNameRequest{ClusterName: "unknown"})
+	assert.ErrorContains(t, err, "400 Bad Request: unknown cluster")
+}
+
+func TestNextServerName(t *testing.T) {
+	newItem := func() map[string]interface{} {
+		item := createMockPluginCluster("pg", "default").Object
+		item["metadata"].(map[string]interface{})["annotations"] = map[string]interface{}{
+			AnnotationServerName:        "pg",
+			AnnotationServerNameLineage: `["pg-1"]`,
+			AnnotationServerNameHistory: `[{"serverName":"pg-2","since":"2024-10-24T12:34:56Z"}]`,
+		}
+		return item
+	}
+	restore := &v1.Restore{ObjectMeta: metav1.ObjectMeta{Name: "dr-drill", UID: "abc"}}
+	plugin := &RestorePluginV2{log: logrus.New(), dynamicClient: newFakeDynamicClient()}
+
+	assert.Equal(t, []string{"pg-1", "pg-2", "pg"}, plugin.knownServerNames(newItem()))
+
+	tests := []struct {
+		name          string
+		strategy      *ServerNameStrategyConfig
+		objects       []runtime.Object
+		listErr       bool
+		expected      string
+		expectedError string
+	}{
+		{name: "default", expected: ""},
+		{name: "restore UID", strategy: &ServerNameStrategyConfig{Type: ServerNameRestoreUID}, expected: "default-pg-abc"},
+		{name: "sequence", strategy: &ServerNameStrategyConfig{Type: ServerNameSequence}, expected: "pg-3"},
+		{
+			name:     "sequence after a live cluster restored from the same backup",
+			strategy: &ServerNameStrategyConfig{Type: ServerNameSequence},
+			objects: []runtime.Object{
+				createMockPluginCluster("pg-copy", "default"),
+				createMockArchivingCluster("pg-drill", "default", "pg-3", nil),
+				// An ObjectStore of the same name in another namespace is another store
+				createMockArchivingCluster("pg", "staging", "pg-7", nil),
+			},
+			expected: "pg-4",
+		},
+		{
+			name:          "sequence without the live clusters",
+			strategy:      &ServerNameStrategyConfig{Type: ServerNameSequence},
+			listErr:       true,
+			expectedError: "cannot check the serverNames of live clusters",
+		},
+		{name: "restore UID without the live clusters", strategy: &ServerNameStrategyConfig{Type: ServerNameRestoreUID}, listErr: true, expected: "default-pg-abc"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dynamicClient := newFakeDynamicClient(tt.objects...)
+			if tt.listErr {
+				dynamicClient.PrependReactor("list", "clusters", func(k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, errors.New("connection refused")
+				})
+			}
+			plugin := &RestorePluginV2{log: logrus.New(), dynamicClient: dynamicClient}
+
+			serverName, err := plugin.nextServerName(newItem(), restore, tt.strategy)
+			if tt.expectedError != "" {
+				assert.ErrorContains(t, err, tt.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			if tt.expected == "" {
+				assert.Regexp(t, `^pg-\d{8}-\d{6}-[a-z0-9]{5}$`, serverName)
+			} else {
+				assert.Equal(t, tt.expected, serverName)
+			}
+		})
+	}
+
+	t.Run("serverName of a live cluster", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(`{"serverName":"pg-drill"}`))
+		}))
+		defer server.Close()
+		strategy := &ServerNameStrategyConfig{Type: ServerNameWebhook, Webhook: &ServerNameWebhookConfig{URL: server.URL}}
+		plugin := &RestorePluginV2{log: logrus.New(), dynamicClient: newFakeDynamicClient(createMockPluginCluster("pg-drill", "default"))}
+
+		_, err := plugin.nextServerName(newItem(), restore, strategy)
+		assert.ErrorContains(t, err, "archived to by a live cluster")
+	})
+
+	t.Run("webhook names", func(t *testing.T) {
+		var response string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(response))
+		}))
+		defer server.Close()
+		strategy := &ServerNameStrategyConfig{Type: ServerNameWebhook, Webhook: &ServerNameWebhookConfig{URL: server.URL}}
+
+		response = `{"serverName":"pg-2"}`
+		_, err := plugin.nextServerName(newItem(), restore, strategy)
+		assert.ErrorContains(t, err, "already archived to")
+
+		response = `{"serverName":"team-a/pg"}`
+		_, err = plugin.nextServerName(newItem(), restore, strategy)
+		assert.ErrorContains(t, err, "invalid serverName")
+
+		response = `{"serverName":""}`
+		_, err = plugin.nextServerName(newItem(), restore, strategy)
+		assert.ErrorContains(t, err, "invalid serverName")
+
+		response = `{"serverName":"prod.pg.v7"}`
+		serverName, err := plugin.nextServerName(newItem(), restore, strategy)
+		require.NoError(t, err)
+		assert.Equal(t, "prod.pg.v7", serverName)
+	})
+}
@@ -0,0 +1,177 @@
+package plugin
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+)
+
+// simulationTimeout bounds reading back what the restore actions created
+const simulationTimeout = 30 * time.Second
+
+// RestoreSimulation is the outcome of running the restore actions over backed-up items
+// without a Kubernetes cluster
+type RestoreSimulation struct {
+	// Restored are the items as they would be restored. Skipped and failed items are left out.
+	Restored []*unstructured.Unstructured `json:"-"`
+
+	// Created are the resources the restore actions create besides the restored items, such
+	// as the override ConfigMap and ScheduledBackups
+	Created []*unstructured.Unstructured `json:"-"`
+
+	// Items reports how each backed-up item was handled
+	Items []SimulatedItem `json:"items"`
+}
+
+// SimulatedItem reports how the restore actions handled a backed-up item
+type SimulatedItem struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+
+	// Skipped is true when the item is left out of the restore
+	Skipped bool `json:"skipped,omitempty"`
+
+	// Error is why the restore of the item fails
+	Error string `json:"error,omitempty"`
+
+	// Warnings are the restore warnings of the item
+	Warnings []string `json:"warnings,omitempty"`
+
+	// AdditionalItems are the items restored before this one, as <resource>/<namespace>/<name>
+	AdditionalItems []string `json:"additionalItems,omitempty"`
+
+	// OperationID tracks the asynchronous operations the restore waits for
+	OperationID string `json:"operationID,omitempty"`
+}
+
+// SimulateRestore runs the cluster and resource patch restore actions over backed-up items
+// with the given configuration, as a restore named restoreName would, against fake clients
+// of an empty destination cluster with CNPG installed. Checks of the destination that would
+// fail without the barman-cloud plugin are skipped; the others find nothing and pass.
+func SimulateRestore(items []*unstructured.Unstructured, config *PluginConfig, restoreName string, log logrus.FieldLogger) (*RestoreSimulation, error) {
+	simulated := *config
+	simulated.SkipPluginCheck = true
+
+	kubeClient := kubefake.NewClientset()
+	kubeClient.Resources = cnpgAPIResources()
+	dynamicClient := newOfflineDynamicClient()
+	clusterAction := &RestorePluginV2{log: log, config: &simulated, dynamicClient: dynamicClient, kubeClient: kubeClient}
+	patchAction := &ResourcePatchRestorePlugin{log: log, config: &simulated}
+
+	restore := &v1.Restore{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      restoreName,
+			Namespace: veleroNamespace(),
+			UID:       types.UID(restoreName),
+		},
+	}
+
+	simulation := &RestoreSimulation{Items: []SimulatedItem{}}
+	statusKeys := make([]string, 0, len(items))
+	for _, backedUp := range items {
+		statusKeys = append(statusKeys, statusKey(backedUp))
+		result := SimulatedItem{Kind: backedUp.GetKind(), Namespace: backedUp.GetNamespace(), Name: backedUp.GetName()}
+
+		var restored runtime.Unstructured = backedUp.DeepCopy()
+		if backedUp.GroupVersionKind().GroupKind() == (schema.GroupKind{Group: cnpgClusterGVR.Group, Kind: "Cluster"}) {
+			out, err := clusterAction.Execute(&velero.RestoreItemActionExecuteInput{
+				Item:           restored,
+				ItemFromBackup: backedUp.DeepCopy(),
+				Restore:        restore,
+			})
+			if err != nil {
+				result.Error = err.Error()
+				simulation.Items = append(simulation.Items, result)
+				continue
+			}
+			restored = out.UpdatedItem
+			result.Skipped = out.SkipRestore
+			result.OperationID = out.OperationID
+			for _, item := range out.AdditionalItems {
+				result.AdditionalItems = append(result.AdditionalItems, item.GroupResource.String()+"/"+item.Namespace+"/"+item.Name)
+			}
+		}
+
+		if !result.Skipped {
+			out, err := patchAction.Execute(&velero.RestoreItemActionExecuteInput{Item: restored, ItemFromBackup: backedUp.DeepCopy(), Restore: restore})
+			if err != nil {
+				result.Error = err.Error()
+				simulation.Items = append(simulation.Items, result)
+				continue
+			}
+			simulation.Restored = append(simulation.Restored, &unstructured.Unstructured{Object: out.UpdatedItem.UnstructuredContent()})
+		}
+		simulation.Items = append(simulation.Items, result)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), simulationTimeout)
+	defer cancel()
+
+	// Warnings went to the status ConfigMap of the restore, which Velero does not restore
+	statusName := StatusConfigMapName(restoreName)
+	configMaps, err := kubeClient.CoreV1().ConfigMaps(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list simulated ConfigMaps")
+	}
+	for i := range configMaps.Items {
+		configMap := &configMaps.Items[i]
+		if configMap.Namespace == restore.Namespace && configMap.Name == statusName {
+			for j, key := range statusKeys {
+				if value, found := configMap.Data[key]; found {
+					simulation.Items[j].Warnings = strings.Split(value, "\n")
+				}
+			}
+			continue
+		}
+
+		// Keep the manifest to what a restored ConfigMap would carry
+		configMap.ManagedFields = nil
+		content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(configMap)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to convert ConfigMap %s/%s", configMap.Namespace, configMap.Name)
+		}
+		unstructured.RemoveNestedField(content, "metadata", "creationTimestamp")
+		created := &unstructured.Unstructured{Object: content}
+		created.SetAPIVersion("v1")
+		created.SetKind("ConfigMap")
+		simulation.Created = append(simulation.Created, created)
+	}
+
+	scheduledBackups, err := dynamicClient.Resource(cnpgScheduledBackupGVR).Namespace(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list simulated ScheduledBackups")
+	}
+	for i := range scheduledBackups.Items {
+		simulation.Created = append(simulation.Created, &scheduledBackups.Items[i])
+	}
+
+	return simulation, nil
+}
+
+// newOfflineDynamicClient returns a fake dynamic client serving the resources the restore
+// action reads, all empty
+func newOfflineDynamicClient() *dynamicfake.FakeDynamicClient {
+	return dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		cnpgBackupGVR:          "BackupList",
+		cnpgClusterGVR:         "ClusterList",
+		volumeSnapshotGVR:      "VolumeSnapshotList",
+		cnpgPoolerGVR:          "PoolerList",
+		cnpgScheduledBackupGVR: "ScheduledBackupList",
+		barmanObjectStoreGVR:   "ObjectStoreList",
+		deploymentGVR:          "DeploymentList",
+		crdGVR:                 "CustomResourceDefinitionList",
+	})
+}
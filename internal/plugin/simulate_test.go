@@ -0,0 +1,71 @@
+package plugin
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestSimulateRestore(t *testing.T) {
+	backedUp := annotatedCluster("pg", "app", map[string]string{
+		AnnotationSchemaVersion:   strconv.Itoa(CurrentSchemaVersion),
+		AnnotationServerName:      "pg",
+		AnnotationBackupMethod:    BackupMethodPlugin,
+		AnnotationCurrentBackupID: "20241024T120000",
+	})
+	skipped := annotatedCluster("skipped", "app", map[string]string{AnnotationSkipRestore: "true"})
+	broken := annotatedCluster("broken", "app", map[string]string{AnnotationBackupMethod: "tape"})
+	pooler := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "postgresql.cnpg.io/v1",
+		"kind":       "Pooler",
+		"metadata":   map[string]interface{}{"name": "pg-rw", "namespace": "app"},
+		"spec":       map[string]interface{}{"instances": int64(3)},
+	}}
+
+	config := DefaultPluginConfig()
+	config.ResourcePatches = []ResourcePatch{
+		{Group: "postgresql.cnpg.io", Kind: "Pooler", MergePatch: []byte(`{"spec":{"instances":1}}`)},
+	}
+
+	simulation, err := SimulateRestore([]*unstructured.Unstructured{broken, backedUp, skipped, pooler}, config, "dr-review", logrus.New())
+	require.NoError(t, err)
+	assert.False(t, config.SkipPluginCheck, "the caller's config is left unchanged")
+
+	require.Len(t, simulation.Items, 4)
+	assert.Contains(t, simulation.Items[0].Error, `unknown backup method "tape"`)
+	assert.Empty(t, simulation.Items[1].Error)
+	assert.False(t, simulation.Items[1].Skipped)
+	assert.True(t, simulation.Items[2].Skipped)
+	assert.Empty(t, simulation.Items[3].Error)
+
+	require.Len(t, simulation.Restored, 2)
+	cluster := simulation.Restored[0]
+	assert.Equal(t, "pg", cluster.GetName())
+	backupID, _, _ := unstructured.NestedString(cluster.Object, "spec", "bootstrap", "recovery", "recoveryTarget", "backupID")
+	assert.Equal(t, "20241024T120000", backupID)
+	instances, _, _ := unstructured.NestedInt64(simulation.Restored[1].Object, "spec", "instances")
+	assert.Equal(t, int64(1), instances)
+
+	require.Len(t, simulation.Created, 1)
+	overrideConfigMap := simulation.Created[0]
+	assert.Equal(t, "ConfigMap", overrideConfigMap.GetKind())
+	assert.Equal(t, "app", overrideConfigMap.GetNamespace())
+	assert.Equal(t, OverrideConfigMapName, overrideConfigMap.GetName())
+}
+
+func TestSimulateRestoreWarnings(t *testing.T) {
+	unmanaged := createMockPluginCluster("legacy", "app")
+
+	simulation, err := SimulateRestore([]*unstructured.Unstructured{unmanaged}, DefaultPluginConfig(), "dr-review", logrus.New())
+	require.NoError(t, err)
+
+	require.Len(t, simulation.Items, 1)
+	require.Len(t, simulation.Items[0].Warnings, 1)
+	assert.Contains(t, simulation.Items[0].Warnings[0], AnnotationBackupMethod)
+	assert.Len(t, simulation.Restored, 1)
+	assert.Empty(t, simulation.Created)
+}
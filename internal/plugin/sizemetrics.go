@@ -0,0 +1,119 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	// AnnotationInstances is the annotation key used to store the number of instances the
+	// cluster ran at backup time
+	AnnotationInstances = "velero-cnpg/instances"
+
+	// AnnotationDatabaseSize is the annotation key used to store the total size of the
+	// cluster's databases at backup time, in bytes
+	AnnotationDatabaseSize = "velero-cnpg/database-size"
+
+	// AnnotationWALRate is the annotation key used to store the average rate the cluster
+	// wrote WAL at since its statistics were reset, in bytes per second
+	AnnotationWALRate = "velero-cnpg/wal-rate"
+)
+
+// databaseSizeCommand is the psql command printing the total size of all databases
+var databaseSizeCommand = []string{
+	"psql", "-XAtq", "-v", "ON_ERROR_STOP=1",
+	"-c", "SELECT sum(pg_database_size(datname))::bigint FROM pg_database",
+}
+
+// walRateCommand is the psql command printing the average WAL rate in bytes per second.
+// pg_stat_wal needs PostgreSQL 14 or later.
+var walRateCommand = []string{
+	"psql", "-XAtq", "-v", "ON_ERROR_STOP=1",
+	"-c", "SELECT round(wal_bytes / greatest(extract(epoch FROM now() - stats_reset), 1))::bigint FROM pg_stat_wal",
+}
+
+// clusterInstances returns the number of instances of a cluster, as reported in its status
+// or requested in its spec
+func clusterInstances(itemContent map[string]interface{}) (int64, bool) {
+	if instances, found, _ := unstructured.NestedInt64(itemContent, "status", "instances"); found && instances > 0 {
+		return instances, true
+	}
+	instances, found, _ := unstructured.NestedInt64(itemContent, "spec", "instances")
+	return instances, found
+}
+
+// annotateSizeMetrics records the instance count, database size and WAL rate of the
+// cluster, so restores can be planned for the storage and time recovery takes. The size
+// and rate are queried on the primary, which hibernated clusters do not have. Failures
+// are logged rather than failing the backup.
+func (p *BackupPluginV2) annotateSizeMetrics(itemContent map[string]interface{}) {
+	if instances, found := clusterInstances(itemContent); found {
+		if err := p.addAnnotation(itemContent, AnnotationInstances, strconv.FormatInt(instances, 10)); err != nil {
+			p.log.Warnf("Failed to annotate instances: %v", err)
+		}
+	}
+
+	if isHibernated(itemContent) {
+		p.log.Info("Cluster is hibernated, not recording its database size and WAL rate")
+		return
+	}
+	primary, _, _ := unstructured.NestedString(itemContent, "status", "currentPrimary")
+	if primary == "" {
+		p.log.Warn("Cluster has no primary, not recording its database size and WAL rate")
+		return
+	}
+
+	podExec, err := p.getPodExec()
+	if err != nil {
+		p.log.Warnf("Failed to create pod exec client, not recording database size and WAL rate: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	namespace := (&unstructured.Unstructured{Object: itemContent}).GetNamespace()
+	for _, metric := range []struct {
+		name       string
+		annotation string
+		command    []string
+	}{
+		{name: "database size", annotation: AnnotationDatabaseSize, command: databaseSizeCommand},
+		{name: "WAL rate", annotation: AnnotationWALRate, command: walRateCommand},
+	} {
+		output, err := podExec(ctx, namespace, primary, postgresContainer, metric.command)
+		if err != nil {
+			p.log.Warnf("Failed to query %s on %s: %v", metric.name, primary, err)
+			continue
+		}
+		value, err := strconv.ParseInt(strings.TrimSpace(output), 10, 64)
+		if err != nil {
+			p.log.Warnf("Unexpected %s %q reported by %s", metric.name, strings.TrimSpace(output), primary)
+			continue
+		}
+		if err := p.addAnnotation(itemContent, metric.annotation, strconv.FormatInt(value, 10)); err != nil {
+			p.log.Warnf("Failed to annotate %s: %v", metric.name, err)
+			continue
+		}
+		p.log.Infof("Annotated cluster with %s: %d", metric.name, value)
+	}
+}
+
+// FormatBytes formats a size in bytes with binary units, e.g. 1.5 GiB
+func FormatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	value, exponent := float64(size)/unit, 0
+	for value >= unit && exponent < 5 {
+		value /= unit
+		exponent++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, "KMGTPE"[exponent])
+}
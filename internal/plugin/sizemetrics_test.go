@@ -0,0 +1,76 @@
+package plugin
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestAnnotateSizeMetrics(t *testing.T) {
+	t.Run("records instances, size and WAL rate", func(t *testing.T) {
+		cluster := createMockPluginCluster("pg", "default")
+		require.NoError(t, unstructured.SetNestedField(cluster.Object, int64(3), "spec", "instances"))
+		require.NoError(t, unstructured.SetNestedField(cluster.Object, int64(2), "status", "instances"))
+		require.NoError(t, unstructured.SetNestedField(cluster.Object, "pg-1", "status", "currentPrimary"))
+
+		plugin := &BackupPluginV2{log: logrus.New(), podExec: func(_ context.Context, namespace, pod, container string, command []string) (string, error) {
+			assert.Equal(t, "default", namespace)
+			assert.Equal(t, "pg-1", pod)
+			assert.Equal(t, postgresContainer, container)
+			if strings.Contains(strings.Join(command, " "), "pg_stat_wal") {
+				return "4096\n", nil
+			}
+			return "1610612736\n", nil
+		}}
+
+		plugin.annotateSizeMetrics(cluster.Object)
+		assert.Equal(t, "2", cluster.GetAnnotations()[AnnotationInstances])
+		assert.Equal(t, "1610612736", cluster.GetAnnotations()[AnnotationDatabaseSize])
+		assert.Equal(t, "4096", cluster.GetAnnotations()[AnnotationWALRate])
+	})
+
+	t.Run("hibernated cluster", func(t *testing.T) {
+		cluster := createMockPluginCluster("pg", "default")
+		require.NoError(t, unstructured.SetNestedField(cluster.Object, int64(3), "spec", "instances"))
+		require.NoError(t, unstructured.SetNestedField(cluster.Object, "pg-1", "status", "currentPrimary"))
+		cluster.SetAnnotations(map[string]string{AnnotationHibernation: "on"})
+
+		plugin := &BackupPluginV2{log: logrus.New(), podExec: func(context.Context, string, string, string, []string) (string, error) {
+			t.Fatal("unexpected exec")
+			return "", nil
+		}}
+
+		plugin.annotateSizeMetrics(cluster.Object)
+		assert.Equal(t, "3", cluster.GetAnnotations()[AnnotationInstances])
+		assert.NotContains(t, cluster.GetAnnotations(), AnnotationDatabaseSize)
+	})
+
+	t.Run("failed queries", func(t *testing.T) {
+		cluster := createMockPluginCluster("pg", "default")
+		require.NoError(t, unstructured.SetNestedField(cluster.Object, "pg-1", "status", "currentPrimary"))
+
+		plugin := &BackupPluginV2{log: logrus.New(), podExec: func(_ context.Context, _, _, _ string, command []string) (string, error) {
+			if strings.Contains(strings.Join(command, " "), "pg_stat_wal") {
+				return "", errors.New(`relation "pg_stat_wal" does not exist`)
+			}
+			return "\n", nil
+		}}
+
+		plugin.annotateSizeMetrics(cluster.Object)
+		assert.NotContains(t, cluster.GetAnnotations(), AnnotationDatabaseSize)
+		assert.NotContains(t, cluster.GetAnnotations(), AnnotationWALRate)
+	})
+}
+
+func TestFormatBytes(t *testing.T) {
+	assert.Equal(t, "512 B", FormatBytes(512))
+	assert.Equal(t, "1.0 KiB", FormatBytes(1024))
+	assert.Equal(t, "1.5 GiB", FormatBytes(1610612736))
+	assert.Equal(t, "2.0 TiB", FormatBytes(2<<40))
+}
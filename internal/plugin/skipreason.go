@@ -0,0 +1,98 @@
+package plugin
+
+import (
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// AnnotationSkipReason is the annotation key used to store why the backup action did not
+// pin a backup ID for the cluster, as one of the SkipReason values
+const AnnotationSkipReason = "velero-cnpg/skip-reason"
+
+const (
+	// SkipReasonPluginDisabled is recorded when the cluster's WAL archiver plugin entry is
+	// disabled and no other backup method is configured
+	SkipReasonPluginDisabled = "plugin-disabled"
+
+	// SkipReasonBackupListFailed is recorded when the cluster's CNPG Backups could not be listed
+	SkipReasonBackupListFailed = "backup-list-failed"
+
+	// SkipReasonInvalidBackup is recorded when the latest completed backup has no usable
+	// backup ID in its status
+	SkipReasonInvalidBackup = "invalid-backup"
+
+	// SkipReasonArchivingFailing is recorded when the cluster has no completed backup and
+	// reports that continuous archiving is failing
+	SkipReasonArchivingFailing = "archiving-failing"
+
+	// SkipReasonNoCompletedBackup is recorded when the cluster has no completed backup
+	SkipReasonNoCompletedBackup = "no-completed-backup"
+)
+
+// knownSkipReason reports whether reason is one the backup action records
+func knownSkipReason(reason string) bool {
+	switch reason {
+	case SkipReasonPluginDisabled, SkipReasonBackupListFailed, SkipReasonInvalidBackup, SkipReasonArchivingFailing, SkipReasonNoCompletedBackup:
+		return true
+	}
+	return false
+}
+
+// conditionContinuousArchiving is the type of the cluster condition CNPG sets to report
+// whether WAL archiving works
+const conditionContinuousArchiving = "ContinuousArchiving"
+
+// archivingFailing reports whether the cluster's ContinuousArchiving condition is False
+func archivingFailing(itemContent map[string]interface{}) bool {
+	conditions, _, _ := unstructured.NestedSlice(itemContent, "status", "conditions")
+	for _, condition := range sliceOfMaps(conditions) {
+		if condition["type"] == conditionContinuousArchiving {
+			return condition["status"] == "False"
+		}
+	}
+	return false
+}
+
+// walArchiverDisabled reports whether the cluster lists a WAL archiver plugin entry that is
+// disabled
+func walArchiverDisabled(itemContent map[string]interface{}) bool {
+	plugins, _, _ := unstructured.NestedSlice(itemContent, "spec", "plugins")
+	entry := walArchiverEntry(plugins, "serverName", true)
+	return entry != nil && !pluginEnabled(entry)
+}
+
+// noCompletedBackupReason returns the skip reason of a cluster without a completed backup
+func noCompletedBackupReason(itemContent map[string]interface{}) string {
+	if archivingFailing(itemContent) {
+		return SkipReasonArchivingFailing
+	}
+	return SkipReasonNoCompletedBackup
+}
+
+// annotateSkipReason records why no backup ID was pinned for the cluster
+func (p *BackupPluginV2) annotateSkipReason(itemContent map[string]interface{}, reason string) {
+	if err := p.addAnnotation(itemContent, AnnotationSkipReason, reason); err != nil {
+		p.log.Warnf("Failed to annotate skip reason: %v", err)
+	}
+}
+
+// handleSkipReason handles a cluster restored in recovery mode without a pinned backup ID
+// according to the policy of the skip reason recorded at backup time: latest recovers
+// from the latest backup in the object store with a restore warning, and fail fails the
+// restore. Clusters backed up before skip reasons were recorded are handled as latest.
+func (p *RestorePluginV2) handleSkipReason(itemContent map[string]interface{}, policies map[string]string, warnings *restoreWarnings) error {
+	reason, found, err := p.getAnnotation(itemContent, AnnotationSkipReason)
+	if err != nil {
+		return err
+	}
+	if !found {
+		warnings.Warnf("No %s annotation found, recovering from the latest backup in the object store", AnnotationCurrentBackupID)
+		return nil
+	}
+
+	if policies[reason] == SkipReasonPolicyFail {
+		return errors.Errorf("no backup ID was pinned when the cluster was backed up (%s), not recovering from the latest backup in the object store (skipReasonPolicies.%s is %s)", reason, reason, SkipReasonPolicyFail)
+	}
+	warnings.Warnf("No backup ID was pinned when the cluster was backed up (%s), recovering from the latest backup in the object store", reason)
+	return nil
+}
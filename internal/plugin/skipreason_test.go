@@ -0,0 +1,146 @@
+package plugin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestBackupExecuteSkipReason(t *testing.T) {
+	invalidBackup := createMockBackup("pg-1", "default", "pg", "completed", "", time.Now())
+	invalidBackup.Object["status"].(map[string]interface{})["backupId"] = int64(1)
+
+	archivingFailed := func(cluster *unstructured.Unstructured) {
+		cluster.Object["status"] = map[string]interface{}{
+			"conditions": []interface{}{
+				map[string]interface{}{"type": conditionContinuousArchiving, "status": "False", "reason": "ContinuousArchivingFailing"},
+			},
+		}
+	}
+
+	tests := []struct {
+		name           string
+		modify         func(cluster *unstructured.Unstructured)
+		backups        []runtime.Object
+		listErr        error
+		expectedReason string
+	}{
+		{
+			name:    "backup pinned",
+			backups: []runtime.Object{createMockBackup("pg-1", "default", "pg", "completed", "20241024T120000", time.Now())},
+		},
+		{
+			name:           "no completed backup",
+			expectedReason: SkipReasonNoCompletedBackup,
+		},
+		{
+			name:           "archiving failing",
+			modify:         archivingFailed,
+			expectedReason: SkipReasonArchivingFailing,
+		},
+		{
+			name:    "archiving failing with a completed backup",
+			modify:  archivingFailed,
+			backups: []runtime.Object{createMockBackup("pg-1", "default", "pg", "completed", "20241024T120000", time.Now())},
+		},
+		{
+			name:           "backups cannot be listed",
+			listErr:        errors.New("connection refused"),
+			expectedReason: SkipReasonBackupListFailed,
+		},
+		{
+			name:           "completed backup with an invalid ID",
+			backups:        []runtime.Object{invalidBackup},
+			expectedReason: SkipReasonInvalidBackup,
+		},
+		{
+			name: "plugin disabled",
+			modify: func(cluster *unstructured.Unstructured) {
+				plugins, _, _ := unstructured.NestedSlice(cluster.Object, "spec", "plugins")
+				plugins[0].(map[string]interface{})["enabled"] = false
+				require.NoError(t, unstructured.SetNestedSlice(cluster.Object, plugins, "spec", "plugins"))
+			},
+			expectedReason: SkipReasonPluginDisabled,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// A reason recorded by an earlier backup is replaced
+			cluster := annotatedCluster("pg", "default", map[string]string{AnnotationSkipReason: SkipReasonBackupListFailed})
+			if tt.modify != nil {
+				tt.modify(cluster)
+			}
+
+			dynamicClient := newFakeDynamicClient(tt.backups...)
+			if tt.listErr != nil {
+				dynamicClient.PrependReactor("list", "backups", func(k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, tt.listErr
+				})
+			}
+			plugin := &BackupPluginV2{
+				log:           logrus.New(),
+				config:        &PluginConfig{},
+				dynamicClient: dynamicClient,
+			}
+
+			result, _, _, _, err := plugin.Execute(cluster, nil)
+			require.NoError(t, err)
+
+			annotations := result.(*unstructured.Unstructured).GetAnnotations()
+			if tt.expectedReason == "" {
+				assert.NotContains(t, annotations, AnnotationSkipReason)
+			} else {
+				assert.Equal(t, tt.expectedReason, annotations[AnnotationSkipReason])
+			}
+		})
+	}
+}
+
+func TestHandleSkipReason(t *testing.T) {
+	policies := map[string]string{SkipReasonArchivingFailing: SkipReasonPolicyFail}
+
+	tests := []struct {
+		name            string
+		annotations     map[string]string
+		expectedWarning string
+		expectedError   string
+	}{
+		{
+			name:            "backed up before skip reasons",
+			expectedWarning: "No velero-cnpg/current-backup-id annotation found",
+		},
+		{
+			name:            "recover from the latest backup",
+			annotations:     map[string]string{AnnotationSkipReason: SkipReasonNoCompletedBackup},
+			expectedWarning: "(no-completed-backup), recovering from the latest backup",
+		},
+		{
+			name:          "refused",
+			annotations:   map[string]string{AnnotationSkipReason: SkipReasonArchivingFailing},
+			expectedError: "skipReasonPolicies.archiving-failing is fail",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			warnings := &restoreWarnings{log: logrus.New()}
+			err := (&RestorePluginV2{log: logrus.New()}).handleSkipReason(annotatedCluster("pg", "default", tt.annotations).Object, policies, warnings)
+			if tt.expectedError != "" {
+				assert.ErrorContains(t, err, tt.expectedError)
+				assert.Empty(t, warnings.messages)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, warnings.messages, 1)
+			assert.Contains(t, warnings.messages[0], tt.expectedWarning)
+		})
+	}
+}
@@ -0,0 +1,845 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	velerov2alpha1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v2alpha1"
+	"github.com/vmware-tanzu/velero/pkg/label"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework/common"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"github.com/vmware-tanzu/velero/pkg/util/boolptr"
+	"github.com/vmware-tanzu/velero/pkg/util/podvolume"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// AnnotationFencedInstances is the CNPG annotation listing fenced instances
+	AnnotationFencedInstances = "cnpg.io/fencedInstances"
+
+	// LabelCluster is the CNPG label holding the cluster a PVC belongs to
+	LabelCluster = "cnpg.io/cluster"
+
+	// LabelInstanceName is the CNPG label holding the instance a PVC belongs to
+	LabelInstanceName = "cnpg.io/instanceName"
+
+	// AnnotationSnapshotFences records, per instance, the backup the snapshot fencing
+	// action fenced the instance for and the PVCs the fence is held for
+	AnnotationSnapshotFences = "velero-cnpg/snapshot-fences"
+)
+
+// fencingOperationTimeout bounds each API interaction of a fencing operation
+const fencingOperationTimeout = 30 * time.Second
+
+// fencingStopTimeout bounds how long Execute waits for a fenced instance to shut
+// PostgreSQL down. CNPG falls back to a fast shutdown after a 180 second smart shutdown.
+const fencingStopTimeout = 5 * time.Minute
+
+// fencingStopInterval is how often the pod of a fenced instance is polled while waiting
+// for it to shut down
+const fencingStopInterval = 2 * time.Second
+
+// cnpgClusterGVR identifies CNPG Cluster resources
+var cnpgClusterGVR = schema.GroupVersionResource{
+	Group:    "postgresql.cnpg.io",
+	Version:  "v1",
+	Resource: "clusters",
+}
+
+// volumeSnapshotGVR identifies CSI VolumeSnapshot resources
+var volumeSnapshotGVR = schema.GroupVersionResource{
+	Group:    "snapshot.storage.k8s.io",
+	Version:  "v1",
+	Resource: "volumesnapshots",
+}
+
+// volumeSnapshotClassGVR identifies CSI VolumeSnapshotClass resources
+var volumeSnapshotClassGVR = schema.GroupVersionResource{
+	Group:    "snapshot.storage.k8s.io",
+	Version:  "v1",
+	Resource: "volumesnapshotclasses",
+}
+
+// dataUploadGVR identifies the DataUpload resources through which Velero's data mover
+// moves CSI snapshots to the backup storage location
+var dataUploadGVR = velerov2alpha1.SchemeGroupVersion.WithResource("datauploads")
+
+// SnapshotFencingPluginV2 fences CNPG instances while Velero takes CSI snapshots of their
+// PVCs, so the snapshots are taken from a cleanly shut down instance instead of a running
+// one. It is registered both as an ItemBlock action and as a v2 backup item action.
+//
+// Velero runs every backup item action of its own, such as the CSI action requesting the
+// VolumeSnapshot, before those of other plugins, so the fence cannot be taken from a backup
+// item action of the PVC. Instead, GetRelatedItems fences the instance while Velero builds
+// the ItemBlock holding the PVC, before any item of the block is backed up, waits for
+// PostgreSQL to shut down and records the fence on the cluster. It returns the other
+// snapshotted PVCs of the instance, so they are backed up in the same block. Execute then
+// claims the recorded fence, and the returned asynchronous operation lifts it once the
+// VolumeSnapshots of every PVC of the instance are ready to use. PVCs Velero does not take
+// CSI snapshots of, such as those backed up by fs-backup, are not fenced.
+type SnapshotFencingPluginV2 struct {
+	log logrus.FieldLogger
+
+	// config overrides the plugin ConfigMap lookup when set
+	config *PluginConfig
+
+	// kubeClient overrides GetClient when set
+	kubeClient kubernetes.Interface
+
+	// dynamicClient overrides GetDynamicClient when set
+	dynamicClient dynamic.Interface
+}
+
+// NewSnapshotFencingPluginV2 instantiates a v2 SnapshotFencingPlugin.
+func NewSnapshotFencingPluginV2(log logrus.FieldLogger) *SnapshotFencingPluginV2 {
+	return &SnapshotFencingPluginV2{log: log}
+}
+
+// getConfig returns the plugin configuration, see loadActionConfig. The ItemBlock action
+// reads the ConfigMap of the backup item action, so one ConfigMap configures both.
+func (p *SnapshotFencingPluginV2) getConfig() (*PluginConfig, error) {
+	return loadActionConfig(p.config, common.PluginKindBackupItemAction, SnapshotFencingPluginName)
+}
+
+// getKubeClient returns the Kubernetes client used to query PVCs and pods
+func (p *SnapshotFencingPluginV2) getKubeClient() (kubernetes.Interface, error) {
+	if p.kubeClient != nil {
+		return p.kubeClient, nil
+	}
+	return GetClient()
+}
+
+// getDynamicClient returns the dynamic client used to query CNPG resources
+func (p *SnapshotFencingPluginV2) getDynamicClient() (dynamic.Interface, error) {
+	if p.dynamicClient != nil {
+		return p.dynamicClient, nil
+	}
+	return GetDynamicClient()
+}
+
+// Name is required to implement the interface, but the Velero pod does not delegate this
+// method -- it's used to tell velero what name it was registered under. The plugin implementation
+// must define it, but it will never actually be called.
+func (p *SnapshotFencingPluginV2) Name() string {
+	return "cnpgSnapshotFencingPlugin"
+}
+
+// AppliesTo returns information about which resources this action should be invoked for.
+// Only PVCs created by CNPG for a cluster instance are selected.
+func (p *SnapshotFencingPluginV2) AppliesTo() (velero.ResourceSelector, error) {
+	config, err := p.getConfig()
+	if err != nil {
+		return noNamespaces(), err
+	}
+	return config.scopeNamespaces(velero.ResourceSelector{
+		IncludedResources: []string{"persistentvolumeclaims"},
+		LabelSelector:     LabelCluster + "," + LabelInstanceName,
+	}), nil
+}
+
+// GetRelatedItems fences the instance owning the PVC before Velero backs up the ItemBlock
+// holding it, waits for the instance to shut down and returns the other PVCs of the
+// instance Velero takes CSI snapshots of
+func (p *SnapshotFencingPluginV2) GetRelatedItems(item runtime.Unstructured, backup *v1.Backup) (_ []velero.ResourceIdentifier, err error) {
+	defer reportError(p.log, "snapshot fencing plugin", item, &err)
+	defer recoverPanic(p.log, "snapshot fencing plugin", item, &err)
+
+	config, err := p.getConfig()
+	if err != nil {
+		return nil, err
+	}
+	if config.SnapshotFencing == nil || !config.SnapshotFencing.Enabled {
+		return nil, nil
+	}
+
+	if backup != nil && backup.Spec.SnapshotVolumes != nil && !*backup.Spec.SnapshotVolumes {
+		p.log.Info("Backup does not snapshot volumes, skipping fencing")
+		return nil, nil
+	}
+
+	pvc := &unstructured.Unstructured{Object: item.UnstructuredContent()}
+	namespace := pvc.GetNamespace()
+	clusterName := pvc.GetLabels()[LabelCluster]
+	instance := pvc.GetLabels()[LabelInstanceName]
+	if clusterName == "" || instance == "" {
+		return nil, nil
+	}
+
+	claim := &corev1.PersistentVolumeClaim{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(pvc.Object, claim); err != nil {
+		return nil, errors.Wrap(err, "failed to convert PVC")
+	}
+
+	kubeClient, err := p.getKubeClient()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get Kubernetes client")
+	}
+	dynamicClient, err := p.getDynamicClient()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create dynamic client")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), fencingOperationTimeout)
+	defer cancel()
+
+	if config.SnapshotFencing.Instances != FencingInstancesAll || config.OptIn {
+		cluster, err := dynamicClient.Resource(cnpgClusterGVR).Namespace(namespace).Get(ctx, clusterName, metav1.GetOptions{})
+		if err != nil {
+			return nil, errors.Wrapf(classifyAPIError(err), "failed to get cluster %s/%s", namespace, clusterName)
+		}
+		if config.OptIn && !optedIn(cluster) {
+			p.log.Infof("Cluster %s/%s has no %s=true annotation, skipping fencing", namespace, clusterName, AnnotationEnabled)
+			return nil, nil
+		}
+		primary, _, _ := unstructured.NestedString(cluster.Object, "status", "currentPrimary")
+		if config.SnapshotFencing.Instances != FencingInstancesAll && primary != instance {
+			p.log.Infof("Instance %s is not the primary of cluster %s/%s, skipping fencing", instance, namespace, clusterName)
+			return nil, nil
+		}
+	}
+
+	reason, err := csiSnapshotSkipReason(ctx, kubeClient, dynamicClient, backup, claim)
+	if err != nil {
+		return nil, err
+	}
+	if reason != "" {
+		p.log.Infof("PVC %s/%s %s, skipping fencing", namespace, claim.Name, reason)
+		return nil, nil
+	}
+
+	pvcs, err := instanceSnapshotPVCs(ctx, kubeClient, dynamicClient, backup, claim)
+	if err != nil {
+		return nil, err
+	}
+
+	// A snapshot requested before the fence is taken from the running instance, which is
+	// what fencing is meant to prevent
+	for _, name := range pvcs {
+		snapshot, err := findVolumeSnapshot(ctx, dynamicClient, namespace, name, backup.Name)
+		if err != nil {
+			return nil, err
+		}
+		if snapshot != nil {
+			return nil, errors.Errorf("VolumeSnapshot %s of PVC %s/%s was requested before instance %s was fenced, so it is taken from the running instance",
+				snapshot.GetName(), namespace, name, instance)
+		}
+	}
+
+	fenced, err := fenceInstance(ctx, dynamicClient, namespace, clusterName, instance, &snapshotFence{Backup: backup.Name, PVCs: pvcs})
+	if err != nil {
+		return nil, err
+	}
+	if !fenced {
+		// Either this backup fenced it for another PVC of the instance, whose related items
+		// include this PVC, or someone else did; in both cases lifting the fence is left to them
+		p.log.Infof("Instance %s of cluster %s/%s is already fenced", instance, namespace, clusterName)
+		return nil, nil
+	}
+
+	p.log.Infof("Fenced instance %s of cluster %s/%s for snapshot of PVCs %s", instance, namespace, clusterName, strings.Join(pvcs, ", "))
+
+	stopCtx, stopCancel := context.WithTimeout(context.Background(), fencingStopTimeout)
+	defer stopCancel()
+	if err := waitForInstanceStopped(stopCtx, kubeClient, namespace, instance); err != nil {
+		// Lift the fence right away, rather than leaving the instance down for a backup
+		// that snapshots it while it is still running
+		unfenceCtx, unfenceCancel := context.WithTimeout(context.Background(), fencingOperationTimeout)
+		defer unfenceCancel()
+		if unfenceErr := unfenceInstance(unfenceCtx, dynamicClient, namespace, clusterName, instance); unfenceErr != nil {
+			p.log.WithError(unfenceErr).Errorf("Failed to unfence instance %s of cluster %s/%s", instance, namespace, clusterName)
+		}
+		return nil, err
+	}
+
+	p.log.Infof("Instance %s of cluster %s/%s shut down", instance, namespace, clusterName)
+
+	var related []velero.ResourceIdentifier
+	for _, name := range pvcs {
+		if name != claim.Name {
+			related = append(related, velero.ResourceIdentifier{
+				GroupResource: schema.GroupResource{Resource: "persistentvolumeclaims"},
+				Namespace:     namespace,
+				Name:          name,
+			})
+		}
+	}
+	return related, nil
+}
+
+// Execute claims the fence GetRelatedItems recorded for the instance owning the PVC and
+// returns an operation ID that tracks the VolumeSnapshots of the PVCs of the instance.
+// Only the first PVC of the instance claims it; the others are tracked by its operation.
+func (p *SnapshotFencingPluginV2) Execute(item runtime.Unstructured, backup *v1.Backup) (_ runtime.Unstructured, _ []velero.ResourceIdentifier, _ string, _ []velero.ResourceIdentifier, err error) {
+	defer reportError(p.log, "snapshot fencing plugin", item, &err)
+	defer recoverPanic(p.log, "snapshot fencing plugin", item, &err)
+
+	config, err := p.getConfig()
+	if err != nil {
+		return nil, nil, "", nil, err
+	}
+	if config.SnapshotFencing == nil || !config.SnapshotFencing.Enabled {
+		return item, nil, "", nil, nil
+	}
+
+	pvc := &unstructured.Unstructured{Object: item.UnstructuredContent()}
+	namespace := pvc.GetNamespace()
+	clusterName := pvc.GetLabels()[LabelCluster]
+	instance := pvc.GetLabels()[LabelInstanceName]
+	if clusterName == "" || instance == "" {
+		return item, nil, "", nil, nil
+	}
+
+	dynamicClient, err := p.getDynamicClient()
+	if err != nil {
+		return nil, nil, "", nil, errors.Wrap(err, "failed to create dynamic client")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), fencingOperationTimeout)
+	defer cancel()
+
+	fence, err := claimSnapshotFence(ctx, dynamicClient, namespace, clusterName, instance, backup.Name)
+	if err != nil {
+		return nil, nil, "", nil, err
+	}
+	if fence == nil {
+		return item, nil, "", nil, nil
+	}
+
+	p.log.Infof("Tracking the fence of instance %s of cluster %s/%s until the snapshots of PVCs %s are taken", instance, namespace, clusterName, strings.Join(fence.PVCs, ", "))
+
+	operationID := encodeFencingOperationID(namespace, clusterName, instance, fence.PVCs, time.Now())
+	return item, nil, operationID, nil, nil
+}
+
+// Progress reports the fencing operation as completed once the VolumeSnapshots of every
+// PVC of the instance are ready to use, lifting the fence at that point. With
+// --snapshot-move-data, Velero creates the PVC's DataUpload only once the snapshot handle
+// of the VolumeSnapshot's content is set, which means the storage cut the snapshot, and
+// deletes the snapshot after the data is moved. The fence is taken before the VolumeSnapshot
+// is requested, so a DataUpload for the PVC completes its snapshot as well.
+func (p *SnapshotFencingPluginV2) Progress(operationID string, backup *v1.Backup) (velero.OperationProgress, error) {
+	progress := velero.OperationProgress{}
+
+	op, err := decodeFencingOperationID(operationID)
+	if err != nil {
+		return progress, err
+	}
+	progress.Started = op.started
+	progress.Updated = time.Now()
+	progress.NTotal = int64(len(op.pvcs))
+	progress.OperationUnits = "VolumeSnapshots"
+
+	dynamicClient, err := p.getDynamicClient()
+	if err != nil {
+		return progress, errors.Wrap(err, "failed to create dynamic client")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), fencingOperationTimeout)
+	defer cancel()
+
+	var descriptions, failures []string
+	for _, pvc := range op.pvcs {
+		state, err := pvcSnapshotState(ctx, dynamicClient, backup, op.namespace, pvc)
+		if err != nil {
+			return progress, err
+		}
+		descriptions = append(descriptions, state.description)
+		if state.failure != "" {
+			failures = append(failures, state.failure)
+		}
+		if state.done {
+			progress.NCompleted++
+		}
+	}
+	if progress.NCompleted < progress.NTotal {
+		progress.Description = strings.Join(descriptions, "; ")
+		return progress, nil
+	}
+
+	if err := unfenceInstance(ctx, dynamicClient, op.namespace, op.cluster, op.instance); err != nil {
+		return progress, err
+	}
+	p.log.Infof("Unfenced instance %s of cluster %s/%s", op.instance, op.namespace, op.cluster)
+
+	progress.Completed = true
+	progress.Err = strings.Join(failures, "; ")
+	progress.Description = fmt.Sprintf("%s, instance %s unfenced", strings.Join(descriptions, "; "), op.instance)
+	return progress, nil
+}
+
+// pvcSnapshot is the state of the snapshot of a PVC tracked by a fencing operation
+type pvcSnapshot struct {
+	// done is set once the snapshot no longer needs the instance fenced
+	done bool
+
+	// failure is why the snapshot failed
+	failure string
+
+	description string
+}
+
+// pvcSnapshotState returns the state of the VolumeSnapshot Velero takes of the PVC in the
+// backup, or of the DataUpload that took it over for backups with --snapshot-move-data
+func pvcSnapshotState(ctx context.Context, dynamicClient dynamic.Interface, backup *v1.Backup, namespace, pvc string) (pvcSnapshot, error) {
+	snapshot, err := findVolumeSnapshot(ctx, dynamicClient, namespace, pvc, backup.Name)
+	if err != nil {
+		return pvcSnapshot{}, err
+	}
+
+	if snapshot != nil {
+		if message, found, _ := unstructured.NestedString(snapshot.Object, "status", "error", "message"); found && message != "" {
+			return pvcSnapshot{
+				done:        true,
+				failure:     fmt.Sprintf("VolumeSnapshot %s failed: %s", snapshot.GetName(), message),
+				description: fmt.Sprintf("VolumeSnapshot %s failed", snapshot.GetName()),
+			}, nil
+		}
+		if ready, _, _ := unstructured.NestedBool(snapshot.Object, "status", "readyToUse"); ready {
+			return pvcSnapshot{done: true, description: fmt.Sprintf("VolumeSnapshot %s taken", snapshot.GetName())}, nil
+		}
+	}
+
+	// The snapshot may still be uploaded by the storage, or already deleted by the data
+	// mover, once its DataUpload exists
+	if boolptr.IsSetToTrue(backup.Spec.SnapshotMoveData) {
+		dataUpload, err := findDataUpload(ctx, dynamicClient, backup.Namespace, namespace, pvc, backup.Name)
+		if err != nil {
+			return pvcSnapshot{}, err
+		}
+		if dataUpload != nil {
+			return pvcSnapshot{done: true, description: fmt.Sprintf("Snapshot of PVC %s moved by DataUpload %s", pvc, dataUpload.GetName())}, nil
+		}
+	}
+
+	if snapshot == nil {
+		return pvcSnapshot{description: fmt.Sprintf("Waiting for VolumeSnapshot of PVC %s", pvc)}, nil
+	}
+	return pvcSnapshot{description: fmt.Sprintf("Waiting for VolumeSnapshot %s to be ready", snapshot.GetName())}, nil
+}
+
+// Cancel lifts the fence of a fencing operation that did not complete
+func (p *SnapshotFencingPluginV2) Cancel(operationID string, backup *v1.Backup) error {
+	op, err := decodeFencingOperationID(operationID)
+	if err != nil {
+		return err
+	}
+
+	dynamicClient, err := p.getDynamicClient()
+	if err != nil {
+		return errors.Wrap(err, "failed to create dynamic client")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), fencingOperationTimeout)
+	defer cancel()
+
+	if err := unfenceInstance(ctx, dynamicClient, op.namespace, op.cluster, op.instance); err != nil {
+		return err
+	}
+	p.log.Infof("Unfenced instance %s of cluster %s/%s after cancellation", op.instance, op.namespace, op.cluster)
+
+	return nil
+}
+
+// fencingOperation identifies the instance fenced for the snapshots of its PVCs
+type fencingOperation struct {
+	namespace string
+	cluster   string
+	instance  string
+	pvcs      []string
+	started   time.Time
+}
+
+// encodeFencingOperationID builds the operation ID of a fencing operation. PVC names
+// cannot hold commas, so the PVCs are joined with them.
+func encodeFencingOperationID(namespace, cluster, instance string, pvcs []string, started time.Time) string {
+	return strings.Join([]string{namespace, cluster, instance, strings.Join(pvcs, ","), fmt.Sprint(started.Unix())}, "/")
+}
+
+// decodeFencingOperationID parses an operation ID built by encodeFencingOperationID
+func decodeFencingOperationID(operationID string) (*fencingOperation, error) {
+	parts := strings.Split(operationID, "/")
+	if len(parts) != 5 {
+		return nil, errors.Errorf("invalid fencing operation ID %q", operationID)
+	}
+
+	var started int64
+	if _, err := fmt.Sscan(parts[4], &started); err != nil {
+		return nil, errors.Wrapf(err, "invalid fencing operation ID %q", operationID)
+	}
+
+	return &fencingOperation{
+		namespace: parts[0],
+		cluster:   parts[1],
+		instance:  parts[2],
+		pvcs:      strings.Split(parts[3], ","),
+		started:   time.Unix(started, 0),
+	}, nil
+}
+
+// findVolumeSnapshot returns the VolumeSnapshot Velero created for the PVC in the given
+// backup, or nil if it does not exist yet
+func findVolumeSnapshot(ctx context.Context, dynamicClient dynamic.Interface, namespace, pvc, backupName string) (*unstructured.Unstructured, error) {
+	snapshots, err := dynamicClient.Resource(volumeSnapshotGVR).Namespace(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: v1.BackupNameLabel + "=" + label.GetValidName(backupName),
+	})
+	if err != nil {
+		return nil, errors.Wrap(classifyAPIError(err), "failed to list VolumeSnapshots")
+	}
+
+	for i := range snapshots.Items {
+		source, _, _ := unstructured.NestedString(snapshots.Items[i].Object, "spec", "source", "persistentVolumeClaimName")
+		if source == pvc {
+			return &snapshots.Items[i], nil
+		}
+	}
+
+	return nil, nil
+}
+
+// findDataUpload returns the DataUpload Velero's data mover created in the Velero
+// namespace for the PVC in the given backup, or nil if it does not exist yet
+func findDataUpload(ctx context.Context, dynamicClient dynamic.Interface, veleroNamespace, namespace, pvc, backupName string) (*unstructured.Unstructured, error) {
+	dataUploads, err := dynamicClient.Resource(dataUploadGVR).Namespace(veleroNamespace).List(ctx, metav1.ListOptions{
+		LabelSelector: v1.BackupNameLabel + "=" + label.GetValidName(backupName),
+	})
+	if err != nil {
+		return nil, errors.Wrap(classifyAPIError(err), "failed to list DataUploads")
+	}
+
+	for i := range dataUploads.Items {
+		sourceNamespace, _, _ := unstructured.NestedString(dataUploads.Items[i].Object, "spec", "sourceNamespace")
+		sourcePVC, _, _ := unstructured.NestedString(dataUploads.Items[i].Object, "spec", "sourcePVC")
+		if sourceNamespace == namespace && sourcePVC == pvc {
+			return &dataUploads.Items[i], nil
+		}
+	}
+
+	return nil, nil
+}
+
+// csiSnapshotSkipReason returns why Velero will not take a CSI snapshot of the PVC in the
+// backup, or "" when it will. Fencing an instance for a PVC that is never snapshotted
+// would keep it down until the operation times out.
+func csiSnapshotSkipReason(ctx context.Context, kubeClient kubernetes.Interface, dynamicClient dynamic.Interface, backup *v1.Backup, pvc *corev1.PersistentVolumeClaim) (string, error) {
+	if pvc.Labels[v1.ExcludeFromBackupLabel] == "true" {
+		return "is excluded from the backup", nil
+	}
+	if pvc.Spec.VolumeName == "" {
+		return "is not bound", nil
+	}
+
+	pv, err := kubeClient.CoreV1().PersistentVolumes().Get(ctx, pvc.Spec.VolumeName, metav1.GetOptions{})
+	if err != nil {
+		return "", errors.Wrapf(classifyAPIError(err), "failed to get PersistentVolume %s", pvc.Spec.VolumeName)
+	}
+	if pv.Spec.CSI == nil {
+		return "is not provisioned by a CSI driver", nil
+	}
+
+	pods, err := kubeClient.CoreV1().Pods(pvc.Namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return "", errors.Wrapf(classifyAPIError(err), "failed to list pods in namespace %s", pvc.Namespace)
+	}
+	defaultToFsBackup := boolptr.IsSetToTrue(backup.Spec.DefaultVolumesToFsBackup)
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		volumes, _ := podvolume.GetVolumesByPod(pod, defaultToFsBackup, false, nil)
+		fsBackupVolumes := sets.New(volumes...)
+		for _, volume := range pod.Spec.Volumes {
+			if volume.PersistentVolumeClaim != nil && volume.PersistentVolumeClaim.ClaimName == pvc.Name && fsBackupVolumes.Has(volume.Name) {
+				return fmt.Sprintf("is backed up by fs-backup through pod %s", pod.Name), nil
+			}
+		}
+	}
+
+	classes, err := dynamicClient.Resource(volumeSnapshotClassGVR).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return "", errors.Wrap(classifyAPIError(err), "failed to list VolumeSnapshotClasses")
+	}
+	for _, class := range classes.Items {
+		if driver, _, _ := unstructured.NestedString(class.Object, "driver"); driver == pv.Spec.CSI.Driver {
+			return "", nil
+		}
+	}
+	return fmt.Sprintf("has no VolumeSnapshotClass for CSI driver %s", pv.Spec.CSI.Driver), nil
+}
+
+// instanceSnapshotPVCs returns the sorted names of the PVCs of the instance owning the PVC
+// that Velero takes CSI snapshots of in the backup, such as PGDATA, WAL and tablespaces.
+// The fence is lifted only once all of them are snapshotted.
+func instanceSnapshotPVCs(ctx context.Context, kubeClient kubernetes.Interface, dynamicClient dynamic.Interface, backup *v1.Backup, pvc *corev1.PersistentVolumeClaim) ([]string, error) {
+	pvcs, err := kubeClient.CoreV1().PersistentVolumeClaims(pvc.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s,%s=%s", LabelCluster, pvc.Labels[LabelCluster], LabelInstanceName, pvc.Labels[LabelInstanceName]),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(classifyAPIError(err), "failed to list PVCs of instance %s", pvc.Labels[LabelInstanceName])
+	}
+
+	names := sets.New(pvc.Name)
+	for i := range pvcs.Items {
+		if names.Has(pvcs.Items[i].Name) {
+			continue
+		}
+		reason, err := csiSnapshotSkipReason(ctx, kubeClient, dynamicClient, backup, &pvcs.Items[i])
+		if err != nil {
+			return nil, err
+		}
+		if reason == "" {
+			names.Insert(pvcs.Items[i].Name)
+		}
+	}
+	return sets.List(names), nil
+}
+
+// waitForInstanceStopped waits until the pod of a fenced instance reports PostgreSQL shut
+// down. CNPG keeps the pod of a fenced instance running but no longer ready.
+func waitForInstanceStopped(ctx context.Context, kubeClient kubernetes.Interface, namespace, instance string) error {
+	err := wait.PollUntilContextCancel(ctx, fencingStopInterval, true, func(ctx context.Context) (bool, error) {
+		pod, err := kubeClient.CoreV1().Pods(namespace).Get(ctx, instance, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return true, nil
+		}
+		if err != nil {
+			return false, errors.Wrapf(classifyAPIError(err), "failed to get pod %s/%s", namespace, instance)
+		}
+		if pod.Status.Phase != corev1.PodRunning {
+			return true, nil
+		}
+		for _, condition := range pod.Status.Conditions {
+			if condition.Type == corev1.PodReady {
+				return condition.Status != corev1.ConditionTrue, nil
+			}
+		}
+		return true, nil
+	})
+	if wait.Interrupted(err) {
+		return errors.Errorf("instance %s/%s did not shut down within %s of being fenced", namespace, instance, fencingStopTimeout)
+	}
+	return err
+}
+
+// snapshotFence records the fence GetRelatedItems took on an instance until Execute
+// claims it
+type snapshotFence struct {
+	// Backup is the name of the backup the instance was fenced for
+	Backup string `json:"backup"`
+
+	// PVCs are the PVCs of the instance whose snapshots the fence is held for
+	PVCs []string `json:"pvcs"`
+}
+
+// fenceInstance adds the instance to the cluster's fenced instances and records the fence.
+// It returns false when the instance (or the whole cluster) was already fenced.
+func fenceInstance(ctx context.Context, dynamicClient dynamic.Interface, namespace, clusterName, instance string, fence *snapshotFence) (bool, error) {
+	fenced := false
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		fenced = false
+		cluster, err := dynamicClient.Resource(cnpgClusterGVR).Namespace(namespace).Get(ctx, clusterName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		instances, err := fencedInstances(cluster)
+		if err != nil {
+			return err
+		}
+		for _, name := range instances {
+			if name == instance || name == "*" {
+				return nil
+			}
+		}
+
+		fences, err := snapshotFences(cluster)
+		if err != nil {
+			return err
+		}
+		fences[instance] = *fence
+
+		if err := setFencedInstances(cluster, append(instances, instance)); err != nil {
+			return err
+		}
+		if err := setSnapshotFences(cluster, fences); err != nil {
+			return err
+		}
+		if _, err := dynamicClient.Resource(cnpgClusterGVR).Namespace(namespace).Update(ctx, cluster, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+		fenced = true
+		return nil
+	})
+	if err != nil {
+		return false, errors.Wrapf(classifyAPIError(err), "failed to fence instance %s of cluster %s/%s", instance, namespace, clusterName)
+	}
+
+	return fenced, nil
+}
+
+// claimSnapshotFence removes the record of the fence taken on the instance for the backup
+// and returns it, or nil when the backup holds no fence on the instance or another PVC of
+// the instance claimed it first. The fence itself stays in place.
+func claimSnapshotFence(ctx context.Context, dynamicClient dynamic.Interface, namespace, clusterName, instance, backupName string) (*snapshotFence, error) {
+	var claimed *snapshotFence
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		claimed = nil
+		cluster, err := dynamicClient.Resource(cnpgClusterGVR).Namespace(namespace).Get(ctx, clusterName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		fences, err := snapshotFences(cluster)
+		if err != nil {
+			return err
+		}
+		fence, found := fences[instance]
+		if !found || fence.Backup != backupName {
+			return nil
+		}
+
+		delete(fences, instance)
+		if err := setSnapshotFences(cluster, fences); err != nil {
+			return err
+		}
+		if _, err := dynamicClient.Resource(cnpgClusterGVR).Namespace(namespace).Update(ctx, cluster, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+		claimed = &fence
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(classifyAPIError(err), "failed to claim the fence of instance %s of cluster %s/%s", instance, namespace, clusterName)
+	}
+
+	return claimed, nil
+}
+
+// unfenceInstance removes the instance from the cluster's fenced instances, along with any
+// unclaimed record of its fence
+func unfenceInstance(ctx context.Context, dynamicClient dynamic.Interface, namespace, clusterName, instance string) error {
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cluster, err := dynamicClient.Resource(cnpgClusterGVR).Namespace(namespace).Get(ctx, clusterName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		instances, err := fencedInstances(cluster)
+		if err != nil {
+			return err
+		}
+		fences, err := snapshotFences(cluster)
+		if err != nil {
+			return err
+		}
+
+		remaining := make([]string, 0, len(instances))
+		for _, name := range instances {
+			if name != instance {
+				remaining = append(remaining, name)
+			}
+		}
+		_, recorded := fences[instance]
+		if len(remaining) == len(instances) && !recorded {
+			return nil
+		}
+		delete(fences, instance)
+
+		if err := setFencedInstances(cluster, remaining); err != nil {
+			return err
+		}
+		if err := setSnapshotFences(cluster, fences); err != nil {
+			return err
+		}
+		_, err = dynamicClient.Resource(cnpgClusterGVR).Namespace(namespace).Update(ctx, cluster, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return errors.Wrapf(classifyAPIError(err), "failed to unfence instance %s of cluster %s/%s", instance, namespace, clusterName)
+	}
+
+	return nil
+}
+
+// fencedInstances parses the fenced instances annotation of a cluster
+func fencedInstances(cluster *unstructured.Unstructured) ([]string, error) {
+	value := cluster.GetAnnotations()[AnnotationFencedInstances]
+	if value == "" {
+		return nil, nil
+	}
+
+	var instances []string
+	if err := json.Unmarshal([]byte(value), &instances); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s annotation", AnnotationFencedInstances)
+	}
+	return instances, nil
+}
+
+// setFencedInstances writes the fenced instances annotation, removing it when empty
+func setFencedInstances(cluster *unstructured.Unstructured, instances []string) error {
+	annotations := cluster.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+
+	if len(instances) == 0 {
+		delete(annotations, AnnotationFencedInstances)
+	} else {
+		raw, err := json.Marshal(instances)
+		if err != nil {
+			return errors.Wrapf(err, "failed to encode %s annotation", AnnotationFencedInstances)
+		}
+		annotations[AnnotationFencedInstances] = string(raw)
+	}
+
+	cluster.SetAnnotations(annotations)
+	return nil
+}
+
+// snapshotFences parses the snapshot fences annotation of a cluster
+func snapshotFences(cluster *unstructured.Unstructured) (map[string]snapshotFence, error) {
+	fences := map[string]snapshotFence{}
+	value := cluster.GetAnnotations()[AnnotationSnapshotFences]
+	if value == "" {
+		return fences, nil
+	}
+
+	if err := json.Unmarshal([]byte(value), &fences); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s annotation", AnnotationSnapshotFences)
+	}
+	return fences, nil
+}
+
+// setSnapshotFences writes the snapshot fences annotation, removing it when empty
+func setSnapshotFences(cluster *unstructured.Unstructured, fences map[string]snapshotFence) error {
+	annotations := cluster.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+
+	if len(fences) == 0 {
+		delete(annotations, AnnotationSnapshotFences)
+	} else {
+		raw, err := json.Marshal(fences)
+		if err != nil {
+			return errors.Wrapf(err, "failed to encode %s annotation", AnnotationSnapshotFences)
+		}
+		annotations[AnnotationSnapshotFences] = string(raw)
+	}
+
+	cluster.SetAnnotations(annotations)
+	return nil
+}
@@ -0,0 +1,674 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// createMockCluster creates a CNPG Cluster resource with the given primary instance
+func createMockCluster(name, namespace, primary string, annotations map[string]interface{}) *unstructured.Unstructured {
+	metadata := map[string]interface{}{
+		"name":      name,
+		"namespace": namespace,
+	}
+	if annotations != nil {
+		metadata["annotations"] = annotations
+	}
+
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "postgresql.cnpg.io/v1",
+			"kind":       "Cluster",
+			"metadata":   metadata,
+			"spec":       map[string]interface{}{"instances": int64(2)},
+			"status":     map[string]interface{}{"currentPrimary": primary},
+		},
+	}
+}
+
+// createMockPVC creates a PVC labelled by CNPG for an instance, bound to the PV of the
+// same name
+func createMockPVC(name, namespace, clusterName, instance string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "PersistentVolumeClaim",
+			"metadata": map[string]interface{}{
+				"name":      name,
+				"namespace": namespace,
+				"labels": map[string]interface{}{
+					LabelCluster:      clusterName,
+					LabelInstanceName: instance,
+				},
+			},
+			"spec": map[string]interface{}{"volumeName": name},
+		},
+	}
+}
+
+// createMockPV creates a PV provisioned by the given CSI driver, or by an in-tree driver
+// when driver is empty
+func createMockPV(name, driver string) *corev1.PersistentVolume {
+	pv := &corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	if driver != "" {
+		pv.Spec.CSI = &corev1.CSIPersistentVolumeSource{Driver: driver, VolumeHandle: name}
+	}
+	return pv
+}
+
+// createMockVolumeSnapshotClass creates a VolumeSnapshotClass of a CSI driver
+func createMockVolumeSnapshotClass(name, driver string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "snapshot.storage.k8s.io/v1",
+			"kind":       "VolumeSnapshotClass",
+			"metadata":   map[string]interface{}{"name": name},
+			"driver":     driver,
+		},
+	}
+}
+
+// createMockInstancePod creates the pod of an instance mounting the given PVCs
+func createMockInstancePod(name, namespace string, ready bool, annotations map[string]string, pvcs ...string) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, Annotations: annotations},
+		Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+	for _, pvc := range pvcs {
+		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+			Name:         pvc,
+			VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: pvc}},
+		})
+	}
+	status := corev1.ConditionFalse
+	if ready {
+		status = corev1.ConditionTrue
+	}
+	pod.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: status}}
+	return pod
+}
+
+// toPVC converts a PVC created by createMockPVC
+func toPVC(t *testing.T, pvc *unstructured.Unstructured) *corev1.PersistentVolumeClaim {
+	claim := &corev1.PersistentVolumeClaim{}
+	require.NoError(t, runtime.DefaultUnstructuredConverter.FromUnstructured(pvc.Object, claim))
+	return claim
+}
+
+// createMockVolumeSnapshot creates a VolumeSnapshot Velero took of a PVC
+func createMockVolumeSnapshot(name, namespace, pvc, backupName string, status map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "snapshot.storage.k8s.io/v1",
+			"kind":       "VolumeSnapshot",
+			"metadata": map[string]interface{}{
+				"name":      name,
+				"namespace": namespace,
+				"labels": map[string]interface{}{
+					v1.BackupNameLabel: backupName,
+				},
+			},
+			"spec": map[string]interface{}{
+				"source": map[string]interface{}{"persistentVolumeClaimName": pvc},
+			},
+			"status": status,
+		},
+	}
+}
+
+// createMockDataUpload creates a DataUpload Velero's data mover created for a PVC
+func createMockDataUpload(name, pvcNamespace, pvc, backupName string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "velero.io/v2alpha1",
+			"kind":       "DataUpload",
+			"metadata": map[string]interface{}{
+				"name":      name,
+				"namespace": "velero",
+				"labels": map[string]interface{}{
+					v1.BackupNameLabel: backupName,
+				},
+			},
+			"spec": map[string]interface{}{
+				"sourceNamespace": pvcNamespace,
+				"sourcePVC":       pvc,
+			},
+		},
+	}
+}
+
+func getSnapshotFences(t *testing.T, dynamicClient dynamic.Interface, namespace, name string) map[string]snapshotFence {
+	cluster, err := dynamicClient.Resource(cnpgClusterGVR).Namespace(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	require.NoError(t, err)
+	fences, err := snapshotFences(cluster)
+	require.NoError(t, err)
+	return fences
+}
+
+func getFencedInstances(t *testing.T, dynamicClient dynamic.Interface, namespace, name string) []string {
+	cluster, err := dynamicClient.Resource(cnpgClusterGVR).Namespace(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	require.NoError(t, err)
+	instances, err := fencedInstances(cluster)
+	require.NoError(t, err)
+	return instances
+}
+
+func TestSnapshotFencingGetRelatedItems(t *testing.T) {
+	fsBackup := true
+	tests := []struct {
+		name              string
+		config            *PluginConfig
+		cluster           *unstructured.Unstructured
+		pvc               *unstructured.Unstructured
+		backup            *v1.Backup
+		kubeObjects       []runtime.Object
+		expectedPVCs      []string
+		expectedInstances []string
+	}{
+		{
+			name:              "fencing disabled",
+			config:            DefaultPluginConfig(),
+			cluster:           createMockCluster("pg", "default", "pg-1", nil),
+			pvc:               createMockPVC("pg-1", "default", "pg", "pg-1"),
+			expectedInstances: nil,
+		},
+		{
+			name:              "primary is fenced",
+			config:            &PluginConfig{SnapshotFencing: &SnapshotFencingConfig{Enabled: true}},
+			cluster:           createMockCluster("pg", "default", "pg-1", nil),
+			pvc:               createMockPVC("pg-1-wal", "default", "pg", "pg-1"),
+			expectedPVCs:      []string{"pg-1-wal"},
+			expectedInstances: []string{"pg-1"},
+		},
+		{
+			name:    "every snapshotted PVC of the instance is tracked",
+			config:  &PluginConfig{SnapshotFencing: &SnapshotFencingConfig{Enabled: true}},
+			cluster: createMockCluster("pg", "default", "pg-1", nil),
+			pvc:     createMockPVC("pg-1-wal", "default", "pg", "pg-1"),
+			kubeObjects: []runtime.Object{
+				toPVC(t, createMockPVC("pg-1", "default", "pg", "pg-1")),
+				toPVC(t, createMockPVC("pg-1-tbs-reports", "default", "pg", "pg-1")),
+				toPVC(t, createMockPVC("pg-2", "default", "pg", "pg-2")),
+				createMockPV("pg-1-tbs-reports", ""),
+			},
+			expectedPVCs:      []string{"pg-1", "pg-1-wal"},
+			expectedInstances: []string{"pg-1"},
+		},
+		{
+			name:              "PVC backed up by fs-backup is not fenced",
+			config:            &PluginConfig{SnapshotFencing: &SnapshotFencingConfig{Enabled: true}},
+			cluster:           createMockCluster("pg", "default", "pg-1", nil),
+			pvc:               createMockPVC("pg-1", "default", "pg", "pg-1"),
+			kubeObjects:       []runtime.Object{createMockInstancePod("pg-1", "default", true, map[string]string{v1.VolumesToBackupAnnotation: "pg-1"}, "pg-1")},
+			expectedInstances: nil,
+		},
+		{
+			name:              "PVC of a backup defaulting to fs-backup is not fenced",
+			config:            &PluginConfig{SnapshotFencing: &SnapshotFencingConfig{Enabled: true}},
+			cluster:           createMockCluster("pg", "default", "pg-1", nil),
+			pvc:               createMockPVC("pg-1", "default", "pg", "pg-1"),
+			backup:            &v1.Backup{Spec: v1.BackupSpec{DefaultVolumesToFsBackup: &fsBackup}},
+			kubeObjects:       []runtime.Object{createMockInstancePod("pg-1", "default", true, nil, "pg-1")},
+			expectedInstances: nil,
+		},
+		{
+			name:              "PVC opted out of fs-backup is fenced",
+			config:            &PluginConfig{SnapshotFencing: &SnapshotFencingConfig{Enabled: true}},
+			cluster:           createMockCluster("pg", "default", "pg-1", nil),
+			pvc:               createMockPVC("pg-1", "default", "pg", "pg-1"),
+			backup:            &v1.Backup{Spec: v1.BackupSpec{DefaultVolumesToFsBackup: &fsBackup}},
+			kubeObjects:       []runtime.Object{createMockInstancePod("pg-1", "default", false, map[string]string{v1.VolumesToExcludeAnnotation: "pg-1"}, "pg-1")},
+			expectedPVCs:      []string{"pg-1"},
+			expectedInstances: []string{"pg-1"},
+		},
+		{
+			name:              "PVC of a PV without CSI driver is not fenced",
+			config:            &PluginConfig{SnapshotFencing: &SnapshotFencingConfig{Enabled: true}},
+			cluster:           createMockCluster("pg", "default", "pg-1", nil),
+			pvc:               createMockPVC("pg-1-tbs-reports", "default", "pg", "pg-1"),
+			kubeObjects:       []runtime.Object{createMockPV("pg-1-tbs-reports", "")},
+			expectedInstances: nil,
+		},
+		{
+			name:              "PVC without VolumeSnapshotClass for its driver is not fenced",
+			config:            &PluginConfig{SnapshotFencing: &SnapshotFencingConfig{Enabled: true}},
+			cluster:           createMockCluster("pg", "default", "pg-1", nil),
+			pvc:               createMockPVC("pg-1-tbs-reports", "default", "pg", "pg-1"),
+			kubeObjects:       []runtime.Object{createMockPV("pg-1-tbs-reports", "nfs.csi.k8s.io")},
+			expectedInstances: nil,
+		},
+		{
+			name:              "replica is not fenced by default",
+			config:            &PluginConfig{SnapshotFencing: &SnapshotFencingConfig{Enabled: true}},
+			cluster:           createMockCluster("pg", "default", "pg-1", nil),
+			pvc:               createMockPVC("pg-2", "default", "pg", "pg-2"),
+			expectedInstances: nil,
+		},
+		{
+			name:              "replica is fenced with all instances",
+			config:            &PluginConfig{SnapshotFencing: &SnapshotFencingConfig{Enabled: true, Instances: FencingInstancesAll}},
+			cluster:           createMockCluster("pg", "default", "pg-1", map[string]interface{}{AnnotationFencedInstances: `["pg-1"]`}),
+			pvc:               createMockPVC("pg-2", "default", "pg", "pg-2"),
+			expectedPVCs:      []string{"pg-2"},
+			expectedInstances: []string{"pg-1", "pg-2"},
+		},
+		{
+			name:              "already fenced instance is left alone",
+			config:            &PluginConfig{SnapshotFencing: &SnapshotFencingConfig{Enabled: true}},
+			cluster:           createMockCluster("pg", "default", "pg-1", map[string]interface{}{AnnotationFencedInstances: `["*"]`}),
+			pvc:               createMockPVC("pg-1", "default", "pg", "pg-1"),
+			expectedInstances: []string{"*"},
+		},
+		{
+			name:              "opt-in skips clusters without the enabled annotation",
+			config:            &PluginConfig{OptIn: true, SnapshotFencing: &SnapshotFencingConfig{Enabled: true, Instances: FencingInstancesAll}},
+			cluster:           createMockCluster("pg", "default", "pg-1", nil),
+			pvc:               createMockPVC("pg-1", "default", "pg", "pg-1"),
+			expectedInstances: nil,
+		},
+		{
+			name:              "opt-in fences clusters with the enabled annotation",
+			config:            &PluginConfig{OptIn: true, SnapshotFencing: &SnapshotFencingConfig{Enabled: true}},
+			cluster:           createMockCluster("pg", "default", "pg-1", map[string]interface{}{AnnotationEnabled: "true"}),
+			pvc:               createMockPVC("pg-1", "default", "pg", "pg-1"),
+			expectedPVCs:      []string{"pg-1"},
+			expectedInstances: []string{"pg-1"},
+		},
+		{
+			name:    "backup without volume snapshots",
+			config:  &PluginConfig{SnapshotFencing: &SnapshotFencingConfig{Enabled: true}},
+			cluster: createMockCluster("pg", "default", "pg-1", nil),
+			pvc:     createMockPVC("pg-1", "default", "pg", "pg-1"),
+			backup: &v1.Backup{
+				Spec: v1.BackupSpec{SnapshotVolumes: new(bool)},
+			},
+			expectedInstances: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dynamicClient := newFakeDynamicClient(tt.cluster, createMockVolumeSnapshotClass("csi-hostpath", "hostpath.csi.k8s.io"))
+			kubeClient := fake.NewClientset(tt.kubeObjects...)
+			for _, name := range []string{"pg-1", "pg-1-wal", "pg-2"} {
+				_, err := kubeClient.CoreV1().PersistentVolumes().Create(context.Background(), createMockPV(name, "hostpath.csi.k8s.io"), metav1.CreateOptions{})
+				require.NoError(t, err)
+			}
+			plugin := &SnapshotFencingPluginV2{
+				log:           logrus.New(),
+				config:        tt.config,
+				kubeClient:    kubeClient,
+				dynamicClient: dynamicClient,
+			}
+
+			backup := tt.backup
+			if backup == nil {
+				backup = &v1.Backup{ObjectMeta: metav1.ObjectMeta{Name: "backup-1"}}
+			}
+
+			related, err := plugin.GetRelatedItems(tt.pvc, backup)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedInstances, getFencedInstances(t, dynamicClient, "default", "pg"))
+
+			fences := getSnapshotFences(t, dynamicClient, "default", "pg")
+			if tt.expectedPVCs == nil {
+				assert.Empty(t, fences)
+				assert.Empty(t, related)
+				return
+			}
+			assert.Equal(t, map[string]snapshotFence{
+				tt.pvc.GetLabels()[LabelInstanceName]: {Backup: backup.Name, PVCs: tt.expectedPVCs},
+			}, fences)
+
+			var expectedRelated []velero.ResourceIdentifier
+			for _, name := range tt.expectedPVCs {
+				if name != tt.pvc.GetName() {
+					expectedRelated = append(expectedRelated, velero.ResourceIdentifier{
+						GroupResource: schema.GroupResource{Resource: "persistentvolumeclaims"},
+						Namespace:     "default",
+						Name:          name,
+					})
+				}
+			}
+			assert.Equal(t, expectedRelated, related)
+		})
+	}
+}
+
+func TestSnapshotFencingExecute(t *testing.T) {
+	fences := `{"pg-1":{"backup":"backup-1","pvcs":["pg-1","pg-1-wal"]}}`
+
+	t.Run("claims the fence of the backup", func(t *testing.T) {
+		dynamicClient := newFakeDynamicClient(createMockCluster("pg", "default", "pg-1", map[string]interface{}{
+			AnnotationFencedInstances: `["pg-1"]`,
+			AnnotationSnapshotFences:  fences,
+		}))
+		plugin := &SnapshotFencingPluginV2{
+			log:           logrus.New(),
+			config:        &PluginConfig{SnapshotFencing: &SnapshotFencingConfig{Enabled: true}},
+			dynamicClient: dynamicClient,
+		}
+		backup := &v1.Backup{ObjectMeta: metav1.ObjectMeta{Name: "backup-1"}}
+
+		_, _, operationID, _, err := plugin.Execute(createMockPVC("pg-1-wal", "default", "pg", "pg-1"), backup)
+		require.NoError(t, err)
+		op, err := decodeFencingOperationID(operationID)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"pg-1", "pg-1-wal"}, op.pvcs)
+		assert.Empty(t, getSnapshotFences(t, dynamicClient, "default", "pg"))
+		assert.Equal(t, []string{"pg-1"}, getFencedInstances(t, dynamicClient, "default", "pg"))
+
+		// The other PVC of the instance is tracked by the same operation
+		_, _, operationID, _, err = plugin.Execute(createMockPVC("pg-1", "default", "pg", "pg-1"), backup)
+		require.NoError(t, err)
+		assert.Empty(t, operationID)
+	})
+
+	t.Run("leaves the fence of another backup alone", func(t *testing.T) {
+		dynamicClient := newFakeDynamicClient(createMockCluster("pg", "default", "pg-1", map[string]interface{}{
+			AnnotationFencedInstances: `["pg-1"]`,
+			AnnotationSnapshotFences:  fences,
+		}))
+		plugin := &SnapshotFencingPluginV2{
+			log:           logrus.New(),
+			config:        &PluginConfig{SnapshotFencing: &SnapshotFencingConfig{Enabled: true}},
+			dynamicClient: dynamicClient,
+		}
+
+		_, _, operationID, _, err := plugin.Execute(createMockPVC("pg-1", "default", "pg", "pg-1"), &v1.Backup{ObjectMeta: metav1.ObjectMeta{Name: "backup-2"}})
+		require.NoError(t, err)
+		assert.Empty(t, operationID)
+		assert.Contains(t, getSnapshotFences(t, dynamicClient, "default", "pg"), "pg-1")
+	})
+
+	t.Run("instance fenced by someone else", func(t *testing.T) {
+		dynamicClient := newFakeDynamicClient(createMockCluster("pg", "default", "pg-1", map[string]interface{}{
+			AnnotationFencedInstances: `["pg-1"]`,
+		}))
+		plugin := &SnapshotFencingPluginV2{
+			log:           logrus.New(),
+			config:        &PluginConfig{SnapshotFencing: &SnapshotFencingConfig{Enabled: true}},
+			dynamicClient: dynamicClient,
+		}
+
+		_, _, operationID, _, err := plugin.Execute(createMockPVC("pg-1", "default", "pg", "pg-1"), &v1.Backup{ObjectMeta: metav1.ObjectMeta{Name: "backup-1"}})
+		require.NoError(t, err)
+		assert.Empty(t, operationID)
+		assert.Equal(t, []string{"pg-1"}, getFencedInstances(t, dynamicClient, "default", "pg"))
+	})
+}
+
+// TestSnapshotFencingActionOrder runs the actions in the order Velero does for the
+// ItemBlock of an instance's PVCs: ItemBlock actions while the block is built, then for
+// each PVC Velero's CSI action, which requests the VolumeSnapshot, before this plugin's
+// backup item action, and finally the asynchronous operations.
+func TestSnapshotFencingActionOrder(t *testing.T) {
+	config := &PluginConfig{SnapshotFencing: &SnapshotFencingConfig{Enabled: true}}
+	backup := &v1.Backup{ObjectMeta: metav1.ObjectMeta{Name: "backup-1"}}
+
+	newPlugin := func(t *testing.T) (*SnapshotFencingPluginV2, dynamic.Interface) {
+		dynamicClient := newFakeDynamicClient(
+			createMockCluster("pg", "default", "pg-1", nil),
+			createMockVolumeSnapshotClass("csi-hostpath", "hostpath.csi.k8s.io"),
+		)
+		kubeClient := fake.NewClientset(
+			toPVC(t, createMockPVC("pg-1", "default", "pg", "pg-1")),
+			toPVC(t, createMockPVC("pg-1-wal", "default", "pg", "pg-1")),
+			createMockPV("pg-1", "hostpath.csi.k8s.io"),
+			createMockPV("pg-1-wal", "hostpath.csi.k8s.io"),
+		)
+		return &SnapshotFencingPluginV2{
+			log:           logrus.New(),
+			config:        config,
+			kubeClient:    kubeClient,
+			dynamicClient: dynamicClient,
+		}, dynamicClient
+	}
+
+	// csiPVCBackupper stands in for velero.io/csi-pvc-backupper, checking that the
+	// instance is fenced when the VolumeSnapshot is requested
+	csiPVCBackupper := func(t *testing.T, dynamicClient dynamic.Interface, pvc string) {
+		assert.Equal(t, []string{"pg-1"}, getFencedInstances(t, dynamicClient, "default", "pg"), "VolumeSnapshot of %s requested from an unfenced instance", pvc)
+		_, err := dynamicClient.Resource(volumeSnapshotGVR).Namespace("default").Create(context.Background(),
+			createMockVolumeSnapshot("velero-"+pvc, "default", pvc, "backup-1", map[string]interface{}{"readyToUse": true}), metav1.CreateOptions{})
+		require.NoError(t, err)
+	}
+
+	t.Run("fences before the snapshots are requested", func(t *testing.T) {
+		plugin, dynamicClient := newPlugin(t)
+
+		// Building the ItemBlock: the PVC mounted by the pod is added first, the other
+		// PVC of the instance as its related item
+		related, err := plugin.GetRelatedItems(createMockPVC("pg-1", "default", "pg", "pg-1"), backup)
+		require.NoError(t, err)
+		require.Len(t, related, 1)
+		_, err = plugin.GetRelatedItems(createMockPVC(related[0].Name, "default", "pg", "pg-1"), backup)
+		require.NoError(t, err)
+
+		// Backing up the items of the block
+		var operationIDs []string
+		for _, pvc := range []string{"pg-1", "pg-1-wal"} {
+			csiPVCBackupper(t, dynamicClient, pvc)
+			_, _, operationID, _, err := plugin.Execute(createMockPVC(pvc, "default", "pg", "pg-1"), backup)
+			require.NoError(t, err)
+			if operationID != "" {
+				operationIDs = append(operationIDs, operationID)
+			}
+		}
+		require.Len(t, operationIDs, 1)
+
+		progress, err := plugin.Progress(operationIDs[0], backup)
+		require.NoError(t, err)
+		assert.True(t, progress.Completed)
+		assert.Equal(t, int64(2), progress.NCompleted)
+		assert.Nil(t, getFencedInstances(t, dynamicClient, "default", "pg"))
+	})
+
+	t.Run("snapshot requested before the fence", func(t *testing.T) {
+		plugin, dynamicClient := newPlugin(t)
+		_, err := dynamicClient.Resource(volumeSnapshotGVR).Namespace("default").Create(context.Background(),
+			createMockVolumeSnapshot("velero-pg-1-wal", "default", "pg-1-wal", "backup-1", nil), metav1.CreateOptions{})
+		require.NoError(t, err)
+
+		_, err = plugin.GetRelatedItems(createMockPVC("pg-1", "default", "pg", "pg-1"), backup)
+		assert.ErrorContains(t, err, "VolumeSnapshot velero-pg-1-wal of PVC default/pg-1-wal was requested before instance pg-1 was fenced")
+		assert.Nil(t, getFencedInstances(t, dynamicClient, "default", "pg"))
+		assert.Empty(t, getSnapshotFences(t, dynamicClient, "default", "pg"))
+	})
+}
+
+func TestSnapshotFencingProgress(t *testing.T) {
+	backup := &v1.Backup{ObjectMeta: metav1.ObjectMeta{Name: "backup-1"}}
+	operationID := encodeFencingOperationID("default", "pg", "pg-1", []string{"pg-1"}, time.Now())
+	fenced := map[string]interface{}{AnnotationFencedInstances: `["pg-1"]`}
+
+	t.Run("waits for the snapshot", func(t *testing.T) {
+		dynamicClient := newFakeDynamicClient(
+			createMockCluster("pg", "default", "pg-1", fenced),
+			createMockVolumeSnapshot("other", "default", "pg-1", "backup-0", map[string]interface{}{"readyToUse": true}),
+		)
+		plugin := &SnapshotFencingPluginV2{log: logrus.New(), dynamicClient: dynamicClient}
+
+		progress, err := plugin.Progress(operationID, backup)
+		require.NoError(t, err)
+		assert.False(t, progress.Completed)
+		assert.Equal(t, []string{"pg-1"}, getFencedInstances(t, dynamicClient, "default", "pg"))
+	})
+
+	t.Run("waits for the snapshot to be ready", func(t *testing.T) {
+		dynamicClient := newFakeDynamicClient(
+			createMockCluster("pg", "default", "pg-1", fenced),
+			createMockVolumeSnapshot("snap", "default", "pg-1", "backup-1", map[string]interface{}{"readyToUse": false}),
+		)
+		plugin := &SnapshotFencingPluginV2{log: logrus.New(), dynamicClient: dynamicClient}
+
+		progress, err := plugin.Progress(operationID, backup)
+		require.NoError(t, err)
+		assert.False(t, progress.Completed)
+	})
+
+	t.Run("unfences once the snapshot is ready", func(t *testing.T) {
+		dynamicClient := newFakeDynamicClient(
+			createMockCluster("pg", "default", "pg-1", fenced),
+			createMockVolumeSnapshot("snap", "default", "pg-1", "backup-1", map[string]interface{}{"readyToUse": true}),
+		)
+		plugin := &SnapshotFencingPluginV2{log: logrus.New(), dynamicClient: dynamicClient}
+
+		progress, err := plugin.Progress(operationID, backup)
+		require.NoError(t, err)
+		assert.True(t, progress.Completed)
+		assert.Empty(t, progress.Err)
+		assert.Nil(t, getFencedInstances(t, dynamicClient, "default", "pg"))
+	})
+
+	t.Run("unfences when the snapshot failed", func(t *testing.T) {
+		dynamicClient := newFakeDynamicClient(
+			createMockCluster("pg", "default", "pg-1", fenced),
+			createMockVolumeSnapshot("snap", "default", "pg-1", "backup-1", map[string]interface{}{
+				"error": map[string]interface{}{"message": "driver failure"},
+			}),
+		)
+		plugin := &SnapshotFencingPluginV2{log: logrus.New(), dynamicClient: dynamicClient}
+
+		progress, err := plugin.Progress(operationID, backup)
+		require.NoError(t, err)
+		assert.True(t, progress.Completed)
+		assert.Contains(t, progress.Err, "driver failure")
+		assert.Nil(t, getFencedInstances(t, dynamicClient, "default", "pg"))
+	})
+
+	moveData := true
+	dataMoverBackup := &v1.Backup{
+		ObjectMeta: metav1.ObjectMeta{Name: "backup-1", Namespace: "velero"},
+		Spec:       v1.BackupSpec{SnapshotMoveData: &moveData},
+	}
+
+	t.Run("unfences once the data mover took over the snapshot", func(t *testing.T) {
+		dynamicClient := newFakeDynamicClient(
+			createMockCluster("pg", "default", "pg-1", fenced),
+			createMockDataUpload("backup-1-x7k2p", "default", "pg-1", "backup-1"),
+		)
+		plugin := &SnapshotFencingPluginV2{log: logrus.New(), dynamicClient: dynamicClient}
+
+		progress, err := plugin.Progress(operationID, dataMoverBackup)
+		require.NoError(t, err)
+		assert.True(t, progress.Completed)
+		assert.Contains(t, progress.Description, "DataUpload backup-1-x7k2p")
+		assert.Nil(t, getFencedInstances(t, dynamicClient, "default", "pg"))
+	})
+
+	t.Run("waits for the data mover", func(t *testing.T) {
+		dynamicClient := newFakeDynamicClient(
+			createMockCluster("pg", "default", "pg-1", fenced),
+			createMockDataUpload("backup-1-x7k2p", "default", "pg-2", "backup-1"),
+			createMockDataUpload("backup-0-m4q9z", "default", "pg-1", "backup-0"),
+		)
+		plugin := &SnapshotFencingPluginV2{log: logrus.New(), dynamicClient: dynamicClient}
+
+		progress, err := plugin.Progress(operationID, dataMoverBackup)
+		require.NoError(t, err)
+		assert.False(t, progress.Completed)
+		assert.Equal(t, []string{"pg-1"}, getFencedInstances(t, dynamicClient, "default", "pg"))
+	})
+
+	t.Run("unfences once the data mover took over a snapshot that is not ready", func(t *testing.T) {
+		dynamicClient := newFakeDynamicClient(
+			createMockCluster("pg", "default", "pg-1", fenced),
+			createMockVolumeSnapshot("snap", "default", "pg-1", "backup-1", map[string]interface{}{"readyToUse": false}),
+			createMockDataUpload("backup-1-x7k2p", "default", "pg-1", "backup-1"),
+		)
+		plugin := &SnapshotFencingPluginV2{log: logrus.New(), dynamicClient: dynamicClient}
+
+		progress, err := plugin.Progress(operationID, dataMoverBackup)
+		require.NoError(t, err)
+		assert.True(t, progress.Completed)
+		assert.Nil(t, getFencedInstances(t, dynamicClient, "default", "pg"))
+	})
+
+	t.Run("data mover backup unfences once the snapshot is ready", func(t *testing.T) {
+		dynamicClient := newFakeDynamicClient(
+			createMockCluster("pg", "default", "pg-1", fenced),
+			createMockVolumeSnapshot("snap", "default", "pg-1", "backup-1", map[string]interface{}{"readyToUse": true}),
+		)
+		plugin := &SnapshotFencingPluginV2{log: logrus.New(), dynamicClient: dynamicClient}
+
+		progress, err := plugin.Progress(operationID, dataMoverBackup)
+		require.NoError(t, err)
+		assert.True(t, progress.Completed)
+		assert.Nil(t, getFencedInstances(t, dynamicClient, "default", "pg"))
+	})
+
+	t.Run("waits for every PVC of the instance", func(t *testing.T) {
+		dynamicClient := newFakeDynamicClient(
+			createMockCluster("pg", "default", "pg-1", fenced),
+			createMockVolumeSnapshot("snap", "default", "pg-1", "backup-1", map[string]interface{}{"readyToUse": true}),
+		)
+		plugin := &SnapshotFencingPluginV2{log: logrus.New(), dynamicClient: dynamicClient}
+
+		operationID := encodeFencingOperationID("default", "pg", "pg-1", []string{"pg-1", "pg-1-wal"}, time.Now())
+		progress, err := plugin.Progress(operationID, backup)
+		require.NoError(t, err)
+		assert.False(t, progress.Completed)
+		assert.Equal(t, int64(2), progress.NTotal)
+		assert.Equal(t, int64(1), progress.NCompleted)
+		assert.Equal(t, []string{"pg-1"}, getFencedInstances(t, dynamicClient, "default", "pg"))
+
+		_, err = dynamicClient.Resource(volumeSnapshotGVR).Namespace("default").Create(context.Background(),
+			createMockVolumeSnapshot("snap-wal", "default", "pg-1-wal", "backup-1", map[string]interface{}{"readyToUse": true}), metav1.CreateOptions{})
+		require.NoError(t, err)
+		progress, err = plugin.Progress(operationID, backup)
+		require.NoError(t, err)
+		assert.True(t, progress.Completed)
+		assert.Nil(t, getFencedInstances(t, dynamicClient, "default", "pg"))
+	})
+
+	t.Run("invalid operation ID", func(t *testing.T) {
+		plugin := &SnapshotFencingPluginV2{log: logrus.New(), dynamicClient: newFakeDynamicClient()}
+
+		_, err := plugin.Progress("default/pg", backup)
+		assert.Error(t, err)
+	})
+}
+
+func TestSnapshotFencingCancel(t *testing.T) {
+	dynamicClient := newFakeDynamicClient(
+		createMockCluster("pg", "default", "pg-1", map[string]interface{}{
+			AnnotationFencedInstances: `["pg-1","pg-2"]`,
+			AnnotationSnapshotFences:  `{"pg-1":{"backup":"backup-1","pvcs":["pg-1"]},"pg-2":{"backup":"backup-1","pvcs":["pg-2"]}}`,
+		}),
+	)
+	plugin := &SnapshotFencingPluginV2{log: logrus.New(), dynamicClient: dynamicClient}
+
+	operationID := encodeFencingOperationID("default", "pg", "pg-1", []string{"pg-1"}, time.Now())
+	require.NoError(t, plugin.Cancel(operationID, &v1.Backup{}))
+	assert.Equal(t, []string{"pg-2"}, getFencedInstances(t, dynamicClient, "default", "pg"))
+	assert.Equal(t, map[string]snapshotFence{"pg-2": {Backup: "backup-1", PVCs: []string{"pg-2"}}}, getSnapshotFences(t, dynamicClient, "default", "pg"))
+}
+
+func TestWaitForInstanceStopped(t *testing.T) {
+	stopped := fake.NewClientset(createMockInstancePod("pg-1", "default", false, nil))
+	require.NoError(t, waitForInstanceStopped(context.Background(), stopped, "default", "pg-1"))
+
+	// A deleted pod has no PostgreSQL running either
+	require.NoError(t, waitForInstanceStopped(context.Background(), fake.NewClientset(), "default", "pg-1"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	running := fake.NewClientset(createMockInstancePod("pg-1", "default", true, nil))
+	err := waitForInstanceStopped(ctx, running, "default", "pg-1")
+	assert.ErrorContains(t, err, "did not shut down")
+}
@@ -0,0 +1,99 @@
+package plugin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// AnnotationSpecDigest is the annotation key used to store digests of the backup-critical
+// spec sections at backup time, as a JSON object keyed by section
+const AnnotationSpecDigest = "velero-cnpg/spec-digest"
+
+// driftSections are the spec sections that decide where a cluster recovers from and which
+// PostgreSQL it runs
+var driftSections = []string{
+	"spec.plugins",
+	"spec.backup.barmanObjectStore",
+	"spec.backup.volumeSnapshot",
+	"spec.imageName",
+	"spec.imageCatalogRef",
+}
+
+// specDigest returns the digest of each drift section present in the cluster
+func specDigest(itemContent map[string]interface{}) (map[string]string, error) {
+	digest := map[string]string{}
+	for _, section := range driftSections {
+		value, found, err := unstructured.NestedFieldNoCopy(itemContent, strings.Split(section, ".")...)
+		if err != nil || !found {
+			continue
+		}
+
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to encode %s", section)
+		}
+		sum := sha256.Sum256(raw)
+		digest[section] = hex.EncodeToString(sum[:8])
+	}
+	return digest, nil
+}
+
+// annotateSpecDigest records the digests of the backup-critical spec sections. Failing to
+// compute them is logged rather than failing the backup.
+func (p *BackupPluginV2) annotateSpecDigest(itemContent map[string]interface{}) {
+	digest, err := specDigest(itemContent)
+	if err == nil {
+		var raw []byte
+		if raw, err = json.Marshal(digest); err == nil {
+			err = p.addAnnotation(itemContent, AnnotationSpecDigest, string(raw))
+		}
+	}
+	if err != nil {
+		p.log.Warnf("Failed to annotate spec digest: %v", err)
+	}
+}
+
+// detectSpecDrift compares the backup-critical spec sections of the restored item with the
+// digests recorded at backup time. Resource modifiers or edits to the backup can change
+// them, and a restore would then recover from another location than the one backed up.
+// Drift is reported as a restore warning naming the sections that changed.
+func (p *RestorePluginV2) detectSpecDrift(itemContent map[string]interface{}, warnings *restoreWarnings) error {
+	value, found, err := p.getAnnotation(itemContent, AnnotationSpecDigest)
+	if err != nil || !found {
+		return err
+	}
+
+	var recorded map[string]string
+	if err := json.Unmarshal([]byte(value), &recorded); err != nil {
+		return errors.Wrapf(err, "failed to decode %s annotation", AnnotationSpecDigest)
+	}
+	current, err := specDigest(itemContent)
+	if err != nil {
+		return err
+	}
+
+	var drift []string
+	for _, section := range driftSections {
+		before, hadBefore := recorded[section]
+		after, hasAfter := current[section]
+		switch {
+		case hadBefore && !hasAfter:
+			drift = append(drift, fmt.Sprintf("%s (removed)", section))
+		case !hadBefore && hasAfter:
+			drift = append(drift, fmt.Sprintf("%s (added)", section))
+		case before != after:
+			drift = append(drift, fmt.Sprintf("%s (changed)", section))
+		}
+	}
+
+	if len(drift) > 0 {
+		warnings.Warnf("Backup-critical spec sections differ from the backed-up cluster: %s", strings.Join(drift, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestSpecDigest(t *testing.T) {
+	cluster := createMockArchivingCluster("pg", "default", "pg", nil)
+
+	digest, err := specDigest(cluster.Object)
+	require.NoError(t, err)
+	assert.Len(t, digest, 2)
+	assert.Contains(t, digest, "spec.plugins")
+	assert.Contains(t, digest, "spec.backup.barmanObjectStore")
+
+	// Fields outside the drift sections do not change the digest
+	cluster.Object["spec"].(map[string]interface{})["instances"] = int64(5)
+	again, err := specDigest(cluster.Object)
+	require.NoError(t, err)
+	assert.Equal(t, digest, again)
+}
+
+func TestDetectSpecDrift(t *testing.T) {
+	tests := []struct {
+		name            string
+		modify          func(cluster *unstructured.Unstructured)
+		expectedWarning string
+	}{
+		{
+			name:   "unchanged",
+			modify: func(cluster *unstructured.Unstructured) {},
+		},
+		{
+			name: "instances changed",
+			modify: func(cluster *unstructured.Unstructured) {
+				_ = unstructured.SetNestedField(cluster.Object, int64(1), "spec", "instances")
+			},
+		},
+		{
+			name: "barmanObjectName changed",
+			modify: func(cluster *unstructured.Unstructured) {
+				_ = unstructured.SetNestedSlice(cluster.Object, []interface{}{
+					map[string]interface{}{
+						"name":       BarmanCloudPluginName,
+						"parameters": map[string]interface{}{"barmanObjectName": "other-store", "serverName": "pg"},
+					},
+				}, "spec", "plugins")
+			},
+			expectedWarning: "spec.plugins (changed)",
+		},
+		{
+			name: "sections added and removed",
+			modify: func(cluster *unstructured.Unstructured) {
+				unstructured.RemoveNestedField(cluster.Object, "spec", "backup", "barmanObjectStore")
+				_ = unstructured.SetNestedField(cluster.Object, "ghcr.io/cloudnative-pg/postgresql:17.0", "spec", "imageName")
+			},
+			expectedWarning: "spec.backup.barmanObjectStore (removed), spec.imageName (added)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := createMockArchivingCluster("pg", "default", "pg", nil)
+			(&BackupPluginV2{log: logrus.New()}).annotateSpecDigest(cluster.Object)
+			require.Contains(t, cluster.GetAnnotations(), AnnotationSpecDigest)
+
+			tt.modify(cluster)
+
+			warnings := &restoreWarnings{log: logrus.New()}
+			require.NoError(t, (&RestorePluginV2{log: logrus.New()}).detectSpecDrift(cluster.Object, warnings))
+			if tt.expectedWarning == "" {
+				assert.Empty(t, warnings.messages)
+				return
+			}
+			require.Len(t, warnings.messages, 1)
+			assert.Contains(t, warnings.messages[0], tt.expectedWarning)
+		})
+	}
+}
+
+func TestDetectSpecDriftInvalidAnnotation(t *testing.T) {
+	cluster := createMockArchivingCluster("pg", "default", "pg", nil)
+	cluster.SetAnnotations(map[string]string{AnnotationSpecDigest: "not json"})
+
+	err := (&RestorePluginV2{log: logrus.New()}).detectSpecDrift(cluster.Object, &restoreWarnings{log: logrus.New()})
+	assert.ErrorContains(t, err, "failed to decode velero-cnpg/spec-digest annotation")
+}
@@ -0,0 +1,156 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/label"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// StatusConfigMapPrefix prefixes the name of the ConfigMap collecting the warnings of a
+// restore. The ConfigMap is created in the Velero namespace and named after the restore.
+const StatusConfigMapPrefix = "cnpg-restore-status-"
+
+// statusUpdateTimeout bounds writing warnings to the status ConfigMap
+const statusUpdateTimeout = 30 * time.Second
+
+// StatusConfigMapName returns the name of the status ConfigMap of a restore
+func StatusConfigMapName(restoreName string) string {
+	return label.GetValidName(StatusConfigMapPrefix + restoreName)
+}
+
+// restoreWarnings collects the non-fatal issues found while restoring an item
+type restoreWarnings struct {
+	log      logrus.FieldLogger
+	messages []string
+}
+
+// Warnf logs a warning and records it for the status ConfigMap
+func (w *restoreWarnings) Warnf(format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	w.log.Warn(message)
+	w.messages = append(w.messages, message)
+}
+
+// statusKey returns the status ConfigMap key of an item, <kind>.<namespace>.<name>
+func statusKey(item runtime.Unstructured) string {
+	obj := &unstructured.Unstructured{Object: item.UnstructuredContent()}
+	return strings.ToLower(obj.GetKind()) + "." + obj.GetNamespace() + "." + obj.GetName()
+}
+
+// recordRestoreWarnings writes the warnings of an item to the status ConfigMap of the
+// restore, one key per item, so operators can find every issue of a restore in one place
+// instead of reconstructing them from the Velero logs
+func recordRestoreWarnings(ctx context.Context, client kubernetes.Interface, restore *v1.Restore, item runtime.Unstructured, warnings []string) error {
+	return setStatusValue(ctx, client, restore, statusKey(item), strings.Join(warnings, "\n"))
+}
+
+// statusValue returns a key of the status ConfigMap of a restore
+func statusValue(ctx context.Context, client kubernetes.Interface, restore *v1.Restore, key string) (string, bool, error) {
+	configMap, err := client.CoreV1().ConfigMaps(restore.Namespace).Get(ctx, StatusConfigMapName(restore.Name), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	value, found := configMap.Data[key]
+	return value, found, nil
+}
+
+// setStatusValue sets a key of the status ConfigMap of a restore, creating the ConfigMap
+// if needed
+func setStatusValue(ctx context.Context, client kubernetes.Interface, restore *v1.Restore, key, value string) error {
+	_, err := updateStatusValue(ctx, client, restore, key, func(string, bool) (string, bool) {
+		return value, true
+	})
+	return err
+}
+
+// updateStatusValue sets a key of the status ConfigMap of a restore to the value update
+// returns for its current value, unless update declines, and reports whether it was set.
+// The ConfigMap is updated at the resourceVersion update saw, so concurrent updates of the
+// key are decided one after the other.
+func updateStatusValue(ctx context.Context, client kubernetes.Interface, restore *v1.Restore, key string, update func(value string, found bool) (string, bool)) (bool, error) {
+	namespace := restore.Namespace
+	name := StatusConfigMapName(restore.Name)
+
+	updated := false
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		updated = false
+		configMap, err := client.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			value, write := update("", false)
+			if !write {
+				return nil
+			}
+			configMap = &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      name,
+					Namespace: namespace,
+					Labels: map[string]string{
+						v1.RestoreNameLabel:       label.GetValidName(restore.Name),
+						v1.ExcludeFromBackupLabel: "true",
+					},
+				},
+				Data: map[string]string{key: value},
+			}
+			_, err = client.CoreV1().ConfigMaps(namespace).Create(ctx, configMap, metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				// Created concurrently by another item; retry as an update
+				return apierrors.NewConflict(corev1.Resource("configmaps"), name, err)
+			}
+			updated = err == nil
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		current, found := configMap.Data[key]
+		value, write := update(current, found)
+		if !write {
+			return nil
+		}
+		if configMap.Data == nil {
+			configMap.Data = map[string]string{}
+		}
+		configMap.Data[key] = value
+		_, err = client.CoreV1().ConfigMaps(namespace).Update(ctx, configMap, metav1.UpdateOptions{})
+		updated = err == nil
+		return err
+	})
+	return updated, err
+}
+
+// flushRestoreWarnings records the collected warnings of an item, if any. Failing to
+// record them is logged rather than failing the restore of the item.
+func flushRestoreWarnings(log logrus.FieldLogger, getClient func() (kubernetes.Interface, error), restore *v1.Restore, item runtime.Unstructured, warnings *restoreWarnings) {
+	if restore == nil || item == nil || len(warnings.messages) == 0 {
+		return
+	}
+
+	client, err := getClient()
+	if err != nil {
+		log.Warnf("Failed to get Kubernetes client, not recording restore warnings: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), statusUpdateTimeout)
+	defer cancel()
+
+	if err := recordRestoreWarnings(ctx, client, restore, item, warnings.messages); err != nil {
+		log.Warnf("Failed to record restore warnings in ConfigMap %s/%s: %v", restore.Namespace, StatusConfigMapName(restore.Name), err)
+	}
+}
@@ -0,0 +1,120 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func getStatusData(t *testing.T, client kubernetes.Interface, restore *v1.Restore) map[string]string {
+	configMap, err := client.CoreV1().ConfigMaps(restore.Namespace).Get(context.Background(), StatusConfigMapName(restore.Name), metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "true", configMap.Labels[v1.ExcludeFromBackupLabel])
+	assert.Equal(t, restore.Name, configMap.Labels[v1.RestoreNameLabel])
+	return configMap.Data
+}
+
+func TestRecordRestoreWarnings(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	restore := &v1.Restore{ObjectMeta: metav1.ObjectMeta{Name: "restore-1", Namespace: "velero"}}
+	pg := createMockCluster("pg", "default", "pg-1", nil)
+	other := createMockCluster("other", "default", "other-1", nil)
+
+	require.NoError(t, recordRestoreWarnings(context.Background(), client, restore, pg, []string{"first", "second"}))
+	require.NoError(t, recordRestoreWarnings(context.Background(), client, restore, other, []string{"third"}))
+	assert.Equal(t, map[string]string{
+		"cluster.default.pg":    "first\nsecond",
+		"cluster.default.other": "third",
+	}, getStatusData(t, client, restore))
+
+	// Executing an item again replaces its warnings
+	require.NoError(t, recordRestoreWarnings(context.Background(), client, restore, pg, []string{"again"}))
+	assert.Equal(t, "again", getStatusData(t, client, restore)["cluster.default.pg"])
+}
+
+func TestFlushRestoreWarnings(t *testing.T) {
+	restore := &v1.Restore{ObjectMeta: metav1.ObjectMeta{Name: "restore-1", Namespace: "velero"}}
+	item := createMockCluster("pg", "default", "pg-1", nil)
+
+	t.Run("no warnings", func(t *testing.T) {
+		client := fake.NewSimpleClientset()
+		getClient := func() (kubernetes.Interface, error) { return client, nil }
+
+		flushRestoreWarnings(logrus.New(), getClient, restore, item, &restoreWarnings{log: logrus.New()})
+		list, err := client.CoreV1().ConfigMaps("velero").List(context.Background(), metav1.ListOptions{})
+		require.NoError(t, err)
+		assert.Empty(t, list.Items)
+	})
+
+	t.Run("without restore", func(t *testing.T) {
+		getClient := func() (kubernetes.Interface, error) {
+			t.Fatal("client must not be requested")
+			return nil, nil
+		}
+		warnings := &restoreWarnings{log: logrus.New()}
+		warnings.Warnf("issue")
+
+		flushRestoreWarnings(logrus.New(), getClient, nil, item, warnings)
+	})
+}
+
+func TestRestoreExecuteRecordsWarnings(t *testing.T) {
+	restore := &v1.Restore{ObjectMeta: metav1.ObjectMeta{Name: "restore-1", Namespace: "velero"}}
+
+	t.Run("cluster without backup method", func(t *testing.T) {
+		client := newFakeKubeClient()
+		plugin := &RestorePluginV2{log: logrus.New(), config: DefaultPluginConfig(), kubeClient: client}
+
+		_, err := plugin.Execute(&velero.RestoreItemActionExecuteInput{
+			Item:    createMockCluster("pg", "default", "pg-1", nil),
+			Restore: restore,
+		})
+		require.NoError(t, err)
+		assert.Contains(t, getStatusData(t, client, restore)["cluster.default.pg"], AnnotationBackupMethod)
+	})
+
+	t.Run("deployment with malformed init containers", func(t *testing.T) {
+		client := fake.NewSimpleClientset()
+		plugin := &DeploymentRestorePlugin{log: logrus.New(), kubeClient: client, config: DefaultPluginConfig()}
+		item := &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "apps/v1",
+			"kind":       "Deployment",
+			"metadata":   map[string]interface{}{"name": "app", "namespace": "default"},
+			"spec": map[string]interface{}{
+				"template": map[string]interface{}{
+					"spec": map[string]interface{}{"initContainers": "not-a-list"},
+				},
+			},
+		}}
+
+		_, err := plugin.Execute(&velero.RestoreItemActionExecuteInput{Item: item, Restore: restore})
+		require.NoError(t, err)
+		assert.Equal(t, "initContainers is not a list, skipping", getStatusData(t, client, restore)["deployment.default.app"])
+	})
+}
+
+func TestChangedSchedulingFields(t *testing.T) {
+	itemContent := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"affinity":          map[string]interface{}{"topologyKey": "zone"},
+			"priorityClassName": "high",
+		},
+	}
+	before := schedulingSnapshot(itemContent)
+
+	spec := itemContent["spec"].(map[string]interface{})
+	delete(spec, "priorityClassName")
+	spec["affinity"].(map[string]interface{})["topologyKey"] = "kubernetes.io/hostname"
+
+	assert.Equal(t, []string{"spec.affinity", "spec.priorityClassName"}, changedSchedulingFields(before, schedulingSnapshot(itemContent)))
+	assert.Empty(t, changedSchedulingFields(before, before))
+}
@@ -0,0 +1,64 @@
+package plugin
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// warningRecorder is a logger that records the warnings logged through it, so strict
+// mode can fail an item on any of them instead of leaving it partially protected
+type warningRecorder struct {
+	logrus.FieldLogger
+
+	// warnings is shared by copies of the recorder
+	warnings *[]string
+}
+
+// newWarningRecorder wraps the logger of an action for the processing of one item
+func newWarningRecorder(log logrus.FieldLogger) warningRecorder {
+	return warningRecorder{FieldLogger: log, warnings: &[]string{}}
+}
+
+func (r warningRecorder) record(message string) {
+	*r.warnings = append(*r.warnings, message)
+}
+
+func (r warningRecorder) Warn(args ...interface{}) {
+	r.record(fmt.Sprint(args...))
+	r.FieldLogger.Warn(args...)
+}
+
+func (r warningRecorder) Warnf(format string, args ...interface{}) {
+	r.record(fmt.Sprintf(format, args...))
+	r.FieldLogger.Warnf(format, args...)
+}
+
+func (r warningRecorder) Warnln(args ...interface{}) {
+	r.record(strings.TrimSuffix(fmt.Sprintln(args...), "\n"))
+	r.FieldLogger.Warnln(args...)
+}
+
+func (r warningRecorder) Warning(args ...interface{}) {
+	r.Warn(args...)
+}
+
+func (r warningRecorder) Warningf(format string, args ...interface{}) {
+	r.Warnf(format, args...)
+}
+
+func (r warningRecorder) Warningln(args ...interface{}) {
+	r.Warnln(args...)
+}
+
+// failStrict fails the item when warnings were recorded and it has not failed otherwise.
+// It must be deferred with the address of the method's named error result, after
+// reportError so that the failure is reported.
+func (r warningRecorder) failStrict(err *error) {
+	if *err != nil || len(*r.warnings) == 0 {
+		return
+	}
+	*err = errors.Errorf("strict mode: %s", strings.Join(*r.warnings, "; "))
+}
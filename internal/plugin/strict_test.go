@@ -0,0 +1,64 @@
+package plugin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+)
+
+func TestWarningRecorder(t *testing.T) {
+	recorder := newWarningRecorder(logrus.New())
+
+	var err error
+	recorder.failStrict(&err)
+	assert.NoError(t, err, "no warnings recorded")
+
+	// Copies share the recorded warnings
+	var log logrus.FieldLogger = recorder
+	log.Warnf("no %s found", "backup")
+	log.Warn("stale ", "backup")
+	log.Info("not a warning")
+
+	recorder.failStrict(&err)
+	assert.EqualError(t, err, "strict mode: no backup found; stale backup")
+
+	err = errors.New("failed anyway")
+	recorder.failStrict(&err)
+	assert.EqualError(t, err, "failed anyway", "an earlier error is kept")
+}
+
+func TestBackupExecuteStrict(t *testing.T) {
+	item := createMockArchivingCluster("pg", "default", "pg", nil)
+	plugin := &BackupPluginV2{
+		log:           logrus.New(),
+		config:        &PluginConfig{Strict: true},
+		dynamicClient: newFakeDynamicClient(createMockBackup("backup-1", "default", "pg", "running", "", time.Now())),
+		kubeClient:    newFakeKubeClient(),
+	}
+
+	_, _, _, _, err := plugin.Execute(item, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "strict mode: ")
+	assert.Contains(t, err.Error(), "No completed backups found for cluster pg in namespace default")
+}
+
+func TestRestoreExecuteStrict(t *testing.T) {
+	item := createMockArchivingCluster("pg", "default", "pg", nil)
+	item.SetAnnotations(map[string]string{AnnotationBackupMethod: BackupMethodBarmanObjectStore})
+	plugin := &RestorePluginV2{
+		log:           logrus.New(),
+		config:        &PluginConfig{Strict: true, RestoreMode: RestoreModeRecovery, SkipSchemaValidation: true, SkipPluginCheck: true},
+		dynamicClient: newFakeDynamicClient(),
+		kubeClient:    newFakeKubeClient(),
+	}
+
+	_, err := plugin.Execute(&velero.RestoreItemActionExecuteInput{Item: item})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "strict mode: ")
+	assert.Contains(t, err.Error(), "No velero-cnpg/current-backup-id annotation found")
+}
@@ -0,0 +1,62 @@
+package plugin
+
+import (
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	// AnnotationVeleroSchedule is the annotation key used to store the name of the Velero
+	// Schedule that created the backup
+	AnnotationVeleroSchedule = "velero-cnpg/velero-schedule"
+
+	// AnnotationBackupTTL is the annotation key used to store the TTL of the Velero backup,
+	// how long it was kept before being garbage collected
+	AnnotationBackupTTL = "velero-cnpg/backup-ttl"
+)
+
+// annotateVeleroSchedule records the Velero Schedule that created the backup and the
+// backup's TTL, so the restore can tell which policy produced the data. Values recorded by
+// an earlier backup, which a restored cluster carries, are removed first so a manual
+// backup is not attributed to a schedule.
+func (p *BackupPluginV2) annotateVeleroSchedule(itemContent map[string]interface{}, backup *v1.Backup) {
+	unstructured.RemoveNestedField(itemContent, "metadata", "annotations", AnnotationVeleroSchedule)
+	unstructured.RemoveNestedField(itemContent, "metadata", "annotations", AnnotationBackupTTL)
+	if backup == nil {
+		return
+	}
+
+	var err error
+	if schedule := backup.Labels[v1.ScheduleNameLabel]; schedule != "" {
+		err = p.addAnnotation(itemContent, AnnotationVeleroSchedule, schedule)
+	}
+	if err == nil && backup.Spec.TTL.Duration > 0 {
+		err = p.addAnnotation(itemContent, AnnotationBackupTTL, backup.Spec.TTL.Duration.String())
+	}
+	if err != nil {
+		p.log.Warnf("Failed to annotate Velero schedule: %v", err)
+	}
+}
+
+// logVeleroSchedule logs the Velero Schedule and TTL of the backup the cluster is restored
+// from, when they were recorded
+func (p *RestorePluginV2) logVeleroSchedule(itemContent map[string]interface{}) error {
+	schedule, _, err := p.getAnnotation(itemContent, AnnotationVeleroSchedule)
+	if err != nil {
+		return err
+	}
+	ttl, _, err := p.getAnnotation(itemContent, AnnotationBackupTTL)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case schedule != "" && ttl != "":
+		p.log.Infof("Cluster was backed up by Velero Schedule %s, with a backup TTL of %s", schedule, ttl)
+	case schedule != "":
+		p.log.Infof("Cluster was backed up by Velero Schedule %s", schedule)
+	case ttl != "":
+		p.log.Infof("Cluster was backed up outside a Velero Schedule, with a backup TTL of %s", ttl)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package plugin
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestAnnotateVeleroSchedule(t *testing.T) {
+	tests := []struct {
+		name             string
+		backup           *v1.Backup
+		expectedSchedule string
+		expectedTTL      string
+	}{
+		{
+			name: "scheduled backup",
+			backup: &v1.Backup{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{v1.ScheduleNameLabel: "nightly"}},
+				Spec:       v1.BackupSpec{TTL: metav1.Duration{Duration: 720 * time.Hour}},
+			},
+			expectedSchedule: "nightly",
+			expectedTTL:      "720h0m0s",
+		},
+		{
+			name:        "manual backup",
+			backup:      &v1.Backup{Spec: v1.BackupSpec{TTL: metav1.Duration{Duration: 24 * time.Hour}}},
+			expectedTTL: "24h0m0s",
+		},
+		{
+			name:   "no TTL",
+			backup: &v1.Backup{},
+		},
+		{
+			name: "no backup",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Values recorded by an earlier backup are replaced
+			cluster := annotatedCluster("pg", "default", map[string]string{
+				AnnotationVeleroSchedule: "hourly",
+				AnnotationBackupTTL:      "1h0m0s",
+			})
+
+			(&BackupPluginV2{log: logrus.New()}).annotateVeleroSchedule(cluster.Object, tt.backup)
+
+			annotations := cluster.GetAnnotations()
+			assert.Equal(t, tt.expectedSchedule, annotations[AnnotationVeleroSchedule])
+			assert.Equal(t, tt.expectedTTL, annotations[AnnotationBackupTTL])
+			if tt.expectedSchedule == "" {
+				assert.NotContains(t, annotations, AnnotationVeleroSchedule)
+			}
+			if tt.expectedTTL == "" {
+				assert.NotContains(t, annotations, AnnotationBackupTTL)
+			}
+		})
+	}
+}
+
+func TestLogVeleroSchedule(t *testing.T) {
+	var output bytes.Buffer
+	log := logrus.New()
+	log.SetOutput(&output)
+
+	cluster := annotatedCluster("pg", "default", map[string]string{
+		AnnotationVeleroSchedule: "nightly",
+		AnnotationBackupTTL:      "720h0m0s",
+	})
+	assert.NoError(t, (&RestorePluginV2{log: log}).logVeleroSchedule(cluster.Object))
+	assert.Contains(t, output.String(), "Velero Schedule nightly, with a backup TTL of 720h0m0s")
+
+	output.Reset()
+	assert.NoError(t, (&RestorePluginV2{log: log}).logVeleroSchedule(annotatedCluster("pg", "default", nil).Object))
+	assert.Empty(t, output.String())
+}
@@ -0,0 +1,209 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// AnnotationBackupEndLSN is the annotation key used to store the LSN the pinned CNPG
+	// backup ended at, the earliest point a restore from it is consistent
+	AnnotationBackupEndLSN = "velero-cnpg/backup-end-lsn"
+
+	// AnnotationBackupEndWAL is the annotation key used to store the WAL file the pinned
+	// CNPG backup ended in, which also names its timeline
+	AnnotationBackupEndWAL = "velero-cnpg/backup-end-wal"
+)
+
+const (
+	// instanceStatusPort is the port of the CNPG instance manager's status endpoint
+	instanceStatusPort = "8000"
+
+	// instanceStatusPath is the path of the CNPG instance manager's status endpoint
+	instanceStatusPath = "/pg/status"
+)
+
+// annotateBackupEnd records where the pinned backup ends, so a restore from it can be
+// verified to have replayed at least that far. Backups without an end LSN are skipped.
+func (p *BackupPluginV2) annotateBackupEnd(itemContent map[string]interface{}, backup *unstructured.Unstructured) {
+	endLSN, _, _ := unstructured.NestedString(backup.Object, "status", "endLSN")
+	endWAL, _, _ := unstructured.NestedString(backup.Object, "status", "endWal")
+	if endLSN == "" {
+		return
+	}
+
+	err := p.addAnnotation(itemContent, AnnotationBackupEndLSN, endLSN)
+	if err == nil && endWAL != "" {
+		err = p.addAnnotation(itemContent, AnnotationBackupEndWAL, endWAL)
+	}
+	if err != nil {
+		p.log.Warnf("Failed to annotate backup end: %v", err)
+	}
+}
+
+// InstanceStatus is the part of the CNPG instance manager's status used for verification
+type InstanceStatus struct {
+	// IsPrimary is false while the instance is in recovery
+	IsPrimary bool `json:"isPrimary"`
+
+	// CurrentLSN is the current write-ahead log location of a primary
+	CurrentLSN string `json:"currentLsn"`
+
+	// ReplayLSN is the last WAL location replayed by an instance in recovery
+	ReplayLSN string `json:"replayLsn"`
+
+	// TimeLineID is the timeline the instance is on
+	TimeLineID int64 `json:"timeLineID"`
+}
+
+// InstanceStatusFunc returns the status of a CNPG instance pod
+type InstanceStatusFunc func(ctx context.Context, namespace, pod string) (*InstanceStatus, error)
+
+// PodProxyInstanceStatus returns an InstanceStatusFunc reading the status endpoint of the
+// instance manager through the API server's pod proxy, like the cnpg kubectl plugin does
+func PodProxyInstanceStatus(client kubernetes.Interface) InstanceStatusFunc {
+	return func(ctx context.Context, namespace, pod string) (*InstanceStatus, error) {
+		raw, err := client.CoreV1().Pods(namespace).ProxyGet("https", pod, instanceStatusPort, instanceStatusPath, nil).DoRaw(ctx)
+		if err != nil {
+			return nil, errors.Wrapf(classifyAPIError(err), "failed to get status of instance %s/%s", namespace, pod)
+		}
+
+		status := &InstanceStatus{}
+		if err := json.Unmarshal(raw, status); err != nil {
+			return nil, errors.Wrapf(err, "failed to decode status of instance %s/%s", namespace, pod)
+		}
+		return status, nil
+	}
+}
+
+// VerifyResult reports whether a restored cluster replayed WAL up to the end of the
+// backup it was recovered from
+type VerifyResult struct {
+	Namespace string `json:"namespace"`
+	Cluster   string `json:"cluster"`
+	Phase     string `json:"phase,omitempty"`
+	BackupID  string `json:"backupID,omitempty"`
+
+	// Schedule and BackupTTL are the Velero Schedule and TTL of the backup restored from
+	Schedule  string `json:"schedule,omitempty"`
+	BackupTTL string `json:"backupTTL,omitempty"`
+
+	// ExpectedLSN and ExpectedTimeline are where the pinned backup ended
+	ExpectedLSN      string `json:"expectedLSN,omitempty"`
+	ExpectedTimeline int64  `json:"expectedTimeline,omitempty"`
+
+	// ReplayedLSN and Timeline are where the primary of the restored cluster is
+	ReplayedLSN string `json:"replayedLSN,omitempty"`
+	Timeline    int64  `json:"timeline,omitempty"`
+	InRecovery  bool   `json:"inRecovery"`
+
+	// Reached is true when the restored cluster has left recovery past the expected point
+	Reached bool `json:"reached"`
+
+	// Problems explains why the expected point was not reached
+	Problems []string `json:"problems,omitempty"`
+}
+
+// VerifyRestoredCluster compares the primary of a restored cluster with the end of the
+// backup recorded in its annotations at backup time
+func VerifyRestoredCluster(ctx context.Context, dynamicClient dynamic.Interface, instanceStatus InstanceStatusFunc, namespace, name string) (*VerifyResult, error) {
+	cluster, err := dynamicClient.Resource(cnpgClusterGVR).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(classifyAPIError(err), "failed to get cluster %s/%s", namespace, name)
+	}
+
+	annotations := cluster.GetAnnotations()
+	result := &VerifyResult{
+		Namespace:   namespace,
+		Cluster:     name,
+		BackupID:    annotations[AnnotationCurrentBackupID],
+		Schedule:    annotations[AnnotationVeleroSchedule],
+		BackupTTL:   annotations[AnnotationBackupTTL],
+		ExpectedLSN: annotations[AnnotationBackupEndLSN],
+	}
+	result.Phase, _, _ = unstructured.NestedString(cluster.Object, "status", "phase")
+
+	var expectedLSN uint64
+	if result.ExpectedLSN == "" {
+		result.Problems = append(result.Problems, fmt.Sprintf("no %s annotation, the backup pinned no completed CNPG backup", AnnotationBackupEndLSN))
+	} else if expectedLSN, err = parseLSN(result.ExpectedLSN); err != nil {
+		return nil, errors.Wrapf(err, "invalid %s annotation", AnnotationBackupEndLSN)
+	}
+	if endWAL := annotations[AnnotationBackupEndWAL]; endWAL != "" {
+		if result.ExpectedTimeline, err = walTimeline(endWAL); err != nil {
+			return nil, errors.Wrapf(err, "invalid %s annotation", AnnotationBackupEndWAL)
+		}
+	}
+
+	primary, _, _ := unstructured.NestedString(cluster.Object, "status", "currentPrimary")
+	if primary == "" {
+		result.Problems = append(result.Problems, "cluster has no primary yet")
+		return result, nil
+	}
+
+	status, err := instanceStatus(ctx, namespace, primary)
+	if err != nil {
+		return nil, err
+	}
+	result.InRecovery = !status.IsPrimary
+	result.Timeline = status.TimeLineID
+	result.ReplayedLSN = status.CurrentLSN
+	if result.InRecovery {
+		result.ReplayedLSN = status.ReplayLSN
+		result.Problems = append(result.Problems, fmt.Sprintf("primary %s is still in recovery", primary))
+	}
+
+	if result.ExpectedLSN != "" {
+		replayedLSN, err := parseLSN(result.ReplayedLSN)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid LSN reported by instance %s", primary)
+		}
+		if replayedLSN < expectedLSN {
+			result.Problems = append(result.Problems, fmt.Sprintf("replayed up to %s, short of the end of the backup at %s", result.ReplayedLSN, result.ExpectedLSN))
+		}
+	}
+	if result.Timeline < result.ExpectedTimeline {
+		result.Problems = append(result.Problems, fmt.Sprintf("on timeline %d, before the backup's timeline %d", result.Timeline, result.ExpectedTimeline))
+	}
+
+	result.Reached = len(result.Problems) == 0
+	return result, nil
+}
+
+// parseLSN parses a PostgreSQL LSN such as 16/B374D848
+func parseLSN(lsn string) (uint64, error) {
+	high, low, found := strings.Cut(lsn, "/")
+	if !found {
+		return 0, errors.Errorf("invalid LSN %q", lsn)
+	}
+	h, err := strconv.ParseUint(high, 16, 32)
+	if err != nil {
+		return 0, errors.Errorf("invalid LSN %q", lsn)
+	}
+	l, err := strconv.ParseUint(low, 16, 32)
+	if err != nil {
+		return 0, errors.Errorf("invalid LSN %q", lsn)
+	}
+	return h<<32 | l, nil
+}
+
+// walTimeline returns the timeline of a WAL file name, its first eight hex digits
+func walTimeline(wal string) (int64, error) {
+	if len(wal) < 24 {
+		return 0, errors.Errorf("invalid WAL file name %q", wal)
+	}
+	timeline, err := strconv.ParseInt(wal[:8], 16, 64)
+	if err != nil {
+		return 0, errors.Errorf("invalid WAL file name %q", wal)
+	}
+	return timeline, nil
+}
@@ -0,0 +1,131 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestAnnotateBackupEnd(t *testing.T) {
+	plugin := &BackupPluginV2{log: logrus.New()}
+
+	backup := createMockBackup("backup-1", "default", "pg", "completed", "1", time.Now())
+	backup.Object["status"].(map[string]interface{})["endLSN"] = "0/5000138"
+	backup.Object["status"].(map[string]interface{})["endWal"] = "000000020000000000000005"
+	cluster := createMockArchivingCluster("pg", "default", "pg", nil)
+	plugin.annotateBackupEnd(cluster.Object, backup)
+	assert.Equal(t, "0/5000138", cluster.GetAnnotations()[AnnotationBackupEndLSN])
+	assert.Equal(t, "000000020000000000000005", cluster.GetAnnotations()[AnnotationBackupEndWAL])
+
+	// Backups without an end LSN are not recorded
+	cluster = createMockArchivingCluster("pg", "default", "pg", nil)
+	plugin.annotateBackupEnd(cluster.Object, createMockBackup("backup-1", "default", "pg", "completed", "1", time.Now()))
+	assert.NotContains(t, cluster.GetAnnotations(), AnnotationBackupEndLSN)
+}
+
+func TestVerifyRestoredCluster(t *testing.T) {
+	tests := []struct {
+		name             string
+		annotations      map[string]string
+		primary          string
+		status           *InstanceStatus
+		expectedReached  bool
+		expectedReplayed string
+		expectedProblems []string
+	}{
+		{
+			name:             "reached",
+			annotations:      map[string]string{AnnotationBackupEndLSN: "0/5000138", AnnotationBackupEndWAL: "000000020000000000000005"},
+			primary:          "pg-1",
+			status:           &InstanceStatus{IsPrimary: true, CurrentLSN: "0/6000060", TimeLineID: 3},
+			expectedReached:  true,
+			expectedReplayed: "0/6000060",
+		},
+		{
+			name:             "LSNs compared numerically",
+			annotations:      map[string]string{AnnotationBackupEndLSN: "0/F0000000"},
+			primary:          "pg-1",
+			status:           &InstanceStatus{IsPrimary: true, CurrentLSN: "1/100", TimeLineID: 1},
+			expectedReached:  true,
+			expectedReplayed: "1/100",
+		},
+		{
+			name:             "still in recovery",
+			annotations:      map[string]string{AnnotationBackupEndLSN: "0/5000138"},
+			primary:          "pg-1",
+			status:           &InstanceStatus{ReplayLSN: "0/4000000", TimeLineID: 1},
+			expectedReplayed: "0/4000000",
+			expectedProblems: []string{
+				"primary pg-1 is still in recovery",
+				"replayed up to 0/4000000, short of the end of the backup at 0/5000138",
+			},
+		},
+		{
+			name:             "earlier timeline",
+			annotations:      map[string]string{AnnotationBackupEndLSN: "0/5000138", AnnotationBackupEndWAL: "000000030000000000000005"},
+			primary:          "pg-1",
+			status:           &InstanceStatus{IsPrimary: true, CurrentLSN: "0/6000060", TimeLineID: 2},
+			expectedReplayed: "0/6000060",
+			expectedProblems: []string{"on timeline 2, before the backup's timeline 3"},
+		},
+		{
+			name:             "no annotation",
+			primary:          "pg-1",
+			status:           &InstanceStatus{IsPrimary: true, CurrentLSN: "0/6000060", TimeLineID: 1},
+			expectedReplayed: "0/6000060",
+			expectedProblems: []string{"no velero-cnpg/backup-end-lsn annotation, the backup pinned no completed CNPG backup"},
+		},
+		{
+			name:             "no primary",
+			annotations:      map[string]string{AnnotationBackupEndLSN: "0/5000138"},
+			expectedProblems: []string{"cluster has no primary yet"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := createMockArchivingCluster("pg", "default", "pg", nil)
+			cluster.SetAnnotations(tt.annotations)
+			if tt.primary != "" {
+				require.NoError(t, unstructured.SetNestedField(cluster.Object, tt.primary, "status", "currentPrimary"))
+			}
+
+			instanceStatus := func(_ context.Context, namespace, pod string) (*InstanceStatus, error) {
+				assert.Equal(t, "default", namespace)
+				assert.Equal(t, tt.primary, pod)
+				return tt.status, nil
+			}
+
+			result, err := VerifyRestoredCluster(context.Background(), newFakeDynamicClient(cluster), instanceStatus, "default", "pg")
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedReached, result.Reached)
+			assert.Equal(t, tt.expectedReplayed, result.ReplayedLSN)
+			assert.Equal(t, tt.expectedProblems, result.Problems)
+		})
+	}
+}
+
+func TestVerifyRestoredClusterNotFound(t *testing.T) {
+	instanceStatus := func(context.Context, string, string) (*InstanceStatus, error) {
+		return nil, nil
+	}
+
+	_, err := VerifyRestoredCluster(context.Background(), newFakeDynamicClient(), instanceStatus, "default", "pg")
+	assert.ErrorContains(t, err, "failed to get cluster default/pg")
+}
+
+func TestParseLSN(t *testing.T) {
+	lsn, err := parseLSN("16/B374D848")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0x16B374D848), lsn)
+
+	for _, invalid := range []string{"", "16", "16/", "x/1", "1/100000000"} {
+		_, err := parseLSN(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
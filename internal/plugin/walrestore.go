@@ -0,0 +1,56 @@
+package plugin
+
+import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// tuneWALRestore applies the WAL restore settings to the recovery source of the cluster.
+// The in-tree object store takes them in barmanObjectStore.wal, next to the settings copied
+// from spec.backup. The barman-cloud plugin reads them from the ObjectStore instead, which
+// is shared with other clusters and left alone, so plugin sources only get a warning.
+func (p *RestorePluginV2) tuneWALRestore(itemContent map[string]interface{}, config *WALRestoreConfig, warnings *restoreWarnings) error {
+	if config == nil || (config.MaxParallel == 0 && len(config.RestoreAdditionalCommandArgs) == 0) {
+		return nil
+	}
+
+	specMap, err := getSpecMap(itemContent)
+	if err != nil {
+		return err
+	}
+
+	var source map[string]interface{}
+	for _, externalCluster := range sliceOfMaps(specMap["externalClusters"]) {
+		if externalCluster["name"] == recoverySourceName {
+			source = externalCluster
+			break
+		}
+	}
+	if source == nil {
+		return nil
+	}
+
+	if _, found := source["barmanObjectStore"]; !found {
+		barmanObjectName, _, _ := unstructured.NestedString(source, "plugin", "parameters", "barmanObjectName")
+		warnings.Warnf("WAL restore tuning applies to barmanObjectStore recovery sources only, set spec.configuration.wal of ObjectStore %s instead", barmanObjectName)
+		return nil
+	}
+
+	wal, err := ensureNestedMapNoCopy(source, "barmanObjectStore", "wal")
+	if err != nil {
+		return err
+	}
+
+	if config.MaxParallel > 0 {
+		wal["maxParallel"] = int64(config.MaxParallel)
+	}
+	if len(config.RestoreAdditionalCommandArgs) > 0 {
+		args := make([]interface{}, 0, len(config.RestoreAdditionalCommandArgs))
+		for _, arg := range config.RestoreAdditionalCommandArgs {
+			args = append(args, arg)
+		}
+		wal["restoreAdditionalCommandArgs"] = args
+	}
+
+	p.log.Infof("Tuned WAL restore of %s: maxParallel=%d, restoreAdditionalCommandArgs=%v", recoverySourceName, config.MaxParallel, config.RestoreAdditionalCommandArgs)
+	return nil
+}
@@ -0,0 +1,61 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestTuneWALRestore(t *testing.T) {
+	plugin := &RestorePluginV2{log: logrus.New()}
+	config := &WALRestoreConfig{MaxParallel: 8, RestoreAdditionalCommandArgs: []string{"--read-timeout=60"}}
+
+	t.Run("in-tree object store source", func(t *testing.T) {
+		cluster := createMockArchivingCluster("pg", "default", "pg", nil)
+		require.NoError(t, unstructured.SetNestedField(cluster.Object, "gzip", "spec", "backup", "barmanObjectStore", "wal", "compression"))
+		require.NoError(t, plugin.configureExternalClusterObjectStore(cluster.Object, "pg"))
+		warnings := &restoreWarnings{log: logrus.New()}
+
+		require.NoError(t, plugin.tuneWALRestore(cluster.Object, config, warnings))
+
+		externalClusters, _, _ := unstructured.NestedSlice(cluster.Object, "spec", "externalClusters")
+		wal, _, _ := unstructured.NestedMap(externalClusters[0].(map[string]interface{}), "barmanObjectStore", "wal")
+		assert.Equal(t, map[string]interface{}{
+			"compression":                  "gzip",
+			"maxParallel":                  int64(8),
+			"restoreAdditionalCommandArgs": []interface{}{"--read-timeout=60"},
+		}, wal)
+		assert.Empty(t, warnings.messages)
+
+		// The archiving configuration of the cluster itself is left unchanged
+		_, found, _ := unstructured.NestedFieldNoCopy(cluster.Object, "spec", "backup", "barmanObjectStore", "wal", "maxParallel")
+		assert.False(t, found)
+	})
+
+	t.Run("plugin source", func(t *testing.T) {
+		cluster := createMockArchivingCluster("pg", "default", "pg", nil)
+		require.NoError(t, plugin.configureExternalCluster(cluster.Object, "pg", "store"))
+		warnings := &restoreWarnings{log: logrus.New()}
+
+		require.NoError(t, plugin.tuneWALRestore(cluster.Object, config, warnings))
+
+		externalClusters, _, _ := unstructured.NestedSlice(cluster.Object, "spec", "externalClusters")
+		assert.NotContains(t, externalClusters[0], "barmanObjectStore")
+		require.Len(t, warnings.messages, 1)
+		assert.Contains(t, warnings.messages[0], "ObjectStore store")
+	})
+
+	t.Run("not configured", func(t *testing.T) {
+		cluster := createMockArchivingCluster("pg", "default", "pg", nil)
+		require.NoError(t, plugin.configureExternalClusterObjectStore(cluster.Object, "pg"))
+
+		require.NoError(t, plugin.tuneWALRestore(cluster.Object, nil, &restoreWarnings{log: logrus.New()}))
+
+		externalClusters, _, _ := unstructured.NestedSlice(cluster.Object, "spec", "externalClusters")
+		_, found, _ := unstructured.NestedFieldNoCopy(externalClusters[0].(map[string]interface{}), "barmanObjectStore", "wal")
+		assert.False(t, found)
+	})
+}
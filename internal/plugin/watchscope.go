@@ -0,0 +1,109 @@
+package plugin
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// defaultOperatorSelector selects the CNPG operator Deployment, as labelled by the CNPG
+// manifests and Helm chart
+const defaultOperatorSelector = "app.kubernetes.io/name=cloudnative-pg"
+
+// watchNamespaceEnv is the operator environment variable restricting the namespaces it
+// reconciles; empty means every namespace
+const watchNamespaceEnv = "WATCH_NAMESPACE"
+
+// operatorWatchScope returns the namespaces the CNPG operators selected by selector reconcile.
+// all is true when an operator watches every namespace, and found is false when no operator
+// Deployment was found or its scope cannot be determined.
+func operatorWatchScope(ctx context.Context, client kubernetes.Interface, selector string) (namespaces []string, all, found bool, err error) {
+	deployments, err := client.AppsV1().Deployments(metav1.NamespaceAll).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, false, false, errors.Wrap(classifyAPIError(err), "failed to list CNPG operator Deployments")
+	}
+
+	for i := range deployments.Items {
+		watched, known := deploymentWatchNamespaces(&deployments.Items[i])
+		if !known {
+			return nil, false, false, nil
+		}
+		if len(watched) == 0 {
+			return nil, true, true, nil
+		}
+		namespaces = append(namespaces, watched...)
+		found = true
+	}
+	sort.Strings(namespaces)
+
+	return namespaces, false, found, nil
+}
+
+// deploymentWatchNamespaces reads WATCH_NAMESPACE from the operator Deployment. known is
+// false when the value comes from a source other than the Deployment itself.
+func deploymentWatchNamespaces(deployment *appsv1.Deployment) (namespaces []string, known bool) {
+	for _, container := range deployment.Spec.Template.Spec.Containers {
+		for _, env := range container.Env {
+			if env.Name != watchNamespaceEnv {
+				continue
+			}
+			if env.ValueFrom != nil {
+				// The Helm chart scopes the operator to its own namespace through the downward API
+				if env.ValueFrom.FieldRef != nil && env.ValueFrom.FieldRef.FieldPath == "metadata.namespace" {
+					return []string{deployment.Namespace}, true
+				}
+				return nil, false
+			}
+			for _, namespace := range strings.Split(env.Value, ",") {
+				if namespace = strings.TrimSpace(namespace); namespace != "" {
+					namespaces = append(namespaces, namespace)
+				}
+			}
+			return namespaces, true
+		}
+	}
+	return nil, true
+}
+
+// checkWatchScope reports a cluster restored into a namespace no CNPG operator watches,
+// where it would never be reconciled. It fails the restore of the cluster with the fail
+// policy and records a warning otherwise. The check is skipped when the operator
+// Deployment cannot be found or read.
+func (p *RestorePluginV2) checkWatchScope(namespace, policy, selector string, warnings *restoreWarnings) error {
+	client, err := p.getKubeClient()
+	if err != nil {
+		p.log.Warnf("Failed to create Kubernetes client, skipping operator watch scope check: %v", err)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	namespaces, all, found, err := operatorWatchScope(ctx, client, selector)
+	if err != nil {
+		p.log.Warnf("Skipping operator watch scope check: %v", err)
+		return nil
+	}
+	if !found || all {
+		return nil
+	}
+	for _, watched := range namespaces {
+		if watched == namespace {
+			return nil
+		}
+	}
+
+	err = errors.Errorf("the CNPG operator only watches namespaces %s, so the cluster restored into %s will not be reconciled; "+
+		"add the namespace to the operator's %s", strings.Join(namespaces, ", "), namespace, watchNamespaceEnv)
+	if policy == WatchScopeFail {
+		return err
+	}
+	warnings.Warnf("Restored outside the CNPG operator's watch scope: %v", err)
+	return nil
+}
@@ -0,0 +1,109 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// createMockOperator creates a CNPG operator Deployment with the given WATCH_NAMESPACE
+// variable, or none when env is nil
+func createMockOperator(namespace string, env *corev1.EnvVar) *appsv1.Deployment {
+	container := corev1.Container{Name: "manager", Image: "ghcr.io/cloudnative-pg/cloudnative-pg:1.26.0"}
+	if env != nil {
+		container.Env = []corev1.EnvVar{{Name: "OPERATOR_IMAGE_NAME", Value: container.Image}, *env}
+	}
+
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "cnpg-controller-manager",
+			Namespace: namespace,
+			Labels:    map[string]string{"app.kubernetes.io/name": "cloudnative-pg"},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{Containers: []corev1.Container{container}},
+			},
+		},
+	}
+}
+
+func TestCheckWatchScope(t *testing.T) {
+	tests := []struct {
+		name          string
+		objects       []runtime.Object
+		policy        string
+		expectedError string
+		expectWarning bool
+	}{
+		{
+			name: "no operator found",
+		},
+		{
+			name:    "operator watching all namespaces",
+			objects: []runtime.Object{createMockOperator("cnpg-system", nil)},
+		},
+		{
+			name:    "namespace listed",
+			objects: []runtime.Object{createMockOperator("cnpg-system", &corev1.EnvVar{Name: watchNamespaceEnv, Value: "team-a, postgres"})},
+		},
+		{
+			name: "operator scoped to the restore namespace",
+			objects: []runtime.Object{createMockOperator("postgres", &corev1.EnvVar{
+				Name:      watchNamespaceEnv,
+				ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.namespace"}},
+			})},
+		},
+		{
+			name: "scope from a ConfigMap",
+			objects: []runtime.Object{createMockOperator("cnpg-system", &corev1.EnvVar{
+				Name:      watchNamespaceEnv,
+				ValueFrom: &corev1.EnvVarSource{ConfigMapKeyRef: &corev1.ConfigMapKeySelector{Key: "namespaces"}},
+			})},
+		},
+		{
+			name:          "namespace not watched",
+			objects:       []runtime.Object{createMockOperator("cnpg-system", &corev1.EnvVar{Name: watchNamespaceEnv, Value: "team-a,team-b"})},
+			expectWarning: true,
+		},
+		{
+			name: "namespace watched by a second operator",
+			objects: []runtime.Object{
+				createMockOperator("cnpg-system", &corev1.EnvVar{Name: watchNamespaceEnv, Value: "team-a"}),
+				createMockOperator("cnpg-postgres", &corev1.EnvVar{Name: watchNamespaceEnv, Value: "postgres"}),
+			},
+		},
+		{
+			name:          "namespace not watched with fail policy",
+			objects:       []runtime.Object{createMockOperator("cnpg-system", &corev1.EnvVar{Name: watchNamespaceEnv, Value: "team-a,team-b"})},
+			policy:        WatchScopeFail,
+			expectedError: "only watches namespaces team-a, team-b",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plugin := &RestorePluginV2{log: logrus.New(), kubeClient: fake.NewSimpleClientset(tt.objects...)}
+			warnings := &restoreWarnings{log: logrus.New()}
+
+			err := plugin.checkWatchScope("postgres", tt.policy, defaultOperatorSelector, warnings)
+			if tt.expectedError != "" {
+				assert.ErrorContains(t, err, tt.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			if tt.expectWarning {
+				assert.Len(t, warnings.messages, 1)
+			} else {
+				assert.Empty(t, warnings.messages)
+			}
+		})
+	}
+}
@@ -0,0 +1,337 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes"
+)
+
+// defaultWebhookTimeout bounds each webhook call when its timeout is not set
+const defaultWebhookTimeout = 10 * time.Second
+
+// WebhookSignatureHeader is the header carrying the signature of webhook calls, as
+// sha256=<hex HMAC-SHA256 of the body with the webhook's signing secret>
+const WebhookSignatureHeader = "X-Velero-CNPG-Signature"
+
+// webhookRecoveryTargetKinds are the recoveryTarget fields that choose where recovery
+// stops, of which a cluster may set only one
+var webhookRecoveryTargetKinds = []string{"targetXID", "targetName", "targetLSN", "targetTime", "targetImmediate"}
+
+// webhookRecoveryTargetFields are the recoveryTarget fields a webhook may set, with
+// whether each is a boolean rather than a string
+var webhookRecoveryTargetFields = map[string]bool{
+	"backupID":        false,
+	"targetTLI":       false,
+	"targetXID":       false,
+	"targetName":      false,
+	"targetLSN":       false,
+	"targetTime":      false,
+	"targetImmediate": true,
+	"exclusive":       true,
+}
+
+// webhookEvent is the body POSTed to webhooks
+type webhookEvent struct {
+	// Event is the event the webhook is called on
+	Event string `json:"event"`
+
+	// Operation is the name of the Velero backup or restore
+	Operation string `json:"operation"`
+
+	// Namespace is the namespace of the cluster
+	Namespace string `json:"namespace"`
+
+	// ClusterName is the name of the cluster
+	ClusterName string `json:"clusterName"`
+
+	// ServerName is the serverName the cluster was backed up with, unset before a backup
+	ServerName string `json:"serverName,omitempty"`
+
+	// BackupMethod is how the cluster was backed up, unset before a backup
+	BackupMethod string `json:"backupMethod,omitempty"`
+
+	// Result is the result annotation of the cluster, set on post events
+	Result json.RawMessage `json:"result,omitempty"`
+}
+
+// webhookResponse is the response of a webhook. An empty response allows the backup or
+// restore to go ahead.
+type webhookResponse struct {
+	// Allowed set to false on a pre event denies the backup or restore of the cluster
+	Allowed *bool `json:"allowed,omitempty"`
+
+	// Reason explains a denial
+	Reason string `json:"reason,omitempty"`
+
+	// RecoveryTarget answered to a preRestore event sets the recovery target of the
+	// restored cluster
+	RecoveryTarget map[string]interface{} `json:"recoveryTarget,omitempty"`
+}
+
+// timeout returns how long a call to the webhook may take
+func (c *WebhookConfig) timeout() time.Duration {
+	if timeout, err := time.ParseDuration(c.Timeout); err == nil && timeout > 0 {
+		return timeout
+	}
+	return defaultWebhookTimeout
+}
+
+// subscribes reports whether the webhook is called on the event
+func (c *WebhookConfig) subscribes(event string) bool {
+	for _, subscribed := range c.Events {
+		if subscribed == event {
+			return true
+		}
+	}
+	return false
+}
+
+// newWebhookEvent describes the cluster to the webhooks of an event. Pre events describe
+// the cluster as received, post events carry the result of the action.
+func newWebhookEvent(event, operation string, itemContent map[string]interface{}) webhookEvent {
+	cluster := &unstructured.Unstructured{Object: itemContent}
+	payload := webhookEvent{
+		Event:       event,
+		Operation:   operation,
+		Namespace:   cluster.GetNamespace(),
+		ClusterName: cluster.GetName(),
+	}
+	annotations := cluster.GetAnnotations()
+	// Before a backup these are left over from the previous one
+	if event != WebhookEventPreBackup {
+		payload.ServerName = annotations[AnnotationServerName]
+		payload.BackupMethod = annotations[AnnotationBackupMethod]
+	}
+	if event == WebhookEventPostBackup || event == WebhookEventPostRestore {
+		if result := annotations[AnnotationResult]; json.Valid([]byte(result)) {
+			payload.Result = json.RawMessage(result)
+		}
+	}
+	return payload
+}
+
+// callWebhooks calls the webhooks subscribed to the event in order, and returns the
+// recovery target they set. A later webhook overrides the fields set by earlier ones, and
+// its target kind replaces theirs. A webhook denying a pre event fails the item whatever
+// its failure policy; a failed call fails it only under the fail policy and is otherwise
+// warned about. getKubeClient reads the signing secrets of the webhooks.
+func callWebhooks(webhooks []WebhookConfig, event webhookEvent, getKubeClient func() (kubernetes.Interface, error), warn func(format string, args ...interface{})) (map[string]interface{}, error) {
+	var recoveryTarget map[string]interface{}
+	for i := range webhooks {
+		webhook := &webhooks[i]
+		if !webhook.subscribes(event.Event) {
+			continue
+		}
+
+		response, err := callWebhook(webhook, event, getKubeClient)
+		if err != nil {
+			if webhook.FailurePolicy == WebhookFailureFail {
+				return nil, err
+			}
+			warn("Ignoring failed webhook %s: %v", webhook.Name, err)
+			continue
+		}
+
+		if response.Allowed != nil && !*response.Allowed {
+			if event.Event != WebhookEventPreBackup && event.Event != WebhookEventPreRestore {
+				warn("Webhook %s denied %s after the fact, ignoring it: %s", webhook.Name, event.Event, response.Reason)
+				continue
+			}
+			return nil, errors.Errorf("webhook %s denied %s of cluster %s/%s: %s", webhook.Name, event.Event, event.Namespace, event.ClusterName, response.Reason)
+		}
+
+		if len(response.RecoveryTarget) == 0 {
+			continue
+		}
+		if recoveryTarget == nil {
+			recoveryTarget = map[string]interface{}{}
+		}
+		if hasRecoveryTargetKind(response.RecoveryTarget) {
+			for _, kind := range webhookRecoveryTargetKinds {
+				delete(recoveryTarget, kind)
+			}
+		}
+		for key, value := range response.RecoveryTarget {
+			recoveryTarget[key] = value
+		}
+	}
+	return recoveryTarget, nil
+}
+
+// hasRecoveryTargetKind reports whether the recovery target chooses where recovery stops
+func hasRecoveryTargetKind(target map[string]interface{}) bool {
+	for _, kind := range webhookRecoveryTargetKinds {
+		if _, set := target[kind]; set {
+			return true
+		}
+	}
+	return false
+}
+
+// callWebhook POSTs the event to the webhook, signed when it has a signing secret, and
+// checks its response
+func callWebhook(webhook *WebhookConfig, event webhookEvent, getKubeClient func() (kubernetes.Interface, error)) (*webhookResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), webhook.timeout())
+	defer cancel()
+
+	var key []byte
+	if webhook.SigningSecret != nil {
+		var err error
+		if key, err = webhookSigningKey(ctx, webhook, getKubeClient); err != nil {
+			return nil, err
+		}
+	}
+
+	var response webhookResponse
+	if err := postSignedJSON(ctx, http.DefaultClient, webhook.URL, "webhook "+webhook.Name, key, event, &response); err != nil {
+		return nil, err
+	}
+
+	if len(response.RecoveryTarget) > 0 && event.Event != WebhookEventPreRestore {
+		return nil, errors.Errorf("webhook %s answered a recoveryTarget to %s, only preRestore may set one", webhook.Name, event.Event)
+	}
+	if err := checkWebhookRecoveryTarget(response.RecoveryTarget); err != nil {
+		return nil, errors.Wrapf(err, "webhook %s answered an invalid recoveryTarget", webhook.Name)
+	}
+	return &response, nil
+}
+
+// webhookSigningKey reads the signing secret of the webhook from the Velero namespace
+func webhookSigningKey(ctx context.Context, webhook *WebhookConfig, getKubeClient func() (kubernetes.Interface, error)) ([]byte, error) {
+	kubeClient, err := getKubeClient()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get Kubernetes client")
+	}
+
+	namespace, selector := veleroNamespace(), webhook.SigningSecret
+	secret, err := kubeClient.CoreV1().Secrets(namespace).Get(ctx, selector.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(classifyAPIError(err), "failed to get signing secret %s/%s of webhook %s", namespace, selector.Name, webhook.Name)
+	}
+	key := secret.Data[selector.Key]
+	if len(key) == 0 {
+		return nil, errors.Errorf("signing secret %s/%s of webhook %s has no key %s", namespace, selector.Name, webhook.Name, selector.Key)
+	}
+	return key, nil
+}
+
+// checkWebhookRecoveryTarget checks a recovery target answered by a webhook
+func checkWebhookRecoveryTarget(target map[string]interface{}) error {
+	kinds := 0
+	for key, value := range target {
+		boolean, known := webhookRecoveryTargetFields[key]
+		if !known {
+			return errors.Errorf("unknown field %q", key)
+		}
+		if _, ok := value.(bool); boolean && !ok {
+			return errors.Errorf("%s must be a boolean", key)
+		}
+		if _, ok := value.(string); !boolean && !ok {
+			return errors.Errorf("%s must be a string", key)
+		}
+		for _, kind := range webhookRecoveryTargetKinds {
+			if key == kind {
+				kinds++
+			}
+		}
+	}
+	if kinds > 1 {
+		return errors.Errorf("only one of %s may be set", strings.Join(webhookRecoveryTargetKinds, ", "))
+	}
+	return nil
+}
+
+// postJSON POSTs request as JSON to url and decodes the JSON response into response. An
+// empty response body leaves response untouched, and a nil response ignores the body.
+// what names the endpoint in errors.
+func postJSON(ctx context.Context, client *http.Client, url, what string, request, response interface{}) error {
+	return postSignedJSON(ctx, client, url, what, nil, request, response)
+}
+
+// postSignedJSON is postJSON signing the body in the WebhookSignatureHeader header with
+// key, unless key is empty
+func postSignedJSON(ctx context.Context, client *http.Client, url, what string, key []byte, request, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode %s request", what)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrapf(err, "failed to build %s request", what)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(key) > 0 {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(body)
+		req.Header.Set(WebhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "%s request failed", what)
+	}
+	defer resp.Body.Close()
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %s response", what)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("%s answered %s: %s", what, resp.Status, strings.TrimSpace(string(raw)))
+	}
+	if response == nil || len(bytes.TrimSpace(raw)) == 0 {
+		return nil
+	}
+
+	if err := json.Unmarshal(raw, response); err != nil {
+		return errors.Wrapf(err, "failed to decode %s response", what)
+	}
+	return nil
+}
+
+// applyWebhookRecoveryTarget sets the recovery target answered by the preRestore webhooks.
+// Its target kind replaces the one already configured, and its other fields are merged in.
+func (p *RestorePluginV2) applyWebhookRecoveryTarget(itemContent map[string]interface{}, target map[string]interface{}, warnings *restoreWarnings) error {
+	recovery, found, err := nestedMapNoCopy(itemContent, "spec", "bootstrap", "recovery")
+	if err != nil {
+		return err
+	}
+	if !found {
+		warnings.Warnf("Cluster does not bootstrap from a recovery, ignoring the recovery target from webhooks")
+		return nil
+	}
+
+	recoveryTarget, err := ensureNestedMapNoCopy(recovery, "recoveryTarget")
+	if err != nil {
+		return errors.Wrap(err, "failed to configure recovery target")
+	}
+	if hasRecoveryTargetKind(target) {
+		for _, kind := range webhookRecoveryTargetKinds {
+			delete(recoveryTarget, kind)
+		}
+	}
+	keys := make([]string, 0, len(target))
+	for key, value := range target {
+		recoveryTarget[key] = value
+		keys = append(keys, fmt.Sprintf("%s=%v", key, value))
+	}
+	sort.Strings(keys)
+
+	p.log.Infof("Configured recovery target from webhooks: %s", strings.Join(keys, ", "))
+	return nil
+}
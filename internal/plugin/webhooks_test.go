@@ -0,0 +1,322 @@
+package plugin
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// webhookServer answers every webhook call with response and records the events it receives
+func webhookServer(t *testing.T, response *string) (*httptest.Server, *[]webhookEvent) {
+	t.Helper()
+	var received []webhookEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event webhookEvent
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&event))
+		received = append(received, event)
+		if *response == "error" {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(*response))
+	}))
+	t.Cleanup(server.Close)
+	return server, &received
+}
+
+func TestNewWebhookEvent(t *testing.T) {
+	item := createMockPluginCluster("pg", "default").Object
+	item["metadata"].(map[string]interface{})["annotations"] = map[string]interface{}{
+		AnnotationServerName:   "pg",
+		AnnotationBackupMethod: BackupMethodPlugin,
+		AnnotationResult:       `{"action":"restore","outcome":"processed"}`,
+	}
+
+	assert.Equal(t, webhookEvent{Event: WebhookEventPreBackup, Operation: "nightly", Namespace: "default", ClusterName: "pg"},
+		newWebhookEvent(WebhookEventPreBackup, "nightly", item))
+	assert.Equal(t, webhookEvent{Event: WebhookEventPreRestore, Operation: "dr", Namespace: "default", ClusterName: "pg", ServerName: "pg", BackupMethod: BackupMethodPlugin},
+		newWebhookEvent(WebhookEventPreRestore, "dr", item))
+	assert.JSONEq(t, `{"action":"restore","outcome":"processed"}`, string(newWebhookEvent(WebhookEventPostRestore, "dr", item).Result))
+}
+
+func TestCallWebhooks(t *testing.T) {
+	var response string
+	server, received := webhookServer(t, &response)
+	event := webhookEvent{Event: WebhookEventPreRestore, Operation: "dr", Namespace: "default", ClusterName: "pg"}
+
+	tests := []struct {
+		name          string
+		response      string
+		failurePolicy string
+		expected      map[string]interface{}
+		expectedError string
+		warned        bool
+	}{
+		{name: "empty response", response: ""},
+		{name: "allowed", response: `{"allowed":true}`},
+		{name: "denied", response: `{"allowed":false,"reason":"change freeze"}`, expectedError: "denied preRestore of cluster default/pg: change freeze"},
+		{
+			name:     "recovery target",
+			response: `{"recoveryTarget":{"targetTime":"2024-10-24 12:00:00+00","exclusive":true}}`,
+			expected: map[string]interface{}{"targetTime": "2024-10-24 12:00:00+00", "exclusive": true},
+		},
+		{name: "unknown recovery target field", response: `{"recoveryTarget":{"targetPoint":"x"}}`, warned: true},
+		{name: "recovery target with two kinds", response: `{"recoveryTarget":{"targetName":"x","targetLSN":"0/3000000"}}`, failurePolicy: WebhookFailureFail, expectedError: "only one of"},
+		{name: "recovery target of the wrong type", response: `{"recoveryTarget":{"targetImmediate":"yes"}}`, failurePolicy: WebhookFailureFail, expectedError: "must be a boolean"},
+		{name: "failure ignored", response: "error", warned: true},
+		{name: "failure fails", response: "error", failurePolicy: WebhookFailureFail, expectedError: "503 Service Unavailable: unavailable"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response = tt.response
+			warned := false
+			webhooks := []WebhookConfig{
+				{Name: "cmdb", URL: server.URL, Events: []string{WebhookEventPostRestore}},
+				{Name: "approval", URL: server.URL, Events: []string{WebhookEventPreRestore}, FailurePolicy: tt.failurePolicy},
+			}
+			*received = nil
+
+			target, err := callWebhooks(webhooks, event, noKubeClient, func(string, ...interface{}) { warned = true })
+			if tt.expectedError != "" {
+				assert.ErrorContains(t, err, tt.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, target)
+			assert.Equal(t, tt.warned, warned)
+			assert.Equal(t, []webhookEvent{event}, *received)
+		})
+	}
+
+	t.Run("recovery target on another event", func(t *testing.T) {
+		response = `{"recoveryTarget":{"targetName":"x"}}`
+		webhooks := []WebhookConfig{{Name: "cmdb", URL: server.URL, Events: []string{WebhookEventPostRestore}, FailurePolicy: WebhookFailureFail}}
+		_, err := callWebhooks(webhooks, webhookEvent{Event: WebhookEventPostRestore}, noKubeClient, func(string, ...interface{}) {})
+		assert.ErrorContains(t, err, "only preRestore may set one")
+	})
+
+	t.Run("denied after the fact", func(t *testing.T) {
+		response = `{"allowed":false}`
+		warned := false
+		webhooks := []WebhookConfig{{Name: "cmdb", URL: server.URL, Events: []string{WebhookEventPostBackup}}}
+		_, err := callWebhooks(webhooks, webhookEvent{Event: WebhookEventPostBackup}, noKubeClient, func(string, ...interface{}) { warned = true })
+		require.NoError(t, err)
+		assert.True(t, warned)
+	})
+}
+
+// noKubeClient is the Kubernetes client getter of webhooks without signing secret
+func noKubeClient() (kubernetes.Interface, error) {
+	return nil, errors.New("no Kubernetes client")
+}
+
+func TestCallWebhooksRecoveryTargetKinds(t *testing.T) {
+	responses := map[string]string{
+		"/change":   `{"recoveryTarget":{"targetTime":"2024-10-24 12:00:00+00","exclusive":true}}`,
+		"/incident": `{"recoveryTarget":{"targetLSN":"0/3000000"}}`,
+		"/timeline": `{"recoveryTarget":{"targetTLI":"2"}}`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(responses[r.URL.Path]))
+	}))
+	defer server.Close()
+
+	webhooks := []WebhookConfig{
+		{Name: "change", URL: server.URL + "/change", Events: []string{WebhookEventPreRestore}},
+		{Name: "incident", URL: server.URL + "/incident", Events: []string{WebhookEventPreRestore}},
+		{Name: "timeline", URL: server.URL + "/timeline", Events: []string{WebhookEventPreRestore}},
+	}
+	target, err := callWebhooks(webhooks, webhookEvent{Event: WebhookEventPreRestore}, noKubeClient, func(string, ...interface{}) {})
+	require.NoError(t, err)
+	// The kind of a later webhook replaces the one of an earlier webhook, other fields are merged
+	assert.Equal(t, map[string]interface{}{"targetLSN": "0/3000000", "exclusive": true, "targetTLI": "2"}, target)
+	require.NoError(t, checkWebhookRecoveryTarget(target))
+}
+
+func TestCallWebhooksSigned(t *testing.T) {
+	var signature string
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signature = r.Header.Get(WebhookSignatureHeader)
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	t.Setenv("VELERO_NAMESPACE", "velero")
+	kubeClient := fake.NewClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "webhook-signing", Namespace: "velero"},
+		Data:       map[string][]byte{"key": []byte("secret")},
+	})
+	getKubeClient := func() (kubernetes.Interface, error) { return kubeClient, nil }
+	event := webhookEvent{Event: WebhookEventPostBackup, Operation: "nightly", Namespace: "default", ClusterName: "pg"}
+
+	webhooks := []WebhookConfig{{
+		Name:          "cmdb",
+		URL:           server.URL,
+		Events:        []string{WebhookEventPostBackup},
+		FailurePolicy: WebhookFailureFail,
+		SigningSecret: &SecretKeySelector{Name: "webhook-signing", Key: "key"},
+	}}
+	_, err := callWebhooks(webhooks, event, getKubeClient, func(string, ...interface{}) {})
+	require.NoError(t, err)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(body)
+	assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), signature)
+
+	// Webhooks without signing secret are not signed
+	webhooks[0].SigningSecret = nil
+	_, err = callWebhooks(webhooks, event, noKubeClient, func(string, ...interface{}) {})
+	require.NoError(t, err)
+	assert.Empty(t, signature)
+
+	// A missing key is a failed call, rather than a call without signature
+	webhooks[0].SigningSecret = &SecretKeySelector{Name: "webhook-signing", Key: "other"}
+	_, err = callWebhooks(webhooks, event, getKubeClient, func(string, ...interface{}) {})
+	assert.ErrorContains(t, err, "signing secret velero/webhook-signing of webhook cmdb has no key other")
+}
+
+func TestApplyWebhookRecoveryTarget(t *testing.T) {
+	plugin := &RestorePluginV2{log: logrus.New()}
+
+	item := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"bootstrap": map[string]interface{}{
+				"recovery": map[string]interface{}{
+					"source":         "origin",
+					"recoveryTarget": map[string]interface{}{"backupID": "20241024T120000", "targetName": "velero-nightly"},
+				},
+			},
+		},
+	}
+	warnings := &restoreWarnings{log: plugin.log}
+	require.NoError(t, plugin.applyWebhookRecoveryTarget(item, map[string]interface{}{"targetTime": "2024-10-24 12:00:00+00"}, warnings))
+	target, _, _ := unstructured.NestedMap(item, "spec", "bootstrap", "recovery", "recoveryTarget")
+	assert.Equal(t, map[string]interface{}{"backupID": "20241024T120000", "targetTime": "2024-10-24 12:00:00+00"}, target)
+	assert.Empty(t, warnings.messages)
+
+	require.NoError(t, plugin.applyWebhookRecoveryTarget(map[string]interface{}{"spec": map[string]interface{}{}}, map[string]interface{}{"targetName": "x"}, warnings))
+	assert.Len(t, warnings.messages, 1)
+}
+
+func TestExecuteWebhooks(t *testing.T) {
+	var response string
+	server, received := webhookServer(t, &response)
+	webhooks := []WebhookConfig{{
+		Name:          "approval",
+		URL:           server.URL,
+		Events:        []string{WebhookEventPreBackup, WebhookEventPostBackup, WebhookEventPreRestore, WebhookEventPostRestore},
+		FailurePolicy: WebhookFailureFail,
+	}}
+
+	client := fake.NewClientset()
+	backupPlugin := &BackupPluginV2{
+		log:           logrus.New(),
+		config:        &PluginConfig{Webhooks: webhooks},
+		dynamicClient: newFakeDynamicClient(),
+		kubeClient:    client,
+	}
+	backup := &v1.Backup{ObjectMeta: metav1.ObjectMeta{Name: "nightly", Namespace: "velero"}}
+
+	t.Run("backup", func(t *testing.T) {
+		response = `{}`
+		*received = nil
+		_, _, _, _, err := backupPlugin.Execute(createMockPluginCluster("pg", "default"), backup)
+		require.NoError(t, err)
+		require.Len(t, *received, 2)
+		assert.Equal(t, WebhookEventPreBackup, (*received)[0].Event)
+		assert.Equal(t, WebhookEventPostBackup, (*received)[1].Event)
+		assert.Equal(t, "nightly", (*received)[1].Operation)
+		assert.Equal(t, "pg", (*received)[1].ServerName)
+		assert.Contains(t, string((*received)[1].Result), `"outcome":"processed"`)
+	})
+
+	t.Run("backup denied", func(t *testing.T) {
+		response = `{"allowed":false,"reason":"maintenance"}`
+		*received = nil
+		_, _, _, _, err := backupPlugin.Execute(createMockPluginCluster("pg", "default"), backup)
+		assert.ErrorContains(t, err, "maintenance")
+		assert.Len(t, *received, 1)
+	})
+
+	config := DefaultPluginConfig()
+	config.SkipPluginCheck = true
+	config.Webhooks = webhooks
+	newRestorePlugin := func(config *PluginConfig) *RestorePluginV2 {
+		return &RestorePluginV2{
+			log:           logrus.New(),
+			config:        config,
+			dynamicClient: newFakeDynamicClient(),
+			kubeClient:    newFakeKubeClient(),
+		}
+	}
+	restorePlugin := newRestorePlugin(config)
+	restore := &v1.Restore{ObjectMeta: metav1.ObjectMeta{Name: "dr-drill", Namespace: "velero"}}
+
+	newItem := func() *unstructured.Unstructured {
+		item := createMockPluginCluster("pg", "default")
+		item.SetAnnotations(map[string]string{
+			AnnotationServerName:   "pg",
+			AnnotationBackupMethod: BackupMethodPlugin,
+		})
+		return item
+	}
+
+	t.Run("restore", func(t *testing.T) {
+		response = `{}`
+		*received = nil
+		output, err := restorePlugin.Execute(&velero.RestoreItemActionExecuteInput{Item: newItem(), Restore: restore})
+		require.NoError(t, err)
+		require.Len(t, *received, 2)
+		assert.Equal(t, WebhookEventPreRestore, (*received)[0].Event)
+		assert.Equal(t, WebhookEventPostRestore, (*received)[1].Event)
+		assert.Contains(t, string((*received)[1].Result), `"action":"restore"`)
+		_, found, _ := unstructured.NestedMap(output.UpdatedItem.UnstructuredContent(), "spec", "bootstrap", "recovery", "recoveryTarget")
+		assert.False(t, found)
+	})
+
+	t.Run("restore denied", func(t *testing.T) {
+		response = `{"allowed":false,"reason":"production restores need a ticket"}`
+		*received = nil
+		_, err := restorePlugin.Execute(&velero.RestoreItemActionExecuteInput{Item: newItem(), Restore: restore})
+		assert.ErrorContains(t, err, "production restores need a ticket")
+		require.Len(t, *received, 1)
+		assert.Equal(t, webhookEvent{
+			Event:        WebhookEventPreRestore,
+			Operation:    "dr-drill",
+			Namespace:    "default",
+			ClusterName:  "pg",
+			ServerName:   "pg",
+			BackupMethod: BackupMethodPlugin,
+		}, (*received)[0])
+	})
+
+	t.Run("restore with recovery target", func(t *testing.T) {
+		targetConfig := *config
+		targetConfig.Webhooks = []WebhookConfig{{Name: "target", URL: server.URL, Events: []string{WebhookEventPreRestore}}}
+		targetPlugin := newRestorePlugin(&targetConfig)
+
+		response = `{"recoveryTarget":{"targetLSN":"0/3000000"}}`
+		output, err := targetPlugin.Execute(&velero.RestoreItemActionExecuteInput{Item: newItem(), Restore: restore})
+		require.NoError(t, err)
+		lsn, _, _ := unstructured.NestedString(output.UpdatedItem.UnstructuredContent(), "spec", "bootstrap", "recovery", "recoveryTarget", "targetLSN")
+		assert.Equal(t, "0/3000000", lsn)
+	})
+}
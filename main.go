@@ -1,17 +1,110 @@
 package main
 
 import (
+	"os"
+
 	"github.com/nvanthao/velero-plugin-cnpg-restore/internal/plugin"
 	"github.com/sirupsen/logrus"
 	"github.com/vmware-tanzu/velero/pkg/plugin/framework"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework/common"
 )
 
+// action is an item action the plugin server can register
+type action struct {
+	name        string
+	initializer common.HandlerInitializer
+}
+
+var restoreItemActions = []action{
+	{plugin.RestorePluginName, newRestorePluginV2},
+	{plugin.DeploymentRestorePluginName, newDeploymentRestorePlugin},
+	{plugin.PDBRestorePluginName, newPDBRestorePlugin},
+	{plugin.DependentsRestorePluginName, newDependentsRestorePlugin},
+	{plugin.OverrideConfigMapRestorePluginName, newOverrideConfigMapRestorePlugin},
+	{plugin.ResourcePatchRestorePluginName, newResourcePatchRestorePlugin},
+}
+
+var backupItemActions = []action{
+	{plugin.BackupPluginName, newBackupPluginV2},
+	{plugin.SnapshotFencingPluginName, newSnapshotFencingPluginV2},
+}
+
+// itemBlockActions share the name of the backup item action they take part in, so they are
+// enabled and disabled together with it
+var itemBlockActions = []action{
+	{plugin.SnapshotFencingPluginName, newSnapshotFencingPluginV2},
+}
+
 func main() {
-	framework.NewServer().
-		RegisterRestoreItemActionV2("replicated.com/cnpg-restore-plugin", newRestorePluginV2).
-		RegisterRestoreItemActionV2("replicated.com/deployment-restore-plugin", newDeploymentRestorePlugin).
-		RegisterBackupItemActionV2("replicated.com/cnpg-backup-plugin", newBackupPluginV2).
-		Serve()
+	// Subcommands run in place of the plugin server
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "verify":
+			os.Exit(runVerify(os.Args[2:], os.Stdout, os.Stderr))
+		case "diagnostics":
+			os.Exit(runDiagnostics(os.Args[2:], os.Stdout, os.Stderr))
+		case "inspect-backup":
+			os.Exit(runInspectBackup(os.Args[2:], os.Stdout, os.Stderr))
+		case "simulate-restore":
+			os.Exit(runSimulateRestore(os.Args[2:], os.Stdout, os.Stderr))
+		case "cleanup-rehearsals":
+			os.Exit(runCleanupRehearsals(os.Args[2:], os.Stdout, os.Stderr))
+		}
+	}
+
+	log := logrus.New()
+	toggles := plugin.LoadActionToggles()
+	server := framework.NewServer()
+
+	if err := plugin.LoadAPILimits(); err != nil {
+		log.Fatalf("Failed to load API limits: %v", err)
+	}
+
+	faults, err := plugin.LoadFaultInjection()
+	if err != nil {
+		log.Fatalf("Failed to load fault injection: %v", err)
+	}
+	if faults != "" {
+		log.Warnf("Injecting faults into the plugin's API calls: %s", faults)
+	}
+
+	instances, err := plugin.LoadRestoreInstances()
+	if err != nil {
+		log.Fatalf("Failed to load restore action instances: %v", err)
+	}
+	for _, instance := range instances {
+		name := plugin.RestorePluginInstanceName(instance)
+		restoreItemActions = append(restoreItemActions, action{name, newNamedRestorePluginV2(name)})
+	}
+
+	for _, a := range restoreItemActions {
+		if !toggles.Enabled(a.name) {
+			log.Infof("Restore item action %s is disabled", a.name)
+			continue
+		}
+		server.RegisterRestoreItemActionV2(a.name, a.initializer)
+		log.Infof("Restore item action %s is active", a.name)
+	}
+
+	for _, a := range backupItemActions {
+		if !toggles.Enabled(a.name) {
+			log.Infof("Backup item action %s is disabled", a.name)
+			continue
+		}
+		server.RegisterBackupItemActionV2(a.name, a.initializer)
+		log.Infof("Backup item action %s is active", a.name)
+	}
+
+	for _, a := range itemBlockActions {
+		if !toggles.Enabled(a.name) {
+			log.Infof("ItemBlock action %s is disabled", a.name)
+			continue
+		}
+		server.RegisterItemBlockAction(a.name, a.initializer)
+		log.Infof("ItemBlock action %s is active", a.name)
+	}
+
+	server.Serve()
 }
 
 func newBackupPluginV2(logger logrus.FieldLogger) (interface{}, error) {
@@ -22,6 +115,32 @@ func newRestorePluginV2(logger logrus.FieldLogger) (interface{}, error) {
 	return plugin.NewRestorePluginV2(logger), nil
 }
 
+func newNamedRestorePluginV2(name string) common.HandlerInitializer {
+	return func(logger logrus.FieldLogger) (interface{}, error) {
+		return plugin.NewNamedRestorePluginV2(logger, name), nil
+	}
+}
+
 func newDeploymentRestorePlugin(logger logrus.FieldLogger) (interface{}, error) {
 	return plugin.NewDeploymentRestorePlugin(logger), nil
 }
+
+func newPDBRestorePlugin(logger logrus.FieldLogger) (interface{}, error) {
+	return plugin.NewPDBRestorePlugin(logger), nil
+}
+
+func newDependentsRestorePlugin(logger logrus.FieldLogger) (interface{}, error) {
+	return plugin.NewDependentsRestorePlugin(logger), nil
+}
+
+func newOverrideConfigMapRestorePlugin(logger logrus.FieldLogger) (interface{}, error) {
+	return plugin.NewOverrideConfigMapRestorePlugin(logger), nil
+}
+
+func newResourcePatchRestorePlugin(logger logrus.FieldLogger) (interface{}, error) {
+	return plugin.NewResourcePatchRestorePlugin(logger), nil
+}
+
+func newSnapshotFencingPluginV2(logger logrus.FieldLogger) (interface{}, error) {
+	return plugin.NewSnapshotFencingPluginV2(logger), nil
+}
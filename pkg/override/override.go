@@ -0,0 +1,302 @@
+// Package override reads the cnpg-velero-override ConfigMap the velero-plugin-cnpg-restore
+// restore action writes next to every restored CNPG cluster.
+//
+// Applications deploying CNPG clusters use it to pick the barman serverNames of a
+// restored cluster: the cluster archives to WriteToServerName and recovers from
+// ReadFromServerName, the serverName of the backed-up cluster.
+//
+// Clusters restored as replica clusters carry promotion instructions: PromoteAfter is
+// how long the replica cluster should replicate healthily before it is promoted.
+//
+// Every restored cluster writes its keys prefixed with its name, e.g.
+// pg.write_to_server_name, so clusters sharing a namespace do not overwrite each
+// other. The unprefixed keys hold the values of the cluster restored last and are kept
+// for namespaces with a single cluster.
+//
+// A cluster restored again keeps the serverNames of its earlier restores in History,
+// under its prefixed history key only, so the sequence of restores can be reconstructed.
+package override
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// ConfigMapName is the name of the override ConfigMap
+	ConfigMapName = "cnpg-velero-override"
+
+	// KeyWriteToServerName is the data key holding the serverName the restored cluster archives to
+	KeyWriteToServerName = "write_to_server_name"
+
+	// KeyReadFromServerName is the data key holding the serverName the restored cluster recovers from
+	KeyReadFromServerName = "read_from_server_name"
+
+	// KeyPromoteAfter is the data key holding how long a replica cluster should replicate
+	// healthily before it is promoted, as a Go duration
+	KeyPromoteAfter = "promote_after"
+
+	// KeyHistory is the data key holding the serverNames of earlier restores of the
+	// cluster, as a JSON list of HistoryEntry from oldest to newest. It is only written
+	// prefixed with the cluster name.
+	KeyHistory = "history"
+)
+
+// ClusterKey returns the data key holding the value of key for the named cluster
+func ClusterKey(cluster, key string) string {
+	return cluster + "." + key
+}
+
+// ErrNotFound is returned when a namespace has no override ConfigMap, i.e. no cluster
+// was restored into it
+var ErrNotFound = errors.New("override ConfigMap not found")
+
+// Override is the content of the override ConfigMap
+type Override struct {
+	// WriteToServerName is the serverName the restored cluster archives to
+	WriteToServerName string
+
+	// ReadFromServerName is the serverName the restored cluster recovers from
+	ReadFromServerName string
+
+	// PromoteAfter is how long the restored replica cluster should replicate healthily
+	// before it is promoted. Zero means it is not to be promoted automatically.
+	PromoteAfter time.Duration
+
+	// History holds the serverNames earlier restores of the cluster wrote, from oldest to
+	// newest
+	History []HistoryEntry
+}
+
+// HistoryEntry records the serverNames an earlier restore of a cluster wrote, and when a
+// later restore replaced them
+type HistoryEntry struct {
+	// WriteToServerName is the serverName the cluster archived to
+	WriteToServerName string `json:"writeToServerName"`
+
+	// ReadFromServerName is the serverName the cluster recovered from
+	ReadFromServerName string `json:"readFromServerName"`
+
+	// ReplacedAt is when a later restore replaced them, in RFC 3339
+	ReplacedAt string `json:"replacedAt"`
+}
+
+// FromConfigMap parses an override ConfigMap from its unprefixed keys
+func FromConfigMap(configMap *corev1.ConfigMap) (*Override, error) {
+	return fromData(configMap, "")
+}
+
+// FromConfigMapForCluster parses the keys of the named cluster from an override
+// ConfigMap, falling back to the unprefixed keys written before clusters had their own
+func FromConfigMapForCluster(configMap *corev1.ConfigMap, cluster string) (*Override, error) {
+	if _, found := configMap.Data[ClusterKey(cluster, KeyWriteToServerName)]; !found {
+		return FromConfigMap(configMap)
+	}
+	return fromData(configMap, cluster)
+}
+
+// fromData parses the keys of the override ConfigMap written for cluster, or the
+// unprefixed keys when cluster is empty
+func fromData(configMap *corev1.ConfigMap, cluster string) (*Override, error) {
+	key := func(key string) string {
+		if cluster == "" {
+			return key
+		}
+		return ClusterKey(cluster, key)
+	}
+
+	override := &Override{
+		WriteToServerName:  configMap.Data[key(KeyWriteToServerName)],
+		ReadFromServerName: configMap.Data[key(KeyReadFromServerName)],
+	}
+
+	if override.WriteToServerName == "" {
+		return nil, errors.Errorf("ConfigMap %s/%s has no %s", configMap.Namespace, configMap.Name, key(KeyWriteToServerName))
+	}
+
+	if value := configMap.Data[key(KeyPromoteAfter)]; value != "" {
+		promoteAfter, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "ConfigMap %s/%s has an invalid %s", configMap.Namespace, configMap.Name, key(KeyPromoteAfter))
+		}
+		override.PromoteAfter = promoteAfter
+	}
+
+	if value := configMap.Data[key(KeyHistory)]; value != "" {
+		if err := json.Unmarshal([]byte(value), &override.History); err != nil {
+			return nil, errors.Wrapf(err, "ConfigMap %s/%s has an invalid %s", configMap.Namespace, configMap.Name, key(KeyHistory))
+		}
+	}
+
+	return override, nil
+}
+
+// Replace returns the override of a new restore of the cluster, whose history ends with
+// the serverNames of o replaced at replacedAt. Restores writing the same serverNames
+// again add no entry.
+func (o *Override) Replace(next *Override, replacedAt time.Time) *Override {
+	replaced := *next
+	replaced.History = append([]HistoryEntry{}, o.History...)
+	if o.WriteToServerName != next.WriteToServerName || o.ReadFromServerName != next.ReadFromServerName {
+		replaced.History = append(replaced.History, HistoryEntry{
+			WriteToServerName:  o.WriteToServerName,
+			ReadFromServerName: o.ReadFromServerName,
+			ReplacedAt:         replacedAt.UTC().Format(time.RFC3339),
+		})
+	}
+	return &replaced
+}
+
+// Data returns the ConfigMap data of the override
+func (o *Override) Data() map[string]string {
+	data := map[string]string{
+		KeyWriteToServerName:  o.WriteToServerName,
+		KeyReadFromServerName: o.ReadFromServerName,
+	}
+	if o.PromoteAfter > 0 {
+		data[KeyPromoteAfter] = o.PromoteAfter.String()
+	}
+	return data
+}
+
+// ClusterData returns the ConfigMap data of the override written for the named cluster:
+// its prefixed keys, along with the unprefixed ones. The history is only written prefixed.
+func (o *Override) ClusterData(cluster string) map[string]string {
+	data := o.Data()
+	for key, value := range o.Data() {
+		data[ClusterKey(cluster, key)] = value
+	}
+	if len(o.History) > 0 {
+		// Encoding a slice of structs of strings cannot fail
+		history, _ := json.Marshal(o.History)
+		data[ClusterKey(cluster, KeyHistory)] = string(history)
+	}
+	return data
+}
+
+// Reader reads override ConfigMaps
+type Reader struct {
+	client kubernetes.Interface
+}
+
+// NewReader instantiates a Reader
+func NewReader(client kubernetes.Interface) *Reader {
+	return &Reader{client: client}
+}
+
+// Get returns the override of the namespace, or ErrNotFound when there is none
+func (r *Reader) Get(ctx context.Context, namespace string) (*Override, error) {
+	configMap, err := r.get(ctx, namespace)
+	if err != nil {
+		return nil, err
+	}
+	return FromConfigMap(configMap)
+}
+
+// GetCluster returns the override of the named cluster in the namespace, or ErrNotFound
+// when there is none
+func (r *Reader) GetCluster(ctx context.Context, namespace, cluster string) (*Override, error) {
+	configMap, err := r.get(ctx, namespace)
+	if err != nil {
+		return nil, err
+	}
+	return FromConfigMapForCluster(configMap, cluster)
+}
+
+// get returns the override ConfigMap of the namespace, or ErrNotFound when there is none
+func (r *Reader) get(ctx context.Context, namespace string) (*corev1.ConfigMap, error) {
+	configMap, err := r.client.CoreV1().ConfigMaps(namespace).Get(ctx, ConfigMapName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get ConfigMap %s/%s", namespace, ConfigMapName)
+	}
+	return configMap, nil
+}
+
+// Watch sends the override of the namespace every time it is written, and nil when it
+// is deleted, until ctx is done. ConfigMaps that cannot be parsed are not sent.
+func (r *Reader) Watch(ctx context.Context, namespace string) (<-chan *Override, error) {
+	watcher, err := r.watch(ctx, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	overrides := make(chan *Override)
+	go func() {
+		defer close(overrides)
+		for {
+			if !r.forward(ctx, watcher, overrides) {
+				return
+			}
+
+			// The API server closes watches periodically, so open a new one
+			if watcher, err = r.watch(ctx, namespace); err != nil {
+				return
+			}
+		}
+	}()
+
+	return overrides, nil
+}
+
+// watch opens a watch on the override ConfigMap of the namespace
+func (r *Reader) watch(ctx context.Context, namespace string) (watch.Interface, error) {
+	watcher, err := r.client.CoreV1().ConfigMaps(namespace).Watch(ctx, metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("metadata.name", ConfigMapName).String(),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to watch ConfigMap %s/%s", namespace, ConfigMapName)
+	}
+	return watcher, nil
+}
+
+// forward sends the overrides seen by the watcher. It returns false when ctx is done and
+// true when the watch was closed.
+func (r *Reader) forward(ctx context.Context, watcher watch.Interface, overrides chan<- *Override) bool {
+	defer watcher.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case event, ok := <-watcher.ResultChan():
+			if !ok {
+				return ctx.Err() == nil
+			}
+
+			var override *Override
+			switch event.Type {
+			case watch.Added, watch.Modified:
+				configMap, ok := event.Object.(*corev1.ConfigMap)
+				if !ok {
+					continue
+				}
+				parsed, err := FromConfigMap(configMap)
+				if err != nil {
+					continue
+				}
+				override = parsed
+			case watch.Deleted:
+			default:
+				continue
+			}
+
+			select {
+			case overrides <- override:
+			case <-ctx.Done():
+				return false
+			}
+		}
+	}
+}
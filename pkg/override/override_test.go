@@ -0,0 +1,200 @@
+package override
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newConfigMap(namespace string, data map[string]string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ConfigMapName,
+			Namespace: namespace,
+		},
+		Data: data,
+	}
+}
+
+func TestFromConfigMap(t *testing.T) {
+	override, err := FromConfigMap(newConfigMap("app", map[string]string{
+		KeyWriteToServerName:  "pg-20250114-143025",
+		KeyReadFromServerName: "pg",
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, &Override{WriteToServerName: "pg-20250114-143025", ReadFromServerName: "pg"}, override)
+	assert.Equal(t, map[string]string{
+		KeyWriteToServerName:  "pg-20250114-143025",
+		KeyReadFromServerName: "pg",
+	}, override.Data())
+
+	_, err = FromConfigMap(newConfigMap("app", map[string]string{KeyReadFromServerName: "pg"}))
+	assert.Error(t, err)
+}
+
+func TestFromConfigMapPromotion(t *testing.T) {
+	data := map[string]string{
+		KeyWriteToServerName:  "pg-20250114-143025",
+		KeyReadFromServerName: "pg",
+		KeyPromoteAfter:       "30m0s",
+	}
+	override, err := FromConfigMap(newConfigMap("app", data))
+	require.NoError(t, err)
+	assert.Equal(t, 30*time.Minute, override.PromoteAfter)
+	assert.Equal(t, data, override.Data())
+
+	data[KeyPromoteAfter] = "soon"
+	_, err = FromConfigMap(newConfigMap("app", data))
+	assert.Error(t, err)
+}
+
+func TestClusterData(t *testing.T) {
+	o := &Override{WriteToServerName: "pg-20250114-143025", ReadFromServerName: "pg", PromoteAfter: 30 * time.Minute}
+	assert.Equal(t, map[string]string{
+		KeyWriteToServerName:       "pg-20250114-143025",
+		KeyReadFromServerName:      "pg",
+		KeyPromoteAfter:            "30m0s",
+		"pg.write_to_server_name":  "pg-20250114-143025",
+		"pg.read_from_server_name": "pg",
+		"pg.promote_after":         "30m0s",
+	}, o.ClusterData("pg"))
+}
+
+func TestHistory(t *testing.T) {
+	replacedAt := time.Date(2025, 1, 15, 9, 0, 0, 0, time.UTC)
+	first := &Override{WriteToServerName: "pg-20250114-143025", ReadFromServerName: "pg"}
+	second := first.Replace(&Override{WriteToServerName: "pg-20250115-090000", ReadFromServerName: "pg-20250114-143025"}, replacedAt)
+	assert.Equal(t, []HistoryEntry{
+		{WriteToServerName: "pg-20250114-143025", ReadFromServerName: "pg", ReplacedAt: "2025-01-15T09:00:00Z"},
+	}, second.History)
+	assert.Empty(t, first.History)
+
+	// Restoring the same serverNames again adds no entry
+	assert.Equal(t, second.History, second.Replace(&Override{WriteToServerName: "pg-20250115-090000", ReadFromServerName: "pg-20250114-143025"}, replacedAt).History)
+
+	// The history is only written under the cluster's keys, and read back from them
+	data := second.ClusterData("pg")
+	assert.JSONEq(t, `[{"writeToServerName":"pg-20250114-143025","readFromServerName":"pg","replacedAt":"2025-01-15T09:00:00Z"}]`, data["pg.history"])
+	assert.NotContains(t, data, KeyHistory)
+
+	got, err := FromConfigMapForCluster(newConfigMap("app", data), "pg")
+	require.NoError(t, err)
+	assert.Equal(t, second, got)
+
+	got, err = FromConfigMap(newConfigMap("app", data))
+	require.NoError(t, err)
+	assert.Empty(t, got.History)
+
+	data["pg.history"] = "not json"
+	_, err = FromConfigMapForCluster(newConfigMap("app", data), "pg")
+	assert.ErrorContains(t, err, "invalid pg.history")
+}
+
+func TestFromConfigMapForCluster(t *testing.T) {
+	configMap := newConfigMap("app", map[string]string{
+		KeyWriteToServerName:                        "orders-20250114-143026",
+		KeyReadFromServerName:                       "orders",
+		ClusterKey("users", KeyWriteToServerName):   "users-20250114-143025",
+		ClusterKey("users", KeyReadFromServerName):  "users",
+		ClusterKey("orders", KeyWriteToServerName):  "orders-20250114-143026",
+		ClusterKey("orders", KeyReadFromServerName): "orders",
+		ClusterKey("orders", KeyPromoteAfter):       "1h0m0s",
+	})
+
+	users, err := FromConfigMapForCluster(configMap, "users")
+	require.NoError(t, err)
+	assert.Equal(t, &Override{WriteToServerName: "users-20250114-143025", ReadFromServerName: "users"}, users)
+
+	orders, err := FromConfigMapForCluster(configMap, "orders")
+	require.NoError(t, err)
+	assert.Equal(t, &Override{WriteToServerName: "orders-20250114-143026", ReadFromServerName: "orders", PromoteAfter: time.Hour}, orders)
+
+	// ConfigMaps written before clusters had their own keys fall back to the unprefixed ones
+	legacy, err := FromConfigMapForCluster(newConfigMap("app", map[string]string{
+		KeyWriteToServerName:  "pg-20250114-143025",
+		KeyReadFromServerName: "pg",
+	}), "pg")
+	require.NoError(t, err)
+	assert.Equal(t, "pg-20250114-143025", legacy.WriteToServerName)
+
+	configMap.Data[ClusterKey("users", KeyPromoteAfter)] = "soon"
+	_, err = FromConfigMapForCluster(configMap, "users")
+	assert.ErrorContains(t, err, "invalid users.promote_after")
+}
+
+func TestReaderGetCluster(t *testing.T) {
+	o := &Override{WriteToServerName: "users-20250114-143025", ReadFromServerName: "users"}
+	reader := NewReader(fake.NewSimpleClientset(newConfigMap("app", o.ClusterData("users"))))
+
+	got, err := reader.GetCluster(context.Background(), "app", "users")
+	require.NoError(t, err)
+	assert.Equal(t, o, got)
+
+	_, err = reader.GetCluster(context.Background(), "other", "users")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestReaderGet(t *testing.T) {
+	client := fake.NewSimpleClientset(newConfigMap("app", map[string]string{
+		KeyWriteToServerName:  "pg-20250114-143025",
+		KeyReadFromServerName: "pg",
+	}))
+	reader := NewReader(client)
+
+	override, err := reader.Get(context.Background(), "app")
+	require.NoError(t, err)
+	assert.Equal(t, "pg-20250114-143025", override.WriteToServerName)
+	assert.Equal(t, "pg", override.ReadFromServerName)
+
+	_, err = reader.Get(context.Background(), "other")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestReaderWatch(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	reader := NewReader(client)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	overrides, err := reader.Watch(ctx, "app")
+	require.NoError(t, err)
+
+	receive := func() *Override {
+		select {
+		case override := <-overrides:
+			return override
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for override")
+			return nil
+		}
+	}
+
+	configMaps := client.CoreV1().ConfigMaps("app")
+	_, err = configMaps.Create(ctx, newConfigMap("app", map[string]string{
+		KeyWriteToServerName:  "pg-1",
+		KeyReadFromServerName: "pg",
+	}), metav1.CreateOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, &Override{WriteToServerName: "pg-1", ReadFromServerName: "pg"}, receive())
+
+	_, err = configMaps.Update(ctx, newConfigMap("app", map[string]string{
+		KeyWriteToServerName:  "pg-2",
+		KeyReadFromServerName: "pg-1",
+	}), metav1.UpdateOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, &Override{WriteToServerName: "pg-2", ReadFromServerName: "pg-1"}, receive())
+
+	require.NoError(t, configMaps.Delete(ctx, ConfigMapName, metav1.DeleteOptions{}))
+	assert.Nil(t, receive())
+
+	cancel()
+	for range overrides {
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/nvanthao/velero-plugin-cnpg-restore/internal/plugin"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+)
+
+// runSimulateRestore implements the simulate-restore subcommand, which runs the restore
+// actions over the CNPG items of a downloaded Velero backup archive and writes the items
+// as backed up and as they would be restored to a directory, for diffing offline. It
+// returns 0 when every item would be restored or skipped, 1 when the restore of some
+// would fail and 2 on error.
+func runSimulateRestore(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("simulate-restore", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	outputDir := flags.String("output-dir", "", "directory to write the manifests and report to")
+	configFile := flags.String("config", "", "plugin ConfigMap manifest to restore with, the defaults when unset")
+	restoreName := flags.String("restore-name", "simulate-restore", "name of the simulated Velero restore")
+	verbose := flags.Bool("verbose", false, "log what the restore actions do to stderr")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(stderr, "simulate-restore requires the path of a backup archive, as written by velero backup download")
+		return 2
+	}
+	if *outputDir == "" {
+		fmt.Fprintln(stderr, "simulate-restore requires --output-dir")
+		return 2
+	}
+
+	config := plugin.DefaultPluginConfig()
+	if *configFile != "" {
+		var err error
+		if config, err = loadConfigFile(*configFile); err != nil {
+			fmt.Fprintf(stderr, "Failed to load plugin config: %v\n", err)
+			return 2
+		}
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to open backup archive: %v\n", err)
+		return 2
+	}
+	defer file.Close()
+
+	items, err := plugin.ReadArchiveCNPGItems(file)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to read backup archive: %v\n", err)
+		return 2
+	}
+
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	if *verbose {
+		log.SetOutput(stderr)
+	}
+
+	simulation, err := plugin.SimulateRestore(items, config, *restoreName, log)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to simulate restore: %v\n", err)
+		return 2
+	}
+
+	if err := writeSimulation(*outputDir, items, simulation); err != nil {
+		fmt.Fprintf(stderr, "Failed to write simulation: %v\n", err)
+		return 2
+	}
+	printSimulation(stdout, *outputDir, simulation)
+
+	for _, item := range simulation.Items {
+		if item.Error != "" {
+			return 1
+		}
+	}
+	return 0
+}
+
+// loadConfigFile reads the plugin configuration from a ConfigMap manifest
+func loadConfigFile(path string) (*plugin.PluginConfig, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	configMap := &corev1.ConfigMap{}
+	if err := yaml.Unmarshal(raw, configMap); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+	return plugin.PluginConfigFromConfigMap(configMap)
+}
+
+// writeSimulation writes the backed-up items below original/, the restored and created
+// items below restored/, both as <namespace>/<kind>-<name>.yaml, and the per-item outcome
+// to report.yaml
+func writeSimulation(dir string, items []*unstructured.Unstructured, simulation *plugin.RestoreSimulation) error {
+	for _, item := range items {
+		if err := writeManifest(filepath.Join(dir, "original"), item); err != nil {
+			return err
+		}
+	}
+	for _, item := range append(append([]*unstructured.Unstructured{}, simulation.Restored...), simulation.Created...) {
+		if err := writeManifest(filepath.Join(dir, "restored"), item); err != nil {
+			return err
+		}
+	}
+
+	report, err := yaml.Marshal(simulation)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "report.yaml"), report, 0o644)
+}
+
+// writeManifest writes an item as YAML to <dir>/<namespace>/<kind>-<name>.yaml
+func writeManifest(dir string, item *unstructured.Unstructured) error {
+	raw, err := yaml.Marshal(item.Object)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s %s/%s: %w", item.GetKind(), item.GetNamespace(), item.GetName(), err)
+	}
+
+	dir = filepath.Join(dir, item.GetNamespace())
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, strings.ToLower(item.GetKind())+"-"+item.GetName()+".yaml"), raw, 0o644)
+}
+
+// printSimulation prints the outcome of each item for humans
+func printSimulation(w io.Writer, dir string, simulation *plugin.RestoreSimulation) {
+	if len(simulation.Items) == 0 {
+		fmt.Fprintln(w, "No CNPG items found in the backup")
+		return
+	}
+
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "NAMESPACE\tKIND\tNAME\tRESULT\tWARNINGS")
+	for _, item := range simulation.Items {
+		result := "restored"
+		if item.Error != "" {
+			result = "failed"
+		} else if item.Skipped {
+			result = "skipped"
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%d\n", item.Namespace, item.Kind, item.Name, result, len(item.Warnings))
+	}
+	table.Flush()
+
+	for _, item := range simulation.Items {
+		notes := item.Warnings
+		if item.Error != "" {
+			notes = append([]string{item.Error}, notes...)
+		}
+		if len(notes) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\n%s %s/%s:\n  - %s\n", item.Kind, item.Namespace, item.Name, strings.Join(notes, "\n  - "))
+	}
+
+	fmt.Fprintf(w, "\nWrote the manifests to %s, compare them with diff -r %s %s\n", dir, filepath.Join(dir, "original"), filepath.Join(dir, "restored"))
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/nvanthao/velero-plugin-cnpg-restore/internal/plugin"
+)
+
+// runVerify implements the verify subcommand, which checks that a restored cluster
+// replayed WAL up to the end of the backup it was recovered from. It returns 0 when
+// it did, 1 when it did not and 2 when it could not tell.
+func runVerify(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	namespace := flags.String("namespace", "", "namespace of the restored cluster")
+	cluster := flags.String("cluster", "", "name of the restored cluster")
+	output := flags.String("output", "text", "output format, text or json")
+	timeout := flags.Duration("timeout", time.Minute, "timeout of the API calls")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *namespace == "" || *cluster == "" {
+		fmt.Fprintln(stderr, "verify requires --namespace and --cluster")
+		return 2
+	}
+	if *output != "text" && *output != "json" {
+		fmt.Fprintf(stderr, "unknown output format %q\n", *output)
+		return 2
+	}
+
+	client, err := plugin.GetClient()
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to create Kubernetes client: %v\n", err)
+		return 2
+	}
+	dynamicClient, err := plugin.GetDynamicClient()
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to create dynamic client: %v\n", err)
+		return 2
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	result, err := plugin.VerifyRestoredCluster(ctx, dynamicClient, plugin.PodProxyInstanceStatus(client), *namespace, *cluster)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to verify cluster %s/%s: %v\n", *namespace, *cluster, err)
+		return 2
+	}
+
+	if *output == "json" {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(result); err != nil {
+			fmt.Fprintf(stderr, "Failed to encode result: %v\n", err)
+			return 2
+		}
+	} else {
+		printVerifyResult(stdout, result)
+	}
+
+	if !result.Reached {
+		return 1
+	}
+	return 0
+}
+
+// printVerifyResult prints a verification result for humans
+func printVerifyResult(w io.Writer, result *plugin.VerifyResult) {
+	fmt.Fprintf(w, "Cluster:    %s/%s\n", result.Namespace, result.Cluster)
+	fmt.Fprintf(w, "Phase:      %s\n", result.Phase)
+	fmt.Fprintf(w, "Backup ID:  %s\n", result.BackupID)
+	if result.Schedule != "" {
+		fmt.Fprintf(w, "Schedule:   %s\n", result.Schedule)
+	}
+	if result.BackupTTL != "" {
+		fmt.Fprintf(w, "Backup TTL: %s\n", result.BackupTTL)
+	}
+	fmt.Fprintf(w, "Expected:   LSN %s, timeline %d\n", result.ExpectedLSN, result.ExpectedTimeline)
+	fmt.Fprintf(w, "Replayed:   LSN %s, timeline %d, in recovery: %t\n", result.ReplayedLSN, result.Timeline, result.InRecovery)
+	if result.Reached {
+		fmt.Fprintln(w, "Result:     reached the end of the backup")
+		return
+	}
+	fmt.Fprintln(w, "Result:     not reached")
+	for _, problem := range result.Problems {
+		fmt.Fprintf(w, "  - %s\n", problem)
+	}
+}